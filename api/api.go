@@ -11,7 +11,10 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	htmltemplate "html/template"
 	"net/url"
+	"regexp"
+	"text/template"
 
 	"maunium.net/go/mautrix/id"
 )
@@ -82,8 +85,69 @@ type ClientConfig struct {
 	// When a user starts a new SAS verification with us, their user ID has to match one of these regexes
 	// for the verification process to start.
 	AcceptVerificationFromUsers []string
+	// Optional. A room ID to redirect ALL output from this client into. Messages are annotated with
+	// the room they would have been sent to, and state changes, redactions, invites, kicks, bans
+	// and new rooms are described in notices instead of being made. This is useful for trying out
+	// new service configs and templates in a staging room before they go live. Leave empty to use
+	// the CANARY_ROOM_ID environment variable, or to send to the intended rooms as normal if that
+	// isn't set either.
+	CanaryRoomID id.RoomID
 }
 
+// A FaultConfig controls the simulated failures injected into requests made by Go-NEB's Matrix clients.
+// It forms the HTTP body to /configureFaults requests. Each rate is the probability (between 0 and 1)
+// that a given request will fail in that way. All rates being 0 disables fault injection. Only
+// requests to the homeserver fail, not e.g. fetches of images which are being uploaded.
+type FaultConfig struct {
+	// Optional. Only inject faults into requests made by this client. If empty, all clients are affected.
+	UserID id.UserID
+	// The probability of a request failing with HTTP 429 M_LIMIT_EXCEEDED.
+	RateLimitRate float64
+	// The number of milliseconds injected HTTP 429 responses ask the client to wait before retrying.
+	RetryAfterMs int
+	// The probability of a request failing with a timeout error before reaching the homeserver.
+	TimeoutRate float64
+	// The probability of a request failing with an HTTP 5xx response.
+	ServerErrorRate float64
+}
+
+// A Template overrides the message which services send for a named notification.
+// It is the body of a request to /configureTemplate.
+type Template struct {
+	// The name of the notification to override, e.g. "github.issues.closed". Templates apply to
+	// every notification whose name starts with this one, so "github" overrides all GitHub
+	// notifications unless a more specific template exists.
+	Name string
+	// The Go text/template used for the plain text body of the message. If both this and HTML are
+	// empty, the override is removed.
+	Text string
+	// Optional. The Go html/template used for the HTML body of the message.
+	HTML string
+}
+
+// A CannedResponse is a custom command, such as "!faq", which an echo service responds to with a
+// fixed message in one room. It is the body of a request to /configureCannedResponse.
+type CannedResponse struct {
+	// The ID of the echo service which responds to the command.
+	ServiceID string
+	// The room which the command can be used in.
+	RoomID id.RoomID
+	// The name of the command without the "!", e.g. "faq". Must be lower case letters, digits,
+	// "-" or "_".
+	Name string
+	// The Go text/template used for the plain text body of the response. If both this and ImageURL
+	// are empty, the response is removed.
+	Text string
+	// Optional. The Go html/template used for the HTML body of the response.
+	HTML string
+	// Optional. The mxc:// or http(s):// URL of an image to respond with.
+	ImageURL string
+	// The user who last set the response, if it was set in chat.
+	SetByUserID id.UserID
+}
+
+var cannedResponseNameRegex = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
 // A IncomingDecimalSAS contains the decimal SAS as displayed on another device. The SAS consists of three numbers.
 type IncomingDecimalSAS struct {
 	// The matrix User ID of the user that Neb uses in the verification process. E.g. @neb:localhost
@@ -107,10 +171,11 @@ type Session struct {
 
 // ConfigFile represents config.sample.yaml
 type ConfigFile struct {
-	Clients  []ClientConfig
-	Realms   []ConfigureAuthRealmRequest
-	Services []ConfigureServiceRequest
-	Sessions []Session
+	Clients   []ClientConfig
+	Realms    []ConfigureAuthRealmRequest
+	Services  []ConfigureServiceRequest
+	Sessions  []Session
+	Templates []Template
 }
 
 // Check validates the /configureService request
@@ -148,6 +213,69 @@ func (c *ClientConfig) Check() error {
 	return nil
 }
 
+// Check that the fault rates are valid probabilities.
+func (c *FaultConfig) Check() error {
+	for _, rate := range []float64{c.RateLimitRate, c.TimeoutRate, c.ServerErrorRate} {
+		if rate < 0 || rate > 1 {
+			return errors.New(`"RateLimitRate", "TimeoutRate" and "ServerErrorRate" must be between 0 and 1`)
+		}
+	}
+	if c.RateLimitRate+c.TimeoutRate+c.ServerErrorRate > 1 {
+		return errors.New(`The sum of all fault rates must not exceed 1`)
+	}
+	if c.RetryAfterMs < 0 {
+		return errors.New(`"RetryAfterMs" must not be negative`)
+	}
+	return nil
+}
+
+// Check that the template has a name and that both of its templates parse.
+func (t *Template) Check() error {
+	if t.Name == "" {
+		return errors.New(`Must supply a "Name"`)
+	}
+	if t.Text == "" && t.HTML != "" {
+		return errors.New(`Must supply a "Text" template when supplying an "HTML" template`)
+	}
+	if _, err := template.New(t.Name).Parse(t.Text); err != nil {
+		return err
+	}
+	if _, err := htmltemplate.New(t.Name).Parse(t.HTML); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Check that the response has a valid name, room and service, that both of its templates parse
+// and that its image URL is one which can be sent into Matrix.
+func (c *CannedResponse) Check() error {
+	if c.ServiceID == "" || c.RoomID == "" {
+		return errors.New(`Must supply a "ServiceID" and a "RoomID"`)
+	}
+	if !cannedResponseNameRegex.MatchString(c.Name) {
+		return errors.New(`"Name" must be lower case letters, digits, "-" or "_"`)
+	}
+	if c.Text == "" && c.HTML != "" {
+		return errors.New(`Must supply a "Text" template when supplying an "HTML" template`)
+	}
+	if _, err := template.New(c.Name).Parse(c.Text); err != nil {
+		return err
+	}
+	if _, err := htmltemplate.New(c.Name).Parse(c.HTML); err != nil {
+		return err
+	}
+	if c.ImageURL != "" {
+		u, err := url.Parse(c.ImageURL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "mxc" && u.Scheme != "http" && u.Scheme != "https" {
+			return errors.New(`"ImageURL" must be an mxc://, http:// or https:// URL`)
+		}
+	}
+	return nil
+}
+
 // Check that the received SAS data contains the correct fields.
 func (c *IncomingDecimalSAS) Check() error {
 	if c.UserID == "" || c.OtherUserID == "" || c.OtherDeviceID == "" {
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/util"
+)
+
+// ConfigureCannedResponse represents an HTTP handler which can process /admin/configureCannedResponse requests.
+type ConfigureCannedResponse struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/configureCannedResponse. The JSON object
+// provided is of type "api.CannedResponse".
+//
+// The response is sent by the given echo service whenever someone uses the command in the room.
+// Supplying an empty "Text" and "ImageURL" removes the response. The templates are executed with
+// the data described in package "echo".
+//
+// Request:
+//  POST /admin/configureCannedResponse
+//  {
+//      "ServiceID": "echo_service",
+//      "RoomID": "!qmElAGdFYCHoCJuaNt:localhost",
+//      "Name": "wifi",
+//      "Text": "{{.Sender}}: the wifi password is hunter2",
+//      "ImageURL": "mxc://localhost/wifi-qr-code"
+//  }
+//
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "OldResponse": {
+//          // The old api.CannedResponse
+//      },
+//      "NewResponse": {
+//          // The new api.CannedResponse
+//      }
+//  }
+func (h *ConfigureCannedResponse) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+
+	var body api.CannedResponse
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	if err := body.Check(); err != nil {
+		return util.MessageResponse(400, "Error parsing canned response: "+err.Error())
+	}
+
+	if _, err := h.Db.LoadService(body.ServiceID); err == sql.ErrNoRows {
+		return util.MessageResponse(400, "Unknown service ID")
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadService")
+		return util.MessageResponse(500, "Error loading service")
+	}
+
+	var oldResponse api.CannedResponse
+	var err error
+	if body.Text == "" && body.ImageURL == "" {
+		err = h.Db.DeleteCannedResponse(body.ServiceID, body.RoomID, body.Name)
+	} else {
+		oldResponse, err = h.Db.StoreCannedResponse(body)
+	}
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("name", body.Name).Error("Failed to store canned response")
+		return util.MessageResponse(500, "Error storing canned response")
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			OldResponse api.CannedResponse
+			NewResponse api.CannedResponse
+		}{oldResponse, body},
+	}
+}
@@ -69,6 +69,63 @@ func (s *ConfigureClient) OnIncomingRequest(req *http.Request) util.JSONResponse
 	}
 }
 
+// ConfigureFaults represents an HTTP handler capable of processing /admin/configureFaults requests.
+type ConfigureFaults struct {
+	Clients *clients.Clients
+}
+
+// OnIncomingRequest handles POST requests to /admin/configureFaults. The JSON object provided
+// is of type "api.FaultConfig".
+//
+// This makes a proportion of the requests Go-NEB's Matrix clients send fail with a 429, a timeout
+// or a 5xx error, which is useful for exercising retry and backoff behaviour in staging and
+// integration tests. Setting all rates to 0 turns fault injection off again.
+//
+// Request:
+//  POST /admin/configureFaults
+//  {
+//      "UserID": "@my_bot:localhost",
+//      "RateLimitRate": 0.1,
+//      "RetryAfterMs": 2000,
+//      "TimeoutRate": 0.05,
+//      "ServerErrorRate": 0.05
+//  }
+//
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//       "OldFaults": {
+//         // The old api.FaultConfig
+//       },
+//       "NewFaults": {
+//         // The new api.FaultConfig
+//       }
+//  }
+func (s *ConfigureFaults) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+
+	var body api.FaultConfig
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	if err := body.Check(); err != nil {
+		return util.MessageResponse(400, err.Error())
+	}
+
+	oldFaults := s.Clients.ConfigureFaults(body)
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			OldFaults api.FaultConfig
+			NewFaults api.FaultConfig
+		}{oldFaults, body},
+	}
+}
+
 // VerifySAS represents an HTTP handler capable of processing /verifySAS requests.
 type VerifySAS struct {
 	Clients *clients.Clients
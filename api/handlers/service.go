@@ -102,7 +102,7 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 		return util.MessageResponse(500, "Error loading old service")
 	}
 
-	client, err := s.clients.Client(service.ServiceUserID())
+	client, err := s.clients.ServiceClient(service)
 	if err != nil {
 		return util.MessageResponse(400, "Unknown matrix client")
 	}
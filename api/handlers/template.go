@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/util"
+)
+
+// ConfigureTemplate represents an HTTP handler which can process /admin/configureTemplate requests.
+type ConfigureTemplate struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/configureTemplate. The JSON object provided
+// is of type "api.Template".
+//
+// The template overrides the message which services send for the named notification. Supplying
+// an empty "Text" and "HTML" removes the override, restoring the service's default message.
+// See package "templates" for how names are matched.
+//
+// Request:
+//  POST /admin/configureTemplate
+//  {
+//      "Name": "github.issues.closed",
+//      "Text": "Issue closed: {{.issue.title}} {{.issue.html_url}}",
+//      "HTML": "Issue closed: <a href=\"{{.issue.html_url}}\">{{.issue.title}}</a>"
+//  }
+//
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "OldTemplate": {
+//          // The old api.Template
+//      },
+//      "NewTemplate": {
+//          // The new api.Template
+//      }
+//  }
+func (h *ConfigureTemplate) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+
+	var body api.Template
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	if err := body.Check(); err != nil {
+		return util.MessageResponse(400, "Error parsing template: "+err.Error())
+	}
+
+	oldTemplate, err := h.Db.LoadTemplate(body.Name)
+	if err != nil && err != sql.ErrNoRows {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadTemplate")
+		return util.MessageResponse(500, "Error loading old template")
+	}
+
+	if body.Text == "" {
+		err = h.Db.DeleteTemplate(body.Name)
+	} else {
+		_, err = h.Db.StoreTemplate(body)
+	}
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("name", body.Name).Error("Failed to store template")
+		return util.MessageResponse(500, "Error storing template")
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			OldTemplate api.Template
+			NewTemplate api.Template
+		}{oldTemplate, body},
+	}
+}
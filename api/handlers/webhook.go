@@ -50,7 +50,7 @@ func (wh *Webhook) Handle(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(404)
 		return
 	}
-	cli, err := wh.clients.Client(service.ServiceUserID())
+	cli, err := wh.clients.ServiceClient(service)
 	if err != nil {
 		log.WithError(err).WithField("user_id", service.ServiceUserID()).Print(
 			"Failed to retrieve matrix client instance")
@@ -10,6 +10,7 @@ import (
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"maunium.net/go/mautrix"
@@ -33,6 +34,9 @@ type BotClient struct {
 	stateStore               *NebStateStore
 	verificationSAS          *sync.Map
 	ongoingVerificationCount int32
+	recentMessages           *recentMessages
+	// The room which everything the client sends is redirected into, if any
+	canaryRoomID id.RoomID
 }
 
 // InitOlmMachine initializes a BotClient's internal OlmMachine given a client object and a Neb store,
@@ -124,12 +128,28 @@ func (botClient *BotClient) DecryptMegolmEvent(evt *mevt.Event) (*mevt.Event, er
 	return botClient.olmMachine.DecryptMegolmEvent(evt)
 }
 
+// RecentMessages returns the latest messages in the room which the BotClient has seen, oldest
+// first. It implements types.RecentMessageLister.
+func (botClient *BotClient) RecentMessages(roomID id.RoomID) []types.RecentMessage {
+	return botClient.recentMessages.list(roomID)
+}
+
 // SendMessageEvent sends the given content to the given room ID using this BotClient as a message event.
 // If the target room has enabled encryption, a megolm session is created if one doesn't already exist
-// and the message is sent after being encrypted.
+// and the message is sent after being encrypted. If the client has a canary room, the message is
+// annotated with the target room and sent to the canary room instead.
 func (botClient *BotClient) SendMessageEvent(roomID id.RoomID, evtType mevt.Type, content interface{},
 	extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
 
+	if canaryRoomID := botClient.canaryRoomID; botClient.redirects(roomID) {
+		log.WithFields(log.Fields{
+			"room_id":        roomID,
+			"canary_room_id": canaryRoomID,
+		}).Info("Redirecting message to canary room")
+		content = canaryContent(roomID, content)
+		roomID = canaryRoomID
+	}
+
 	olmMachine := botClient.olmMachine
 	if olmMachine.StateStore.IsEncrypted(roomID) {
 		// Check if there is already a megolm session
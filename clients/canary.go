@@ -0,0 +1,192 @@
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// canaryRoomKey is the key added to redirected message content which holds the room ID the
+// message was originally destined for.
+const canaryRoomKey = "org.matrix.neb.canary.room_id"
+
+// canaryContent annotates the content of a message event which was meant for targetRoomID so
+// that it can be sent to the canary room instead. If the content cannot be annotated, it is
+// returned unmodified.
+func canaryContent(targetRoomID id.RoomID, content interface{}) interface{} {
+	b, err := json.Marshal(content)
+	if err != nil {
+		log.WithError(err).WithField("room_id", targetRoomID).Warn("Failed to annotate canary message")
+		return content
+	}
+	var annotated map[string]interface{}
+	if err := json.Unmarshal(b, &annotated); err != nil || annotated == nil {
+		return content
+	}
+	if body, ok := annotated["body"].(string); ok {
+		annotated["body"] = fmt.Sprintf("[canary: %s] %s", targetRoomID, body)
+	}
+	if formatted, ok := annotated["formatted_body"].(string); ok {
+		annotated["formatted_body"] = fmt.Sprintf(
+			"<b>[canary: %s]</b> %s", html.EscapeString(targetRoomID.String()), formatted,
+		)
+	}
+	annotated[canaryRoomKey] = targetRoomID
+	return annotated
+}
+
+// canaryServerName is the server name of the made-up rooms which clients with a canary room
+// pretend to create. It is reserved, so the rooms can't exist.
+const canaryServerName = "canary.invalid"
+
+// canaryStateChange describes a state event.
+func canaryStateChange(eventType mevt.Type, stateKey string, content interface{}) string {
+	b, err := json.Marshal(content)
+	if err != nil {
+		b = []byte(fmt.Sprintf("%v", content))
+	}
+	return fmt.Sprintf("Set %s state %q to %s", eventType.Type, stateKey, b)
+}
+
+// withReason adds the reason for a change to its description, if there is one.
+func withReason(change, reason string) string {
+	if reason == "" {
+		return change
+	}
+	return fmt.Sprintf("%s because %q", change, reason)
+}
+
+// forService returns the client to use for the service. If the service has its own canary room,
+// it is a copy of the client which redirects everything to that room instead.
+func (botClient *BotClient) forService(service types.Service) *BotClient {
+	canaryRoomID := service.ServiceCanaryRoomID()
+	if canaryRoomID == "" || canaryRoomID == botClient.canaryRoomID {
+		return botClient
+	}
+	serviceClient := *botClient
+	serviceClient.canaryRoomID = canaryRoomID
+	return &serviceClient
+}
+
+// redirects returns whether changes to the room are redirected to the client's canary room.
+func (botClient *BotClient) redirects(roomID id.RoomID) bool {
+	return botClient.canaryRoomID != "" && roomID != botClient.canaryRoomID
+}
+
+// sendCanaryNotice tells the canary room about a change which would have been made to
+// targetRoomID.
+func (botClient *BotClient) sendCanaryNotice(targetRoomID id.RoomID, change string) (*mautrix.RespSendEvent, error) {
+	canaryRoomID := botClient.canaryRoomID
+	log.WithFields(log.Fields{
+		"room_id":        targetRoomID,
+		"canary_room_id": canaryRoomID,
+	}).Info("Redirecting change to canary room")
+	return botClient.SendMessageEvent(canaryRoomID, mevt.EventMessage, map[string]interface{}{
+		"msgtype":     mevt.MsgNotice,
+		"body":        fmt.Sprintf("[canary: %s] %s", targetRoomID, change),
+		canaryRoomKey: targetRoomID,
+	})
+}
+
+// SendStateEvent sends a state event to the room, or describes it in the canary room if the
+// client has one.
+func (botClient *BotClient) SendStateEvent(roomID id.RoomID, eventType mevt.Type, stateKey string,
+	contentJSON interface{}) (*mautrix.RespSendEvent, error) {
+
+	if botClient.redirects(roomID) {
+		return botClient.sendCanaryNotice(roomID, canaryStateChange(eventType, stateKey, contentJSON))
+	}
+	return botClient.Client.SendStateEvent(roomID, eventType, stateKey, contentJSON)
+}
+
+// SendMassagedStateEvent sends a state event with a timestamp to the room, or describes it in the
+// canary room if the client has one.
+func (botClient *BotClient) SendMassagedStateEvent(roomID id.RoomID, eventType mevt.Type, stateKey string,
+	contentJSON interface{}, ts int64) (*mautrix.RespSendEvent, error) {
+
+	if botClient.redirects(roomID) {
+		return botClient.sendCanaryNotice(roomID, canaryStateChange(eventType, stateKey, contentJSON))
+	}
+	return botClient.Client.SendMassagedStateEvent(roomID, eventType, stateKey, contentJSON, ts)
+}
+
+// RedactEvent redacts the event, or describes the redaction in the canary room if the client has
+// one.
+func (botClient *BotClient) RedactEvent(roomID id.RoomID, eventID id.EventID,
+	extra ...mautrix.ReqRedact) (*mautrix.RespSendEvent, error) {
+
+	if botClient.redirects(roomID) {
+		change := fmt.Sprintf("Redact %s", eventID)
+		if len(extra) > 0 {
+			change = withReason(change, extra[0].Reason)
+		}
+		return botClient.sendCanaryNotice(roomID, change)
+	}
+	return botClient.Client.RedactEvent(roomID, eventID, extra...)
+}
+
+// InviteUser invites the user to the room, or describes the invite in the canary room if the
+// client has one.
+func (botClient *BotClient) InviteUser(roomID id.RoomID, req *mautrix.ReqInviteUser) (*mautrix.RespInviteUser, error) {
+	if botClient.redirects(roomID) {
+		_, err := botClient.sendCanaryNotice(roomID, fmt.Sprintf("Invite %s", req.UserID))
+		return &mautrix.RespInviteUser{}, err
+	}
+	return botClient.Client.InviteUser(roomID, req)
+}
+
+// KickUser kicks the user from the room, or describes the kick in the canary room if the client
+// has one.
+func (botClient *BotClient) KickUser(roomID id.RoomID, req *mautrix.ReqKickUser) (*mautrix.RespKickUser, error) {
+	if botClient.redirects(roomID) {
+		_, err := botClient.sendCanaryNotice(roomID, withReason(fmt.Sprintf("Kick %s", req.UserID), req.Reason))
+		return &mautrix.RespKickUser{}, err
+	}
+	return botClient.Client.KickUser(roomID, req)
+}
+
+// BanUser bans the user from the room, or describes the ban in the canary room if the client has
+// one.
+func (botClient *BotClient) BanUser(roomID id.RoomID, req *mautrix.ReqBanUser) (*mautrix.RespBanUser, error) {
+	if botClient.redirects(roomID) {
+		_, err := botClient.sendCanaryNotice(roomID, withReason(fmt.Sprintf("Ban %s", req.UserID), req.Reason))
+		return &mautrix.RespBanUser{}, err
+	}
+	return botClient.Client.BanUser(roomID, req)
+}
+
+// UnbanUser unbans the user from the room, or describes the unban in the canary room if the
+// client has one.
+func (botClient *BotClient) UnbanUser(roomID id.RoomID, req *mautrix.ReqUnbanUser) (*mautrix.RespUnbanUser, error) {
+	if botClient.redirects(roomID) {
+		_, err := botClient.sendCanaryNotice(roomID, fmt.Sprintf("Unban %s", req.UserID))
+		return &mautrix.RespUnbanUser{}, err
+	}
+	return botClient.Client.UnbanUser(roomID, req)
+}
+
+// CreateRoom creates a room. If the client has a canary room, the room isn't created: the request
+// is described in the canary room and a made-up room ID is returned instead. Everything sent to
+// the made-up room is redirected to the canary room like any other, so invites and state for the
+// new room are described there too.
+func (botClient *BotClient) CreateRoom(req *mautrix.ReqCreateRoom) (*mautrix.RespCreateRoom, error) {
+	if botClient.canaryRoomID == "" {
+		return botClient.Client.CreateRoom(req)
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	roomID := id.RoomID(fmt.Sprintf("!canary-%d:%s", time.Now().UnixNano(), canaryServerName))
+	if _, err := botClient.sendCanaryNotice(roomID, fmt.Sprintf("Create room %s", b)); err != nil {
+		return nil, err
+	}
+	return &mautrix.RespCreateRoom{RoomID: roomID}, nil
+}
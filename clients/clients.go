@@ -27,6 +27,9 @@ type Clients struct {
 	dbMutex    sync.Mutex
 	mapMutex   sync.Mutex
 	clients    map[id.UserID]BotClient
+	faults     *faultInjector
+	// The room which clients without their own CanaryRoomID redirect everything they send into
+	canaryRoomID id.RoomID
 }
 
 // New makes a new collection of matrix clients
@@ -35,6 +38,7 @@ func New(db database.Storer, cli *http.Client) *Clients {
 		db:         db,
 		httpClient: cli,
 		clients:    make(map[id.UserID]BotClient), // user_id => BotClient
+		faults:     newFaultInjector(),
 	}
 	return clients
 }
@@ -49,12 +53,37 @@ func (c *Clients) Client(userID id.UserID) (*BotClient, error) {
 	return &entry, err
 }
 
+// ServiceClient gets a client for the service to send with. If the service has its own canary room,
+// the client redirects everything it sends there instead.
+func (c *Clients) ServiceClient(service types.Service) (*BotClient, error) {
+	botClient, err := c.Client(service.ServiceUserID())
+	if err != nil {
+		return nil, err
+	}
+	return botClient.forService(service), nil
+}
+
 // Update updates the config for a matrix client
 func (c *Clients) Update(config api.ClientConfig) (api.ClientConfig, error) {
 	_, old, err := c.updateClientInDB(config)
 	return old.config, err
 }
 
+// ConfigureFaults sets the simulated failures to inject into requests made by the matrix clients.
+// Returns the previous fault config.
+func (c *Clients) ConfigureFaults(config api.FaultConfig) api.FaultConfig {
+	log.WithField("faults", config).Info("Configuring fault injection")
+	return c.faults.setConfig(config)
+}
+
+// SetCanaryRoom makes every client which doesn't have its own CanaryRoomID redirect everything it
+// sends into the room, so that new configs can be tried out without changing any other rooms.
+// Must be called before Start.
+func (c *Clients) SetCanaryRoom(roomID id.RoomID) {
+	log.WithField("canary_room_id", roomID).Info("Redirecting all clients to canary room")
+	c.canaryRoomID = roomID
+}
+
 // Start listening on client /sync streams
 func (c *Clients) Start() error {
 	configs, err := c.db.LoadMatrixClientConfigs()
@@ -160,6 +189,14 @@ func (c *Clients) onMessageEvent(botClient *BotClient, event *mevt.Event) {
 		}).Warn("Error loading services")
 	}
 
+	c.notifyObservers(botClient, services, event)
+
+	// Remember the message once it has been handled, so that services looking back at recent
+	// messages don't see the one they are handling.
+	if event.Sender != botClient.UserID {
+		defer botClient.recentMessages.add(event)
+	}
+
 	message := event.Content.AsMessage()
 	body := message.Body
 
@@ -172,41 +209,91 @@ func (c *Clients) onMessageEvent(botClient *BotClient, event *mevt.Event) {
 		return
 	}
 
-	// replace all smart quotes with their normal counterparts so shellwords can parse it
-	body = strings.Replace(body, `‘`, `'`, -1)
-	body = strings.Replace(body, `’`, `'`, -1)
-	body = strings.Replace(body, `“`, `"`, -1)
-	body = strings.Replace(body, `”`, `"`, -1)
+	body = replaceSmartQuotes(body)
 
-	var responses []interface{}
+	// Each response is sent by the client of the service which made it, so that it goes to the
+	// service's canary room if it has one.
+	type response struct {
+		cli     *BotClient
+		content interface{}
+	}
+	var responses []response
 
 	for _, service := range services {
+		serviceClient := botClient.forService(service)
 		if body[0] == '!' { // message is a command
-			args, err := shellwords.Parse(body[1:])
-			if err != nil {
-				args = strings.Split(body[1:], " ")
-			}
+			args := parseCommandArgs(body)
 
-			if response := runCommandForService(service.Commands(botClient), event, args); response != nil {
-				responses = append(responses, response)
+			if content := runCommandForService(service.Commands(serviceClient), event, args); content != nil {
+				responses = append(responses, response{serviceClient, content})
 			}
 		} else { // message isn't a command, it might need expanding
-			expansions := runExpansionsForService(service.Expansions(botClient), event, body)
-			responses = append(responses, expansions...)
+			for _, content := range runExpansionsForService(service.Expansions(serviceClient), event, body) {
+				responses = append(responses, response{serviceClient, content})
+			}
 		}
 	}
 
-	for _, content := range responses {
-		if _, err := botClient.SendMessageEvent(event.RoomID, mevt.EventMessage, content); err != nil {
+	for _, res := range responses {
+		if _, err := res.cli.SendMessageEvent(event.RoomID, mevt.EventMessage, res.content); err != nil {
 			log.WithFields(log.Fields{
 				"room_id": event.RoomID,
-				"content": content,
+				"content": res.content,
 				"sender":  event.Sender,
 			}).WithError(err).Error("Failed to send command response")
 		}
 	}
 }
 
+// onObservedEvent tells the services of the bot which want to see every message about a redaction
+// or reaction.
+func (c *Clients) onObservedEvent(botClient *BotClient, event *mevt.Event) {
+	services, err := c.db.LoadServicesForUser(botClient.UserID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey:      err,
+			"room_id":         event.RoomID,
+			"service_user_id": botClient.UserID,
+		}).Warn("Error loading services")
+		return
+	}
+	c.notifyObservers(botClient, services, event)
+}
+
+// notifyObservers passes the event to the services which implement types.MessageObserver. Events
+// sent by the bot itself are not passed on, so that services which relay messages don't loop.
+func (c *Clients) notifyObservers(botClient *BotClient, services []types.Service, event *mevt.Event) {
+	if event.Sender == botClient.UserID {
+		return
+	}
+	for _, service := range services {
+		if observer, ok := service.(types.MessageObserver); ok {
+			observer.OnMessage(botClient.forService(service), event)
+		}
+	}
+}
+
+// replaceSmartQuotes replaces all smart quotes with their normal counterparts so shellwords can parse it
+func replaceSmartQuotes(body string) string {
+	body = strings.Replace(body, `‘`, `'`, -1)
+	body = strings.Replace(body, `’`, `'`, -1)
+	body = strings.Replace(body, `“`, `"`, -1)
+	body = strings.Replace(body, `”`, `"`, -1)
+	return body
+}
+
+// parseCommandArgs splits a "!command" message body into its arguments. Quoted
+// arguments are kept together where possible; if the body cannot be parsed as
+// shell words it is split on spaces instead.
+func parseCommandArgs(body string) []string {
+	body = strings.TrimPrefix(body, "!")
+	args, err := shellwords.Parse(body)
+	if err != nil {
+		args = strings.Split(body, " ")
+	}
+	return args
+}
+
 // runCommandForService runs a single command read from a matrix event. Runs
 // the matching command with the longest path. Returns the JSON encodable
 // content of a single matrix message event to use as a response or nil if no
@@ -231,7 +318,13 @@ func runCommandForService(cmds []types.Command, event *mevt.Event, arguments []s
 		"user_id": event.Sender,
 		"command": bestMatch.Path,
 	}).Info("Executing command")
-	content, err := bestMatch.Command(event.RoomID, event.Sender, cmdArgs)
+	var content interface{}
+	var err error
+	if bestMatch.EventCommand != nil {
+		content, err = bestMatch.EventCommand(event, cmdArgs)
+	} else {
+		content, err = bestMatch.Command(event.RoomID, event.Sender, cmdArgs)
+	}
 	if err != nil {
 		if content != nil {
 			log.WithFields(log.Fields{
@@ -335,13 +428,18 @@ func (c *Clients) initClient(botClient *BotClient) error {
 		return err
 	}
 
-	client.Client = c.httpClient
+	client.Client = c.faults.wrap(c.httpClient, config.UserID, client.HomeserverURL.Host)
 	client.DeviceID = config.DeviceID
 	if client.DeviceID == "" {
 		log.Warn("Device ID is not set which will result in E2E encryption/decryption not working")
 	}
 	botClient.Client = client
 	botClient.verificationSAS = &sync.Map{}
+	botClient.recentMessages = newRecentMessages()
+	botClient.canaryRoomID = config.CanaryRoomID
+	if botClient.canaryRoomID == "" {
+		botClient.canaryRoomID = c.canaryRoomID
+	}
 
 	syncer := client.Syncer.(*mautrix.DefaultSyncer)
 
@@ -366,6 +464,14 @@ func (c *Clients) initClient(botClient *BotClient) error {
 		c.onMessageEvent(botClient, event)
 	})
 
+	syncer.OnEventType(mevt.EventRedaction, func(_ mautrix.EventSource, event *mevt.Event) {
+		c.onObservedEvent(botClient, event)
+	})
+
+	syncer.OnEventType(mevt.EventReaction, func(_ mautrix.EventSource, event *mevt.Event) {
+		c.onObservedEvent(botClient, event)
+	})
+
 	syncer.OnEventType(mevt.Type{Type: "m.room.bot.options", Class: mevt.UnknownEventType}, func(_ mautrix.EventSource, event *mevt.Event) {
 		c.onBotOptionsEvent(botClient.Client, event)
 	})
@@ -391,6 +497,8 @@ func (c *Clients) initClient(botClient *BotClient) error {
 		} else {
 			if decrypted.Type == mevt.EventMessage {
 				c.onMessageEvent(botClient, decrypted)
+			} else if decrypted.Type == mevt.EventRedaction || decrypted.Type == mevt.EventReaction {
+				c.onObservedEvent(botClient, decrypted)
 			}
 			log.WithFields(log.Fields{
 				"type":      evt.Type,
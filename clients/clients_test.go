@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/types"
 	"maunium.net/go/mautrix"
@@ -151,3 +152,166 @@ func TestSASVerificationHandling(t *testing.T) {
 		t.Error("Verification did not finish after receiving the SAS from the correct user")
 	}
 }
+
+func TestCanaryContent(t *testing.T) {
+	content := canaryContent("!target:hs", mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          "Build passed",
+		Format:        mevt.FormatHTML,
+		FormattedBody: "<b>Build</b> passed",
+	})
+	annotated, ok := content.(map[string]interface{})
+	if !ok {
+		t.Fatalf("TestCanaryContent: expected annotated map, got %T", content)
+	}
+	if want := "[canary: !target:hs] Build passed"; annotated["body"] != want {
+		t.Errorf("TestCanaryContent: want body %q, got %q", want, annotated["body"])
+	}
+	if want := "<b>[canary: !target:hs]</b> <b>Build</b> passed"; annotated["formatted_body"] != want {
+		t.Errorf("TestCanaryContent: want formatted_body %q, got %q", want, annotated["formatted_body"])
+	}
+	if annotated[canaryRoomKey] != id.RoomID("!target:hs") {
+		t.Errorf("TestCanaryContent: want target room annotation, got %v", annotated[canaryRoomKey])
+	}
+	if annotated["msgtype"] != "m.notice" {
+		t.Errorf("TestCanaryContent: msgtype was not preserved, got %v", annotated["msgtype"])
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	var passedThrough int
+	trans := struct{ MockTransport }{}
+	trans.roundTrip = func(*http.Request) (*http.Response, error) {
+		passedThrough++
+		return &http.Response{StatusCode: 200}, nil
+	}
+	faults := newFaultInjector()
+	cli := faults.wrap(&http.Client{Transport: trans}, "@service:user", "someplace.somewhere")
+
+	faultTests := []struct {
+		config      api.FaultConfig
+		url         string
+		roll        float64
+		expectCode  int
+		expectError bool
+	}{
+		{api.FaultConfig{}, "", 0, 200, false},
+		{api.FaultConfig{RateLimitRate: 0.5}, "", 0.25, 429, false},
+		{api.FaultConfig{RateLimitRate: 0.5}, "", 0.75, 200, false},
+		{api.FaultConfig{RateLimitRate: 0.2, TimeoutRate: 0.2}, "", 0.3, 0, true},
+		{api.FaultConfig{RateLimitRate: 0.2, TimeoutRate: 0.2, ServerErrorRate: 0.2}, "", 0.5, 500, false},
+		{api.FaultConfig{UserID: "@other:user", ServerErrorRate: 1}, "", 0, 200, false},
+		{api.FaultConfig{ServerErrorRate: 1}, "https://images.elsewhere/hero.png", 0, 200, false},
+	}
+	for _, ft := range faultTests {
+		faults.setConfig(ft.config)
+		roll := ft.roll
+		faults.rand = func() float64 { return roll }
+
+		passedThrough = 0
+		url := ft.url
+		if url == "" {
+			url = "https://someplace.somewhere/_matrix/client/r0/sync"
+		}
+		req, _ := http.NewRequest("GET", url, nil)
+		res, err := cli.Transport.RoundTrip(req)
+		if ft.expectError {
+			if err == nil {
+				t.Errorf("TestFaultInjection %+v roll %v: expected error, got none", ft.config, roll)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("TestFaultInjection %+v roll %v: unexpected error %s", ft.config, roll, err)
+			continue
+		}
+		if res.StatusCode != ft.expectCode {
+			t.Errorf("TestFaultInjection %+v roll %v: want code %d, got %d", ft.config, roll, ft.expectCode, res.StatusCode)
+		}
+		if wantPassed := ft.expectCode == 200; (passedThrough == 1) != wantPassed {
+			t.Errorf("TestFaultInjection %+v roll %v: request passed through %d times", ft.config, roll, passedThrough)
+		}
+	}
+}
+
+func TestRecentMessages(t *testing.T) {
+	recent := newRecentMessages()
+	messageEvent := func(eventID id.EventID, raw map[string]interface{}) *mevt.Event {
+		content := mevt.Content{Raw: raw}
+		if veryRaw, err := content.MarshalJSON(); err != nil {
+			t.Fatalf("Error marshalling JSON: %s", err)
+		} else {
+			content.VeryRaw = veryRaw
+		}
+		content.ParseRaw(mevt.EventMessage)
+		return &mevt.Event{
+			Type:    mevt.EventMessage,
+			ID:      eventID,
+			Sender:  "@link:hyrule",
+			RoomID:  "!castle:hyrule",
+			Content: content,
+		}
+	}
+	for i := 1; i <= recentMessagesPerRoom+5; i++ {
+		recent.add(messageEvent(id.EventID(fmt.Sprintf("$%d", i)), map[string]interface{}{
+			"body":    fmt.Sprintf("message %d", i),
+			"msgtype": "m.text",
+		}))
+	}
+	recent.add(messageEvent("$edit", map[string]interface{}{
+		"body":          "* edited 10",
+		"msgtype":       "m.text",
+		"m.new_content": map[string]interface{}{"body": "edited 10", "msgtype": "m.text"},
+		"m.relates_to":  map[string]interface{}{"rel_type": "m.replace", "event_id": "$10"},
+	}))
+	recent.add(messageEvent("$reply", map[string]interface{}{
+		"body":         "> <@zelda:hyrule> hello\n\nhi zelda",
+		"msgtype":      "m.text",
+		"m.relates_to": map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$1"}},
+	}))
+
+	messages := recent.list("!castle:hyrule")
+	if len(messages) != recentMessagesPerRoom {
+		t.Fatalf("Expected %d messages, got %d", recentMessagesPerRoom, len(messages))
+	}
+	for i, want := range map[int]string{0: "message 7", 3: "edited 10", recentMessagesPerRoom - 2: "message 55", recentMessagesPerRoom - 1: "hi zelda"} {
+		if messages[i].Body != want {
+			t.Errorf("Message %d: got %q, want %q", i, messages[i].Body, want)
+		}
+	}
+	if messages := recent.list("!dungeon:hyrule"); len(messages) != 0 {
+		t.Errorf("Expected no messages in another room, got %v", messages)
+	}
+}
+
+func TestCanaryStateChange(t *testing.T) {
+	change := canaryStateChange(mevt.StateTopic, "", map[string]string{"topic": "Build passed"})
+	if want := `Set m.room.topic state "" to {"topic":"Build passed"}`; change != want {
+		t.Errorf("TestCanaryStateChange: want %q, got %q", want, change)
+	}
+	if want := `Ban @ganon:hs because "Spam"`; withReason("Ban @ganon:hs", "Spam") != want {
+		t.Errorf("TestCanaryStateChange: want %q, got %q", want, withReason("Ban @ganon:hs", "Spam"))
+	}
+}
+
+func TestCanaryRoomForService(t *testing.T) {
+	botClient := &BotClient{canaryRoomID: "!staging:hs"}
+	service := types.NewDefaultService("id", "@neb:hs", "echo")
+	if cli := botClient.forService(&service); cli.canaryRoomID != "!staging:hs" {
+		t.Errorf("TestCanaryRoomForService: want the client's canary room, got %q", cli.canaryRoomID)
+	}
+	service.CanaryRoomID = "!echo-staging:hs"
+	cli := botClient.forService(&service)
+	if cli.canaryRoomID != "!echo-staging:hs" {
+		t.Errorf("TestCanaryRoomForService: want the service's canary room, got %q", cli.canaryRoomID)
+	}
+	if botClient.canaryRoomID != "!staging:hs" {
+		t.Errorf("TestCanaryRoomForService: the client's canary room was changed to %q", botClient.canaryRoomID)
+	}
+	if !cli.redirects("!canary-1:" + canaryServerName) {
+		t.Errorf("TestCanaryRoomForService: want made-up rooms to be redirected")
+	}
+	if cli.redirects("!echo-staging:hs") {
+		t.Errorf("TestCanaryRoomForService: want the canary room not to be redirected")
+	}
+}
@@ -0,0 +1,123 @@
+package clients
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+
+	"github.com/matrix-org/go-neb/api"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// faultTimeoutError is returned by the faultInjector when it simulates a timeout. It implements
+// net.Error so it looks the same to callers as a real timeout would.
+type faultTimeoutError struct{}
+
+func (faultTimeoutError) Error() string   { return "fault injection: simulated request timeout" }
+func (faultTimeoutError) Timeout() bool   { return true }
+func (faultTimeoutError) Temporary() bool { return true }
+
+// faultInjector is an http.RoundTripper which fails a configurable proportion of requests before
+// passing the rest on to the wrapped transport.
+type faultInjector struct {
+	mu     sync.RWMutex
+	config api.FaultConfig
+	rand   func() float64
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{rand: rand.Float64}
+}
+
+func (f *faultInjector) setConfig(config api.FaultConfig) (old api.FaultConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	old = f.config
+	f.config = config
+	return
+}
+
+func (f *faultInjector) getConfig() api.FaultConfig {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.config
+}
+
+// wrap returns a copy of cli whose requests to the homeserver at homeserverHost on behalf of
+// userID are subject to fault injection. Requests to anywhere else, e.g. to fetch images to
+// upload, aren't.
+func (f *faultInjector) wrap(cli *http.Client, userID id.UserID, homeserverHost string) *http.Client {
+	wrapped := *cli
+	next := cli.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	wrapped.Transport = &faultTransport{f, userID, homeserverHost, next}
+	return &wrapped
+}
+
+// fault works out which fault, if any, to inject for a request made by userID. Returns nil if
+// the request should be made as normal.
+func (f *faultInjector) fault(req *http.Request, userID id.UserID) (*http.Response, error) {
+	config := f.getConfig()
+	if config.UserID != "" && config.UserID != userID {
+		return nil, nil
+	}
+	roll := f.rand()
+	if roll < config.RateLimitRate {
+		return faultResponse(req, 429, fmt.Sprintf(
+			`{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests (injected fault)","retry_after_ms":%d}`,
+			config.RetryAfterMs,
+		)), nil
+	}
+	roll -= config.RateLimitRate
+	if roll < config.TimeoutRate {
+		return nil, faultTimeoutError{}
+	}
+	roll -= config.TimeoutRate
+	if roll < config.ServerErrorRate {
+		return faultResponse(req, 500, `{"errcode":"M_UNKNOWN","error":"Internal server error (injected fault)"}`), nil
+	}
+	return nil, nil
+}
+
+func faultResponse(req *http.Request, code int, body string) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Request:    req,
+	}
+}
+
+type faultTransport struct {
+	injector       *faultInjector
+	userID         id.UserID
+	homeserverHost string
+	next           http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.homeserverHost {
+		return t.next.RoundTrip(req)
+	}
+	res, err := t.injector.fault(req, t.userID)
+	if res == nil && err == nil {
+		return t.next.RoundTrip(req)
+	}
+	log.WithFields(log.Fields{
+		"user_id": t.userID,
+		"method":  req.Method,
+		"path":    req.URL.Path,
+	}).Warn("Injecting fault into Matrix request")
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return res, err
+}
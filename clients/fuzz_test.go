@@ -0,0 +1,73 @@
+//go:build go1.18
+// +build go1.18
+
+package clients
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func FuzzCommandParsing(f *testing.F) {
+	for _, input := range commandParseTests {
+		f.Add(input.body)
+	}
+	f.Add(`!test "unterminated quote`)
+	f.Add("!test sub command with args")
+	f.Add("!")
+
+	noop := func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+		return nil, nil
+	}
+	cmds := []types.Command{
+		{Path: []string{"test"}, Command: noop},
+		{Path: []string{"test", "sub"}, Command: noop},
+	}
+	event := &mevt.Event{Sender: "@someone:somewhere", RoomID: "!foo:bar"}
+
+	f.Fuzz(func(t *testing.T, body string) {
+		body = replaceSmartQuotes(body)
+		if body == "" || body[0] != '!' {
+			return
+		}
+		args := parseCommandArgs(body)
+		runCommandForService(cmds, event, args)
+	})
+}
+
+func FuzzExpansions(f *testing.F) {
+	f.Add("matrix-org/go-neb#123 and #45")
+	f.Add("nothing to expand here")
+	f.Add("#3dprinting testing#1234")
+
+	var seen [][]string
+	expans := []types.Expansion{
+		{
+			Regexp: regexp.MustCompile(`(?:(?:([A-z0-9-_.]+)/([A-z0-9-_.]+))|\B)#([0-9]+)\b`),
+			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+				seen = append(seen, matchingGroups)
+				return matchingGroups[0]
+			},
+		},
+	}
+	event := &mevt.Event{Sender: "@someone:somewhere", RoomID: "!foo:bar"}
+
+	f.Fuzz(func(t *testing.T, body string) {
+		seen = nil
+		responses := runExpansionsForService(expans, event, body)
+		if len(responses) != len(seen) {
+			t.Fatalf("got %d responses for %d expansions", len(responses), len(seen))
+		}
+		unique := map[string]bool{}
+		for _, groups := range seen {
+			if unique[groups[0]] {
+				t.Fatalf("expanded %q more than once", groups[0])
+			}
+			unique[groups[0]] = true
+		}
+	})
+}
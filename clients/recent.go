@@ -0,0 +1,88 @@
+package clients
+
+import (
+	"sync"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// How many messages are remembered for each room
+const recentMessagesPerRoom = 50
+
+// recentMessages remembers the latest messages in each room, in a ring buffer per room. They are
+// only kept in memory, so are forgotten when Go-NEB restarts.
+type recentMessages struct {
+	mu    sync.Mutex
+	rooms map[id.RoomID]*messageRing
+}
+
+type messageRing struct {
+	messages [recentMessagesPerRoom]types.RecentMessage
+	// The index of the next message to write, and how many have been written up to the size
+	next, count int
+}
+
+func newRecentMessages() *recentMessages {
+	return &recentMessages{rooms: make(map[id.RoomID]*messageRing)}
+}
+
+// add remembers the message event. Edits update the message they replace, if it is remembered.
+func (r *recentMessages) add(event *mevt.Event) {
+	if r == nil {
+		return
+	}
+	message := event.Content.AsMessage()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ring := r.rooms[event.RoomID]
+	if ring == nil {
+		ring = &messageRing{}
+		r.rooms[event.RoomID] = ring
+	}
+	if message.RelatesTo != nil && message.RelatesTo.Type == mevt.RelReplace {
+		if message.NewContent == nil {
+			return
+		}
+		for i := range ring.messages {
+			m := &ring.messages[i]
+			if m.EventID == message.RelatesTo.EventID && m.Sender == event.Sender {
+				m.Body = message.NewContent.Body
+			}
+		}
+		return
+	}
+	body := message.Body
+	if message.GetReplyTo() != "" {
+		body = mevt.TrimReplyFallbackText(body)
+	}
+	ring.messages[ring.next] = types.RecentMessage{
+		EventID: event.ID,
+		Sender:  event.Sender,
+		Body:    body,
+	}
+	ring.next = (ring.next + 1) % recentMessagesPerRoom
+	if ring.count < recentMessagesPerRoom {
+		ring.count++
+	}
+}
+
+// list returns the remembered messages in the room, oldest first.
+func (r *recentMessages) list(roomID id.RoomID) []types.RecentMessage {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ring := r.rooms[roomID]
+	if ring == nil {
+		return nil
+	}
+	messages := make([]types.RecentMessage, 0, ring.count)
+	start := (ring.next - ring.count + recentMessagesPerRoom) % recentMessagesPerRoom
+	for i := 0; i < ring.count; i++ {
+		messages = append(messages, ring.messages[(start+i)%recentMessagesPerRoom])
+	}
+	return messages
+}
@@ -116,11 +116,52 @@ func (d *ServiceDB) LoadService(serviceID string) (service types.Service, err er
 // DeleteService deletes the given service from the database.
 func (d *ServiceDB) DeleteService(serviceID string) (err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		if err := deleteAllServiceStateTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err := deleteAllCannedResponsesTxn(txn, serviceID); err != nil {
+			return err
+		}
 		return deleteServiceTxn(txn, serviceID)
 	})
 	return
 }
 
+// LoadServiceState loads the state which a service stored under the given key. Returns
+// sql.ErrNoRows if there is no such state.
+func (d *ServiceDB) LoadServiceState(serviceID, stateKey string) (stateJSON []byte, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		stateJSON, err = selectServiceStateTxn(txn, serviceID, stateKey)
+		return err
+	})
+	return
+}
+
+// StoreServiceState stores state for a service under the given key, replacing any state which
+// was already stored there. Services use this for anything which must outlive a single request,
+// since services are loaded afresh from the database for every request.
+func (d *ServiceDB) StoreServiceState(serviceID, stateKey string, stateJSON []byte) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		_, err := selectServiceStateTxn(txn, serviceID, stateKey)
+		if err == sql.ErrNoRows {
+			return insertServiceStateTxn(txn, time.Now(), serviceID, stateKey, stateJSON)
+		} else if err != nil {
+			return err
+		} else {
+			return updateServiceStateTxn(txn, time.Now(), serviceID, stateKey, stateJSON)
+		}
+	})
+	return
+}
+
+// DeleteServiceState removes the state which a service stored under the given key, if any.
+func (d *ServiceDB) DeleteServiceState(serviceID, stateKey string) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteServiceStateTxn(txn, serviceID, stateKey)
+	})
+	return
+}
+
 // LoadServicesForUser loads all the bot services configured for a given user.
 // Returns an empty list if there aren't any services configured.
 func (d *ServiceDB) LoadServicesForUser(serviceUserID id.UserID) (services []types.Service, err error) {
@@ -276,6 +317,109 @@ func (d *ServiceDB) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOpt
 	return
 }
 
+// LoadTemplate loads the template override with the given name. Returns sql.ErrNoRows if the
+// template isn't overridden.
+func (d *ServiceDB) LoadTemplate(name string) (tmpl api.Template, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		tmpl, err = selectTemplateTxn(txn, name)
+		return err
+	})
+	return
+}
+
+// LoadTemplates loads every template override from the database.
+func (d *ServiceDB) LoadTemplates() (tmpls []api.Template, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		tmpls, err = selectTemplatesTxn(txn)
+		return err
+	})
+	return
+}
+
+// StoreTemplate stores a template override into the database either by inserting a new
+// template or updating an existing one. Returns the old template if there was one.
+func (d *ServiceDB) StoreTemplate(tmpl api.Template) (old api.Template, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		old, err = selectTemplateTxn(txn, tmpl.Name)
+		if err == sql.ErrNoRows {
+			return insertTemplateTxn(txn, time.Now(), tmpl)
+		} else if err != nil {
+			return err
+		} else {
+			return updateTemplateTxn(txn, time.Now(), tmpl)
+		}
+	})
+	return
+}
+
+// DeleteTemplate removes the template override with the given name, if there is one.
+func (d *ServiceDB) DeleteTemplate(name string) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteTemplateTxn(txn, name)
+	})
+	return
+}
+
+// LoadCannedResponses loads every canned response of the given service, in every room.
+func (d *ServiceDB) LoadCannedResponses(serviceID string) (responses []api.CannedResponse, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		responses, err = selectCannedResponsesTxn(txn, serviceID)
+		return err
+	})
+	return
+}
+
+// StoreCannedResponse stores a canned response into the database either by inserting a new
+// response or updating an existing one. Returns the old response if there was one.
+func (d *ServiceDB) StoreCannedResponse(response api.CannedResponse) (old api.CannedResponse, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		old, err = selectCannedResponseTxn(txn, response.ServiceID, response.RoomID, response.Name)
+		if err == sql.ErrNoRows {
+			return insertCannedResponseTxn(txn, time.Now(), response)
+		} else if err != nil {
+			return err
+		} else {
+			return updateCannedResponseTxn(txn, time.Now(), response)
+		}
+	})
+	return
+}
+
+// DeleteCannedResponse removes the named canned response from the room, if there is one.
+func (d *ServiceDB) DeleteCannedResponse(serviceID string, roomID id.RoomID, name string) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteCannedResponseTxn(txn, serviceID, roomID, name)
+	})
+	return
+}
+
+// QueueNotification stores a notification which is being held back from a room.
+func (d *ServiceDB) QueueNotification(n types.QueuedNotification) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertQueuedNotificationTxn(txn, time.Now(), n)
+	})
+	return
+}
+
+// LoadQueuedNotifications loads every queued notification, oldest first.
+func (d *ServiceDB) LoadQueuedNotifications() (notifs []types.QueuedNotification, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		notifs, err = selectQueuedNotificationsTxn(txn)
+		return err
+	})
+	return
+}
+
+// DeleteQueuedNotifications deletes the notifications which were queued for the given room by the
+// given service for the given reason, at or before the given time. Notifications queued since
+// they were loaded are kept.
+func (d *ServiceDB) DeleteQueuedNotifications(userID id.UserID, roomID id.RoomID, serviceID, reason string, until time.Time) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteQueuedNotificationsForRoomTxn(txn, userID, roomID, serviceID, reason, until)
+	})
+	return
+}
+
 // InsertFromConfig inserts entries from the config file into the database. This only really
 // makes sense for in-memory databases.
 func (d *ServiceDB) InsertFromConfig(cfg *api.ConfigFile) error {
@@ -324,6 +468,16 @@ func (d *ServiceDB) InsertFromConfig(cfg *api.ConfigFile) error {
 		}
 	}
 
+	// Insert template overrides
+	for _, t := range cfg.Templates {
+		if err := t.Check(); err != nil {
+			return err
+		}
+		if _, err := d.StoreTemplate(t); err != nil {
+			return err
+		}
+	}
+
 	// Do not insert services yet, they require more work to set up.
 	return nil
 }
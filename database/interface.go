@@ -1,6 +1,9 @@
 package database
 
 import (
+	"database/sql"
+	"time"
+
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/types"
 	"maunium.net/go/mautrix/id"
@@ -21,6 +24,10 @@ type Storer interface {
 	LoadServicesByType(serviceType string) (services []types.Service, err error)
 	StoreService(service types.Service) (oldService types.Service, err error)
 
+	LoadServiceState(serviceID, stateKey string) (stateJSON []byte, err error)
+	StoreServiceState(serviceID, stateKey string, stateJSON []byte) (err error)
+	DeleteServiceState(serviceID, stateKey string) (err error)
+
 	LoadAuthRealm(realmID string) (realm types.AuthRealm, err error)
 	LoadAuthRealmsByType(realmType string) (realms []types.AuthRealm, err error)
 	StoreAuthRealm(realm types.AuthRealm) (old types.AuthRealm, err error)
@@ -33,6 +40,19 @@ type Storer interface {
 	LoadBotOptions(userID id.UserID, roomID id.RoomID) (opts types.BotOptions, err error)
 	StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOptions, err error)
 
+	LoadTemplate(name string) (tmpl api.Template, err error)
+	LoadTemplates() (tmpls []api.Template, err error)
+	StoreTemplate(tmpl api.Template) (old api.Template, err error)
+	DeleteTemplate(name string) (err error)
+
+	LoadCannedResponses(serviceID string) (responses []api.CannedResponse, err error)
+	StoreCannedResponse(response api.CannedResponse) (old api.CannedResponse, err error)
+	DeleteCannedResponse(serviceID string, roomID id.RoomID, name string) (err error)
+
+	QueueNotification(n types.QueuedNotification) error
+	LoadQueuedNotifications() (notifs []types.QueuedNotification, err error)
+	DeleteQueuedNotifications(userID id.UserID, roomID id.RoomID, serviceID, reason string, until time.Time) error
+
 	InsertFromConfig(cfg *api.ConfigFile) error
 }
 
@@ -90,6 +110,21 @@ func (s *NopStorage) StoreService(service types.Service) (oldService types.Servi
 	return
 }
 
+// LoadServiceState NOP
+func (s *NopStorage) LoadServiceState(serviceID, stateKey string) (stateJSON []byte, err error) {
+	return nil, sql.ErrNoRows
+}
+
+// StoreServiceState NOP
+func (s *NopStorage) StoreServiceState(serviceID, stateKey string, stateJSON []byte) (err error) {
+	return
+}
+
+// DeleteServiceState NOP
+func (s *NopStorage) DeleteServiceState(serviceID, stateKey string) (err error) {
+	return
+}
+
 // LoadAuthRealm NOP
 func (s *NopStorage) LoadAuthRealm(realmID string) (realm types.AuthRealm, err error) {
 	return
@@ -135,6 +170,56 @@ func (s *NopStorage) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOp
 	return
 }
 
+// LoadTemplate NOP
+func (s *NopStorage) LoadTemplate(name string) (tmpl api.Template, err error) {
+	return
+}
+
+// LoadTemplates NOP
+func (s *NopStorage) LoadTemplates() (tmpls []api.Template, err error) {
+	return
+}
+
+// StoreTemplate NOP
+func (s *NopStorage) StoreTemplate(tmpl api.Template) (old api.Template, err error) {
+	return
+}
+
+// DeleteTemplate NOP
+func (s *NopStorage) DeleteTemplate(name string) (err error) {
+	return
+}
+
+// LoadCannedResponses NOP
+func (s *NopStorage) LoadCannedResponses(serviceID string) (responses []api.CannedResponse, err error) {
+	return
+}
+
+// StoreCannedResponse NOP
+func (s *NopStorage) StoreCannedResponse(response api.CannedResponse) (old api.CannedResponse, err error) {
+	return
+}
+
+// DeleteCannedResponse NOP
+func (s *NopStorage) DeleteCannedResponse(serviceID string, roomID id.RoomID, name string) (err error) {
+	return
+}
+
+// QueueNotification NOP
+func (s *NopStorage) QueueNotification(n types.QueuedNotification) error {
+	return nil
+}
+
+// LoadQueuedNotifications NOP
+func (s *NopStorage) LoadQueuedNotifications() (notifs []types.QueuedNotification, err error) {
+	return
+}
+
+// DeleteQueuedNotifications NOP
+func (s *NopStorage) DeleteQueuedNotifications(userID id.UserID, roomID id.RoomID, serviceID, reason string, until time.Time) error {
+	return nil
+}
+
 // InsertFromConfig NOP
 func (s *NopStorage) InsertFromConfig(cfg *api.ConfigFile) error {
 	return nil
@@ -61,6 +61,47 @@ CREATE TABLE IF NOT EXISTS bot_options (
 	time_updated_ms BIGINT NOT NULL,
 	UNIQUE(user_id, room_id)
 );
+
+CREATE TABLE IF NOT EXISTS templates (
+	name TEXT NOT NULL,
+	text_template TEXT NOT NULL,
+	html_template TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(name)
+);
+
+CREATE TABLE IF NOT EXISTS service_state (
+	service_id TEXT NOT NULL,
+	state_key TEXT NOT NULL,
+	state_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(service_id, state_key)
+);
+
+CREATE TABLE IF NOT EXISTS queued_notifications (
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	service_id TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	notification_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS queued_notifications_idx ON queued_notifications(user_id, room_id, service_id, reason);
+
+CREATE TABLE IF NOT EXISTS canned_responses (
+	service_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	text_template TEXT NOT NULL,
+	html_template TEXT NOT NULL,
+	image_url TEXT NOT NULL,
+	set_by_user_id TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(service_id, room_id, name)
+);
 `
 
 const selectMatrixClientConfigSQL = `
@@ -270,6 +311,56 @@ func deleteServiceTxn(txn *sql.Tx, serviceID string) error {
 	return err
 }
 
+const selectServiceStateSQL = `
+SELECT state_json FROM service_state WHERE service_id = $1 AND state_key = $2
+`
+
+func selectServiceStateTxn(txn *sql.Tx, serviceID, stateKey string) (stateJSON []byte, err error) {
+	err = txn.QueryRow(selectServiceStateSQL, serviceID, stateKey).Scan(&stateJSON)
+	return
+}
+
+const insertServiceStateSQL = `
+INSERT INTO service_state(
+	service_id, state_key, state_json, time_added_ms, time_updated_ms
+) VALUES ($1, $2, $3, $4, $5)
+`
+
+func insertServiceStateTxn(txn *sql.Tx, now time.Time, serviceID, stateKey string, stateJSON []byte) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(insertServiceStateSQL, serviceID, stateKey, stateJSON, t, t)
+	return err
+}
+
+const updateServiceStateSQL = `
+UPDATE service_state SET state_json = $1, time_updated_ms = $2
+	WHERE service_id = $3 AND state_key = $4
+`
+
+func updateServiceStateTxn(txn *sql.Tx, now time.Time, serviceID, stateKey string, stateJSON []byte) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(updateServiceStateSQL, stateJSON, t, serviceID, stateKey)
+	return err
+}
+
+const deleteServiceStateSQL = `
+DELETE FROM service_state WHERE service_id = $1 AND state_key = $2
+`
+
+func deleteServiceStateTxn(txn *sql.Tx, serviceID, stateKey string) error {
+	_, err := txn.Exec(deleteServiceStateSQL, serviceID, stateKey)
+	return err
+}
+
+const deleteAllServiceStateSQL = `
+DELETE FROM service_state WHERE service_id = $1
+`
+
+func deleteAllServiceStateTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteAllServiceStateSQL, serviceID)
+	return err
+}
+
 const insertRealmSQL = `
 INSERT INTO auth_realms(
 	realm_id, realm_type, realm_json, time_added_ms, time_updated_ms
@@ -495,3 +586,201 @@ func updateBotOptionsTxn(txn *sql.Tx, now time.Time, opts types.BotOptions) erro
 	_, err = txn.Exec(updateBotOptionsSQL, optsJSON, opts.SetByUserID, t, opts.UserID, opts.RoomID)
 	return err
 }
+
+const selectTemplateSQL = `
+SELECT text_template, html_template FROM templates WHERE name = $1
+`
+
+func selectTemplateTxn(txn *sql.Tx, name string) (tmpl api.Template, err error) {
+	tmpl.Name = name
+	err = txn.QueryRow(selectTemplateSQL, name).Scan(&tmpl.Text, &tmpl.HTML)
+	return
+}
+
+const selectTemplatesSQL = `
+SELECT name, text_template, html_template FROM templates
+`
+
+func selectTemplatesTxn(txn *sql.Tx) (tmpls []api.Template, err error) {
+	rows, err := txn.Query(selectTemplatesSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tmpl api.Template
+		if err = rows.Scan(&tmpl.Name, &tmpl.Text, &tmpl.HTML); err != nil {
+			return
+		}
+		tmpls = append(tmpls, tmpl)
+	}
+	return
+}
+
+const insertTemplateSQL = `
+INSERT INTO templates(
+	name, text_template, html_template, time_added_ms, time_updated_ms
+) VALUES ($1, $2, $3, $4, $5)
+`
+
+func insertTemplateTxn(txn *sql.Tx, now time.Time, tmpl api.Template) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(insertTemplateSQL, tmpl.Name, tmpl.Text, tmpl.HTML, t, t)
+	return err
+}
+
+const updateTemplateSQL = `
+UPDATE templates SET text_template = $1, html_template = $2, time_updated_ms = $3
+	WHERE name = $4
+`
+
+func updateTemplateTxn(txn *sql.Tx, now time.Time, tmpl api.Template) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(updateTemplateSQL, tmpl.Text, tmpl.HTML, t, tmpl.Name)
+	return err
+}
+
+const deleteTemplateSQL = `
+DELETE FROM templates WHERE name = $1
+`
+
+func deleteTemplateTxn(txn *sql.Tx, name string) error {
+	_, err := txn.Exec(deleteTemplateSQL, name)
+	return err
+}
+
+const insertQueuedNotificationSQL = `
+INSERT INTO queued_notifications(
+	user_id, room_id, service_id, reason, notification_json, time_added_ms
+) VALUES ($1, $2, $3, $4, $5, $6)
+`
+
+func insertQueuedNotificationTxn(txn *sql.Tx, now time.Time, n types.QueuedNotification) error {
+	t := now.UnixNano() / 1000000
+	notifJSON, err := json.Marshal(&n)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(insertQueuedNotificationSQL, n.UserID, n.RoomID, n.ServiceID, n.Reason, notifJSON, t)
+	return err
+}
+
+const selectQueuedNotificationsSQL = `
+SELECT notification_json, time_added_ms FROM queued_notifications ORDER BY time_added_ms
+`
+
+func selectQueuedNotificationsTxn(txn *sql.Tx) ([]types.QueuedNotification, error) {
+	rows, err := txn.Query(selectQueuedNotificationsSQL)
+	if err != nil {
+		return nil, err
+	}
+	return scanQueuedNotifications(rows)
+}
+
+func scanQueuedNotifications(rows *sql.Rows) (notifs []types.QueuedNotification, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var notifJSON []byte
+		var t int64
+		if err = rows.Scan(&notifJSON, &t); err != nil {
+			return
+		}
+		var n types.QueuedNotification
+		if err = json.Unmarshal(notifJSON, &n); err != nil {
+			return
+		}
+		n.Queued = time.Unix(0, t*1000000)
+		notifs = append(notifs, n)
+	}
+	return
+}
+
+const deleteQueuedNotificationsForRoomSQL = `
+DELETE FROM queued_notifications
+	WHERE user_id = $1 AND room_id = $2 AND service_id = $3 AND reason = $4 AND time_added_ms <= $5
+`
+
+func deleteQueuedNotificationsForRoomTxn(txn *sql.Tx, userID id.UserID, roomID id.RoomID, serviceID, reason string, until time.Time) error {
+	t := until.UnixNano() / 1000000
+	_, err := txn.Exec(deleteQueuedNotificationsForRoomSQL, userID, roomID, serviceID, reason, t)
+	return err
+}
+
+const selectCannedResponseSQL = `
+SELECT text_template, html_template, image_url, set_by_user_id FROM canned_responses
+	WHERE service_id = $1 AND room_id = $2 AND name = $3
+`
+
+func selectCannedResponseTxn(txn *sql.Tx, serviceID string, roomID id.RoomID, name string) (response api.CannedResponse, err error) {
+	response.ServiceID = serviceID
+	response.RoomID = roomID
+	response.Name = name
+	err = txn.QueryRow(selectCannedResponseSQL, serviceID, roomID, name).Scan(
+		&response.Text, &response.HTML, &response.ImageURL, &response.SetByUserID,
+	)
+	return
+}
+
+const selectCannedResponsesSQL = `
+SELECT room_id, name, text_template, html_template, image_url, set_by_user_id FROM canned_responses
+	WHERE service_id = $1 ORDER BY room_id, name
+`
+
+func selectCannedResponsesTxn(txn *sql.Tx, serviceID string) (responses []api.CannedResponse, err error) {
+	rows, err := txn.Query(selectCannedResponsesSQL, serviceID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		response := api.CannedResponse{ServiceID: serviceID}
+		if err = rows.Scan(
+			&response.RoomID, &response.Name, &response.Text, &response.HTML, &response.ImageURL, &response.SetByUserID,
+		); err != nil {
+			return
+		}
+		responses = append(responses, response)
+	}
+	return
+}
+
+const insertCannedResponseSQL = `
+INSERT INTO canned_responses(
+	service_id, room_id, name, text_template, html_template, image_url, set_by_user_id, time_added_ms, time_updated_ms
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+`
+
+func insertCannedResponseTxn(txn *sql.Tx, now time.Time, r api.CannedResponse) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(insertCannedResponseSQL, r.ServiceID, r.RoomID, r.Name, r.Text, r.HTML, r.ImageURL, r.SetByUserID, t, t)
+	return err
+}
+
+const updateCannedResponseSQL = `
+UPDATE canned_responses SET text_template = $1, html_template = $2, image_url = $3, set_by_user_id = $4,
+	time_updated_ms = $5 WHERE service_id = $6 AND room_id = $7 AND name = $8
+`
+
+func updateCannedResponseTxn(txn *sql.Tx, now time.Time, r api.CannedResponse) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(updateCannedResponseSQL, r.Text, r.HTML, r.ImageURL, r.SetByUserID, t, r.ServiceID, r.RoomID, r.Name)
+	return err
+}
+
+const deleteCannedResponseSQL = `
+DELETE FROM canned_responses WHERE service_id = $1 AND room_id = $2 AND name = $3
+`
+
+func deleteCannedResponseTxn(txn *sql.Tx, serviceID string, roomID id.RoomID, name string) error {
+	_, err := txn.Exec(deleteCannedResponseSQL, serviceID, roomID, name)
+	return err
+}
+
+const deleteAllCannedResponsesSQL = `
+DELETE FROM canned_responses WHERE service_id = $1
+`
+
+func deleteAllCannedResponsesTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteAllCannedResponsesSQL, serviceID)
+	return err
+}
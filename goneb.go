@@ -16,31 +16,105 @@ import (
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
 	_ "github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/notify"
 	"github.com/matrix-org/go-neb/polling"
 	_ "github.com/matrix-org/go-neb/realms/github"
+	_ "github.com/matrix-org/go-neb/realms/imgur"
 	_ "github.com/matrix-org/go-neb/realms/jira"
+	_ "github.com/matrix-org/go-neb/realms/raindrop"
 
+	_ "github.com/matrix-org/go-neb/services/acme"
+	_ "github.com/matrix-org/go-neb/services/airquality"
 	_ "github.com/matrix-org/go-neb/services/alertmanager"
+	_ "github.com/matrix-org/go-neb/services/alerts"
+	_ "github.com/matrix-org/go-neb/services/analytics"
+	_ "github.com/matrix-org/go-neb/services/announcer"
+	_ "github.com/matrix-org/go-neb/services/appwatch"
+	_ "github.com/matrix-org/go-neb/services/birthday"
+	_ "github.com/matrix-org/go-neb/services/bitbucket"
+	_ "github.com/matrix-org/go-neb/services/bookmarks"
+	_ "github.com/matrix-org/go-neb/services/circleci"
+	_ "github.com/matrix-org/go-neb/services/cron"
+	_ "github.com/matrix-org/go-neb/services/crypto"
 	_ "github.com/matrix-org/go-neb/services/cryptotest"
+	_ "github.com/matrix-org/go-neb/services/currency"
+	_ "github.com/matrix-org/go-neb/services/deadman"
+	_ "github.com/matrix-org/go-neb/services/devutil"
+	_ "github.com/matrix-org/go-neb/services/dice"
+	_ "github.com/matrix-org/go-neb/services/driftwatch"
 	_ "github.com/matrix-org/go-neb/services/echo"
+	_ "github.com/matrix-org/go-neb/services/faqmatch"
+	_ "github.com/matrix-org/go-neb/services/folderwatch"
+	_ "github.com/matrix-org/go-neb/services/food"
 	_ "github.com/matrix-org/go-neb/services/giphy"
 	_ "github.com/matrix-org/go-neb/services/github"
+	_ "github.com/matrix-org/go-neb/services/gitlab"
 
 	_ "github.com/matrix-org/go-neb/services/google"
+	_ "github.com/matrix-org/go-neb/services/governance"
+	_ "github.com/matrix-org/go-neb/services/grafana"
 	_ "github.com/matrix-org/go-neb/services/guggy"
+	_ "github.com/matrix-org/go-neb/services/hackernews"
+	_ "github.com/matrix-org/go-neb/services/homeassistant"
+	_ "github.com/matrix-org/go-neb/services/httpcheck"
 	_ "github.com/matrix-org/go-neb/services/imgur"
+	_ "github.com/matrix-org/go-neb/services/incident"
+	_ "github.com/matrix-org/go-neb/services/ipinfo"
+	_ "github.com/matrix-org/go-neb/services/ipp"
+	_ "github.com/matrix-org/go-neb/services/jenkins"
 
 	_ "github.com/matrix-org/go-neb/services/jira"
+	_ "github.com/matrix-org/go-neb/services/karma"
+	_ "github.com/matrix-org/go-neb/services/langfilter"
+	_ "github.com/matrix-org/go-neb/services/logalert"
+	_ "github.com/matrix-org/go-neb/services/minutes"
+	_ "github.com/matrix-org/go-neb/services/monitoring"
+	_ "github.com/matrix-org/go-neb/services/netutil"
+	_ "github.com/matrix-org/go-neb/services/nextcloud"
+	_ "github.com/matrix-org/go-neb/services/ocr"
+	_ "github.com/matrix-org/go-neb/services/oncall"
+	_ "github.com/matrix-org/go-neb/services/osm"
+	_ "github.com/matrix-org/go-neb/services/pagerduty"
+	_ "github.com/matrix-org/go-neb/services/picker"
+	_ "github.com/matrix-org/go-neb/services/plugin"
+	_ "github.com/matrix-org/go-neb/services/poll"
+	_ "github.com/matrix-org/go-neb/services/qr"
+	_ "github.com/matrix-org/go-neb/services/quotes"
+	_ "github.com/matrix-org/go-neb/services/reddit"
+	_ "github.com/matrix-org/go-neb/services/relay"
+	_ "github.com/matrix-org/go-neb/services/reminders"
+	_ "github.com/matrix-org/go-neb/services/roomstats"
+	_ "github.com/matrix-org/go-neb/services/rota"
 	_ "github.com/matrix-org/go-neb/services/rssbot"
+	_ "github.com/matrix-org/go-neb/services/s3events"
+	_ "github.com/matrix-org/go-neb/services/sed"
+	_ "github.com/matrix-org/go-neb/services/shortener"
 	_ "github.com/matrix-org/go-neb/services/slackapi"
+	_ "github.com/matrix-org/go-neb/services/socialfeed"
+	_ "github.com/matrix-org/go-neb/services/space"
+	_ "github.com/matrix-org/go-neb/services/sponsors"
+	_ "github.com/matrix-org/go-neb/services/standup"
+	_ "github.com/matrix-org/go-neb/services/stock"
+	_ "github.com/matrix-org/go-neb/services/timer"
+	_ "github.com/matrix-org/go-neb/services/timezone"
+	_ "github.com/matrix-org/go-neb/services/translate"
 	_ "github.com/matrix-org/go-neb/services/travisci"
+	_ "github.com/matrix-org/go-neb/services/twitch"
+	_ "github.com/matrix-org/go-neb/services/unfurl"
+	_ "github.com/matrix-org/go-neb/services/urban"
+	_ "github.com/matrix-org/go-neb/services/weather"
 	_ "github.com/matrix-org/go-neb/services/wikipedia"
+	_ "github.com/matrix-org/go-neb/services/wikiwatch"
+	_ "github.com/matrix-org/go-neb/services/wolfram"
+	_ "github.com/matrix-org/go-neb/services/xkcd"
+	_ "github.com/matrix-org/go-neb/services/youtube"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/util"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
+	"maunium.net/go/mautrix/id"
 )
 
 // loadFromConfig loads a config file and returns a ConfigFile
@@ -123,7 +197,7 @@ func insertServicesFromConfig(clis *clients.Clients, serviceReqs []api.Configure
 		}
 
 		// Fetch the client for this service and register/poll
-		c, err := clis.Client(s.UserID)
+		c, err := clis.ServiceClient(service)
 		if err != nil {
 			return fmt.Errorf("config: Service[%d] : %s", i, err)
 		}
@@ -178,6 +252,9 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 	}
 
 	matrixClients := clients.New(db, matrixClient)
+	if e.CanaryRoomID != "" {
+		matrixClients.SetCanaryRoom(id.RoomID(e.CanaryRoomID))
+	}
 	if err := matrixClients.Start(); err != nil {
 		log.WithError(err).Panic("Failed to start up clients")
 	}
@@ -204,7 +281,10 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 		mux.Handle("/admin/getService", prometheus.InstrumentHandler("getService", util.MakeJSONAPI(&handlers.GetService{db})))
 		mux.Handle("/admin/getSession", prometheus.InstrumentHandler("getSession", util.MakeJSONAPI(&handlers.GetSession{db})))
 		mux.Handle("/admin/configureClient", prometheus.InstrumentHandler("configureClient", util.MakeJSONAPI(&handlers.ConfigureClient{matrixClients})))
+		mux.Handle("/admin/configureFaults", prometheus.InstrumentHandler("configureFaults", util.MakeJSONAPI(&handlers.ConfigureFaults{matrixClients})))
 		mux.Handle("/admin/configureService", prometheus.InstrumentHandler("configureService", util.MakeJSONAPI(handlers.NewConfigureService(db, matrixClients))))
+		mux.Handle("/admin/configureTemplate", prometheus.InstrumentHandler("configureTemplate", util.MakeJSONAPI(&handlers.ConfigureTemplate{db})))
+		mux.Handle("/admin/configureCannedResponse", prometheus.InstrumentHandler("configureCannedResponse", util.MakeJSONAPI(&handlers.ConfigureCannedResponse{db})))
 		mux.Handle("/admin/configureAuthRealm", prometheus.InstrumentHandler("configureAuthRealm", util.MakeJSONAPI(&handlers.ConfigureAuthRealm{db})))
 		mux.Handle("/admin/requestAuthSession", prometheus.InstrumentHandler("requestAuthSession", util.MakeJSONAPI(&handlers.RequestAuthSession{db})))
 		mux.Handle("/admin/removeAuthSession", prometheus.InstrumentHandler("removeAuthSession", util.MakeJSONAPI(&handlers.RemoveAuthSession{db})))
@@ -213,6 +293,15 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 	if err := polling.Start(); err != nil {
 		log.WithError(err).Panic("Failed to start polling")
 	}
+	notify.SetClients(func(userID id.UserID, serviceID string) (types.MatrixClient, error) {
+		service, err := db.LoadService(serviceID)
+		if err != nil {
+			// The service has gone, but its notifications are still sent by its user
+			return matrixClients.Client(userID)
+		}
+		return matrixClients.ServiceClient(service)
+	})
+	notify.Start()
 }
 
 type envVars struct {
@@ -222,6 +311,7 @@ type envVars struct {
 	BaseURL      string
 	LogDir       string
 	ConfigFile   string
+	CanaryRoomID string
 }
 
 func main() {
@@ -232,6 +322,7 @@ func main() {
 		BaseURL:      os.Getenv("BASE_URL"),
 		LogDir:       os.Getenv("LOG_DIR"),
 		ConfigFile:   os.Getenv("CONFIG_FILE"),
+		CanaryRoomID: os.Getenv("CANARY_ROOM_ID"),
 	}
 
 	if e.LogDir != "" {
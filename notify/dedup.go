@@ -0,0 +1,66 @@
+package notify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// The longest deduplication window which rooms can configure.
+const maxDedupWindow = 24 * time.Hour
+
+// Timestamps and times of day, which often differ between two copies of the same event which
+// arrived by different routes, e.g. a webhook and a poll.
+var timestampRegex = regexp.MustCompile(`\d{4}-\d{2}-\d{2}[t ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?(z|[+-]\d{2}:?\d{2})?|\d{1,2}:\d{2}(:\d{2})?`)
+
+type dedupKey struct {
+	roomID id.RoomID
+	hash   string
+}
+
+// The notifications recently sent into each room, and when. Services are loaded afresh for every
+// request, and duplicates usually come from different services, so this is kept globally.
+var (
+	dedupMutex   sync.Mutex
+	recentlySent = make(map[dedupKey]time.Time)
+)
+
+// normalise reduces a message body to the parts which identify the event it describes, so that
+// near-identical messages hash the same.
+func normalise(body string) string {
+	body = strings.ToLower(body)
+	body = timestampRegex.ReplaceAllString(body, "")
+	return strings.Join(strings.Fields(body), " ")
+}
+
+func hashBody(body string) string {
+	h := sha256.Sum256([]byte(normalise(body)))
+	return hex.EncodeToString(h[:])
+}
+
+// duplicate returns true if the same message was sent to the room within the window before now.
+// Otherwise the message is remembered, even if the room has no window, so that later copies are
+// suppressed once the room sets one.
+func duplicate(roomID id.RoomID, body string, window time.Duration, now time.Time) bool {
+	if window > maxDedupWindow {
+		window = maxDedupWindow
+	}
+	dedupMutex.Lock()
+	defer dedupMutex.Unlock()
+	for k, sent := range recentlySent {
+		if now.Sub(sent) > maxDedupWindow {
+			delete(recentlySent, k)
+		}
+	}
+	k := dedupKey{roomID, hashBody(body)}
+	if sent, ok := recentlySent[k]; ok && now.Sub(sent) < window {
+		return true
+	}
+	recentlySent[k] = now
+	return false
+}
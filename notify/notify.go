@@ -0,0 +1,411 @@
+// Package notify delivers the notifications which services send into rooms, following each
+// room's delivery preferences.
+//
+// Rooms configure delivery using the "notifications" key of their bot options (the
+// "m.room.bot.options" state event), keyed by service ID. The "*" entry applies to every service
+// which isn't listed by ID:
+//
+//    {
+//        "notifications": {
+//            "github_service": {
+//                "digest": "daily",
+//                "digest_hour": 9,
+//                "digest_bypass": ["critical"],
+//                "dedup_window_secs": 300,
+//                "follow_ups": "thread",
+//                "quiet_hours": {
+//                    "start": "22:00",
+//                    "end": "07:30",
+//                    "timezone": "Europe/London",
+//                    "bypass": ["critical", "page"]
+//                }
+//            }
+//        }
+//    }
+//
+// Notifications for a room in digest mode are queued in the database and sent as a single
+// summary every hour ("hourly") or once a day at digest_hour UTC ("daily"). Notifications with a
+// severity listed in digest_bypass, which defaults to ["critical"], are still sent immediately.
+//
+// Notifications which are the same as one sent to the room in the last dedup_window_secs, by
+// any service, are dropped. Messages are compared ignoring case, whitespace and timestamps. This
+// stops the same event being posted twice when it arrives both by webhook and by polling.
+//
+// Services can tag notifications with a correlation key, such as the pull request or alert they
+// are about. Later notifications with the same key are posted as follow-ups to the first one, in
+// the way given by follow_ups: "thread" (the default) replies in a thread, "reply" replies to the
+// latest message, "edit" replaces the first message and "none" sends a new message. Queued
+// notifications are never posted as follow-ups. Keys which have had no notifications for 30 days
+// are forgotten, and start a new message again.
+//
+// Notifications sent during a room's quiet hours are held and sent as a single summary when the
+// quiet hours end. Times are in the given IANA timezone, or UTC if none is given. Notifications
+// with a severity listed in the quiet hours' bypass list, which defaults to ["critical"], are
+// delivered as usual.
+package notify
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/templates"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Severity is how important a notification is.
+type Severity string
+
+// The severities which services use. Services may use other values, e.g. the severity label of
+// an alert, which rooms can match on in their options.
+const (
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+// The reasons for which notifications are queued.
+const (
+	reasonDigest     = "digest"
+	reasonQuietHours = "quiet_hours"
+)
+
+// How often queued notifications are checked to see whether they should be sent.
+const flushInterval = time.Minute
+
+// timeNow is replaced in tests.
+var timeNow = time.Now
+
+// A Notification is a message which a service wants to send into a room.
+type Notification struct {
+	RoomID  id.RoomID
+	Content mevt.MessageEventContent
+	// Optional. Defaults to SeverityInfo.
+	Severity Severity
+	// Optional. Identifies what the notification is about, e.g. "github owner/repo#123", so that
+	// notifications about the same thing can be grouped together.
+	CorrelationKey string
+}
+
+// RoomOptions are the delivery preferences of a room for a service.
+type RoomOptions struct {
+	// "hourly" or "daily" to send notifications as a digest rather than immediately.
+	Digest string `json:"digest"`
+	// Optional. The hour of the day, in UTC, at which daily digests are sent. Defaults to 9.
+	DigestHour *int `json:"digest_hour"`
+	// Optional. Notifications with these severities are sent immediately even in digest mode.
+	// Defaults to ["critical"].
+	DigestBypass []Severity `json:"digest_bypass"`
+	// Optional. Notifications which are the same as one sent to the room this many seconds ago
+	// or less are dropped. At most a day. Defaults to 0, which disables deduplication.
+	DedupWindowSecs int `json:"dedup_window_secs"`
+	// Optional. How notifications with the same correlation key as an earlier one are posted:
+	// "thread", "reply", "edit" or "none". Defaults to "thread".
+	FollowUps string `json:"follow_ups"`
+	// Optional. When to hold notifications back.
+	QuietHours *QuietHours `json:"quiet_hours"`
+}
+
+// QuietHours is a period of each day during which notifications are held back.
+type QuietHours struct {
+	// The time of day the quiet hours start, e.g. "22:00".
+	Start string `json:"start"`
+	// The time of day the quiet hours end, e.g. "07:30". This may be earlier than the start
+	// time, in which case the quiet hours span midnight.
+	End string `json:"end"`
+	// Optional. The IANA timezone the times are in, e.g. "Europe/London". Defaults to UTC.
+	Timezone string `json:"timezone"`
+	// Optional. Notifications with these severities are sent during quiet hours.
+	// Defaults to ["critical"].
+	Bypass []Severity `json:"bypass"`
+}
+
+// active returns true if the given time is within the quiet hours. Invalid quiet hours are
+// never active.
+func (q *QuietHours) active(now time.Time) bool {
+	loc, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		log.WithError(err).WithField("timezone", q.Timezone).Error("Invalid quiet hours timezone")
+		return false
+	}
+	start, err := time.Parse("15:04", q.Start)
+	if err != nil {
+		log.WithError(err).WithField("start", q.Start).Error("Invalid quiet hours start time")
+		return false
+	}
+	end, err := time.Parse("15:04", q.End)
+	if err != nil {
+		log.WithError(err).WithField("end", q.End).Error("Invalid quiet hours end time")
+		return false
+	}
+	now = now.In(loc)
+	nowMins := now.Hour()*60 + now.Minute()
+	startMins := start.Hour()*60 + start.Minute()
+	endMins := end.Hour()*60 + end.Minute()
+	if startMins <= endMins {
+		return nowMins >= startMins && nowMins < endMins
+	}
+	return nowMins >= startMins || nowMins < endMins
+}
+
+// holding returns true if a notification with the given severity should be held back at the
+// given time.
+func (o *RoomOptions) holding(severity Severity, now time.Time) bool {
+	if o.QuietHours == nil || !o.QuietHours.active(now) {
+		return false
+	}
+	return !bypasses(o.QuietHours.Bypass, severity)
+}
+
+// bypasses returns true if the severity is in the list, which defaults to ["critical"].
+func bypasses(list []Severity, severity Severity) bool {
+	if list == nil {
+		list = []Severity{SeverityCritical}
+	}
+	for _, s := range list {
+		if strings.EqualFold(string(s), string(severity)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *RoomOptions) digesting(severity Severity) bool {
+	if o.Digest != "hourly" && o.Digest != "daily" {
+		return false
+	}
+	return !bypasses(o.DigestBypass, severity)
+}
+
+// due returns true if notifications queued for the given reason, the oldest of which was queued
+// at the given time, should be sent now.
+func (o *RoomOptions) due(reason string, oldest, now time.Time) bool {
+	if reason == reasonQuietHours {
+		return o.QuietHours == nil || !o.QuietHours.active(now)
+	}
+	return o.digestDue(oldest, now)
+}
+
+// digestDue returns true if a digest whose oldest notification was queued at the given time
+// should be sent now. Digests which are no longer configured are sent straight away.
+func (o *RoomOptions) digestDue(oldest, now time.Time) bool {
+	oldest = oldest.UTC()
+	switch o.Digest {
+	case "hourly":
+		return !now.Before(oldest.Truncate(time.Hour).Add(time.Hour))
+	case "daily":
+		hour := 9
+		if o.DigestHour != nil {
+			hour = *o.DigestHour
+		}
+		next := time.Date(oldest.Year(), oldest.Month(), oldest.Day(), hour, 0, 0, 0, time.UTC)
+		if !next.After(oldest) {
+			next = next.AddDate(0, 0, 1)
+		}
+		return !now.Before(next)
+	}
+	return true
+}
+
+// Options returns the delivery preferences of the given room for the given service.
+func Options(userID id.UserID, roomID id.RoomID, serviceID string) RoomOptions {
+	var opts RoomOptions
+	db := database.GetServiceDB()
+	if db == nil {
+		return opts
+	}
+	botOpts, err := db.LoadBotOptions(userID, roomID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithError(err).WithField("room_id", roomID).Error("Failed to load bot options")
+		}
+		return opts
+	}
+	notifOpts, ok := botOpts.Options["notifications"].(map[string]interface{})
+	if !ok {
+		return opts
+	}
+	serviceOpts, ok := notifOpts[serviceID]
+	if !ok {
+		serviceOpts = notifOpts["*"]
+	}
+	if serviceOpts == nil {
+		return opts
+	}
+	// The options were decoded generically, so round-trip them through JSON to get them typed.
+	b, err := json.Marshal(serviceOpts)
+	if err == nil {
+		err = json.Unmarshal(b, &opts)
+	}
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"room_id":    roomID,
+			"service_id": serviceID,
+		}).Error("Invalid notification options")
+		return RoomOptions{}
+	}
+	return opts
+}
+
+// Send delivers a notification from a service, either immediately or later according to the
+// room's preferences. Returns the ID of the event which was sent, which is empty if the
+// notification was queued or dropped.
+func Send(cli types.MatrixClient, service types.Service, n Notification) (id.EventID, error) {
+	if n.Severity == "" {
+		n.Severity = SeverityInfo
+	}
+	opts := Options(service.ServiceUserID(), n.RoomID, service.ServiceID())
+	if duplicate(n.RoomID, n.Content.Body, time.Duration(opts.DedupWindowSecs)*time.Second, timeNow()) {
+		log.WithFields(log.Fields{
+			"room_id":    n.RoomID,
+			"service_id": service.ServiceID(),
+		}).Info("Dropping duplicate notification")
+		return "", nil
+	}
+	reason := ""
+	if opts.holding(n.Severity, timeNow()) {
+		reason = reasonQuietHours
+	} else if opts.digesting(n.Severity) {
+		reason = reasonDigest
+	}
+	if reason != "" {
+		err := database.GetServiceDB().QueueNotification(types.QueuedNotification{
+			UserID:    service.ServiceUserID(),
+			RoomID:    n.RoomID,
+			ServiceID: service.ServiceID(),
+			Reason:    reason,
+			Severity:  string(n.Severity),
+			Content:   n.Content,
+		})
+		if err == nil {
+			return "", nil
+		}
+		// Better to send it now than not at all.
+		log.WithError(err).WithFields(log.Fields{
+			"room_id": n.RoomID,
+			"reason":  reason,
+		}).Error("Failed to queue notification")
+	}
+	return deliver(cli, service, n, opts)
+}
+
+// clientFor returns the client to send queued notifications with.
+var clientFor func(userID id.UserID, serviceID string) (types.MatrixClient, error)
+
+// SetClients sets the function which returns the client to send a user's queued notifications
+// from a service with. It is given rather than the pool of clients, so that services which send
+// notifications don't depend on the clients package, which needs cgo for end-to-end encryption.
+func SetClients(f func(userID id.UserID, serviceID string) (types.MatrixClient, error)) {
+	clientFor = f
+}
+
+// Start sending queued notifications when they are due. Does not block.
+func Start() {
+	go func() {
+		for {
+			flushSafely(timeNow())
+			time.Sleep(flushInterval)
+		}
+	}()
+}
+
+// flushSafely flushes the queue, recovering from panics so that the next flush still happens.
+func flushSafely(now time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithField("panic", r).Errorf("Notification flusher panicked!\n%s", debug.Stack())
+		}
+	}()
+	flush(now)
+}
+
+type queueKey struct {
+	userID    id.UserID
+	roomID    id.RoomID
+	serviceID string
+	reason    string
+}
+
+// flush sends every queued notification which is due at the given time.
+func flush(now time.Time) {
+	queued, err := database.GetServiceDB().LoadQueuedNotifications()
+	if err != nil {
+		log.WithError(err).Error("Failed to load queued notifications")
+		return
+	}
+	// Notifications are loaded oldest first, so the first of each key is the oldest.
+	byKey := make(map[queueKey][]types.QueuedNotification)
+	var keys []queueKey
+	for _, n := range queued {
+		k := queueKey{n.UserID, n.RoomID, n.ServiceID, n.Reason}
+		if _, ok := byKey[k]; !ok {
+			keys = append(keys, k)
+		}
+		byKey[k] = append(byKey[k], n)
+	}
+	for _, k := range keys {
+		notifs := byKey[k]
+		opts := Options(k.userID, k.roomID, k.serviceID)
+		if !opts.due(k.reason, notifs[0].Queued, now) {
+			continue
+		}
+		logger := log.WithFields(log.Fields{
+			"room_id":    k.roomID,
+			"service_id": k.serviceID,
+			"reason":     k.reason,
+		})
+		cli, err := clientFor(k.userID, k.serviceID)
+		if err != nil {
+			logger.WithError(err).Error("Failed to load client for queued notifications")
+			continue
+		}
+		logger.WithField("count", len(notifs)).Info("Sending queued notifications")
+		if _, err = cli.SendMessageEvent(k.roomID, mevt.EventMessage, summary(k.serviceID, k.reason, notifs)); err != nil {
+			// They stay queued, to be sent on the next flush
+			logger.WithError(err).Error("Failed to send queued notifications")
+			continue
+		}
+		err = database.GetServiceDB().DeleteQueuedNotifications(k.userID, k.roomID, k.serviceID, k.reason, notifs[len(notifs)-1].Queued)
+		if err != nil {
+			logger.WithError(err).Error("Failed to delete sent notifications")
+		}
+	}
+}
+
+// summary formats queued notifications into a single message. Operators can override it with a
+// template named "notify.<reason>", e.g. "notify.digest" or "notify.quiet_hours", which is given the service ID and the
+// notifications.
+func summary(serviceID, reason string, notifs []types.QueuedNotification) mevt.MessageEventContent {
+	title := fmt.Sprintf("Digest of %d notifications from %s", len(notifs), serviceID)
+	if reason == reasonQuietHours {
+		title = fmt.Sprintf("%d notifications from %s during quiet hours", len(notifs), serviceID)
+	}
+	body := []string{title}
+	formatted := []string{"<b>" + html.EscapeString(title) + "</b><ul>"}
+	for _, n := range notifs {
+		body = append(body, "• "+n.Content.Body)
+		if n.Content.FormattedBody != "" {
+			formatted = append(formatted, "<li>"+n.Content.FormattedBody+"</li>")
+		} else {
+			formatted = append(formatted, "<li>"+html.EscapeString(n.Content.Body)+"</li>")
+		}
+	}
+	formatted = append(formatted, "</ul>")
+	return templates.Render("notify."+reason, struct {
+		ServiceID     string
+		Notifications []types.QueuedNotification
+	}{serviceID, notifs}, mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.Join(body, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: strings.Join(formatted, ""),
+	})
+}
@@ -0,0 +1,494 @@
+package notify
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	testUserID = id.UserID("@bot:hyrule")
+	testRoomID = id.RoomID("!room:hyrule")
+)
+
+type notifyStorage struct {
+	database.NopStorage
+	options map[string]interface{}
+	queued  []types.QueuedNotification
+	state   map[string][]byte
+	now     time.Time
+}
+
+func (s *notifyStorage) LoadServiceState(serviceID, stateKey string) ([]byte, error) {
+	stateJSON, ok := s.state[serviceID+" "+stateKey]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return stateJSON, nil
+}
+
+func (s *notifyStorage) StoreServiceState(serviceID, stateKey string, stateJSON []byte) error {
+	if s.state == nil {
+		s.state = make(map[string][]byte)
+	}
+	s.state[serviceID+" "+stateKey] = stateJSON
+	return nil
+}
+
+func (s *notifyStorage) DeleteServiceState(serviceID, stateKey string) error {
+	delete(s.state, serviceID+" "+stateKey)
+	return nil
+}
+
+func (s *notifyStorage) LoadBotOptions(userID id.UserID, roomID id.RoomID) (types.BotOptions, error) {
+	return types.BotOptions{UserID: userID, RoomID: roomID, Options: s.options}, nil
+}
+
+func (s *notifyStorage) QueueNotification(n types.QueuedNotification) error {
+	n.Queued = s.now
+	s.queued = append(s.queued, n)
+	return nil
+}
+
+func (s *notifyStorage) LoadQueuedNotifications() ([]types.QueuedNotification, error) {
+	return append([]types.QueuedNotification(nil), s.queued...), nil
+}
+
+func (s *notifyStorage) DeleteQueuedNotifications(userID id.UserID, roomID id.RoomID, serviceID, reason string, until time.Time) error {
+	var kept []types.QueuedNotification
+	for _, n := range s.queued {
+		if n.UserID != userID || n.RoomID != roomID || n.ServiceID != serviceID || n.Reason != reason || n.Queued.After(until) {
+			kept = append(kept, n)
+		}
+	}
+	s.queued = kept
+	return nil
+}
+
+type recordingClient struct {
+	sent []mevt.MessageEventContent
+	raw  []map[string]interface{}
+	// Whether sending fails, as if the homeserver were down
+	failing bool
+}
+
+func (c *recordingClient) JoinRoom(roomIDorAlias, serverName string, content interface{}) (*mautrix.RespJoinRoom, error) {
+	return &mautrix.RespJoinRoom{}, nil
+}
+
+func (c *recordingClient) SendMessageEvent(roomID id.RoomID, eventType mevt.Type, contentJSON interface{},
+	extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
+	if c.failing {
+		return nil, fmt.Errorf("Homeserver is down")
+	}
+	b, err := json.Marshal(contentJSON)
+	if err != nil {
+		return nil, err
+	}
+	var content mevt.MessageEventContent
+	var raw map[string]interface{}
+	if err = json.Unmarshal(b, &content); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	c.sent = append(c.sent, content)
+	c.raw = append(c.raw, raw)
+	return &mautrix.RespSendEvent{EventID: id.EventID(fmt.Sprintf("$%d", len(c.sent)))}, nil
+}
+
+func (c *recordingClient) UploadLink(link string) (*mautrix.RespMediaUpload, error) {
+	return &mautrix.RespMediaUpload{}, nil
+}
+
+type testService struct {
+	types.DefaultService
+}
+
+func TestDigest(t *testing.T) {
+	start := time.Date(2020, 6, 1, 10, 30, 0, 0, time.UTC)
+	store := &notifyStorage{
+		options: map[string]interface{}{
+			"notifications": map[string]interface{}{
+				"*": map[string]interface{}{"digest": "hourly"},
+			},
+		},
+		now: start,
+	}
+	database.SetServiceDB(store)
+	cli := &recordingClient{}
+	clientFor = func(userID id.UserID, serviceID string) (types.MatrixClient, error) {
+		return cli, nil
+	}
+	srv := &testService{types.NewDefaultService("github_service", testUserID, "github")}
+
+	for _, body := range []string{"first", "second"} {
+		_, err := Send(cli, srv, Notification{
+			RoomID:  testRoomID,
+			Content: mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: body},
+		})
+		if err != nil {
+			t.Fatalf("Send returned an error: %s", err)
+		}
+	}
+	if len(cli.sent) != 0 || len(store.queued) != 2 {
+		t.Fatalf("Expected 2 queued and 0 sent notifications, got %d queued and %d sent", len(store.queued), len(cli.sent))
+	}
+
+	// critical notifications bypass the digest
+	_, err := Send(cli, srv, Notification{
+		RoomID:   testRoomID,
+		Content:  mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "urgent"},
+		Severity: SeverityCritical,
+	})
+	if err != nil {
+		t.Fatalf("Send returned an error: %s", err)
+	}
+	if len(cli.sent) != 1 || cli.sent[0].Body != "urgent" {
+		t.Fatalf("Expected the critical notification to be sent immediately, got %+v", cli.sent)
+	}
+
+	flush(start.Add(20 * time.Minute))
+	if len(cli.sent) != 1 {
+		t.Fatalf("Digest was sent before it was due: %+v", cli.sent)
+	}
+
+	// The digest stays queued if it can't be sent
+	cli.failing = true
+	flush(start.Add(30 * time.Minute))
+	cli.failing = false
+	if len(store.queued) != 2 {
+		t.Fatalf("Expected the digest to stay queued when it failed to send, got %+v", store.queued)
+	}
+
+	flush(start.Add(31 * time.Minute))
+	if len(cli.sent) != 2 {
+		t.Fatalf("Expected digest to be sent on the hour, got %+v", cli.sent)
+	}
+	digest := cli.sent[1]
+	if !strings.Contains(digest.Body, "first") || !strings.Contains(digest.Body, "second") {
+		t.Errorf("Digest is missing notifications: %s", digest.Body)
+	}
+	if len(store.queued) != 0 {
+		t.Errorf("Expected the queue to be empty after sending the digest, got %+v", store.queued)
+	}
+}
+
+func TestDigestDue(t *testing.T) {
+	hour := 9
+	oldest := time.Date(2020, 6, 1, 10, 30, 0, 0, time.UTC)
+	testCases := []struct {
+		opts RoomOptions
+		now  time.Time
+		want bool
+	}{
+		{RoomOptions{Digest: "hourly"}, oldest.Add(29 * time.Minute), false},
+		{RoomOptions{Digest: "hourly"}, oldest.Add(30 * time.Minute), true},
+		{RoomOptions{Digest: "daily", DigestHour: &hour}, oldest.Add(12 * time.Hour), false},
+		{RoomOptions{Digest: "daily", DigestHour: &hour}, oldest.Add(22*time.Hour + 30*time.Minute), true},
+		{RoomOptions{Digest: "daily"}, oldest.Add(22*time.Hour + 30*time.Minute), true},
+		// digest mode has been turned off since the notification was queued
+		{RoomOptions{}, oldest, true},
+	}
+	for _, tc := range testCases {
+		if got := tc.opts.digestDue(oldest, tc.now); got != tc.want {
+			t.Errorf("digestDue(%+v, %s): want %v, got %v", tc.opts, tc.now, tc.want, got)
+		}
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	// 23:30 in London, during British Summer Time
+	night := time.Date(2020, 6, 1, 22, 30, 0, 0, time.UTC)
+	store := &notifyStorage{
+		options: map[string]interface{}{
+			"notifications": map[string]interface{}{
+				"github_service": map[string]interface{}{
+					"quiet_hours": map[string]interface{}{
+						"start":    "22:00",
+						"end":      "07:30",
+						"timezone": "Europe/London",
+						"bypass":   []interface{}{"page"},
+					},
+				},
+			},
+		},
+		now: night,
+	}
+	database.SetServiceDB(store)
+	cli := &recordingClient{}
+	clientFor = func(userID id.UserID, serviceID string) (types.MatrixClient, error) {
+		return cli, nil
+	}
+	timeNow = func() time.Time { return night }
+	defer func() { timeNow = time.Now }()
+	srv := &testService{types.NewDefaultService("github_service", testUserID, "github")}
+
+	for _, severity := range []Severity{SeverityInfo, SeverityCritical, "page"} {
+		_, err := Send(cli, srv, Notification{
+			RoomID:   testRoomID,
+			Content:  mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: string(severity)},
+			Severity: severity,
+		})
+		if err != nil {
+			t.Fatalf("Send returned an error: %s", err)
+		}
+	}
+	if len(cli.sent) != 1 || cli.sent[0].Body != "page" {
+		t.Fatalf("Expected only the page to be sent during quiet hours, got %+v", cli.sent)
+	}
+	if len(store.queued) != 2 {
+		t.Fatalf("Expected 2 held notifications, got %+v", store.queued)
+	}
+
+	// 07:29 in London
+	flush(time.Date(2020, 6, 2, 6, 29, 0, 0, time.UTC))
+	if len(cli.sent) != 1 {
+		t.Fatalf("Held notifications were sent during quiet hours: %+v", cli.sent)
+	}
+	// 07:30 in London
+	flush(time.Date(2020, 6, 2, 6, 30, 0, 0, time.UTC))
+	if len(cli.sent) != 2 {
+		t.Fatalf("Expected held notifications to be sent when quiet hours ended, got %+v", cli.sent)
+	}
+	if body := cli.sent[1].Body; !strings.Contains(body, "info") || !strings.Contains(body, "critical") {
+		t.Errorf("Quiet hours summary is missing notifications: %s", body)
+	}
+}
+
+func TestQuietHoursActive(t *testing.T) {
+	testCases := []struct {
+		quiet QuietHours
+		now   time.Time
+		want  bool
+	}{
+		{QuietHours{Start: "09:00", End: "17:00"}, time.Date(2020, 1, 1, 8, 59, 0, 0, time.UTC), false},
+		{QuietHours{Start: "09:00", End: "17:00"}, time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC), true},
+		{QuietHours{Start: "09:00", End: "17:00"}, time.Date(2020, 1, 1, 17, 0, 0, 0, time.UTC), false},
+		{QuietHours{Start: "22:00", End: "07:00"}, time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC), true},
+		{QuietHours{Start: "22:00", End: "07:00"}, time.Date(2020, 1, 1, 3, 0, 0, 0, time.UTC), true},
+		{QuietHours{Start: "22:00", End: "07:00"}, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), false},
+		// 23:00 in New York
+		{QuietHours{Start: "22:00", End: "07:00", Timezone: "America/New_York"}, time.Date(2020, 1, 2, 4, 0, 0, 0, time.UTC), true},
+		{QuietHours{Start: "22:00", End: "07:00", Timezone: "Not/A_Zone"}, time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC), false},
+		{QuietHours{Start: "ten", End: "07:00"}, time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC), false},
+	}
+	for _, tc := range testCases {
+		if got := tc.quiet.active(tc.now); got != tc.want {
+			t.Errorf("active(%+v, %s): want %v, got %v", tc.quiet, tc.now, tc.want, got)
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	store := &notifyStorage{
+		options: map[string]interface{}{
+			"notifications": map[string]interface{}{
+				"*": map[string]interface{}{"dedup_window_secs": 60},
+			},
+		},
+	}
+	database.SetServiceDB(store)
+	cli := &recordingClient{}
+	now := time.Date(2020, 6, 1, 10, 30, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+	webhook := &testService{types.NewDefaultService("github_webhook", testUserID, "github-webhook")}
+	poller := &testService{types.NewDefaultService("github_poller", testUserID, "github")}
+
+	send := func(srv types.Service, body string) {
+		if _, err := Send(cli, srv, Notification{
+			RoomID:  testRoomID,
+			Content: mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: body},
+		}); err != nil {
+			t.Fatalf("Send returned an error: %s", err)
+		}
+	}
+	send(webhook, "[owner/repo] alice pushed 2 commits at 10:30:01")
+	send(poller, "[Owner/Repo]  alice pushed 2 commits at 10:30:05")
+	send(poller, "[owner/repo] bob pushed 1 commit at 10:30:05")
+	if len(cli.sent) != 2 {
+		t.Fatalf("Expected the near-identical message to be dropped, got %+v", cli.sent)
+	}
+
+	// the same message to another room isn't a duplicate
+	if _, err := Send(cli, poller, Notification{
+		RoomID:  "!other:hyrule",
+		Content: mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "[owner/repo] bob pushed 1 commit"},
+	}); err != nil {
+		t.Fatalf("Send returned an error: %s", err)
+	}
+	if len(cli.sent) != 3 {
+		t.Fatalf("Expected the message to another room to be sent, got %+v", cli.sent)
+	}
+
+	// nor is it once the window has passed
+	now = now.Add(time.Minute)
+	send(webhook, "[owner/repo] alice pushed 2 commits at 10:31:01")
+	if len(cli.sent) != 4 {
+		t.Fatalf("Expected the message to be sent after the window, got %+v", cli.sent)
+	}
+
+	// messages sent while the room has no window are still remembered for when it sets one
+	windowed := store.options["notifications"]
+	delete(store.options, "notifications")
+	send(webhook, "[owner/repo] carol opened an issue")
+	store.options["notifications"] = windowed
+	send(poller, "[owner/repo] carol opened an issue")
+	if len(cli.sent) != 5 {
+		t.Fatalf("Expected the message sent without a window to be remembered, got %+v", cli.sent)
+	}
+}
+
+func TestFollowUps(t *testing.T) {
+	testCases := []struct {
+		followUps string
+		want      []map[string]interface{} // the m.relates_to of each message
+	}{
+		{"", []map[string]interface{}{
+			nil,
+			{"rel_type": "m.thread", "event_id": "$1", "is_falling_back": true, "m.in_reply_to": map[string]interface{}{"event_id": "$1"}},
+			nil,
+			{"rel_type": "m.thread", "event_id": "$1", "is_falling_back": true, "m.in_reply_to": map[string]interface{}{"event_id": "$2"}},
+		}},
+		{"reply", []map[string]interface{}{
+			nil,
+			{"m.in_reply_to": map[string]interface{}{"event_id": "$1"}},
+			nil,
+			{"m.in_reply_to": map[string]interface{}{"event_id": "$2"}},
+		}},
+		{"edit", []map[string]interface{}{
+			nil,
+			{"rel_type": "m.replace", "event_id": "$1"},
+			nil,
+			{"rel_type": "m.replace", "event_id": "$1"},
+		}},
+		{"none", []map[string]interface{}{nil, nil, nil, nil}},
+	}
+	for _, tc := range testCases {
+		database.SetServiceDB(&notifyStorage{
+			options: map[string]interface{}{
+				"notifications": map[string]interface{}{
+					"*": map[string]interface{}{"follow_ups": tc.followUps},
+				},
+			},
+		})
+		cli := &recordingClient{}
+		srv := &testService{types.NewDefaultService("alertmanager_service", testUserID, "alertmanager")}
+		for i, key := range []string{"alert 1", "alert 1", "alert 2", "alert 1"} {
+			_, err := Send(cli, srv, Notification{
+				RoomID:         testRoomID,
+				Content:        mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: fmt.Sprintf("update %d", i)},
+				CorrelationKey: key,
+			})
+			if err != nil {
+				t.Fatalf("Send returned an error: %s", err)
+			}
+		}
+		for i, raw := range cli.raw {
+			got, _ := raw["m.relates_to"].(map[string]interface{})
+			if !reflect.DeepEqual(got, tc.want[i]) {
+				t.Errorf("follow_ups %q message %d: want m.relates_to %v, got %v", tc.followUps, i, tc.want[i], got)
+			}
+		}
+		if tc.followUps == "edit" {
+			newContent, _ := cli.raw[3]["m.new_content"].(map[string]interface{})
+			if cli.raw[3]["body"] != "* update 3" || newContent["body"] != "update 3" {
+				t.Errorf("Edit has the wrong body: %v", cli.raw[3])
+			}
+		}
+	}
+}
+
+// slowClient takes a while to send messages, like a real homeserver, so that concurrent
+// notifications overlap.
+type slowClient struct {
+	*recordingClient
+}
+
+func (c *slowClient) SendMessageEvent(roomID id.RoomID, eventType mevt.Type, contentJSON interface{},
+	extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
+	time.Sleep(time.Millisecond)
+	return c.recordingClient.SendMessageEvent(roomID, eventType, contentJSON, extra...)
+}
+
+func TestConcurrentFollowUps(t *testing.T) {
+	database.SetServiceDB(&notifyStorage{})
+	recording := &recordingClient{}
+	cli := &slowClient{recording}
+	srv := &testService{types.NewDefaultService("alertmanager_service", testUserID, "alertmanager")}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := Send(cli, srv, Notification{
+				RoomID:         testRoomID,
+				Content:        mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: fmt.Sprintf("firing %d", i)},
+				CorrelationKey: "alert 1",
+			}); err != nil {
+				t.Errorf("Send returned an error: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	roots := 0
+	for _, raw := range recording.raw {
+		if _, ok := raw["m.relates_to"]; !ok {
+			roots++
+		}
+	}
+	if len(recording.raw) != 10 || roots != 1 {
+		t.Errorf("Expected 10 messages in one thread, got %d messages and %d threads", len(recording.raw), roots)
+	}
+	if len(threadLocks) != 0 {
+		t.Errorf("Expected the thread locks to be forgotten, got %v", threadLocks)
+	}
+}
+
+func TestThreadsForgotten(t *testing.T) {
+	store := &notifyStorage{}
+	database.SetServiceDB(store)
+	now := time.Date(2020, 6, 1, 10, 30, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+	cli := &recordingClient{}
+	srv := &testService{types.NewDefaultService("alertmanager_service", testUserID, "alertmanager")}
+	send := func(key string) {
+		if _, err := Send(cli, srv, Notification{
+			RoomID:         testRoomID,
+			Content:        mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: key},
+			CorrelationKey: key,
+		}); err != nil {
+			t.Fatalf("Send returned an error: %s", err)
+		}
+	}
+
+	send("alert 1")
+	now = now.Add(threadMemory + time.Hour)
+	send("alert 2")
+	if _, ok := store.state["alertmanager_service "+threadStateKey(testRoomID, "alert 1")]; ok {
+		t.Errorf("Expected the old thread to be forgotten")
+	}
+	if _, ok := store.state["alertmanager_service "+threadStateKey(testRoomID, "alert 2")]; !ok {
+		t.Errorf("Expected the new thread to be remembered")
+	}
+
+	// A notification with a forgotten key starts a new thread
+	send("alert 1")
+	if relatesTo, ok := cli.raw[2]["m.relates_to"]; ok {
+		t.Errorf("Expected a new thread, got m.relates_to %v", relatesTo)
+	}
+}
@@ -0,0 +1,261 @@
+package notify
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The ways follow-ups can be posted, set with the "follow_ups" room option.
+const (
+	followUpThread = "thread"
+	followUpReply  = "reply"
+	followUpEdit   = "edit"
+	followUpNone   = "none"
+)
+
+// How long after its latest notification a correlation key's thread is forgotten, so that the
+// threads of alerts and issues which are long over don't pile up in the database. Notifications
+// with the key after that start a new thread.
+const threadMemory = 30 * 24 * time.Hour
+
+// The state key of each service's index of its threads, from their state keys to when they were
+// last used, which is how forgotten threads are found.
+const threadsStateKey = "notify.threads"
+
+// Services are loaded afresh for every request, so thread indexes are only loaded and stored
+// while holding this.
+var threadsMutex sync.Mutex
+
+// The locks of the threads which are being followed up, keyed by service ID and thread state
+// key. A thread is loaded, followed up and stored while holding its lock, so that notifications
+// with the same correlation key sent at once don't each start a thread or follow up the same
+// message.
+var (
+	threadLocksMutex sync.Mutex
+	threadLocks      = make(map[string]*threadLock)
+)
+
+type threadLock struct {
+	sync.Mutex
+	// How many notifications hold or are waiting for the lock. It is forgotten when none are.
+	users int
+}
+
+// lockThread locks the thread, returning the function which unlocks it.
+func lockThread(serviceID string, roomID id.RoomID, correlationKey string) func() {
+	key := serviceID + " " + threadStateKey(roomID, correlationKey)
+	threadLocksMutex.Lock()
+	l := threadLocks[key]
+	if l == nil {
+		l = &threadLock{}
+		threadLocks[key] = l
+	}
+	l.users++
+	threadLocksMutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		threadLocksMutex.Lock()
+		defer threadLocksMutex.Unlock()
+		if l.users--; l.users == 0 {
+			delete(threadLocks, key)
+		}
+	}
+}
+
+// thread is the state kept for each correlation key in each room.
+type thread struct {
+	// The first message sent with the correlation key.
+	RootEventID id.EventID
+	// The latest message sent with the correlation key.
+	LastEventID id.EventID
+	// When the latest message was sent.
+	Updated time.Time
+}
+
+func threadStateKey(roomID id.RoomID, correlationKey string) string {
+	return "notify.thread " + roomID.String() + " " + correlationKey
+}
+
+func loadThread(serviceID string, roomID id.RoomID, correlationKey string) (*thread, error) {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(serviceID, threadStateKey(roomID, correlationKey))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var t thread
+	if err := json.Unmarshal(stateJSON, &t); err != nil {
+		return nil, err
+	}
+	if timeNow().Sub(t.Updated) > threadMemory {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+func storeThread(serviceID string, roomID id.RoomID, correlationKey string, t *thread) error {
+	stateJSON, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	stateKey := threadStateKey(roomID, correlationKey)
+	if err = database.GetServiceDB().StoreServiceState(serviceID, stateKey, stateJSON); err != nil {
+		return err
+	}
+	return indexThread(serviceID, stateKey, t.Updated)
+}
+
+// indexThread records when the thread was last used in the service's index of threads, and
+// forgets the threads which haven't been used for threadMemory.
+func indexThread(serviceID, stateKey string, updated time.Time) error {
+	threadsMutex.Lock()
+	defer threadsMutex.Unlock()
+	db := database.GetServiceDB()
+	index := make(map[string]time.Time)
+	stateJSON, err := db.LoadServiceState(serviceID, threadsStateKey)
+	if err == nil {
+		err = json.Unmarshal(stateJSON, &index)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	for key, used := range index {
+		if updated.Sub(used) <= threadMemory {
+			continue
+		}
+		if err = db.DeleteServiceState(serviceID, key); err != nil {
+			return err
+		}
+		delete(index, key)
+	}
+	index[stateKey] = updated
+	if stateJSON, err = json.Marshal(index); err != nil {
+		return err
+	}
+	return db.StoreServiceState(serviceID, threadsStateKey, stateJSON)
+}
+
+// followUp turns the content into a follow-up to the thread, in the given way.
+func followUp(mode string, content mevt.MessageEventContent, t *thread) (map[string]interface{}, error) {
+	switch mode {
+	case followUpReply:
+		return ReplyContent(t.LastEventID, content)
+	case followUpEdit:
+		return EditContent(t.RootEventID, content)
+	default:
+		return ThreadReplyContent(t.RootEventID, t.LastEventID, content)
+	}
+}
+
+func rawContent(content mevt.MessageEventContent) (map[string]interface{}, error) {
+	b, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	err = json.Unmarshal(b, &raw)
+	return raw, err
+}
+
+// ReplyContent returns the content of a message which replies to the given event.
+func ReplyContent(inReplyTo id.EventID, content mevt.MessageEventContent) (map[string]interface{}, error) {
+	raw, err := rawContent(content)
+	if err != nil {
+		return nil, err
+	}
+	raw["m.relates_to"] = map[string]interface{}{
+		"m.in_reply_to": map[string]interface{}{"event_id": inReplyTo},
+	}
+	return raw, nil
+}
+
+// ThreadReplyContent returns the content of a message in the thread under the root event.
+// Clients without thread support show it as a reply to the inReplyTo event.
+func ThreadReplyContent(root, inReplyTo id.EventID, content mevt.MessageEventContent) (map[string]interface{}, error) {
+	raw, err := rawContent(content)
+	if err != nil {
+		return nil, err
+	}
+	raw["m.relates_to"] = map[string]interface{}{
+		"rel_type":        "m.thread",
+		"event_id":        root,
+		"is_falling_back": true,
+		"m.in_reply_to":   map[string]interface{}{"event_id": inReplyTo},
+	}
+	return raw, nil
+}
+
+// EditContent returns the content of a message which replaces the given event with the content.
+func EditContent(original id.EventID, content mevt.MessageEventContent) (map[string]interface{}, error) {
+	raw, err := rawContent(content)
+	if err != nil {
+		return nil, err
+	}
+	newContent := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		newContent[k] = v
+	}
+	raw["m.new_content"] = newContent
+	raw["body"] = "* " + content.Body
+	if content.FormattedBody != "" {
+		raw["formatted_body"] = "* " + content.FormattedBody
+	}
+	raw["m.relates_to"] = map[string]interface{}{
+		"rel_type": "m.replace",
+		"event_id": original,
+	}
+	return raw, nil
+}
+
+// deliver sends a notification, posting it as a follow-up if an earlier notification had the
+// same correlation key.
+func deliver(cli types.MatrixClient, service types.Service, n Notification, opts RoomOptions) (id.EventID, error) {
+	if n.CorrelationKey == "" || opts.FollowUps == followUpNone {
+		resp, err := cli.SendMessageEvent(n.RoomID, mevt.EventMessage, n.Content)
+		if err != nil {
+			return "", err
+		}
+		return resp.EventID, nil
+	}
+	logger := log.WithFields(log.Fields{
+		"room_id":         n.RoomID,
+		"service_id":      service.ServiceID(),
+		"correlation_key": n.CorrelationKey,
+	})
+	defer lockThread(service.ServiceID(), n.RoomID, n.CorrelationKey)()
+	t, err := loadThread(service.ServiceID(), n.RoomID, n.CorrelationKey)
+	if err != nil {
+		// Not being able to thread the message is no reason not to send it.
+		logger.WithError(err).Error("Failed to load notification thread")
+	}
+	var content interface{} = n.Content
+	if t != nil {
+		if content, err = followUp(opts.FollowUps, n.Content, t); err != nil {
+			return "", err
+		}
+	}
+	resp, err := cli.SendMessageEvent(n.RoomID, mevt.EventMessage, content)
+	if err != nil {
+		return "", err
+	}
+	if t == nil {
+		t = &thread{RootEventID: resp.EventID, LastEventID: resp.EventID}
+	} else if opts.FollowUps != followUpEdit {
+		t.LastEventID = resp.EventID
+	}
+	t.Updated = timeNow()
+	if err = storeThread(service.ServiceID(), n.RoomID, n.CorrelationKey, t); err != nil {
+		logger.WithError(err).Error("Failed to store notification thread")
+	}
+	return resp.EventID, nil
+}
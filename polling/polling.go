@@ -90,7 +90,7 @@ func pollLoop(service types.Service, ts int64) {
 		return
 	}
 	logger.Info("Starting polling loop")
-	cli, err := clientPool.Client(service.ServiceUserID())
+	cli, err := clientPool.ServiceClient(service)
 	if err != nil {
 		logger.WithError(err).WithField("user_id", service.ServiceUserID()).Error("Poll setup failed: failed to load client")
 		return
@@ -0,0 +1,334 @@
+// Package imgur implements OAuth2 support for imgur.com
+package imgur
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// RealmType of the Imgur Realm
+const RealmType = "imgur"
+
+var httpClient = &http.Client{}
+
+// Realm can handle OAuth processes with imgur.com
+//
+// Imgur does not let the redirect URL be picked when authorising, so the "Authorization callback
+// URL" of the Imgur application must be set to the redirect URL of this realm, which is
+// BASE_URL/realms/redirects/$REALM_ID_BASE64.
+//
+// Example request:
+//  {
+//      "ClientSecret": "YOUR_CLIENT_SECRET",
+//      "ClientID": "YOUR_CLIENT_ID"
+//  }
+type Realm struct {
+	id          string
+	redirectURL string
+
+	// The client secret for this Imgur application.
+	ClientSecret string
+	// The client ID for this Imgur application.
+	ClientID string
+	// Optional. The URL to redirect the client to after authentication.
+	StarterLink string
+}
+
+// Session represents an authenticated imgur session
+type Session struct {
+	id      string
+	userID  id.UserID
+	realmID string
+
+	// AccessToken is the imgur access token for the user
+	AccessToken string
+	// RefreshToken is used to get a new AccessToken once it expires
+	RefreshToken string
+	// ExpiresAt is the unix timestamp when the AccessToken expires
+	ExpiresAt int64
+	// AccountUsername is the imgur username of the account the user authorised with
+	AccountUsername string
+	// Optional. The client-supplied URL to redirect them to after the auth process is complete.
+	ClientsRedirectURL string
+}
+
+// AuthRequest is a request for authenticating with imgur.com
+type AuthRequest struct {
+	// Optional. The URL to redirect to after authentication.
+	RedirectURL string
+}
+
+// AuthResponse is a response to an AuthRequest.
+type AuthResponse struct {
+	// The URL to visit to perform OAuth on imgur.com
+	URL string
+}
+
+// tokenResponse is imgur's response when exchanging a code or refresh token for an access token
+type tokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	RefreshToken    string `json:"refresh_token"`
+	ExpiresIn       int64  `json:"expires_in"`
+	AccountUsername string `json:"account_username"`
+}
+
+// Authenticated returns true if the user has completed the auth process
+func (s *Session) Authenticated() bool {
+	return s.AccessToken != ""
+}
+
+// Info returns the imgur account which the user authorised with.
+func (s *Session) Info() interface{} {
+	return struct {
+		AccountUsername string
+	}{s.AccountUsername}
+}
+
+// UserID returns the user_id who authorised with Imgur
+func (s *Session) UserID() id.UserID {
+	return s.userID
+}
+
+// RealmID returns the realm ID of the realm which performed the authentication
+func (s *Session) RealmID() string {
+	return s.realmID
+}
+
+// ID returns the session ID
+func (s *Session) ID() string {
+	return s.id
+}
+
+// ID returns the realm ID
+func (r *Realm) ID() string {
+	return r.id
+}
+
+// Type is imgur
+func (r *Realm) Type() string {
+	return RealmType
+}
+
+// Init does nothing.
+func (r *Realm) Init() error {
+	return nil
+}
+
+// Register does nothing.
+func (r *Realm) Register() error {
+	return nil
+}
+
+// RequestAuthSession generates an OAuth2 URL for this user to auth with imgur via.
+// The request body is of type "imgur.AuthRequest". The response is of type "imgur.AuthResponse".
+//
+// Request example:
+//   {
+//       "RedirectURL": "https://optional-url.com/to/redirect/to/after/auth"
+//   }
+//
+// Response example:
+//   {
+//       "URL": "https://api.imgur.com/oauth2/authorize?client_id=abcdef&response_type=code&state=...."
+//   }
+func (r *Realm) RequestAuthSession(userID id.UserID, req json.RawMessage) interface{} {
+	state, err := randomString(10)
+	if err != nil {
+		log.WithError(err).Print("Failed to generate state param")
+		return nil
+	}
+
+	u, _ := url.Parse("https://api.imgur.com/oauth2/authorize")
+	q := u.Query()
+	q.Set("client_id", r.ClientID)
+	q.Set("response_type", "code")
+	q.Set("state", state)
+	u.RawQuery = q.Encode()
+	session := &Session{
+		id:      state, // key off the state for redirects
+		userID:  userID,
+		realmID: r.ID(),
+	}
+
+	// check if they supplied a redirect URL
+	var reqBody AuthRequest
+	if err = json.Unmarshal(req, &reqBody); err != nil {
+		log.WithError(err).Print("Failed to decode request body")
+		return nil
+	}
+	session.ClientsRedirectURL = reqBody.RedirectURL
+	log.WithFields(log.Fields{
+		"clients_redirect_url": session.ClientsRedirectURL,
+		"redirect_url":         u.String(),
+	}).Print("RequestAuthSession: Performing redirect")
+
+	_, err = database.GetServiceDB().StoreAuthSession(session)
+	if err != nil {
+		log.WithError(err).Print("Failed to store new auth session")
+		return nil
+	}
+
+	return &AuthResponse{u.String()}
+}
+
+// OnReceiveRedirect processes OAuth redirect requests from Imgur
+func (r *Realm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {
+	// parse out params from the request
+	code := req.URL.Query().Get("code")
+	state := req.URL.Query().Get("state")
+	logger := log.WithFields(log.Fields{
+		"state": state,
+	})
+	logger.WithField("code", code).Print("ImgurRealm: OnReceiveRedirect")
+	if code == "" || state == "" {
+		failWith(logger, w, 400, "code and state are required", nil)
+		return
+	}
+	// load the session (we keyed off the state param)
+	session, err := database.GetServiceDB().LoadAuthSessionByID(r.ID(), state)
+	if err != nil {
+		// most likely cause
+		failWith(logger, w, 400, "Provided ?state= param is not recognised.", err)
+		return
+	}
+	imgurSession, ok := session.(*Session)
+	if !ok {
+		failWith(logger, w, 500, "Unexpected session found.", nil)
+		return
+	}
+	logger.WithField("user_id", imgurSession.UserID()).Print("Mapped redirect to user")
+
+	if imgurSession.AccessToken != "" {
+		r.redirectOr(w, 400, "You have already authenticated with Imgur", logger, imgurSession)
+		return
+	}
+
+	// exchange code for access_token
+	token, err := r.requestToken(url.Values{"grant_type": {"authorization_code"}, "code": {code}})
+	if err != nil {
+		failWith(logger, w, 502, "Failed to exchange code for token", err)
+		return
+	}
+
+	// update database and return
+	imgurSession.setToken(token)
+	logger.WithField("account", imgurSession.AccountUsername).Print("Imgur account linked.")
+	_, err = database.GetServiceDB().StoreAuthSession(imgurSession)
+	if err != nil {
+		failWith(logger, w, 500, "Failed to persist session", err)
+		return
+	}
+	r.redirectOr(
+		w, 200, "You have successfully linked your Imgur account to "+imgurSession.UserID().String(), logger, imgurSession,
+	)
+}
+
+// AccessToken returns a current access token for the session, refreshing it first if it has
+// expired.
+func (r *Realm) AccessToken(session *Session) (string, error) {
+	if session.AccessToken == "" {
+		return "", fmt.Errorf("Imgur auth session for %s has not been completed", session.UserID())
+	}
+	// Refresh a little early so the token doesn't expire mid-request
+	if session.ExpiresAt == 0 || time.Now().Add(time.Minute).Unix() < session.ExpiresAt {
+		return session.AccessToken, nil
+	}
+	token, err := r.requestToken(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {session.RefreshToken}})
+	if err != nil {
+		return "", fmt.Errorf("Failed to refresh Imgur access token: %s", err)
+	}
+	session.setToken(token)
+	if _, err = database.GetServiceDB().StoreAuthSession(session); err != nil {
+		return "", err
+	}
+	return session.AccessToken, nil
+}
+
+// requestToken asks imgur for an access token using the given grant
+func (r *Realm) requestToken(grant url.Values) (*tokenResponse, error) {
+	grant.Set("client_id", r.ClientID)
+	grant.Set("client_secret", r.ClientSecret)
+	res, err := httpClient.PostForm("https://api.imgur.com/oauth2/token", grant)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Imgur responded with HTTP %d", res.StatusCode)
+	}
+	var token tokenResponse
+	if err = json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("Imgur did not return an access token")
+	}
+	return &token, nil
+}
+
+func (s *Session) setToken(token *tokenResponse) {
+	s.AccessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		s.RefreshToken = token.RefreshToken
+	}
+	if token.AccountUsername != "" {
+		s.AccountUsername = token.AccountUsername
+	}
+	s.ExpiresAt = 0
+	if token.ExpiresIn > 0 {
+		s.ExpiresAt = time.Now().Unix() + token.ExpiresIn
+	}
+}
+
+func (r *Realm) redirectOr(w http.ResponseWriter, code int, msg string, logger *log.Entry, imgurSession *Session) {
+	if imgurSession.ClientsRedirectURL != "" {
+		w.Header().Set("Location", imgurSession.ClientsRedirectURL)
+		w.WriteHeader(302)
+		// technically don't need a body but *shrug*
+		w.Write([]byte(imgurSession.ClientsRedirectURL))
+	} else {
+		failWith(logger, w, code, msg, nil)
+	}
+}
+
+// AuthSession returns an Imgur Session for this user
+func (r *Realm) AuthSession(id string, userID id.UserID, realmID string) types.AuthSession {
+	return &Session{
+		id:      id,
+		userID:  userID,
+		realmID: realmID,
+	}
+}
+
+func failWith(logger *log.Entry, w http.ResponseWriter, code int, msg string, err error) {
+	logger.WithError(err).Print(msg)
+	w.WriteHeader(code)
+	w.Write([]byte(msg))
+}
+
+// Generate a cryptographically secure pseudorandom string with the given number of bytes (length).
+// Returns a hex string of the bytes.
+func randomString(length int) (string, error) {
+	b := make([]byte, length)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func init() {
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &Realm{id: realmID, redirectURL: redirectURL}
+	})
+}
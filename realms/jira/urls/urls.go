@@ -2,7 +2,7 @@
 // types of JIRA URL which Go-NEB cares about:
 //    - URL Keys => matrix.org/jira
 //    - Base URLs => https://matrix.org/jira/
-//    - REST URLs => https://matrix.org/jira/rest/api/2/issue/12680
+//    - REST URLs => https://matrix.org/jira/rest/api/2/issue/12680 or https://matrix.org/jira/rest/agile/1.0/sprint/5
 // When making outbound requests to JIRA, Go-NEB needs to use the Base URL representation. Likewise, when Go-NEB
 // sends Matrix messages with JIRA URLs in them, the Base URL needs to be used to form the URL. The URL Key is
 // used to determine equivalence of various JIRA installations and is mainly required when searching the database.
@@ -46,6 +46,9 @@ func ParseJIRAURL(u string) (j JIRAURL, err error) {
 	// Attempt to parse out REST API paths. This is a horrible heuristic which mostly works.
 	if strings.Contains(u, "/rest/api/") {
 		j.Base = makeBaseURL(strings.Split(u, "/rest/api/")[0])
+	} else if strings.Contains(u, "/rest/agile/") {
+		// JIRA Software (e.g. sprint) REST URLs
+		j.Base = makeBaseURL(strings.Split(u, "/rest/agile/")[0])
 	} else {
 		// Assume it already is a base URL
 		j.Base = makeBaseURL(u)
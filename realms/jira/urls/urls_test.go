@@ -16,6 +16,7 @@ var urltests = []struct {
 	{"https://matrix.org/jira/", "https://matrix.org/jira/", "matrix.org/jira", "https://matrix.org/jira/"},
 	// valid rest url as input
 	{"https://matrix.org/jira/rest/api/2/issue/12680", "https://matrix.org/jira/", "matrix.org/jira", "https://matrix.org/jira/rest/api/2/issue/12680"},
+	{"https://matrix.org/jira/rest/agile/1.0/sprint/5", "https://matrix.org/jira/", "matrix.org/jira", "https://matrix.org/jira/rest/agile/1.0/sprint/5"},
 	// missing trailing slash as input
 	{"https://matrix.org/jira", "https://matrix.org/jira/", "matrix.org/jira", "https://matrix.org/jira"},
 	// missing protocol but with trailing slash
@@ -0,0 +1,140 @@
+// Package schedule works out when things which recur on a schedule, such as announcements, are due.
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule is when something recurs, in the timezone it is used with.
+//
+// Examples:
+//   { "every": "weekday", "at": "09:30" }
+//   { "every": "week", "on": ["Monday", "Thursday"], "at": "10:00" }
+//   { "every": "week", "on": ["Monday"], "interval": 2 }
+//   { "every": "month", "day_of_month": 1, "at": "12:00" }
+type Schedule struct {
+	// "day", "weekday" (Monday to Friday), "week" or "month".
+	Every string `json:"every"`
+	// The days of the week for "week" schedules, e.g. ["Monday"]. Defaults to Monday.
+	On []string `json:"on"`
+	// Optional. Only recur every this many weeks, for "week" schedules. E.g. 2 for fortnightly sprints.
+	Interval int `json:"interval"`
+	// The day of the month for "month" schedules, 1-28. Defaults to the 1st.
+	DayOfMonth int `json:"day_of_month"`
+	// The time of day, as "15:04" in the room's timezone. Defaults to "09:00".
+	At string `json:"at"`
+}
+
+// Check returns an error if the schedule is misconfigured.
+func (s *Schedule) Check() error {
+	switch s.Every {
+	case "day", "weekday", "week", "month":
+	default:
+		return fmt.Errorf("'every' must be one of day, weekday, week or month, not '%s'", s.Every)
+	}
+	if _, err := s.weekdays(); err != nil {
+		return err
+	}
+	if s.Interval < 0 {
+		return fmt.Errorf("Bad interval %d", s.Interval)
+	}
+	if s.DayOfMonth < 0 || s.DayOfMonth > 28 {
+		return fmt.Errorf("day_of_month must be between 1 and 28, got %d", s.DayOfMonth)
+	}
+	_, _, err := s.timeOfDay()
+	return err
+}
+
+func (s *Schedule) timeOfDay() (hour, min int, err error) {
+	if s.At == "" {
+		return 9, 0, nil
+	}
+	t, err := time.Parse("15:04", s.At)
+	if err != nil {
+		return 0, 0, fmt.Errorf("'at' must be a time like 15:04, not '%s'", s.At)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+func (s *Schedule) weekdays() (map[time.Weekday]bool, error) {
+	days := make(map[time.Weekday]bool)
+	if len(s.On) == 0 {
+		days[time.Monday] = true
+		return days, nil
+	}
+	for _, name := range s.On {
+		found := false
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if strings.EqualFold(d.String(), name) {
+				days[d] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("'%s' is not a day of the week", name)
+		}
+	}
+	return days, nil
+}
+
+// matches returns true if the schedule recurs on the day of t.
+func (s *Schedule) matches(t time.Time, days map[time.Weekday]bool) bool {
+	switch s.Every {
+	case "weekday":
+		return t.Weekday() != time.Saturday && t.Weekday() != time.Sunday
+	case "week":
+		return days[t.Weekday()]
+	case "month":
+		dom := s.DayOfMonth
+		if dom == 0 {
+			dom = 1
+		}
+		return t.Day() == dom
+	}
+	return true
+}
+
+// Next returns the first time after now that the schedule recurs, in the given location. prev
+// is when it last recurred, or zero if it never has. "week" schedules with an interval recur in
+// the week of prev, and then every interval weeks after it.
+func (s *Schedule) Next(now, prev time.Time, loc *time.Location) (time.Time, error) {
+	hour, min, err := s.timeOfDay()
+	if err != nil {
+		return time.Time{}, err
+	}
+	days, err := s.weekdays()
+	if err != nil {
+		return time.Time{}, err
+	}
+	next, err := s.firstAfter(now.In(loc), hour, min, days)
+	if err != nil || s.Every != "week" || s.Interval < 2 || prev.IsZero() {
+		return next, err
+	}
+	prevWeek := weekStart(prev.In(loc))
+	if weekStart(next).Equal(prevWeek) {
+		return next, nil
+	}
+	if skipTo := prevWeek.AddDate(0, 0, 7*s.Interval); next.Before(skipTo) {
+		return s.firstAfter(skipTo.Add(-time.Second), hour, min, days)
+	}
+	return next, nil
+}
+
+func (s *Schedule) firstAfter(t time.Time, hour, min int, days map[time.Weekday]bool) (time.Time, error) {
+	// Every schedule recurs within a couple of months, so this always finds the next time.
+	for i := 0; i < 62; i++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+i, hour, min, 0, 0, t.Location())
+		if day.After(t) && s.matches(day, days) {
+			return day, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Schedule never recurs")
+}
+
+// weekStart returns midnight on the Monday of the week of t.
+func weekStart(t time.Time) time.Time {
+	offset := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,50 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("No timezone database: ", err)
+	}
+	// 2021-06-04 was a Friday
+	now := time.Date(2021, 6, 4, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		schedule Schedule
+		prev     time.Time
+		loc      *time.Location
+		want     time.Time
+	}{
+		{Schedule{Every: "day"}, time.Time{}, time.UTC, time.Date(2021, 6, 5, 9, 0, 0, 0, time.UTC)},
+		{Schedule{Every: "day", At: "13:30"}, time.Time{}, time.UTC, time.Date(2021, 6, 4, 13, 30, 0, 0, time.UTC)},
+		// 13:30 in London is 12:30 UTC
+		{Schedule{Every: "day", At: "13:30"}, time.Time{}, london, time.Date(2021, 6, 4, 13, 30, 0, 0, london)},
+		{Schedule{Every: "weekday"}, time.Time{}, time.UTC, time.Date(2021, 6, 7, 9, 0, 0, 0, time.UTC)},
+		{Schedule{Every: "week", On: []string{"tuesday", "Thursday"}}, time.Time{}, time.UTC, time.Date(2021, 6, 8, 9, 0, 0, 0, time.UTC)},
+		{Schedule{Every: "month", DayOfMonth: 3}, time.Time{}, time.UTC, time.Date(2021, 7, 3, 9, 0, 0, 0, time.UTC)},
+		// Fortnightly: last posted on Monday 31st May, so not on the 7th
+		{Schedule{Every: "week", Interval: 2}, time.Date(2021, 5, 31, 9, 0, 0, 0, time.UTC), time.UTC, time.Date(2021, 6, 14, 9, 0, 0, 0, time.UTC)},
+		{Schedule{Every: "week", Interval: 2}, time.Date(2021, 5, 24, 9, 0, 0, 0, time.UTC), time.UTC, time.Date(2021, 6, 7, 9, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range testCases {
+		if err := tc.schedule.Check(); err != nil {
+			t.Errorf("Schedule %+v failed check: %s", tc.schedule, err)
+			continue
+		}
+		got, err := tc.schedule.Next(now, tc.prev, tc.loc)
+		if err != nil {
+			t.Errorf("Next(%+v) failed: %s", tc.schedule, err)
+		} else if !got.Equal(tc.want) {
+			t.Errorf("Next(%+v) = %s, want %s", tc.schedule, got, tc.want)
+		}
+	}
+
+	for _, s := range []Schedule{{Every: "year"}, {Every: "week", On: []string{"Someday"}}, {Every: "day", At: "9am"}} {
+		if err := s.Check(); err == nil {
+			t.Errorf("Expected schedule %+v to fail check", s)
+		}
+	}
+}
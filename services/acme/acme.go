@@ -0,0 +1,346 @@
+// Package acme implements a Service which announces new certificates for domains, as seen in
+// certificate transparency logs, and flags the ones from unexpected issuers.
+package acme
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the ACME service
+const ServiceType = "acme"
+
+const (
+	defaultPollInterval = time.Hour
+	minPollIntervalMins = 15
+)
+
+// crt.sh searches the certificate transparency logs. Overridden by tests.
+var crtshURL = "https://crt.sh/"
+
+// crt.sh can be slow to search domains with many certificates
+var httpClient = &http.Client{Timeout: time.Minute}
+
+// Service contains the Config fields for the ACME service.
+//
+// Certificate authorities log every certificate they issue in public certificate transparency
+// logs, which this service searches through crt.sh. New certificates for the domains are announced
+// to the room, so that renewals by Let's Encrypt or another ACME client can be seen to happen.
+// ACME accounts can't list the certificates issued to them, so the logs are the only place which
+// has every certificate, including ones issued to someone else.
+//
+// Certificates from issuers which aren't expected for the domain are flagged, as they can mean
+// that someone else has control of the domain or its DNS. Issuers are matched by part of their
+// name, e.g. "Let's Encrypt" matches "C=US, O=Let's Encrypt, CN=R3". If a domain has no
+// expected issuers, every certificate is expected.
+//
+// The certificates which exist when a domain is added are not announced.
+//
+// Example JSON request:
+//   {
+//       "room_id": "!security:localhost",
+//       "poll_interval_mins": 60,
+//       "domains": {
+//           "example.com": {
+//               "include_subdomains": true,
+//               "expected_issuers": ["Let's Encrypt"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// The room to announce new certificates to.
+	RoomID id.RoomID `json:"room_id"`
+	// Optional. How often to search the logs, in minutes. Defaults to 60, and can't be less than 15.
+	PollIntervalMins int `json:"poll_interval_mins"`
+	// The domains to watch.
+	Domains map[string]Domain `json:"domains"`
+}
+
+// Domain is which certificates are watched for a domain.
+type Domain struct {
+	// Optional. Also watch certificates for subdomains, including wildcards. Defaults to false.
+	IncludeSubdomains bool `json:"include_subdomains"`
+	// Optional. Parts of the names of the issuers which certificates are expected from.
+	ExpectedIssuers []string `json:"expected_issuers"`
+}
+
+// expected returns whether the domain expects certificates from the issuer.
+func (d *Domain) expected(issuer string) bool {
+	if len(d.ExpectedIssuers) == 0 {
+		return true
+	}
+	for _, expected := range d.ExpectedIssuers {
+		if strings.Contains(strings.ToLower(issuer), strings.ToLower(expected)) {
+			return true
+		}
+	}
+	return false
+}
+
+// cert is a certificate from the logs.
+type cert struct {
+	// crt.sh's ID for the certificate
+	ID         int64  `json:"id"`
+	IssuerName string `json:"issuer_name"`
+	// The names in the certificate, one per line
+	NameValue string `json:"name_value"`
+	NotBefore string `json:"not_before"`
+	NotAfter  string `json:"not_after"`
+}
+
+// names returns the names in the certificate, without duplicates.
+func (c *cert) names() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, name := range strings.Split(c.NameValue, "\n") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// notAfter returns when the certificate expires, or the zero time if it isn't known.
+func (c *cert) notAfter() time.Time {
+	t, _ := time.Parse("2006-01-02T15:04:05", c.NotAfter)
+	return t
+}
+
+// seenState is what has been seen in the logs. It is stored in the service state under "seen".
+type seenState struct {
+	// The domains whose existing certificates have been seen
+	Domains map[string]bool `json:"domains"`
+	// The IDs of the certificates which have been seen, and when they expire so they can be
+	// forgotten
+	Certs map[int64]int64 `json:"certs"`
+}
+
+func (s *Service) pollInterval() time.Duration {
+	if s.PollIntervalMins <= 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(s.PollIntervalMins) * time.Minute
+}
+
+// OnPoll searches the logs for every domain and announces the certificates which haven't been
+// seen.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	s.check(cli, time.Now())
+	return time.Now().Add(s.pollInterval())
+}
+
+func (s *Service) check(cli types.MatrixClient, now time.Time) {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	seen, err := s.loadSeen()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load seen certificates")
+		return
+	}
+	for certID, expiresSecs := range seen.Certs {
+		if expiresSecs != 0 && now.Unix() > expiresSecs {
+			delete(seen.Certs, certID)
+		}
+	}
+
+	var names []string
+	for name := range s.Domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		domain := s.Domains[name]
+		certs, err := fetchCerts(name, domain.IncludeSubdomains)
+		if err != nil {
+			logger.WithError(err).WithField("domain", name).Error("Failed to search certificate transparency logs")
+			continue
+		}
+		sort.Slice(certs, func(i, j int) bool { return certs[i].ID < certs[j].ID })
+		announce := seen.Domains[name]
+		seen.Domains[name] = true
+		for _, c := range certs {
+			if _, ok := seen.Certs[c.ID]; ok {
+				continue
+			}
+			var expiresSecs int64
+			if notAfter := c.notAfter(); !notAfter.IsZero() {
+				if now.After(notAfter) {
+					// Forgotten already, and not worth announcing
+					continue
+				}
+				expiresSecs = notAfter.Unix()
+			}
+			seen.Certs[c.ID] = expiresSecs
+			if announce {
+				s.announce(cli, name, &domain, c)
+			}
+		}
+	}
+
+	if err = s.storeSeen(seen); err != nil {
+		logger.WithError(err).Error("Failed to store seen certificates")
+	}
+}
+
+func (s *Service) announce(cli types.MatrixClient, domain string, d *Domain, c cert) {
+	link := fmt.Sprintf("%s?id=%d", crtshURL, c.ID)
+	details := fmt.Sprintf("%s\nIssued by %s, valid from %s until %s\n%s", strings.Join(c.names(), ", "),
+		c.IssuerName, formatDate(c.NotBefore), formatDate(c.NotAfter), link)
+	text := "🔏 New certificate for " + details
+	severity := notify.SeverityInfo
+	if !d.expected(c.IssuerName) {
+		text = fmt.Sprintf("🚨 Unexpected certificate for %s\n%s\nIt isn't from an expected issuer (%s). "+
+			"If nobody asked for it, someone else may control the domain or its DNS.",
+			domain, details, strings.Join(d.ExpectedIssuers, ", "))
+		severity = notify.SeverityCritical
+	}
+	_, err := notify.Send(cli, s, notify.Notification{
+		RoomID: s.RoomID,
+		Content: mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    text,
+		},
+		Severity:       severity,
+		CorrelationKey: fmt.Sprintf("acme %d", c.ID),
+	})
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"domain":  domain,
+			"room_id": s.RoomID,
+		}).Error("Failed to announce certificate")
+	}
+}
+
+// fetchCerts returns the certificates for the domain which haven't expired, and for its
+// subdomains if asked to.
+func fetchCerts(domain string, includeSubdomains bool) ([]cert, error) {
+	queries := []string{domain}
+	if includeSubdomains {
+		queries = append(queries, "%."+domain)
+	}
+	var certs []cert
+	for _, q := range queries {
+		u := crtshURL + "?" + url.Values{
+			"q":           {q},
+			"output":      {"json"},
+			"exclude":     {"expired"},
+			"deduplicate": {"Y"},
+		}.Encode()
+		var found []cert
+		if err := getJSON(u, &found); err != nil {
+			return nil, err
+		}
+		certs = append(certs, found...)
+	}
+	return certs, nil
+}
+
+func getJSON(u string, out interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "Go-NEB")
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// formatDate returns the day of a crt.sh timestamp, e.g. "2021-03-15".
+func formatDate(timestamp string) string {
+	if t, err := time.Parse("2006-01-02T15:04:05", timestamp); err == nil {
+		return t.Format("2006-01-02")
+	}
+	return timestamp
+}
+
+func (s *Service) loadSeen() (*seenState, error) {
+	seen := &seenState{
+		Domains: make(map[string]bool),
+		Certs:   make(map[int64]int64),
+	}
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "seen")
+	if err == sql.ErrNoRows {
+		return seen, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, seen); err != nil {
+		return nil, err
+	}
+	if seen.Domains == nil {
+		seen.Domains = make(map[string]bool)
+	}
+	if seen.Certs == nil {
+		seen.Certs = make(map[int64]int64)
+	}
+	return seen, nil
+}
+
+func (s *Service) storeSeen(seen *seenState) error {
+	stateJSON, err := json.Marshal(seen)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "seen", stateJSON)
+}
+
+// Register makes sure that the domains are configured properly, and joins the room.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.RoomID == "" {
+		return fmt.Errorf("A room_id is required")
+	}
+	if s.PollIntervalMins < 0 || (s.PollIntervalMins > 0 && s.PollIntervalMins < minPollIntervalMins) {
+		return fmt.Errorf("poll_interval_mins can't be less than %d", minPollIntervalMins)
+	}
+	if len(s.Domains) == 0 {
+		return fmt.Errorf("At least one domain is required")
+	}
+	for name := range s.Domains {
+		if name == "" || name != strings.ToLower(name) || strings.ContainsAny(name, " /:@%*") {
+			return fmt.Errorf("Bad domain '%s': use a lower case domain, e.g. example.com", name)
+		}
+	}
+	if _, err := client.JoinRoom(s.RoomID.String(), "", nil); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    s.RoomID,
+		}).Error("Failed to join room")
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package acme
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestCheck(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	logs := map[string]string{
+		"hyrule.example":   `[{"id":1,"issuer_name":"C=US, O=Let's Encrypt, CN=R3","name_value":"hyrule.example","not_before":"2021-01-01T00:00:00","not_after":"2021-04-01T00:00:00"}]`,
+		"%.hyrule.example": `[]`,
+	}
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		q := req.URL.Query()
+		if req.URL.Host != "crt.sh" || q.Get("output") != "json" || q.Get("exclude") != "expired" {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		body, ok := logs[q.Get("q")]
+		if !ok {
+			return nil, fmt.Errorf("Unexpected search: %s", q.Get("q"))
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$cert:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"room_id": "!security:hyrule",
+		"domains": {
+			"hyrule.example": {"include_subdomains": true, "expected_issuers": ["let's encrypt"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create ACME service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register ACME service: ", err)
+	}
+	s := srv.(*Service)
+
+	now := time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC)
+	s.check(matrixCli, now)
+	if len(sent) != 0 {
+		t.Errorf("Announced certificates which existed when the domain was added: %q", sent)
+	}
+
+	logs["hyrule.example"] = `[
+		{"id":1,"issuer_name":"C=US, O=Let's Encrypt, CN=R3","name_value":"hyrule.example","not_before":"2021-01-01T00:00:00","not_after":"2021-04-01T00:00:00"},
+		{"id":2,"issuer_name":"C=US, O=Let's Encrypt, CN=R3","name_value":"hyrule.example\nwww.hyrule.example","not_before":"2021-03-14T00:00:00","not_after":"2021-06-12T00:00:00"}
+	]`
+	logs["%.hyrule.example"] = `[
+		{"id":2,"issuer_name":"C=US, O=Let's Encrypt, CN=R3","name_value":"hyrule.example\nwww.hyrule.example","not_before":"2021-03-14T00:00:00","not_after":"2021-06-12T00:00:00"},
+		{"id":3,"issuer_name":"C=GB, O=Sectigo Limited, CN=Sectigo RSA DV","name_value":"mail.hyrule.example","not_before":"2021-03-14T12:00:00","not_after":"2022-03-14T12:00:00"}
+	]`
+	s.check(matrixCli, now)
+	s.check(matrixCli, now.Add(time.Hour))
+
+	want := []string{
+		"🔏 New certificate for hyrule.example, www.hyrule.example\nIssued by C=US, O=Let's Encrypt, CN=R3, valid from 2021-03-14 until 2021-06-12\nhttps://crt.sh/?id=2",
+		"🚨 Unexpected certificate for hyrule.example\nmail.hyrule.example\nIssued by C=GB, O=Sectigo Limited, CN=Sectigo RSA DV, valid from 2021-03-14 until 2022-03-14\nhttps://crt.sh/?id=3\n" +
+			"It isn't from an expected issuer (let's encrypt). If nobody asked for it, someone else may control the domain or its DNS.",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad announcements: got %q, want %q", sent, want)
+	}
+
+	// Expired certificates are forgotten, and not announced again if the logs still have them
+	s.check(matrixCli, time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC))
+	seen, err := s.loadSeen()
+	if err != nil {
+		t.Fatal("Failed to load seen certificates: ", err)
+	}
+	if _, ok := seen.Certs[1]; ok || len(seen.Certs) != 2 {
+		t.Errorf("Expired certificates weren't forgotten: %v", seen.Certs)
+	}
+	if len(sent) != len(want) {
+		t.Errorf("Announced an expired certificate: %q", sent[len(want):])
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"domains": {"hyrule.example": {}}}`,
+		`{"room_id": "!security:hyrule"}`,
+		`{"room_id": "!security:hyrule", "poll_interval_mins": 5, "domains": {"hyrule.example": {}}}`,
+		`{"room_id": "!security:hyrule", "domains": {"*.hyrule.example": {}}}`,
+		`{"room_id": "!security:hyrule", "domains": {"Hyrule.Example": {}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create ACME service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// Package airquality implements a Service which reports air quality and warns rooms when it is poor.
+package airquality
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Air Quality service
+const ServiceType = "airquality"
+
+// How often the air quality of alert locations is checked by default, and at most
+const (
+	defaultPollInterval = time.Hour
+	minPollInterval     = 10 * time.Minute
+)
+
+// The index above which rooms are warned, unless they configure their own
+const defaultThreshold = 150
+
+// Service contains the Config fields for the Air Quality service.
+//
+// This service reports the US EPA air quality index of places: "!aqi London" responds with the
+// index, what it means, and the main pollutant. Rooms can also be warned when the index of a
+// location goes above a threshold, and told when it has dropped back below it.
+//
+// The readings come from OpenAQ (https://openaq.org/), which is free and works out the index
+// from the PM2.5 measurements of monitoring stations in a city, or IQAir AirVisual
+// (https://www.iqair.com/air-pollution-data-api), which needs an api_key and places given as
+// "city, state, country", e.g. "Los Angeles, California, USA".
+//
+// Example JSON request:
+//   {
+//       "provider": "openaq",
+//       "poll_interval_mins": 60,
+//       "rooms": {
+//           "!office:localhost": {
+//               "locations": ["London", "Manchester"],
+//               "threshold": 150
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The provider of readings: "openaq" or "iqair". Defaults to "openaq".
+	Provider string `json:"provider"`
+	// The IQAir API key. Required for the iqair provider.
+	APIKey string `json:"api_key"`
+	// Optional. How often to check the locations of rooms, in minutes. Defaults to 60, and can't
+	// be less than 10.
+	PollIntervalMins int `json:"poll_interval_mins"`
+	// Optional. The rooms to warn about poor air quality.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is the locations a room is warned about.
+type RoomConfig struct {
+	// The places to check, in the form the provider needs.
+	Locations []string `json:"locations"`
+	// Optional. Warn the room when the index goes above this. Defaults to 150.
+	Threshold int `json:"threshold"`
+}
+
+// alertState is whether a room has been warned about a location. It is stored in the service
+// state under "alert <room ID> <location>".
+type alertState struct {
+	Alerting bool `json:"alerting"`
+	AQI      int  `json:"aqi"`
+}
+
+func (r *RoomConfig) threshold() int {
+	if r.Threshold <= 0 {
+		return defaultThreshold
+	}
+	return r.Threshold
+}
+
+// Commands supported:
+//    !aqi place
+// Responds with the air quality index of the place.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"aqi"},
+			Arguments: []string{"place"},
+			Help:      "Show the air quality index of a place",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdAQI(args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdAQI(args []string) (interface{}, error) {
+	place := strings.Join(args, " ")
+	if place == "" {
+		return nil, fmt.Errorf("Usage: !aqi place")
+	}
+	r, err := s.provider().read(place)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the air quality of %s: %s", place, err)
+	}
+	if r == nil {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("No air quality readings found for %s", place),
+		}, nil
+	}
+	return readingMessage(place, r), nil
+}
+
+func readingMessage(place string, r *reading) *mevt.MessageEventContent {
+	title := fmt.Sprintf("Air quality in %s: %d (%s)", place, r.AQI, category(r.AQI))
+	var details []string
+	if r.MainPollutant != "" {
+		details = append(details, "Main pollutant: "+r.MainPollutant)
+	}
+	if r.PM25 >= 0 {
+		details = append(details, fmt.Sprintf("PM2.5 %.1f µg/m³", r.PM25))
+	}
+	if r.Stations == 1 {
+		details = append(details, "1 station")
+	} else if r.Stations > 1 {
+		details = append(details, fmt.Sprintf("%d stations", r.Stations))
+	}
+	body, htmlBody := title, "<strong>"+html.EscapeString(title)+"</strong>"
+	if len(details) > 0 {
+		body += "\n" + strings.Join(details, " · ")
+		htmlBody += "<br>" + html.EscapeString(strings.Join(details, " · "))
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          body,
+		Format:        mevt.FormatHTML,
+		FormattedBody: htmlBody,
+	}
+}
+
+// OnPoll checks the air quality of the locations of each room, and warns the rooms whose
+// locations went above their threshold, or tells them when they have dropped back below it.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	// Rooms often share locations, so each is only read once
+	readings := make(map[string]*reading)
+	for roomID, room := range s.Rooms {
+		for _, location := range room.Locations {
+			locLogger := logger.WithFields(log.Fields{
+				"room_id":  roomID,
+				"location": location,
+			})
+			r, ok := readings[location]
+			if !ok {
+				var err error
+				if r, err = s.provider().read(location); err != nil {
+					locLogger.WithError(err).Error("Failed to read air quality")
+				}
+				readings[location] = r
+			}
+			if r == nil {
+				continue
+			}
+			if err := s.checkAlert(cli, roomID, room, location, r); err != nil {
+				locLogger.WithError(err).Error("Failed to check air quality alert")
+			}
+		}
+	}
+	return time.Now().Add(s.pollInterval())
+}
+
+// checkAlert warns the room if the reading crossed its threshold since the last one.
+func (s *Service) checkAlert(cli types.MatrixClient, roomID id.RoomID, room RoomConfig, location string, r *reading) error {
+	db := database.GetServiceDB()
+	stateKey := "alert " + roomID.String() + " " + location
+	var state alertState
+	stateJSON, err := db.LoadServiceState(s.ServiceID(), stateKey)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	} else if err == nil {
+		if err = json.Unmarshal(stateJSON, &state); err != nil {
+			return err
+		}
+	}
+
+	alerting := r.AQI > room.threshold()
+	if alerting != state.Alerting {
+		msg := readingMessage(location, r)
+		severity := notify.SeverityInfo
+		if alerting {
+			msg.Body = "⚠️ " + msg.Body
+			msg.FormattedBody = "⚠️ " + msg.FormattedBody
+			severity = notify.SeverityWarning
+		} else {
+			msg.Body = fmt.Sprintf("Air quality in %s is back below %d: %d (%s)", location, room.threshold(), r.AQI, category(r.AQI))
+			msg.FormattedBody = html.EscapeString(msg.Body)
+		}
+		_, err = notify.Send(cli, s, notify.Notification{
+			RoomID:         roomID,
+			Content:        *msg,
+			Severity:       severity,
+			CorrelationKey: "airquality " + location,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	state = alertState{Alerting: alerting, AQI: r.AQI}
+	if stateJSON, err = json.Marshal(state); err != nil {
+		return err
+	}
+	return db.StoreServiceState(s.ServiceID(), stateKey, stateJSON)
+}
+
+func (s *Service) pollInterval() time.Duration {
+	if s.PollIntervalMins <= 0 {
+		return defaultPollInterval
+	}
+	if interval := time.Duration(s.PollIntervalMins) * time.Minute; interval > minPollInterval {
+		return interval
+	}
+	return minPollInterval
+}
+
+func (s *Service) provider() provider {
+	if s.Provider == "iqair" {
+		return &iqAirProvider{apiKey: s.APIKey}
+	}
+	return &openAQProvider{}
+}
+
+// Register makes sure that the provider is configured, and joins the rooms to warn.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	switch s.Provider {
+	case "", "openaq":
+	case "iqair":
+		if s.APIKey == "" {
+			return fmt.Errorf("An api_key is required for the iqair provider")
+		}
+	default:
+		return fmt.Errorf("Unknown provider '%s': must be openaq or iqair", s.Provider)
+	}
+	for roomID, room := range s.Rooms {
+		if room.Threshold < 0 {
+			return fmt.Errorf("Bad threshold %d for room %s", room.Threshold, roomID)
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
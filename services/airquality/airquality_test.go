@@ -0,0 +1,141 @@
+package airquality
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestPM25AQI(t *testing.T) {
+	testCases := map[float64]int{
+		0:     0,
+		9:     38,
+		12:    50,
+		12.05: 50,
+		35.4:  100,
+		55.5:  151,
+		200:   250,
+		600:   500,
+	}
+	for conc, want := range testCases {
+		if got := pm25AQI(conc); got != want {
+			t.Errorf("pm25AQI(%v) = %d, want %d", conc, got, want)
+		}
+	}
+}
+
+func TestAQI(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch req.URL.String() {
+		case "https://api.openaq.org/v2/latest?city=Delhi&limit=100&parameter=pm25":
+			body = `{"results":[{"measurements":[{"parameter":"pm25","value":160}]},
+				{"measurements":[{"parameter":"pm25","value":140}]},{"measurements":[{"parameter":"pm25","value":-999}]}]}`
+		case "https://api.openaq.org/v2/latest?city=Atlantis&limit=100&parameter=pm25":
+			body = `{"results":[]}`
+		case "https://api.airvisual.com/v2/city?city=Los+Angeles&country=USA&key=secret&state=California":
+			body = `{"status":"success","data":{"current":{"pollution":{"aqius":57,"mainus":"o3"}}}}`
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	openAQ := &Service{}
+	res, err := openAQ.cmdAQI([]string{"Delhi"})
+	if err != nil {
+		t.Fatalf("!aqi failed: %s", err)
+	}
+	want := "Air quality in Delhi: 200 (Unhealthy)\nMain pollutant: PM2.5 · PM2.5 150.0 µg/m³ · 2 stations"
+	if body := res.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("Bad !aqi: got %q, want %q", body, want)
+	}
+	res, err = openAQ.cmdAQI([]string{"Atlantis"})
+	if err != nil || res.(*mevt.MessageEventContent).Body != "No air quality readings found for Atlantis" {
+		t.Errorf("Expected no readings for Atlantis, got %v, %v", res, err)
+	}
+
+	iqAir := &Service{Provider: "iqair", APIKey: "secret"}
+	res, err = iqAir.cmdAQI(strings.Fields("Los Angeles, California, USA"))
+	if err != nil {
+		t.Fatalf("!aqi failed: %s", err)
+	}
+	want = "Air quality in Los Angeles, California, USA: 57 (Moderate)\nMain pollutant: ozone"
+	if body := res.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("Bad !aqi: got %q, want %q", body, want)
+	}
+	if _, err = iqAir.cmdAQI([]string{"Los", "Angeles"}); err == nil {
+		t.Errorf("Expected IQAir places without a state and country to be refused")
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	var pm25 float64
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(
+				fmt.Sprintf(`{"results":[{"measurements":[{"parameter":"pm25","value":%v}]}]}`, pm25),
+			)),
+		}, nil
+	})}
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!office:hyrule"}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$alert:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"rooms": {"!office:hyrule": {"locations": ["London"], "threshold": 100}}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create airquality service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register airquality service: ", err)
+	}
+	s := srv.(*Service)
+
+	// Each change across the threshold is announced once
+	for _, pm25 = range []float64{10, 40, 45, 20, 20} {
+		s.OnPoll(matrixCli)
+	}
+	want := []string{
+		"⚠️ Air quality in London: 112 (Unhealthy for sensitive groups)\nMain pollutant: PM2.5 · PM2.5 40.0 µg/m³ · 1 station",
+		"Air quality in London is back below 100: 68 (Moderate)",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad alerts: got %q, want %q", sent, want)
+	}
+}
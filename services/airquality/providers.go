@@ -0,0 +1,191 @@
+package airquality
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The provider APIs. Overridden by tests.
+var (
+	openAQURL = "https://api.openaq.org/v2/"
+	iqAirURL  = "https://api.airvisual.com/v2/"
+)
+
+var httpClient = &http.Client{}
+
+// reading is the air quality of a place.
+type reading struct {
+	// The US EPA air quality index
+	AQI int
+	// The pollutant which the index is worst for, e.g. "PM2.5", if known
+	MainPollutant string
+	// The PM2.5 concentration in µg/m³, or -1 if unknown
+	PM25 float64
+	// How many monitoring stations the reading is from, or 0 if unknown
+	Stations int
+}
+
+// A provider reads the air quality of places. It returns nil if it doesn't know the place.
+type provider interface {
+	read(place string) (*reading, error)
+}
+
+// openAQProvider uses OpenAQ, which collects measurements from monitoring stations. The index
+// is worked out from the average PM2.5 concentration of the stations in the city.
+type openAQProvider struct{}
+
+func (p *openAQProvider) read(place string) (*reading, error) {
+	q := url.Values{}
+	q.Set("city", place)
+	q.Set("parameter", "pm25")
+	q.Set("limit", "100")
+	var latest struct {
+		Results []struct {
+			Measurements []struct {
+				Parameter string  `json:"parameter"`
+				Value     float64 `json:"value"`
+			} `json:"measurements"`
+		} `json:"results"`
+	}
+	if err := getJSON(openAQURL+"latest?"+q.Encode(), &latest); err != nil {
+		return nil, err
+	}
+	var total float64
+	var stations int
+	for _, result := range latest.Results {
+		for _, m := range result.Measurements {
+			// Broken sensors report negative concentrations
+			if m.Parameter == "pm25" && m.Value >= 0 {
+				total += m.Value
+				stations++
+			}
+		}
+	}
+	if stations == 0 {
+		return nil, nil
+	}
+	pm25 := total / float64(stations)
+	return &reading{
+		AQI:           pm25AQI(pm25),
+		MainPollutant: "PM2.5",
+		PM25:          pm25,
+		Stations:      stations,
+	}, nil
+}
+
+// iqAirProvider uses IQAir AirVisual, which needs places to be given as "city, state, country",
+// e.g. "Los Angeles, California, USA".
+type iqAirProvider struct {
+	apiKey string
+}
+
+// The names IQAir gives pollutants
+var iqAirPollutants = map[string]string{
+	"p2": "PM2.5",
+	"p1": "PM10",
+	"o3": "ozone",
+	"n2": "NO₂",
+	"s2": "SO₂",
+	"co": "CO",
+}
+
+func (p *iqAirProvider) read(place string) (*reading, error) {
+	parts := strings.Split(place, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("places must be given as city, state, country, e.g. Los Angeles, California, USA")
+	}
+	q := url.Values{}
+	q.Set("city", strings.TrimSpace(parts[0]))
+	q.Set("state", strings.TrimSpace(parts[1]))
+	q.Set("country", strings.TrimSpace(parts[2]))
+	q.Set("key", p.apiKey)
+	var city struct {
+		Status string `json:"status"`
+		Data   struct {
+			Message string `json:"message"`
+			Current struct {
+				Pollution struct {
+					AQIUS  int    `json:"aqius"`
+					MainUS string `json:"mainus"`
+				} `json:"pollution"`
+			} `json:"current"`
+		} `json:"data"`
+	}
+	if err := getJSON(iqAirURL+"city?"+q.Encode(), &city); err != nil {
+		return nil, err
+	}
+	if city.Status != "success" {
+		if city.Data.Message == "city_not_found" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s", city.Data.Message)
+	}
+	return &reading{
+		AQI:           city.Data.Current.Pollution.AQIUS,
+		MainPollutant: iqAirPollutants[city.Data.Current.Pollution.MainUS],
+		PM25:          -1,
+	}, nil
+}
+
+func getJSON(u string, out interface{}) error {
+	res, err := httpClient.Get(u)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	// IQAir describes errors in the body
+	if err = json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("Request error: %d, %s", res.StatusCode, err)
+	}
+	return nil
+}
+
+// The US EPA breakpoints between PM2.5 concentrations, in µg/m³, and the index
+var pm25Breakpoints = []struct {
+	concLow, concHigh float64
+	aqiLow, aqiHigh   int
+}{
+	{0, 12, 0, 50},
+	{12.1, 35.4, 51, 100},
+	{35.5, 55.4, 101, 150},
+	{55.5, 150.4, 151, 200},
+	{150.5, 250.4, 201, 300},
+	{250.5, 350.4, 301, 400},
+	{350.5, 500.4, 401, 500},
+}
+
+// pm25AQI returns the US EPA air quality index of a PM2.5 concentration. Concentrations beyond
+// the top of the scale are 500.
+func pm25AQI(conc float64) int {
+	conc = math.Floor(conc*10) / 10
+	for _, bp := range pm25Breakpoints {
+		if conc <= bp.concHigh {
+			aqi := float64(bp.aqiHigh-bp.aqiLow)/(bp.concHigh-bp.concLow)*(conc-bp.concLow) + float64(bp.aqiLow)
+			return int(math.Round(aqi))
+		}
+	}
+	return 500
+}
+
+// category returns the US EPA name for the index, e.g. "Moderate".
+func category(aqi int) string {
+	switch {
+	case aqi <= 50:
+		return "Good"
+	case aqi <= 100:
+		return "Moderate"
+	case aqi <= 150:
+		return "Unhealthy for sensitive groups"
+	case aqi <= 200:
+		return "Unhealthy"
+	case aqi <= 300:
+		return "Very unhealthy"
+	}
+	return "Hazardous"
+}
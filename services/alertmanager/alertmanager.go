@@ -11,6 +11,8 @@ import (
 	text "text/template"
 
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/templates"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
@@ -32,6 +34,14 @@ const ServiceType = "alertmanager"
 //
 // You can set msg_type to either m.text or m.notice
 //
+// When an alert which was sent to a room resolves, the message it was sent in is edited to say
+// so, rather than a separate message being sent. Set on_resolve to "thread" to reply to the
+// message instead, or to "message" to send a new message using the templates.
+//
+// Rooms can leave out the templates, in which case they are sent a short summary of each alert.
+// Operators can change that message for every such room with a template override named
+// "alertmanager.firing" or "alertmanager.resolved" (see package "templates").
+//
 // Example JSON request:
 //    {
 //        rooms: {
@@ -48,11 +58,17 @@ type Service struct {
 	// The URL which should be added to alertmanagers config - Populated by Go-NEB after Service registration.
 	WebhookURL string `json:"webhook_url"`
 	// A map of matrix rooms to templates
-	Rooms map[id.RoomID]struct {
-		TextTemplate string           `json:"text_template"`
-		HTMLTemplate string           `json:"html_template"`
-		MsgType      mevt.MessageType `json:"msg_type"`
-	} `json:"rooms"`
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is the configuration for a room which alerts are sent to.
+type RoomConfig struct {
+	TextTemplate string           `json:"text_template"`
+	HTMLTemplate string           `json:"html_template"`
+	MsgType      mevt.MessageType `json:"msg_type"`
+	// Optional. What to do when an alert which was sent to the room resolves: "edit" the message
+	// it was sent in (the default), reply to that message in a "thread", or send a new "message".
+	OnResolve string `json:"on_resolve"`
 }
 
 // WebhookNotification is the payload from Alertmanager
@@ -65,15 +81,19 @@ type WebhookNotification struct {
 	CommonLabels      map[string]string `json:"commonLabels"`
 	CommonAnnotations map[string]string `json:"commonAnnotations"`
 	ExternalURL       string            `json:"externalURL"`
-	Alerts            []struct {
-		Status       string            `json:"status"`
-		Labels       map[string]string `json:"labels"`
-		Annotations  map[string]string `json:"annotations"`
-		StartsAt     string            `json:"startsAt"`
-		EndsAt       string            `json:"endsAt"`
-		GeneratorURL string            `json:"generatorURL"`
-		SilenceURL   string
-	} `json:"alerts"`
+	Alerts            []Alert           `json:"alerts"`
+}
+
+// Alert is a single alert in a WebhookNotification.
+type Alert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     string            `json:"startsAt"`
+	EndsAt       string            `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+	SilenceURL   string
 }
 
 // OnReceiveWebhook receives requests from Alertmanager and sends requests to Matrix as a result.
@@ -98,74 +118,123 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		alert.SilenceURL = fmt.Sprintf("%s#silences/new?filter={%s}", notif.ExternalURL, strings.Join(filters, ","))
 	}
 
-	for roomID, templates := range s.Rooms {
-		var msg interface{}
-		// we don't check whether the templates parse because we already did when storing them in the db
-		textTemplate, _ := text.New("textTemplate").Parse(templates.TextTemplate)
-		var bodyBuffer bytes.Buffer
-		if err := textTemplate.Execute(&bodyBuffer, notif); err != nil {
-			log.WithError(err).Error("Alertmanager webhook failed to execute text template")
+	severity := notifSeverity(notif)
+	for roomID, room := range s.Rooms {
+		roomNotif := notif
+		if room.OnResolve != resolveMessage {
+			// Alerts which were sent to the room while firing are resolved in place, so they
+			// don't need a new message.
+			roomNotif.Alerts = s.resolveSentAlerts(cli, roomID, room, notif.Alerts)
+			if len(roomNotif.Alerts) == 0 {
+				continue
+			}
+		}
+		msg, err := room.render(roomNotif)
+		if err != nil {
+			log.WithError(err).Error("Alertmanager webhook failed to execute template")
 			w.WriteHeader(500)
 			return
 		}
-		if templates.HTMLTemplate != "" {
-			// we don't check whether the templates parse because we already did when storing them in the db
-			htmlTemplate, _ := html.New("htmlTemplate").Parse(templates.HTMLTemplate)
-			var formattedBodyBuffer bytes.Buffer
-			if err := htmlTemplate.Execute(&formattedBodyBuffer, notif); err != nil {
-				log.WithError(err).Error("Alertmanager webhook failed to execute HTML template")
-				w.WriteHeader(500)
-				return
-			}
-			msg = mevt.MessageEventContent{
-				Body:          bodyBuffer.String(),
-				MsgType:       templates.MsgType,
-				Format:        mevt.FormatHTML,
-				FormattedBody: formattedBodyBuffer.String(),
-			}
-		} else {
-			msg = mevt.MessageEventContent{
-				Body:    bodyBuffer.String(),
-				MsgType: templates.MsgType,
-			}
-		}
 
 		log.WithFields(log.Fields{
 			"message": msg,
 			"room_id": roomID,
 		}).Print("Sending Alertmanager notification to room")
-		if _, e := cli.SendMessageEvent(roomID, mevt.EventMessage, msg); e != nil {
+		eventID, e := notify.Send(cli, s, notify.Notification{
+			RoomID:         roomID,
+			Content:        msg,
+			Severity:       severity,
+			CorrelationKey: "alertmanager " + notif.GroupKey,
+		})
+		if e != nil {
 			log.WithError(e).WithField("room_id", roomID).Print(
 				"Failed to send Alertmanager notification to room.")
+			continue
+		}
+		if eventID != "" && room.OnResolve != resolveMessage {
+			s.trackFiringAlerts(roomID, eventID, msg, roomNotif.Alerts)
 		}
 	}
 	w.WriteHeader(200)
 }
 
+// render renders the notification using the room's templates.
+func (room *RoomConfig) render(notif WebhookNotification) (mevt.MessageEventContent, error) {
+	if room.TextTemplate == "" {
+		// Rooms without their own templates use the operator's "alertmanager.<status>"
+		// template override, if there is one.
+		msgType := room.MsgType
+		if msgType == "" {
+			msgType = mevt.MsgNotice
+		}
+		return templates.Render("alertmanager."+notif.Status, notif, defaultMessage(notif, msgType)), nil
+	}
+	// we don't check whether the templates parse because we already did when storing them in the db
+	textTemplate, _ := text.New("textTemplate").Parse(room.TextTemplate)
+	var bodyBuffer bytes.Buffer
+	if err := textTemplate.Execute(&bodyBuffer, notif); err != nil {
+		return mevt.MessageEventContent{}, err
+	}
+	if room.HTMLTemplate == "" {
+		return mevt.MessageEventContent{
+			Body:    bodyBuffer.String(),
+			MsgType: room.MsgType,
+		}, nil
+	}
+	// we don't check whether the templates parse because we already did when storing them in the db
+	htmlTemplate, _ := html.New("htmlTemplate").Parse(room.HTMLTemplate)
+	var formattedBodyBuffer bytes.Buffer
+	if err := htmlTemplate.Execute(&formattedBodyBuffer, notif); err != nil {
+		return mevt.MessageEventContent{}, err
+	}
+	return mevt.MessageEventContent{
+		Body:          bodyBuffer.String(),
+		MsgType:       room.MsgType,
+		Format:        mevt.FormatHTML,
+		FormattedBody: formattedBodyBuffer.String(),
+	}, nil
+}
+
 // Register makes sure the Config information supplied is valid.
 func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
 	s.WebhookURL = s.webhookEndpointURL
-	for _, templates := range s.Rooms {
+	for _, room := range s.Rooms {
+		// validate that the msgtype is either m.notice or m.text
+		if room.MsgType != "" && room.MsgType != "m.notice" && room.MsgType != "m.text" {
+			return fmt.Errorf("msg_type is neither 'm.notice' nor 'm.text'")
+		}
+
+		// validate what to do when alerts resolve
+		if room.OnResolve != "" && room.OnResolve != resolveEdit && room.OnResolve != resolveThread &&
+			room.OnResolve != resolveMessage {
+			return fmt.Errorf("on_resolve is neither 'edit', 'thread' nor 'message'")
+		}
+
+		// rooms without templates use the default message or the operator's template override
+		if room.TextTemplate == "" && room.HTMLTemplate == "" {
+			continue
+		}
+
 		// validate that we have at least a plain text template
-		if templates.TextTemplate == "" {
+		if room.TextTemplate == "" {
 			return fmt.Errorf("plain text template missing")
 		}
 
 		// validate the plain text template is valid
-		_, err := text.New("textTemplate").Parse(templates.TextTemplate)
+		_, err := text.New("textTemplate").Parse(room.TextTemplate)
 		if err != nil {
 			return fmt.Errorf("plain text template is invalid: %v", err)
 		}
 
-		if templates.HTMLTemplate != "" {
+		if room.HTMLTemplate != "" {
 			// validate that the html template is valid
-			_, err := html.New("htmlTemplate").Parse(templates.HTMLTemplate)
+			_, err := html.New("htmlTemplate").Parse(room.HTMLTemplate)
 			if err != nil {
 				return fmt.Errorf("html template is invalid: %v", err)
 			}
 		}
-		// validate that the msgtype is either m.notice or m.text
-		if templates.MsgType != "m.notice" && templates.MsgType != "m.text" {
+		// validate that the msgtype is set when using templates
+		if room.MsgType == "" {
 			return fmt.Errorf("msg_type is neither 'm.notice' nor 'm.text'")
 		}
 	}
@@ -173,6 +242,39 @@ func (s *Service) Register(oldService types.Service, client types.MatrixClient)
 	return nil
 }
 
+// notifSeverity returns the most severe "severity" label of the alerts, so that critical alerts
+// can skip digests.
+func notifSeverity(notif WebhookNotification) notify.Severity {
+	severity := notify.Severity(strings.ToLower(notif.CommonLabels["severity"]))
+	for _, alert := range notif.Alerts {
+		if s := notify.Severity(strings.ToLower(alert.Labels["severity"])); s == notify.SeverityCritical {
+			return s
+		} else if severity == "" {
+			severity = s
+		}
+	}
+	return severity
+}
+
+// defaultMessage is sent to rooms which don't have their own templates, when the operator
+// hasn't overridden the "alertmanager" template either.
+func defaultMessage(notif WebhookNotification, msgType mevt.MessageType) mevt.MessageEventContent {
+	var lines []string
+	for _, alert := range notif.Alerts {
+		line := fmt.Sprintf("[%s] %s", strings.ToUpper(alert.Status), alert.Labels["alertname"])
+		if summary := alert.Annotations["summary"]; summary != "" {
+			line += ": " + summary
+		} else if description := alert.Annotations["description"]; description != "" {
+			line += ": " + description
+		}
+		lines = append(lines, line)
+	}
+	return mevt.MessageEventContent{
+		Body:    strings.Join(lines, "\n"),
+		MsgType: msgType,
+	}
+}
+
 // PostRegister deletes this service if there are no registered repos.
 func (s *Service) PostRegister(oldService types.Service) {
 	// At least one room still active
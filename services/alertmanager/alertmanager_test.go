@@ -114,7 +114,7 @@ func buildTestClient(msgs *[]mevt.MessageEventContent) types.MatrixClient {
 	return matrixCli
 }
 
-func buildTestService(t *testing.T) types.Service {
+func buildTestService(t testing.TB) types.Service {
 	htmlTemplate, err := json.Marshal(
 		`{{range .Alerts}}
 		{{index .Labels "severity" }} : {{- index .Labels "alertname" -}}
@@ -183,3 +183,98 @@ func checkSilenceLine(t *testing.T, line string, expectedKeys map[string]string)
 		t.Errorf("number of filter fields got %d, want %d", matched, len(expectedKeys))
 	}
 }
+
+func TestResolveEdits(t *testing.T) {
+	store := testutils.NewStateStorage()
+	database.SetServiceDB(store)
+
+	var sent []map[string]interface{}
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		sent = append(sent, content)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`{"event_id":"$%d"}`, len(sent)))),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", "alertmanager", "@neb:hs", []byte(`{
+		"rooms": {"!testroom:id": {}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notify := func(body string) {
+		req, err := http.NewRequest("POST", "", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("Failed to create webhook request: %s", err)
+		}
+		mockWriter := httptest.NewRecorder()
+		srv.OnReceiveWebhook(mockWriter, req, matrixCli)
+		if mockWriter.Code != 200 {
+			t.Fatalf("Expected response 200 OK, got %d", mockWriter.Code)
+		}
+	}
+
+	notify(`{"status": "firing", "groupKey": "g", "alerts": [
+		{"status": "firing", "fingerprint": "a1", "labels": {"alertname": "DiskFull"}, "startsAt": "2020-06-01T10:00:00Z"},
+		{"status": "firing", "fingerprint": "a2", "labels": {"alertname": "HighLoad"}, "startsAt": "2020-06-01T10:05:00Z"}
+	]}`)
+	if len(sent) != 1 {
+		t.Fatalf("Expected 1 message for the firing alerts, got %d", len(sent))
+	}
+
+	notify(`{"status": "resolved", "groupKey": "g", "alerts": [
+		{"status": "resolved", "fingerprint": "a1", "labels": {"alertname": "DiskFull"},
+		 "startsAt": "2020-06-01T10:00:00Z", "endsAt": "2020-06-01T10:23:00Z"}
+	]}`)
+	if len(sent) != 2 {
+		t.Fatalf("Expected the resolved alert to edit the original message, got %d messages", len(sent))
+	}
+	edit := sent[1]
+	relatesTo, _ := edit["m.relates_to"].(map[string]interface{})
+	if relatesTo["rel_type"] != "m.replace" || relatesTo["event_id"] != "$1" {
+		t.Errorf("Expected an edit of $1, got m.relates_to %v", relatesTo)
+	}
+	newContent, _ := edit["m.new_content"].(map[string]interface{})
+	if body, _ := newContent["body"].(string); !strings.Contains(body, "✅ DiskFull resolved after 23m") {
+		t.Errorf("Edit does not say the alert resolved: %q", body)
+	}
+
+	// alerts which weren't sent while firing still get a message
+	notify(`{"status": "resolved", "groupKey": "g", "alerts": [
+		{"status": "resolved", "fingerprint": "a3", "labels": {"alertname": "Unknown"},
+		 "startsAt": "2020-06-01T10:00:00Z", "endsAt": "2020-06-01T10:10:00Z"}
+	]}`)
+	if len(sent) != 3 {
+		t.Fatalf("Expected a message for the untracked alert, got %d messages", len(sent))
+	}
+	if _, ok := sent[2]["m.new_content"]; ok {
+		t.Errorf("Expected a new message for the untracked alert, got an edit")
+	}
+
+	notify(`{"status": "resolved", "groupKey": "g", "alerts": [
+		{"status": "resolved", "fingerprint": "a2", "labels": {"alertname": "HighLoad"},
+		 "startsAt": "2020-06-01T10:05:00Z", "endsAt": "2020-06-01T12:10:00Z"}
+	]}`)
+	if len(sent) != 4 {
+		t.Fatalf("Expected the second resolved alert to edit the original message, got %d messages", len(sent))
+	}
+	newContent, _ = sent[3]["m.new_content"].(map[string]interface{})
+	body, _ := newContent["body"].(string)
+	if !strings.Contains(body, "✅ DiskFull resolved after 23m") || !strings.Contains(body, "✅ HighLoad resolved after 2h5m") {
+		t.Errorf("Edit does not list both resolved alerts: %q", body)
+	}
+	for key := range store.State {
+		if strings.HasPrefix(key, "id alert ") || strings.HasPrefix(key, "id message ") {
+			t.Errorf("Expected all alert state to be removed once resolved, got %s", key)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+//go:build go1.18
+// +build go1.18
+
+package alertmanager
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func FuzzOnReceiveWebhook(f *testing.F) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	msgs := []mevt.MessageEventContent{}
+	matrixCli := buildTestClient(&msgs)
+	srv := buildTestService(f)
+	amService := srv.(*Service)
+
+	f.Add([]byte(`{"externalURL":"http://alertmanager","alerts":[{"labels":{"alertname":"alert 1","severity":"huge"},` +
+		`"generatorURL":"http://x"}]}`))
+	f.Add([]byte(`{"alerts":[{}]}`))
+	f.Add([]byte(`[]`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		msgs = msgs[:0]
+		req, err := http.NewRequest("POST", "", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		amService.OnReceiveWebhook(w, req, matrixCli)
+		if w.Code != 200 && w.Code != 400 && w.Code != 500 {
+			t.Errorf("unexpected response code %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package alertmanager
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The values of on_resolve.
+const (
+	resolveEdit    = "edit"
+	resolveThread  = "thread"
+	resolveMessage = "message"
+)
+
+// sentAlert is stored for each firing alert which was sent to a room, until it resolves.
+type sentAlert struct {
+	// The message the alert was sent in.
+	EventID id.EventID
+	// When the alert started firing.
+	StartsAt string
+}
+
+// sentMessage is stored for each message which was sent about firing alerts, until they have
+// all resolved, so that the message can be edited as they do.
+type sentMessage struct {
+	Content mevt.MessageEventContent
+	// The fingerprints of the alerts in the message which are still firing.
+	Firing []string
+	// A line for each alert in the message which has resolved.
+	Resolved []string
+}
+
+func alertStateKey(roomID id.RoomID, fingerprint string) string {
+	return "alert " + roomID.String() + " " + fingerprint
+}
+
+func messageStateKey(roomID id.RoomID, eventID id.EventID) string {
+	return "message " + roomID.String() + " " + eventID.String()
+}
+
+// fingerprint returns Alertmanager's fingerprint for the alert, or a hash of its labels for
+// versions of Alertmanager which don't send one.
+func fingerprint(alert Alert) string {
+	if alert.Fingerprint != "" {
+		return alert.Fingerprint
+	}
+	var labels []string
+	for k, v := range alert.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	h := sha256.Sum256([]byte(strings.Join(labels, "\n")))
+	return hex.EncodeToString(h[:8])
+}
+
+func (s *Service) loadState(key string, state interface{}) (bool, error) {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), key)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(stateJSON, state)
+}
+
+func (s *Service) storeState(key string, state interface{}) error {
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), key, stateJSON)
+}
+
+// trackFiringAlerts remembers which message the firing alerts were sent to the room in.
+func (s *Service) trackFiringAlerts(roomID id.RoomID, eventID id.EventID, content mevt.MessageEventContent, alerts []Alert) {
+	msg := sentMessage{Content: content}
+	for _, alert := range alerts {
+		if alert.Status == "resolved" {
+			continue
+		}
+		fp := fingerprint(alert)
+		// Alertmanager repeats notifications for alerts which keep firing. Keep the message
+		// the alert was first sent in, which is the one to edit when it resolves.
+		var sent sentAlert
+		if ok, err := s.loadState(alertStateKey(roomID, fp), &sent); err != nil || ok {
+			continue
+		}
+		if err := s.storeState(alertStateKey(roomID, fp), sentAlert{eventID, alert.StartsAt}); err != nil {
+			log.WithError(err).WithField("fingerprint", fp).Error("Failed to store firing alert")
+			continue
+		}
+		msg.Firing = append(msg.Firing, fp)
+	}
+	if len(msg.Firing) == 0 {
+		return
+	}
+	if err := s.storeState(messageStateKey(roomID, eventID), msg); err != nil {
+		log.WithError(err).WithField("event_id", eventID).Error("Failed to store alert message")
+	}
+}
+
+// resolveSentAlerts marks resolved alerts which were sent to the room while firing as resolved,
+// by editing or replying to the message they were sent in. Returns the alerts which still need
+// to be sent.
+func (s *Service) resolveSentAlerts(cli types.MatrixClient, roomID id.RoomID, room RoomConfig, alerts []Alert) []Alert {
+	var unsent []Alert
+	for _, alert := range alerts {
+		if alert.Status != "resolved" || !s.resolveSentAlert(cli, roomID, room, alert) {
+			unsent = append(unsent, alert)
+		}
+	}
+	return unsent
+}
+
+// resolveSentAlert returns true if the alert was sent to the room and has now been marked as
+// resolved.
+func (s *Service) resolveSentAlert(cli types.MatrixClient, roomID id.RoomID, room RoomConfig, alert Alert) bool {
+	fp := fingerprint(alert)
+	logger := log.WithFields(log.Fields{
+		"room_id":     roomID,
+		"fingerprint": fp,
+	})
+	var sent sentAlert
+	ok, err := s.loadState(alertStateKey(roomID, fp), &sent)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load firing alert")
+		return false
+	} else if !ok {
+		return false
+	}
+	line := fmt.Sprintf("✅ %s resolved after %s", alertName(alert), resolvedAfter(alert, sent))
+
+	// Reply instead of editing if we've forgotten what the message said.
+	var msg sentMessage
+	editing := false
+	if room.OnResolve != resolveThread {
+		if editing, err = s.loadState(messageStateKey(roomID, sent.EventID), &msg); err != nil {
+			logger.WithError(err).Error("Failed to load alert message")
+		}
+	}
+	var content map[string]interface{}
+	if editing {
+		msg.Resolved = append(msg.Resolved, line)
+		content, err = notify.EditContent(sent.EventID, resolvedContent(msg))
+	} else {
+		content, err = notify.ThreadReplyContent(sent.EventID, sent.EventID, mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    line,
+		})
+	}
+	if err == nil {
+		_, err = cli.SendMessageEvent(roomID, mevt.EventMessage, content)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to mark alert as resolved")
+		return false
+	}
+
+	if err = database.GetServiceDB().DeleteServiceState(s.ServiceID(), alertStateKey(roomID, fp)); err != nil {
+		logger.WithError(err).Error("Failed to forget resolved alert")
+	}
+	if editing {
+		for i := range msg.Firing {
+			if msg.Firing[i] == fp {
+				msg.Firing = append(msg.Firing[:i], msg.Firing[i+1:]...)
+				break
+			}
+		}
+		key := messageStateKey(roomID, sent.EventID)
+		if len(msg.Firing) == 0 {
+			err = database.GetServiceDB().DeleteServiceState(s.ServiceID(), key)
+		} else {
+			err = s.storeState(key, msg)
+		}
+		if err != nil {
+			logger.WithError(err).Error("Failed to update alert message")
+		}
+	}
+	return true
+}
+
+// resolvedContent is the original message with a line added for each alert which has resolved.
+func resolvedContent(msg sentMessage) mevt.MessageEventContent {
+	content := msg.Content
+	content.Body += "\n\n" + strings.Join(msg.Resolved, "\n")
+	if content.FormattedBody != "" {
+		var lines []string
+		for _, line := range msg.Resolved {
+			lines = append(lines, html.EscapeString(line))
+		}
+		content.FormattedBody += "<br><br>" + strings.Join(lines, "<br>")
+	}
+	return content
+}
+
+func alertName(alert Alert) string {
+	if name := alert.Labels["alertname"]; name != "" {
+		return name
+	}
+	return "Alert"
+}
+
+// resolvedAfter returns how long the alert was firing for, e.g. "23m".
+func resolvedAfter(alert Alert, sent sentAlert) string {
+	startsAt := alert.StartsAt
+	if startsAt == "" {
+		startsAt = sent.StartsAt
+	}
+	start, err := time.Parse(time.RFC3339, startsAt)
+	if err != nil {
+		return "an unknown time"
+	}
+	end, err := time.Parse(time.RFC3339, alert.EndsAt)
+	if err != nil || end.Before(start) {
+		end = time.Now()
+	}
+	return formatDuration(end.Sub(start))
+}
+
+func formatDuration(d time.Duration) string {
+	mins := int(d.Round(time.Minute).Minutes())
+	switch {
+	case mins < 1:
+		return "less than a minute"
+	case mins < 60:
+		return fmt.Sprintf("%dm", mins)
+	case mins < 24*60:
+		return fmt.Sprintf("%dh%dm", mins/60, mins%60)
+	default:
+		return fmt.Sprintf("%dd%dh", mins/(24*60), mins%(24*60)/60)
+	}
+}
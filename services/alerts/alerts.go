@@ -0,0 +1,455 @@
+// Package alerts implements a Service which warns rooms about earthquakes and severe weather.
+package alerts
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Alerts service
+const ServiceType = "alerts"
+
+// How often the feeds are checked by default. The earthquake feed only covers the past hour, so
+// they can't be checked less often than every half hour without missing some.
+const (
+	defaultPollInterval = 5 * time.Minute
+	maxPollIntervalMins = 30
+)
+
+// Defaults for rooms which don't configure their own
+const (
+	defaultMinMagnitude = 4.5
+	defaultMinSeverity  = "severe"
+)
+
+// How long alerts are remembered for, so they are only posted once. Earthquakes drop out of the
+// feed after an hour, and warnings without an expiry time are assumed to be over after a week.
+const (
+	quakeMemory   = 2 * time.Hour
+	warningMemory = 7 * 24 * time.Hour
+)
+
+// Service contains the Config fields for the Alerts service.
+//
+// This service checks the USGS earthquake feed (https://earthquake.usgs.gov/earthquakes/feed/),
+// the US National Weather Service's alerts (https://www.weather.gov/alerts) and MeteoAlarm's
+// European weather warnings (https://meteoalarm.org/), and posts new earthquakes and warnings to
+// the rooms which want them.
+//
+// Example JSON request:
+//   {
+//       "poll_interval_mins": 5,
+//       "rooms": {
+//           "!california:localhost": {
+//               "earthquakes": {
+//                   "min_magnitude": 4,
+//                   "regions": [
+//                       {"name": "Bay Area", "lat": 37.77, "lon": -122.42, "radius_km": 200}
+//                   ]
+//               },
+//               "weather": {
+//                   "nws_areas": ["CA"],
+//                   "min_severity": "severe"
+//               }
+//           },
+//           "!europe:localhost": {
+//               "weather": {
+//                   "meteoalarm_countries": ["united-kingdom", "france"]
+//               }
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. How often to check the feeds, in minutes. Defaults to 5, and can't be more than 30.
+	PollIntervalMins int `json:"poll_interval_mins"`
+	// The rooms to warn, and what to warn them about.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is what a room is warned about. At least one of the fields must be set.
+type RoomConfig struct {
+	// Optional. Warn the room about earthquakes.
+	Earthquakes *EarthquakeConfig `json:"earthquakes"`
+	// Optional. Warn the room about severe weather.
+	Weather *WeatherConfig `json:"weather"`
+}
+
+// EarthquakeConfig is which earthquakes a room is warned about.
+type EarthquakeConfig struct {
+	// Optional. The smallest magnitude to warn about. Defaults to 4.5.
+	MinMagnitude float64 `json:"min_magnitude"`
+	// Optional. Only warn about earthquakes in these regions. Defaults to anywhere in the world.
+	Regions []Region `json:"regions"`
+}
+
+// Region is a circle on the map.
+type Region struct {
+	// Optional. What to call the region in warnings.
+	Name string `json:"name"`
+	// The centre of the region
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	// How far the region reaches from its centre, in kilometres.
+	RadiusKM float64 `json:"radius_km"`
+}
+
+// WeatherConfig is which weather warnings a room is warned about.
+type WeatherConfig struct {
+	// Optional. The National Weather Service areas to warn about: US states and territories, e.g.
+	// "CA", or marine areas, e.g. "PZ".
+	NWSAreas []string `json:"nws_areas"`
+	// Optional. The countries to warn about, as MeteoAlarm names them in its feeds, e.g.
+	// "united-kingdom".
+	MeteoAlarmCountries []string `json:"meteoalarm_countries"`
+	// Optional. The least severe warnings to post: "minor", "moderate", "severe" or "extreme".
+	// Defaults to "severe".
+	MinSeverity string `json:"min_severity"`
+}
+
+// region returns the region the earthquake is in, or nil if it should be ignored. Rooms
+// without regions are warned about earthquakes anywhere, which are in an unnamed region.
+func (c *EarthquakeConfig) region(q quake) *Region {
+	minMagnitude := c.MinMagnitude
+	if minMagnitude == 0 {
+		minMagnitude = defaultMinMagnitude
+	}
+	if q.Magnitude < minMagnitude {
+		return nil
+	}
+	if len(c.Regions) == 0 {
+		return &Region{}
+	}
+	for i, r := range c.Regions {
+		if distanceKM(r.Lat, r.Lon, q.Lat, q.Lon) <= r.RadiusKM {
+			return &c.Regions[i]
+		}
+	}
+	return nil
+}
+
+// sources returns the feeds the room's warnings come from, e.g. "nws:CA".
+func (c *WeatherConfig) sources() []string {
+	var sources []string
+	for _, area := range c.NWSAreas {
+		sources = append(sources, "nws:"+strings.ToUpper(area))
+	}
+	for _, country := range c.MeteoAlarmCountries {
+		sources = append(sources, "meteoalarm:"+strings.ToLower(country))
+	}
+	return sources
+}
+
+func (c *WeatherConfig) wants(w warning) bool {
+	minSeverity := c.MinSeverity
+	if minSeverity == "" {
+		minSeverity = defaultMinSeverity
+	}
+	if severityRank(w.Severity) < severityRank(minSeverity) {
+		return false
+	}
+	for _, source := range c.sources() {
+		if source == w.Source {
+			return true
+		}
+	}
+	return false
+}
+
+// OnPoll checks the feeds and posts the earthquakes and warnings which haven't been posted yet
+// to the rooms which want them.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	next := time.Now().Add(s.pollInterval())
+	seen, err := s.loadSeen()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load seen alerts")
+		return next
+	}
+	now := time.Now()
+	for alertID, forgetAt := range seen {
+		if now.After(forgetAt) {
+			delete(seen, alertID)
+		}
+	}
+
+	if s.wantsQuakes() {
+		quakes, err := fetchQuakes()
+		if err != nil {
+			logger.WithError(err).Error("Failed to fetch earthquakes")
+		}
+		for _, q := range quakes {
+			seenKey := "usgs " + q.ID
+			if _, ok := seen[seenKey]; ok {
+				continue
+			}
+			// Quakes can reach the feed late, so they are remembered from whenever they were seen
+			forgetAt := q.Time
+			if now.After(forgetAt) {
+				forgetAt = now
+			}
+			seen[seenKey] = forgetAt.Add(quakeMemory)
+			for roomID, room := range s.Rooms {
+				if room.Earthquakes == nil {
+					continue
+				}
+				if r := room.Earthquakes.region(q); r != nil {
+					s.send(cli, roomID, quakeMessage(q, r.Name), quakeSeverity(q))
+				}
+			}
+		}
+	}
+
+	for _, source := range s.weatherSources() {
+		warnings, err := fetchWarnings(source)
+		if err != nil {
+			logger.WithError(err).WithField("source", source).Error("Failed to fetch weather warnings")
+			continue
+		}
+		for _, w := range warnings {
+			seenKey := source + " " + w.ID
+			if _, ok := seen[seenKey]; ok {
+				continue
+			}
+			seen[seenKey] = now.Add(warningMemory)
+			if !w.Expires.IsZero() && w.Expires.Before(seen[seenKey]) {
+				seen[seenKey] = w.Expires
+			}
+			for roomID, room := range s.Rooms {
+				if room.Weather != nil && room.Weather.wants(w) {
+					s.send(cli, roomID, warningMessage(w), warningSeverity(w))
+				}
+			}
+		}
+	}
+
+	if err = s.storeSeen(seen); err != nil {
+		logger.WithError(err).Error("Failed to store seen alerts")
+	}
+	return next
+}
+
+// quakeSeverity is critical for earthquakes which tsunami warning centres have put out
+// information about.
+func quakeSeverity(q quake) notify.Severity {
+	if q.Tsunami {
+		return notify.SeverityCritical
+	}
+	return notify.SeverityWarning
+}
+
+// warningSeverity is critical for extreme weather.
+func warningSeverity(w warning) notify.Severity {
+	if strings.EqualFold(w.Severity, "extreme") {
+		return notify.SeverityCritical
+	}
+	return notify.SeverityWarning
+}
+
+func (s *Service) send(cli types.MatrixClient, roomID id.RoomID, msg *mevt.MessageEventContent, severity notify.Severity) {
+	_, err := notify.Send(cli, s, notify.Notification{
+		RoomID:   roomID,
+		Content:  *msg,
+		Severity: severity,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    roomID,
+			"service_id": s.ServiceID(),
+		}).Error("Failed to send alert")
+	}
+}
+
+func (s *Service) wantsQuakes() bool {
+	for _, room := range s.Rooms {
+		if room.Earthquakes != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// weatherSources returns the weather feeds which rooms want warnings from, so that each is only
+// fetched once.
+func (s *Service) weatherSources() []string {
+	var sources []string
+	wanted := make(map[string]bool)
+	for _, room := range s.Rooms {
+		if room.Weather == nil {
+			continue
+		}
+		for _, source := range room.Weather.sources() {
+			if !wanted[source] {
+				wanted[source] = true
+				sources = append(sources, source)
+			}
+		}
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+func fetchWarnings(source string) ([]warning, error) {
+	if area := strings.TrimPrefix(source, "nws:"); area != source {
+		return fetchNWSWarnings(area)
+	}
+	return fetchMeteoAlarmWarnings(strings.TrimPrefix(source, "meteoalarm:"))
+}
+
+func quakeMessage(q quake, regionName string) *mevt.MessageEventContent {
+	title := fmt.Sprintf("🌍 M%.1f earthquake", q.Magnitude)
+	if q.Place != "" {
+		title += " – " + q.Place
+	}
+	if regionName != "" {
+		title += " (" + regionName + ")"
+	}
+	details := fmt.Sprintf("Depth %.1f km · %s", q.DepthKM, q.Time.Format("Mon 2 Jan 15:04 MST"))
+	body, htmlBody := title+"\n"+details, "<strong>"+html.EscapeString(title)+"</strong><br>"+html.EscapeString(details)
+	if q.URL != "" {
+		body += " · " + q.URL
+		htmlBody += fmt.Sprintf(` · <a href="%s">Details</a>`, html.EscapeString(q.URL))
+	}
+	if q.Tsunami {
+		body += "\nTsunami information has been issued for this earthquake"
+		htmlBody += "<br><strong>Tsunami information has been issued for this earthquake</strong>"
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          body,
+		Format:        mevt.FormatHTML,
+		FormattedBody: htmlBody,
+	}
+}
+
+func warningMessage(w warning) *mevt.MessageEventContent {
+	title := "⚠️ " + w.Event
+	if w.Severity != "" {
+		title += " (" + w.Severity + ")"
+	}
+	var lines []string
+	if w.Headline != "" && w.Headline != w.Event {
+		lines = append(lines, w.Headline)
+	}
+	if w.Areas != "" {
+		lines = append(lines, "Areas: "+w.Areas)
+	}
+	if !w.Expires.IsZero() {
+		lines = append(lines, "Until "+w.Expires.UTC().Format("Mon 2 Jan 15:04 MST"))
+	}
+	body, htmlBody := title, "<strong>"+html.EscapeString(title)+"</strong>"
+	for _, line := range lines {
+		body += "\n" + line
+		htmlBody += "<br>" + html.EscapeString(line)
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          body,
+		Format:        mevt.FormatHTML,
+		FormattedBody: htmlBody,
+	}
+}
+
+// loadSeen returns when each alert which has been posted can be forgotten, keyed by the feed
+// and the alert's ID.
+func (s *Service) loadSeen() (map[string]time.Time, error) {
+	seen := make(map[string]time.Time)
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "seen")
+	if err == sql.ErrNoRows {
+		return seen, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, &seen); err != nil {
+		return nil, err
+	}
+	return seen, nil
+}
+
+func (s *Service) storeSeen(seen map[string]time.Time) error {
+	stateJSON, err := json.Marshal(seen)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "seen", stateJSON)
+}
+
+func (s *Service) pollInterval() time.Duration {
+	if s.PollIntervalMins <= 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(s.PollIntervalMins) * time.Minute
+}
+
+// Register makes sure that each room is warned about something sensible, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.PollIntervalMins < 0 || s.PollIntervalMins > maxPollIntervalMins {
+		return fmt.Errorf("poll_interval_mins must be between 1 and %d so that no earthquakes are missed", maxPollIntervalMins)
+	}
+	for roomID, room := range s.Rooms {
+		if err := room.check(); err != nil {
+			return fmt.Errorf("Bad config for room %s: %s", roomID, err)
+		}
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func (r *RoomConfig) check() error {
+	if r.Earthquakes == nil && r.Weather == nil {
+		return fmt.Errorf("nothing to warn about: set earthquakes or weather")
+	}
+	if q := r.Earthquakes; q != nil {
+		if q.MinMagnitude < 0 {
+			return fmt.Errorf("min_magnitude can't be negative")
+		}
+		for _, region := range q.Regions {
+			if region.Lat < -90 || region.Lat > 90 || region.Lon < -180 || region.Lon > 180 {
+				return fmt.Errorf("region %q isn't on the map", region.Name)
+			}
+			if region.RadiusKM <= 0 {
+				return fmt.Errorf("region %q needs a radius_km", region.Name)
+			}
+		}
+	}
+	if w := r.Weather; w != nil {
+		if len(w.sources()) == 0 {
+			return fmt.Errorf("weather needs nws_areas or meteoalarm_countries")
+		}
+		if w.MinSeverity != "" && severityRank(w.MinSeverity) < 0 {
+			return fmt.Errorf("unknown min_severity %q: must be one of %s", w.MinSeverity, strings.Join(severities, ", "))
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestOnPoll(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	quakeTime := time.Date(2021, 6, 4, 12, 0, 0, 0, time.UTC)
+	expires := time.Now().Add(time.Hour).UTC()
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("User-Agent") == "" {
+			t.Errorf("No User-Agent for %s", req.URL)
+		}
+		var body string
+		switch req.URL.String() {
+		case "https://earthquake.usgs.gov/earthquakes/feed/v1.0/summary/all_hour.geojson":
+			body = fmt.Sprintf(`{"features":[
+				{"id":"ci1","properties":{"mag":5.1,"place":"10 km SW of Ridgecrest, CA","time":%d,
+					"url":"https://usgs.example/ci1","tsunami":0},"geometry":{"coordinates":[-117.77,35.55,8.1]}},
+				{"id":"ci2","properties":{"mag":3.2,"place":"Near Los Angeles","time":%d},"geometry":{"coordinates":[-118.2,34.1,5]}},
+				{"id":"us3","properties":{"mag":6.5,"place":"Fiji region","time":%d,"tsunami":1},"geometry":{"coordinates":[178.1,-18.1,550]}}
+			]}`, quakeTime.UnixNano()/int64(time.Millisecond), quakeTime.UnixNano()/int64(time.Millisecond),
+				quakeTime.UnixNano()/int64(time.Millisecond))
+		case "https://api.weather.gov/alerts/active?area=CA":
+			body = fmt.Sprintf(`{"features":[
+				{"properties":{"id":"nws1","event":"Excessive Heat Warning","headline":"Excessive Heat Warning until 8 PM",
+					"severity":"Severe","areaDesc":"Inland Empire","expires":"%s"}},
+				{"properties":{"id":"nws2","event":"Air Quality Alert","severity":"Unknown","areaDesc":"Coachella Valley"}}
+			]}`, expires.Format(time.RFC3339))
+		case "https://feeds.meteoalarm.org/api/v1/warnings/feeds-united-kingdom":
+			body = `{"warnings":[{"uuid":"ma1","alert":{"info":[
+				{"language":"cy","event":"Rhybudd gwynt melyn","severity":"Moderate"},
+				{"language":"en-GB","event":"Yellow wind warning","severity":"Moderate","area":[{"areaDesc":"Wales"}]}
+			]}}]}`
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	sent := make(map[id.RoomID][]string)
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		roomID := id.RoomID(strings.Split(strings.TrimPrefix(req.URL.Path, "/_matrix/client/r0/rooms/"), "/")[0])
+		sent[roomID] = append(sent[roomID], msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$alert:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"rooms": {
+			"!california:hyrule": {
+				"earthquakes": {"min_magnitude": 4, "regions": [{"name": "SoCal", "lat": 34.05, "lon": -118.24, "radius_km": 300}]},
+				"weather": {"nws_areas": ["ca"]}
+			},
+			"!world:hyrule": {"earthquakes": {"min_magnitude": 6}},
+			"!wales:hyrule": {"weather": {"meteoalarm_countries": ["United-Kingdom"], "min_severity": "moderate"}}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create alerts service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register alerts service: ", err)
+	}
+	s := srv.(*Service)
+
+	// Alerts are only posted once
+	s.OnPoll(matrixCli)
+	s.OnPoll(matrixCli)
+
+	want := map[id.RoomID][]string{
+		"!california:hyrule": {
+			"🌍 M5.1 earthquake – 10 km SW of Ridgecrest, CA (SoCal)\nDepth 8.1 km · Fri 4 Jun 12:00 UTC · https://usgs.example/ci1",
+			"⚠️ Excessive Heat Warning (Severe)\nExcessive Heat Warning until 8 PM\nAreas: Inland Empire\nUntil " +
+				expires.Format("Mon 2 Jan 15:04 MST"),
+		},
+		"!world:hyrule": {
+			"🌍 M6.5 earthquake – Fiji region\nDepth 550.0 km · Fri 4 Jun 12:00 UTC\nTsunami information has been issued for this earthquake",
+		},
+		"!wales:hyrule": {
+			"⚠️ Yellow wind warning (Moderate)\nAreas: Wales",
+		},
+	}
+	for roomID, wantMsgs := range want {
+		if strings.Join(sent[roomID], "|") != strings.Join(wantMsgs, "|") {
+			t.Errorf("Bad alerts for %s: got %q, want %q", roomID, sent[roomID], wantMsgs)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"poll_interval_mins": 60}`,
+		`{"rooms": {"!a:hyrule": {}}}`,
+		`{"rooms": {"!a:hyrule": {"earthquakes": {"regions": [{"lat": 10, "lon": 10}]}}}}`,
+		`{"rooms": {"!a:hyrule": {"earthquakes": {"regions": [{"lat": 100, "lon": 10, "radius_km": 10}]}}}}`,
+		`{"rooms": {"!a:hyrule": {"weather": {}}}}`,
+		`{"rooms": {"!a:hyrule": {"weather": {"nws_areas": ["CA"], "min_severity": "scary"}}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create alerts service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected Register(%s) to fail", config)
+		}
+	}
+}
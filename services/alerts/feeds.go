@@ -0,0 +1,228 @@
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The feeds. Overridden by tests.
+var (
+	usgsURL       = "https://earthquake.usgs.gov/earthquakes/feed/v1.0/summary/all_hour.geojson"
+	nwsURL        = "https://api.weather.gov/alerts/active"
+	meteoAlarmURL = "https://feeds.meteoalarm.org/api/v1/warnings/feeds-"
+)
+
+var httpClient = &http.Client{}
+
+// quake is an earthquake reported by the USGS.
+type quake struct {
+	ID        string
+	Magnitude float64
+	// e.g. "10 km SW of Ridgecrest, CA"
+	Place    string
+	Time     time.Time
+	Lat, Lon float64
+	DepthKM  float64
+	URL      string
+	// Whether a tsunami warning centre has put out information about it
+	Tsunami bool
+}
+
+// warning is a severe weather warning.
+type warning struct {
+	ID string
+	// The feed the warning came from, e.g. "nws:CA" or "meteoalarm:united-kingdom"
+	Source string
+	// e.g. "Tornado Warning"
+	Event    string
+	Headline string
+	// The CAP severity: "Extreme", "Severe", "Moderate", "Minor" or "Unknown"
+	Severity string
+	Areas    string
+	// The zero time if not known
+	Expires time.Time
+}
+
+// The CAP severities, from least to most severe
+var severities = []string{"minor", "moderate", "severe", "extreme"}
+
+// severityRank returns how severe the CAP severity is, or -1 if it is unknown.
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if strings.EqualFold(s, severity) {
+			return i
+		}
+	}
+	return -1
+}
+
+// fetchQuakes returns the earthquakes of the past hour.
+func fetchQuakes() ([]quake, error) {
+	var feed struct {
+		Features []struct {
+			ID         string `json:"id"`
+			Properties struct {
+				Mag     float64 `json:"mag"`
+				Place   string  `json:"place"`
+				Time    int64   `json:"time"`
+				URL     string  `json:"url"`
+				Tsunami int     `json:"tsunami"`
+			} `json:"properties"`
+			Geometry struct {
+				// Longitude, latitude and depth
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := getJSON(usgsURL, &feed); err != nil {
+		return nil, err
+	}
+	var quakes []quake
+	for _, f := range feed.Features {
+		if len(f.Geometry.Coordinates) < 3 {
+			continue
+		}
+		quakes = append(quakes, quake{
+			ID:        f.ID,
+			Magnitude: f.Properties.Mag,
+			Place:     f.Properties.Place,
+			Time:      time.Unix(0, f.Properties.Time*int64(time.Millisecond)).UTC(),
+			Lon:       f.Geometry.Coordinates[0],
+			Lat:       f.Geometry.Coordinates[1],
+			DepthKM:   f.Geometry.Coordinates[2],
+			URL:       f.Properties.URL,
+			Tsunami:   f.Properties.Tsunami == 1,
+		})
+	}
+	return quakes, nil
+}
+
+// fetchNWSWarnings returns the active National Weather Service alerts for an area, e.g. "CA".
+func fetchNWSWarnings(area string) ([]warning, error) {
+	q := url.Values{}
+	q.Set("area", area)
+	var alerts struct {
+		Features []struct {
+			Properties struct {
+				ID       string `json:"id"`
+				Event    string `json:"event"`
+				Headline string `json:"headline"`
+				Severity string `json:"severity"`
+				AreaDesc string `json:"areaDesc"`
+				Expires  string `json:"expires"`
+			} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := getJSON(nwsURL+"?"+q.Encode(), &alerts); err != nil {
+		return nil, err
+	}
+	var warnings []warning
+	for _, f := range alerts.Features {
+		p := f.Properties
+		warnings = append(warnings, warning{
+			ID:       p.ID,
+			Source:   "nws:" + area,
+			Event:    p.Event,
+			Headline: p.Headline,
+			Severity: p.Severity,
+			Areas:    p.AreaDesc,
+			Expires:  parseTime(p.Expires),
+		})
+	}
+	return warnings, nil
+}
+
+// fetchMeteoAlarmWarnings returns the active MeteoAlarm warnings for a country, e.g. "united-kingdom".
+func fetchMeteoAlarmWarnings(country string) ([]warning, error) {
+	var feed struct {
+		Warnings []struct {
+			UUID  string `json:"uuid"`
+			Alert struct {
+				Info []struct {
+					Language string `json:"language"`
+					Event    string `json:"event"`
+					Headline string `json:"headline"`
+					Severity string `json:"severity"`
+					Expires  string `json:"expires"`
+					Area     []struct {
+						AreaDesc string `json:"areaDesc"`
+					} `json:"area"`
+				} `json:"info"`
+			} `json:"alert"`
+		} `json:"warnings"`
+	}
+	if err := getJSON(meteoAlarmURL+url.PathEscape(country), &feed); err != nil {
+		return nil, err
+	}
+	var warnings []warning
+	for _, w := range feed.Warnings {
+		if len(w.Alert.Info) == 0 {
+			continue
+		}
+		// Warnings are in the local languages, and usually English too
+		info := w.Alert.Info[0]
+		for _, i := range w.Alert.Info {
+			if strings.HasPrefix(strings.ToLower(i.Language), "en") {
+				info = i
+				break
+			}
+		}
+		var areas []string
+		for _, a := range info.Area {
+			areas = append(areas, a.AreaDesc)
+		}
+		warnings = append(warnings, warning{
+			ID:       w.UUID,
+			Source:   "meteoalarm:" + country,
+			Event:    info.Event,
+			Headline: info.Headline,
+			Severity: info.Severity,
+			Areas:    strings.Join(areas, "; "),
+			Expires:  parseTime(info.Expires),
+		})
+	}
+	return warnings, nil
+}
+
+func parseTime(t string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, t)
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed
+}
+
+func getJSON(u string, out interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	// The NWS refuses requests without a User-Agent
+	req.Header.Set("User-Agent", "Go-NEB")
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// distanceKM returns the great-circle distance between two points.
+func distanceKM(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKM = 6371
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat, dLon := rad(lat2-lat1), rad(lon2-lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKM * math.Asin(math.Sqrt(a))
+}
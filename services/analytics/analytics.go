@@ -0,0 +1,356 @@
+// Package analytics implements a Service which posts daily website traffic digests from Matomo or
+// Plausible.
+package analytics
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Analytics service
+const ServiceType = "analytics"
+
+// How many days before the digest's day its traffic is compared to
+const baselineDays = 7
+
+// How many pages and referrers are listed
+const topCount = 5
+
+var httpClient = &http.Client{}
+
+// Service contains the Config fields for the Analytics service.
+//
+// Each day, at the site's configured time, the service posts a digest of the previous day's
+// traffic to the site's room: visitors, pageviews, the top pages and the top referrers. If the
+// site has thresholds, the room is also alerted when the day's visitors were that much higher or
+// lower than the average of the 7 days before.
+//
+// Sites can be on Matomo (https://matomo.org), using an auth token from its personal security
+// settings and the numeric site ID, or on Plausible (https://plausible.io), using a Stats API key
+// and the site's domain as its ID.
+//
+// Example JSON request:
+//   {
+//       "sites": [
+//           {
+//               "name": "Blog",
+//               "provider": "plausible",
+//               "url": "https://plausible.io",
+//               "site_id": "blog.example.com",
+//               "api_token": "YOUR_API_KEY",
+//               "room_id": "!web:localhost",
+//               "timezone": "Europe/London",
+//               "at": "08:00",
+//               "spike_percent": 100,
+//               "drop_percent": 50
+//           }
+//       ]
+//   }
+type Service struct {
+	types.DefaultService
+	// The sites to post digests for.
+	Sites []Site `json:"sites"`
+}
+
+// Site is a website whose traffic is posted to a room.
+type Site struct {
+	// The name of the site in digests. Must be unique.
+	Name string `json:"name"`
+	// "matomo" or "plausible".
+	Provider string `json:"provider"`
+	// The URL of the Matomo or Plausible instance, e.g. "https://plausible.io".
+	URL string `json:"url"`
+	// The ID of the site: its numeric ID on Matomo, or its domain on Plausible.
+	SiteID string `json:"site_id"`
+	// The Matomo auth token or Plausible API key.
+	APIToken string `json:"api_token"`
+	// The room to post to.
+	RoomID id.RoomID `json:"room_id"`
+	// Optional. The IANA timezone days are counted in, e.g. "America/New_York". This should be
+	// the site's timezone in Matomo or Plausible. Defaults to UTC.
+	Timezone string `json:"timezone"`
+	// Optional. The time of day to post the digest at, as "15:04". Defaults to "08:00".
+	At string `json:"at"`
+	// Optional. Alert the room when a day has this many percent more visitors than average. No
+	// alerts are sent by default.
+	SpikePercent int `json:"spike_percent"`
+	// Optional. Alert the room when a day has this many percent fewer visitors than average. No
+	// alerts are sent by default.
+	DropPercent int `json:"drop_percent"`
+}
+
+func (s *Site) at() string {
+	if s.At == "" {
+		return "08:00"
+	}
+	return s.At
+}
+
+// postTime returns when to post on the day in the site's timezone.
+func (s *Site) postTime(day time.Time) time.Time {
+	at, _ := time.Parse("15:04", s.at())
+	return time.Date(day.Year(), day.Month(), day.Day(), at.Hour(), at.Minute(), 0, 0, day.Location())
+}
+
+// provider returns the API client for the site's provider.
+func (s *Site) provider() provider {
+	baseURL := strings.TrimSuffix(s.URL, "/")
+	if s.Provider == "matomo" {
+		return &matomo{baseURL, s.SiteID, s.APIToken}
+	}
+	return &plausible{baseURL, s.SiteID, s.APIToken}
+}
+
+// check returns an error if the site is misconfigured.
+func (s *Site) check() error {
+	if s.Name == "" {
+		return fmt.Errorf("Sites need a name")
+	}
+	if s.Provider != "matomo" && s.Provider != "plausible" {
+		return fmt.Errorf("Site %s: unknown provider '%s': must be matomo or plausible", s.Name, s.Provider)
+	}
+	if s.URL == "" || s.SiteID == "" || s.APIToken == "" || s.RoomID == "" {
+		return fmt.Errorf("Site %s: url, site_id, api_token and room_id are required", s.Name)
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("Site %s: %s", s.Name, err)
+	}
+	if _, err := time.Parse("15:04", s.at()); err != nil {
+		return fmt.Errorf("Site %s: bad time '%s': must be like 08:00", s.Name, s.At)
+	}
+	if s.SpikePercent < 0 || s.DropPercent < 0 || s.DropPercent >= 100 {
+		return fmt.Errorf("Site %s: spike_percent must be positive, and drop_percent between 0 and 100", s.Name)
+	}
+	return nil
+}
+
+// provider gets traffic from an analytics API.
+type provider interface {
+	// report returns the traffic of the day.
+	report(day time.Time) (*report, error)
+	// dailyVisitors returns the number of visitors on each day from start to end, inclusive.
+	dailyVisitors(start, end time.Time) ([]int, error)
+}
+
+// report is a day's traffic.
+type report struct {
+	Visitors     int
+	Pageviews    int
+	TopPages     []count
+	TopReferrers []count
+}
+
+// count is how many visitors a page or referrer had.
+type count struct {
+	Label    string
+	Visitors int
+}
+
+// OnPoll posts the digests of the sites whose time to post has come today. It returns when the
+// next site's time to post comes.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	return s.post(cli, time.Now())
+}
+
+func (s *Service) post(cli types.MatrixClient, now time.Time) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	next := now.Add(24 * time.Hour)
+	posted, err := s.loadPosted()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load when digests were posted")
+		return next
+	}
+
+	for _, site := range s.Sites {
+		siteLogger := logger.WithField("site", site.Name)
+		loc, err := time.LoadLocation(site.Timezone)
+		if err != nil {
+			siteLogger.WithError(err).Error("Invalid timezone")
+			continue
+		}
+		local := now.In(loc)
+		today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+		if postAt := site.postTime(today); now.Before(postAt) {
+			if postAt.Before(next) {
+				next = postAt
+			}
+			continue
+		}
+		if tomorrow := site.postTime(today.AddDate(0, 0, 1)); tomorrow.Before(next) {
+			next = tomorrow
+		}
+		date := today.Format("2006-01-02")
+		if posted[site.Name] == date {
+			continue
+		}
+
+		msgs, err := digest(&site, today.AddDate(0, 0, -1))
+		if err != nil {
+			siteLogger.WithError(err).Error("Failed to fetch traffic")
+			continue
+		}
+		for _, msg := range msgs {
+			if _, err := notify.Send(cli, s, notify.Notification{RoomID: site.RoomID, Content: *msg}); err != nil {
+				siteLogger.WithError(err).Error("Failed to post digest")
+			}
+		}
+		posted[site.Name] = date
+	}
+
+	if err = s.storePosted(posted); err != nil {
+		logger.WithError(err).Error("Failed to store when digests were posted")
+	}
+	return next
+}
+
+// digest returns the messages to post about the day's traffic: an alert, if the day's traffic
+// crossed one of the site's thresholds, and the digest.
+func digest(site *Site, day time.Time) ([]*mevt.MessageEventContent, error) {
+	p := site.provider()
+	r, err := p.report(day)
+	if err != nil {
+		return nil, err
+	}
+	baseline, err := p.dailyVisitors(day.AddDate(0, 0, -baselineDays), day.AddDate(0, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	average := 0.0
+	for _, visitors := range baseline {
+		average += float64(visitors) / float64(len(baseline))
+	}
+	dayName := day.Format("Mon 2 Jan")
+
+	var msgs []*mevt.MessageEventContent
+	change := 0.0
+	if average > 0 {
+		change = (float64(r.Visitors) - average) / average * 100
+		if site.SpikePercent > 0 && change >= float64(site.SpikePercent) {
+			msgs = append(msgs, notice(fmt.Sprintf("📈 %s had a traffic spike on %s: %d visitors, %.0f%% more than the average of %.0f",
+				site.Name, dayName, r.Visitors, change, average)))
+		} else if site.DropPercent > 0 && -change >= float64(site.DropPercent) {
+			msgs = append(msgs, notice(fmt.Sprintf("📉 %s had a traffic drop on %s: %d visitors, %.0f%% fewer than the average of %.0f",
+				site.Name, dayName, r.Visitors, -change, average)))
+		}
+	}
+
+	lines := []string{fmt.Sprintf("📊 %s on %s: %d visitors, %d pageviews", site.Name, dayName, r.Visitors, r.Pageviews)}
+	if average > 0 {
+		lines[0] += fmt.Sprintf(" (%+.0f%% on the last %d days)", change, baselineDays)
+	}
+	if len(r.TopPages) > 0 {
+		lines = append(lines, "Top pages: "+formatCounts(r.TopPages))
+	}
+	if len(r.TopReferrers) > 0 {
+		lines = append(lines, "Top referrers: "+formatCounts(r.TopReferrers))
+	}
+	return append(msgs, notice(strings.Join(lines, "\n"))), nil
+}
+
+func formatCounts(counts []count) string {
+	var texts []string
+	for i, c := range counts {
+		if i == topCount {
+			break
+		}
+		texts = append(texts, fmt.Sprintf("%s (%d)", c.Label, c.Visitors))
+	}
+	return strings.Join(texts, ", ")
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+// getJSON fetches the URL, sending the headers, and decodes the JSON response into v.
+func getJSON(u string, headers map[string]string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// loadPosted returns the local date each site's digest was last posted on.
+func (s *Service) loadPosted() (map[string]string, error) {
+	posted := make(map[string]string)
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "posted")
+	if err == sql.ErrNoRows {
+		return posted, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, &posted); err != nil {
+		return nil, err
+	}
+	return posted, nil
+}
+
+func (s *Service) storePosted(posted map[string]string) error {
+	stateJSON, err := json.Marshal(posted)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "posted", stateJSON)
+}
+
+// Register makes sure that the sites are configured properly, and joins their rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	names := make(map[string]bool)
+	for _, site := range s.Sites {
+		if err := site.check(); err != nil {
+			return err
+		}
+		if names[site.Name] {
+			return fmt.Errorf("There is more than one site called %s", site.Name)
+		}
+		names[site.Name] = true
+	}
+	for _, site := range s.Sites {
+		if _, err := client.JoinRoom(site.RoomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    site.RoomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package analytics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func plausibleResponse(t *testing.T, req *http.Request) string {
+	q := req.URL.Query()
+	if req.Header.Get("Authorization") != "Bearer plausible_key" || q.Get("site_id") != "blog.example.com" {
+		t.Fatalf("Bad Plausible request: %s", req.URL.String())
+	}
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/aggregate") && q.Get("date") == "2021-03-14":
+		return `{"results":{"visitors":{"value":300},"pageviews":{"value":900}}}`
+	case strings.HasSuffix(req.URL.Path, "/breakdown") && q.Get("property") == "event:page":
+		return `{"results":[{"page":"/","visitors":200},{"page":"/about","visitors":50}]}`
+	case strings.HasSuffix(req.URL.Path, "/breakdown") && q.Get("property") == "visit:source":
+		return `{"results":[{"source":"Google","visitors":120}]}`
+	case strings.HasSuffix(req.URL.Path, "/timeseries") && q.Get("date") == "2021-03-07,2021-03-13":
+		return `{"results":[{"date":"2021-03-07","visitors":100},{"date":"2021-03-08","visitors":90},
+			{"date":"2021-03-09","visitors":110},{"date":"2021-03-10","visitors":100},{"date":"2021-03-11","visitors":100},
+			{"date":"2021-03-12","visitors":100},{"date":"2021-03-13","visitors":100}]}`
+	}
+	t.Fatalf("Unexpected Plausible request: %s", req.URL.String())
+	return ""
+}
+
+func matomoResponse(t *testing.T, req *http.Request) string {
+	q := req.URL.Query()
+	if q.Get("token_auth") != "matomo_token" || q.Get("idSite") != "3" || q.Get("format") != "JSON" {
+		t.Fatalf("Bad Matomo request: %s", req.URL.String())
+	}
+	switch method, date := q.Get("method"), q.Get("date"); {
+	case method == "VisitsSummary.get" && date == "2021-03-14":
+		return `{"nb_visits":40,"nb_uniq_visitors":30}`
+	case method == "VisitsSummary.get" && date == "2021-03-07,2021-03-13":
+		return `{"2021-03-07":{"nb_uniq_visitors":100},"2021-03-08":{"nb_uniq_visitors":100},
+			"2021-03-09":{"nb_uniq_visitors":100},"2021-03-10":{"nb_uniq_visitors":100},
+			"2021-03-11":{"nb_uniq_visitors":100},"2021-03-12":{"nb_uniq_visitors":100},"2021-03-13":[]}`
+	case method == "Actions.get":
+		return `{"nb_pageviews":80}`
+	case method == "Actions.getPageUrls" && q.Get("flat") == "1":
+		return `[{"label":"/index","nb_visits":20}]`
+	case method == "Referrers.getAll":
+		return `[]`
+	}
+	t.Fatalf("Unexpected Matomo request: %s", req.URL.String())
+	return ""
+}
+
+func TestDigests(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch req.URL.Host {
+		case "plausible.example.com":
+			body = plausibleResponse(t, req)
+		case "matomo.example.com":
+			body = matomoResponse(t, req)
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$digest:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"sites": [
+			{
+				"name": "Blog", "provider": "plausible", "url": "https://plausible.example.com/",
+				"site_id": "blog.example.com", "api_token": "plausible_key", "room_id": "!web:hyrule",
+				"timezone": "Europe/London", "spike_percent": 100, "drop_percent": 50
+			},
+			{
+				"name": "Shop", "provider": "matomo", "url": "https://matomo.example.com",
+				"site_id": "3", "api_token": "matomo_token", "room_id": "!shop:hyrule",
+				"at": "09:00", "spike_percent": 100, "drop_percent": 50
+			}
+		]
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create analytics service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register analytics service: ", err)
+	}
+	s := srv.(*Service)
+
+	// Monday 15 March 2021
+	morning := time.Date(2021, 3, 15, 7, 0, 0, 0, time.UTC)
+	if next := s.post(matrixCli, morning); !next.Equal(morning.Add(time.Hour)) || len(sent) != 0 {
+		t.Errorf("Bad early post: next %s, sent %q", next, sent)
+	}
+	if next := s.post(matrixCli, morning.Add(90*time.Minute)); !next.Equal(morning.Add(2 * time.Hour)) {
+		t.Errorf("Bad next post time: %s", next)
+	}
+	s.post(matrixCli, morning.Add(2*time.Hour))
+	s.post(matrixCli, morning.Add(3*time.Hour))
+
+	want := []string{
+		"📈 Blog had a traffic spike on Sun 14 Mar: 300 visitors, 200% more than the average of 100",
+		"📊 Blog on Sun 14 Mar: 300 visitors, 900 pageviews (+200% on the last 7 days)\n" +
+			"Top pages: / (200), /about (50)\nTop referrers: Google (120)",
+		"📉 Shop had a traffic drop on Sun 14 Mar: 30 visitors, 65% fewer than the average of 86",
+		"📊 Shop on Sun 14 Mar: 30 visitors, 80 pageviews (-65% on the last 7 days)\nTop pages: /index (20)",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad digests: got %q want %q", sent, want)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"sites": [{"name": "Blog", "provider": "ga", "url": "https://a", "site_id": "1", "api_token": "t", "room_id": "!a:b"}]}`,
+		`{"sites": [{"name": "Blog", "provider": "matomo", "url": "https://a", "site_id": "1", "room_id": "!a:b"}]}`,
+		`{"sites": [{"name": "Blog", "provider": "matomo", "url": "https://a", "site_id": "1", "api_token": "t", "room_id": "!a:b", "at": "8am"}]}`,
+		`{"sites": [{"name": "Blog", "provider": "matomo", "url": "https://a", "site_id": "1", "api_token": "t", "room_id": "!a:b"},
+			{"name": "Blog", "provider": "plausible", "url": "https://a", "site_id": "b", "api_token": "t", "room_id": "!a:b"}]}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create analytics service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
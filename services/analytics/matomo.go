@@ -0,0 +1,120 @@
+package analytics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// matomo gets traffic from the Matomo Reporting API:
+// https://developer.matomo.org/api-reference/reporting-api
+type matomo struct {
+	baseURL   string
+	siteID    string
+	tokenAuth string
+}
+
+// matomoSummary is the part of a VisitsSummary.get report which is used
+type matomoSummary struct {
+	Visits       int `json:"nb_visits"`
+	UniqVisitors int `json:"nb_uniq_visitors"`
+}
+
+// visitors returns the number of unique visitors, or the number of visits if Matomo isn't set
+// up to count unique visitors.
+func (s *matomoSummary) visitors() int {
+	if s.UniqVisitors > 0 {
+		return s.UniqVisitors
+	}
+	return s.Visits
+}
+
+// matomoRow is a row of a report broken down by label, such as the page URL or referrer
+type matomoRow struct {
+	Label  string `json:"label"`
+	Visits int    `json:"nb_visits"`
+}
+
+func (m *matomo) report(day time.Time) (*report, error) {
+	date := day.Format("2006-01-02")
+	var summary matomoSummary
+	if err := m.get("VisitsSummary.get", date, nil, &summary); err != nil {
+		return nil, err
+	}
+	var actions struct {
+		Pageviews int `json:"nb_pageviews"`
+	}
+	if err := m.get("Actions.get", date, nil, &actions); err != nil {
+		return nil, err
+	}
+	r := &report{
+		Visitors:  summary.visitors(),
+		Pageviews: actions.Pageviews,
+	}
+
+	var pages, referrers []matomoRow
+	limit := strconv.Itoa(topCount)
+	if err := m.get("Actions.getPageUrls", date, url.Values{"flat": {"1"}, "filter_limit": {limit}}, &pages); err != nil {
+		return nil, err
+	}
+	if err := m.get("Referrers.getAll", date, url.Values{"filter_limit": {limit}}, &referrers); err != nil {
+		return nil, err
+	}
+	for _, row := range pages {
+		r.TopPages = append(r.TopPages, count{row.Label, row.Visits})
+	}
+	for _, row := range referrers {
+		r.TopReferrers = append(r.TopReferrers, count{row.Label, row.Visits})
+	}
+	return r, nil
+}
+
+func (m *matomo) dailyVisitors(start, end time.Time) ([]int, error) {
+	// Matomo returns an object keyed by date, with an empty array for days without visits
+	var days map[string]json.RawMessage
+	if err := m.get("VisitsSummary.get", start.Format("2006-01-02")+","+end.Format("2006-01-02"), nil, &days); err != nil {
+		return nil, err
+	}
+	var dates []string
+	for date := range days {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	var visitors []int
+	for _, date := range dates {
+		var summary matomoSummary
+		// Days without visits don't unmarshal, and are left as 0
+		_ = json.Unmarshal(days[date], &summary)
+		visitors = append(visitors, summary.visitors())
+	}
+	return visitors, nil
+}
+
+func (m *matomo) get(method, date string, q url.Values, v interface{}) error {
+	if q == nil {
+		q = url.Values{}
+	}
+	q.Set("module", "API")
+	q.Set("method", method)
+	q.Set("idSite", m.siteID)
+	q.Set("period", "day")
+	q.Set("date", date)
+	q.Set("format", "JSON")
+	q.Set("token_auth", m.tokenAuth)
+	var raw json.RawMessage
+	if err := getJSON(m.baseURL+"/index.php?"+q.Encode(), nil, &raw); err != nil {
+		return err
+	}
+	// Matomo responds to bad requests with 200 OK and an error result
+	var apiErr struct {
+		Result  string `json:"result"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(raw, &apiErr) == nil && apiErr.Result == "error" {
+		return fmt.Errorf("Matomo error: %s", apiErr.Message)
+	}
+	return json.Unmarshal(raw, v)
+}
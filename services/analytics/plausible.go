@@ -0,0 +1,95 @@
+package analytics
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// plausible gets traffic from the Plausible Stats API:
+// https://plausible.io/docs/stats-api
+type plausible struct {
+	baseURL string
+	siteID  string
+	apiKey  string
+}
+
+func (p *plausible) report(day time.Time) (*report, error) {
+	date := day.Format("2006-01-02")
+	var aggregate struct {
+		Results struct {
+			Visitors  struct{ Value int } `json:"visitors"`
+			Pageviews struct{ Value int } `json:"pageviews"`
+		} `json:"results"`
+	}
+	if err := p.get("aggregate", url.Values{
+		"period":  {"day"},
+		"date":    {date},
+		"metrics": {"visitors,pageviews"},
+	}, &aggregate); err != nil {
+		return nil, err
+	}
+	r := &report{
+		Visitors:  aggregate.Results.Visitors.Value,
+		Pageviews: aggregate.Results.Pageviews.Value,
+	}
+
+	var err error
+	if r.TopPages, err = p.breakdown(date, "event:page", "page"); err != nil {
+		return nil, err
+	}
+	if r.TopReferrers, err = p.breakdown(date, "visit:source", "source"); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// breakdown returns the values of the property with the most visitors on the day. The values
+// are under the key in the results.
+func (p *plausible) breakdown(date, property, key string) ([]count, error) {
+	var breakdown struct {
+		Results []map[string]interface{} `json:"results"`
+	}
+	if err := p.get("breakdown", url.Values{
+		"period":   {"day"},
+		"date":     {date},
+		"property": {property},
+		"limit":    {strconv.Itoa(topCount)},
+	}, &breakdown); err != nil {
+		return nil, err
+	}
+	var counts []count
+	for _, result := range breakdown.Results {
+		label, _ := result[key].(string)
+		visitors, _ := result["visitors"].(float64)
+		counts = append(counts, count{label, int(visitors)})
+	}
+	return counts, nil
+}
+
+func (p *plausible) dailyVisitors(start, end time.Time) ([]int, error) {
+	var timeseries struct {
+		Results []struct {
+			Visitors int `json:"visitors"`
+		} `json:"results"`
+	}
+	if err := p.get("timeseries", url.Values{
+		"period":  {"custom"},
+		"date":    {start.Format("2006-01-02") + "," + end.Format("2006-01-02")},
+		"metrics": {"visitors"},
+	}, &timeseries); err != nil {
+		return nil, err
+	}
+	var visitors []int
+	for _, result := range timeseries.Results {
+		visitors = append(visitors, result.Visitors)
+	}
+	return visitors, nil
+}
+
+func (p *plausible) get(endpoint string, q url.Values, v interface{}) error {
+	q.Set("site_id", p.siteID)
+	return getJSON(p.baseURL+"/api/v1/stats/"+endpoint+"?"+q.Encode(), map[string]string{
+		"Authorization": "Bearer " + p.apiKey,
+	}, v)
+}
@@ -0,0 +1,301 @@
+// Package announcer implements a Service which posts scheduled announcements and updates room topics.
+package announcer
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"math"
+	"text/template"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/schedule"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Announcer service
+const ServiceType = "announcer"
+
+// Announcements which are due more than this long ago, e.g. because Go-NEB wasn't running, are
+// skipped rather than posted late.
+const maxLateness = time.Hour
+
+// Service contains the Config fields for the Announcer service.
+//
+// This service posts recurring announcements into rooms, and can set the room topic on a schedule,
+// e.g. to say which sprint it is or how long is left until a release freeze. Setting the topic
+// requires the service user to be able to change it.
+//
+// The text, html and topic of announcements are Go templates (https://golang.org/pkg/text/template/),
+// which are given an AnnouncementData. An announcement can rotate through a list of items, such as
+// who runs the next standup, which is given to the templates as .Item.
+//
+// Example JSON request:
+//   {
+//       "rooms": {
+//           "!team:localhost": {
+//               "timezone": "Europe/London",
+//               "announcements": [
+//                   {
+//                       "every": "weekday",
+//                       "at": "09:55",
+//                       "text": "Standup in 5 minutes, run by {{.Item}}",
+//                       "items": ["@alice:localhost", "@bob:localhost"]
+//                   },
+//                   {
+//                       "every": "week",
+//                       "on": ["Monday"],
+//                       "interval": 2,
+//                       "at": "09:00",
+//                       "count": 41,
+//                       "topic": "Sprint {{.Count}} · {{.DaysUntil \"2021-07-01\"}} days until the release freeze"
+//                   }
+//               ]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is the announcements of a room.
+type RoomConfig struct {
+	// Optional. The IANA timezone which the schedules are in, e.g. "America/New_York". Defaults to UTC.
+	Timezone      string         `json:"timezone"`
+	Announcements []Announcement `json:"announcements"`
+}
+
+// Announcement is a message and/or topic which is posted on a schedule (see package "schedule").
+// At least one of Text and Topic is required.
+type Announcement struct {
+	schedule.Schedule
+	// The template of the plain text body of the message.
+	Text string `json:"text"`
+	// Optional. The template of the HTML body of the message.
+	HTML string `json:"html"`
+	// Optional. The msgtype of the message, m.text or m.notice. Defaults to m.notice.
+	MsgType mevt.MessageType `json:"msg_type"`
+	// Optional. The template of the room topic.
+	Topic string `json:"topic"`
+	// Optional. Items which each announcement takes in turn, e.g. people.
+	Items []string `json:"items"`
+	// How many times the announcement has been posted. Can be set to start counting from a
+	// number, e.g. the current sprint. Updated by Go-NEB.
+	Count int `json:"count"`
+	// When the announcement will next be posted, in seconds since the epoch. Populated by Go-NEB.
+	NextTimestampSecs int64 `json:"next_timestamp_secs"`
+	// When the announcement was last posted, in seconds since the epoch. Populated by Go-NEB.
+	LastTimestampSecs int64 `json:"last_timestamp_secs"`
+}
+
+// AnnouncementData is the data which announcement templates are executed with.
+type AnnouncementData struct {
+	RoomID id.RoomID
+	// The time the announcement is due, in the room's timezone.
+	Now time.Time
+	// How many times the announcement was posted before.
+	Count int
+	// The item whose turn it is, if the announcement has items.
+	Item string
+}
+
+// DaysUntil returns the number of days from Now until the date, given as "2006-01-02". It is
+// negative once the date has passed.
+func (d AnnouncementData) DaysUntil(date string) (int, error) {
+	t, err := time.ParseInLocation("2006-01-02", date, d.Now.Location())
+	if err != nil {
+		return 0, err
+	}
+	today := time.Date(d.Now.Year(), d.Now.Month(), d.Now.Day(), 0, 0, 0, 0, d.Now.Location())
+	// Days aren't always 24 hours long when the clocks change
+	return int(math.Round(t.Sub(today).Hours() / 24)), nil
+}
+
+// OnPoll posts the announcements which are due, and returns when the next one is.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	now := time.Now()
+	var next time.Time
+	for roomID, room := range s.Rooms {
+		loc, err := time.LoadLocation(room.Timezone)
+		if err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Invalid timezone")
+			continue
+		}
+		for i := range room.Announcements {
+			a := &room.Announcements[i]
+			due := time.Unix(a.NextTimestampSecs, 0)
+			if a.NextTimestampSecs != 0 && !now.Before(due) {
+				if now.Sub(due) > maxLateness {
+					logger.WithFields(log.Fields{
+						"room_id": roomID,
+						"due":     due,
+					}).Warn("Skipping late announcement")
+				} else {
+					s.announce(cli, roomID, a, due.In(loc))
+					a.Count++
+				}
+				a.LastTimestampSecs = due.Unix()
+			}
+			if a.NextTimestampSecs == 0 || !now.Before(due) {
+				var last time.Time
+				if a.LastTimestampSecs != 0 {
+					last = time.Unix(a.LastTimestampSecs, 0)
+				}
+				n, err := a.Next(now, last, loc)
+				if err != nil {
+					logger.WithError(err).WithField("room_id", roomID).Error("Failed to schedule announcement")
+					continue
+				}
+				a.NextTimestampSecs = n.Unix()
+			}
+			if n := time.Unix(a.NextTimestampSecs, 0); next.IsZero() || n.Before(next) {
+				next = n
+			}
+		}
+	}
+	// Persist the service to save the announcement times and counts
+	if _, err := database.GetServiceDB().StoreService(s); err != nil {
+		logger.WithError(err).Error("Failed to persist announcement times for service")
+	}
+	return next
+}
+
+// announce posts the announcement and sets the room topic.
+func (s *Service) announce(cli types.MatrixClient, roomID id.RoomID, a *Announcement, now time.Time) {
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    roomID,
+	})
+	data := AnnouncementData{
+		RoomID: roomID,
+		Now:    now,
+		Count:  a.Count,
+	}
+	if len(a.Items) > 0 {
+		data.Item = a.Items[a.Count%len(a.Items)]
+	}
+	if a.Text != "" {
+		content, err := a.message(data)
+		if err != nil {
+			logger.WithError(err).Error("Failed to render announcement")
+		} else if _, err = cli.SendMessageEvent(roomID, mevt.EventMessage, content); err != nil {
+			logger.WithError(err).Error("Failed to send announcement")
+		}
+	}
+	if a.Topic != "" {
+		topic, err := render(template.New("topic"), a.Topic, data)
+		if err != nil {
+			logger.WithError(err).Error("Failed to render topic")
+			return
+		}
+		tcli, ok := cli.(types.StateSender)
+		if !ok {
+			logger.Error("Client cannot set room topics")
+			return
+		}
+		if _, err = tcli.SendStateEvent(roomID, mevt.StateTopic, "", map[string]string{"topic": topic}); err != nil {
+			logger.WithError(err).Error("Failed to set topic")
+		}
+	}
+}
+
+// message renders the message of the announcement.
+func (a *Announcement) message(data AnnouncementData) (mevt.MessageEventContent, error) {
+	content := mevt.MessageEventContent{MsgType: a.MsgType}
+	if content.MsgType == "" {
+		content.MsgType = mevt.MsgNotice
+	}
+	var err error
+	if content.Body, err = render(template.New("text"), a.Text, data); err != nil {
+		return content, err
+	}
+	if a.HTML != "" {
+		h, err := htmltemplate.New("html").Parse(a.HTML)
+		if err != nil {
+			return content, err
+		}
+		var buf bytes.Buffer
+		if err = h.Execute(&buf, data); err != nil {
+			return content, err
+		}
+		content.Format = mevt.FormatHTML
+		content.FormattedBody = buf.String()
+	}
+	return content, nil
+}
+
+func render(t *template.Template, text string, data AnnouncementData) (string, error) {
+	t, err := t.Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// check returns an error if the announcement is misconfigured.
+func (a *Announcement) check() error {
+	if err := a.Schedule.Check(); err != nil {
+		return err
+	}
+	if a.Text == "" && a.Topic == "" {
+		return fmt.Errorf("Announcements need a text or a topic")
+	}
+	if a.MsgType != "" && a.MsgType != mevt.MsgText && a.MsgType != mevt.MsgNotice {
+		return fmt.Errorf("msg_type must be m.text or m.notice, not %s", a.MsgType)
+	}
+	if _, err := template.New("text").Parse(a.Text); err != nil {
+		return fmt.Errorf("Bad text template: %s", err)
+	}
+	if _, err := htmltemplate.New("html").Parse(a.HTML); err != nil {
+		return fmt.Errorf("Bad html template: %s", err)
+	}
+	if _, err := template.New("topic").Parse(a.Topic); err != nil {
+		return fmt.Errorf("Bad topic template: %s", err)
+	}
+	return nil
+}
+
+// Register checks the announcements of each room and joins them.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	for roomID, room := range s.Rooms {
+		if _, err := time.LoadLocation(room.Timezone); err != nil {
+			return fmt.Errorf("Bad timezone for room %s: %s", roomID, err)
+		}
+		for i := range room.Announcements {
+			if err := room.Announcements[i].check(); err != nil {
+				return fmt.Errorf("Bad announcement %d for room %s: %s", i, roomID, err)
+			}
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
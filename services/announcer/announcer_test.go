@@ -0,0 +1,101 @@
+package announcer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+)
+
+func TestAnnouncements(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	var messages []string
+	var topics []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			return nil, err
+		}
+		if strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			messages = append(messages, content["body"].(string))
+		} else if strings.Contains(req.URL.Path, "/state/m.room.topic") {
+			topics = append(topics, content["topic"].(string))
+		} else {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"rooms": {
+			"!castle:hyrule": {
+				"announcements": [{
+					"every": "day",
+					"text": "Standup run by {{.Item}}",
+					"items": ["@zelda:hyrule", "@link:hyrule"],
+					"topic": "Sprint {{.Count}}",
+					"count": 41
+				}]
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create announcer service: ", err)
+	}
+	s := srv.(*Service)
+	if err = s.Rooms["!castle:hyrule"].Announcements[0].check(); err != nil {
+		t.Fatalf("Announcement failed check: %s", err)
+	}
+
+	// The first poll only schedules the announcement
+	next := s.OnPoll(matrixCli)
+	if len(messages) != 0 || next.Before(time.Now()) {
+		t.Fatalf("Expected the announcement to be scheduled, got %v, next %s", messages, next)
+	}
+
+	// Make it due
+	a := &s.Rooms["!castle:hyrule"].Announcements[0]
+	a.NextTimestampSecs = time.Now().Add(-time.Minute).Unix()
+	s.OnPoll(matrixCli)
+	if len(messages) != 1 || messages[0] != "Standup run by @link:hyrule" {
+		t.Errorf("Bad announcement: %v", messages)
+	}
+	if len(topics) != 1 || topics[0] != "Sprint 41" {
+		t.Errorf("Bad topic: %v", topics)
+	}
+	if a.Count != 42 || time.Unix(a.NextTimestampSecs, 0).Before(time.Now()) {
+		t.Errorf("Expected the announcement to be counted and rescheduled, got %+v", a)
+	}
+
+	// Announcements which are very late are skipped
+	a.NextTimestampSecs = time.Now().Add(-2 * maxLateness).Unix()
+	s.OnPoll(matrixCli)
+	if len(messages) != 1 || a.Count != 42 {
+		t.Errorf("Expected the late announcement to be skipped, got %v", messages)
+	}
+}
+
+func TestDaysUntil(t *testing.T) {
+	d := AnnouncementData{Now: time.Date(2021, 6, 4, 23, 0, 0, 0, time.UTC)}
+	for date, want := range map[string]int{"2021-06-04": 0, "2021-06-05": 1, "2021-07-01": 27, "2021-06-01": -3} {
+		if got, err := d.DaysUntil(date); err != nil || got != want {
+			t.Errorf("DaysUntil(%s) = %d, %v, want %d", date, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package appwatch
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestCheck(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("Failed to generate key: ", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	fdroid := `{"packageName":"org.hyrule.ocarina","suggestedVersionCode":10,"packages":[{"versionName":"1.0","versionCode":10}]}`
+	track := `{"track":"beta","releases":[{"name":"2.0","versionCodes":["20"],"status":"completed"}]}`
+	editsDeleted := 0
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch u := req.URL.String(); {
+		case u == "https://oauth2.googleapis.com/token":
+			body = `{"access_token":"triforce","token_type":"Bearer","expires_in":3600}`
+		case u == fdroidURL+"org.hyrule.ocarina":
+			body = fdroid
+		case req.Header.Get("Authorization") != "Bearer triforce":
+			return nil, fmt.Errorf("Unauthorised request: %s", u)
+		case req.Method == "POST" && u == playURL+"com.hyrule.sheikah/edits":
+			body = `{"id":"edit1"}`
+		case req.Method == "GET" && u == playURL+"com.hyrule.sheikah/edits/edit1/tracks/beta":
+			body = track
+		case req.Method == "DELETE" && u == playURL+"com.hyrule.sheikah/edits/edit1":
+			editsDeleted++
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s %s", req.Method, u)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$release:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	config, _ := json.Marshal(map[string]interface{}{
+		"room_id":         "!releases:hyrule",
+		"fdroid_packages": []string{"org.hyrule.ocarina"},
+		"play_packages":   []string{"com.hyrule.sheikah"},
+		"play_track":      "beta",
+		"play_service_account": map[string]string{
+			"client_email": "appwatch@hyrule.iam.gserviceaccount.com",
+			"private_key":  string(keyPEM),
+		},
+		"language": "fr-FR",
+	})
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", config)
+	if err != nil {
+		t.Fatal("Failed to create appwatch service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register appwatch service: ", err)
+	}
+	s := srv.(*Service)
+
+	s.check(matrixCli)
+	if len(sent) != 0 {
+		t.Errorf("Announced versions which were out when the packages were added: %q", sent)
+	}
+
+	fdroid = `{"packageName":"org.hyrule.ocarina","suggestedVersionCode":11,"packages":[{"versionName":"1.2-beta","versionCode":12},{"versionName":"1.1","versionCode":11}]}`
+	track = `{"track":"beta","releases":[
+		{"name":"2.1","versionCodes":["21"],"status":"inProgress","userFraction":0.2,"releaseNotes":[
+			{"language":"en-US","text":"Warp songs"},{"language":"fr-FR","text":"Chants de téléportation"}]},
+		{"name":"2.2","versionCodes":["22"],"status":"draft"},
+		{"name":"2.0","versionCodes":["20"],"status":"completed"}
+	]}`
+	s.check(matrixCli)
+	s.check(matrixCli)
+
+	want := []string{
+		"📦 org.hyrule.ocarina 1.1 is out on F-Droid\nhttps://f-droid.org/packages/org.hyrule.ocarina/",
+		"📦 com.hyrule.sheikah 2.1 is out on Google Play (beta), rolling out to 20% of users\nWhat's new:\nChants de téléportation\n" +
+			"https://play.google.com/store/apps/details?id=com.hyrule.sheikah",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad announcements: got %q, want %q", sent, want)
+	}
+	if editsDeleted != 3 {
+		t.Errorf("Deleted %d Google Play edits, want 3", editsDeleted)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"fdroid_packages": ["org.fdroid.fdroid"]}`,
+		`{"room_id": "!releases:hyrule"}`,
+		`{"room_id": "!releases:hyrule", "fdroid_packages": ["fdroid"]}`,
+		`{"room_id": "!releases:hyrule", "poll_interval_mins": 1, "fdroid_packages": ["org.fdroid.fdroid"]}`,
+		`{"room_id": "!releases:hyrule", "play_packages": ["com.example.app"]}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create appwatch service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
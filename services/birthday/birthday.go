@@ -0,0 +1,696 @@
+// Package birthday implements a Service which celebrates birthdays and anniversaries in rooms.
+package birthday
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Birthday service
+const ServiceType = "birthday"
+
+// How far ahead the digest and "!birthday upcoming" look
+const (
+	digestDays   = 7
+	upcomingDays = 30
+)
+
+// The layouts birthdays can be given in. Years are left out, because they aren't needed.
+var dayLayouts = []string{"2 January", "January 2", "2 Jan", "Jan 2", "01-02"}
+
+// The layouts anniversaries can be given in
+var dateLayouts = []string{"2 January 2006", "January 2 2006", "2 Jan 2006", "Jan 2 2006", "2006-01-02"}
+
+var ordinalRegex = regexp.MustCompile(`\b(\d{1,2})(st|nd|rd|th)\b`)
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// Service contains the Config fields for the Birthday service.
+//
+// Rooms opt in to birthdays by being configured here. Members of those rooms tell the bot their
+// birthday with "!birthday set 14 March", which can be done in a direct message to the bot, and
+// then choose which rooms celebrate it by saying "!birthday share" in them. Birthdays are never
+// mentioned in rooms which the member hasn't shared them with, and years aren't asked for, so
+// ages are never given away. "!birthday forget" removes everything the bot knows about a member.
+//
+// Rooms can also have anniversaries, e.g. "!anniversary add 3 June 2015 Project launch", which are
+// celebrated each year in the room.
+//
+// On the day, the bot congratulates people in the room at the configured time. Once a week it
+// also posts a digest of the birthdays and anniversaries coming up in the next 7 days.
+//
+// Example JSON request:
+//   {
+//       "rooms": {
+//           "!team:localhost": {
+//               "timezone": "Europe/London",
+//               "at": "09:00",
+//               "digest_day": "monday"
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// The rooms which celebrate birthdays and anniversaries.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is the settings of a room.
+type RoomConfig struct {
+	// Optional. The IANA timezone of the room, e.g. "America/New_York". Defaults to UTC.
+	Timezone string `json:"timezone"`
+	// Optional. The time of day to post at, as "15:04". Defaults to "09:00".
+	At string `json:"at"`
+	// Optional. The day of the week to post the digest of upcoming birthdays, e.g. "friday", or
+	// "none" for no digest. Defaults to "monday".
+	DigestDay string `json:"digest_day"`
+}
+
+func (r *RoomConfig) at() string {
+	if r.At == "" {
+		return "09:00"
+	}
+	return r.At
+}
+
+func (r *RoomConfig) digestDay() string {
+	if r.DigestDay == "" {
+		return "monday"
+	}
+	return strings.ToLower(r.DigestDay)
+}
+
+// postTime returns when to post on the day in the room's timezone.
+func (r *RoomConfig) postTime(day time.Time) time.Time {
+	at, _ := time.Parse("15:04", r.at())
+	return time.Date(day.Year(), day.Month(), day.Day(), at.Hour(), at.Minute(), 0, 0, day.Location())
+}
+
+// check returns an error if the room is misconfigured.
+func (r *RoomConfig) check() error {
+	if _, err := time.LoadLocation(r.Timezone); err != nil {
+		return err
+	}
+	if _, err := time.Parse("15:04", r.at()); err != nil {
+		return fmt.Errorf("Bad time '%s': must be like 09:00", r.At)
+	}
+	if _, ok := weekdays[r.digestDay()]; !ok && r.digestDay() != "none" {
+		return fmt.Errorf("Bad digest_day '%s': must be a day of the week or none", r.DigestDay)
+	}
+	return nil
+}
+
+// birthday is a member's birthday. Birthdays are stored in the service state under "birthdays",
+// keyed by user ID.
+type birthday struct {
+	Month time.Month `json:"month"`
+	Day   int        `json:"day"`
+	// The rooms which the member shares their birthday with
+	Rooms []id.RoomID `json:"rooms"`
+}
+
+func (b *birthday) sharedWith(roomID id.RoomID) bool {
+	for _, r := range b.Rooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// anniversary is a yearly event in a room. Anniversaries are stored in the service state under
+// "anniversaries", keyed by room ID.
+type anniversary struct {
+	Label string `json:"label"`
+	// The date of the original event, as "2006-01-02"
+	Date string `json:"date"`
+}
+
+// event is a birthday or anniversary which falls on a day.
+type event struct {
+	day time.Time
+	// The member whose birthday it is, or empty for an anniversary
+	userID id.UserID
+	label  string
+	years  int
+}
+
+func (e *event) text() string {
+	if e.userID != "" {
+		return fmt.Sprintf("%s's birthday", e.userID)
+	}
+	return fmt.Sprintf("%s since %s", pluralYears(e.years), e.label)
+}
+
+func (e *event) html() string {
+	if e.userID != "" {
+		return pill(e.userID) + "'s birthday"
+	}
+	return html.EscapeString(e.text())
+}
+
+// Commands supported:
+//    !birthday set 14 March
+// Remembers the sender's birthday.
+//    !birthday share
+//    !birthday hide
+// Starts or stops celebrating the sender's birthday in the room.
+//    !birthday forget
+// Forgets the sender's birthday, and stops celebrating it everywhere.
+//    !birthday upcoming
+// Responds with the birthdays and anniversaries in the room in the next 30 days.
+//    !anniversary add 3 June 2015 label
+//    !anniversary remove label
+// Adds or removes an anniversary in the room.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"birthday", "set"},
+			Arguments: []string{"day month"},
+			Help:      "Tell the bot your birthday, e.g. !birthday set 14 March",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSet(userID, args)
+			},
+		},
+		{
+			Path: []string{"birthday", "share"},
+			Help: "Celebrate your birthday in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdShare(roomID, userID, true)
+			},
+		},
+		{
+			Path: []string{"birthday", "hide"},
+			Help: "Stop celebrating your birthday in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdShare(roomID, userID, false)
+			},
+		},
+		{
+			Path: []string{"birthday", "forget"},
+			Help: "Make the bot forget your birthday",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdForget(userID)
+			},
+		},
+		{
+			Path: []string{"birthday", "upcoming"},
+			Help: fmt.Sprintf("Show the birthdays and anniversaries in this room in the next %d days", upcomingDays),
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdUpcoming(roomID, time.Now())
+			},
+		},
+		{
+			Path:      []string{"anniversary", "add"},
+			Arguments: []string{"day month year", "label"},
+			Help:      "Celebrate an anniversary in this room, e.g. !anniversary add 3 June 2015 Project launch",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdAddAnniversary(roomID, args)
+			},
+		},
+		{
+			Path:      []string{"anniversary", "remove"},
+			Arguments: []string{"label"},
+			Help:      "Stop celebrating an anniversary in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdRemoveAnniversary(roomID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdSet(userID id.UserID, args []string) (interface{}, error) {
+	t, err := parseDate(strings.Join(args, " "), dayLayouts)
+	if err != nil {
+		return nil, fmt.Errorf("Usage: !birthday set 14 March")
+	}
+	birthdays, err := s.loadBirthdays()
+	if err != nil {
+		return nil, err
+	}
+	b := birthdays[userID]
+	if b == nil {
+		b = &birthday{}
+		birthdays[userID] = b
+	}
+	b.Month, b.Day = t.Month(), t.Day()
+	if err = s.storeBirthdays(birthdays); err != nil {
+		return nil, err
+	}
+	body := fmt.Sprintf("Saved your birthday as %d %s.", b.Day, b.Month)
+	if len(b.Rooms) == 0 {
+		body += " Say !birthday share in a room to have it celebrated there."
+	}
+	return notice(body), nil
+}
+
+func (s *Service) cmdShare(roomID id.RoomID, userID id.UserID, share bool) (interface{}, error) {
+	if _, ok := s.Rooms[roomID]; !ok {
+		return nil, fmt.Errorf("Birthdays aren't celebrated in this room")
+	}
+	birthdays, err := s.loadBirthdays()
+	if err != nil {
+		return nil, err
+	}
+	b := birthdays[userID]
+	if b == nil {
+		return nil, fmt.Errorf("I don't know your birthday yet. Tell me with !birthday set 14 March")
+	}
+	if share == b.sharedWith(roomID) {
+		if share {
+			return notice("Your birthday is already celebrated in this room"), nil
+		}
+		return notice("Your birthday isn't celebrated in this room"), nil
+	}
+	if share {
+		b.Rooms = append(b.Rooms, roomID)
+	} else {
+		var rooms []id.RoomID
+		for _, r := range b.Rooms {
+			if r != roomID {
+				rooms = append(rooms, r)
+			}
+		}
+		b.Rooms = rooms
+	}
+	if err = s.storeBirthdays(birthdays); err != nil {
+		return nil, err
+	}
+	if share {
+		return notice(fmt.Sprintf("Your birthday on %d %s will be celebrated in this room", b.Day, b.Month)), nil
+	}
+	return notice("Your birthday won't be celebrated in this room any more"), nil
+}
+
+func (s *Service) cmdForget(userID id.UserID) (interface{}, error) {
+	birthdays, err := s.loadBirthdays()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := birthdays[userID]; !ok {
+		return notice("I don't know your birthday"), nil
+	}
+	delete(birthdays, userID)
+	if err = s.storeBirthdays(birthdays); err != nil {
+		return nil, err
+	}
+	return notice("I've forgotten your birthday"), nil
+}
+
+func (s *Service) cmdUpcoming(roomID id.RoomID, now time.Time) (interface{}, error) {
+	room, ok := s.Rooms[roomID]
+	if !ok {
+		return nil, fmt.Errorf("Birthdays aren't celebrated in this room")
+	}
+	loc, err := time.LoadLocation(room.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	today := startOfDay(now.In(loc))
+	events, err := s.events(roomID, today, today.AddDate(0, 0, upcomingDays))
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return notice(fmt.Sprintf("There are no birthdays or anniversaries in the next %d days", upcomingDays)), nil
+	}
+	msg := eventList(fmt.Sprintf("Coming up in the next %d days:", upcomingDays), events)
+	return &msg, nil
+}
+
+func (s *Service) cmdAddAnniversary(roomID id.RoomID, args []string) (interface{}, error) {
+	if _, ok := s.Rooms[roomID]; !ok {
+		return nil, fmt.Errorf("Anniversaries aren't celebrated in this room")
+	}
+	// The date is the first 3 words, or the first word if it is "2006-01-02"
+	var t time.Time
+	var err error
+	label := ""
+	if len(args) > 3 {
+		t, err = parseDate(strings.Join(args[:3], " "), dateLayouts)
+		label = strings.Join(args[3:], " ")
+	}
+	if t.IsZero() && len(args) > 1 {
+		t, err = parseDate(args[0], dateLayouts)
+		label = strings.Join(args[1:], " ")
+	}
+	if t.IsZero() || err != nil {
+		return nil, fmt.Errorf("Usage: !anniversary add 3 June 2015 label")
+	}
+
+	anniversaries, err := s.loadAnniversaries()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range anniversaries[roomID] {
+		if strings.EqualFold(a.Label, label) {
+			return nil, fmt.Errorf("There is already an anniversary called %s", a.Label)
+		}
+	}
+	anniversaries[roomID] = append(anniversaries[roomID], anniversary{label, t.Format("2006-01-02")})
+	if err = s.storeAnniversaries(anniversaries); err != nil {
+		return nil, err
+	}
+	return notice(fmt.Sprintf("%s will be celebrated every %d %s", label, t.Day(), t.Month())), nil
+}
+
+func (s *Service) cmdRemoveAnniversary(roomID id.RoomID, args []string) (interface{}, error) {
+	label := strings.Join(args, " ")
+	anniversaries, err := s.loadAnniversaries()
+	if err != nil {
+		return nil, err
+	}
+	for i, a := range anniversaries[roomID] {
+		if !strings.EqualFold(a.Label, label) {
+			continue
+		}
+		anniversaries[roomID] = append(anniversaries[roomID][:i], anniversaries[roomID][i+1:]...)
+		if err = s.storeAnniversaries(anniversaries); err != nil {
+			return nil, err
+		}
+		return notice(fmt.Sprintf("%s won't be celebrated any more", a.Label)), nil
+	}
+	return nil, fmt.Errorf("There is no anniversary called %s in this room", label)
+}
+
+// OnPoll congratulates people in the rooms whose time to post has come today, and posts the
+// weekly digests. It returns when the next room's time to post comes.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	return s.post(cli, time.Now())
+}
+
+func (s *Service) post(cli types.MatrixClient, now time.Time) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	next := now.Add(24 * time.Hour)
+	earliest := func(t time.Time) {
+		if t.Before(next) {
+			next = t
+		}
+	}
+	posted, err := s.loadPosted()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load when rooms were posted in")
+		return next
+	}
+
+	for roomID, room := range s.Rooms {
+		roomLogger := logger.WithField("room_id", roomID)
+		loc, err := time.LoadLocation(room.Timezone)
+		if err != nil {
+			roomLogger.WithError(err).Error("Invalid timezone")
+			continue
+		}
+		today := startOfDay(now.In(loc))
+		date := today.Format("2006-01-02")
+		if postAt := room.postTime(today); now.Before(postAt) {
+			earliest(postAt)
+			continue
+		}
+		earliest(room.postTime(today.AddDate(0, 0, 1)))
+		if posted[roomID.String()] == date {
+			continue
+		}
+
+		events, err := s.events(roomID, today, today.AddDate(0, 0, digestDays+1))
+		if err != nil {
+			roomLogger.WithError(err).Error("Failed to load birthdays")
+			continue
+		}
+		var todays, upcoming []event
+		for _, e := range events {
+			if e.day.Equal(today) {
+				todays = append(todays, e)
+			} else {
+				upcoming = append(upcoming, e)
+			}
+		}
+		if len(todays) > 0 {
+			s.send(cli, roomID, congratulations(todays))
+		}
+		if weekday, ok := weekdays[room.digestDay()]; ok && today.Weekday() == weekday && len(upcoming) > 0 {
+			msg := eventList("Coming up this week:", upcoming)
+			s.send(cli, roomID, &msg)
+		}
+		posted[roomID.String()] = date
+	}
+
+	if err = s.storePosted(posted); err != nil {
+		logger.WithError(err).Error("Failed to store when rooms were posted in")
+	}
+	return next
+}
+
+func (s *Service) send(cli types.MatrixClient, roomID id.RoomID, msg *mevt.MessageEventContent) {
+	if _, err := cli.SendMessageEvent(roomID, mevt.EventMessage, msg); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    roomID,
+			"service_id": s.ServiceID(),
+		}).Error("Failed to send birthday message")
+	}
+}
+
+// events returns the birthdays shared with the room and the room's anniversaries from the start
+// day up to but not including the end day, in order.
+func (s *Service) events(roomID id.RoomID, start, end time.Time) ([]event, error) {
+	birthdays, err := s.loadBirthdays()
+	if err != nil {
+		return nil, err
+	}
+	anniversaries, err := s.loadAnniversaries()
+	if err != nil {
+		return nil, err
+	}
+	var events []event
+	for userID, b := range birthdays {
+		if !b.sharedWith(roomID) {
+			continue
+		}
+		if day := nextOccurrence(b.Month, b.Day, start); day.Before(end) {
+			events = append(events, event{day: day, userID: userID})
+		}
+	}
+	for _, a := range anniversaries[roomID] {
+		t, err := time.Parse("2006-01-02", a.Date)
+		if err != nil {
+			continue
+		}
+		day := nextOccurrence(t.Month(), t.Day(), start)
+		if years := day.Year() - t.Year(); years > 0 && day.Before(end) {
+			events = append(events, event{day: day, label: a.Label, years: years})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].day.Equal(events[j].day) {
+			return events[i].day.Before(events[j].day)
+		}
+		return events[i].text() < events[j].text()
+	})
+	return events, nil
+}
+
+// nextOccurrence returns the first day on or after the start day which is the day of the month.
+// Birthdays on the 29th of February are celebrated on the 28th in other years.
+func nextOccurrence(month time.Month, day int, start time.Time) time.Time {
+	for year := start.Year(); ; year++ {
+		d := day
+		if month == time.February && day == 29 && !isLeap(year) {
+			d = 28
+		}
+		t := time.Date(year, month, d, 0, 0, 0, 0, start.Location())
+		if !t.Before(start) {
+			return t
+		}
+	}
+}
+
+func isLeap(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// parseDate parses the date in any of the layouts, ignoring case, commas and ordinals like "14th".
+func parseDate(text string, layouts []string) (time.Time, error) {
+	text = strings.Join(strings.Fields(strings.Replace(text, ",", " ", -1)), " ")
+	text = ordinalRegex.ReplaceAllString(text, "$1")
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, text); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Bad date '%s'", text)
+}
+
+// congratulations returns the message for the birthdays and anniversaries which are today.
+func congratulations(events []event) *mevt.MessageEventContent {
+	var names, namesHTML, lines, linesHTML []string
+	for _, e := range events {
+		if e.userID != "" {
+			names = append(names, e.userID.String())
+			namesHTML = append(namesHTML, pill(e.userID))
+		} else {
+			line := fmt.Sprintf("🎉 Today is %s!", e.text())
+			lines = append(lines, line)
+			linesHTML = append(linesHTML, html.EscapeString(line))
+		}
+	}
+	if len(names) > 0 {
+		lines = append([]string{"🎂 Happy birthday " + joinAnd(names) + "!"}, lines...)
+		linesHTML = append([]string{"🎂 Happy birthday " + joinAnd(namesHTML) + "!"}, linesHTML...)
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgText,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: strings.Join(linesHTML, "<br>"),
+	}
+}
+
+// eventList returns a message listing the events under the title.
+func eventList(title string, events []event) mevt.MessageEventContent {
+	var lines, items []string
+	for _, e := range events {
+		day := e.day.Format("Mon 2 Jan")
+		lines = append(lines, fmt.Sprintf("%s: %s", day, e.text()))
+		items = append(items, fmt.Sprintf("<li>%s: %s</li>", day, e.html()))
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          title + "\n" + strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: html.EscapeString(title) + "<ul>" + strings.Join(items, "") + "</ul>",
+	}
+}
+
+func joinAnd(items []string) string {
+	if len(items) == 1 {
+		return items[0]
+	}
+	return strings.Join(items[:len(items)-1], ", ") + " and " + items[len(items)-1]
+}
+
+func pluralYears(n int) string {
+	if n == 1 {
+		return "1 year"
+	}
+	return fmt.Sprintf("%d years", n)
+}
+
+func pill(userID id.UserID) string {
+	return fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, userID, html.EscapeString(userID.String()))
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func (s *Service) loadBirthdays() (map[id.UserID]*birthday, error) {
+	birthdays := make(map[id.UserID]*birthday)
+	if err := s.loadState("birthdays", &birthdays); err != nil {
+		return nil, err
+	}
+	return birthdays, nil
+}
+
+func (s *Service) storeBirthdays(birthdays map[id.UserID]*birthday) error {
+	return s.storeState("birthdays", birthdays)
+}
+
+func (s *Service) loadAnniversaries() (map[id.RoomID][]anniversary, error) {
+	anniversaries := make(map[id.RoomID][]anniversary)
+	if err := s.loadState("anniversaries", &anniversaries); err != nil {
+		return nil, err
+	}
+	return anniversaries, nil
+}
+
+func (s *Service) storeAnniversaries(anniversaries map[id.RoomID][]anniversary) error {
+	return s.storeState("anniversaries", anniversaries)
+}
+
+// loadPosted returns the date each room was last posted in, in the room's timezone.
+func (s *Service) loadPosted() (map[string]string, error) {
+	posted := make(map[string]string)
+	if err := s.loadState("posted", &posted); err != nil {
+		return nil, err
+	}
+	return posted, nil
+}
+
+func (s *Service) storePosted(posted map[string]string) error {
+	return s.storeState("posted", posted)
+}
+
+func (s *Service) loadState(key string, out interface{}) error {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), key)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(stateJSON, out)
+}
+
+func (s *Service) storeState(key string, value interface{}) error {
+	stateJSON, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), key, stateJSON)
+}
+
+// Register checks each room and joins them.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	for roomID, room := range s.Rooms {
+		if err := room.check(); err != nil {
+			return fmt.Errorf("Bad room %s: %s", roomID, err)
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
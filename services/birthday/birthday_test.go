@@ -0,0 +1,144 @@
+package birthday
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestBirthdays(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$birthday:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"rooms": {"!team:hyrule": {"timezone": "UTC", "at": "09:00"}}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create birthday service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register birthday service: ", err)
+	}
+	s := srv.(*Service)
+
+	body := func(res interface{}, err error) string {
+		if err != nil {
+			t.Fatalf("Command failed: %s", err)
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+	for user, day := range map[id.UserID]string{
+		"@alice:hyrule": "15th March",
+		"@bob:hyrule":   "march 17",
+		"@carol:hyrule": "29 Feb",
+		"@dave:hyrule":  "16 Mar",
+	} {
+		body(s.cmdSet(user, strings.Fields(day)))
+		if user != "@dave:hyrule" {
+			body(s.cmdShare("!team:hyrule", user, true))
+		}
+	}
+	if _, err = s.cmdShare("!other:hyrule", "@alice:hyrule", true); err == nil {
+		t.Errorf("Expected sharing in an unconfigured room to fail")
+	}
+	if _, err = s.cmdShare("!team:hyrule", "@erin:hyrule", true); err == nil {
+		t.Errorf("Expected sharing an unknown birthday to fail")
+	}
+	if _, err = s.cmdSet("@erin:hyrule", []string{"32", "March"}); err == nil {
+		t.Errorf("Expected a bad birthday to be refused")
+	}
+	body(s.cmdAddAnniversary("!team:hyrule", strings.Fields("15 March 2016 Project launch")))
+	body(s.cmdAddAnniversary("!team:hyrule", strings.Fields("2020-03-20 Office move")))
+	body(s.cmdAddAnniversary("!team:hyrule", strings.Fields("2020-04-01 Fools")))
+	if got := body(s.cmdRemoveAnniversary("!team:hyrule", []string{"fools"})); got != "Fools won't be celebrated any more" {
+		t.Errorf("Bad remove: %s", got)
+	}
+
+	if got := body(s.cmdUpcoming("!team:hyrule", time.Date(2021, 2, 20, 12, 0, 0, 0, time.UTC))); got != "Coming up in the next 30 days:\n"+
+		"Sun 28 Feb: @carol:hyrule's birthday\n"+
+		"Mon 15 Mar: 5 years since Project launch\n"+
+		"Mon 15 Mar: @alice:hyrule's birthday\n"+
+		"Wed 17 Mar: @bob:hyrule's birthday\n"+
+		"Sat 20 Mar: 1 year since Office move" {
+		t.Errorf("Bad upcoming: %s", got)
+	}
+
+	// Monday 15 March 2021: nothing is posted before 09:00, and everything is only posted once
+	monday := time.Date(2021, 3, 15, 8, 0, 0, 0, time.UTC)
+	if next := s.post(matrixCli, monday); !next.Equal(monday.Add(time.Hour)) {
+		t.Errorf("Bad next post time before 09:00: %s", next)
+	}
+	if len(sent) != 0 {
+		t.Errorf("Posted before 09:00: %q", sent)
+	}
+	if next := s.post(matrixCli, monday.Add(90*time.Minute)); !next.Equal(monday.Add(25 * time.Hour)) {
+		t.Errorf("Bad next post time after 09:00: %s", next)
+	}
+	s.post(matrixCli, monday.Add(2*time.Hour))
+	want := []string{
+		"🎂 Happy birthday @alice:hyrule!\n🎉 Today is 5 years since Project launch!",
+		"Coming up this week:\nWed 17 Mar: @bob:hyrule's birthday\nSat 20 Mar: 1 year since Office move",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad messages: got %q, want %q", sent, want)
+	}
+
+	// Forgotten birthdays aren't celebrated
+	body(s.cmdForget("@bob:hyrule"))
+	sent = nil
+	s.post(matrixCli, time.Date(2021, 3, 17, 9, 0, 0, 0, time.UTC))
+	if len(sent) != 0 {
+		t.Errorf("Posted a forgotten birthday: %q", sent)
+	}
+}
+
+func TestNextOccurrence(t *testing.T) {
+	testCases := []struct {
+		month time.Month
+		day   int
+		start time.Time
+		want  string
+	}{
+		{time.March, 14, time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), "2021-03-14"},
+		{time.March, 14, time.Date(2021, 3, 14, 0, 0, 0, 0, time.UTC), "2021-03-14"},
+		{time.March, 14, time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC), "2022-03-14"},
+		{time.February, 29, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), "2021-02-28"},
+		{time.February, 29, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), "2024-02-29"},
+	}
+	for _, tc := range testCases {
+		if got := nextOccurrence(tc.month, tc.day, tc.start).Format("2006-01-02"); got != tc.want {
+			t.Errorf("nextOccurrence(%s %d, %s): got %s, want %s", tc.month, tc.day, tc.start, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package bitbucket implements a Service which sends notices into rooms when Bitbucket Cloud sends
+// webhook events to it.
+package bitbucket
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/templates"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Bitbucket service.
+const ServiceType = "bitbucket"
+
+// The biggest webhook payload which is read
+const maxPayloadSize = 5 * 1024 * 1024
+
+// Matches 'workspace/repo'
+var workspaceRepoRegex = regexp.MustCompile(`^[A-Za-z0-9-_.]+/[A-Za-z0-9-_.]+$`)
+
+// Service contains the Config fields for the Bitbucket service.
+//
+// This service will send notices into a Matrix room when Bitbucket Cloud sends webhook events to
+// it. It requires a public domain which Bitbucket can reach. Notices will be sent as the service
+// user ID.
+//
+// Go-NEB can't create the webhooks itself. Add a webhook to each repository under Repository
+// settings > Webhooks, with the URL in webhook_url and the secret from this config, and choose
+// the triggers to send: pushes, pull requests created, merged, declined, approved and with
+// changes requested, and builds once they have finished. Builds, including Bitbucket Pipelines,
+// come from the "Build status created" and "Build status updated" triggers.
+//
+// Example JSON request:
+//   {
+//       "secret_token": "a long random string",
+//       "rooms": {
+//           "!ewfug483gsfe:localhost": {
+//               "repos": {
+//                   "my-workspace/my-repo": {
+//                       "events": ["push", "pull_request", "pipeline"],
+//                       "branches": ["main", "release/*"]
+//                   }
+//               }
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL to add as the repositories' webhook. Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// Optional. The secret the webhooks are set up with. If supplied, Go-NEB will check the
+	// X-Hub-Signature of incoming webhook requests with it.
+	SecretToken string `json:"secret_token"`
+	// A map from Matrix room ID to the Bitbucket repositories to announce events from.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is which events are announced in a room.
+type RoomConfig struct {
+	// A map of "workspace/repo" repositories to the events to announce.
+	Repos map[string]RepoConfig `json:"repos"`
+}
+
+// RepoConfig is which of a repository's events are announced.
+type RepoConfig struct {
+	// Optional. The events to announce: "push", "pull_request" and "pipeline". Defaults to all
+	// of them.
+	Events []string `json:"events"`
+	// Optional. Only announce pushes to, pull requests into and builds of branches matching these
+	// patterns, e.g. "release/*".
+	Branches []string `json:"branches"`
+}
+
+// allows returns whether the room wants to hear about the event.
+func (c *RepoConfig) allows(ev *event) bool {
+	if len(c.Events) > 0 && !contains(c.Events, ev.Kind) {
+		return false
+	}
+	branches := ev.branches()
+	if len(c.Branches) == 0 || len(branches) == 0 {
+		return true
+	}
+	for _, branch := range branches {
+		for _, pattern := range c.Branches {
+			if ok, _ := path.Match(pattern, branch); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// OnReceiveWebhook receives requests from Bitbucket and sends notices about them into the rooms
+// of their repository.
+//
+// If a secret token is configured, the request must be signed with it. Events which aren't
+// announced, or are about repositories which aren't configured, are acknowledged and ignored, so
+// that Bitbucket doesn't disable the webhook.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxPayloadSize))
+	if err != nil {
+		log.WithError(err).Error("Failed to read Bitbucket webhook body")
+		w.WriteHeader(400)
+		return
+	}
+	if s.SecretToken != "" && !checkSignature(body, req.Header.Get("X-Hub-Signature"), s.SecretToken) {
+		log.WithFields(log.Fields{
+			"service_id":      s.ServiceID(),
+			"X-Hub-Signature": req.Header.Get("X-Hub-Signature"),
+		}).Warn("Received Bitbucket webhook which failed the signature check")
+		w.WriteHeader(403)
+		return
+	}
+	eventKey := req.Header.Get("X-Event-Key")
+	ev, err := parseEvent(eventKey, body)
+	if err != nil {
+		log.WithError(err).WithField("event", eventKey).Error("Failed to parse Bitbucket webhook")
+		w.WriteHeader(400)
+		return
+	}
+	if ev == nil {
+		log.WithField("event", eventKey).Debug("Ignoring Bitbucket event")
+		w.WriteHeader(200)
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"event": eventKey,
+		"repo":  ev.payload.Repository.FullName,
+	})
+
+	msg := utils.StrippedHTMLMessage(mevt.MsgNotice, ev.htmlMessage())
+	msg = renderTemplate(eventKey, body, msg)
+	for roomID, roomConfig := range s.Rooms {
+		for repo, repoConfig := range roomConfig.Repos {
+			if !strings.EqualFold(repo, ev.payload.Repository.FullName) {
+				continue
+			}
+			if !repoConfig.allows(ev) {
+				logger.WithField("room_id", roomID).Debug("Notification filtered out for room")
+				continue
+			}
+			logger.WithFields(log.Fields{
+				"message": msg,
+				"room_id": roomID,
+			}).Print("Sending notification to room")
+			if _, e := notify.Send(cli, s, notify.Notification{
+				RoomID:         roomID,
+				Content:        msg,
+				CorrelationKey: ev.correlationKey(),
+			}); e != nil {
+				logger.WithError(e).WithField("room_id", roomID).Print(
+					"Failed to send notification to room.")
+			}
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// checkSignature reports whether the "sha256=<hex>" signature is the HMAC of the body with the
+// secret.
+func checkSignature(body []byte, signature, secret string) bool {
+	sigHex := strings.TrimPrefix(signature, "sha256=")
+	if sigHex == signature {
+		return false
+	}
+	sig, err := hex.DecodeString(sigHex)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// renderTemplate applies any template override for this event, named after its X-Event-Key
+// header, e.g. "bitbucket.pullrequest.fulfilled". The template is given the raw webhook payload,
+// so its fields are those documented by Bitbucket.
+func renderTemplate(eventKey string, body []byte, msg mevt.MessageEventContent) mevt.MessageEventContent {
+	var data map[string]interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return msg
+	}
+	return templates.Render("bitbucket."+strings.Replace(eventKey, ":", ".", 1), data, msg)
+}
+
+// Register makes sure the Config information supplied is valid, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	repos := 0
+	for roomID, roomConfig := range s.Rooms {
+		for repo, repoConfig := range roomConfig.Repos {
+			if !workspaceRepoRegex.MatchString(repo) {
+				return fmt.Errorf("Repository '%s' in room %s is not a workspace/repo name", repo, roomID)
+			}
+			for _, event := range repoConfig.Events {
+				switch event {
+				case eventPush, eventPullRequest, eventPipeline:
+				default:
+					return fmt.Errorf("Repository '%s' in room %s has an unknown event '%s'", repo, roomID, event)
+				}
+			}
+			for _, pattern := range repoConfig.Branches {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("Branch pattern '%s' is malformed: %s", pattern, err)
+				}
+			}
+			repos++
+		}
+	}
+	if repos == 0 {
+		return fmt.Errorf("At least one repository is required")
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,197 @@
+package bitbucket
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const (
+	pushEvent = `{
+		"actor": {"display_name": "Link"},
+		"repository": {"full_name": "hyrule/castle"},
+		"push": {"changes": [{
+			"new": {"type": "branch", "name": "%s"},
+			"old": {"type": "branch", "name": "%s"},
+			"commits": [
+				{"hash": "da156088", "message": "Light the torches\n", "author": {"raw": "Zelda <zelda@hyrule>"}},
+				{"hash": "b6568db1", "message": "Open the gate\n\nThe guards were asleep",
+					"author": {"raw": "Link <link@hyrule>", "user": {"display_name": "Link"}}}
+			],
+			"truncated": false,
+			"links": {"html": {"href": "https://bitbucket.org/hyrule/castle/branches/compare/da156088..b6568db1"}}
+		}]}
+	}`
+	pullRequestEvent = `{
+		"actor": {"display_name": "Zelda"},
+		"repository": {"full_name": "hyrule/castle"},
+		"pullrequest": {"id": 12, "title": "Repair the <bridge>",
+			"source": {"branch": {"name": "bridge"}}, "destination": {"branch": {"name": "%s"}},
+			"links": {"html": {"href": "https://bitbucket.org/hyrule/castle/pull-requests/12"}}}
+	}`
+	commitStatusEvent = `{
+		"actor": {"display_name": "Link"},
+		"repository": {"full_name": "hyrule/castle"},
+		"commit_status": {"name": "Pipeline #31 for main", "state": "%s", "type": "build", "refname": "main",
+			"url": "https://bitbucket.org/hyrule/castle/addon/pipelines/home#!/results/31"}
+	}`
+)
+
+func sign(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhook(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.String(), "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, fmt.Sprintf("%s %s", room, msg.Body))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"secret_token": "triforce",
+		"rooms": {
+			"!castle:hyrule": {
+				"repos": {"Hyrule/Castle": {}}
+			},
+			"!builds:hyrule": {
+				"repos": {"hyrule/castle": {"events": ["pull_request", "pipeline"], "branches": ["main", "release/*"]}}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create bitbucket service: ", err)
+	}
+	s := srv.(*Service)
+
+	for _, tc := range []struct {
+		eventKey  string
+		body      string
+		signature string // defaults to the body signed with the secret
+		code      int
+	}{
+		{"repo:push", fmt.Sprintf(pushEvent, "main", "main"), "", 200},
+		{"pullrequest:fulfilled", fmt.Sprintf(pullRequestEvent, "main"), "", 200},
+		{"pullrequest:created", fmt.Sprintf(pullRequestEvent, "feature"), "", 200},
+		// Edits and comments aren't announced
+		{"pullrequest:updated", fmt.Sprintf(pullRequestEvent, "main"), "", 200},
+		{"pullrequest:comment_created", fmt.Sprintf(pullRequestEvent, "main"), "", 200},
+		// Builds are only announced once they finish
+		{"repo:commit_status_created", fmt.Sprintf(commitStatusEvent, "INPROGRESS"), "", 200},
+		{"repo:commit_status_updated", fmt.Sprintf(commitStatusEvent, "FAILED"), "", 200},
+		{"repo:push", strings.Replace(fmt.Sprintf(pushEvent, "main", "main"), "hyrule/castle", "termina/clock-town", 1), "", 200},
+		{"repo:push", fmt.Sprintf(pushEvent, "main", "main"), "none", 403},
+		{"repo:push", fmt.Sprintf(pushEvent, "main", "main"), sign("{}", "triforce"), 403},
+		{"repo:push", fmt.Sprintf(pushEvent, "main", "main"), sign(fmt.Sprintf(pushEvent, "main", "main"), "ganon"), 403},
+		{"repo:push", `{"push": {}}`, "", 400},
+		{"repo:push", `not json`, "", 400},
+	} {
+		req := httptest.NewRequest("POST", "https://neb.endpoint/bitbucket", strings.NewReader(tc.body))
+		req.Header.Set("X-Event-Key", tc.eventKey)
+		switch tc.signature {
+		case "":
+			req.Header.Set("X-Hub-Signature", sign(tc.body, "triforce"))
+		case "none":
+		default:
+			req.Header.Set("X-Hub-Signature", tc.signature)
+		}
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, matrixCli)
+		if w.Code != tc.code {
+			t.Errorf("Bad response to %s %s: got %d, want %d", tc.eventKey, tc.body, w.Code, tc.code)
+		}
+	}
+
+	want := map[string]bool{
+		"!castle:hyrule [hyrule/castle] Link pushed 2 commits to main: " +
+			"https://bitbucket.org/hyrule/castle/branches/compare/da156088..b6568db1\n" +
+			"Zelda: Light the torches\nLink: Open the gate": true,
+		"!castle:hyrule [hyrule/castle] Zelda merged pull request #12: Repair the <bridge> [bridge → main] - " +
+			"https://bitbucket.org/hyrule/castle/pull-requests/12": true,
+		"!builds:hyrule [hyrule/castle] Zelda merged pull request #12: Repair the <bridge> [bridge → main] - " +
+			"https://bitbucket.org/hyrule/castle/pull-requests/12": true,
+		"!castle:hyrule [hyrule/castle] Zelda opened pull request #12: Repair the <bridge> [bridge → feature] - " +
+			"https://bitbucket.org/hyrule/castle/pull-requests/12": true,
+		"!castle:hyrule [hyrule/castle] Pipeline #31 for main on main failed - " +
+			"https://bitbucket.org/hyrule/castle/addon/pipelines/home#!/results/31": true,
+		"!builds:hyrule [hyrule/castle] Pipeline #31 for main on main failed - " +
+			"https://bitbucket.org/hyrule/castle/addon/pipelines/home#!/results/31": true,
+	}
+	if len(sent) != len(want) {
+		t.Errorf("Bad number of notices: got %d, want %d: %q", len(sent), len(want), sent)
+	}
+	for _, msg := range sent {
+		if !want[msg] {
+			t.Errorf("Unexpected notice: %q", msg)
+		}
+	}
+}
+
+func TestPushHTMLMessage(t *testing.T) {
+	ev, err := parseEvent("repo:push", []byte(`{
+		"actor": {"display_name": "Link"},
+		"repository": {"full_name": "hyrule/castle"},
+		"push": {"changes": [{"new": null, "old": {"type": "branch", "name": "old-map"}}]}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to parse event: ", err)
+	}
+	want := `[<u>hyrule/castle</u>] Link <b><font color="red">deleted</font> old-map</b>`
+	if got := ev.htmlMessage(); got != want {
+		t.Errorf("Bad deleted branch message: got %q, want %q", got, want)
+	}
+	if got := ev.branches(); len(got) != 1 || got[0] != "old-map" {
+		t.Errorf("Bad deleted branch branches: %v", got)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"rooms": {"!castle:hyrule": {"repos": {}}}}`,
+		`{"rooms": {"!castle:hyrule": {"repos": {"castle": {}}}}}`,
+		`{"rooms": {"!castle:hyrule": {"repos": {"hyrule/castle/gate": {}}}}}`,
+		`{"rooms": {"!castle:hyrule": {"repos": {"hyrule/castle": {"events": ["issue"]}}}}}`,
+		`{"rooms": {"!castle:hyrule": {"repos": {"hyrule/castle": {"branches": ["release/["]}}}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create bitbucket service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package bitbucket
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// The kinds of event which are announced
+const (
+	eventPush        = "push"
+	eventPullRequest = "pull_request"
+	eventPipeline    = "pipeline"
+)
+
+// How many commits of a push are listed
+const maxCommits = 3
+
+// What the pull request events which are announced say was done to the pull request, keyed by the
+// X-Event-Key header. Updates and comments aren't announced.
+var pullRequestActions = map[string]string{
+	"pullrequest:created":                 "opened",
+	"pullrequest:fulfilled":               "merged",
+	"pullrequest:rejected":                "declined",
+	"pullrequest:approved":                "approved",
+	"pullrequest:changes_request_created": "requested changes on",
+}
+
+type link struct {
+	Href string `json:"href"`
+}
+
+type ref struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Target struct {
+		Hash string `json:"hash"`
+	} `json:"target"`
+}
+
+// payload is the parts of a webhook payload which the notices are made from. Each kind of event
+// only fills in some of it.
+type payload struct {
+	Actor struct {
+		DisplayName string `json:"display_name"`
+	} `json:"actor"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Push struct {
+		Changes []struct {
+			New     *ref `json:"new"`
+			Old     *ref `json:"old"`
+			Commits []struct {
+				Hash    string `json:"hash"`
+				Message string `json:"message"`
+				Author  struct {
+					Raw  string `json:"raw"`
+					User *struct {
+						DisplayName string `json:"display_name"`
+					} `json:"user"`
+				} `json:"author"`
+				Links struct {
+					HTML link `json:"html"`
+				} `json:"links"`
+			} `json:"commits"`
+			Truncated bool `json:"truncated"`
+			Links     struct {
+				HTML link `json:"html"`
+			} `json:"links"`
+		} `json:"changes"`
+	} `json:"push"`
+	PullRequest struct {
+		ID     int    `json:"id"`
+		Title  string `json:"title"`
+		Source struct {
+			Branch struct {
+				Name string `json:"name"`
+			} `json:"branch"`
+		} `json:"source"`
+		Destination struct {
+			Branch struct {
+				Name string `json:"name"`
+			} `json:"branch"`
+		} `json:"destination"`
+		Links struct {
+			HTML link `json:"html"`
+		} `json:"links"`
+	} `json:"pullrequest"`
+	CommitStatus struct {
+		Name    string `json:"name"`
+		State   string `json:"state"`
+		Type    string `json:"type"`
+		RefName string `json:"refname"`
+		URL     string `json:"url"`
+	} `json:"commit_status"`
+}
+
+// event is a webhook request which is announced.
+type event struct {
+	// The X-Event-Key header, e.g. "pullrequest:fulfilled"
+	Key string
+	// eventPush, eventPullRequest or eventPipeline
+	Kind    string
+	payload payload
+}
+
+// parseEvent returns the event of a webhook request, or nil if it isn't announced.
+func parseEvent(eventKey string, body []byte) (*event, error) {
+	ev := &event{Key: eventKey}
+	switch {
+	case eventKey == "repo:push":
+		ev.Kind = eventPush
+	case pullRequestActions[eventKey] != "":
+		ev.Kind = eventPullRequest
+	case eventKey == "repo:commit_status_created" || eventKey == "repo:commit_status_updated":
+		ev.Kind = eventPipeline
+	default:
+		return nil, nil
+	}
+	if err := json.Unmarshal(body, &ev.payload); err != nil {
+		return nil, err
+	}
+	if ev.payload.Repository.FullName == "" {
+		return nil, fmt.Errorf("Payload is missing its repository")
+	}
+	// Builds are only announced once they have finished
+	if ev.Kind == eventPipeline {
+		switch ev.payload.CommitStatus.State {
+		case "SUCCESSFUL", "FAILED", "STOPPED":
+		default:
+			return nil, nil
+		}
+	}
+	return ev, nil
+}
+
+// branches returns the branches the event is about: the branches pushed to, the destination
+// branch of a pull request or the branch built.
+func (ev *event) branches() []string {
+	p := &ev.payload
+	switch ev.Kind {
+	case eventPush:
+		var branches []string
+		for _, c := range p.Push.Changes {
+			for _, r := range []*ref{c.New, c.Old} {
+				if r != nil && r.Type == "branch" {
+					branches = append(branches, r.Name)
+					break
+				}
+			}
+		}
+		return branches
+	case eventPullRequest:
+		return []string{p.PullRequest.Destination.Branch.Name}
+	case eventPipeline:
+		if p.CommitStatus.RefName != "" {
+			return []string{p.CommitStatus.RefName}
+		}
+	}
+	return nil
+}
+
+// correlationKey identifies the pull request the event is about, e.g.
+// "bitbucket workspace/repo#12", or "" if it isn't about one.
+func (ev *event) correlationKey() string {
+	if ev.Kind != eventPullRequest {
+		return ""
+	}
+	return fmt.Sprintf("bitbucket %s#%d", strings.ToLower(ev.payload.Repository.FullName), ev.payload.PullRequest.ID)
+}
+
+// htmlMessage returns the notice for the event, in the same form as the Github webhook service's.
+func (ev *event) htmlMessage() string {
+	p := &ev.payload
+	repo := fmt.Sprintf("[<u>%s</u>]", html.EscapeString(p.Repository.FullName))
+	actor := html.EscapeString(p.Actor.DisplayName)
+	switch ev.Kind {
+	case eventPush:
+		var lines []string
+		for _, c := range p.Push.Changes {
+			lines = append(lines, pushChangeHTML(repo, actor, c.New, c.Old, len(c.Commits), c.Truncated, c.Links.HTML.Href))
+			// The commits are newest first
+			for i, commit := range c.Commits {
+				if i == maxCommits {
+					break
+				}
+				author := commit.Author.Raw
+				if j := strings.Index(author, " <"); j > 0 {
+					author = author[:j]
+				}
+				if commit.Author.User != nil {
+					author = commit.Author.User.DisplayName
+				}
+				lines = append(lines, fmt.Sprintf("%s: %s", html.EscapeString(author), html.EscapeString(firstLine(commit.Message))))
+			}
+		}
+		return strings.Join(lines, "<br>\n")
+	case eventPullRequest:
+		pr := &p.PullRequest
+		return fmt.Sprintf("%s %s %s <b>pull request #%d</b>: %s [%s → %s] - %s",
+			repo,
+			actor,
+			pullRequestActions[ev.Key],
+			pr.ID,
+			html.EscapeString(pr.Title),
+			html.EscapeString(pr.Source.Branch.Name),
+			html.EscapeString(pr.Destination.Branch.Name),
+			html.EscapeString(pr.Links.HTML.Href),
+		)
+	case eventPipeline:
+		status := map[string]string{
+			"SUCCESSFUL": `<font color="green">passed</font>`,
+			"FAILED":     `<font color="red">failed</font>`,
+			"STOPPED":    "was stopped",
+		}[p.CommitStatus.State]
+		on := ""
+		if p.CommitStatus.RefName != "" {
+			on = " on " + html.EscapeString(p.CommitStatus.RefName)
+		}
+		return fmt.Sprintf("%s <b>%s</b>%s %s - %s",
+			repo,
+			html.EscapeString(p.CommitStatus.Name),
+			on,
+			status,
+			html.EscapeString(p.CommitStatus.URL),
+		)
+	}
+	return ""
+}
+
+// pushChangeHTML describes a change to a branch or tag made by a push.
+func pushChangeHTML(repo, actor string, newRef, oldRef *ref, commits int, truncated bool, compareURL string) string {
+	if newRef == nil && oldRef != nil {
+		return fmt.Sprintf(`%s %s <b><font color="red">deleted</font> %s</b>`, repo, actor, html.EscapeString(oldRef.Name))
+	}
+	if newRef == nil {
+		return fmt.Sprintf("%s %s pushed", repo, actor)
+	}
+	if newRef.Type == "tag" {
+		return fmt.Sprintf("%s %s tagged <b>%s</b>", repo, actor, html.EscapeString(newRef.Name))
+	}
+	count := fmt.Sprint(commits)
+	if truncated {
+		count = "more than " + count
+	}
+	noun := "commits"
+	if commits == 1 && !truncated {
+		noun = "commit"
+	}
+	msg := fmt.Sprintf("%s %s pushed %s %s to <b>%s</b>", repo, actor, count, noun, html.EscapeString(newRef.Name))
+	if compareURL != "" {
+		msg += ": " + html.EscapeString(compareURL)
+	}
+	return msg
+}
+
+func firstLine(s string) string {
+	return strings.TrimSpace(strings.SplitN(s, "\n", 2)[0])
+}
@@ -0,0 +1,492 @@
+// Package bookmarks implements a Service which saves links and messages for people to read later.
+package bookmarks
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/realms/raindrop"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Bookmarks service
+const ServiceType = "bookmarks"
+
+const (
+	// How many bookmarks each user can have
+	maxBookmarks = 500
+	// How many bookmarks are shown by "!bookmarks list" and "!bookmarks search"
+	listCount = 10
+	// How much of a bookmark's text is shown when listing it
+	maxSummaryLength = 80
+	defaultReaction  = "🔖"
+)
+
+var urlRegex = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// The Raindrop.io API. Overridden by tests.
+var raindropURL = "https://api.raindrop.io/rest/v1/raindrop"
+
+var httpClient = &http.Client{}
+
+// Service contains the Config fields for the Bookmarks service.
+//
+// People save links with "!save https://example.com", or save any message by reacting to it with
+// 🔖. Each person has their own bookmarks, which they find again with "!bookmarks list" and
+// "!bookmarks search".
+//
+// Bookmarks can also be saved to Raindrop.io. People log in through a "raindrop" realm, after
+// which everything they save is saved to their Raindrop account too, and "!bookmarks export"
+// saves their older bookmarks there.
+//
+// Example JSON request:
+//   {
+//       "reaction": "🔖",
+//       "realm_id": "raindrop-realm-id"
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The emoji which saves a message when people react to it with it. Defaults to 🔖.
+	Reaction string `json:"reaction"`
+	// Optional. The ID of an existing "raindrop" realm, used to save bookmarks to the Raindrop.io
+	// accounts of people who have logged in.
+	RealmID string `json:"realm_id"`
+}
+
+// bookmark is something which someone saved. Each user's bookmarks are stored in the service state
+// under "bookmarks <user ID>", oldest first.
+type bookmark struct {
+	URL string `json:"url"`
+	// The message which was saved, or the note given with "!save"
+	Text               string    `json:"text"`
+	RoomID             id.RoomID `json:"room_id"`
+	SavedTimestampSecs int64     `json:"saved_timestamp_secs"`
+	// Whether the bookmark has been saved to Raindrop
+	Exported bool `json:"exported"`
+}
+
+// summary returns the bookmark on one line, e.g. "https://example.com – A good read".
+func (b *bookmark) summary() string {
+	text := strings.Join(strings.Fields(b.Text), " ")
+	if text == "" || text == b.URL {
+		return b.URL
+	}
+	if runes := []rune(text); len(runes) > maxSummaryLength {
+		text = string(runes[:maxSummaryLength]) + "…"
+	}
+	return b.URL + " – " + text
+}
+
+// Commands supported:
+//    !save url [note]
+// Saves the link for the sender.
+//    !bookmarks list
+// Responds with the sender's 10 most recent bookmarks.
+//    !bookmarks search words
+// Responds with the sender's bookmarks which contain all the words.
+//    !bookmarks remove N
+// Removes the sender's bookmark numbered N.
+//    !bookmarks export
+// Saves the sender's bookmarks to their Raindrop.io account.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"save"},
+			Arguments: []string{"url", "[note]"},
+			Help:      "Bookmark a link",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSave(roomID, userID, args, time.Now())
+			},
+		},
+		{
+			Path: []string{"bookmarks", "list"},
+			Help: "Show your most recent bookmarks",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdList(userID)
+			},
+		},
+		{
+			Path:      []string{"bookmarks", "search"},
+			Arguments: []string{"words"},
+			Help:      "Search your bookmarks",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSearch(userID, args)
+			},
+		},
+		{
+			Path:      []string{"bookmarks", "remove"},
+			Arguments: []string{"N"},
+			Help:      "Remove one of your bookmarks",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdRemove(userID, args)
+			},
+		},
+		{
+			Path: []string{"bookmarks", "export"},
+			Help: "Save your bookmarks to Raindrop.io",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdExport(userID)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdSave(roomID id.RoomID, userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Usage: !save url [note]")
+	}
+	if u, err := url.Parse(args[0]); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("'%s' isn't a link. Usage: !save url [note]", args[0])
+	}
+	return s.save(userID, bookmark{
+		URL:                args[0],
+		Text:               strings.Join(args[1:], " "),
+		RoomID:             roomID,
+		SavedTimestampSecs: now.Unix(),
+	})
+}
+
+// OnMessage saves the messages which people react to with the bookmark emoji.
+func (s *Service) OnMessage(cli types.MatrixClient, evt *mevt.Event) {
+	if evt.Type != mevt.EventReaction {
+		return
+	}
+	rel, _ := evt.Content.Raw["m.relates_to"].(map[string]interface{})
+	if rel == nil || rel["rel_type"] != "m.annotation" {
+		return
+	}
+	key, _ := rel["key"].(string)
+	eventID, _ := rel["event_id"].(string)
+	// Some clients add a variation selector to emoji
+	if strings.TrimSuffix(key, "\ufe0f") != strings.TrimSuffix(s.reaction(), "\ufe0f") || eventID == "" {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    evt.RoomID,
+		"event_id":   eventID,
+	})
+
+	var res interface{}
+	b, err := fetchBookmark(cli, evt.RoomID, id.EventID(eventID))
+	if err == nil {
+		b.SavedTimestampSecs = time.Now().Unix()
+		res, err = s.save(evt.Sender, *b)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to bookmark message")
+		res = &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("Failed to bookmark that message for %s: %s", evt.Sender, err),
+		}
+	}
+	if _, err = cli.SendMessageEvent(evt.RoomID, mevt.EventMessage, res); err != nil {
+		logger.WithError(err).Error("Failed to send bookmark response")
+	}
+}
+
+// fetchBookmark returns a bookmark of the message. Its URL is the first link in the message, or a
+// link to the message itself if there isn't one.
+func fetchBookmark(cli types.MatrixClient, roomID id.RoomID, eventID id.EventID) (*bookmark, error) {
+	evCli, ok := cli.(types.EventGetter)
+	if !ok {
+		return nil, fmt.Errorf("Unable to fetch messages with this client")
+	}
+	original, err := evCli.GetEvent(roomID, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch the message: %s", err)
+	}
+	if original.Type.Type == mevt.EventEncrypted.Type {
+		return nil, fmt.Errorf("Encrypted messages can't be bookmarked by reacting to them")
+	} else if original.Type.Type != mevt.EventMessage.Type {
+		return nil, fmt.Errorf("Only messages can be bookmarked")
+	}
+	original.Content.ParseRaw(mevt.EventMessage)
+	text := original.Content.AsMessage().Body
+	link := urlRegex.FindString(text)
+	if link == "" {
+		link = fmt.Sprintf("https://matrix.to/#/%s/%s", roomID, eventID)
+	} else {
+		link = strings.TrimRight(link, ".,;:!?)")
+	}
+	return &bookmark{
+		URL:    link,
+		Text:   text,
+		RoomID: roomID,
+	}, nil
+}
+
+// save adds the bookmark to the user's bookmarks, and to their Raindrop account if they have
+// logged into it.
+func (s *Service) save(userID id.UserID, b bookmark) (interface{}, error) {
+	bookmarks, err := s.loadBookmarks(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, existing := range bookmarks {
+		if existing.URL == b.URL {
+			return notice(fmt.Sprintf("%s has already bookmarked %s", userID, b.URL)), nil
+		}
+	}
+	if len(bookmarks) >= maxBookmarks {
+		return nil, fmt.Errorf("You have %d bookmarks, which is the most you can have. Remove some with !bookmarks remove N", len(bookmarks))
+	}
+
+	body := fmt.Sprintf("🔖 Saved %s for %s", b.URL, userID)
+	if token, _, err := s.raindropToken(userID); err != nil {
+		log.WithError(err).WithField("user_id", userID).Error("Failed to get Raindrop access token")
+	} else if token != "" {
+		if err = exportBookmark(token, b); err != nil {
+			log.WithError(err).WithField("user_id", userID).Error("Failed to save bookmark to Raindrop")
+			body += ", but failed to save it to Raindrop"
+		} else {
+			b.Exported = true
+			body += " and to Raindrop"
+		}
+	}
+	if err = s.storeBookmarks(userID, append(bookmarks, b)); err != nil {
+		return nil, err
+	}
+	return notice(body), nil
+}
+
+func (s *Service) cmdList(userID id.UserID) (interface{}, error) {
+	bookmarks, err := s.loadBookmarks(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(bookmarks) == 0 {
+		return notice("You have no bookmarks. Save links with !save url, or by reacting to messages with " + s.reaction()), nil
+	}
+	var numbers []int
+	for i := len(bookmarks) - 1; i >= 0 && len(numbers) < listCount; i-- {
+		numbers = append(numbers, i+1)
+	}
+	return notice(fmt.Sprintf("Your bookmarks (%d):\n%s", len(bookmarks), listBookmarks(bookmarks, numbers))), nil
+}
+
+func (s *Service) cmdSearch(userID id.UserID, args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Usage: !bookmarks search words")
+	}
+	bookmarks, err := s.loadBookmarks(userID)
+	if err != nil {
+		return nil, err
+	}
+	var numbers []int
+	for i := len(bookmarks) - 1; i >= 0 && len(numbers) < listCount; i-- {
+		text := strings.ToLower(bookmarks[i].URL + " " + bookmarks[i].Text)
+		matches := true
+		for _, word := range args {
+			if !strings.Contains(text, strings.ToLower(word)) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			numbers = append(numbers, i+1)
+		}
+	}
+	if len(numbers) == 0 {
+		return notice(fmt.Sprintf("None of your bookmarks match '%s'", strings.Join(args, " "))), nil
+	}
+	return notice(fmt.Sprintf("Your bookmarks matching '%s':\n%s", strings.Join(args, " "), listBookmarks(bookmarks, numbers))), nil
+}
+
+func (s *Service) cmdRemove(userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !bookmarks remove N")
+	}
+	bookmarks, err := s.loadBookmarks(userID)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 || n > len(bookmarks) {
+		return nil, fmt.Errorf("You don't have a bookmark %s. See the numbers with !bookmarks list", args[0])
+	}
+	removed := bookmarks[n-1]
+	if err = s.storeBookmarks(userID, append(bookmarks[:n-1], bookmarks[n:]...)); err != nil {
+		return nil, err
+	}
+	return notice("Removed " + removed.URL), nil
+}
+
+func (s *Service) cmdExport(userID id.UserID) (interface{}, error) {
+	if s.RealmID == "" {
+		return nil, fmt.Errorf("Saving bookmarks to Raindrop has not been set up")
+	}
+	token, realm, err := s.raindropToken(userID)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return matrix.StarterLinkMessage{
+			Body: "You need to log into Raindrop before you can save bookmarks to it.",
+			Link: realm.StarterLink,
+		}, nil
+	}
+	bookmarks, err := s.loadBookmarks(userID)
+	if err != nil {
+		return nil, err
+	}
+	exported := 0
+	for i := range bookmarks {
+		if bookmarks[i].Exported {
+			continue
+		}
+		if err = exportBookmark(token, bookmarks[i]); err != nil {
+			break
+		}
+		bookmarks[i].Exported = true
+		exported++
+	}
+	// Remember what was exported, even if something failed
+	if storeErr := s.storeBookmarks(userID, bookmarks); storeErr != nil {
+		return nil, storeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Saved %d bookmarks to Raindrop, then failed: %s", exported, err)
+	}
+	if exported == 1 {
+		return notice("Saved 1 bookmark to Raindrop"), nil
+	}
+	return notice(fmt.Sprintf("Saved %d bookmarks to Raindrop", exported)), nil
+}
+
+// raindropToken returns the user's Raindrop access token and the realm, or an empty token if
+// Raindrop isn't set up or the user hasn't logged into it.
+func (s *Service) raindropToken(userID id.UserID) (string, *raindrop.Realm, error) {
+	if s.RealmID == "" {
+		return "", nil, nil
+	}
+	realm, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return "", nil, err
+	}
+	raindropRealm, ok := realm.(*raindrop.Realm)
+	if !ok {
+		return "", nil, fmt.Errorf("Failed to cast realm %s into a RaindropRealm", s.RealmID)
+	}
+	session, err := database.GetServiceDB().LoadAuthSessionByUser(s.RealmID, userID)
+	if err != nil {
+		return "", raindropRealm, nil
+	}
+	raindropSession, ok := session.(*raindrop.Session)
+	if !ok || !raindropSession.Authenticated() {
+		return "", raindropRealm, nil
+	}
+	token, err := raindropRealm.AccessToken(raindropSession)
+	return token, raindropRealm, err
+}
+
+// exportBookmark saves the bookmark to the Raindrop account with the access token.
+func exportBookmark(token string, b bookmark) error {
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"link": b.URL,
+		"note": b.Text,
+		// Raindrop fills in the title and excerpt from the page
+		"pleaseParse": map[string]interface{}{},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", raindropURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Raindrop responded with HTTP %d", res.StatusCode)
+	}
+	return nil
+}
+
+// listBookmarks returns the bookmarks with the numbers, one per line.
+func listBookmarks(bookmarks []bookmark, numbers []int) string {
+	lines := make([]string, len(numbers))
+	for i, n := range numbers {
+		lines[i] = fmt.Sprintf("%d. %s", n, bookmarks[n-1].summary())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s *Service) reaction() string {
+	if s.Reaction == "" {
+		return defaultReaction
+	}
+	return s.Reaction
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func (s *Service) loadBookmarks(userID id.UserID) ([]bookmark, error) {
+	var bookmarks []bookmark
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "bookmarks "+userID.String())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, &bookmarks); err != nil {
+		return nil, err
+	}
+	return bookmarks, nil
+}
+
+func (s *Service) storeBookmarks(userID id.UserID, bookmarks []bookmark) error {
+	stateJSON, err := json.Marshal(bookmarks)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "bookmarks "+userID.String(), stateJSON)
+}
+
+// Register makes sure that the given realm ID, if any, maps to a raindrop realm.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.RealmID == "" {
+		return nil
+	}
+	realm, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return err
+	}
+	if realm.Type() != raindrop.RealmType {
+		return fmt.Errorf("Realm is of type '%s', not '%s'", realm.Type(), raindrop.RealmType)
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
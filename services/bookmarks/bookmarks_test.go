@@ -0,0 +1,238 @@
+package bookmarks
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/realms/raindrop"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// storage keeps service state, and returns the realm and session which it was created with
+type storage struct {
+	*testutils.StateStorage
+	realm   types.AuthRealm
+	session types.AuthSession
+}
+
+func (s *storage) LoadAuthRealm(realmID string) (types.AuthRealm, error) {
+	if s.realm == nil {
+		return nil, sql.ErrNoRows
+	}
+	return s.realm, nil
+}
+
+func (s *storage) LoadAuthSessionByUser(realmID string, userID id.UserID) (types.AuthSession, error) {
+	if s.session == nil || s.session.UserID() != userID {
+		return nil, sql.ErrNoRows
+	}
+	return s.session, nil
+}
+
+func TestCommands(t *testing.T) {
+	database.SetServiceDB(&storage{StateStorage: testutils.NewStateStorage()})
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create bookmarks service: ", err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register bookmarks service: ", err)
+	}
+	s := srv.(*Service)
+
+	body := func(res interface{}, err error) string {
+		if err != nil {
+			t.Fatalf("Command failed: %s", err)
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+	save := func(args string) (interface{}, error) {
+		return s.cmdSave("!someroom:hyrule", "@link:hyrule", strings.Fields(args), time.Now())
+	}
+
+	if got := body(save("https://example.com/sword Where to find the Master Sword")); got != "🔖 Saved https://example.com/sword for @link:hyrule" {
+		t.Errorf("Bad save: %s", got)
+	}
+	body(save("https://example.com/shield"))
+	body(save("https://example.com/bow Bows and arrows"))
+	if got := body(save("https://example.com/shield")); got != "@link:hyrule has already bookmarked https://example.com/shield" {
+		t.Errorf("Bad duplicate save: %s", got)
+	}
+	if _, err = save("not-a-link"); err == nil {
+		t.Errorf("Expected saving something which isn't a link to fail")
+	}
+
+	if got := body(s.cmdList("@link:hyrule")); got != "Your bookmarks (3):\n"+
+		"3. https://example.com/bow – Bows and arrows\n"+
+		"2. https://example.com/shield\n"+
+		"1. https://example.com/sword – Where to find the Master Sword" {
+		t.Errorf("Bad list: %s", got)
+	}
+	if got := body(s.cmdSearch("@link:hyrule", []string{"MASTER", "sword"})); got != "Your bookmarks matching 'MASTER sword':\n"+
+		"1. https://example.com/sword – Where to find the Master Sword" {
+		t.Errorf("Bad search: %s", got)
+	}
+	if got := body(s.cmdRemove("@link:hyrule", []string{"2"})); got != "Removed https://example.com/shield" {
+		t.Errorf("Bad remove: %s", got)
+	}
+	if _, err = s.cmdRemove("@link:hyrule", []string{"3"}); err == nil {
+		t.Errorf("Expected removing a bookmark which doesn't exist to fail")
+	}
+	// Bookmarks are per user
+	if got := body(s.cmdList("@zelda:hyrule")); got != "You have no bookmarks. Save links with !save url, or by reacting to messages with 🔖" {
+		t.Errorf("Bad list for another user: %s", got)
+	}
+}
+
+func TestReaction(t *testing.T) {
+	database.SetServiceDB(&storage{StateStorage: testutils.NewStateStorage()})
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var body string
+		if strings.Contains(req.URL.Path, "/event/$link") {
+			body = `{"type":"m.room.message","event_id":"$link","room_id":"!someroom:hyrule","sender":"@zelda:hyrule",
+				"content":{"msgtype":"m.text","body":"Have you read https://example.com/hyrule-history? It's great."}}`
+		} else if strings.Contains(req.URL.Path, "/event/$plain") {
+			body = `{"type":"m.room.message","event_id":"$plain","room_id":"!someroom:hyrule","sender":"@zelda:hyrule",
+				"content":{"msgtype":"m.text","body":"Meet at the castle at noon"}}`
+		} else if strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			var msg mevt.MessageEventContent
+			if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+				t.Fatalf("Failed to decode message: %s", err)
+			}
+			sent = append(sent, msg.Body)
+			body = `{"event_id":"$response"}`
+		} else {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create bookmarks service: ", err)
+	}
+	s := srv.(*Service)
+	react := func(key, eventID string) {
+		s.OnMessage(matrixCli, &mevt.Event{
+			Type:   mevt.EventReaction,
+			Sender: "@link:hyrule",
+			RoomID: "!someroom:hyrule",
+			Content: mevt.Content{Raw: map[string]interface{}{
+				"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": eventID, "key": key},
+			}},
+		})
+	}
+	react("👍", "$link")
+	react("🔖", "$link")
+	react("🔖\ufe0f", "$plain")
+
+	want := []string{
+		"🔖 Saved https://example.com/hyrule-history for @link:hyrule",
+		"🔖 Saved https://matrix.to/#/!someroom:hyrule/$plain for @link:hyrule",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad responses: got %q, want %q", sent, want)
+	}
+	res, err := s.cmdList("@link:hyrule")
+	if err != nil {
+		t.Fatalf("Failed to list bookmarks: %s", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "Your bookmarks (2):\n"+
+		"2. https://matrix.to/#/!someroom:hyrule/$plain – Meet at the castle at noon\n"+
+		"1. https://example.com/hyrule-history – Have you read https://example.com/hyrule-history? It's great." {
+		t.Errorf("Bad list: %s", got)
+	}
+}
+
+func TestExport(t *testing.T) {
+	realm, err := types.CreateAuthRealm("raindrop-realm", raindrop.RealmType, []byte(
+		`{"ClientID":"My ID","ClientSecret":"shh","StarterLink":"https://example.com/login"}`,
+	))
+	if err != nil {
+		t.Fatal("Failed to create raindrop realm: ", err)
+	}
+	session := realm.AuthSession("session", "@navi:hyrule", "raindrop-realm").(*raindrop.Session)
+	session.AccessToken = "navis_token"
+	database.SetServiceDB(&storage{StateStorage: testutils.NewStateStorage(), realm: realm, session: session})
+
+	var exported []string
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "POST" || req.URL.String() != "https://api.raindrop.io/rest/v1/raindrop" {
+			t.Fatalf("Bad request: %s %s", req.Method, req.URL.String())
+		}
+		if auth := req.Header.Get("Authorization"); auth != "Bearer navis_token" {
+			t.Fatalf("Bad Authorization header: %s", auth)
+		}
+		var raindrop struct {
+			Link string `json:"link"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&raindrop); err != nil {
+			t.Fatalf("Failed to decode raindrop: %s", err)
+		}
+		exported = append(exported, raindrop.Link)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"result":true}`)),
+		}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"realm_id":"raindrop-realm"}`))
+	if err != nil {
+		t.Fatal("Failed to create bookmarks service: ", err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register bookmarks service: ", err)
+	}
+	s := srv.(*Service)
+
+	// Bookmarks saved before logging in are exported by !bookmarks export
+	if err = s.storeBookmarks("@navi:hyrule", []bookmark{{URL: "https://example.com/old"}}); err != nil {
+		t.Fatalf("Failed to store bookmarks: %s", err)
+	}
+	res, err := s.cmdSave("!someroom:hyrule", "@navi:hyrule", []string{"https://example.com/new"}, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to save bookmark: %s", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "🔖 Saved https://example.com/new for @navi:hyrule and to Raindrop" {
+		t.Errorf("Bad save: %s", got)
+	}
+	res, err = s.cmdExport("@navi:hyrule")
+	if err != nil {
+		t.Fatalf("Failed to export bookmarks: %s", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "Saved 1 bookmark to Raindrop" {
+		t.Errorf("Bad export: %s", got)
+	}
+	if strings.Join(exported, " ") != "https://example.com/new https://example.com/old" {
+		t.Errorf("Bad exported links: %q", exported)
+	}
+
+	// Users who haven't logged into Raindrop are asked to
+	res, err = s.cmdExport("@link:hyrule")
+	if err != nil {
+		t.Fatalf("Failed to respond to logged out user: %s", err)
+	}
+	if msg, ok := res.(matrix.StarterLinkMessage); !ok || msg.Link != "https://example.com/login" {
+		t.Errorf("Expected a starter link, got %+v", res)
+	}
+}
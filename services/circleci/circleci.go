@@ -0,0 +1,341 @@
+// Package circleci implements a Service which sends notices into rooms when CircleCI workflows and
+// jobs finish.
+package circleci
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/templates"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the CircleCI service.
+const ServiceType = "circleci"
+
+// The biggest webhook payload which is read
+const maxPayloadSize = 1024 * 1024
+
+// The events which can be announced
+const (
+	eventWorkflow = "workflow"
+	eventJob      = "job"
+)
+
+// The webhook event types of each event
+var eventTypes = map[string]string{
+	"workflow-completed": eventWorkflow,
+	"job-completed":      eventJob,
+}
+
+// What each status is announced as, and its colour.
+var statuses = map[string]struct {
+	Text  string
+	Color string
+}{
+	"success":      {"succeeded", "green"},
+	"failed":       {"failed", "red"},
+	"error":        {"errored", "red"},
+	"canceled":     {"was canceled", "gray"},
+	"unauthorized": {"was unauthorized", "gray"},
+}
+
+// Service contains the Config fields for the CircleCI service.
+//
+// This service will send notices into a Matrix room when CircleCI workflows, and optionally jobs,
+// finish. It requires a public domain which CircleCI can reach. Notices will be sent as the service
+// user ID.
+//
+// Go-NEB can't set up the webhooks itself. Add a webhook to each project under Project Settings >
+// Webhooks, with the URL in webhook_url and the secret from this config, and choose the "Workflow
+// completed" and "Job completed" events.
+//
+// Projects are named by their CircleCI project slug, e.g. "gh/matrix-org/go-neb".
+//
+// Operators can change the notices with template overrides named "circleci.workflow" and
+// "circleci.job" (see package "templates"), which are given the webhook payload, e.g.
+// {{.workflow.url}}.
+//
+// Example JSON request:
+//   {
+//       "secret": "a long random string",
+//       "rooms": {
+//           "!ewfug483gsfe:localhost": {
+//               "projects": {
+//                   "gh/matrix-org/go-neb": {
+//                       "events": ["workflow", "job"],
+//                       "branches": ["main", "release/*"]
+//                   }
+//               }
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL to add as the projects' webhook. Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The secret the webhooks are set up with, which CircleCI signs its requests with.
+	Secret string `json:"secret"`
+	// A map from Matrix room ID to the CircleCI projects to announce.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is which projects are announced in a room.
+type RoomConfig struct {
+	// A map of CircleCI project slugs to what is announced about them.
+	Projects map[string]ProjectConfig `json:"projects"`
+}
+
+// ProjectConfig is what is announced about a project.
+type ProjectConfig struct {
+	// Optional. What to announce: "workflow" and "job". Defaults to workflows.
+	Events []string `json:"events"`
+	// Optional. Only announce builds of branches matching these patterns, e.g. "release/*".
+	Branches []string `json:"branches"`
+}
+
+// allows returns whether the event is announced.
+func (c *ProjectConfig) allows(event, branch string) bool {
+	events := c.Events
+	if len(events) == 0 {
+		events = []string{eventWorkflow}
+	}
+	if !contains(events, event) {
+		return false
+	}
+	if len(c.Branches) == 0 {
+		return true
+	}
+	for _, pattern := range c.Branches {
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// payload is the parts of a webhook payload which the notices are made from.
+type payload struct {
+	Type    string `json:"type"`
+	Project struct {
+		Slug string `json:"slug"`
+	} `json:"project"`
+	Workflow struct {
+		ID        string     `json:"id"`
+		Name      string     `json:"name"`
+		Status    string     `json:"status"`
+		URL       string     `json:"url"`
+		CreatedAt *time.Time `json:"created_at"`
+		StoppedAt *time.Time `json:"stopped_at"`
+	} `json:"workflow"`
+	Job struct {
+		Name      string     `json:"name"`
+		Number    int        `json:"number"`
+		Status    string     `json:"status"`
+		StartedAt *time.Time `json:"started_at"`
+		StoppedAt *time.Time `json:"stopped_at"`
+	} `json:"job"`
+	Pipeline struct {
+		Number int `json:"number"`
+		VCS    struct {
+			Branch string `json:"branch"`
+			Tag    string `json:"tag"`
+			Commit struct {
+				Subject string `json:"subject"`
+				Author  struct {
+					Name string `json:"name"`
+				} `json:"author"`
+			} `json:"commit"`
+		} `json:"vcs"`
+	} `json:"pipeline"`
+}
+
+// htmlMessage returns the notice for the event, coloured by how it went.
+func (p *payload) htmlMessage(event string) string {
+	name, status, started, stopped := p.Workflow.Name, p.Workflow.Status, p.Workflow.CreatedAt, p.Workflow.StoppedAt
+	if event == eventJob {
+		name, status, started, stopped = p.Job.Name, p.Job.Status, p.Job.StartedAt, p.Job.StoppedAt
+	}
+	msg := fmt.Sprintf("[<u>%s</u>] %s <b>%s</b>", html.EscapeString(p.Project.Slug), event, html.EscapeString(name))
+	if p.Pipeline.VCS.Tag != "" {
+		msg += " of tag " + html.EscapeString(p.Pipeline.VCS.Tag)
+	} else if p.Pipeline.VCS.Branch != "" {
+		msg += " of " + html.EscapeString(p.Pipeline.VCS.Branch)
+	}
+	if s, ok := statuses[status]; ok {
+		msg += fmt.Sprintf(` <font color="%s">%s</font>`, s.Color, s.Text)
+	} else {
+		msg += " " + html.EscapeString(status)
+	}
+	if started != nil && stopped != nil && stopped.After(*started) {
+		msg += " in " + stopped.Sub(*started).Round(time.Second).String()
+	}
+	if commit := p.Pipeline.VCS.Commit; commit.Subject != "" {
+		msg += fmt.Sprintf(" (#%d: %s", p.Pipeline.Number, html.EscapeString(commit.Subject))
+		if commit.Author.Name != "" {
+			msg += " by " + html.EscapeString(commit.Author.Name)
+		}
+		msg += ")"
+	}
+	if p.Workflow.URL != "" {
+		msg += " - " + html.EscapeString(p.Workflow.URL)
+	}
+	return msg
+}
+
+// OnReceiveWebhook receives requests from CircleCI and sends notices about them into the rooms of
+// their project.
+//
+// Requests must be signed with the secret. Events which aren't announced, or are about projects
+// which aren't configured, are acknowledged and ignored.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxPayloadSize))
+	if err != nil {
+		log.WithError(err).Error("Failed to read CircleCI webhook body")
+		w.WriteHeader(400)
+		return
+	}
+	if !checkSignature(body, req.Header.Get("Circleci-Signature"), s.Secret) {
+		log.WithFields(log.Fields{
+			"service_id":         s.ServiceID(),
+			"circleci-signature": req.Header.Get("Circleci-Signature"),
+		}).Warn("Received CircleCI webhook which failed the signature check")
+		w.WriteHeader(403)
+		return
+	}
+	var p payload
+	if err = json.Unmarshal(body, &p); err != nil {
+		log.WithError(err).Error("CircleCI webhook received an invalid JSON payload")
+		w.WriteHeader(400)
+		return
+	}
+	event, ok := eventTypes[p.Type]
+	if !ok {
+		log.WithField("type", p.Type).Debug("Ignoring CircleCI event")
+		w.WriteHeader(200)
+		return
+	}
+	if p.Project.Slug == "" {
+		log.Error("CircleCI webhook is missing its project")
+		w.WriteHeader(400)
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"project": p.Project.Slug,
+		"type":    p.Type,
+	})
+
+	msg := utils.StrippedHTMLMessage(mevt.MsgNotice, p.htmlMessage(event))
+	var data map[string]interface{}
+	if err = json.Unmarshal(body, &data); err == nil {
+		msg = templates.Render("circleci."+event, data, msg)
+	}
+	for roomID, roomConfig := range s.Rooms {
+		for project, projectConfig := range roomConfig.Projects {
+			if !strings.EqualFold(project, p.Project.Slug) || !projectConfig.allows(event, p.Pipeline.VCS.Branch) {
+				continue
+			}
+			logger.WithField("room_id", roomID).Print("Sending CircleCI notification to room")
+			if _, e := notify.Send(cli, s, notify.Notification{
+				RoomID:         roomID,
+				Content:        msg,
+				CorrelationKey: "circleci " + p.Workflow.ID,
+			}); e != nil {
+				logger.WithError(e).WithField("room_id", roomID).Print(
+					"Failed to send CircleCI notification to room.")
+			}
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// checkSignature reports whether the circleci-signature header has a "v1=<hex>" signature which is
+// the HMAC of the body with the secret. The header can have several comma-separated signatures.
+func checkSignature(body []byte, header, secret string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	want := mac.Sum(nil)
+	for _, sig := range strings.Split(header, ",") {
+		sig = strings.TrimSpace(sig)
+		sigHex := strings.TrimPrefix(sig, "v1=")
+		if sigHex == sig {
+			continue
+		}
+		if got, err := hex.DecodeString(sigHex); err == nil && hmac.Equal(got, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// Register makes sure the Config information supplied is valid, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if s.Secret == "" {
+		return fmt.Errorf("A secret is required")
+	}
+	projects := 0
+	for roomID, roomConfig := range s.Rooms {
+		for project, projectConfig := range roomConfig.Projects {
+			if strings.Count(project, "/") != 2 {
+				return fmt.Errorf("Project '%s' in room %s is not a project slug like gh/owner/repo", project, roomID)
+			}
+			for _, event := range projectConfig.Events {
+				if event != eventWorkflow && event != eventJob {
+					return fmt.Errorf("Project '%s' in room %s has an unknown event '%s'", project, roomID, event)
+				}
+			}
+			for _, pattern := range projectConfig.Branches {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("Branch pattern '%s' is malformed: %s", pattern, err)
+				}
+			}
+			projects++
+		}
+	}
+	if projects == 0 {
+		return fmt.Errorf("At least one project is required")
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package circleci
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const (
+	workflowEvent = `{
+		"type": "workflow-completed",
+		"project": {"id": "a1b2", "name": "castle", "slug": "gh/hyrule/castle"},
+		"workflow": {"id": "w-31", "name": "build-and-test", "status": "%s",
+			"created_at": "2021-06-07T09:00:00.000Z", "stopped_at": "2021-06-07T09:01:35.200Z",
+			"url": "https://app.circleci.com/pipelines/github/hyrule/castle/31/workflows/w-31"},
+		"pipeline": {"number": 31, "vcs": {"branch": "%s",
+			"commit": {"subject": "Open the gate", "author": {"name": "Link"}}}}
+	}`
+	jobEvent = `{
+		"type": "job-completed",
+		"project": {"id": "a1b2", "name": "castle", "slug": "gh/hyrule/castle"},
+		"workflow": {"id": "w-31", "name": "build-and-test", "status": "failing",
+			"url": "https://app.circleci.com/pipelines/github/hyrule/castle/31/workflows/w-31"},
+		"job": {"name": "test", "number": 62, "status": "failed",
+			"started_at": "2021-06-07T09:00:10Z", "stopped_at": "2021-06-07T09:00:55Z"},
+		"pipeline": {"number": 31, "vcs": {"branch": "main"}}
+	}`
+)
+
+func sign(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhook(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.String(), "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, fmt.Sprintf("%s %s", room, msg.Body))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"secret": "triforce",
+		"rooms": {
+			"!castle:hyrule": {
+				"projects": {"gh/Hyrule/Castle": {}}
+			},
+			"!builds:hyrule": {
+				"projects": {"gh/hyrule/castle": {"events": ["workflow", "job"], "branches": ["main", "release/*"]}}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create circleci service: ", err)
+	}
+	s := srv.(*Service)
+
+	for _, tc := range []struct {
+		body      string
+		signature string // defaults to the body signed with the secret
+		code      int
+	}{
+		{fmt.Sprintf(workflowEvent, "success", "main"), "", 200},
+		{fmt.Sprintf(workflowEvent, "failed", "feature"), "", 200},
+		{jobEvent, "", 200},
+		{`{"type": "ping"}`, "", 200},
+		{strings.Replace(fmt.Sprintf(workflowEvent, "success", "main"), "gh/hyrule/castle", "gh/termina/clock-town", 1), "", 200},
+		{fmt.Sprintf(workflowEvent, "success", "main"), "none", 403},
+		{fmt.Sprintf(workflowEvent, "success", "main"), sign("{}", "triforce"), 403},
+		{fmt.Sprintf(workflowEvent, "success", "main"), sign(fmt.Sprintf(workflowEvent, "success", "main"), "ganon"), 403},
+		{`{"type": "workflow-completed"}`, "", 400},
+		{`not json`, "", 400},
+	} {
+		req := httptest.NewRequest("POST", "https://neb.endpoint/circleci", strings.NewReader(tc.body))
+		switch tc.signature {
+		case "":
+			// CircleCI may add signatures of other versions
+			req.Header.Set("circleci-signature", "v2=abcdef, "+sign(tc.body, "triforce"))
+		case "none":
+		default:
+			req.Header.Set("circleci-signature", tc.signature)
+		}
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, matrixCli)
+		if w.Code != tc.code {
+			t.Errorf("Bad response to %s: got %d, want %d", tc.body, w.Code, tc.code)
+		}
+	}
+
+	url := " - https://app.circleci.com/pipelines/github/hyrule/castle/31/workflows/w-31"
+	want := map[string]bool{
+		"!castle:hyrule [gh/hyrule/castle] workflow build-and-test of main succeeded in 1m35s (#31: Open the gate by Link)" + url: true,
+		"!builds:hyrule [gh/hyrule/castle] workflow build-and-test of main succeeded in 1m35s (#31: Open the gate by Link)" + url: true,
+		"!castle:hyrule [gh/hyrule/castle] workflow build-and-test of feature failed in 1m35s (#31: Open the gate by Link)" + url: true,
+		"!builds:hyrule [gh/hyrule/castle] job test of main failed in 45s" + url:                                                  true,
+	}
+	if len(sent) != len(want) {
+		t.Errorf("Bad number of notices: got %d, want %d: %q", len(sent), len(want), sent)
+	}
+	for _, msg := range sent {
+		if !want[msg] {
+			t.Errorf("Unexpected notice: %q", msg)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"rooms": {"!castle:hyrule": {"projects": {"gh/hyrule/castle": {}}}}}`,
+		`{"secret": "triforce"}`,
+		`{"secret": "triforce", "rooms": {"!castle:hyrule": {"projects": {}}}}`,
+		`{"secret": "triforce", "rooms": {"!castle:hyrule": {"projects": {"hyrule/castle": {}}}}}`,
+		`{"secret": "triforce", "rooms": {"!castle:hyrule": {"projects": {"gh/hyrule/castle": {"events": ["pipeline"]}}}}}`,
+		`{"secret": "triforce", "rooms": {"!castle:hyrule": {"projects": {"gh/hyrule/castle": {"branches": ["release/["]}}}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create circleci service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Package cron implements a Service which explains cron expressions and previews when they run.
+package cron
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	robfigcron "github.com/robfig/cron/v3"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Cron service
+const ServiceType = "cron"
+
+// How many run times "!cron explain" previews
+const previewCount = 5
+
+// The cron package marks fields which were given as "*" or "?" with the top bit.
+const starBit = 1 << 63
+
+// Service contains the Config fields for the Cron service.
+//
+// This service explains cron expressions: "!cron explain 0 9 * * 1-5" responds with "At 09:00, on
+// Monday through Friday" and the next five times the expression runs. Expressions have the usual
+// five fields (minute, hour, day of month, month and day of week), or are one of the descriptors
+// such as "@daily" or "@every 1h30m". The run times are in the timezone of the room, unless the
+// expression starts with e.g. "CRON_TZ=Europe/Paris".
+//
+// Example JSON request:
+//   {
+//       "timezone": "Europe/London",
+//       "rooms": {
+//           "!ops:localhost": {
+//               "timezone": "America/New_York"
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The IANA timezone of run times, e.g. "America/New_York". Defaults to UTC.
+	Timezone string `json:"timezone"`
+	// Optional. Rooms which use a different timezone.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is the settings of a room.
+type RoomConfig struct {
+	// The IANA timezone of run times in the room.
+	Timezone string `json:"timezone"`
+}
+
+// Commands supported:
+//    !cron explain expression
+// Responds with a description of the cron expression and the next times it runs.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"cron", "explain"},
+			Arguments: []string{"expression"},
+			Help:      "Explain a cron expression and show when it next runs",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdExplain(roomID, args, time.Now())
+			},
+		},
+	}
+}
+
+func (s *Service) cmdExplain(roomID id.RoomID, args []string, now time.Time) (interface{}, error) {
+	// The expression can be quoted or not
+	expr := strings.TrimSpace(strings.Join(args, " "))
+	if expr == "" {
+		return nil, fmt.Errorf("Usage: !cron explain \"0 9 * * 1-5\"")
+	}
+	sched, err := robfigcron.ParseStandard(expr)
+	if err != nil {
+		return nil, fmt.Errorf("Bad cron expression '%s': %s", expr, err)
+	}
+	loc, err := s.location(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	description := describe(sched)
+	var times []string
+	t := now.In(loc)
+	for i := 0; i < previewCount; i++ {
+		t = sched.Next(t)
+		if t.IsZero() {
+			// The expression can't ever match, e.g. the 30th of February
+			break
+		}
+		times = append(times, t.Format("Mon 2 Jan 2006 15:04 MST"))
+	}
+	if len(times) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("%s\nThis never runs!", description),
+		}, nil
+	}
+	htmlTimes := make([]string, len(times))
+	for i, t := range times {
+		htmlTimes[i] = "<li>" + html.EscapeString(t) + "</li>"
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("%s\nNext runs:\n%s", description, strings.Join(times, "\n")),
+		Format:  mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf(
+			"<strong>%s</strong><br>Next runs:<ul>%s</ul>", html.EscapeString(description), strings.Join(htmlTimes, ""),
+		),
+	}, nil
+}
+
+// location returns the timezone of the room.
+func (s *Service) location(roomID id.RoomID) (*time.Location, error) {
+	tz := s.Timezone
+	if room, ok := s.Rooms[roomID]; ok && room.Timezone != "" {
+		tz = room.Timezone
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("Bad timezone '%s': %s", tz, err)
+	}
+	return loc, nil
+}
+
+// describe returns a description of the schedule, e.g. "At 09:00, on Monday through Friday".
+func describe(sched robfigcron.Schedule) string {
+	switch sc := sched.(type) {
+	case robfigcron.ConstantDelaySchedule:
+		return "Every " + sc.Delay.String()
+	case *robfigcron.SpecSchedule:
+		desc := describeTime(sc) + describeDays(sc)
+		if months := values(sc.Month, 1, 12); len(months) < 12 {
+			desc += ", in " + formatList(months, monthName)
+		}
+		if sc.Location != time.Local {
+			desc += " (" + sc.Location.String() + ")"
+		}
+		return desc
+	}
+	return "Unknown schedule"
+}
+
+func describeTime(sc *robfigcron.SpecSchedule) string {
+	minutes := values(sc.Minute, 0, 59)
+	hours := values(sc.Hour, 0, 23)
+	minuteStep := step(minutes, 0, 59)
+	hourStep := step(hours, 0, 23)
+
+	// A few times of day are listed, e.g. "At 09:00 and 17:30"
+	if len(minutes) < 60 && minuteStep == 0 && len(hours) < 24 && hourStep == 0 && len(minutes)*len(hours) <= 6 {
+		var times []string
+		for _, h := range hours {
+			for _, m := range minutes {
+				times = append(times, fmt.Sprintf("%02d:%02d", h, m))
+			}
+		}
+		return "At " + joinList(times)
+	}
+
+	var desc string
+	switch {
+	case len(minutes) == 60:
+		desc = "Every minute"
+	case minuteStep > 0:
+		desc = fmt.Sprintf("Every %d minutes", minuteStep)
+		if minutes[0] != 0 {
+			desc += fmt.Sprintf(" from minute %d", minutes[0])
+		}
+	case len(minutes) == 1:
+		desc = fmt.Sprintf("At minute %d", minutes[0])
+	default:
+		desc = "At minutes " + formatList(minutes, strconv.Itoa)
+	}
+	switch {
+	case len(hours) == 24:
+		if len(minutes) < 60 && minuteStep == 0 {
+			desc += " past every hour"
+		}
+	case hourStep > 0:
+		desc += fmt.Sprintf(" past every %d hours", hourStep)
+		if hours[0] != 0 {
+			desc += fmt.Sprintf(" from %02d:00", hours[0])
+		}
+	case len(hours) == 1:
+		desc += fmt.Sprintf(", during hour %d", hours[0])
+	default:
+		desc += ", during hours " + formatList(hours, strconv.Itoa)
+	}
+	return desc
+}
+
+// describeDays describes the days of the month and week. Like cron, the schedule runs on days
+// which match either of them if both are restricted.
+func describeDays(sc *robfigcron.SpecSchedule) string {
+	var dom, dow string
+	if days := values(sc.Dom, 1, 31); sc.Dom&starBit == 0 {
+		if len(days) == 1 {
+			dom = fmt.Sprintf("on day %d of the month", days[0])
+		} else {
+			dom = "on days " + formatList(days, strconv.Itoa) + " of the month"
+		}
+	}
+	if sc.Dow&starBit == 0 {
+		dow = "on " + formatList(values(sc.Dow, 0, 6), func(d int) string { return time.Weekday(d).String() })
+	}
+	switch {
+	case dom != "" && dow != "":
+		return ", " + dom + " or " + dow
+	case dom != "":
+		return ", " + dom
+	case dow != "":
+		return ", " + dow
+	}
+	return ""
+}
+
+func monthName(m int) string {
+	return time.Month(m).String()
+}
+
+// values returns the values between min and max whose bits are set.
+func values(bits uint64, min, max int) []int {
+	var vals []int
+	for v := min; v <= max; v++ {
+		if bits&(1<<uint(v)) != 0 {
+			vals = append(vals, v)
+		}
+	}
+	return vals
+}
+
+// step returns the step between the values if they are e.g. "*/15" or "5-59/10", or 0 if they
+// aren't evenly spaced all the way up to max.
+func step(vals []int, min, max int) int {
+	if len(vals) < 3 {
+		return 0
+	}
+	n := vals[1] - vals[0]
+	if n < 2 || vals[0]-min >= n || vals[len(vals)-1]+n <= max {
+		return 0
+	}
+	for i := 2; i < len(vals); i++ {
+		if vals[i]-vals[i-1] != n {
+			return 0
+		}
+	}
+	return n
+}
+
+// formatList formats the values as e.g. "1, 3 and 5 through 8", naming each with name.
+func formatList(vals []int, name func(int) string) string {
+	var parts []string
+	for i := 0; i < len(vals); {
+		j := i
+		for j+1 < len(vals) && vals[j+1] == vals[j]+1 {
+			j++
+		}
+		if j-i >= 2 {
+			parts = append(parts, name(vals[i])+" through "+name(vals[j]))
+		} else {
+			for k := i; k <= j; k++ {
+				parts = append(parts, name(vals[k]))
+			}
+		}
+		i = j + 1
+	}
+	return joinList(parts)
+}
+
+// joinList joins the items as e.g. "a, b and c".
+func joinList(items []string) string {
+	if len(items) <= 1 {
+		return strings.Join(items, "")
+	}
+	return strings.Join(items[:len(items)-1], ", ") + " and " + items[len(items)-1]
+}
+
+// Register makes sure that the timezones are known.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("Bad timezone: %s", err)
+	}
+	for roomID, room := range s.Rooms {
+		if _, err := time.LoadLocation(room.Timezone); err != nil {
+			return fmt.Errorf("Bad timezone for room %s: %s", roomID, err)
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
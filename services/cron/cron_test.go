@@ -0,0 +1,90 @@
+package cron
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	robfigcron "github.com/robfig/cron/v3"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestDescribe(t *testing.T) {
+	testCases := map[string]string{
+		"0 9 * * 1-5":                  "At 09:00, on Monday through Friday",
+		"30 9,17 * * *":                "At 09:30 and 17:30",
+		"*/15 9-17 * * *":              "Every 15 minutes, during hours 9 through 17",
+		"5-59/10 * * * *":              "Every 10 minutes from minute 5",
+		"0 */2 * * *":                  "At minute 0 past every 2 hours",
+		"15 * * * *":                   "At minute 15 past every hour",
+		"* * * * *":                    "Every minute",
+		"0 0 1,15 * 1":                 "At 00:00, on days 1 and 15 of the month or on Monday",
+		"0 12 1 1-3 *":                 "At 12:00, on day 1 of the month, in January through March",
+		"0 8 * * 0,6":                  "At 08:00, on Sunday and Saturday",
+		"0,10,20,30 1 * * *":           "At 01:00, 01:10, 01:20 and 01:30",
+		"0,5,10,20,30,40,50 1 * * *":   "At minutes 0, 5, 10, 20, 30, 40 and 50, during hour 1",
+		"@daily":                       "At 00:00",
+		"@every 1h30m":                 "Every 1h30m0s",
+		"CRON_TZ=Asia/Tokyo 0 9 * * *": "At 09:00 (Asia/Tokyo)",
+	}
+	for expr, want := range testCases {
+		sched, err := robfigcron.ParseStandard(expr)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %s", expr, err)
+			continue
+		}
+		if got := describe(sched); got != want {
+			t.Errorf("describe(%s) = %q, want %q", expr, got, want)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"rooms": {"!nyc:hyrule": {"timezone": "America/New_York"}}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create cron service: ", err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register cron service: ", err)
+	}
+	s := srv.(*Service)
+
+	// A Friday, after the day's run in New York (10:00 EDT)
+	now := time.Date(2020, time.July, 3, 14, 0, 0, 0, time.UTC)
+	res, err := s.cmdExplain("!nyc:hyrule", []string{"0 9 * * 1-5"}, now)
+	if err != nil {
+		t.Fatalf("!cron explain failed: %s", err)
+	}
+	want := "At 09:00, on Monday through Friday\nNext runs:\n" +
+		"Mon 6 Jul 2020 09:00 EDT\nTue 7 Jul 2020 09:00 EDT\nWed 8 Jul 2020 09:00 EDT\n" +
+		"Thu 9 Jul 2020 09:00 EDT\nFri 10 Jul 2020 09:00 EDT"
+	if body := res.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("Bad explanation: got %q, want %q", body, want)
+	}
+
+	// Unquoted expressions are split into several args, and rooms default to UTC
+	res, err = s.cmdExplain("!other:hyrule", strings.Fields("0 9 * * 1-5"), now)
+	if err != nil {
+		t.Fatalf("!cron explain failed: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; !strings.Contains(body, "Mon 6 Jul 2020 09:00 UTC") {
+		t.Errorf("Expected times in UTC, got %s", body)
+	}
+
+	res, err = s.cmdExplain("!other:hyrule", []string{"0 0 30 2 *"}, now)
+	if err != nil {
+		t.Fatalf("!cron explain failed: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; !strings.HasSuffix(body, "This never runs!") {
+		t.Errorf("Expected the 30th of February never to run, got %s", body)
+	}
+
+	for _, expr := range []string{"", "0 9 * *", "61 * * * *", "0 9 * * Funday"} {
+		if _, err = s.cmdExplain("!other:hyrule", []string{expr}, now); err == nil {
+			t.Errorf("Expected '%s' to be refused", expr)
+		}
+	}
+}
@@ -0,0 +1,518 @@
+// Package crypto implements a Service which looks up cryptocurrency prices, and alerts rooms when
+// prices cross thresholds.
+package crypto
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Crypto service
+const ServiceType = "crypto"
+
+const (
+	defaultPollInterval = 5 * time.Minute
+	// How many alerts each room can have
+	maxAlertsPerRoom = 20
+)
+
+// The CoinGecko API, which needs no key. Overridden by tests.
+var coingeckoURL = "https://api.coingecko.com/api/v3/"
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// CoinGecko knows coins by ID rather than by symbol, as many coins share symbols. These are the
+// coins which people most likely mean by each symbol; other coins can be looked up by their ID,
+// e.g. "!crypto shiba-inu".
+var coinIDs = map[string]string{
+	"ada":   "cardano",
+	"algo":  "algorand",
+	"atom":  "cosmos",
+	"avax":  "avalanche-2",
+	"bch":   "bitcoin-cash",
+	"bnb":   "binancecoin",
+	"btc":   "bitcoin",
+	"dai":   "dai",
+	"doge":  "dogecoin",
+	"dot":   "polkadot",
+	"etc":   "ethereum-classic",
+	"eth":   "ethereum",
+	"link":  "chainlink",
+	"ltc":   "litecoin",
+	"matic": "matic-network",
+	"shib":  "shiba-inu",
+	"sol":   "solana",
+	"trx":   "tron",
+	"uni":   "uniswap",
+	"usdc":  "usd-coin",
+	"usdt":  "tether",
+	"xlm":   "stellar",
+	"xmr":   "monero",
+	"xrp":   "ripple",
+	"xtz":   "tezos",
+	"zec":   "zcash",
+}
+
+// "BTC > 50000", "eth<2,000" or "sol > 1.5k"
+var alertRegex = regexp.MustCompile(`^(\S+?)\s*([<>])\s*([0-9][0-9,]*(?:\.[0-9]+)?)([km]?)$`)
+
+// CoinGecko's currencies, e.g. "usd" or "sats"
+var currencyRegex = regexp.MustCompile(`^[A-Za-z]{3,4}$`)
+
+// Commands and OnPoll both update the alerts, so they are only loaded and stored while holding
+// this, lest a new alert be lost when OnPoll removes the ones which fired.
+var alertsMutex sync.Mutex
+
+// Service contains the Config fields for the Crypto service.
+//
+// Prices come from CoinGecko. Coins can be given by their symbol, e.g. "BTC", or by their
+// CoinGecko ID, e.g. "bitcoin".
+//
+// Anyone in a room can set alerts with "!crypto alert BTC > 50000". The room is told once when the
+// price goes above or below the threshold, and then the alert is removed.
+//
+// Example JSON request:
+//   {
+//       "currency": "usd",
+//       "poll_interval_mins": 5
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The currency to show prices in, e.g. "eur". Defaults to "usd".
+	Currency string `json:"currency"`
+	// Optional. How often to check the prices of coins with alerts, in minutes. Defaults to 5.
+	PollIntervalMins int `json:"poll_interval_mins"`
+}
+
+// alertState is every room's alerts. It is stored in the service state under "alerts".
+type alertState struct {
+	Alerts []alert `json:"alerts"`
+	// The number of the last alert added, so that numbers aren't reused
+	LastID int `json:"last_id"`
+}
+
+type alert struct {
+	ID     int       `json:"id"`
+	RoomID id.RoomID `json:"room_id"`
+	UserID id.UserID `json:"user_id"`
+	// The symbol or ID which the user gave, e.g. "BTC"
+	Symbol string `json:"symbol"`
+	CoinID string `json:"coin_id"`
+	// Whether the room is told when the price goes above the threshold, rather than below it
+	Above     bool    `json:"above"`
+	Threshold float64 `json:"threshold"`
+}
+
+// crossed returns whether the price is beyond the alert's threshold.
+func (a *alert) crossed(price float64) bool {
+	if a.Above {
+		return price > a.Threshold
+	}
+	return price < a.Threshold
+}
+
+func (a *alert) direction() string {
+	if a.Above {
+		return "above"
+	}
+	return "below"
+}
+
+// coinPrice is CoinGecko's price of a coin, in the currency which was asked for.
+type coinPrice struct {
+	price float64
+	// The change over the last 24 hours, as a percentage
+	change float64
+}
+
+// Commands supported:
+//    !btc
+// Responds with the price of bitcoin.
+//    !crypto symbol...
+// Responds with the prices of the coins.
+//    !crypto alert symbol >|< price
+// Tells the room when the coin's price goes above or below the price.
+//    !crypto alerts
+// Responds with the room's alerts.
+//    !crypto alert remove N
+// Removes the room's alert numbered N.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"btc"},
+			Help: "Show the price of bitcoin",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdPrices([]string{"btc"})
+			},
+		},
+		{
+			Path:      []string{"crypto"},
+			Arguments: []string{"symbol"},
+			Help:      "Show the prices of cryptocurrencies, e.g. !crypto BTC ETH",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdPrices(args)
+			},
+		},
+		{
+			Path:      []string{"crypto", "alert"},
+			Arguments: []string{"symbol", ">|<", "price"},
+			Help:      "Tell this room when a price goes above or below a threshold, e.g. !crypto alert BTC > 50000",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdAlert(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"crypto", "alerts"},
+			Help: "List this room's price alerts",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdAlerts(roomID)
+			},
+		},
+		{
+			Path:      []string{"crypto", "alert", "remove"},
+			Arguments: []string{"N"},
+			Help:      "Remove one of this room's price alerts",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdRemove(roomID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdPrices(args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Usage: !crypto symbol, e.g. !crypto BTC")
+	}
+	var ids []string
+	for _, arg := range args {
+		ids = append(ids, coinID(arg))
+	}
+	prices, err := s.fetchPrices(ids)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch prices: %s", err)
+	}
+	var lines []string
+	for i, arg := range args {
+		p, ok := prices[ids[i]]
+		if !ok {
+			lines = append(lines, fmt.Sprintf("%s: no price found", strings.ToUpper(arg)))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s (%+.2f%% in 24h)", strings.ToUpper(arg), s.formatPrice(p.price), p.change))
+	}
+	return notice(strings.Join(lines, "\n")), nil
+}
+
+func (s *Service) cmdAlert(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	m := alertRegex.FindStringSubmatch(strings.Join(args, " "))
+	if m == nil {
+		return nil, fmt.Errorf("Usage: !crypto alert symbol >|< price, e.g. !crypto alert BTC > 50000")
+	}
+	threshold, err := strconv.ParseFloat(strings.Replace(m[3], ",", "", -1), 64)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' isn't a price", m[3])
+	}
+	switch m[4] {
+	case "k":
+		threshold *= 1e3
+	case "m":
+		threshold *= 1e6
+	}
+	a := alert{
+		RoomID:    roomID,
+		UserID:    userID,
+		Symbol:    strings.ToUpper(m[1]),
+		CoinID:    coinID(m[1]),
+		Above:     m[2] == ">",
+		Threshold: threshold,
+	}
+
+	prices, err := s.fetchPrices([]string{a.CoinID})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch the price of %s: %s", a.Symbol, err)
+	}
+	p, ok := prices[a.CoinID]
+	if !ok {
+		return nil, fmt.Errorf("There is no price for %s", a.Symbol)
+	}
+	if a.crossed(p.price) {
+		return nil, fmt.Errorf("%s is already %s %s, at %s", a.Symbol, a.direction(), s.formatPrice(a.Threshold), s.formatPrice(p.price))
+	}
+
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+	alerts, err := s.loadAlerts()
+	if err != nil {
+		return nil, err
+	}
+	count := 0
+	for _, other := range alerts.Alerts {
+		if other.RoomID == roomID {
+			count++
+		}
+	}
+	if count >= maxAlertsPerRoom {
+		return nil, fmt.Errorf("This room has %d alerts, which is the most it can have", count)
+	}
+	alerts.LastID++
+	a.ID = alerts.LastID
+	alerts.Alerts = append(alerts.Alerts, a)
+	if err = s.storeAlerts(alerts); err != nil {
+		return nil, err
+	}
+	return notice(fmt.Sprintf("Alert #%d: this room will be told when %s goes %s %s. It's %s now.",
+		a.ID, a.Symbol, a.direction(), s.formatPrice(a.Threshold), s.formatPrice(p.price))), nil
+}
+
+func (s *Service) cmdAlerts(roomID id.RoomID) (interface{}, error) {
+	alertsMutex.Lock()
+	alerts, err := s.loadAlerts()
+	alertsMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, a := range alerts.Alerts {
+		if a.RoomID == roomID {
+			lines = append(lines, fmt.Sprintf("#%d: %s %s %s, set by %s", a.ID, a.Symbol, a.direction(), s.formatPrice(a.Threshold), a.UserID))
+		}
+	}
+	if len(lines) == 0 {
+		return notice("This room has no price alerts"), nil
+	}
+	return notice("Price alerts:\n" + strings.Join(lines, "\n")), nil
+}
+
+func (s *Service) cmdRemove(roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !crypto alert remove N")
+	}
+	alertID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return nil, fmt.Errorf("Usage: !crypto alert remove N")
+	}
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+	alerts, err := s.loadAlerts()
+	if err != nil {
+		return nil, err
+	}
+	for i, a := range alerts.Alerts {
+		// Rooms can only remove their own alerts
+		if a.ID == alertID && a.RoomID == roomID {
+			alerts.Alerts = append(alerts.Alerts[:i], alerts.Alerts[i+1:]...)
+			if err = s.storeAlerts(alerts); err != nil {
+				return nil, err
+			}
+			return notice(fmt.Sprintf("Removed alert #%d", alertID)), nil
+		}
+	}
+	return nil, fmt.Errorf("This room has no alert #%d", alertID)
+}
+
+func (s *Service) pollInterval() time.Duration {
+	if s.PollIntervalMins <= 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(s.PollIntervalMins) * time.Minute
+}
+
+// OnPoll checks the prices of the coins with alerts, and tells the rooms whose thresholds have
+// been crossed.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	s.checkAlerts(cli)
+	return time.Now().Add(s.pollInterval())
+}
+
+func (s *Service) checkAlerts(cli types.MatrixClient) {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+	alerts, err := s.loadAlerts()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load alerts")
+		return
+	}
+	if len(alerts.Alerts) == 0 {
+		return
+	}
+	seen := make(map[string]bool)
+	var ids []string
+	for _, a := range alerts.Alerts {
+		if !seen[a.CoinID] {
+			seen[a.CoinID] = true
+			ids = append(ids, a.CoinID)
+		}
+	}
+	prices, err := s.fetchPrices(ids)
+	if err != nil {
+		logger.WithError(err).Error("Failed to fetch prices")
+		return
+	}
+
+	var remaining []alert
+	for _, a := range alerts.Alerts {
+		p, ok := prices[a.CoinID]
+		if !ok || !a.crossed(p.price) {
+			remaining = append(remaining, a)
+			continue
+		}
+		emoji := "📈"
+		if !a.Above {
+			emoji = "📉"
+		}
+		_, err := notify.Send(cli, s, notify.Notification{
+			RoomID: a.RoomID,
+			Content: mevt.MessageEventContent{
+				MsgType: mevt.MsgNotice,
+				Body: fmt.Sprintf("%s %s is %s %s, at %s (%+.2f%% in 24h)\nAlert #%d set by %s", emoji, a.Symbol,
+					a.direction(), s.formatPrice(a.Threshold), s.formatPrice(p.price), p.change, a.ID, a.UserID),
+			},
+			Severity:       notify.SeverityWarning,
+			CorrelationKey: fmt.Sprintf("crypto %d", a.ID),
+		})
+		if err != nil {
+			logger.WithError(err).WithField("room_id", a.RoomID).Error("Failed to send price alert")
+			// Try again next time
+			remaining = append(remaining, a)
+		}
+	}
+	if len(remaining) == len(alerts.Alerts) {
+		return
+	}
+	alerts.Alerts = remaining
+	if err = s.storeAlerts(alerts); err != nil {
+		logger.WithError(err).Error("Failed to store alerts")
+	}
+}
+
+// fetchPrices returns the prices of the coins which CoinGecko knows, keyed by ID.
+func (s *Service) fetchPrices(ids []string) (map[string]coinPrice, error) {
+	currency := s.currency()
+	u := coingeckoURL + "simple/price?" + url.Values{
+		"ids":                 {strings.Join(ids, ",")},
+		"vs_currencies":       {currency},
+		"include_24hr_change": {"true"},
+	}.Encode()
+	res, err := httpClient.Get(u)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var body map[string]map[string]float64
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	prices := make(map[string]coinPrice)
+	for coin, values := range body {
+		if price, ok := values[currency]; ok {
+			prices[coin] = coinPrice{price, values[currency+"_24h_change"]}
+		}
+	}
+	return prices, nil
+}
+
+// coinID returns CoinGecko's ID of the coin with the symbol, or the symbol itself if it isn't a
+// well known one, as it may be an ID.
+func coinID(symbol string) string {
+	symbol = strings.ToLower(symbol)
+	if coin, ok := coinIDs[symbol]; ok {
+		return coin
+	}
+	return symbol
+}
+
+func (s *Service) currency() string {
+	if s.Currency == "" {
+		return "usd"
+	}
+	return strings.ToLower(s.Currency)
+}
+
+// formatPrice returns the price with the currency, e.g. "50,123.45 USD", or to 4 significant
+// figures if it is less than 1.
+func (s *Service) formatPrice(price float64) string {
+	currency := strings.ToUpper(s.currency())
+	if price < 1 {
+		return strconv.FormatFloat(price, 'g', 4, 64) + " " + currency
+	}
+	whole, fraction := strconv.FormatFloat(price, 'f', 2, 64), ""
+	if i := strings.Index(whole, "."); i >= 0 {
+		whole, fraction = whole[:i], whole[i:]
+	}
+	for i := len(whole) - 3; i > 0; i -= 3 {
+		whole = whole[:i] + "," + whole[i:]
+	}
+	return whole + fraction + " " + currency
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func (s *Service) loadAlerts() (*alertState, error) {
+	var alerts alertState
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "alerts")
+	if err == sql.ErrNoRows {
+		return &alerts, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, &alerts); err != nil {
+		return nil, err
+	}
+	return &alerts, nil
+}
+
+func (s *Service) storeAlerts(alerts *alertState) error {
+	stateJSON, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "alerts", stateJSON)
+}
+
+// Register makes sure that the poll interval is sensible.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.PollIntervalMins < 0 {
+		return fmt.Errorf("poll_interval_mins can't be negative")
+	}
+	if s.Currency != "" && !currencyRegex.MatchString(s.Currency) {
+		return fmt.Errorf("Bad currency '%s': use a currency code, e.g. usd", s.Currency)
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestCrypto(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	prices := map[string]string{
+		"bitcoin":  `{"eur":45123.456,"eur_24h_change":2.3456}`,
+		"ethereum": `{"eur":1500.1,"eur_24h_change":-1.5}`,
+		"dogecoin": `{"eur":0.0512345,"eur_24h_change":0}`,
+	}
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		q := req.URL.Query()
+		if !strings.HasPrefix(req.URL.String(), coingeckoURL+"simple/price?") || q.Get("vs_currencies") != "eur" {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		var found []string
+		for _, coin := range strings.Split(q.Get("ids"), ",") {
+			if p, ok := prices[coin]; ok {
+				found = append(found, fmt.Sprintf("%q:%s", coin, p))
+			}
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("{" + strings.Join(found, ",") + "}")),
+		}, nil
+	})}
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$alert:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"currency": "EUR"}`))
+	if err != nil {
+		t.Fatal("Failed to create crypto service: ", err)
+	}
+	s := srv.(*Service)
+
+	respond := func(res interface{}, err error) string {
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+	for _, tc := range []struct {
+		got, want string
+	}{
+		{respond(s.cmdPrices([]string{"btc", "Ethereum", "doge", "ganoncoin"})),
+			"BTC: 45,123.46 EUR (+2.35% in 24h)\nETHEREUM: 1,500.10 EUR (-1.50% in 24h)\nDOGE: 0.05123 EUR (+0.00% in 24h)\nGANONCOIN: no price found"},
+		{respond(s.cmdAlert("!traders:hyrule", "@link:hyrule", []string{"BTC", ">", "50,000"})),
+			"Alert #1: this room will be told when BTC goes above 50,000.00 EUR. It's 45,123.46 EUR now."},
+		{respond(s.cmdAlert("!traders:hyrule", "@zelda:hyrule", []string{"eth<1.2k"})),
+			"Alert #2: this room will be told when ETH goes below 1,200.00 EUR. It's 1,500.10 EUR now."},
+		{respond(s.cmdAlert("!traders:hyrule", "@link:hyrule", []string{"BTC", "<", "50000"})),
+			"error: BTC is already below 50,000.00 EUR, at 45,123.46 EUR"},
+		{respond(s.cmdAlert("!traders:hyrule", "@link:hyrule", []string{"BTC", "50000"})),
+			"error: Usage: !crypto alert symbol >|< price, e.g. !crypto alert BTC > 50000"},
+		{respond(s.cmdAlert("!other:hyrule", "@link:hyrule", []string{"doge", ">", "1"})),
+			"Alert #3: this room will be told when DOGE goes above 1.00 EUR. It's 0.05123 EUR now."},
+		{respond(s.cmdRemove("!traders:hyrule", []string{"3"})), "error: This room has no alert #3"},
+		{respond(s.cmdRemove("!other:hyrule", []string{"#3"})), "Removed alert #3"},
+		{respond(s.cmdAlerts("!traders:hyrule")),
+			"Price alerts:\n#1: BTC above 50,000.00 EUR, set by @link:hyrule\n#2: ETH below 1,200.00 EUR, set by @zelda:hyrule"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("Got %q, want %q", tc.got, tc.want)
+		}
+	}
+
+	s.checkAlerts(matrixCli)
+	if len(sent) != 0 {
+		t.Errorf("Alerted before prices crossed thresholds: %q", sent)
+	}
+	prices["bitcoin"] = `{"eur":50500,"eur_24h_change":11.9}`
+	s.checkAlerts(matrixCli)
+	s.checkAlerts(matrixCli)
+	want := "📈 BTC is above 50,000.00 EUR, at 50,500.00 EUR (+11.90% in 24h)\nAlert #1 set by @link:hyrule"
+	if len(sent) != 1 || sent[0] != want {
+		t.Errorf("Bad alerts: got %q, want %q", sent, want)
+	}
+	if got := respond(s.cmdAlerts("!traders:hyrule")); got != "Price alerts:\n#2: ETH below 1,200.00 EUR, set by @zelda:hyrule" {
+		t.Errorf("Alert wasn't removed after alerting: %s", got)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"poll_interval_mins": -1}`,
+		`{"currency": "euros"}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create crypto service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// Package currency implements a Service which converts between currencies with the European
+// Central Bank's reference rates.
+package currency
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Currency service
+const ServiceType = "currency"
+
+// The ECB's rates against the euro, which are published once each working day. Overridden by tests.
+var ratesURL = "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-daily.xml"
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// ISO 4217 currency codes, e.g. "EUR"
+var currencyRegex = regexp.MustCompile(`^[A-Za-z]{3}$`)
+
+// How long the rates are used before they are fetched again. The ECB publishes new rates at about
+// 16:00 CET, so rates are at most a few hours older than the ECB's.
+const ratesTTL = 6 * time.Hour
+
+// The rates are shared by every Currency service, so that the ECB is asked for them once no matter
+// how many rooms convert currencies.
+var (
+	ratesMutex  sync.Mutex
+	cachedRates *rateTable
+)
+
+// rateTable is the value of a euro in each currency on a day.
+type rateTable struct {
+	// The day the ECB published the rates, e.g. "2021-03-15"
+	date    string
+	rates   map[string]float64
+	fetched time.Time
+}
+
+// Service contains the Config fields for the Currency service.
+//
+// Amounts are converted with the reference rates which the European Central Bank publishes each
+// working day, for about 30 currencies. No API key is needed.
+//
+// Example JSON request:
+//   {
+//       "default_currency": "GBP"
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The currency to convert into when only one currency is given, e.g. "!fx 100 USD".
+	// Defaults to EUR.
+	DefaultCurrency string `json:"default_currency"`
+}
+
+// ecbEnvelope is the ECB's daily rates XML.
+type ecbEnvelope struct {
+	Days []struct {
+		Time  string `xml:"time,attr"`
+		Rates []struct {
+			Currency string `xml:"currency,attr"`
+			Rate     string `xml:"rate,attr"`
+		} `xml:"Cube"`
+	} `xml:"Cube>Cube"`
+}
+
+// Commands supported:
+//    !fx [amount] currency [to] currency...
+// Responds with the amount, or 1, converted from the first currency into the others, e.g.
+// "!fx 100 USD EUR GBP".
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"fx"},
+			Arguments: []string{"amount", "from", "to"},
+			Help:      "Convert an amount between currencies, e.g. !fx 100 USD EUR",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdFX(args, time.Now())
+			},
+		},
+	}
+}
+
+func (s *Service) cmdFX(args []string, now time.Time) (interface{}, error) {
+	amount := 1.0
+	if len(args) > 0 {
+		if a, err := parseAmount(args[0]); err == nil {
+			amount = a
+			args = args[1:]
+		}
+	}
+	var currencies []string
+	for _, arg := range args {
+		if word := strings.ToLower(arg); word == "to" || word == "in" || word == "into" {
+			continue
+		}
+		currencies = append(currencies, strings.ToUpper(arg))
+	}
+	if len(currencies) == 1 {
+		currencies = append(currencies, s.defaultCurrency())
+	}
+	if len(currencies) < 2 {
+		return nil, fmt.Errorf("Usage: !fx [amount] currency currency, e.g. !fx 100 USD EUR")
+	}
+
+	table, err := loadRates(now)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch exchange rates: %s", err)
+	}
+	for _, c := range currencies {
+		if _, ok := table.rates[c]; !ok {
+			return nil, fmt.Errorf("There is no rate for '%s'. Rates are known for: %s", c, strings.Join(table.currencies(), ", "))
+		}
+	}
+
+	from := currencies[0]
+	lines := make([]string, 0, len(currencies))
+	for _, to := range currencies[1:] {
+		converted := amount * table.rates[to] / table.rates[from]
+		lines = append(lines, fmt.Sprintf("%s %s = %s %s", formatAmount(amount), from, formatAmount(converted), to))
+	}
+	lines = append(lines, fmt.Sprintf("ECB reference rates of %s", table.date))
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    strings.Join(lines, "\n"),
+	}, nil
+}
+
+func (s *Service) defaultCurrency() string {
+	if s.DefaultCurrency == "" {
+		return "EUR"
+	}
+	return strings.ToUpper(s.DefaultCurrency)
+}
+
+// currencies returns the currencies which the table has rates for, in alphabetical order.
+func (t *rateTable) currencies() []string {
+	var currencies []string
+	for c := range t.rates {
+		currencies = append(currencies, c)
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+// parseAmount parses an amount like "100", "1,000.50" or "2.5k".
+func parseAmount(word string) (float64, error) {
+	s := strings.ToLower(strings.Replace(word, ",", "", -1))
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier, s = 1e3, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		multiplier, s = 1e6, strings.TrimSuffix(s, "m")
+	}
+	amount, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(amount) || math.IsInf(amount, 0) || amount < 0 {
+		return 0, fmt.Errorf("'%s' isn't an amount", word)
+	}
+	return amount * multiplier, nil
+}
+
+// formatAmount returns the amount to 2 decimal places, or to 4 significant figures if it is less
+// than a cent.
+func formatAmount(amount float64) string {
+	if amount != 0 && amount < 0.01 {
+		return strconv.FormatFloat(amount, 'g', 4, 64)
+	}
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+// loadRates returns the latest rates, fetching them if the cached ones are too old.
+func loadRates(now time.Time) (*rateTable, error) {
+	ratesMutex.Lock()
+	defer ratesMutex.Unlock()
+	if cachedRates != nil && now.Sub(cachedRates.fetched) < ratesTTL {
+		return cachedRates, nil
+	}
+	table, err := fetchRates()
+	if err != nil {
+		if cachedRates != nil {
+			// Older rates are better than none
+			return cachedRates, nil
+		}
+		return nil, err
+	}
+	table.fetched = now
+	cachedRates = table
+	return table, nil
+}
+
+func fetchRates() (*rateTable, error) {
+	res, err := httpClient.Get(ratesURL)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var envelope ecbEnvelope
+	if err = xml.NewDecoder(res.Body).Decode(&envelope); err != nil {
+		return nil, err
+	}
+	if len(envelope.Days) == 0 {
+		return nil, fmt.Errorf("No rates were published")
+	}
+	day := envelope.Days[0]
+	table := &rateTable{
+		date: day.Time,
+		// The rates are the value of a euro
+		rates: map[string]float64{"EUR": 1},
+	}
+	for _, r := range day.Rates {
+		rate, err := strconv.ParseFloat(r.Rate, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("Bad rate for %s: '%s'", r.Currency, r.Rate)
+		}
+		table.rates[r.Currency] = rate
+	}
+	return table, nil
+}
+
+// Register makes sure that the default currency is a currency code.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.DefaultCurrency != "" && !currencyRegex.MatchString(s.DefaultCurrency) {
+		return fmt.Errorf("Bad default_currency '%s': use a 3 letter code, e.g. EUR", s.DefaultCurrency)
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package currency
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const ecbXML = `<?xml version="1.0" encoding="UTF-8"?>
+<gesmes:Envelope xmlns:gesmes="http://www.gesmes.org/xml/2002-08-01" xmlns="http://www.ecb.int/vocabulary/2002-08-01/eurofxref">
+	<gesmes:subject>Reference rates</gesmes:subject>
+	<Cube>
+		<Cube time="2021-03-15">
+			<Cube currency="USD" rate="1.1925"/>
+			<Cube currency="JPY" rate="130.11"/>
+			<Cube currency="GBP" rate="0.85773"/>
+		</Cube>
+	</Cube>
+</gesmes:Envelope>`
+
+func TestFX(t *testing.T) {
+	fetches := 0
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != ratesURL {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		fetches++
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(ecbXML)),
+		}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"default_currency": "gbp"}`))
+	if err != nil {
+		t.Fatal("Failed to create currency service: ", err)
+	}
+	s := srv.(*Service)
+	now := time.Date(2021, 3, 15, 17, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"100", "USD", "EUR"}, "100.00 USD = 83.86 EUR\nECB reference rates of 2021-03-15"},
+		{[]string{"1,000", "eur", "to", "usd", "jpy"}, "1000.00 EUR = 1192.50 USD\n1000.00 EUR = 130110.00 JPY\nECB reference rates of 2021-03-15"},
+		{[]string{"2.5k", "JPY"}, "2500.00 JPY = 16.48 GBP\nECB reference rates of 2021-03-15"},
+		{[]string{"JPY", "in", "EUR"}, "1.00 JPY = 0.007686 EUR\nECB reference rates of 2021-03-15"},
+		{[]string{"100", "USD", "XYZ"}, "error: There is no rate for 'XYZ'. Rates are known for: EUR, GBP, JPY, USD"},
+		{[]string{"100"}, "error: Usage: !fx [amount] currency currency, e.g. !fx 100 USD EUR"},
+	} {
+		var got string
+		res, err := s.cmdFX(tc.args, now)
+		if err != nil {
+			got = "error: " + err.Error()
+		} else {
+			got = res.(*mevt.MessageEventContent).Body
+		}
+		if got != tc.want {
+			t.Errorf("!fx %v: got %q, want %q", tc.args, got, tc.want)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("Fetched the rates %d times, want once", fetches)
+	}
+
+	if _, err = s.cmdFX([]string{"USD"}, now.Add(ratesTTL)); err != nil {
+		t.Fatal("!fx failed: ", err)
+	}
+	if fetches != 2 {
+		t.Errorf("Didn't fetch the rates again once they were old")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"default_currency": "euro"}`))
+	if err != nil {
+		t.Fatal("Failed to create currency service: ", err)
+	}
+	if err = srv.Register(nil, nil); err == nil {
+		t.Error("Expected a bad default_currency to be refused")
+	}
+}
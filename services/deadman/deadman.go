@@ -0,0 +1,413 @@
+// Package deadman implements a Service which alerts rooms when scheduled jobs, such as backups,
+// stop checking in.
+package deadman
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Deadman service
+const ServiceType = "deadman"
+
+// The longest the poller sleeps for, so that it notices checks which are added to the config
+const pollInterval = time.Hour
+
+const defaultGrace = time.Hour
+
+// How much of the body of a failure ping is shown, e.g. the end of a job's log
+const maxFailureBody = 1000
+
+// timeNow is replaced in tests.
+var timeNow = time.Now
+
+// Pings and OnPoll both update the checks, so they are only loaded and stored while holding this,
+// lest a ping arriving as a check goes overdue be lost.
+var checksMutex sync.Mutex
+
+// Service contains the Config fields for the Deadman service.
+//
+// Each check has a ping URL, which is the webhook URL with "?check=" and the check's name, e.g.
+//    https://neb.example.com/services/hooks/ZGVhZG1hbg?check=nightly-backup
+// A cron job pings it when it succeeds:
+//    0 2 * * * /usr/local/bin/backup.sh && curl -fsS -m 10 "$PING_URL"
+// If there is no ping within the check's period plus its grace time, counted from the last ping,
+// or from when the check was added if it has never been pinged, the check's room is alerted that
+// it is down. The room is told when pings start arriving again.
+//
+// Jobs can also report failing straight away by adding "&status=fail" to the ping URL. The start
+// of the ping's body, which can be the job's output, is included in the alert:
+//    backup.sh 2>&1 | tail -n 20 | curl -fsS -m 10 --data-binary @- "$PING_URL&status=fail"
+//
+// Checks with a key must be pinged with "&key=" and the key, so that only the jobs which know it
+// can ping them.
+//
+// Example JSON request:
+//   {
+//       "checks": {
+//           "nightly-backup": {
+//               "room_id": "!ops:localhost",
+//               "period": "24h",
+//               "grace": "1h",
+//               "key": "s3cr3t"
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which checks are pinged at, with "?check=" and the check's name. Set by Go-NEB.
+	WebhookURL string `json:"webhook_url"`
+	// The checks, keyed by name.
+	Checks map[string]Check `json:"checks"`
+}
+
+// Check is a job which should ping the service regularly.
+type Check struct {
+	// The room to alert when the check is down.
+	RoomID id.RoomID `json:"room_id"`
+	// How often the job should ping, e.g. "24h" or "15m".
+	Period string `json:"period"`
+	// Optional. How much later than the period a ping can be before the check is down, e.g.
+	// "30m". Defaults to an hour.
+	Grace string `json:"grace"`
+	// Optional. A secret which pings must include.
+	Key string `json:"key"`
+}
+
+func (c *Check) period() time.Duration {
+	d, _ := time.ParseDuration(c.Period)
+	return d
+}
+
+func (c *Check) grace() time.Duration {
+	if c.Grace == "" {
+		return defaultGrace
+	}
+	d, _ := time.ParseDuration(c.Grace)
+	return d
+}
+
+// checkState is what is known about a check from its pings. The states of all the checks are
+// stored in the service state under "checks".
+type checkState struct {
+	// When the check was first seen, which is when it starts being expected to ping
+	AddedTimestampSecs int64 `json:"added_timestamp_secs"`
+	// 0 if the check has never been pinged
+	LastPingTimestampSecs int64 `json:"last_ping_timestamp_secs"`
+	// Whether the room was told that the check is down, so that it is only told once
+	Down bool `json:"down"`
+}
+
+// lastPing returns when the check last pinged, or when it was added if it never has.
+func (c *checkState) lastPing() time.Time {
+	if c.LastPingTimestampSecs == 0 {
+		return time.Unix(c.AddedTimestampSecs, 0)
+	}
+	return time.Unix(c.LastPingTimestampSecs, 0)
+}
+
+// OnReceiveWebhook records a ping from a job.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	q := req.URL.Query()
+	name := q.Get("check")
+	check, ok := s.Checks[name]
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(q.Get("key")), []byte(check.Key)) != 1 {
+		w.WriteHeader(403)
+		return
+	}
+	failed := q.Get("status") == "fail"
+	var body []byte
+	if failed && req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxFailureBody)); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	checksMutex.Lock()
+	defer checksMutex.Unlock()
+	states, err := s.loadStates()
+	if err != nil {
+		log.WithError(err).WithField("check", name).Error("Failed to load checks")
+		w.WriteHeader(500)
+		return
+	}
+	now := timeNow()
+	state := states[name]
+	if state == nil {
+		state = &checkState{AddedTimestampSecs: now.Unix()}
+		states[name] = state
+	}
+	wasDown := state.Down
+	state.LastPingTimestampSecs = now.Unix()
+	state.Down = failed
+	if err = s.storeStates(states); err != nil {
+		log.WithError(err).WithField("check", name).Error("Failed to store checks")
+		w.WriteHeader(500)
+		return
+	}
+
+	if failed {
+		text := fmt.Sprintf("🚨 %s reported a failure", name)
+		if output := strings.TrimSpace(strings.ToValidUTF8(string(body), "")); output != "" {
+			text += ":\n" + output
+		}
+		s.alert(cli, name, check, text, notify.SeverityCritical)
+	} else if wasDown {
+		s.alert(cli, name, check, fmt.Sprintf("✅ %s is back up", name), notify.SeverityInfo)
+	}
+	w.WriteHeader(200)
+}
+
+// OnPoll alerts the rooms of the checks which are overdue, and returns when the next one could be.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	now := timeNow()
+	next := s.checkDue(cli, now)
+	if next.IsZero() || next.After(now.Add(pollInterval)) {
+		return now.Add(pollInterval)
+	}
+	return next
+}
+
+// checkDue alerts the rooms of the checks which haven't been pinged in time, and returns when
+// the next check which is up will be overdue, or the zero time if none are up.
+func (s *Service) checkDue(cli types.MatrixClient, now time.Time) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	checksMutex.Lock()
+	defer checksMutex.Unlock()
+	states, err := s.loadStates()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load checks")
+		return time.Time{}
+	}
+
+	var next time.Time
+	var overdue []string
+	changed := false
+	for name, check := range s.Checks {
+		state := states[name]
+		if state == nil {
+			state = &checkState{AddedTimestampSecs: now.Unix()}
+			states[name] = state
+			changed = true
+		}
+		if state.Down {
+			continue
+		}
+		deadline := state.lastPing().Add(check.period() + check.grace())
+		if now.Before(deadline) {
+			if next.IsZero() || deadline.Before(next) {
+				next = deadline
+			}
+			continue
+		}
+		state.Down = true
+		overdue = append(overdue, name)
+		changed = true
+	}
+	if !changed {
+		return next
+	}
+	// Store first, so that the rooms can't be alerted twice if storing fails
+	if err = s.storeStates(states); err != nil {
+		logger.WithError(err).Error("Failed to store checks")
+		return time.Time{}
+	}
+
+	sort.Strings(overdue)
+	for _, name := range overdue {
+		check := s.Checks[name]
+		state := states[name]
+		var text string
+		if state.LastPingTimestampSecs == 0 {
+			text = fmt.Sprintf("🚨 %s is down: it hasn't pinged since it was added %s ago", name,
+				formatDuration(now.Sub(state.lastPing())))
+		} else {
+			text = fmt.Sprintf("🚨 %s is down: its last ping was %s ago", name, formatDuration(now.Sub(state.lastPing())))
+		}
+		text += fmt.Sprintf(" (expected every %s, with %s grace)", formatDuration(check.period()), formatDuration(check.grace()))
+		s.alert(cli, name, check, text, notify.SeverityCritical)
+	}
+	return next
+}
+
+func (s *Service) alert(cli types.MatrixClient, name string, check Check, text string, severity notify.Severity) {
+	_, err := notify.Send(cli, s, notify.Notification{
+		RoomID: check.RoomID,
+		Content: mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    text,
+		},
+		Severity:       severity,
+		CorrelationKey: "deadman " + name,
+	})
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"check":   name,
+			"room_id": check.RoomID,
+		}).Error("Failed to send deadman alert")
+	}
+}
+
+// Commands supported:
+//    !deadman status
+// Responds with every check, whether it is up and when it last pinged.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"deadman", "status"},
+			Help: "Show whether the scheduled jobs are checking in",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdStatus(timeNow())
+			},
+		},
+	}
+}
+
+func (s *Service) cmdStatus(now time.Time) (interface{}, error) {
+	if len(s.Checks) == 0 {
+		return nil, fmt.Errorf("There are no checks")
+	}
+	checksMutex.Lock()
+	states, err := s.loadStates()
+	checksMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range s.Checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"Checks:"}
+	for _, name := range names {
+		check := s.Checks[name]
+		every := "expected every " + formatDuration(check.period())
+		state := states[name]
+		switch {
+		case state == nil || state.LastPingTimestampSecs == 0 && !state.Down:
+			lines = append(lines, fmt.Sprintf("⏳ %s – waiting for its first ping, %s", name, every))
+		case state.LastPingTimestampSecs == 0:
+			lines = append(lines, fmt.Sprintf("🚨 %s – down, never pinged, %s", name, every))
+		case state.Down:
+			lines = append(lines, fmt.Sprintf("🚨 %s – down, last ping %s ago, %s", name,
+				formatDuration(now.Sub(state.lastPing())), every))
+		default:
+			lines = append(lines, fmt.Sprintf("✅ %s – up, last ping %s ago, %s", name,
+				formatDuration(now.Sub(state.lastPing())), every))
+		}
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    strings.Join(lines, "\n"),
+	}, nil
+}
+
+// formatDuration returns the duration to the minute, e.g. "1d2h" or "45m", or in seconds if it
+// is shorter than a minute.
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	d = d.Round(time.Minute)
+	var parts []string
+	if days := d / (24 * time.Hour); days > 0 {
+		parts = append(parts, fmt.Sprintf("%dd", days))
+	}
+	if h := (d % (24 * time.Hour)) / time.Hour; h > 0 {
+		parts = append(parts, fmt.Sprintf("%dh", h))
+	}
+	if m := (d % time.Hour) / time.Minute; m > 0 {
+		parts = append(parts, fmt.Sprintf("%dm", m))
+	}
+	return strings.Join(parts, "")
+}
+
+func (s *Service) loadStates() (map[string]*checkState, error) {
+	states := make(map[string]*checkState)
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "checks")
+	if err == sql.ErrNoRows {
+		return states, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func (s *Service) storeStates(states map[string]*checkState) error {
+	stateJSON, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "checks", stateJSON)
+}
+
+// Register makes sure that the checks are configured properly, and joins their rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	for name, check := range s.Checks {
+		if name == "" || url.QueryEscape(name) != name {
+			return fmt.Errorf("Bad check name '%s': use letters, numbers, '-', '_' and '.'", name)
+		}
+		if check.RoomID == "" {
+			return fmt.Errorf("Check %s needs a room_id", name)
+		}
+		if d, err := time.ParseDuration(check.Period); err != nil || d < time.Minute {
+			return fmt.Errorf("Check %s: bad period '%s': use e.g. 24h or 15m", name, check.Period)
+		}
+		if check.Grace != "" {
+			if d, err := time.ParseDuration(check.Grace); err != nil || d < 0 {
+				return fmt.Errorf("Check %s: bad grace '%s': use e.g. 1h or 30m", name, check.Grace)
+			}
+		}
+	}
+	s.WebhookURL = s.webhookEndpointURL
+	for name, check := range s.Checks {
+		if _, err := client.JoinRoom(check.RoomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"check":      name,
+				"room_id":    check.RoomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
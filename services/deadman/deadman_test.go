@@ -0,0 +1,127 @@
+package deadman
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestDeadman(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$alert:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"checks": {
+			"backup": {"room_id": "!ops:hyrule", "period": "24h", "key": "s3cr3t"},
+			"report": {"room_id": "!ops:hyrule", "period": "1h", "grace": "0s"}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create deadman service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register deadman service: ", err)
+	}
+	s := srv.(*Service)
+
+	start := time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC)
+	ping := func(after time.Duration, query, body string) int {
+		timeNow = func() time.Time { return start.Add(after) }
+		req, _ := http.NewRequest("POST", "https://neb.example.com/services/hooks/aWQ?"+query, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, matrixCli)
+		return w.Code
+	}
+
+	if next := s.checkDue(matrixCli, start); !next.Equal(start.Add(time.Hour)) {
+		t.Errorf("Bad first deadline: %s", next)
+	}
+	for query, want := range map[string]int{
+		"check=backup&key=s3cr3t": 200,
+		"check=backup&key=guess":  403,
+		"check=backup":            403,
+		"check=nothing":           404,
+	} {
+		if code := ping(2*time.Hour, query, ""); code != want {
+			t.Errorf("Ping %s: got %d, want %d", query, code, want)
+		}
+	}
+
+	if next := s.checkDue(matrixCli, start.Add(90*time.Minute)); !next.Equal(start.Add(27 * time.Hour)) {
+		t.Errorf("Bad deadline after report went down: %s", next)
+	}
+	s.checkDue(matrixCli, start.Add(100*time.Minute))
+	ping(2*time.Hour, "check=report", "")
+	ping(3*time.Hour, "check=backup&key=s3cr3t&status=fail", "rsync: disk full\n")
+
+	timeNow = func() time.Time { return start.Add(4 * time.Hour) }
+	res, err := s.cmdStatus(timeNow())
+	if err != nil {
+		t.Fatal("Failed to get status: ", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "Checks:\n"+
+		"🚨 backup – down, last ping 1h ago, expected every 1d\n"+
+		"✅ report – up, last ping 2h ago, expected every 1h" {
+		t.Errorf("Bad status: %s", got)
+	}
+	s.checkDue(matrixCli, start.Add(30*time.Hour))
+
+	want := []string{
+		"🚨 report is down: it hasn't pinged since it was added 1h30m ago (expected every 1h, with 0s grace)",
+		"✅ report is back up",
+		"🚨 backup reported a failure:\nrsync: disk full",
+		"🚨 report is down: its last ping was 1d4h ago (expected every 1h, with 0s grace)",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad alerts: got %q, want %q", sent, want)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"checks": {"backup": {"period": "24h"}}}`,
+		`{"checks": {"backup": {"room_id": "!ops:hyrule", "period": "daily"}}}`,
+		`{"checks": {"backup": {"room_id": "!ops:hyrule", "period": "10s"}}}`,
+		`{"checks": {"backup": {"room_id": "!ops:hyrule", "period": "24h", "grace": "-1h"}}}`,
+		`{"checks": {"nightly backup": {"room_id": "!ops:hyrule", "period": "24h"}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create deadman service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
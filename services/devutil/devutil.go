@@ -0,0 +1,287 @@
+// Package devutil implements a Service with small utilities for developers, like hashing and decoding.
+package devutil
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Devutil service
+const ServiceType = "devutil"
+
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Unix timestamps larger than this are taken to be in milliseconds: it is in the year 33658 in
+// seconds, but 2001 in milliseconds.
+const maxUnixSeconds = 1e12
+
+// Service contains the Config fields for the Devutil service.
+//
+// This service has small utilities which developers often want in chat. It has no configuration.
+//
+// Commands:
+//    !hash md5|sha1|sha256|sha512 text
+// Responds with the hex digest of the text.
+//    !base64 encode text
+//    !base64 decode text
+// Responds with the text encoded or decoded. Decoding accepts the URL-safe alphabet and missing padding.
+//    !uuid
+// Responds with a random (version 4) UUID.
+//    !jwt decode token
+// Responds with the header and claims of the JSON Web Token. The signature is not checked.
+//    !timestamp [unix time or ISO 8601 time]
+// Converts between Unix and ISO 8601 times. Defaults to now.
+//
+// The text of commands is used exactly as it was sent, including quotes and spaces.
+//
+// Example JSON request:
+//   {}
+type Service struct {
+	types.DefaultService
+}
+
+// Commands supported:
+//    !hash algorithm text
+//    !base64 encode|decode text
+//    !uuid
+//    !jwt decode token
+//    !timestamp [time]
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"hash"},
+			Arguments: []string{"md5|sha1|sha256|sha512", "text"},
+			Help:      "Hash some text",
+			EventCommand: func(evt *mevt.Event, args []string) (interface{}, error) {
+				if len(args) < 1 {
+					return nil, fmt.Errorf("Usage: !hash md5|sha1|sha256|sha512 text")
+				}
+				return cmdHash(strings.ToLower(args[0]), rawText(evt, 2))
+			},
+		},
+		{
+			Path:      []string{"base64", "encode"},
+			Arguments: []string{"text"},
+			Help:      "Base64 encode some text",
+			EventCommand: func(evt *mevt.Event, args []string) (interface{}, error) {
+				return codeMessage(base64.StdEncoding.EncodeToString([]byte(rawText(evt, 2)))), nil
+			},
+		},
+		{
+			Path:      []string{"base64", "decode"},
+			Arguments: []string{"text"},
+			Help:      "Decode some base64",
+			EventCommand: func(evt *mevt.Event, args []string) (interface{}, error) {
+				return cmdBase64Decode(rawText(evt, 2))
+			},
+		},
+		{
+			Path: []string{"uuid"},
+			Help: "Generate a random UUID",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				u, err := newUUID()
+				if err != nil {
+					return nil, err
+				}
+				return codeMessage(u), nil
+			},
+		},
+		{
+			Path:      []string{"jwt", "decode"},
+			Arguments: []string{"token"},
+			Help:      "Show the header and claims of a JSON Web Token",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				if len(args) != 1 {
+					return nil, fmt.Errorf("Usage: !jwt decode token")
+				}
+				return cmdJWTDecode(args[0])
+			},
+		},
+		{
+			Path:      []string{"timestamp"},
+			Arguments: []string{"[unix|iso]"},
+			Help:      "Convert between Unix and ISO 8601 times",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return cmdTimestamp(strings.Join(args, " "), time.Now())
+			},
+		},
+	}
+}
+
+// rawText returns the body of the command message after the first n words, so that text is used
+// as it was sent rather than split into arguments.
+func rawText(evt *mevt.Event, n int) string {
+	body, _ := evt.Content.Raw["body"].(string)
+	body = strings.TrimLeftFunc(body, unicode.IsSpace)
+	for i := 0; i < n; i++ {
+		end := strings.IndexFunc(body, unicode.IsSpace)
+		if end == -1 {
+			return ""
+		}
+		body = strings.TrimLeftFunc(body[end:], unicode.IsSpace)
+	}
+	return body
+}
+
+// codeMessage returns a notice with the text formatted as code.
+func codeMessage(text string) *mevt.MessageEventContent {
+	if strings.Contains(text, "\n") {
+		return &mevt.MessageEventContent{
+			MsgType:       mevt.MsgNotice,
+			Body:          "```\n" + text + "\n```",
+			Format:        mevt.FormatHTML,
+			FormattedBody: "<pre><code>" + html.EscapeString(text) + "</code></pre>",
+		}
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          text,
+		Format:        mevt.FormatHTML,
+		FormattedBody: "<code>" + html.EscapeString(text) + "</code>",
+	}
+}
+
+func cmdHash(algorithm, text string) (interface{}, error) {
+	newHash, ok := hashes[algorithm]
+	if !ok {
+		var names []string
+		for name := range hashes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown hash '%s': must be one of %s", algorithm, strings.Join(names, ", "))
+	}
+	h := newHash()
+	h.Write([]byte(text))
+	return codeMessage(hex.EncodeToString(h.Sum(nil))), nil
+}
+
+func cmdBase64Decode(text string) (interface{}, error) {
+	decoded, err := decodeBase64(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid base64: %s", err)
+	}
+	return codeMessage(string(decoded)), nil
+}
+
+// decodeBase64 decodes standard or URL-safe base64, with or without padding.
+func decodeBase64(text string) ([]byte, error) {
+	text = strings.TrimRight(strings.TrimSpace(text), "=")
+	if strings.ContainsAny(text, "-_") {
+		return base64.RawURLEncoding.DecodeString(text)
+	}
+	return base64.RawStdEncoding.DecodeString(text)
+}
+
+// newUUID returns a random version 4 UUID, as defined by RFC 4122.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+func cmdJWTDecode(token string) (interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("A JWT has three parts separated by dots, this has %d", len(parts))
+	}
+	var out bytes.Buffer
+	for i, name := range []string{"Header", "Claims"} {
+		decoded, err := decodeBase64(parts[i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", strings.ToLower(name), err)
+		}
+		var pretty bytes.Buffer
+		if err = json.Indent(&pretty, decoded, "", "  "); err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", strings.ToLower(name), err)
+		}
+		fmt.Fprintf(&out, "%s:\n%s\n", name, pretty.String())
+	}
+
+	// Spell out the registered time claims, which are hard to read
+	claims, _ := decodeBase64(parts[1])
+	var times map[string]interface{}
+	if json.Unmarshal(claims, &times) == nil {
+		for _, claim := range []string{"iat", "nbf", "exp"} {
+			if secs, ok := times[claim].(float64); ok {
+				fmt.Fprintf(&out, "%s: %s\n", claim, time.Unix(int64(secs), 0).UTC().Format(time.RFC3339))
+			}
+		}
+	}
+	out.WriteString("The signature has not been verified.")
+	return codeMessage(out.String()), nil
+}
+
+// The layouts !timestamp accepts, besides Unix times
+var isoLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+func cmdTimestamp(arg string, now time.Time) (interface{}, error) {
+	arg = strings.TrimSpace(arg)
+	var t time.Time
+	if arg == "" {
+		t = now
+	} else if n, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		if n > maxUnixSeconds || n < -maxUnixSeconds {
+			t = time.Unix(0, n*int64(time.Millisecond))
+		} else {
+			t = time.Unix(n, 0)
+		}
+	} else {
+		parsed := false
+		for _, layout := range isoLayouts {
+			// Times without a timezone are in UTC
+			if t, err = time.Parse(layout, arg); err == nil {
+				parsed = true
+				break
+			}
+		}
+		if !parsed {
+			return nil, fmt.Errorf("'%s' is not a Unix or ISO 8601 time", arg)
+		}
+	}
+	return codeMessage(fmt.Sprintf(
+		"%s\nUnix: %d\nUnix (ms): %d", t.UTC().Format(time.RFC3339Nano), t.Unix(), t.UnixNano()/int64(time.Millisecond),
+	)), nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
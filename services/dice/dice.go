@@ -0,0 +1,344 @@
+// Package dice implements a Service which rolls dice, flips coins and picks at random, e.g. for
+// tabletop games.
+package dice
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Dice service
+const ServiceType = "dice"
+
+// Limits on rolls, so that they can't flood the room or keep the bot busy
+const (
+	defaultMaxDice = 100
+	maxSides       = 1000
+	maxTerms       = 20
+)
+
+// The characters dice expressions are made of, so that "!roll 2d6 + 3 to hit" can tell the
+// expression from the label
+var expressionRegex = regexp.MustCompile(`^[0-9dDkKhHlL%+-]+$`)
+
+// Rolls dice. Overridden by tests.
+var randIntn = rand.Intn
+
+// Service contains the Config fields for the Dice service.
+//
+// Dice are rolled with expressions like "3d6+2", "d20-1", "d%" or "4d6kh3", which keeps the
+// highest 3 of the 4 dice ("kl" keeps the lowest). Each room can roll up to max_dice dice at a
+// time, and tabletop rooms which need more can be given a higher limit.
+//
+// "!pick" also picks one of the options given, like the Picker service's "!pick". Bots with both
+// services will answer twice.
+//
+// Example JSON request:
+//   {
+//       "max_dice": 100,
+//       "rooms": {
+//           "!tabletop:localhost": {
+//               "max_dice": 500
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. How many dice can be rolled at once. Defaults to 100.
+	MaxDice int `json:"max_dice"`
+	// Optional. Limits for particular rooms, which override the limits above.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is the limits of a room.
+type RoomConfig struct {
+	// Optional. How many dice can be rolled at once in the room.
+	MaxDice int `json:"max_dice"`
+}
+
+// maxDice returns how many dice can be rolled at once in the room.
+func (s *Service) maxDice(roomID id.RoomID) int {
+	if room, ok := s.Rooms[roomID]; ok && room.MaxDice > 0 {
+		return room.MaxDice
+	}
+	if s.MaxDice > 0 {
+		return s.MaxDice
+	}
+	return defaultMaxDice
+}
+
+// term is a part of a dice expression: either some dice or a constant.
+type term struct {
+	negative bool
+	// The number of dice, or 0 for a constant
+	count int
+	sides int
+	// How many of the highest dice to keep, or of the lowest if negative, or 0 to keep them all
+	keep     int
+	constant int
+}
+
+// parseExpression parses a dice expression like "3d6+2".
+func parseExpression(expr string) ([]term, error) {
+	expr = strings.ToLower(expr)
+	var terms []term
+	i := 0
+	// number reads the digits at i, returning -1 if there aren't any
+	number := func() (int, error) {
+		start := i
+		for i < len(expr) && expr[i] >= '0' && expr[i] <= '9' {
+			i++
+		}
+		if start == i {
+			return -1, nil
+		}
+		return strconv.Atoi(expr[start:i])
+	}
+	for {
+		var t term
+		if i < len(expr) && (expr[i] == '+' || expr[i] == '-') {
+			t.negative = expr[i] == '-'
+			i++
+		} else if len(terms) > 0 {
+			return nil, fmt.Errorf("Expected + or - at '%s'", expr[i:])
+		}
+		n, err := number()
+		if err != nil {
+			return nil, fmt.Errorf("%s is too big", expr)
+		}
+		if i < len(expr) && expr[i] == 'd' {
+			i++
+			t.count = 1
+			if n >= 0 {
+				t.count = n
+			}
+			if i < len(expr) && expr[i] == '%' {
+				t.sides = 100
+				i++
+			} else if t.sides, err = number(); err != nil || t.sides < 0 {
+				return nil, fmt.Errorf("Dice need a number of sides, like d6")
+			}
+			if t.count < 1 || t.sides < 2 || t.sides > maxSides {
+				return nil, fmt.Errorf("Dice must have 2 to %d sides, and there must be at least one", maxSides)
+			}
+			if i < len(expr) && expr[i] == 'k' {
+				i++
+				lowest := i < len(expr) && expr[i] == 'l'
+				if i < len(expr) && (expr[i] == 'h' || expr[i] == 'l') {
+					i++
+				}
+				if t.keep, err = number(); err != nil || t.keep < 1 || t.keep > t.count {
+					return nil, fmt.Errorf("Can only keep 1 to %d of %dd%d", t.count, t.count, t.sides)
+				}
+				if lowest {
+					t.keep = -t.keep
+				}
+			}
+		} else if n >= 0 {
+			t.constant = n
+		} else if i == len(expr) {
+			return nil, fmt.Errorf("%s is missing a number or dice at the end", expr)
+		} else {
+			return nil, fmt.Errorf("Expected a number or dice at '%s'", expr[i:])
+		}
+		terms = append(terms, t)
+		if len(terms) > maxTerms {
+			return nil, fmt.Errorf("Expressions can have up to %d parts", maxTerms)
+		}
+		if i == len(expr) {
+			return terms, nil
+		}
+	}
+}
+
+// roll rolls the dice of the terms, returning the total and how each term was worked out.
+func roll(terms []term) (int, string) {
+	total := 0
+	var working strings.Builder
+	for i, t := range terms {
+		if t.negative {
+			working.WriteString(" - ")
+		} else if i > 0 {
+			working.WriteString(" + ")
+		}
+		value := t.constant
+		if t.count == 0 {
+			working.WriteString(strconv.Itoa(t.constant))
+		} else {
+			rolls := make([]int, t.count)
+			for j := range rolls {
+				rolls[j] = randIntn(t.sides) + 1
+			}
+			kept, dropped := keep(rolls, t.keep)
+			value = 0
+			for _, r := range kept {
+				value += r
+			}
+			working.WriteString(formatRolls(kept))
+			if len(dropped) > 0 {
+				working.WriteString(" (dropped " + strings.Trim(formatRolls(dropped), "[]") + ")")
+			}
+		}
+		if t.negative {
+			value = -value
+		}
+		total += value
+	}
+	return total, working.String()
+}
+
+// keep splits the rolls into the ones kept and the ones dropped: the highest n if n is positive,
+// the lowest -n if it is negative, or all of them if it is 0. The rolls keep their order.
+func keep(rolls []int, n int) (kept, dropped []int) {
+	if n == 0 {
+		return rolls, nil
+	}
+	order := make([]int, len(rolls))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		if n > 0 {
+			return rolls[order[a]] > rolls[order[b]]
+		}
+		return rolls[order[a]] < rolls[order[b]]
+	})
+	if n < 0 {
+		n = -n
+	}
+	keepIndex := make(map[int]bool)
+	for _, i := range order[:n] {
+		keepIndex[i] = true
+	}
+	for i, r := range rolls {
+		if keepIndex[i] {
+			kept = append(kept, r)
+		} else {
+			dropped = append(dropped, r)
+		}
+	}
+	return kept, dropped
+}
+
+func formatRolls(rolls []int) string {
+	texts := make([]string, len(rolls))
+	for i, r := range rolls {
+		texts[i] = strconv.Itoa(r)
+	}
+	return "[" + strings.Join(texts, ", ") + "]"
+}
+
+// Commands supported:
+//    !roll 3d6+2 [label]
+// Responds with the dice rolled and their total.
+//    !flip
+// Responds with heads or tails.
+//    !pick option1 | option2 | ...
+// Responds with one of the options, which can also be separated by commas.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"roll"},
+			Arguments: []string{"3d6+2", "[label]"},
+			Help:      "Roll some dice",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdRoll(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"flip"},
+			Help: "Flip a coin",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdFlip(userID)
+			},
+		},
+		{
+			Path:      []string{"pick"},
+			Arguments: []string{"option1 | option2 | ..."},
+			Help:      "Pick one of the options",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdPick(args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdRoll(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	// The expression can be split by spaces, e.g. "2d6 + 3"
+	n := 0
+	for n < len(args) && expressionRegex.MatchString(args[n]) {
+		n++
+	}
+	expr := strings.Join(args[:n], "")
+	label := strings.Join(args[n:], " ")
+	if expr == "" {
+		return nil, fmt.Errorf("Usage: !roll 3d6+2 [label]")
+	}
+	terms, err := parseExpression(expr)
+	if err != nil {
+		return nil, err
+	}
+	dice := 0
+	for _, t := range terms {
+		dice += t.count
+	}
+	if max := s.maxDice(roomID); dice > max {
+		return nil, fmt.Errorf("Only %d dice can be rolled at once here", max)
+	}
+
+	total, working := roll(terms)
+	rolled := strings.ToLower(expr)
+	if label != "" {
+		rolled += " (" + label + ")"
+	}
+	return notice(fmt.Sprintf("🎲 %s rolled %s: %s = %d", userID, rolled, working, total)), nil
+}
+
+func (s *Service) cmdFlip(userID id.UserID) (interface{}, error) {
+	side := "heads"
+	if randIntn(2) == 1 {
+		side = "tails"
+	}
+	return notice(fmt.Sprintf("🪙 %s flipped %s", userID, side)), nil
+}
+
+func (s *Service) cmdPick(args []string) (interface{}, error) {
+	text := strings.Join(args, " ")
+	sep := "|"
+	if !strings.Contains(text, sep) {
+		sep = ","
+	}
+	var options []string
+	for _, option := range strings.Split(text, sep) {
+		if option = strings.TrimSpace(option); option != "" {
+			options = append(options, option)
+		}
+	}
+	if len(options) < 2 {
+		return nil, fmt.Errorf("Usage: !pick option1 | option2 | ...")
+	}
+	return notice("🎯 " + options[randIntn(len(options))]), nil
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package dice
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestRoll(t *testing.T) {
+	var rolls []int
+	randIntn = func(n int) int {
+		roll := rolls[0]
+		rolls = rolls[1:]
+		if roll >= n {
+			t.Fatalf("Roll %d is out of range for %d", roll, n)
+		}
+		return roll
+	}
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"max_dice": 10,
+		"rooms": {"!tabletop:hyrule": {"max_dice": 50}}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create dice service: ", err)
+	}
+	s := srv.(*Service)
+
+	testCases := []struct {
+		args  string
+		rolls []int
+		want  string
+	}{
+		{"3d6+2", []int{3, 1, 5}, "🎲 @alice:hyrule rolled 3d6+2: [4, 2, 6] + 2 = 14"},
+		{"d20 - 1 to hit", []int{19}, "🎲 @alice:hyrule rolled d20-1 (to hit): [20] - 1 = 19"},
+		{"4d6kh3", []int{2, 0, 5, 3}, "🎲 @alice:hyrule rolled 4d6kh3: [3, 6, 4] (dropped 1) = 13"},
+		{"2d20kl1", []int{14, 7}, "🎲 @alice:hyrule rolled 2d20kl1: [8] (dropped 15) = 8"},
+		{"d%+1d4", []int{41, 2}, "🎲 @alice:hyrule rolled d%+1d4: [42] + [3] = 45"},
+		{"5", nil, "🎲 @alice:hyrule rolled 5: 5 = 5"},
+	}
+	for _, tc := range testCases {
+		rolls = tc.rolls
+		res, err := s.cmdRoll("!room:hyrule", "@alice:hyrule", strings.Fields(tc.args))
+		if err != nil {
+			t.Errorf("!roll %s: %s", tc.args, err)
+			continue
+		}
+		if got := res.(*mevt.MessageEventContent).Body; got != tc.want {
+			t.Errorf("!roll %s: got %q want %q", tc.args, got, tc.want)
+		}
+	}
+
+	for _, args := range []string{"", "2d", "d1", "3d6+", "3d6d4", "2d6k3", "d6x", "11d6", "d1001", "99999999999999999999"} {
+		if _, err := s.cmdRoll("!room:hyrule", "@alice:hyrule", strings.Fields(args)); err == nil {
+			t.Errorf("Expected !roll %s to be refused", args)
+		}
+	}
+	// Rooms can have a higher limit
+	rolls = make([]int, 11)
+	if _, err := s.cmdRoll("!tabletop:hyrule", "@alice:hyrule", []string{"11d6"}); err != nil {
+		t.Errorf("Failed to roll more dice in a room with a higher limit: %s", err)
+	}
+}
+
+func TestFlipAndPick(t *testing.T) {
+	var rolls []int
+	randIntn = func(n int) int {
+		roll := rolls[0]
+		rolls = rolls[1:]
+		return roll
+	}
+	s := &Service{}
+
+	rolls = []int{1}
+	if res, _ := s.cmdFlip("@alice:hyrule"); res.(*mevt.MessageEventContent).Body != "🪙 @alice:hyrule flipped tails" {
+		t.Errorf("Bad flip: %+v", res)
+	}
+	rolls = []int{1}
+	if res, _ := s.cmdPick(strings.Fields("pizza, with pineapple | pasta")); res.(*mevt.MessageEventContent).Body != "🎯 pasta" {
+		t.Errorf("Bad pick: %+v", res)
+	}
+	rolls = []int{2}
+	if res, _ := s.cmdPick(strings.Fields("red, green, blue")); res.(*mevt.MessageEventContent).Body != "🎯 blue" {
+		t.Errorf("Bad pick with commas: %+v", res)
+	}
+	if _, err := s.cmdPick([]string{"alone"}); err == nil {
+		t.Errorf("Expected a pick of one option to be refused")
+	}
+}
@@ -0,0 +1,543 @@
+// Package driftwatch implements a Service which alerts a room when the SSH host keys or DNS
+// records of hosts change.
+package driftwatch
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Driftwatch service
+const ServiceType = "driftwatch"
+
+const (
+	defaultPollInterval = time.Hour
+	minPollIntervalMins = 5
+	defaultSSHPort      = 22
+	lookupTimeout       = 10 * time.Second
+)
+
+// The kind of observation which holds the SSH host key, alongside the DNS record types
+const kindSSH = "SSH"
+
+// The DNS record types which can be watched
+var recordTypes = []string{"A", "AAAA", "CNAME", "MX", "NS", "TXT"}
+
+// fetchSSH and lookupDNS are replaced in tests.
+var (
+	fetchSSH  = fetchHostKey
+	lookupDNS = lookupRecords
+)
+
+// OnPoll and the accept command both update the recorded values, so the hosts are only loaded and
+// stored while holding this.
+var hostsMutex sync.Mutex
+
+// Service contains the Config fields for the Driftwatch service.
+//
+// The service looks up the SSH host key and the DNS records of each host when it starts, and
+// records them. It looks them up again every poll interval, and tells the room when they differ
+// from what it recorded, which can be a sign that the host was hijacked or someone is in the
+// middle. The room is only told once about each new value, and is told if the recorded value
+// comes back.
+//
+// Expected changes, like moving a host to a new server, are accepted with:
+//    !driftwatch accept git.example.com
+// which records the values which were last looked up. Lookups which fail, like when a host is
+// down, are logged and skipped rather than counted as a change, but a DNS name which stops
+// existing is a change.
+//
+// Example JSON request:
+//   {
+//       "room_id": "!ops:localhost",
+//       "poll_interval_mins": 60,
+//       "hosts": {
+//           "git.example.com": {
+//               "ssh": true,
+//               "dns": ["A", "AAAA"]
+//           },
+//           "example.com": {
+//               "dns": ["A", "MX", "NS"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// The room to alert about changes.
+	RoomID id.RoomID `json:"room_id"`
+	// Optional. How often to look the hosts up, in minutes. Defaults to 60, and can't be less than 5.
+	PollIntervalMins int `json:"poll_interval_mins"`
+	// The hosts to watch, keyed by hostname.
+	Hosts map[string]Host `json:"hosts"`
+}
+
+// Host is what is watched on a host. At least one of SSH and DNS must be set.
+type Host struct {
+	// Optional. Watch the host's SSH host key.
+	SSH bool `json:"ssh"`
+	// Optional. The port SSH listens on. Defaults to 22.
+	SSHPort int `json:"ssh_port"`
+	// Optional. The DNS record types to watch: "A", "AAAA", "CNAME", "MX", "NS" or "TXT".
+	DNS []string `json:"dns"`
+}
+
+// hostState is what was looked up for a host, keyed by the kind of observation: "SSH" or a DNS
+// record type. The states of all the hosts are stored in the service state under "hosts".
+type hostState struct {
+	// The values which are expected: the first ones looked up, or the ones last accepted
+	Recorded map[string][]string `json:"recorded"`
+	// The values from the last lookup which succeeded
+	Current map[string][]string `json:"current"`
+	// When the host was last looked up
+	CheckedTimestampSecs int64 `json:"checked_timestamp_secs"`
+}
+
+// drifted returns the kinds of observation whose current values aren't the recorded ones.
+func (h *hostState) drifted() []string {
+	var kinds []string
+	for kind, values := range h.Current {
+		if recorded, ok := h.Recorded[kind]; ok && !equal(recorded, values) {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func (s *Service) pollInterval() time.Duration {
+	if s.PollIntervalMins <= 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(s.PollIntervalMins) * time.Minute
+}
+
+// OnPoll looks up every host and alerts the room about the changes.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	s.checkHosts(cli, s.lookupAll(), time.Now())
+	return time.Now().Add(s.pollInterval())
+}
+
+// lookupAll looks up what is watched on every host, keyed by hostname then kind. Kinds which
+// couldn't be looked up are left out.
+func (s *Service) lookupAll() map[string]map[string][]string {
+	observed := make(map[string]map[string][]string)
+	for name, host := range s.Hosts {
+		logger := log.WithFields(log.Fields{
+			"service_id": s.ServiceID(),
+			"host":       name,
+		})
+		values := make(map[string][]string)
+		if host.SSH {
+			port := host.SSHPort
+			if port == 0 {
+				port = defaultSSHPort
+			}
+			key, err := fetchSSH(net.JoinHostPort(name, strconv.Itoa(port)), lookupTimeout)
+			if err != nil {
+				logger.WithError(err).Warn("Failed to fetch SSH host key")
+			} else {
+				values[kindSSH] = []string{key}
+			}
+		}
+		for _, recordType := range host.DNS {
+			records, err := lookupDNS(name, strings.ToUpper(recordType))
+			if err != nil {
+				logger.WithError(err).WithField("record_type", recordType).Warn("Failed to look up DNS records")
+				continue
+			}
+			sort.Strings(records)
+			values[strings.ToUpper(recordType)] = records
+		}
+		observed[name] = values
+	}
+	return observed
+}
+
+// checkHosts compares what was observed with what was recorded, stores it, and alerts the room
+// about values which are new since the last lookup.
+func (s *Service) checkHosts(cli types.MatrixClient, observed map[string]map[string][]string, now time.Time) {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+	states, err := s.loadStates()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load hosts")
+		return
+	}
+
+	type change struct {
+		host, kind     string
+		from, to       []string
+		backToRecorded bool
+	}
+	var changes []change
+	for name, values := range observed {
+		state := states[name]
+		if state == nil {
+			state = &hostState{
+				Recorded: make(map[string][]string),
+				Current:  make(map[string][]string),
+			}
+			states[name] = state
+		}
+		state.CheckedTimestampSecs = now.Unix()
+		for kind, value := range values {
+			last, seen := state.Current[kind]
+			state.Current[kind] = value
+			recorded, ok := state.Recorded[kind]
+			if !ok {
+				// Newly watched, so there is nothing to compare against yet
+				state.Recorded[kind] = value
+				continue
+			}
+			if seen && equal(last, value) {
+				continue
+			}
+			if equal(recorded, value) {
+				if seen {
+					changes = append(changes, change{name, kind, last, value, true})
+				}
+				continue
+			}
+			changes = append(changes, change{name, kind, recorded, value, false})
+		}
+	}
+	// Store first, so that the room can't be alerted twice if storing fails
+	if err = s.storeStates(states); err != nil {
+		logger.WithError(err).Error("Failed to store hosts")
+		return
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].host != changes[j].host {
+			return changes[i].host < changes[j].host
+		}
+		return changes[i].kind < changes[j].kind
+	})
+	for _, c := range changes {
+		if c.backToRecorded {
+			s.alert(cli, c.host, fmt.Sprintf("✅ %s %s changed back to the recorded value: %s",
+				c.host, describeKind(c.kind), formatValues(c.to)), notify.SeverityInfo)
+			continue
+		}
+		s.alert(cli, c.host, fmt.Sprintf("🚨 %s %s changed\nRecorded: %s\nNow: %s\nIf this was expected, use !driftwatch accept %s",
+			c.host, describeKind(c.kind), formatValues(c.from), formatValues(c.to), c.host), notify.SeverityCritical)
+	}
+}
+
+func (s *Service) alert(cli types.MatrixClient, host, text string, severity notify.Severity) {
+	_, err := notify.Send(cli, s, notify.Notification{
+		RoomID: s.RoomID,
+		Content: mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    text,
+		},
+		Severity:       severity,
+		CorrelationKey: "driftwatch " + host,
+	})
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"host":    host,
+			"room_id": s.RoomID,
+		}).Error("Failed to send driftwatch alert")
+	}
+}
+
+// Commands supported:
+//    !driftwatch status
+// Responds with every host and whether anything on it differs from what was recorded.
+//
+//    !driftwatch accept hostname
+// Records the values which were last looked up for the host, so that they are expected from now
+// on. Only works in the service's room.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"driftwatch", "status"},
+			Help: "Show whether the watched hosts' SSH keys and DNS records have changed",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdStatus(time.Now())
+			},
+		},
+		{
+			Path:      []string{"driftwatch", "accept"},
+			Arguments: []string{"hostname"},
+			Help:      "Accept the changes to a host's SSH key and DNS records as expected",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdAccept(roomID, userID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdStatus(now time.Time) (interface{}, error) {
+	if len(s.Hosts) == 0 {
+		return nil, fmt.Errorf("There are no hosts")
+	}
+	hostsMutex.Lock()
+	states, err := s.loadStates()
+	hostsMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range s.Hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"Hosts:"}
+	for _, name := range names {
+		state := states[name]
+		if state == nil || state.CheckedTimestampSecs == 0 {
+			lines = append(lines, fmt.Sprintf("⏳ %s – not looked up yet", name))
+			continue
+		}
+		checked := formatDuration(now.Sub(time.Unix(state.CheckedTimestampSecs, 0)))
+		if drifted := state.drifted(); len(drifted) > 0 {
+			var described []string
+			for _, kind := range drifted {
+				described = append(described, describeKind(kind))
+			}
+			lines = append(lines, fmt.Sprintf("🚨 %s – %s changed, checked %s ago", name,
+				strings.Join(described, ", "), checked))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("✅ %s – unchanged, checked %s ago", name, checked))
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    strings.Join(lines, "\n"),
+	}, nil
+}
+
+func (s *Service) cmdAccept(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !driftwatch accept hostname")
+	}
+	if roomID != s.RoomID {
+		return nil, fmt.Errorf("Changes can only be accepted in %s", s.RoomID)
+	}
+	name := strings.ToLower(args[0])
+	if _, ok := s.Hosts[name]; !ok {
+		return nil, fmt.Errorf("%s isn't watched", name)
+	}
+
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+	states, err := s.loadStates()
+	if err != nil {
+		return nil, err
+	}
+	state := states[name]
+	if state == nil || len(state.drifted()) == 0 {
+		return nil, fmt.Errorf("Nothing on %s has changed", name)
+	}
+	drifted := state.drifted()
+	for _, kind := range drifted {
+		state.Recorded[kind] = state.Current[kind]
+	}
+	if err = s.storeStates(states); err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"host":       name,
+		"user_id":    userID,
+		"kinds":      drifted,
+	}).Info("Accepted driftwatch changes")
+
+	var described []string
+	for _, kind := range drifted {
+		described = append(described, describeKind(kind))
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Recorded the new %s of %s", strings.Join(described, ", "), name),
+	}, nil
+}
+
+// lookupRecords returns the records of the given type for the name. A name without such records
+// has none, rather than an error.
+func lookupRecords(name, recordType string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	var records []string
+	var err error
+	switch recordType {
+	case "A", "AAAA":
+		var addrs []net.IPAddr
+		addrs, err = net.DefaultResolver.LookupIPAddr(ctx, name)
+		for _, addr := range addrs {
+			if (addr.IP.To4() != nil) == (recordType == "A") {
+				records = append(records, addr.IP.String())
+			}
+		}
+	case "CNAME":
+		var cname string
+		cname, err = net.DefaultResolver.LookupCNAME(ctx, name)
+		if err == nil && !strings.EqualFold(strings.TrimSuffix(cname, "."), name) {
+			records = append(records, cname)
+		}
+	case "MX":
+		var mxs []*net.MX
+		mxs, err = net.DefaultResolver.LookupMX(ctx, name)
+		for _, mx := range mxs {
+			records = append(records, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	case "NS":
+		var nss []*net.NS
+		nss, err = net.DefaultResolver.LookupNS(ctx, name)
+		for _, ns := range nss {
+			records = append(records, ns.Host)
+		}
+	case "TXT":
+		records, err = net.DefaultResolver.LookupTXT(ctx, name)
+	default:
+		return nil, fmt.Errorf("Unsupported record type %s", recordType)
+	}
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	return records, err
+}
+
+func describeKind(kind string) string {
+	if kind == kindSSH {
+		return "SSH host key"
+	}
+	return kind + " records"
+}
+
+func formatValues(values []string) string {
+	if len(values) == 0 {
+		return "(none)"
+	}
+	return strings.Join(values, ", ")
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// formatDuration returns the duration to the minute, e.g. "1d2h" or "45m", or in seconds if it
+// is shorter than a minute.
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	d = d.Round(time.Minute)
+	var parts []string
+	if days := d / (24 * time.Hour); days > 0 {
+		parts = append(parts, fmt.Sprintf("%dd", days))
+	}
+	if h := (d % (24 * time.Hour)) / time.Hour; h > 0 {
+		parts = append(parts, fmt.Sprintf("%dh", h))
+	}
+	if m := (d % time.Hour) / time.Minute; m > 0 {
+		parts = append(parts, fmt.Sprintf("%dm", m))
+	}
+	return strings.Join(parts, "")
+}
+
+func (s *Service) loadStates() (map[string]*hostState, error) {
+	states := make(map[string]*hostState)
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "hosts")
+	if err == sql.ErrNoRows {
+		return states, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func (s *Service) storeStates(states map[string]*hostState) error {
+	stateJSON, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "hosts", stateJSON)
+}
+
+// Register makes sure that the hosts are configured properly, and joins the room.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.RoomID == "" {
+		return fmt.Errorf("A room_id is required")
+	}
+	if s.PollIntervalMins < 0 || (s.PollIntervalMins > 0 && s.PollIntervalMins < minPollIntervalMins) {
+		return fmt.Errorf("poll_interval_mins can't be less than %d", minPollIntervalMins)
+	}
+	if len(s.Hosts) == 0 {
+		return fmt.Errorf("At least one host is required")
+	}
+	for name, host := range s.Hosts {
+		if name == "" || name != strings.ToLower(name) || strings.ContainsAny(name, " /:@") {
+			return fmt.Errorf("Bad hostname '%s': use a lower case hostname, e.g. git.example.com", name)
+		}
+		if !host.SSH && len(host.DNS) == 0 {
+			return fmt.Errorf("Host %s needs ssh or dns to be set", name)
+		}
+		if host.SSHPort < 0 || host.SSHPort > 65535 {
+			return fmt.Errorf("Host %s: bad ssh_port %d", name, host.SSHPort)
+		}
+		for _, recordType := range host.DNS {
+			if !supportedRecordType(recordType) {
+				return fmt.Errorf("Host %s: unsupported record type '%s': use %s", name, recordType,
+					strings.Join(recordTypes, ", "))
+			}
+		}
+	}
+	if _, err := client.JoinRoom(s.RoomID.String(), "", nil); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    s.RoomID,
+		}).Error("Failed to join room")
+	}
+	return nil
+}
+
+func supportedRecordType(recordType string) bool {
+	for _, t := range recordTypes {
+		if strings.EqualFold(t, recordType) {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
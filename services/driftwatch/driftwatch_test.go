@@ -0,0 +1,213 @@
+package driftwatch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestDriftwatch(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$alert:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"room_id": "!ops:hyrule",
+		"hosts": {
+			"git.hyrule": {"ssh": true, "ssh_port": 2222, "dns": ["a"]},
+			"hyrule": {"dns": ["MX"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create driftwatch service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register driftwatch service: ", err)
+	}
+	s := srv.(*Service)
+
+	sshKey := "ssh-ed25519 SHA256:old"
+	aRecords := []string{"192.0.2.2", "192.0.2.1"}
+	var sshErr error
+	fetchSSH = func(addr string, timeout time.Duration) (string, error) {
+		if addr != "git.hyrule:2222" {
+			t.Errorf("Bad SSH address: %s", addr)
+		}
+		return sshKey, sshErr
+	}
+	lookupDNS = func(name, recordType string) ([]string, error) {
+		if name == "git.hyrule" && recordType == "A" {
+			return append([]string(nil), aRecords...), nil
+		}
+		if name == "hyrule" && recordType == "MX" {
+			return []string{"10 mx.hyrule."}, nil
+		}
+		return nil, fmt.Errorf("unexpected lookup of %s %s", recordType, name)
+	}
+
+	start := time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC)
+	poll := func(after time.Duration) {
+		s.checkHosts(matrixCli, s.lookupAll(), start.Add(after))
+	}
+	status := func(after time.Duration) string {
+		res, err := s.cmdStatus(start.Add(after))
+		if err != nil {
+			t.Fatal("Failed to get status: ", err)
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+
+	if got := status(0); got != "Hosts:\n⏳ git.hyrule – not looked up yet\n⏳ hyrule – not looked up yet" {
+		t.Errorf("Bad status before lookups: %s", got)
+	}
+	poll(0)
+	// The order of the records doesn't matter
+	aRecords = []string{"192.0.2.1", "192.0.2.2"}
+	poll(time.Hour)
+	if len(sent) != 0 {
+		t.Errorf("Alerted before anything changed: %q", sent)
+	}
+	if _, err = s.cmdAccept("!ops:hyrule", "@alice:hyrule", []string{"git.hyrule"}); err == nil {
+		t.Error("Accepted a host which hasn't changed")
+	}
+
+	sshKey = "ssh-ed25519 SHA256:new"
+	aRecords = []string{"203.0.113.9"}
+	poll(2 * time.Hour)
+	// The same change is only alerted once, and a failed lookup isn't a change
+	sshErr = fmt.Errorf("connection refused")
+	poll(3 * time.Hour)
+	if got := status(3*time.Hour + 30*time.Minute); got != "Hosts:\n"+
+		"🚨 git.hyrule – A records, SSH host key changed, checked 30m ago\n"+
+		"✅ hyrule – unchanged, checked 30m ago" {
+		t.Errorf("Bad status after changes: %s", got)
+	}
+
+	aRecords = []string{"192.0.2.1", "192.0.2.2"}
+	poll(4 * time.Hour)
+	if _, err = s.cmdAccept("!other:hyrule", "@alice:hyrule", []string{"git.hyrule"}); err == nil {
+		t.Error("Accepted changes in another room")
+	}
+	res, err := s.cmdAccept("!ops:hyrule", "@alice:hyrule", []string{"git.hyrule"})
+	if err != nil {
+		t.Fatal("Failed to accept changes: ", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "Recorded the new SSH host key of git.hyrule" {
+		t.Errorf("Bad accept response: %s", got)
+	}
+	sshErr = nil
+	poll(5 * time.Hour)
+	if got := status(5 * time.Hour); !strings.Contains(got, "✅ git.hyrule – unchanged") {
+		t.Errorf("Bad status after accepting: %s", got)
+	}
+
+	want := []string{
+		"🚨 git.hyrule A records changed\nRecorded: 192.0.2.1, 192.0.2.2\nNow: 203.0.113.9\nIf this was expected, use !driftwatch accept git.hyrule",
+		"🚨 git.hyrule SSH host key changed\nRecorded: ssh-ed25519 SHA256:old\nNow: ssh-ed25519 SHA256:new\nIf this was expected, use !driftwatch accept git.hyrule",
+		"✅ git.hyrule A records changed back to the recorded value: 192.0.2.1, 192.0.2.2",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad alerts: got %q, want %q", sent, want)
+	}
+}
+
+func TestFetchHostKey(t *testing.T) {
+	// The blob of a real key, whose fingerprint is from ssh-keygen -l
+	blob, _ := base64.StdEncoding.DecodeString("AAAAC3NzaC1lZDI1NTE5AAAAIL3c8Rub5vldmIag5AmTGbDYH/0IrSKlPNA/5HYgzVLj")
+	want := "ssh-ed25519 SHA256:aFsJJ+jb3ufWZ8qMxW/A3AAjpSz/80bU0YT55MWH1To"
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "SSH-2.0-") {
+			t.Errorf("Bad client version: %q", line)
+			return
+		}
+		conn.Write([]byte("Welcome to hyrule\r\nSSH-2.0-OpenSSH_9.6\r\n"))
+		writePacket(conn, append([]byte{msgKexInit}, make([]byte, 16+10*4+5)...))
+		for i := 0; i < 2; i++ {
+			payload, err := readPacket(r)
+			if err != nil {
+				t.Errorf("Failed to read client packet: %s", err)
+				return
+			}
+			if i == 1 && payload[0] != msgKexECDHInit {
+				t.Errorf("Bad client packet: %d", payload[0])
+			}
+		}
+		reply := appendString([]byte{msgKexECDHReply}, blob)
+		reply = appendString(reply, make([]byte, 32))
+		reply = appendString(reply, []byte("signature"))
+		writePacket(conn, reply)
+	}()
+
+	got, err := fetchHostKey(listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal("Failed to fetch host key: ", err)
+	}
+	if got != want {
+		t.Errorf("Bad host key: got %s, want %s", got, want)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"hosts": {"git.hyrule": {"ssh": true}}}`,
+		`{"room_id": "!ops:hyrule"}`,
+		`{"room_id": "!ops:hyrule", "poll_interval_mins": 1, "hosts": {"git.hyrule": {"ssh": true}}}`,
+		`{"room_id": "!ops:hyrule", "hosts": {"git.hyrule": {}}}`,
+		`{"room_id": "!ops:hyrule", "hosts": {"Git.Hyrule": {"ssh": true}}}`,
+		`{"room_id": "!ops:hyrule", "hosts": {"git.hyrule": {"ssh": true, "ssh_port": 70000}}}`,
+		`{"room_id": "!ops:hyrule", "hosts": {"git.hyrule": {"dns": ["SRV"]}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create driftwatch service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
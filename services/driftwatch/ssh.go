@@ -0,0 +1,190 @@
+package driftwatch
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// SSH message numbers, from RFC 4253 and RFC 5656
+const (
+	msgDisconnect   = 1
+	msgKexInit      = 20
+	msgKexECDHInit  = 30
+	msgKexECDHReply = 31
+)
+
+// The most bytes in a packet before the keys are exchanged, which is far more than a host key
+// needs.
+const maxPacketSize = 64 * 1024
+
+// The host key algorithms asked for, most preferred first. The server uses the first one which it
+// has a key for.
+var hostKeyAlgorithms = []string{
+	"ssh-ed25519",
+	"ecdsa-sha2-nistp256",
+	"ecdsa-sha2-nistp384",
+	"ecdsa-sha2-nistp521",
+	"rsa-sha2-512",
+	"rsa-sha2-256",
+	"ssh-rsa",
+}
+
+// fetchHostKey connects to an SSH server and returns the type and SHA256 fingerprint of its
+// host key, in the form shown by ssh-keygen -l, e.g. "ssh-ed25519 SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8".
+//
+// Only the start of the key exchange is done: the server sends its host key in reply to the
+// client's ephemeral key, which is all that is needed. The curve25519 exchange is used because
+// any 32 bytes are a valid public key for it, so the client's key can be random. The server's
+// signature isn't checked, since the connection is closed straight after.
+func fetchHostKey(addr string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return "", err
+	}
+	return readHostKey(conn)
+}
+
+func readHostKey(conn io.ReadWriter) (string, error) {
+	if _, err := io.WriteString(conn, "SSH-2.0-GoNEB_driftwatch\r\n"); err != nil {
+		return "", err
+	}
+	r := bufio.NewReader(conn)
+	// Servers can send other lines before their version
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("Failed to read the SSH version: %s", err)
+		}
+		if strings.HasPrefix(line, "SSH-") {
+			if !strings.HasPrefix(line, "SSH-2.0-") && !strings.HasPrefix(line, "SSH-1.99-") {
+				return "", fmt.Errorf("Unsupported SSH version %s", strings.TrimSpace(line))
+			}
+			break
+		}
+	}
+
+	var cookie [16]byte
+	if _, err := rand.Read(cookie[:]); err != nil {
+		return "", err
+	}
+	kexInit := []byte{msgKexInit}
+	kexInit = append(kexInit, cookie[:]...)
+	for _, list := range [][]string{
+		{"curve25519-sha256", "curve25519-sha256@libssh.org"},
+		hostKeyAlgorithms,
+		{"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes256-ctr"},
+		{"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes256-ctr"},
+		{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1"},
+		{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1"},
+		{"none"},
+		{"none"},
+		{},
+		{},
+	} {
+		kexInit = appendString(kexInit, []byte(strings.Join(list, ",")))
+	}
+	// first_kex_packet_follows and the reserved uint32
+	kexInit = append(kexInit, 0, 0, 0, 0, 0)
+	if err := writePacket(conn, kexInit); err != nil {
+		return "", err
+	}
+	var clientKey [32]byte
+	if _, err := rand.Read(clientKey[:]); err != nil {
+		return "", err
+	}
+	if err := writePacket(conn, appendString([]byte{msgKexECDHInit}, clientKey[:])); err != nil {
+		return "", err
+	}
+
+	for {
+		payload, err := readPacket(r)
+		if err != nil {
+			return "", err
+		}
+		switch payload[0] {
+		case msgKexECDHReply:
+			blob, _, ok := parseString(payload[1:])
+			if !ok {
+				return "", fmt.Errorf("Malformed SSH key exchange reply")
+			}
+			keyType, _, ok := parseString(blob)
+			if !ok {
+				return "", fmt.Errorf("Malformed SSH host key")
+			}
+			sum := sha256.Sum256(blob)
+			return string(keyType) + " SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+		case msgDisconnect:
+			// reason code, then the description
+			if len(payload) >= 5 {
+				if desc, _, ok := parseString(payload[5:]); ok {
+					return "", fmt.Errorf("SSH server disconnected: %s", desc)
+				}
+			}
+			return "", fmt.Errorf("SSH server disconnected")
+		}
+		// Anything else, like the server's KEXINIT, is skipped
+	}
+}
+
+// writePacket writes an unencrypted SSH packet, as sent before the keys are exchanged.
+func writePacket(w io.Writer, payload []byte) error {
+	// The padding is at least 4 bytes, and pads the packet to a multiple of 8 bytes
+	padding := 8 - (5+len(payload))%8
+	if padding < 4 {
+		padding += 8
+	}
+	packet := make([]byte, 5+len(payload)+padding)
+	binary.BigEndian.PutUint32(packet, uint32(1+len(payload)+padding))
+	packet[4] = byte(padding)
+	copy(packet[5:], payload)
+	_, err := w.Write(packet)
+	return err
+}
+
+// readPacket reads an unencrypted SSH packet and returns its payload, which is never empty.
+func readPacket(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("Failed to read SSH packet: %s", err)
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	padding := uint32(header[4])
+	if length > maxPacketSize || length < padding+2 {
+		return nil, fmt.Errorf("Bad SSH packet length %d", length)
+	}
+	rest := make([]byte, length-1)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("Failed to read SSH packet: %s", err)
+	}
+	return rest[:len(rest)-int(padding)], nil
+}
+
+func appendString(b, s []byte) []byte {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(s)))
+	return append(append(b, length[:]...), s...)
+}
+
+// parseString reads a length-prefixed string, returning it and the bytes after it.
+func parseString(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+	length := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < length {
+		return nil, nil, false
+	}
+	return b[4 : 4+length], b[4+length:], true
+}
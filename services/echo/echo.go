@@ -1,10 +1,37 @@
-// Package echo implements a Service which echoes back !commands.
+// Package echo implements a Service which echoes back !commands, and responds to custom
+// commands with canned responses.
+//
+// Canned responses
+//
+// Room moderators can define commands such as !faq, !wifi or !rules which respond with a fixed
+// message, in chat with !response or through the /admin/configureCannedResponse API. Each
+// command is specific to the room it was defined in. The text and HTML of a response are Go
+// templates, executed with:
+//
+//    .Sender      The user ID of the user who used the command.
+//    .SenderPill  An HTML mention of the user, for HTML templates.
+//    .Args        The arguments given to the command.
+//    .RoomID      The room the command was used in.
+//
+// e.g. "{{.Sender}}: the rules are at https://example.com/rules". A response may also have an
+// image, which is sent before its text.
 package echo
 
 import (
+	"fmt"
+	"html/template"
+	"net/url"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/templates"
 	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/uploadcache"
+	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -12,16 +39,68 @@ import (
 // ServiceType of the Echo service
 const ServiceType = "echo"
 
-// Service represents the Echo service. It has no Config fields.
+// The power level needed to manage canned responses if the service doesn't say otherwise.
+const defaultModeratorPowerLevel = 50
+
+// Commands which canned responses can't replace.
+var builtinCommands = map[string]bool{"echo": true, "response": true}
+
+// The biggest image which is uploaded for a canned response
+const maxImageSize = 5 * 1024 * 1024
+
+// How long images with http(s) URLs, which can only be set through the admin API, are used for
+// after they are uploaded to Matrix before they are uploaded again, in case they have changed.
+const imageCacheTTL = time.Hour
+
+// httpClient fetches images, refusing URLs on private networks. Overridden by tests.
+var httpClient = utils.NewPublicHTTPClient(30*time.Second, 5)
+
+// Service represents the Echo service.
+//
+// Example request:
+//   {
+//       "moderator_power_level": 50
+//   }
 type Service struct {
 	types.DefaultService
+	// Optional. The power level a user needs in a room to set canned responses there. Defaults to
+	// 50. Set to 0 to let everyone set them.
+	ModeratorPowerLevel *int `json:"moderator_power_level"`
+}
+
+// responseData is the data which canned response templates are executed with.
+type responseData struct {
+	Sender     id.UserID
+	SenderPill template.HTML
+	Args       []string
+	RoomID     id.RoomID
+}
+
+// senderPill returns an HTML mention of the user. User IDs can contain characters which are
+// special in URLs and HTML, so both the link and the text are escaped.
+func senderPill(userID id.UserID) template.HTML {
+	href := "https://matrix.to/#/" + url.PathEscape(userID.String())
+	return template.HTML(fmt.Sprintf(
+		`<a href="%s">%s</a>`, template.HTMLEscapeString(href), template.HTMLEscapeString(userID.String()),
+	))
 }
 
 // Commands supported:
 //    !echo some message
 // Responds with a notice of "some message".
+//    !response set faq Read the FAQ at https://example.com/faq, {{.Sender}}
+// Makes !faq respond with the text in this room. Only room moderators can set responses.
+//    !response image wifi mxc://example.com/qr-code
+// Makes !wifi respond with the image in this room, as well as any text. http(s) images are
+// uploaded to Matrix when they are set, and must be on the public internet.
+//    !response remove faq
+// Removes !faq from this room.
+//    !response list
+// Lists the canned responses in this room.
+//
+// Plus every canned response, e.g. !faq.
 func (e *Service) Commands(cli types.MatrixClient) []types.Command {
-	return []types.Command{
+	cmds := []types.Command{
 		{
 			Path: []string{"echo"},
 			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
@@ -31,7 +110,281 @@ func (e *Service) Commands(cli types.MatrixClient) []types.Command {
 				}, nil
 			},
 		},
+		{
+			Path:      []string{"response", "set"},
+			Arguments: []string{"name", "text"},
+			Help:      "Set the text of a canned response in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return e.cmdSetResponse(cli, roomID, userID, args, false)
+			},
+		},
+		{
+			Path:      []string{"response", "image"},
+			Arguments: []string{"name", "image_url"},
+			Help:      "Set the image of a canned response in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return e.cmdSetResponse(cli, roomID, userID, args, true)
+			},
+		},
+		{
+			Path:      []string{"response", "remove"},
+			Arguments: []string{"name"},
+			Help:      "Remove a canned response from this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return e.cmdRemoveResponse(cli, roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"response", "list"},
+			Help: "List the canned responses in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return e.cmdListResponses(roomID)
+			},
+		},
+	}
+
+	responses, err := database.GetServiceDB().LoadCannedResponses(e.ServiceID())
+	if err != nil {
+		log.WithError(err).WithField("service_id", e.ServiceID()).Error("Failed to load canned responses")
+		return cmds
+	}
+	// Responses are per room but commands aren't, so each command looks up the response for the
+	// room it was used in.
+	names := make(map[string]bool)
+	for _, r := range responses {
+		if names[r.Name] || builtinCommands[r.Name] {
+			continue
+		}
+		names[r.Name] = true
+		name := r.Name
+		cmds = append(cmds, types.Command{
+			Path: []string{name},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return e.cmdCannedResponse(cli, name, roomID, userID, args)
+			},
+		})
+	}
+	return cmds
+}
+
+// roomResponses returns the canned responses of the room, keyed off their names.
+func (e *Service) roomResponses(roomID id.RoomID) (map[string]api.CannedResponse, error) {
+	responses, err := database.GetServiceDB().LoadCannedResponses(e.ServiceID())
+	if err != nil {
+		return nil, err
+	}
+	roomResponses := make(map[string]api.CannedResponse)
+	for _, r := range responses {
+		if r.RoomID == roomID {
+			roomResponses[r.Name] = r
+		}
+	}
+	return roomResponses, nil
+}
+
+func (e *Service) cmdCannedResponse(cli types.MatrixClient, name string, roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	responses, err := e.roomResponses(roomID)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := responses[name]
+	if !ok {
+		return nil, nil // the command belongs to another room
+	}
+
+	if r.ImageURL != "" {
+		image, err := e.imageMessage(cli, r)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to send the !%s image: %s", name, err)
+		}
+		if r.Text == "" {
+			return image, nil
+		}
+		if _, err = cli.SendMessageEvent(roomID, mevt.EventMessage, image); err != nil {
+			return nil, err
+		}
+	}
+
+	data := responseData{
+		Sender:     userID,
+		SenderPill: senderPill(userID),
+		Args:       args,
+		RoomID:     roomID,
+	}
+	content, err := templates.Execute(api.Template{Name: "echo." + name, Text: r.Text, HTML: r.HTML}, mevt.MsgNotice, data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to render !%s: %s", name, err)
+	}
+	return content, nil
+}
+
+// imageMessage returns an image message for the response's image, uploading it to Matrix first
+// if needed.
+func (e *Service) imageMessage(cli types.MatrixClient, r api.CannedResponse) (*mevt.MessageEventContent, error) {
+	if strings.HasPrefix(r.ImageURL, "mxc://") {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgImage,
+			Body:    r.Name,
+			URL:     id.ContentURIString(r.ImageURL),
+		}, nil
+	}
+	content, err := uploadcache.Fetch(e.ServiceID()+" response image "+r.ImageURL, imageCacheTTL, func() (mevt.MessageEventContent, error) {
+		mxcURL, err := uploadImage(cli, r.ImageURL)
+		if err != nil {
+			return mevt.MessageEventContent{}, err
+		}
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgImage,
+			Body:    r.Name,
+			URL:     mxcURL,
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// uploadImage fetches the image and uploads it to Matrix, returning its mxc:// URL.
+func uploadImage(cli types.MatrixClient, imageURL string) (id.ContentURIString, error) {
+	mediaCli, ok := cli.(types.MediaUploader)
+	if !ok {
+		return "", fmt.Errorf("Unable to upload images with this client")
+	}
+	data, contentType, err := utils.FetchImage(httpClient, imageURL, maxImageSize)
+	if err != nil {
+		return "", err
+	}
+	resUpload, err := mediaCli.UploadBytes(data, contentType)
+	if err != nil {
+		return "", err
+	}
+	return resUpload.ContentURI.CUString(), nil
+}
+
+func (e *Service) cmdSetResponse(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string, image bool) (interface{}, error) {
+	if len(args) < 2 {
+		if image {
+			return nil, fmt.Errorf("Usage: !response image name image_url")
+		}
+		return nil, fmt.Errorf("Usage: !response set name text")
+	}
+	if err := e.requireModerator(cli, roomID, userID); err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(strings.TrimPrefix(args[0], "!"))
+	if builtinCommands[name] {
+		return nil, fmt.Errorf("!%s can't be replaced", name)
+	}
+
+	responses, err := e.roomResponses(roomID)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := responses[name]
+	if !ok {
+		r = api.CannedResponse{ServiceID: e.ServiceID(), RoomID: roomID, Name: name}
+	}
+	if image {
+		// Images are uploaded straight away, so that they are only fetched once, and so that
+		// whoever set them finds out if they can't be
+		r.ImageURL = args[1]
+		if u, err := url.Parse(r.ImageURL); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			mxcURL, err := uploadImage(cli, r.ImageURL)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to upload the image: %s", err)
+			}
+			r.ImageURL = string(mxcURL)
+		}
+	} else {
+		r.Text = strings.Join(args[1:], " ")
+		r.HTML = ""
+	}
+	r.SetByUserID = userID
+	if err = r.Check(); err != nil {
+		return nil, err
+	}
+	if _, err = database.GetServiceDB().StoreCannedResponse(r); err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Set !%s", name),
+	}, nil
+}
+
+func (e *Service) cmdRemoveResponse(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !response remove name")
+	}
+	if err := e.requireModerator(cli, roomID, userID); err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(strings.TrimPrefix(args[0], "!"))
+	responses, err := e.roomResponses(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := responses[name]; !ok {
+		return nil, fmt.Errorf("There is no !%s in this room", name)
+	}
+	if err = database.GetServiceDB().DeleteCannedResponse(e.ServiceID(), roomID, name); err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Removed !%s", name),
+	}, nil
+}
+
+func (e *Service) cmdListResponses(roomID id.RoomID) (interface{}, error) {
+	responses, err := e.roomResponses(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if len(responses) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "There are no canned responses in this room",
+		}, nil
+	}
+	var names []string
+	for name := range responses {
+		names = append(names, "!"+name)
+	}
+	sort.Strings(names)
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    "Canned responses: " + strings.Join(names, ", "),
+	}, nil
+}
+
+// requireModerator returns an error unless the user has at least the moderator power level in
+// the room.
+func (e *Service) requireModerator(cli types.MatrixClient, roomID id.RoomID, userID id.UserID) error {
+	stateCli, ok := cli.(types.StateGetter)
+	if !ok {
+		return fmt.Errorf("Unable to check power levels with this client")
+	}
+	var powerLevels struct {
+		Users        map[id.UserID]int `json:"users"`
+		UsersDefault int               `json:"users_default"`
+	}
+	if err := stateCli.StateEvent(roomID, mevt.StatePowerLevels, "", &powerLevels); err != nil {
+		return fmt.Errorf("Failed to load the room's power levels: %s", err)
+	}
+	level, ok := powerLevels.Users[userID]
+	if !ok {
+		level = powerLevels.UsersDefault
+	}
+	required := defaultModeratorPowerLevel
+	if e.ModeratorPowerLevel != nil {
+		required = *e.ModeratorPowerLevel
+	}
+	if level < required {
+		return fmt.Errorf("Only users with power level %d or higher can change canned responses", required)
 	}
+	return nil
 }
 
 func init() {
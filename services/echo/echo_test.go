@@ -0,0 +1,213 @@
+package echo
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// responseStorage keeps canned responses in memory
+type responseStorage struct {
+	database.NopStorage
+	responses []api.CannedResponse
+}
+
+func (s *responseStorage) LoadCannedResponses(serviceID string) ([]api.CannedResponse, error) {
+	var responses []api.CannedResponse
+	for _, r := range s.responses {
+		if r.ServiceID == serviceID {
+			responses = append(responses, r)
+		}
+	}
+	return responses, nil
+}
+
+func (s *responseStorage) StoreCannedResponse(response api.CannedResponse) (old api.CannedResponse, err error) {
+	for i, r := range s.responses {
+		if r.ServiceID == response.ServiceID && r.RoomID == response.RoomID && r.Name == response.Name {
+			s.responses[i] = response
+			return r, nil
+		}
+	}
+	s.responses = append(s.responses, response)
+	return
+}
+
+func (s *responseStorage) DeleteCannedResponse(serviceID string, roomID id.RoomID, name string) error {
+	for i, r := range s.responses {
+		if r.ServiceID == serviceID && r.RoomID == roomID && r.Name == name {
+			s.responses = append(s.responses[:i], s.responses[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// runCommand runs the best matching command of the service, like clients do
+func runCommand(srv types.Service, cli types.MatrixClient, roomID id.RoomID, userID id.UserID, body string) (interface{}, error) {
+	args := strings.Split(strings.TrimPrefix(body, "!"), " ")
+	var best *types.Command
+	cmds := srv.Commands(cli)
+	for i := range cmds {
+		if cmds[i].Matches(args) && (best == nil || len(best.Path) < len(cmds[i].Path)) {
+			best = &cmds[i]
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	return best.Command(roomID, userID, args[len(best.Path):])
+}
+
+func TestCannedResponses(t *testing.T) {
+	database.SetServiceDB(&responseStorage{})
+
+	srv, err := types.CreateService("id", ServiceType, "@echobot:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create echo service: ", err)
+	}
+
+	// Mock the response from Matrix: @zelda is a moderator of !castle, and images can be sent
+	var sentImages []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/state/m.room.power_levels") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"users":{"@zelda:hyrule":100},"users_default":0}`)),
+			}, nil
+		} else if strings.Contains(req.URL.Path, "/_matrix/media/r0/upload") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://hyrule/map"}`)),
+			}, nil
+		} else if strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			body, _ := ioutil.ReadAll(req.Body)
+			sentImages = append(sentImages, string(body))
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$image"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@echobot:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	// Only moderators can set responses
+	if _, err = runCommand(srv, matrixCli, "!castle:hyrule", "@link:hyrule", "!response set rules Be nice"); err == nil {
+		t.Fatal("A non-moderator set a canned response")
+	}
+	if _, err = runCommand(srv, matrixCli, "!castle:hyrule", "@zelda:hyrule", "!response set echo Hi"); err == nil {
+		t.Fatal("Replaced a built-in command")
+	}
+	if _, err = runCommand(srv, matrixCli, "!castle:hyrule", "@zelda:hyrule", "!response set rules {{.Sender}}: be nice"); err != nil {
+		t.Fatalf("Failed to set canned response: %s", err)
+	}
+	if _, err = runCommand(srv, matrixCli, "!castle:hyrule", "@zelda:hyrule", "!response image rules mxc://hyrule/rules"); err != nil {
+		t.Fatalf("Failed to set canned response image: %s", err)
+	}
+
+	res, err := runCommand(srv, matrixCli, "!castle:hyrule", "@link:hyrule", "!rules")
+	if err != nil {
+		t.Fatalf("Failed to respond to !rules: %s", err)
+	}
+	if content, ok := res.(mevt.MessageEventContent); !ok || content.Body != "@link:hyrule: be nice" {
+		t.Errorf("Bad !rules response: %+v", res)
+	}
+	if len(sentImages) != 1 || !strings.Contains(sentImages[0], "mxc://hyrule/rules") {
+		t.Errorf("Expected the !rules image to be sent, got %v", sentImages)
+	}
+
+	// http(s) images are uploaded when they are set, and must be on the public internet
+	defer func() { httpClient = utils.NewPublicHTTPClient(30*time.Second, 5) }()
+	if _, err = runCommand(srv, matrixCli, "!castle:hyrule", "@zelda:hyrule", "!response image map http://169.254.169.254/latest/meta-data"); err == nil {
+		t.Error("Set an image from a private network")
+	}
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "https://images.hyrule/map.png" {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": []string{"image/png"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString("a map of hyrule")),
+		}, nil
+	})}
+	if _, err = runCommand(srv, matrixCli, "!castle:hyrule", "@zelda:hyrule", "!response image map https://images.hyrule/map.png"); err != nil {
+		t.Fatalf("Failed to set canned response image: %s", err)
+	}
+	res, err = runCommand(srv, matrixCli, "!castle:hyrule", "@link:hyrule", "!map")
+	if err != nil {
+		t.Fatalf("Failed to respond to !map: %s", err)
+	}
+	if content, ok := res.(*mevt.MessageEventContent); !ok || content.MsgType != mevt.MsgImage || content.URL != "mxc://hyrule/map" {
+		t.Errorf("Bad !map response: %+v", res)
+	}
+
+	// Responses are per room
+	if res, err = runCommand(srv, matrixCli, "!village:hyrule", "@link:hyrule", "!rules"); res != nil || err != nil {
+		t.Errorf("Responded to !rules in another room: %+v %v", res, err)
+	}
+
+	res, err = runCommand(srv, matrixCli, "!castle:hyrule", "@link:hyrule", "!response list")
+	if err != nil {
+		t.Fatalf("Failed to list canned responses: %s", err)
+	}
+	if content := res.(*mevt.MessageEventContent); content.Body != "Canned responses: !map, !rules" {
+		t.Errorf("Bad list: %s", content.Body)
+	}
+
+	if _, err = runCommand(srv, matrixCli, "!castle:hyrule", "@zelda:hyrule", "!response remove rules"); err != nil {
+		t.Fatalf("Failed to remove canned response: %s", err)
+	}
+	if res, err = runCommand(srv, matrixCli, "!castle:hyrule", "@link:hyrule", "!rules"); res != nil || err != nil {
+		t.Errorf("Responded to a removed !rules: %+v %v", res, err)
+	}
+}
+
+func TestModeratorPowerLevelZero(t *testing.T) {
+	database.SetServiceDB(&responseStorage{})
+
+	srv, err := types.CreateService("id", ServiceType, "@echobot:hyrule", []byte(`{"moderator_power_level":0}`))
+	if err != nil {
+		t.Fatal("Failed to create echo service: ", err)
+	}
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/state/m.room.power_levels") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"users":{"@zelda:hyrule":100},"users_default":0}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@echobot:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	if _, err = runCommand(srv, matrixCli, "!castle:hyrule", "@link:hyrule", "!response set rules Be nice"); err != nil {
+		t.Errorf("A moderator power level of 0 stopped @link setting a canned response: %s", err)
+	}
+}
+
+func TestSenderPill(t *testing.T) {
+	pill := string(senderPill(`@"><script>:hyrule`))
+	want := `<a href="https://matrix.to/#/@%22%3E%3Cscript%3E:hyrule">@&#34;&gt;&lt;script&gt;:hyrule</a>`
+	if pill != want {
+		t.Errorf("Bad pill: got %s, want %s", pill, want)
+	}
+}
@@ -0,0 +1,281 @@
+// Package faqmatch implements a Service which answers questions asked in rooms from an FAQ.
+package faqmatch
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the FAQ match service
+const ServiceType = "faqmatch"
+
+const (
+	defaultRefreshInterval = time.Hour
+	minRefreshIntervalMins = 5
+	defaultThreshold       = 0.5
+	// How much of an answer is quoted in the reply
+	maxSnippetLength = 280
+)
+
+// Words which questions start with, for questions asked without a question mark
+var questionWords = map[string]bool{
+	"are": true, "can": true, "could": true, "do": true, "does": true, "how": true, "is": true,
+	"should": true, "what": true, "when": true, "where": true, "which": true, "who": true, "why": true,
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// The FAQ indexes, keyed by service ID, so that the FAQ isn't read and tokenised again for every
+// question.
+var (
+	indexesMutex sync.Mutex
+	indexes      = make(map[string]*index)
+)
+
+// Service contains the Config fields for the FAQ match service.
+//
+// The FAQ is read from web pages and files, in HTML or Markdown. Each heading in them is a
+// question, answered by the text up to the next heading, such as:
+//   ## How do I reset my password?
+//   Go to the login page and click "Forgot password".
+//
+// When someone asks a question in one of the rooms which is like a question in the FAQ, Go-NEB
+// replies with the FAQ's answer and a link to it. Questions are matched by the words they share,
+// counting the words few questions in the FAQ have for the most, so the wording doesn't have to
+// be the same. Each room has a threshold from 0 to 1 for how sure Go-NEB must be of a match to
+// reply: higher means fewer but better answers. The FAQ is read again every hour, or as often as
+// refresh_interval_mins says.
+//
+// Example JSON request:
+//   {
+//       "sources": [
+//           {
+//               "url": "https://wiki.localhost/FAQ"
+//           },
+//           {
+//               "url": "/var/lib/go-neb/faq.md",
+//               "link": "https://github.com/my-org/my-project/blob/main/FAQ.md"
+//           }
+//       ],
+//       "rooms": {
+//           "!support:localhost": {
+//               "threshold": 0.6
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// The web pages and files the FAQ is in.
+	Sources []Source `json:"sources"`
+	// The rooms to answer questions in.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+	// Optional. How often to read the FAQ again, in minutes. Defaults to 60.
+	RefreshIntervalMins int `json:"refresh_interval_mins"`
+}
+
+// Source is a web page or file with questions and answers.
+type Source struct {
+	// The http(s) URL of the web page, or the path of the file. Files ending in ".md" or
+	// ".markdown", and pages served as text/markdown, are read as Markdown, and everything else as
+	// HTML.
+	URL string `json:"url"`
+	// Optional. Where to link to the answers. Defaults to the web page's URL. Answers from files
+	// aren't linked to without one.
+	Link string `json:"link"`
+}
+
+// RoomConfig is how a room's questions are answered.
+type RoomConfig struct {
+	// Optional. How sure Go-NEB must be that a question is in the FAQ to answer it, from 0 to 1.
+	// Defaults to 0.5.
+	Threshold float64 `json:"threshold"`
+}
+
+func (r *RoomConfig) threshold() float64 {
+	if r.Threshold > 0 {
+		return r.Threshold
+	}
+	return defaultThreshold
+}
+
+func (s *Service) refreshInterval() time.Duration {
+	if s.RefreshIntervalMins > 0 {
+		return time.Duration(s.RefreshIntervalMins) * time.Minute
+	}
+	return defaultRefreshInterval
+}
+
+// OnPoll reads the FAQ again, so that changes to it are answered with.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	if _, err := s.refresh(); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey:   err,
+			"service_id":   s.ServiceID(),
+			"service_type": s.ServiceType(),
+		}).Error("Failed to read FAQ")
+	}
+	return time.Now().Add(s.refreshInterval())
+}
+
+// refresh reads every source and indexes their entries. The sources which can't be read are
+// skipped, unless none of them can.
+func (s *Service) refresh() (*index, error) {
+	var (
+		entries []entry
+		lastErr error
+	)
+	for i := range s.Sources {
+		src := &s.Sources[i]
+		srcEntries, err := fetchSource(src)
+		if err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"service_id": s.ServiceID(),
+				"url":        src.URL,
+			}).Warn("Failed to read FAQ source")
+			lastErr = err
+			continue
+		}
+		entries = append(entries, srcEntries...)
+	}
+	if len(entries) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	idx := newIndex(entries)
+	indexesMutex.Lock()
+	indexes[s.ServiceID()] = idx
+	indexesMutex.Unlock()
+	return idx, nil
+}
+
+// index returns the service's FAQ index, reading the FAQ if it hasn't been yet.
+func (s *Service) index() (*index, error) {
+	indexesMutex.Lock()
+	idx, ok := indexes[s.ServiceID()]
+	indexesMutex.Unlock()
+	if ok {
+		return idx, nil
+	}
+	return s.refresh()
+}
+
+// OnMessage answers the questions asked in the configured rooms which are in the FAQ. Notices,
+// which are sent by bots, and replies, which are part of a conversation, are left alone.
+func (s *Service) OnMessage(cli types.MatrixClient, evt *mevt.Event) {
+	room, ok := s.Rooms[evt.RoomID]
+	if !ok || evt.Type != mevt.EventMessage {
+		return
+	}
+	msg := evt.Content.AsMessage()
+	if msg.MsgType != mevt.MsgText || msg.RelatesTo != nil || !isQuestion(msg.Body) {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    evt.RoomID,
+		"event_id":   evt.ID,
+	})
+	idx, err := s.index()
+	if err != nil {
+		logger.WithError(err).Error("Failed to read FAQ")
+		return
+	}
+	m := idx.best(msg.Body)
+	if m == nil || m.confidence < room.threshold() {
+		return
+	}
+	logger.WithFields(log.Fields{
+		"question":   m.entry.Question,
+		"confidence": m.confidence,
+	}).Info("Answering question from FAQ")
+	if _, err := cli.SendMessageEvent(evt.RoomID, mevt.EventMessage, answerMessage(evt, m.entry)); err != nil {
+		logger.WithError(err).Error("Failed to send answer")
+	}
+}
+
+// isQuestion returns whether the message is a question, by its question mark or first word.
+func isQuestion(body string) bool {
+	body = strings.TrimSpace(body)
+	if strings.HasSuffix(body, "?") {
+		return true
+	}
+	fields := strings.Fields(strings.ToLower(body))
+	return len(fields) > 2 && questionWords[strings.Trim(fields[0], ",.!")]
+}
+
+// answerMessage returns a reply to the question with the entry's answer.
+func answerMessage(evt *mevt.Event, e *entry) *mevt.MessageEventContent {
+	answer := snippet(e.Answer, maxSnippetLength)
+	question := html.EscapeString(e.Question)
+	if e.Link != "" {
+		question = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(e.Link), question)
+	}
+	body := fmt.Sprintf("❓ This might be answered in the FAQ: %s\n%s", e.Question, answer)
+	if e.Link != "" {
+		body += "\n" + e.Link
+	}
+	content := &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          body,
+		Format:        mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf("❓ This might be answered in the FAQ: <b>%s</b><br>%s", question, html.EscapeString(answer)),
+	}
+	content.SetReply(evt)
+	return content
+}
+
+// Register makes sure that the sources and thresholds are valid, and joins the rooms. The FAQ is
+// read again with the new sources when it's next needed.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Sources) == 0 {
+		return fmt.Errorf("At least one source is required")
+	}
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	if s.RefreshIntervalMins < 0 || (s.RefreshIntervalMins > 0 && s.RefreshIntervalMins < minRefreshIntervalMins) {
+		return fmt.Errorf("refresh_interval_mins can't be less than %d", minRefreshIntervalMins)
+	}
+	for _, src := range s.Sources {
+		if src.URL == "" {
+			return fmt.Errorf("Every source needs a url")
+		}
+	}
+	for roomID, room := range s.Rooms {
+		if room.Threshold < 0 || room.Threshold > 1 {
+			return fmt.Errorf("Room %s has a bad threshold %g: must be between 0 and 1", roomID, room.Threshold)
+		}
+	}
+
+	indexesMutex.Lock()
+	delete(indexes, s.ServiceID())
+	indexesMutex.Unlock()
+
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package faqmatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const wikiPage = `<html><head><title>FAQ</title><style>h2 { color: green }</style></head><body>
+<h1>Hyrule FAQ</h1>
+<h2 id="sword">Where can I find the Master Sword?</h2>
+<p>The Master Sword rests in the <b>Lost Woods</b>, deep in the Korok Forest.</p>
+<h2 id="hearts">How do I get more heart containers?</h2>
+<p>Trade four Spirit Orbs at any Goddess Statue.</p>
+<h2 id="horses">Can horses be registered at stables?</h2>
+<ul><li>Tame a wild horse</li><li>Ride it to any stable</li></ul>
+</body></html>`
+
+const faqMarkdown = `# Shrine FAQ
+
+## How long do shrines take?
+
+Most shrines take *ten minutes*, and blessings take no time at all.
+
+## Why won't the shrine door open?
+
+The door only opens once the Sheikah Slate has been activated at the Great Plateau tower.
+`
+
+func TestParse(t *testing.T) {
+	entries, err := parseHTML(strings.NewReader(wikiPage), "https://wiki.hyrule/FAQ#top")
+	if err != nil {
+		t.Fatal("Failed to parse page: ", err)
+	}
+	want := []entry{
+		{"Where can I find the Master Sword?", "The Master Sword rests in the Lost Woods, deep in the Korok Forest.", "https://wiki.hyrule/FAQ#sword", nil},
+		{"How do I get more heart containers?", "Trade four Spirit Orbs at any Goddess Statue.", "https://wiki.hyrule/FAQ#hearts", nil},
+		{"Can horses be registered at stables?", "Tame a wild horse Ride it to any stable", "https://wiki.hyrule/FAQ#horses", nil},
+	}
+	if fmt.Sprint(entries) != fmt.Sprint(want) {
+		t.Errorf("Bad page entries: got %v, want %v", entries, want)
+	}
+
+	dir, err := ioutil.TempDir("", "faqmatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "FAQ.md")
+	if err = ioutil.WriteFile(file, []byte(faqMarkdown), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = fetchSource(&Source{URL: file, Link: "https://github.com/hyrule/shrines/blob/main/FAQ.md"})
+	if err != nil {
+		t.Fatal("Failed to read file: ", err)
+	}
+	want = []entry{
+		{"How long do shrines take?", "Most shrines take ten minutes, and blessings take no time at all.",
+			"https://github.com/hyrule/shrines/blob/main/FAQ.md#how-long-do-shrines-take", nil},
+		{"Why won't the shrine door open?", "The door only opens once the Sheikah Slate has been activated at the Great Plateau tower.",
+			"https://github.com/hyrule/shrines/blob/main/FAQ.md#why-won-t-the-shrine-door-open", nil},
+	}
+	if fmt.Sprint(entries) != fmt.Sprint(want) {
+		t.Errorf("Bad file entries: got %v, want %v", entries, want)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	entries, _ := parseHTML(strings.NewReader(wikiPage), "")
+	idx := newIndex(entries)
+	for _, tc := range []struct {
+		question string
+		want     string
+	}{
+		{"where is the master sword", "Where can I find the Master Sword?"},
+		{"how can I get heart containers?", "How do I get more heart containers?"},
+		{"Which stable should I register my horse at?", "Can horses be registered at stables?"},
+		{"where do spirit orbs go to get heart containers", "How do I get more heart containers?"},
+		{"What is the weather like?", ""},
+	} {
+		got := ""
+		if m := idx.best(tc.question); m != nil && m.confidence >= defaultThreshold {
+			got = m.entry.Question
+		}
+		if got != tc.want {
+			t.Errorf("Bad match for %q: got %q, want %q", tc.question, got, tc.want)
+		}
+	}
+}
+
+func TestOnMessage(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "https://wiki.hyrule/FAQ" {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(""))}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": {"text/html"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString(wikiPage)),
+		}, nil
+	})}
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, fmt.Sprintf("%s %s %s", room, msg.MsgType, msg.Body))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$answer:hyrule"}`))}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"sources": [{"url": "https://wiki.hyrule/FAQ"}, {"url": "https://wiki.hyrule/missing"}],
+		"rooms": {
+			"!castle:hyrule": {},
+			"!sages:hyrule": {"threshold": 0.9}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create faqmatch service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register faqmatch service: ", err)
+	}
+	s := srv.(*Service)
+
+	for _, m := range []struct {
+		room    id.RoomID
+		msgType mevt.MessageType
+		body    string
+	}{
+		{"!castle:hyrule", mevt.MsgText, "Where is the Master Sword?"},
+		// Not questions
+		{"!castle:hyrule", mevt.MsgText, "The Master Sword is mine"},
+		{"!castle:hyrule", mevt.MsgNotice, "Where is the Master Sword?"},
+		// Not sure enough
+		{"!sages:hyrule", mevt.MsgText, "Where is the Master Sword?"},
+		{"!market:hyrule", mevt.MsgText, "Where is the Master Sword?"},
+		{"!sages:hyrule", mevt.MsgText, "where can I find the master sword"},
+	} {
+		s.OnMessage(matrixCli, &mevt.Event{
+			Type:    mevt.EventMessage,
+			ID:      "$question:hyrule",
+			RoomID:  m.room,
+			Sender:  "@link:hyrule",
+			Content: mevt.Content{Parsed: &mevt.MessageEventContent{MsgType: m.msgType, Body: m.body}},
+		})
+	}
+
+	want := []string{
+		"!castle:hyrule m.notice > <@link:hyrule> Where is the Master Sword?\n\n❓ This might be answered in the FAQ: Where can I find the Master Sword?\n" +
+			"The Master Sword rests in the Lost Woods, deep in the Korok Forest.\nhttps://wiki.hyrule/FAQ#sword",
+		"!sages:hyrule m.notice > <@link:hyrule> where can I find the master sword\n\n❓ This might be answered in the FAQ: Where can I find the Master Sword?\n" +
+			"The Master Sword rests in the Lost Woods, deep in the Korok Forest.\nhttps://wiki.hyrule/FAQ#sword",
+	}
+	if strings.Join(sent, "\n\n") != strings.Join(want, "\n\n") {
+		t.Errorf("Bad messages: got %q, want %q", sent, want)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"rooms": {"!castle:hyrule": {}}}`,
+		`{"sources": [{"url": "faq.md"}]}`,
+		`{"sources": [{"link": "https://wiki.hyrule/FAQ"}], "rooms": {"!castle:hyrule": {}}}`,
+		`{"sources": [{"url": "faq.md"}], "rooms": {"!castle:hyrule": {"threshold": 1.5}}}`,
+		`{"sources": [{"url": "faq.md"}], "rooms": {"!castle:hyrule": {}}, "refresh_interval_mins": 1}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create faqmatch service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package faqmatch
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/russross/blackfriday"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// The biggest FAQ page which is read
+const maxPageSize = 2 * 1024 * 1024
+
+// Words which say nothing about what a question is about, so aren't matched on
+var stopWords = map[string]bool{
+	"a": true, "about": true, "am": true, "an": true, "and": true, "any": true, "are": true, "as": true,
+	"at": true, "be": true, "but": true, "by": true, "can": true, "could": true, "do": true, "does": true,
+	"for": true, "from": true, "get": true, "has": true, "have": true, "how": true, "i": true, "if": true,
+	"in": true, "is": true, "it": true, "its": true, "me": true, "my": true, "of": true, "on": true,
+	"or": true, "should": true, "so": true, "that": true, "the": true, "there": true, "this": true,
+	"to": true, "we": true, "what": true, "when": true, "where": true, "which": true, "who": true,
+	"why": true, "will": true, "with": true, "would": true, "you": true, "your": true,
+}
+
+// entry is a question in the FAQ and its answer.
+type entry struct {
+	Question string
+	Answer   string
+	// Optional. A link to the question in the FAQ.
+	Link string
+	// The entry's terms, weighted by how much they tell it apart from the other entries
+	vector map[string]float64
+}
+
+// index is every entry in a service's FAQ, ready to be matched against.
+type index struct {
+	entries []entry
+	// How rare each term is across the entries
+	idf map[string]float64
+}
+
+// match is an entry which a question might be answered by, and how confident that is, from 0 to 1.
+type match struct {
+	entry      *entry
+	confidence float64
+}
+
+// newIndex weighs the terms of the entries by TF-IDF, so that the words which only a few entries
+// have count for the most.
+func newIndex(entries []entry) *index {
+	idx := &index{entries: entries, idf: make(map[string]float64)}
+	termCounts := make([]map[string]float64, len(entries))
+	for i, e := range entries {
+		// An entry is mostly about its question, but its answer has words people might ask with too
+		counts := make(map[string]float64)
+		for _, term := range terms(e.Question) {
+			counts[term]++
+		}
+		for _, term := range terms(e.Answer) {
+			counts[term] += 0.25
+		}
+		for term := range counts {
+			idx.idf[term]++
+		}
+		termCounts[i] = counts
+	}
+	for term, df := range idx.idf {
+		idx.idf[term] = math.Log(1 + float64(len(entries))/df)
+	}
+	for i, counts := range termCounts {
+		idx.entries[i].vector = idx.weigh(counts)
+	}
+	return idx
+}
+
+// weigh turns term counts into a vector of unit length, ignoring the terms no entry has.
+func (idx *index) weigh(counts map[string]float64) map[string]float64 {
+	vector := make(map[string]float64)
+	var norm float64
+	for term, n := range counts {
+		if idf, ok := idx.idf[term]; ok {
+			vector[term] = n * idf
+			norm += vector[term] * vector[term]
+		}
+	}
+	norm = math.Sqrt(norm)
+	for term := range vector {
+		vector[term] /= norm
+	}
+	return vector
+}
+
+// best returns the entry most like the question, by the cosine similarity of their terms, or nil
+// if no entry has any of the question's terms.
+func (idx *index) best(question string) *match {
+	counts := make(map[string]float64)
+	for _, term := range terms(question) {
+		counts[term]++
+	}
+	vector := idx.weigh(counts)
+	var best *match
+	for i := range idx.entries {
+		e := &idx.entries[i]
+		var similarity float64
+		for term, w := range vector {
+			similarity += w * e.vector[term]
+		}
+		if similarity > 0 && (best == nil || similarity > best.confidence) {
+			best = &match{entry: e, confidence: similarity}
+		}
+	}
+	return best
+}
+
+// terms returns the words of the text which say what it is about, lower cased and with plurals
+// made singular, so that "Which ports are open?" matches "Open port".
+func terms(text string) []string {
+	var ts []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if stopWords[word] {
+			continue
+		}
+		if len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") {
+			word = strings.TrimSuffix(word, "s")
+		}
+		ts = append(ts, word)
+	}
+	return ts
+}
+
+// fetchSource reads the FAQ entries of a source, which is either a local file or a web page.
+func fetchSource(src *Source) ([]entry, error) {
+	var (
+		page     []byte
+		markdown bool
+		err      error
+	)
+	link := src.Link
+	if strings.HasPrefix(src.URL, "http://") || strings.HasPrefix(src.URL, "https://") {
+		if link == "" {
+			link = src.URL
+		}
+		var res *http.Response
+		res, err = httpClient.Get(src.URL)
+		if res != nil {
+			defer res.Body.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+		}
+		page, err = ioutil.ReadAll(io.LimitReader(res.Body, maxPageSize))
+		markdown = strings.HasPrefix(res.Header.Get("Content-Type"), "text/markdown")
+	} else {
+		page, err = ioutil.ReadFile(src.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(path.Ext(src.URL)) {
+	case ".md", ".markdown":
+		markdown = true
+	}
+	if markdown {
+		page = blackfriday.Markdown(page, blackfriday.HtmlRenderer(0, "", ""),
+			blackfriday.EXTENSION_FENCED_CODE|blackfriday.EXTENSION_TABLES|blackfriday.EXTENSION_AUTOLINK|
+				blackfriday.EXTENSION_HEADER_IDS|blackfriday.EXTENSION_AUTO_HEADER_IDS)
+	}
+	return parseHTML(bytes.NewReader(page), link)
+}
+
+// parseHTML splits a page into FAQ entries by its headings: each heading is a question, answered
+// by the text up to the next heading. Headings without text after them, like the page's title,
+// aren't questions. Questions are linked to by their heading's ID if they have one.
+func parseHTML(r io.Reader, link string) ([]entry, error) {
+	var (
+		entries   []entry
+		current   *entry
+		heading   bool
+		skipDepth int
+		answer    strings.Builder
+	)
+	finish := func() {
+		if current != nil {
+			current.Answer = strings.Join(strings.Fields(answer.String()), " ")
+			if current.Question != "" && current.Answer != "" {
+				entries = append(entries, *current)
+			}
+		}
+		answer.Reset()
+	}
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				return nil, z.Err()
+			}
+			finish()
+			return entries, nil
+		case html.StartTagToken:
+			tag := z.Token()
+			switch tag.DataAtom {
+			case atom.H1, atom.H2, atom.H3:
+				finish()
+				current = &entry{Link: link}
+				heading = true
+				for _, attr := range tag.Attr {
+					if attr.Key == "id" && link != "" {
+						current.Link = strings.SplitN(link, "#", 2)[0] + "#" + attr.Val
+					}
+				}
+			case atom.Script, atom.Style:
+				skipDepth++
+			case atom.P, atom.Li, atom.Br, atom.Div, atom.Tr:
+				answer.WriteString(" ")
+			}
+		case html.EndTagToken:
+			switch z.Token().DataAtom {
+			case atom.H1, atom.H2, atom.H3:
+				heading = false
+				if current != nil {
+					current.Question = strings.Join(strings.Fields(current.Question), " ")
+				}
+			case atom.Script, atom.Style:
+				if skipDepth > 0 {
+					skipDepth--
+				}
+			}
+		case html.TextToken:
+			if skipDepth > 0 || current == nil {
+				continue
+			}
+			text := string(z.Text())
+			if heading {
+				current.Question += text
+			} else {
+				answer.WriteString(text)
+			}
+		}
+	}
+}
+
+// snippet shortens the answer to at most the given number of characters, ending at a word.
+func snippet(answer string, max int) string {
+	runes := []rune(answer)
+	if len(runes) <= max {
+		return answer
+	}
+	cut := string(runes[:max])
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, ",.;:") + "…"
+}
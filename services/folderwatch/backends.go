@@ -0,0 +1,421 @@
+package folderwatch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Dropbox's APIs. Overridden by tests.
+var (
+	dropboxTokenURL   = "https://api.dropboxapi.com/oauth2/token"
+	dropboxAPIURL     = "https://api.dropboxapi.com/2/"
+	dropboxContentURL = "https://content.dropboxapi.com/2/"
+)
+
+var httpClient = &http.Client{Timeout: 60 * time.Second}
+
+// How long the sftp command may take before it is given up on
+const sftpTimeout = 60 * time.Second
+
+// errTooLarge is returned when downloading a file which is too large to upload into rooms.
+var errTooLarge = errors.New("file is too large")
+
+// readLimited reads up to maxSize bytes, failing if there are more.
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err == nil && int64(len(data)) > maxSize {
+		return nil, errTooLarge
+	}
+	return data, err
+}
+
+// remoteFile is a file in a watched folder.
+type remoteFile struct {
+	Name string
+	Size int64
+}
+
+// A backend lists and downloads the files in a remote folder.
+type backend interface {
+	// list returns the files directly in the folder, leaving out folders.
+	list() ([]remoteFile, error)
+	// download returns the contents of the file in the folder, failing if it is larger than
+	// maxSize.
+	download(name string, maxSize int64) ([]byte, error)
+}
+
+// sftpBackend runs OpenSSH's sftp command in batch mode, so it uses the SSH keys and known hosts
+// of the user Go-NEB runs as.
+type sftpBackend struct {
+	path string
+	// user@host, or host
+	host         string
+	port         string
+	dir          string
+	identityFile string
+}
+
+func newSFTPBackend(sftpPath string, u *url.URL, identityFile string) *sftpBackend {
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	return &sftpBackend{
+		path:         sftpPath,
+		host:         host,
+		port:         u.Port(),
+		dir:          u.Path,
+		identityFile: identityFile,
+	}
+}
+
+// run runs the batch commands, and returns what sftp printed.
+func (b *sftpBackend) run(commands string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sftpTimeout)
+	defer cancel()
+	args := []string{"-b", "-", "-o", "BatchMode=yes"}
+	if b.port != "" {
+		args = append(args, "-P", b.port)
+	}
+	if b.identityFile != "" {
+		args = append(args, "-i", b.identityFile)
+	}
+	cmd := exec.CommandContext(ctx, b.path, append(args, b.host)...)
+	cmd.Stdin = strings.NewReader(commands)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %s", err, msg)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+func (b *sftpBackend) list() ([]remoteFile, error) {
+	out, err := b.run(fmt.Sprintf("ls -ln %s\n", quoteSFTP(b.dir)))
+	if err != nil {
+		return nil, err
+	}
+	return parseSFTPListing(out), nil
+}
+
+func (b *sftpBackend) download(name string, maxSize int64) ([]byte, error) {
+	if strings.ContainsAny(name, "\"\n/") {
+		return nil, fmt.Errorf("Can't download '%s' with sftp", name)
+	}
+	f, err := ioutil.TempFile("", "go-neb-folderwatch")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if _, err = b.run(fmt.Sprintf("get %s %s\n", quoteSFTP(path.Join(b.dir, name)), quoteSFTP(f.Name()))); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	if err == nil && int64(len(data)) > maxSize {
+		return nil, errTooLarge
+	}
+	return data, err
+}
+
+// quoteSFTP quotes the path as an argument to an sftp batch command.
+func quoteSFTP(p string) string {
+	return `"` + strings.Replace(p, `"`, `\"`, -1) + `"`
+}
+
+// parseSFTPListing returns the regular files in the output of "ls -ln", e.g.
+//    -rw-r--r--    1 1000     1000         1234 Mar 15 10:00 /reports/q1.pdf
+func parseSFTPListing(out string) []remoteFile {
+	var files []remoteFile
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Batch mode echoes the commands
+		if !strings.HasPrefix(line, "-") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 9 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			continue
+		}
+		// The name is everything after the date, and may have spaces in it
+		rest := line
+		for i := 0; i < 8; i++ {
+			rest = strings.TrimLeft(rest, " ")
+			rest = rest[strings.Index(rest, " "):]
+		}
+		files = append(files, remoteFile{
+			Name: path.Base(strings.TrimLeft(rest, " ")),
+			Size: size,
+		})
+	}
+	return files
+}
+
+// webDAVBackend lists folders with PROPFIND, e.g. on Nextcloud or a file server.
+type webDAVBackend struct {
+	// The folder's URL, ending in "/"
+	url      string
+	username string
+	password string
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ContentLength string `xml:"getcontentlength"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/></d:prop></d:propfind>`
+
+func (b *webDAVBackend) do(method, u string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if b.username != "" {
+		req.SetBasicAuth(b.username, b.password)
+	}
+	if method == "PROPFIND" {
+		req.Header.Set("Depth", "1")
+		req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	}
+	return httpClient.Do(req)
+}
+
+func (b *webDAVBackend) list() ([]remoteFile, error) {
+	res, err := b.do("PROPFIND", b.url, strings.NewReader(propfindBody))
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var ms multistatus
+	if err = xml.NewDecoder(res.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+	folder, err := url.Parse(b.url)
+	if err != nil {
+		return nil, err
+	}
+	var files []remoteFile
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		// The folder itself is listed too
+		if strings.TrimSuffix(href.Path, "/") == strings.TrimSuffix(folder.Path, "/") {
+			continue
+		}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") || ps.Prop.ResourceType.Collection != nil {
+				continue
+			}
+			size, _ := strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			files = append(files, remoteFile{
+				Name: path.Base(href.Path),
+				Size: size,
+			})
+		}
+	}
+	return files, nil
+}
+
+func (b *webDAVBackend) download(name string, maxSize int64) ([]byte, error) {
+	res, err := b.do("GET", b.url+url.PathEscape(name), nil)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	return readLimited(res.Body, maxSize)
+}
+
+// dropboxBackend uses the Dropbox API with an app's refresh token, which doesn't expire.
+type dropboxBackend struct {
+	dir          string
+	appKey       string
+	appSecret    string
+	refreshToken string
+	// The short-lived access token, once it has been fetched
+	accessToken string
+}
+
+func (b *dropboxBackend) token() (string, error) {
+	if b.accessToken != "" {
+		return b.accessToken, nil
+	}
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {b.refreshToken},
+	}
+	req, err := http.NewRequest("POST", dropboxTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(b.appKey, b.appSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Dropbox refused the refresh token: %d", res.StatusCode)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	b.accessToken = body.AccessToken
+	return b.accessToken, nil
+}
+
+// call calls the RPC endpoint, e.g. "files/list_folder", decoding its response into out.
+func (b *dropboxBackend) call(endpoint string, in, out interface{}) error {
+	token, err := b.token()
+	if err != nil {
+		return err
+	}
+	reqJSON, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", dropboxAPIURL+endpoint, bytes.NewReader(reqJSON))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("Request error: %d %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+type dropboxListing struct {
+	Entries []struct {
+		Tag  string `json:".tag"`
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+	} `json:"entries"`
+	Cursor  string `json:"cursor"`
+	HasMore bool   `json:"has_more"`
+}
+
+func (b *dropboxBackend) list() ([]remoteFile, error) {
+	var files []remoteFile
+	var listing dropboxListing
+	// Dropbox's root folder is "", not "/"
+	err := b.call("files/list_folder", map[string]interface{}{"path": strings.TrimSuffix(b.dir, "/")}, &listing)
+	for {
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range listing.Entries {
+			if e.Tag == "file" {
+				files = append(files, remoteFile{Name: e.Name, Size: e.Size})
+			}
+		}
+		if !listing.HasMore {
+			return files, nil
+		}
+		cursor := listing.Cursor
+		listing = dropboxListing{}
+		err = b.call("files/list_folder/continue", map[string]string{"cursor": cursor}, &listing)
+	}
+}
+
+func (b *dropboxBackend) download(name string, maxSize int64) ([]byte, error) {
+	token, err := b.token()
+	if err != nil {
+		return nil, err
+	}
+	arg, err := json.Marshal(map[string]string{"path": path.Join(b.dir, name)})
+	if err != nil {
+		return nil, err
+	}
+	// Headers can only be ASCII, so Dropbox wants the rest escaped as it would be in JSON
+	var escaped strings.Builder
+	for _, r := range string(arg) {
+		if r < 0x80 {
+			escaped.WriteRune(r)
+		} else {
+			for _, u := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&escaped, "\\u%04x", u)
+			}
+		}
+	}
+	req, err := http.NewRequest("POST", dropboxContentURL+"files/download", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Dropbox-API-Arg", escaped.String())
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	return readLimited(res.Body, maxSize)
+}
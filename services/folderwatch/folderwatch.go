@@ -0,0 +1,428 @@
+// Package folderwatch implements a Service which announces new files in SFTP, WebDAV and Dropbox
+// folders.
+package folderwatch
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Folder watch service
+const ServiceType = "folderwatch"
+
+const (
+	defaultPollInterval = 5 * time.Minute
+	minPollIntervalMins = 1
+	// How many new files are announced each poll, so that a bulk upload doesn't flood rooms
+	maxFilesPerPoll = 10
+	// The largest files which can be uploaded into rooms
+	maxUploadLimit = 50 * 1024 * 1024
+)
+
+// Service contains the Config fields for the Folder watch service.
+//
+// Each folder is checked for new files, which are announced to its rooms. Only the files directly
+// in the folder are watched, not those in its subfolders. Files can be limited to those whose
+// names match one of the "include" glob patterns, e.g. "*.pdf", and none of the "exclude" ones.
+// Files no larger than "upload_max_size" bytes are uploaded into the rooms as well.
+//
+// Folders are one of:
+//  - "sftp", with a URL like "sftp://user@host:22/path". OpenSSH's sftp command is used, so the
+//    host must be in Go-NEB's known_hosts, and its key must be the default or "identity_file".
+//  - "webdav", with the folder's URL, e.g. on Nextcloud
+//    "https://cloud.example.com/remote.php/dav/files/alice/Reports/", and optionally a
+//    username and password.
+//  - "dropbox", with its path, e.g. "/Reports", and the app key, app secret and OAuth refresh
+//    token of a Dropbox app which can read files.
+//
+// The files already in a folder when it is added are not announced.
+//
+// Example JSON request:
+//   {
+//       "folders": {
+//           "reports": {
+//               "type": "webdav",
+//               "url": "https://cloud.example.com/remote.php/dav/files/alice/Reports/",
+//               "username": "alice",
+//               "password": "app-password",
+//               "include": ["*.pdf"],
+//               "upload_max_size": 1048576,
+//               "rooms": ["!reports:localhost"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. How often to check the folders for new files, in minutes. Defaults to 5.
+	PollIntervalMins int `json:"poll_interval_mins"`
+	// Optional. The path to the sftp command. Defaults to "sftp".
+	SFTPPath string `json:"sftp_path"`
+	// The folders to watch, keyed by the name they are announced with.
+	Folders map[string]Folder `json:"folders"`
+}
+
+// Folder is a remote folder, and which of its new files are announced where.
+type Folder struct {
+	// "sftp", "webdav" or "dropbox".
+	Type string `json:"type"`
+	// The folder's URL, for sftp and webdav.
+	URL string `json:"url"`
+	// The folder's path, for dropbox.
+	Path string `json:"path"`
+	// Optional. The SSH private key to use, for sftp.
+	IdentityFile string `json:"identity_file"`
+	// Optional. The username and password, for webdav.
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// The app key, app secret and refresh token of the Dropbox app, for dropbox.
+	AppKey       string `json:"app_key"`
+	AppSecret    string `json:"app_secret"`
+	RefreshToken string `json:"refresh_token"`
+	// Optional. Glob patterns, at least one of which a file's name must match. Defaults to every
+	// file.
+	Include []string `json:"include"`
+	// Optional. Glob patterns which a file's name must not match.
+	Exclude []string `json:"exclude"`
+	// Optional. The largest files which are uploaded into the rooms, in bytes. Defaults to 0, for
+	// none.
+	UploadMaxSize int64 `json:"upload_max_size"`
+	// The rooms to announce new files to.
+	Rooms []id.RoomID `json:"rooms"`
+}
+
+// watches returns whether the file's name matches the folder's patterns.
+func (f *Folder) watches(name string) bool {
+	for _, pattern := range f.Exclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// backend returns the backend the folder is listed with.
+func (s *Service) backend(f *Folder) backend {
+	switch f.Type {
+	case "sftp":
+		u, _ := url.Parse(f.URL)
+		return newSFTPBackend(s.sftpPath(), u, f.IdentityFile)
+	case "webdav":
+		folderURL := f.URL
+		if !strings.HasSuffix(folderURL, "/") {
+			folderURL += "/"
+		}
+		return &webDAVBackend{url: folderURL, username: f.Username, password: f.Password}
+	default:
+		return &dropboxBackend{
+			dir:          "/" + strings.Trim(f.Path, "/"),
+			appKey:       f.AppKey,
+			appSecret:    f.AppSecret,
+			refreshToken: f.RefreshToken,
+		}
+	}
+}
+
+func (s *Service) sftpPath() string {
+	if s.SFTPPath == "" {
+		return "sftp"
+	}
+	return s.SFTPPath
+}
+
+func (s *Service) pollInterval() time.Duration {
+	if s.PollIntervalMins <= 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(s.PollIntervalMins) * time.Minute
+}
+
+// OnPoll announces the files which have been added to the folders since the last poll.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	s.check(cli)
+	return time.Now().Add(s.pollInterval())
+}
+
+func (s *Service) check(cli types.MatrixClient) {
+	var names []string
+	for name := range s.Folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		folder := s.Folders[name]
+		if err := s.checkFolder(cli, name, &folder); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey:   err,
+				"service_id":   s.ServiceID(),
+				"service_type": s.ServiceType(),
+				"folder":       name,
+			}).Error("Failed to check folder")
+		}
+	}
+}
+
+// checkFolder announces the folder's new files. The names of the files in the folder are stored
+// in the service state under "files <name>", so a file which is deleted and added again is
+// announced again.
+func (s *Service) checkFolder(cli types.MatrixClient, name string, folder *Folder) error {
+	b := s.backend(folder)
+	files, err := b.list()
+	if err != nil {
+		return err
+	}
+	stateKey := "files " + name
+	known, err := s.loadFiles(stateKey)
+	if err != nil {
+		return err
+	}
+	var current []string
+	var added []remoteFile
+	for _, f := range files {
+		current = append(current, f.Name)
+		if known != nil && !known[f.Name] && folder.watches(f.Name) {
+			added = append(added, f)
+		}
+	}
+	// Remember the files first, so that they aren't announced again if sending fails
+	if err = s.storeFiles(stateKey, current); err != nil {
+		return err
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].Name < added[j].Name })
+
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"folder":     name,
+	})
+	var more int
+	if len(added) > maxFilesPerPoll {
+		more = len(added) - maxFilesPerPoll
+		added = added[:maxFilesPerPoll]
+	}
+	content := filesContent(name, added, more)
+	for _, roomID := range folder.Rooms {
+		if _, err := notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: content}); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to announce new files")
+		}
+	}
+
+	mediaCli, ok := cli.(types.MediaUploader)
+	if folder.UploadMaxSize <= 0 || !ok {
+		return nil
+	}
+	for _, f := range added {
+		if f.Size > folder.UploadMaxSize {
+			continue
+		}
+		fileContent, err := uploadFile(mediaCli, b, f, folder.UploadMaxSize)
+		if err != nil {
+			logger.WithError(err).WithField("file", f.Name).Error("Failed to upload file")
+			continue
+		}
+		for _, roomID := range folder.Rooms {
+			if _, err := notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: *fileContent}); err != nil {
+				logger.WithError(err).WithField("room_id", roomID).Error("Failed to send file")
+			}
+		}
+	}
+	return nil
+}
+
+// filesContent returns a message listing the new files in the folder.
+func filesContent(folderName string, files []remoteFile, more int) mevt.MessageEventContent {
+	title := fmt.Sprintf("New files in %s:", folderName)
+	if len(files) == 1 && more == 0 {
+		title = fmt.Sprintf("New file in %s:", folderName)
+	}
+	lines := []string{"📂 " + title}
+	htmlLines := []string{"📂 " + html.EscapeString(title)}
+	for _, f := range files {
+		line := fmt.Sprintf("%s (%s)", f.Name, formatSize(f.Size))
+		lines = append(lines, " - "+line)
+		htmlLines = append(htmlLines, "<li>"+html.EscapeString(line)+"</li>")
+	}
+	if more > 0 {
+		line := fmt.Sprintf("…and %d more", more)
+		lines = append(lines, " - "+line)
+		htmlLines = append(htmlLines, "<li>"+html.EscapeString(line)+"</li>")
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: htmlLines[0] + "<ul>" + strings.Join(htmlLines[1:], "") + "</ul>",
+	}
+}
+
+// uploadFile downloads the file and uploads it to Matrix, returning the message to send it in.
+func uploadFile(mediaCli types.MediaUploader, b backend, f remoteFile, maxSize int64) (*mevt.MessageEventContent, error) {
+	data, err := b.download(f.Name, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	contentType := mime.TypeByExtension(path.Ext(f.Name))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	resUpload, err := mediaCli.UploadBytes(data, contentType)
+	if err != nil {
+		return nil, err
+	}
+	msgType := mevt.MsgFile
+	if strings.HasPrefix(contentType, "image/") {
+		msgType = mevt.MsgImage
+	}
+	return &mevt.MessageEventContent{
+		MsgType: msgType,
+		Body:    f.Name,
+		URL:     resUpload.ContentURI.CUString(),
+		Info: &mevt.FileInfo{
+			MimeType: contentType,
+			Size:     len(data),
+		},
+	}, nil
+}
+
+// formatSize returns the number of bytes in a human-readable way, e.g. "1.5 MB".
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// loadFiles returns the names of the files which were in the folder last time, or nil if it has
+// never been checked.
+func (s *Service) loadFiles(stateKey string) (map[string]bool, error) {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), stateKey)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	if err = json.Unmarshal(stateJSON, &names); err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool)
+	for _, name := range names {
+		files[name] = true
+	}
+	return files, nil
+}
+
+func (s *Service) storeFiles(stateKey string, names []string) error {
+	if names == nil {
+		names = []string{}
+	}
+	sort.Strings(names)
+	stateJSON, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), stateKey, stateJSON)
+}
+
+// Register makes sure that the folders are configured properly, and joins their rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.PollIntervalMins < 0 || (s.PollIntervalMins > 0 && s.PollIntervalMins < minPollIntervalMins) {
+		return fmt.Errorf("poll_interval_mins can't be less than %d", minPollIntervalMins)
+	}
+	if len(s.Folders) == 0 {
+		return fmt.Errorf("At least one folder is required")
+	}
+	rooms := make(map[id.RoomID]bool)
+	for name, f := range s.Folders {
+		if err := s.validateFolder(&f); err != nil {
+			return fmt.Errorf("Bad folder '%s': %s", name, err)
+		}
+		for _, roomID := range f.Rooms {
+			rooms[roomID] = true
+		}
+	}
+	for roomID := range rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func (s *Service) validateFolder(f *Folder) error {
+	switch f.Type {
+	case "sftp":
+		u, err := url.Parse(f.URL)
+		if err != nil || u.Scheme != "sftp" || u.Hostname() == "" || strings.HasPrefix(u.Hostname(), "-") {
+			return fmt.Errorf("url must be like sftp://user@host/path")
+		}
+		if _, err := exec.LookPath(s.sftpPath()); err != nil {
+			return fmt.Errorf("Cannot find sftp: %s", err)
+		}
+	case "webdav":
+		u, err := url.Parse(f.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url must be an http or https URL")
+		}
+	case "dropbox":
+		if f.AppKey == "" || f.AppSecret == "" || f.RefreshToken == "" {
+			return fmt.Errorf("An app_key, app_secret and refresh_token are required")
+		}
+	default:
+		return fmt.Errorf("Unknown type '%s': must be sftp, webdav or dropbox", f.Type)
+	}
+	for _, pattern := range append(f.Include, f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Bad pattern '%s': %s", pattern, err)
+		}
+	}
+	if f.UploadMaxSize < 0 || f.UploadMaxSize > maxUploadLimit {
+		return fmt.Errorf("upload_max_size must be between 0 and %d", maxUploadLimit)
+	}
+	if len(f.Rooms) == 0 {
+		return fmt.Errorf("No rooms to announce new files to")
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
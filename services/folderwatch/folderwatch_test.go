@@ -0,0 +1,186 @@
+package folderwatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const davFile = `<d:response><d:href>/dav/Reports/%s</d:href><d:propstat><d:prop>
+	<d:resourcetype/><d:getcontentlength>%d</d:getcontentlength></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`
+
+func TestPoll(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	davFiles := []string{fmt.Sprintf(davFile, "old.pdf", 10)}
+	dropboxPages := []string{
+		`{"entries": [{".tag": "file", "name": "map.png", "size": 5}], "cursor": "c1", "has_more": false}`,
+	}
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		body, status := "", 200
+		switch {
+		case req.Method == "PROPFIND" && req.URL.String() == "https://dav.hyrule/dav/Reports/":
+			if user, pass, _ := req.BasicAuth(); user != "zelda" || pass != "triforce" || req.Header.Get("Depth") != "1" {
+				return nil, fmt.Errorf("Bad PROPFIND: %v", req.Header)
+			}
+			body, status = `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">
+				<d:response><d:href>/dav/Reports/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop>
+				<d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>
+				<d:response><d:href>/dav/Reports/Archive/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop>
+				<d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`+strings.Join(davFiles, "")+`</d:multistatus>`, 207
+		case req.URL.String() == "https://api.dropboxapi.com/oauth2/token":
+			body = `{"access_token": "sheikah_slate", "expires_in": 14400}`
+		case req.URL.String() == "https://api.dropboxapi.com/2/files/list_folder":
+			if req.Header.Get("Authorization") != "Bearer sheikah_slate" {
+				return nil, fmt.Errorf("Bad token: %s", req.Header.Get("Authorization"))
+			}
+			body = dropboxPages[0]
+		case req.URL.String() == "https://api.dropboxapi.com/2/files/list_folder/continue":
+			body = dropboxPages[1]
+		case req.URL.String() == "https://content.dropboxapi.com/2/files/download":
+			if req.Header.Get("Dropbox-API-Arg") != `{"path":"/Maps/temple_\u00e9.png"}` {
+				return nil, fmt.Errorf("Bad download: %s", req.Header.Get("Dropbox-API-Arg"))
+			}
+			body = "\x89PNG\r\n\x1a\n"
+		default:
+			return nil, fmt.Errorf("Unknown request: %s %s", req.Method, req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: status,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	var sent []string
+	var uploads int
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		if strings.Contains(req.URL.String(), "/upload") {
+			uploads++
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://hyrule/temple"}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, fmt.Sprintf("%s %s %s", room, msg.MsgType, msg.Body))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$file:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"folders": {
+			"Reports": {
+				"type": "webdav",
+				"url": "https://dav.hyrule/dav/Reports",
+				"username": "zelda",
+				"password": "triforce",
+				"include": ["*.pdf", "*.csv"],
+				"exclude": ["draft*"],
+				"rooms": ["!reports:hyrule"]
+			},
+			"Maps": {
+				"type": "dropbox",
+				"path": "/Maps/",
+				"app_key": "key",
+				"app_secret": "secret",
+				"refresh_token": "refresh",
+				"upload_max_size": 100,
+				"rooms": ["!maps:hyrule"]
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create folderwatch service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register folderwatch service: ", err)
+	}
+	s := srv.(*Service)
+
+	s.check(matrixCli)
+	if len(sent) != 0 {
+		t.Errorf("Announced files which were in the folders before they were added: %v", sent)
+	}
+
+	davFiles = append(davFiles,
+		fmt.Sprintf(davFile, "q1%20report.pdf", 1572864),
+		fmt.Sprintf(davFile, "draft.pdf", 10),
+		fmt.Sprintf(davFile, "notes.txt", 10))
+	dropboxPages = []string{
+		`{"entries": [{".tag": "file", "name": "map.png", "size": 5}, {".tag": "folder", "name": "Old"}], "cursor": "c1", "has_more": true}`,
+		`{"entries": [{".tag": "file", "name": "temple_é.png", "size": 8}, {".tag": "file", "name": "huge.png", "size": 1000}], "cursor": "c2", "has_more": false}`,
+	}
+	s.check(matrixCli)
+	s.check(matrixCli)
+
+	want := []string{
+		"!maps:hyrule m.notice 📂 New files in Maps:\n - huge.png (1000 bytes)\n - temple_é.png (8 bytes)",
+		"!maps:hyrule m.image temple_é.png",
+		"!reports:hyrule m.notice 📂 New file in Reports:\n - q1 report.pdf (1.5 MB)",
+	}
+	if strings.Join(sent, "\n\n") != strings.Join(want, "\n\n") {
+		t.Errorf("Bad messages: got %q, want %q", sent, want)
+	}
+	if uploads != 1 {
+		t.Errorf("Expected one file to be uploaded, got %d", uploads)
+	}
+}
+
+func TestParseSFTPListing(t *testing.T) {
+	out := `sftp> ls -ln "/reports"
+drwxr-xr-x    2 1000     1000         4096 Mar 15 10:00 /reports/archive
+-rw-r--r--    1 1000     1000         1234 Mar 15 10:00 /reports/q1 report.pdf
+-rw-r--r--    1 1000     1000           12 Jan  2  2020 /reports/old.csv
+`
+	files := parseSFTPListing(out)
+	want := []remoteFile{{"q1 report.pdf", 1234}, {"old.csv", 12}}
+	if fmt.Sprint(files) != fmt.Sprint(want) {
+		t.Errorf("Bad listing: got %v, want %v", files, want)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"folders": {"a": {"type": "ftp", "url": "ftp://hyrule/", "rooms": ["!a:hyrule"]}}}`,
+		`{"folders": {"a": {"type": "webdav", "url": "https://dav.hyrule/"}}}`,
+		`{"folders": {"a": {"type": "webdav", "url": "dav.hyrule/files", "rooms": ["!a:hyrule"]}}}`,
+		`{"folders": {"a": {"type": "sftp", "url": "sftp://-oProxyCommand=evil/", "rooms": ["!a:hyrule"]}}}`,
+		`{"folders": {"a": {"type": "dropbox", "path": "/", "app_key": "key", "rooms": ["!a:hyrule"]}}}`,
+		`{"folders": {"a": {"type": "webdav", "url": "https://dav.hyrule/", "include": ["[a"], "rooms": ["!a:hyrule"]}}}`,
+		`{"folders": {"a": {"type": "webdav", "url": "https://dav.hyrule/", "upload_max_size": -1, "rooms": ["!a:hyrule"]}}}`,
+		`{"poll_interval_mins": -1, "folders": {"a": {"type": "webdav", "url": "https://dav.hyrule/", "rooms": ["!a:hyrule"]}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create folderwatch service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Package food implements a Service which looks up recipes and nutrition facts.
+package food
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Food service
+const ServiceType = "food"
+
+// How many ingredients recipe cards list before saying how many more there are
+const maxIngredients = 8
+
+// Service contains the Config fields for the Food service.
+//
+// This service looks up recipes with "!recipe dish", and responds with a card showing a picture
+// of the dish, how long it takes, the ingredients and a link to the method. "!nutrition food"
+// responds with the calories, fat, protein and carbohydrates in the food, e.g. "1 cup of rice".
+//
+// The lookups use either Spoonacular (https://spoonacular.com/food-api) or Edamam
+// (https://developer.edamam.com/). Edamam has separate applications for recipe search and
+// nutrition analysis, which have their own IDs and keys.
+//
+// Example JSON request:
+//   {
+//       "provider": "spoonacular",
+//       "api_key": "0123456789abcdef"
+//   }
+// Or:
+//   {
+//       "provider": "edamam",
+//       "recipe_app_id": "a1b2c3d4",
+//       "recipe_app_key": "0123456789abcdef",
+//       "nutrition_app_id": "e5f6a7b8",
+//       "nutrition_app_key": "fedcba9876543210"
+//   }
+type Service struct {
+	types.DefaultService
+	// The lookup provider: "spoonacular" or "edamam".
+	Provider string `json:"provider"`
+	// The Spoonacular API key. Required for the spoonacular provider.
+	APIKey string `json:"api_key"`
+	// The Edamam recipe search application. Required for "!recipe" with the edamam provider.
+	RecipeAppID  string `json:"recipe_app_id"`
+	RecipeAppKey string `json:"recipe_app_key"`
+	// The Edamam nutrition analysis application. Required for "!nutrition" with the edamam provider.
+	NutritionAppID  string `json:"nutrition_app_id"`
+	NutritionAppKey string `json:"nutrition_app_key"`
+}
+
+// Commands supported:
+//    !recipe dish
+// Responds with a card describing a recipe for the dish.
+//    !nutrition food
+// Responds with the nutrition facts of the food.
+func (s *Service) Commands(client types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"recipe"},
+			Arguments: []string{"dish"},
+			Help:      "Find a recipe",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdRecipe(client, args)
+			},
+		},
+		{
+			Path:      []string{"nutrition"},
+			Arguments: []string{"food"},
+			Help:      "Look up the nutrition facts of a food",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdNutrition(args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdRecipe(client types.MatrixClient, args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Usage: !recipe dish")
+	}
+	dish := strings.Join(args, " ")
+	r, err := s.provider().recipe(dish)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find a recipe for %s: %s", dish, err)
+	}
+	if r == nil {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("No recipes found for %s!", dish),
+		}, nil
+	}
+
+	lines := []string{r.Title}
+	htmlLines := []string{fmt.Sprintf(
+		"<a href=\"%s\"><strong>%s</strong></a>", html.EscapeString(r.URL), html.EscapeString(r.Title),
+	)}
+	var facts []string
+	if r.ReadyInMinutes > 0 {
+		facts = append(facts, fmt.Sprintf("Ready in %d minutes", r.ReadyInMinutes))
+	}
+	if r.Servings > 0 {
+		facts = append(facts, fmt.Sprintf("Serves %d", r.Servings))
+	}
+	if len(facts) > 0 {
+		lines = append(lines, strings.Join(facts, " · "))
+		htmlLines = append(htmlLines, html.EscapeString(strings.Join(facts, " · ")))
+	}
+	if len(r.Ingredients) > 0 {
+		ingredients := "Ingredients: " + summariseIngredients(r.Ingredients)
+		lines = append(lines, ingredients)
+		htmlLines = append(htmlLines, html.EscapeString(ingredients))
+	}
+	lines = append(lines, r.URL)
+
+	// The picture goes at the top of the card, if it can be uploaded
+	if r.ImageURL != "" {
+		if resUpload, err := client.UploadLink(r.ImageURL); err != nil {
+			log.WithError(err).WithField("url", r.ImageURL).Warn("Failed to upload recipe image")
+		} else {
+			htmlLines[0] = fmt.Sprintf(
+				"<img src=\"%s\" alt=\"%s\" height=\"200\"><br>", resUpload.ContentURI.CUString(), html.EscapeString(r.Title),
+			) + htmlLines[0]
+		}
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: strings.Join(htmlLines, "<br>"),
+	}, nil
+}
+
+// summariseIngredients lists the first few ingredients, e.g. "flour, eggs and 3 more".
+func summariseIngredients(ingredients []string) string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range ingredients {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if len(names) > maxIngredients {
+		return strings.Join(names[:maxIngredients], ", ") + fmt.Sprintf(" and %d more", len(names)-maxIngredients)
+	}
+	if len(names) > 1 {
+		return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+	}
+	return strings.Join(names, "")
+}
+
+func (s *Service) cmdNutrition(args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Usage: !nutrition food")
+	}
+	food := strings.Join(args, " ")
+	n, err := s.provider().nutrition(food)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up %s: %s", food, err)
+	}
+	if n == nil {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("No nutrition facts found for %s!", food),
+		}, nil
+	}
+	facts := fmt.Sprintf(
+		"%.0f kcal · Fat %.1f g · Protein %.1f g · Carbohydrates %.1f g", n.Calories, n.Fat, n.Protein, n.Carbs,
+	)
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          fmt.Sprintf("%s\n%s", food, facts),
+		Format:        mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf("<strong>%s</strong><br>%s", html.EscapeString(food), html.EscapeString(facts)),
+	}, nil
+}
+
+func (s *Service) provider() provider {
+	if s.Provider == "edamam" {
+		return &edamamProvider{
+			recipeAppID:     s.RecipeAppID,
+			recipeAppKey:    s.RecipeAppKey,
+			nutritionAppID:  s.NutritionAppID,
+			nutritionAppKey: s.NutritionAppKey,
+		}
+	}
+	return &spoonacularProvider{apiKey: s.APIKey}
+}
+
+// Register makes sure that the provider is configured.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	switch s.Provider {
+	case "spoonacular":
+		if s.APIKey == "" {
+			return fmt.Errorf("An api_key is required for the spoonacular provider")
+		}
+	case "edamam":
+		recipes := s.RecipeAppID != "" && s.RecipeAppKey != ""
+		nutrition := s.NutritionAppID != "" && s.NutritionAppKey != ""
+		if !recipes && !nutrition {
+			return fmt.Errorf("The edamam provider needs a recipe_app_id and recipe_app_key, or a nutrition_app_id and nutrition_app_key, or both")
+		}
+	default:
+		return fmt.Errorf("Unknown provider '%s': must be spoonacular or edamam", s.Provider)
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package food
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func createService(t *testing.T, config string) *Service {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+	if err != nil {
+		t.Fatal("Failed to create food service: ", err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register food service: ", err)
+	}
+	return srv.(*Service)
+}
+
+func TestFood(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch req.URL.String() {
+		case "https://api.spoonacular.com/recipes/complexSearch?apiKey=secret&number=1&query=pumpkin+soup":
+			body = `{"results":[{"id":42,"title":"Pumpkin Soup"}]}`
+		case "https://api.spoonacular.com/recipes/42/information?apiKey=secret":
+			body = `{"title":"Pumpkin Soup","image":"https://img.example/42.jpg","sourceUrl":"https://food.example/soup",
+				"readyInMinutes":45,"servings":4,"extendedIngredients":[{"name":"pumpkin"},{"name":"Onion"},{"name":"onion"},
+				{"name":"stock"},{"name":"cream"},{"name":"salt"},{"name":"pepper"},{"name":"nutmeg"},{"name":"butter"},
+				{"name":"garlic"}]}`
+		case "https://api.spoonacular.com/recipes/guessNutrition?apiKey=secret&title=rock":
+			body = `{"calories":{"value":0},"fat":{"value":0},"protein":{"value":0},"carbs":{"value":0}}`
+		case "https://api.edamam.com/api/recipes/v2?app_id=rid&app_key=rkey&q=omelette&type=public":
+			body = `{"hits":[{"recipe":{"label":"Omelette","url":"https://food.example/omelette","yield":1,
+				"totalTime":0,"ingredients":[{"food":"eggs"},{"food":"butter"}]}}]}`
+		case "https://api.edamam.com/api/nutrition-data?app_id=nid&app_key=nkey&ingr=1+apple":
+			body = `{"calories":95,"totalNutrients":{"FAT":{"quantity":0.31},"PROCNT":{"quantity":0.47},
+				"CHOCDF":{"quantity":25.13}}}`
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() == "https://img.example/42.jpg" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("some image data")),
+			}, nil
+		} else if strings.Contains(req.URL.String(), "_matrix/media/r0/upload") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://foo/soup"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	spoonacular := createService(t, `{"provider":"spoonacular","api_key":"secret"}`)
+	res, err := spoonacular.cmdRecipe(matrixCli, []string{"pumpkin", "soup"})
+	if err != nil {
+		t.Fatalf("!recipe failed: %s", err)
+	}
+	content := res.(*mevt.MessageEventContent)
+	want := "Pumpkin Soup\nReady in 45 minutes · Serves 4\n" +
+		"Ingredients: pumpkin, onion, stock, cream, salt, pepper, nutmeg, butter and 1 more\nhttps://food.example/soup"
+	if content.Body != want {
+		t.Errorf("Bad recipe: got %q, want %q", content.Body, want)
+	}
+	if !strings.HasPrefix(content.FormattedBody, `<img src="mxc://foo/soup"`) {
+		t.Errorf("Expected the recipe card to have a picture, got %s", content.FormattedBody)
+	}
+	res, err = spoonacular.cmdNutrition([]string{"rock"})
+	if err != nil || res.(*mevt.MessageEventContent).Body != "No nutrition facts found for rock!" {
+		t.Errorf("Expected no nutrition facts for rock, got %v, %v", res, err)
+	}
+
+	edamam := createService(t, `{"provider":"edamam","recipe_app_id":"rid","recipe_app_key":"rkey",
+		"nutrition_app_id":"nid","nutrition_app_key":"nkey"}`)
+	res, err = edamam.cmdRecipe(matrixCli, []string{"omelette"})
+	if err != nil {
+		t.Fatalf("!recipe failed: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "Omelette\nServes 1\nIngredients: eggs and butter\nhttps://food.example/omelette" {
+		t.Errorf("Bad recipe: %q", body)
+	}
+	res, err = edamam.cmdNutrition([]string{"1", "apple"})
+	if err != nil {
+		t.Fatalf("!nutrition failed: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "1 apple\n95 kcal · Fat 0.3 g · Protein 0.5 g · Carbohydrates 25.1 g" {
+		t.Errorf("Bad nutrition facts: %q", body)
+	}
+
+	// Edamam services can be set up for only one of the commands
+	edamam = createService(t, `{"provider":"edamam","nutrition_app_id":"nid","nutrition_app_key":"nkey"}`)
+	if _, err = edamam.cmdRecipe(matrixCli, []string{"omelette"}); err == nil {
+		t.Errorf("Expected !recipe to fail without a recipe app")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{`{}`, `{"provider":"spoonacular"}`, `{"provider":"edamam","recipe_app_id":"rid"}`} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create food service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected Register(%s) to fail", config)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package food
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// The provider APIs. Overridden by tests.
+var (
+	spoonacularURL = "https://api.spoonacular.com/"
+	edamamURL      = "https://api.edamam.com/"
+)
+
+var httpClient = &http.Client{}
+
+// recipe is what the providers know about a recipe.
+type recipe struct {
+	Title string
+	// The URL of a picture of the dish, if there is one
+	ImageURL string
+	// The page with the method
+	URL string
+	// 0 if unknown
+	ReadyInMinutes int
+	Servings       int
+	// The names of the ingredients, e.g. "flour"
+	Ingredients []string
+}
+
+// nutrition is the nutrition facts of a food.
+type nutrition struct {
+	Calories float64
+	// In grams
+	Fat     float64
+	Protein float64
+	Carbs   float64
+}
+
+// A provider looks up recipes and nutrition facts. Both return nil if nothing was found.
+type provider interface {
+	recipe(dish string) (*recipe, error)
+	nutrition(food string) (*nutrition, error)
+}
+
+// spoonacularProvider uses the Spoonacular food API.
+type spoonacularProvider struct {
+	apiKey string
+}
+
+func (p *spoonacularProvider) recipe(dish string) (*recipe, error) {
+	q := url.Values{}
+	q.Set("query", dish)
+	q.Set("number", "1")
+	q.Set("apiKey", p.apiKey)
+	var search struct {
+		Results []struct {
+			ID int `json:"id"`
+		} `json:"results"`
+	}
+	if err := getJSON(spoonacularURL+"recipes/complexSearch?"+q.Encode(), &search); err != nil {
+		return nil, err
+	}
+	if len(search.Results) == 0 {
+		return nil, nil
+	}
+
+	// Searches don't include the ingredients
+	q = url.Values{}
+	q.Set("apiKey", p.apiKey)
+	var info struct {
+		Title               string `json:"title"`
+		Image               string `json:"image"`
+		SourceURL           string `json:"sourceUrl"`
+		SpoonacularURL      string `json:"spoonacularSourceUrl"`
+		ReadyInMinutes      int    `json:"readyInMinutes"`
+		Servings            int    `json:"servings"`
+		ExtendedIngredients []struct {
+			Name string `json:"name"`
+		} `json:"extendedIngredients"`
+	}
+	infoURL := spoonacularURL + "recipes/" + strconv.Itoa(search.Results[0].ID) + "/information?" + q.Encode()
+	if err := getJSON(infoURL, &info); err != nil {
+		return nil, err
+	}
+	r := &recipe{
+		Title:          info.Title,
+		ImageURL:       info.Image,
+		URL:            info.SourceURL,
+		ReadyInMinutes: info.ReadyInMinutes,
+		Servings:       info.Servings,
+	}
+	if r.URL == "" {
+		r.URL = info.SpoonacularURL
+	}
+	for _, ingredient := range info.ExtendedIngredients {
+		r.Ingredients = append(r.Ingredients, ingredient.Name)
+	}
+	return r, nil
+}
+
+func (p *spoonacularProvider) nutrition(food string) (*nutrition, error) {
+	q := url.Values{}
+	q.Set("title", food)
+	q.Set("apiKey", p.apiKey)
+	type amount struct {
+		Value float64 `json:"value"`
+	}
+	var guess struct {
+		Calories amount `json:"calories"`
+		Fat      amount `json:"fat"`
+		Protein  amount `json:"protein"`
+		Carbs    amount `json:"carbs"`
+	}
+	if err := getJSON(spoonacularURL+"recipes/guessNutrition?"+q.Encode(), &guess); err != nil {
+		return nil, err
+	}
+	if guess.Calories.Value == 0 && guess.Fat.Value == 0 && guess.Protein.Value == 0 && guess.Carbs.Value == 0 {
+		return nil, nil
+	}
+	return &nutrition{
+		Calories: guess.Calories.Value,
+		Fat:      guess.Fat.Value,
+		Protein:  guess.Protein.Value,
+		Carbs:    guess.Carbs.Value,
+	}, nil
+}
+
+// edamamProvider uses the Edamam recipe search and nutrition analysis APIs, which have separate
+// application IDs and keys.
+type edamamProvider struct {
+	recipeAppID, recipeAppKey       string
+	nutritionAppID, nutritionAppKey string
+}
+
+func (p *edamamProvider) recipe(dish string) (*recipe, error) {
+	if p.recipeAppID == "" || p.recipeAppKey == "" {
+		return nil, fmt.Errorf("recipe search isn't configured")
+	}
+	q := url.Values{}
+	q.Set("type", "public")
+	q.Set("q", dish)
+	q.Set("app_id", p.recipeAppID)
+	q.Set("app_key", p.recipeAppKey)
+	var search struct {
+		Hits []struct {
+			Recipe struct {
+				Label       string  `json:"label"`
+				Image       string  `json:"image"`
+				URL         string  `json:"url"`
+				Yield       float64 `json:"yield"`
+				TotalTime   float64 `json:"totalTime"`
+				Ingredients []struct {
+					Food string `json:"food"`
+				} `json:"ingredients"`
+			} `json:"recipe"`
+		} `json:"hits"`
+	}
+	if err := getJSON(edamamURL+"api/recipes/v2?"+q.Encode(), &search); err != nil {
+		return nil, err
+	}
+	if len(search.Hits) == 0 {
+		return nil, nil
+	}
+	hit := search.Hits[0].Recipe
+	r := &recipe{
+		Title:          hit.Label,
+		ImageURL:       hit.Image,
+		URL:            hit.URL,
+		ReadyInMinutes: int(hit.TotalTime),
+		Servings:       int(hit.Yield),
+	}
+	for _, ingredient := range hit.Ingredients {
+		r.Ingredients = append(r.Ingredients, ingredient.Food)
+	}
+	return r, nil
+}
+
+func (p *edamamProvider) nutrition(food string) (*nutrition, error) {
+	if p.nutritionAppID == "" || p.nutritionAppKey == "" {
+		return nil, fmt.Errorf("nutrition analysis isn't configured")
+	}
+	q := url.Values{}
+	q.Set("ingr", food)
+	q.Set("app_id", p.nutritionAppID)
+	q.Set("app_key", p.nutritionAppKey)
+	type nutrient struct {
+		Quantity float64 `json:"quantity"`
+	}
+	var data struct {
+		Calories       float64 `json:"calories"`
+		TotalNutrients struct {
+			Fat     nutrient `json:"FAT"`
+			Protein nutrient `json:"PROCNT"`
+			Carbs   nutrient `json:"CHOCDF"`
+		} `json:"totalNutrients"`
+	}
+	if err := getJSON(edamamURL+"api/nutrition-data?"+q.Encode(), &data); err != nil {
+		return nil, err
+	}
+	// Foods which Edamam doesn't understand have no nutrients rather than an error
+	if data.Calories == 0 && data.TotalNutrients.Fat.Quantity == 0 && data.TotalNutrients.Protein.Quantity == 0 {
+		return nil, nil
+	}
+	return &nutrition{
+		Calories: data.Calories,
+		Fat:      data.TotalNutrients.Fat.Quantity,
+		Protein:  data.TotalNutrients.Protein.Quantity,
+		Carbs:    data.TotalNutrients.Carbs.Quantity,
+	}, nil
+}
+
+func getJSON(u string, out interface{}) error {
+	res, err := httpClient.Get(u)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
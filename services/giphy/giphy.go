@@ -2,14 +2,17 @@
 package giphy
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/uploadcache"
 	log "github.com/sirupsen/logrus"
 	"maunium.net/go/mautrix/event"
 	mevt "maunium.net/go/mautrix/event"
@@ -35,16 +38,35 @@ type result struct {
 	} `json:"images"`
 }
 
-type giphySearch struct {
-	Data result `json:"data"`
+type giphyResponse struct {
+	// An object for the translate and random endpoints, and a list for search. Giphy returns an
+	// empty list instead of an object if there are no results.
+	Data json.RawMessage `json:"data"`
 }
 
+var httpClient = &http.Client{}
+
+// The ratings Giphy supports, from most to least family friendly.
+var ratings = []string{"g", "pg", "pg-13", "r"}
+
+// How many results can be picked from with !giphy N query.
+const maxResultNumber = 50
+
+// Searches are cached for an hour unless configured otherwise, to make the most of the API key's
+// quota.
+const defaultCacheTTLMins = 60
+
 // Service contains the Config fields for the Giphy Service.
 //
 // Example request:
 //   {
 //       "api_key": "dc6zaTOxFJmzC",
-//       "use_downsized": false
+//       "use_downsized": false,
+//       "rating": "pg",
+//       "room_ratings": {
+//           "!kids:localhost": "g"
+//       },
+//       "cache_ttl_mins": 30
 //   }
 type Service struct {
 	types.DefaultService
@@ -55,11 +77,23 @@ type Service struct {
 	// Uses the original image when set to false.
 	// Defaults to false.
 	UseDownsized bool `json:"use_downsized"`
+	// The content rating of GIFs to return: "g", "pg", "pg-13" or "r". Defaults to "g".
+	Rating string `json:"rating"`
+	// Optional. The content rating to use in particular rooms, overriding Rating.
+	RoomRatings map[id.RoomID]string `json:"room_ratings"`
+	// Optional. Reuse the GIF uploaded for a search when the same search is made again within this
+	// many minutes, rather than searching and uploading it again. Random GIFs are never reused.
+	// Defaults to 60. Set to -1 to not cache GIFs.
+	CacheTTLMins int `json:"cache_ttl_mins"`
 }
 
 // Commands supported:
 //   !giphy some search query without quotes
 // Responds with a suitable GIF into the same room as the command.
+//   !giphy 3 some search query without quotes
+// Responds with the 3rd search result for the query.
+//   !giphy random some tag
+// Responds with a random GIF with the tag, or any random GIF if no tag is given.
 func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	return []types.Command{
 		types.Command{
@@ -68,28 +102,110 @@ func (s *Service) Commands(client types.MatrixClient) []types.Command {
 				return s.cmdGiphy(client, roomID, userID, args)
 			},
 		},
+		types.Command{
+			Path: []string{"giphy", "random"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGiphyRandom(client, roomID, userID, args)
+			},
+		},
+	}
+}
+
+// Register makes sure that the configured ratings are ones which Giphy supports.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.Rating != "" && !validRating(s.Rating) {
+		return fmt.Errorf("Invalid rating %q: must be one of %s", s.Rating, strings.Join(ratings, ", "))
+	}
+	for roomID, rating := range s.RoomRatings {
+		if !validRating(rating) {
+			return fmt.Errorf("Invalid rating %q for room %s: must be one of %s", rating, roomID, strings.Join(ratings, ", "))
+		}
 	}
+	return nil
+}
+
+func validRating(rating string) bool {
+	for _, r := range ratings {
+		if strings.EqualFold(r, rating) {
+			return true
+		}
+	}
+	return false
+}
+
+// ratingFor returns the content rating to use in the room.
+func (s *Service) ratingFor(roomID id.RoomID) string {
+	if rating := s.RoomRatings[roomID]; rating != "" {
+		return strings.ToLower(rating)
+	}
+	if s.Rating != "" {
+		return strings.ToLower(s.Rating)
+	}
+	return "g"
 }
 
 func (s *Service) cmdGiphy(client types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
-	// only 1 arg which is the text to search for.
-	query := strings.Join(args, " ")
-	gifResult, err := s.searchGiphy(query)
+	rating := s.ratingFor(roomID)
+	var query, kind string
+	var find func() (*result, error)
+	// !giphy N query picks the Nth search result
+	n, convErr := 0, error(nil)
+	if len(args) > 1 {
+		n, convErr = strconv.Atoi(args[0])
+	}
+	if len(args) > 1 && convErr == nil {
+		if n < 1 || n > maxResultNumber {
+			return nil, fmt.Errorf("Result number must be between 1 and %d", maxResultNumber)
+		}
+		query, kind = strings.Join(args[1:], " "), "search "+strconv.Itoa(n)
+		find = func() (*result, error) { return s.searchGiphy(query, n, rating) }
+	} else {
+		// only 1 arg which is the text to search for.
+		query, kind = strings.Join(args, " "), "translate"
+		find = func() (*result, error) { return s.translateGiphy(query, rating) }
+	}
+	key := uploadcache.Key(s.ServiceID(), fmt.Sprintf("%s %s %t", kind, rating, s.UseDownsized), query)
+	ttlMins := s.CacheTTLMins
+	if ttlMins == 0 {
+		ttlMins = defaultCacheTTLMins
+	}
+	msg, err := uploadcache.Fetch(key, time.Duration(ttlMins)*time.Minute, func() (mevt.MessageEventContent, error) {
+		gifResult, err := find()
+		if err != nil {
+			return mevt.MessageEventContent{}, err
+		}
+		return s.gifMessage(client, gifResult)
+	})
 	if err != nil {
 		return nil, err
 	}
+	return msg, nil
+}
 
+func (s *Service) cmdGiphyRandom(client types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	gifResult, err := s.randomGiphy(strings.Join(args, " "), s.ratingFor(roomID))
+	if err != nil {
+		return nil, err
+	}
+	msg, err := s.gifMessage(client, gifResult)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *Service) gifMessage(client types.MatrixClient, gifResult *result) (mevt.MessageEventContent, error) {
 	image := gifResult.Images.Original
 	if s.UseDownsized {
 		image = gifResult.Images.Downsized
 	}
 
 	if image.URL == "" {
-		return nil, fmt.Errorf("No results")
+		return mevt.MessageEventContent{}, fmt.Errorf("No results")
 	}
 	resUpload, err := client.UploadLink(image.URL)
 	if err != nil {
-		return nil, err
+		return mevt.MessageEventContent{}, err
 	}
 
 	return mevt.MessageEventContent{
@@ -105,31 +221,71 @@ func (s *Service) cmdGiphy(client types.MatrixClient, roomID id.RoomID, userID i
 	}, nil
 }
 
-// searchGiphy returns info about a gif
-func (s *Service) searchGiphy(query string) (*result, error) {
+// translateGiphy returns info about the gif which best matches the query
+func (s *Service) translateGiphy(query, rating string) (*result, error) {
 	log.Info("Searching giphy for ", query)
-	u, err := url.Parse("http://api.giphy.com/v1/gifs/translate")
+	return s.queryGiphy("translate", url.Values{
+		"s":      {query},
+		"rating": {rating},
+	})
+}
+
+// searchGiphy returns info about the nth gif in the search results for the query
+func (s *Service) searchGiphy(query string, n int, rating string) (*result, error) {
+	log.WithField("n", n).Info("Searching giphy for ", query)
+	return s.queryGiphy("search", url.Values{
+		"q":      {query},
+		"limit":  {"1"},
+		"offset": {strconv.Itoa(n - 1)},
+		"rating": {rating},
+	})
+}
+
+// randomGiphy returns info about a random gif with the tag, which may be empty
+func (s *Service) randomGiphy(tag, rating string) (*result, error) {
+	log.Info("Getting random giphy for ", tag)
+	params := url.Values{"rating": {rating}}
+	if tag != "" {
+		params.Set("tag", tag)
+	}
+	return s.queryGiphy("random", params)
+}
+
+func (s *Service) queryGiphy(endpoint string, params url.Values) (*result, error) {
+	u, err := url.Parse("http://api.giphy.com/v1/gifs/" + endpoint)
 	if err != nil {
 		return nil, err
 	}
-	q := u.Query()
-	q.Set("s", query)
-	q.Set("api_key", s.APIKey)
-	u.RawQuery = q.Encode()
-	res, err := http.Get(u.String())
+	params.Set("api_key", s.APIKey)
+	u.RawQuery = params.Encode()
+	res, err := httpClient.Get(u.String())
 	if res != nil {
 		defer res.Body.Close()
 	}
 	if err != nil {
 		return nil, err
 	}
-	var search giphySearch
-	if err := json.NewDecoder(res.Body).Decode(&search); err != nil {
-		// Giphy returns a JSON object which has { data: [] } if there are 0 results.
-		// This fails to be deserialised by Go.
-		return nil, fmt.Errorf("No results")
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Giphy responded with HTTP %d", res.StatusCode)
+	}
+	var giphyRes giphyResponse
+	if err := json.NewDecoder(res.Body).Decode(&giphyRes); err != nil {
+		return nil, err
+	}
+	var gif result
+	if bytes.HasPrefix(bytes.TrimSpace(giphyRes.Data), []byte("[")) {
+		var gifs []result
+		if err := json.Unmarshal(giphyRes.Data, &gifs); err != nil {
+			return nil, err
+		}
+		if len(gifs) == 0 {
+			return nil, fmt.Errorf("No results")
+		}
+		gif = gifs[0]
+	} else if err := json.Unmarshal(giphyRes.Data, &gif); err != nil {
+		return nil, err
 	}
-	return &search.Data, nil
+	return &gif, nil
 }
 
 func asInt(strInt string) int {
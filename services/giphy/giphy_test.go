@@ -0,0 +1,154 @@
+package giphy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const giphyImageURL = "https://media.giphy.com/media/hey/giphy.gif"
+
+var giphyResult = `{
+	"slug": "hey-listen",
+	"images": {
+		"original": {"url": "` + giphyImageURL + `", "width": "64", "height": "48", "size": "1234"},
+		"downsized": {"url": "` + giphyImageURL + `", "width": "32", "height": "24", "size": "123"}
+	}
+}`
+
+func TestCommand(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	var requests []*http.Request
+	giphyTrans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req)
+		if req.URL.Query().Get("api_key") != "secret" {
+			t.Fatalf("Bad api_key: got %s want secret", req.URL.Query().Get("api_key"))
+		}
+		var body string
+		switch req.URL.Path {
+		case "/v1/gifs/translate", "/v1/gifs/random":
+			body = `{"data":` + giphyResult + `}`
+		case "/v1/gifs/search":
+			body = `{"data":[` + giphyResult + `]}`
+		default:
+			t.Fatalf("Unexpected Giphy URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	// clobber the giphy service http client instance
+	httpClient = &http.Client{Transport: giphyTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@giphybot:hyrule", []byte(
+		`{"api_key":"secret","rating":"pg-13","room_ratings":{"!kids:hyrule":"g"}}`,
+	))
+	if err != nil {
+		t.Fatal("Failed to create Giphy service: ", err)
+	}
+	giphy := srv.(*Service)
+
+	// Mock the response from Matrix
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() == giphyImageURL { // getting the giphy image
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("some image data")),
+			}, nil
+		} else if strings.Contains(req.URL.String(), "_matrix/media/r0/upload") { // uploading the image to matrix
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://foo/bar"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@giphybot:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	cmds := giphy.Commands(matrixCli)
+	if len(cmds) != 2 {
+		t.Fatalf("Unexpected number of commands: %d", len(cmds))
+	}
+	giphyCmd, randomCmd := cmds[0], cmds[1]
+
+	testCases := []struct {
+		cmd        types.Command
+		roomID     id.RoomID
+		args       []string
+		wantPath   string
+		wantParams map[string]string
+		wantCached bool
+	}{
+		{giphyCmd, "!someroom:hyrule", []string{"hey", "listen!"}, "/v1/gifs/translate",
+			map[string]string{"s": "hey listen!", "rating": "pg-13"}, false},
+		// the same query in the same rating is served from the cache
+		{giphyCmd, "!otherroom:hyrule", []string{"hey", "listen!"}, "", nil, true},
+		// but not in a room with a different rating
+		{giphyCmd, "!kids:hyrule", []string{"hey", "listen!"}, "/v1/gifs/translate",
+			map[string]string{"s": "hey listen!", "rating": "g"}, false},
+		{giphyCmd, "!someroom:hyrule", []string{"3", "hey", "listen!"}, "/v1/gifs/search",
+			map[string]string{"q": "hey listen!", "offset": "2", "limit": "1", "rating": "pg-13"}, false},
+		// a lone number is a query like any other
+		{giphyCmd, "!someroom:hyrule", []string{"42"}, "/v1/gifs/translate",
+			map[string]string{"s": "42"}, false},
+		{randomCmd, "!someroom:hyrule", []string{"zelda"}, "/v1/gifs/random",
+			map[string]string{"tag": "zelda", "rating": "pg-13"}, false},
+		// random results are never cached
+		{randomCmd, "!someroom:hyrule", []string{"zelda"}, "/v1/gifs/random",
+			map[string]string{"tag": "zelda", "rating": "pg-13"}, false},
+	}
+	for _, tc := range testCases {
+		requests = nil
+		res, err := tc.cmd.Command(tc.roomID, "@navi:hyrule", tc.args)
+		if err != nil {
+			t.Fatalf("%v: Failed to process command: %s", tc.args, err)
+		}
+		content, ok := res.(mevt.MessageEventContent)
+		if !ok || content.MsgType != mevt.MsgImage || content.URL != "mxc://foo/bar" || content.Info.Width != 64 {
+			t.Errorf("%v: Unexpected response: %+v", tc.args, res)
+		}
+		if tc.wantCached {
+			if len(requests) != 0 {
+				t.Errorf("%v: expected a cached result, but Giphy was called: %v", tc.args, requests)
+			}
+			continue
+		}
+		if len(requests) != 1 {
+			t.Fatalf("%v: expected 1 Giphy request, got %d", tc.args, len(requests))
+		}
+		if requests[0].URL.Path != tc.wantPath {
+			t.Errorf("%v: got path %s want %s", tc.args, requests[0].URL.Path, tc.wantPath)
+		}
+		for k, v := range tc.wantParams {
+			if got := requests[0].URL.Query().Get(k); got != v {
+				t.Errorf("%v: got %s=%q want %q", tc.args, k, got, v)
+			}
+		}
+	}
+}
+
+func TestRegisterRejectsUnknownRatings(t *testing.T) {
+	for _, cfg := range []string{`{"rating":"nc-17"}`, `{"room_ratings":{"!a:hyrule":"x"}}`} {
+		srv, err := types.CreateService("id", ServiceType, "@giphybot:hyrule", []byte(cfg))
+		if err != nil {
+			t.Fatal("Failed to create Giphy service: ", err)
+		}
+		if err := srv.Register(nil, nil); err == nil {
+			t.Errorf("%s: expected Register to fail", cfg)
+		}
+	}
+}
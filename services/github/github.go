@@ -92,18 +92,27 @@ func (s *Service) requireGithubClientFor(userID id.UserID) (cli *gogithub.Client
 }
 
 const numberGithubSearchSummaries = 3
-const cmdGithubSearchUsage = `!github search "search query"`
+const cmdGithubSearchUsage = `!github search [owner/repo] "search query"`
+
+// searchQuery returns the Github search query for the args of !github search. If the first arg is
+// an owner/repo, the search is limited to the issues and pull requests of that repository.
+func searchQuery(args []string) string {
+	if len(args) > 1 && ownerRepoRegex.MatchString(args[0]) {
+		return "repo:" + args[0] + " " + strings.Join(args[1:], " ")
+	}
+	return strings.Join(args, " ")
+}
 
 func (s *Service) cmdGithubSearch(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
 	cli := s.githubClientFor(userID, true)
-	if len(args) < 2 {
+	if len(args) == 0 || (len(args) == 1 && ownerRepoRegex.MatchString(args[0])) {
 		return &mevt.MessageEventContent{
 			MsgType: mevt.MsgNotice,
 			Body:    "Usage: " + cmdGithubSearchUsage,
 		}, nil
 	}
 
-	query := strings.Join(args, " ")
+	query := searchQuery(args)
 	searchResult, res, err := cli.Search.Issues(context.Background(), query, nil)
 
 	if err != nil {
@@ -134,8 +143,12 @@ func (s *Service) cmdGithubSearch(roomID id.RoomID, userID id.UserID, args []str
 			continue
 		}
 		escapedTitle, escapedUserLogin := html.EscapeString(*issue.Title), html.EscapeString(*issue.User.Login)
-		htmlBuffer.WriteString(fmt.Sprintf(`<li><a href="%s" rel="noopener">%s: %s</a></li>`, *issue.HTMLURL, escapedUserLogin, escapedTitle))
-		plainBuffer.WriteString(fmt.Sprintf("%d. %s\n", i+1, *issue.HTMLURL))
+		state := ""
+		if issue.State != nil {
+			state = " [" + *issue.State + "]"
+		}
+		htmlBuffer.WriteString(fmt.Sprintf(`<li><a href="%s" rel="noopener">%s: %s</a>%s</li>`, *issue.HTMLURL, escapedUserLogin, escapedTitle, state))
+		plainBuffer.WriteString(fmt.Sprintf("%d. %s : %s%s\n", i+1, *issue.HTMLURL, *issue.Title, state))
 	}
 	htmlBuffer.WriteString("</ol>")
 
@@ -365,7 +378,13 @@ func (s *Service) cmdGithubAssign(roomID id.RoomID, userID id.UserID, args []str
 		return resp, nil
 	}
 
-	issue, res, err := cli.Issues.AddAssignees(context.Background(), owner, repo, issueNum, args[1:])
+	// Allow users to be given as @mentions, like on Github
+	var assignees []string
+	for _, assignee := range args[1:] {
+		assignees = append(assignees, strings.TrimPrefix(assignee, "@"))
+	}
+
+	issue, res, err := cli.Issues.AddAssignees(context.Background(), owner, repo, issueNum, assignees)
 
 	if err != nil {
 		log.WithField("err", err).Print("Failed to add issue assignees")
@@ -381,6 +400,66 @@ func (s *Service) cmdGithubAssign(roomID id.RoomID, userID id.UserID, args []str
 	}, nil
 }
 
+const cmdGithubLabelUsage = `!github label [owner/repo]#issue label ["another label"] [...]`
+
+func (s *Service) cmdGithubLabel(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(userID)
+	if cli == nil {
+		return resp, err
+	}
+	if len(args) < 1 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Usage: " + cmdGithubLabelUsage,
+		}, nil
+	} else if len(args) < 2 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Needs at least one label. Usage: " + cmdGithubLabelUsage,
+		}, nil
+	}
+
+	// get owner,repo,issue,resp out of args[0]
+	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, cmdGithubLabelUsage)
+	if resp != nil {
+		return resp, nil
+	}
+
+	// Github creates labels which don't exist yet, so check for them first to stop typos from
+	// cluttering the repository with new labels.
+	for _, label := range args[1:] {
+		_, res, err := cli.Issues.GetLabel(context.Background(), owner, repo, label)
+		if err != nil {
+			if res != nil && res.StatusCode == 404 {
+				return &mevt.MessageEventContent{
+					MsgType: mevt.MsgNotice,
+					Body:    fmt.Sprintf("%s/%s has no label called '%s'", owner, repo, label),
+				}, nil
+			}
+			log.WithField("err", err).Print("Failed to get label")
+			if res == nil {
+				return nil, fmt.Errorf("Failed to get label. Failed to connect to Github")
+			}
+			return nil, fmt.Errorf("Failed to get label. HTTP %d", res.StatusCode)
+		}
+	}
+
+	_, res, err := cli.Issues.AddLabelsToIssue(context.Background(), owner, repo, issueNum, args[1:])
+
+	if err != nil {
+		log.WithField("err", err).Print("Failed to add issue labels")
+		if res == nil {
+			return nil, fmt.Errorf("Failed to add issue labels. Failed to connect to Github")
+		}
+		return nil, fmt.Errorf("Failed to add issue labels. HTTP %d", res.StatusCode)
+	}
+
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Labelled %s/%s#%d with: %s", owner, repo, issueNum, strings.Join(args[1:], ", ")),
+	}, nil
+}
+
 func (s *Service) githubIssueCloseReopen(roomID id.RoomID, userID id.UserID, args []string, state, verb, help string) (interface{}, error) {
 	cli, resp, err := s.requireGithubClientFor(userID)
 	if cli == nil {
@@ -554,6 +633,10 @@ func (s *Service) expandCommit(roomID id.RoomID, userID id.UserID, owner, repo,
 }
 
 // Commands supported:
+//    !github search [owner/repo] "search query"
+// Responds with the most relevant issues and pull requests for the query, searching only the
+// repository if one is given. Private repositories are searched if the user has linked a Github
+// account which can see them.
 //    !github create owner/repo "issue title" "optional issue description"
 // Responds with the outcome of the issue creation request. This command requires
 // a Github account to be linked to the Matrix user ID issuing the command. If there
@@ -562,6 +645,10 @@ func (s *Service) expandCommit(roomID id.RoomID, userID id.UserID, owner, repo,
 // Responds with the outcome of the issue comment creation request. This command requires
 // a Github account to be linked to the Matrix user ID issuing the command. If there
 // is no link, it will return a Starter Link instead.
+//    !github label [owner/repo]#issue label ["another label"]
+//    !github assign [owner/repo]#issue username [username]
+// Label and assign issues and pull requests for triage. These commands also require a
+// linked Github account with push access to the repository.
 func (s *Service) Commands(cli types.MatrixClient) []types.Command {
 	return []types.Command{
 		{
@@ -594,6 +681,12 @@ func (s *Service) Commands(cli types.MatrixClient) []types.Command {
 				return s.cmdGithubAssign(roomID, userID, args)
 			},
 		},
+		{
+			Path: []string{"github", "label"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGithubLabel(roomID, userID, args)
+			},
+		},
 		{
 			Path: []string{"github", "close"},
 			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
@@ -612,10 +705,12 @@ func (s *Service) Commands(cli types.MatrixClient) []types.Command {
 				return &mevt.MessageEventContent{
 					MsgType: mevt.MsgNotice,
 					Body: strings.Join([]string{
+						cmdGithubSearchUsage,
 						cmdGithubCreateUsage,
 						cmdGithubReactUsage,
 						cmdGithubCommentUsage,
 						cmdGithubAssignUsage,
+						cmdGithubLabelUsage,
 						cmdGithubCloseUsage,
 						cmdGithubReopenUsage,
 					}, "\n"),
@@ -630,9 +725,19 @@ func (s *Service) Commands(cli types.MatrixClient) []types.Command {
 // Where #12 is an issue number or pull request. If there is a default repository set on the room,
 // it will also expand strings of the form:
 //   #12
-// using the default repository.
+// using the default repository. Links to issues, pull requests, commits and discussions, e.g.
+//   https://github.com/owner/repo/pull/12
+// are expanded into a preview of their title, state, author and labels, as well as the comment
+// linked to if there is one. A room can turn these previews off with the bot option:
+//   { github: { url_previews: false } }
 func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
 	return []types.Expansion{
+		types.Expansion{
+			Regexp: githubURLRegex,
+			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+				return s.expandURL(roomID, userID, matchingGroups)
+			},
+		},
 		types.Expansion{
 			Regexp: ownerRepoIssueRegex,
 			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
@@ -0,0 +1,270 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/database"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Matches links to issues, pull requests, commits and discussions, optionally to a comment on them.
+// E.g. https://github.com/owner/repo/pull/12#issuecomment-345 - Captured groups for
+// owner/repo/kind/number or sha/comment ID
+var githubURLRegex = regexp.MustCompile(
+	`https://github\.com/([A-z0-9-_.]+)/([A-z0-9-_.]+)/(issues|pull|commit|discussions)/([0-9a-fA-F]+)\b(?:[^\s#]*#(?:issuecomment|discussioncomment)-([0-9]+))?`,
+)
+
+// The longest comment excerpt included in a preview
+const maxCommentPreviewLength = 300
+
+// expandURL previews the issue, pull request, commit or discussion linked to, unless the room has
+// turned URL previews off.
+func (s *Service) expandURL(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+	if len(matchingGroups) != 6 {
+		log.WithField("groups", matchingGroups).Print("Unexpected number of groups")
+		return nil
+	}
+	if !s.urlPreviews(roomID) {
+		return nil
+	}
+	owner, repo, kind, ref, commentID := matchingGroups[1], matchingGroups[2], matchingGroups[3], matchingGroups[4], matchingGroups[5]
+	if kind == "commit" {
+		return s.expandCommit(roomID, userID, owner, repo, ref)
+	}
+	num, err := strconv.Atoi(ref)
+	if err != nil {
+		return nil // a sha-like string after /issues/
+	}
+	logger := log.WithFields(log.Fields{
+		"owner":  owner,
+		"repo":   repo,
+		"number": num,
+	})
+	cli := s.githubClientFor(userID, true)
+
+	var card *previewCard
+	if kind == "discussions" {
+		card, err = fetchDiscussionCard(cli, owner, repo, num)
+	} else {
+		card, err = fetchIssueCard(cli, owner, repo, num)
+	}
+	if err != nil {
+		logger.WithError(err).Print("Failed to fetch preview")
+		return nil
+	}
+	if commentID != "" && kind != "discussions" {
+		// Discussion comments can only be fetched by their GraphQL node ID, so they are previewed
+		// as the discussion itself.
+		if err = addIssueComment(cli, owner, repo, commentID, card); err != nil {
+			logger.WithError(err).WithField("comment_id", commentID).Print("Failed to fetch comment")
+		}
+	}
+	return card.message()
+}
+
+// urlPreviews returns false if the room has turned off previews of Github links with the bot option:
+//  { github: { url_previews: false } }
+func (s *Service) urlPreviews(roomID id.RoomID) bool {
+	opts, err := database.GetServiceDB().LoadBotOptions(s.ServiceUserID(), roomID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithError(err).WithField("room_id", roomID).Error("Failed to load bot options")
+		}
+		return true
+	}
+	ghOpts, ok := opts.Options["github"].(map[string]interface{})
+	if !ok {
+		return true
+	}
+	enabled, ok := ghOpts["url_previews"].(bool)
+	return !ok || enabled
+}
+
+// previewCard is the summary of an issue, pull request or discussion shown when it is linked to.
+type previewCard struct {
+	Ref     string // e.g. owner/repo#12
+	Kind    string // e.g. Issue, Pull request
+	Title   string
+	State   string
+	Author  string
+	Labels  []string
+	URL     string
+	Comment *previewComment
+}
+
+type previewComment struct {
+	Author string
+	Body   string
+	URL    string
+}
+
+func fetchIssueCard(cli *gogithub.Client, owner, repo string, num int) (*previewCard, error) {
+	i, _, err := cli.Issues.Get(context.Background(), owner, repo, num)
+	if err != nil {
+		return nil, err
+	}
+	card := &previewCard{
+		Ref:    fmt.Sprintf("%s/%s#%d", owner, repo, num),
+		Kind:   "Issue",
+		Title:  i.GetTitle(),
+		State:  i.GetState(),
+		Author: i.GetUser().GetLogin(),
+		URL:    i.GetHTMLURL(),
+	}
+	for _, l := range i.Labels {
+		card.Labels = append(card.Labels, l.GetName())
+	}
+	if i.IsPullRequest() {
+		card.Kind = "Pull request"
+		// Only the pull request itself says whether it was merged
+		pr, _, err := cli.PullRequests.Get(context.Background(), owner, repo, num)
+		if err != nil {
+			return nil, err
+		}
+		if pr.GetMerged() {
+			card.State = "merged"
+		}
+	}
+	return card, nil
+}
+
+func addIssueComment(cli *gogithub.Client, owner, repo, commentID string, card *previewCard) error {
+	cid, err := strconv.ParseInt(commentID, 10, 64)
+	if err != nil {
+		return err
+	}
+	c, _, err := cli.Issues.GetComment(context.Background(), owner, repo, cid)
+	if err != nil {
+		return err
+	}
+	card.Comment = &previewComment{
+		Author: c.GetUser().GetLogin(),
+		Body:   c.GetBody(),
+		URL:    c.GetHTMLURL(),
+	}
+	return nil
+}
+
+// Discussions are only available through Github's GraphQL API.
+const discussionQuery = `query($owner: String!, $repo: String!, $number: Int!) {
+	repository(owner: $owner, name: $repo) {
+		discussion(number: $number) {
+			title url closed
+			author { login }
+			category { name }
+			labels(first: 10) { nodes { name } }
+		}
+	}
+}`
+
+func fetchDiscussionCard(cli *gogithub.Client, owner, repo string, num int) (*previewCard, error) {
+	req, err := cli.NewRequest("POST", "graphql", map[string]interface{}{
+		"query": discussionQuery,
+		"variables": map[string]interface{}{
+			"owner":  owner,
+			"repo":   repo,
+			"number": num,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Data struct {
+			Repository struct {
+				Discussion *struct {
+					Title  string `json:"title"`
+					URL    string `json:"url"`
+					Closed bool   `json:"closed"`
+					Author struct {
+						Login string `json:"login"`
+					} `json:"author"`
+					Category struct {
+						Name string `json:"name"`
+					} `json:"category"`
+					Labels struct {
+						Nodes []struct {
+							Name string `json:"name"`
+						} `json:"nodes"`
+					} `json:"labels"`
+				} `json:"discussion"`
+			} `json:"repository"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if _, err = cli.Do(context.Background(), req, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Errors) > 0 {
+		return nil, fmt.Errorf("GraphQL error: %s", res.Errors[0].Message)
+	}
+	d := res.Data.Repository.Discussion
+	if d == nil {
+		return nil, fmt.Errorf("No discussion %s/%s#%d", owner, repo, num)
+	}
+	card := &previewCard{
+		Ref:    fmt.Sprintf("%s/%s#%d", owner, repo, num),
+		Kind:   "Discussion",
+		Title:  d.Title,
+		State:  "open",
+		Author: d.Author.Login,
+		URL:    d.URL,
+	}
+	if d.Category.Name != "" {
+		card.Kind = "Discussion in " + d.Category.Name
+	}
+	if d.Closed {
+		card.State = "closed"
+	}
+	for _, l := range d.Labels.Nodes {
+		card.Labels = append(card.Labels, l.Name)
+	}
+	return card, nil
+}
+
+// message renders the card as a notice.
+func (c *previewCard) message() *mevt.MessageEventContent {
+	var htmlBuffer bytes.Buffer
+	var plainBuffer bytes.Buffer
+
+	htmlBuffer.WriteString(fmt.Sprintf(`<a href="%s"><strong>%s</strong>: %s</a> [%s]<br />`,
+		html.EscapeString(c.URL), html.EscapeString(c.Ref), html.EscapeString(c.Title), html.EscapeString(c.State)))
+	plainBuffer.WriteString(fmt.Sprintf("%s: %s [%s]\n", c.Ref, c.Title, c.State))
+
+	details := fmt.Sprintf("%s by %s", c.Kind, c.Author)
+	if len(c.Labels) > 0 {
+		details += " · Labels: " + strings.Join(c.Labels, ", ")
+	}
+	htmlBuffer.WriteString(html.EscapeString(details))
+	plainBuffer.WriteString(details)
+
+	if c.Comment != nil {
+		body := strings.TrimSpace(c.Comment.Body)
+		if len(body) > maxCommentPreviewLength {
+			body = strings.TrimSpace(strings.ToValidUTF8(body[:maxCommentPreviewLength], "")) + "…"
+		}
+		htmlBuffer.WriteString(fmt.Sprintf(`<br /><a href="%s">%s commented</a>:<blockquote>%s</blockquote>`,
+			html.EscapeString(c.Comment.URL), html.EscapeString(c.Comment.Author),
+			strings.Replace(html.EscapeString(body), "\n", "<br />", -1)))
+		plainBuffer.WriteString(fmt.Sprintf("\n%s commented:\n> %s", c.Comment.Author, strings.Replace(body, "\n", "\n> ", -1)))
+	}
+
+	return &mevt.MessageEventContent{
+		Body:          plainBuffer.String(),
+		MsgType:       mevt.MsgNotice,
+		Format:        mevt.FormatHTML,
+		FormattedBody: htmlBuffer.String(),
+	}
+}
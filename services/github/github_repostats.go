@@ -0,0 +1,463 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/github/client"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RepoStatsServiceType of the Github repository statistics service.
+const RepoStatsServiceType = "github-repostats"
+
+// How many contributors and slow reviews are listed for each repository
+const numberDigestEntries = 3
+
+// The most merged pull requests whose reviews are looked at for each repository, to bound the
+// number of API calls made for busy repositories.
+const maxReviewedPullRequests = 30
+
+// RepoStatsService contains the Config fields for the Github repository statistics service.
+//
+// Before you can set up this service, you need to set up a Github Realm, and the ClientUserID
+// needs to have logged into Github with it.
+//
+// This service posts a weekly digest of activity on Github repositories into Matrix rooms: new
+// stars, issues and pull requests opened and closed, the top contributors, and the pull requests
+// which waited longest for a review. Digests are sent as the service user ID, not the ClientUserID.
+//
+// Example request:
+//   {
+//       ClientUserID: "@alice:localhost",
+//       RealmID: "github-realm-id",
+//       Rooms: {
+//           "!qmElAGdFYCHoCJuaNt:localhost": {
+//               Repos: ["matrix-org/go-neb", "matrix-org/synapse"]
+//           }
+//       },
+//       Weekday: "Monday",
+//       Hour: 9
+//   }
+type RepoStatsService struct {
+	types.DefaultService
+	// The user ID whose Github credentials are used to compute the statistics.
+	ClientUserID id.UserID
+	// The ID of an existing "github" realm. This realm will be used to obtain
+	// the Github credentials of the ClientUserID.
+	RealmID string
+	// A map from Matrix room ID to the "owner/repo"-style repositories to post digests for.
+	Rooms map[id.RoomID]struct {
+		Repos []string
+	}
+	// Optional. The day of the week to post digests on, e.g. "Monday". Defaults to Monday.
+	Weekday string
+	// Optional. The hour of the day (0-23, UTC) to post digests at. Defaults to midnight.
+	Hour int
+	// The time the next digest will be posted, in seconds since the epoch. Populated by Go-NEB.
+	NextDigestTimestampSecs int64
+}
+
+// repoStats is a week of activity on a repository.
+type repoStats struct {
+	Repo           string
+	NewStars       int
+	OpenedIssues   int
+	ClosedIssues   int
+	OpenedPRs      int
+	MergedPRs      int
+	Contributors   []contributorCount
+	SlowestReviews []reviewWait
+}
+
+type contributorCount struct {
+	Name    string
+	Commits int
+}
+
+// reviewWait is how long a pull request waited for its first review.
+type reviewWait struct {
+	Number int
+	Title  string
+	URL    string
+	Wait   time.Duration
+}
+
+// Register makes sure that the service can read the repositories, and works out when the first
+// digest should be posted. The schedule carries over from the old service if it didn't change.
+func (s *RepoStatsService) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.RealmID == "" || s.ClientUserID == "" {
+		return fmt.Errorf("RealmID and ClientUserID is required")
+	}
+	if _, err := s.weekday(); err != nil {
+		return err
+	}
+	if s.Hour < 0 || s.Hour > 23 {
+		return fmt.Errorf("Hour must be between 0 and 23, got %d", s.Hour)
+	}
+	for roomID, roomConfig := range s.Rooms {
+		for _, repo := range roomConfig.Repos {
+			if !ownerRepoRegex.MatchString(repo) {
+				return fmt.Errorf("Repo '%s' of room %s is not of the form owner/repo", repo, roomID)
+			}
+		}
+	}
+	if _, err := getTokenForUser(s.RealmID, s.ClientUserID); err != nil {
+		return fmt.Errorf("User %s does not have a Github auth session with realm %s: %s", s.ClientUserID, s.RealmID, err)
+	}
+
+	if old, ok := oldService.(*RepoStatsService); ok && old.Weekday == s.Weekday && old.Hour == s.Hour {
+		s.NextDigestTimestampSecs = old.NextDigestTimestampSecs
+	} else {
+		next, _ := s.nextDigest(time.Now())
+		s.NextDigestTimestampSecs = next.Unix()
+	}
+
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+// OnPoll posts the digests when they are due, and returns when the next ones are.
+func (s *RepoStatsService) OnPoll(cli types.MatrixClient) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	now := time.Now()
+	due := time.Unix(s.NextDigestTimestampSecs, 0)
+	if s.NextDigestTimestampSecs != 0 && now.Before(due) {
+		return due
+	}
+
+	if s.NextDigestTimestampSecs != 0 {
+		s.postDigests(cli, now.AddDate(0, 0, -7), now)
+	}
+
+	next, err := s.nextDigest(now)
+	if err != nil {
+		logger.WithError(err).Error("Failed to schedule the next digest")
+		return time.Time{}
+	}
+	s.NextDigestTimestampSecs = next.Unix()
+	// Persist the service to save the next digest time
+	if _, err := database.GetServiceDB().StoreService(s); err != nil {
+		logger.WithError(err).Error("Failed to persist next digest time for service")
+	}
+	return next
+}
+
+func (s *RepoStatsService) postDigests(cli types.MatrixClient, since, until time.Time) {
+	ghCli := s.githubClientFor(s.ClientUserID)
+	if ghCli == nil {
+		return
+	}
+	// Repositories can be in more than one room, so only work out their statistics once.
+	stats := make(map[string]*repoStats)
+	for roomID, roomConfig := range s.Rooms {
+		var roomStats []*repoStats
+		for _, repo := range roomConfig.Repos {
+			st, ok := stats[strings.ToLower(repo)]
+			if !ok {
+				var err error
+				ownerRepo := strings.Split(repo, "/")
+				if st, err = fetchRepoStats(ghCli, ownerRepo[0], ownerRepo[1], since, until); err != nil {
+					log.WithError(err).WithField("repo", repo).Error("Failed to fetch repository statistics")
+					continue
+				}
+				stats[strings.ToLower(repo)] = st
+			}
+			roomStats = append(roomStats, st)
+		}
+		if len(roomStats) == 0 {
+			continue
+		}
+		if _, err := cli.SendMessageEvent(roomID, mevt.EventMessage, digestMessage(roomStats, since, until)); err != nil {
+			log.WithError(err).WithField("room_id", roomID).Error("Failed to send digest")
+		}
+	}
+}
+
+func (s *RepoStatsService) weekday() (time.Weekday, error) {
+	if s.Weekday == "" {
+		return time.Monday, nil
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), s.Weekday) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("Weekday '%s' is not a day of the week", s.Weekday)
+}
+
+// nextDigest returns the first time after now that a digest should be posted.
+func (s *RepoStatsService) nextDigest(now time.Time) (time.Time, error) {
+	weekday, err := s.weekday()
+	if err != nil {
+		return time.Time{}, err
+	}
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), s.Hour, 0, 0, 0, time.UTC)
+	next = next.AddDate(0, 0, (int(weekday)-int(next.Weekday())+7)%7)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next, nil
+}
+
+func (s *RepoStatsService) githubClientFor(userID id.UserID) *gogithub.Client {
+	token, err := getTokenForUser(s.RealmID, userID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"user_id":    userID,
+			"realm_id":   s.RealmID,
+		}).Print("Failed to get token for user")
+		return nil
+	}
+	return client.New(token)
+}
+
+// fetchRepoStats works out the activity on the repository between since and until.
+func fetchRepoStats(cli *gogithub.Client, owner, repo string, since, until time.Time) (*repoStats, error) {
+	st := &repoStats{Repo: owner + "/" + repo}
+	var err error
+	if st.NewStars, err = countNewStars(cli, owner, repo, since, until); err != nil {
+		return nil, err
+	}
+
+	dates := since.UTC().Format("2006-01-02") + ".." + until.UTC().Format("2006-01-02")
+	counts := []struct {
+		query string
+		count *int
+	}{
+		{"is:issue created:" + dates, &st.OpenedIssues},
+		{"is:issue closed:" + dates, &st.ClosedIssues},
+		{"is:pr created:" + dates, &st.OpenedPRs},
+	}
+	for _, c := range counts {
+		res, _, err := cli.Search.Issues(context.Background(), fmt.Sprintf("repo:%s/%s %s", owner, repo, c.query),
+			&gogithub.SearchOptions{ListOptions: gogithub.ListOptions{PerPage: 1}})
+		if err != nil {
+			return nil, err
+		}
+		*c.count = res.GetTotal()
+	}
+
+	merged, _, err := cli.Search.Issues(context.Background(), fmt.Sprintf("repo:%s/%s is:pr merged:%s", owner, repo, dates),
+		&gogithub.SearchOptions{ListOptions: gogithub.ListOptions{PerPage: maxReviewedPullRequests}})
+	if err != nil {
+		return nil, err
+	}
+	st.MergedPRs = merged.GetTotal()
+	if st.SlowestReviews, err = slowestReviews(cli, owner, repo, merged.Issues); err != nil {
+		return nil, err
+	}
+
+	if st.Contributors, err = topContributors(cli, owner, repo, since, until); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// countNewStars counts the stars given to the repository between since and until.
+func countNewStars(cli *gogithub.Client, owner, repo string, since, until time.Time) (int, error) {
+	opts := &gogithub.ListOptions{PerPage: 100}
+	firstPage, res, err := cli.Activity.ListStargazers(context.Background(), owner, repo, opts)
+	if err != nil {
+		return 0, err
+	}
+	lastPage := res.LastPage
+	if lastPage == 0 {
+		lastPage = 1 // every stargazer fitted on the first page
+	}
+	// Stargazers are listed oldest first, so work back from the last page until they are too old.
+	count := 0
+	for page := lastPage; page >= 1; page-- {
+		stars := firstPage
+		if page != 1 {
+			opts.Page = page
+			if stars, _, err = cli.Activity.ListStargazers(context.Background(), owner, repo, opts); err != nil {
+				return 0, err
+			}
+		}
+		tooOld := false
+		for _, star := range stars {
+			starredAt := star.GetStarredAt().Time
+			if starredAt.Before(since) {
+				tooOld = true
+			} else if starredAt.Before(until) {
+				count++
+			}
+		}
+		if tooOld {
+			break
+		}
+	}
+	return count, nil
+}
+
+// slowestReviews returns the pull requests which waited longest for their first review, slowest first.
+func slowestReviews(cli *gogithub.Client, owner, repo string, prs []gogithub.Issue) ([]reviewWait, error) {
+	var waits []reviewWait
+	for _, pr := range prs {
+		reviews, _, err := cli.PullRequests.ListReviews(context.Background(), owner, repo, pr.GetNumber(),
+			&gogithub.ListOptions{PerPage: 100})
+		if err != nil {
+			return nil, err
+		}
+		var first time.Time
+		for _, review := range reviews {
+			// Authors can comment on their own pull requests, but that isn't a review.
+			if review.GetUser().GetLogin() == pr.GetUser().GetLogin() || review.GetSubmittedAt().IsZero() {
+				continue
+			}
+			if first.IsZero() || review.GetSubmittedAt().Before(first) {
+				first = review.GetSubmittedAt()
+			}
+		}
+		if first.IsZero() {
+			continue // merged without a review
+		}
+		waits = append(waits, reviewWait{
+			Number: pr.GetNumber(),
+			Title:  pr.GetTitle(),
+			URL:    pr.GetHTMLURL(),
+			Wait:   first.Sub(pr.GetCreatedAt()),
+		})
+	}
+	sort.SliceStable(waits, func(i, j int) bool {
+		return waits[i].Wait > waits[j].Wait
+	})
+	if len(waits) > numberDigestEntries {
+		waits = waits[:numberDigestEntries]
+	}
+	return waits, nil
+}
+
+// topContributors returns the people who made the most commits to the default branch between
+// since and until, most commits first.
+func topContributors(cli *gogithub.Client, owner, repo string, since, until time.Time) ([]contributorCount, error) {
+	commitCounts := make(map[string]int)
+	opts := &gogithub.CommitsListOptions{
+		Since:       since,
+		Until:       until,
+		ListOptions: gogithub.ListOptions{PerPage: 100},
+	}
+	for {
+		commits, res, err := cli.Repositories.ListCommits(context.Background(), owner, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range commits {
+			name := c.GetAuthor().GetLogin()
+			if name == "" {
+				// The commit's email isn't linked to a Github account
+				name = c.GetCommit().GetAuthor().GetName()
+			}
+			commitCounts[name]++
+		}
+		if res.NextPage == 0 {
+			break
+		}
+		opts.Page = res.NextPage
+	}
+
+	var contributors []contributorCount
+	for name, count := range commitCounts {
+		contributors = append(contributors, contributorCount{Name: name, Commits: count})
+	}
+	sort.Slice(contributors, func(i, j int) bool {
+		if contributors[i].Commits != contributors[j].Commits {
+			return contributors[i].Commits > contributors[j].Commits
+		}
+		return contributors[i].Name < contributors[j].Name
+	})
+	if len(contributors) > numberDigestEntries {
+		contributors = contributors[:numberDigestEntries]
+	}
+	return contributors, nil
+}
+
+// digestMessage renders the statistics of the repositories as a notice.
+func digestMessage(stats []*repoStats, since, until time.Time) mevt.MessageEventContent {
+	var htmlBuffer bytes.Buffer
+	var plainBuffer bytes.Buffer
+
+	period := fmt.Sprintf("%s to %s", since.UTC().Format("2 Jan"), until.UTC().Format("2 Jan 2006"))
+	htmlBuffer.WriteString(fmt.Sprintf("<strong>Weekly digest</strong> (%s)", period))
+	plainBuffer.WriteString(fmt.Sprintf("Weekly digest (%s)", period))
+
+	for _, st := range stats {
+		summary := fmt.Sprintf("★ %d new stars · %d issues opened, %d closed · %d pull requests opened, %d merged",
+			st.NewStars, st.OpenedIssues, st.ClosedIssues, st.OpenedPRs, st.MergedPRs)
+		htmlBuffer.WriteString(fmt.Sprintf(`<br /><br /><a href="https://github.com/%s"><strong>%s</strong></a><br />%s`,
+			html.EscapeString(st.Repo), html.EscapeString(st.Repo), html.EscapeString(summary)))
+		plainBuffer.WriteString(fmt.Sprintf("\n\n%s\n%s", st.Repo, summary))
+
+		if len(st.Contributors) > 0 {
+			var names []string
+			for _, c := range st.Contributors {
+				names = append(names, fmt.Sprintf("%s (%d)", c.Name, c.Commits))
+			}
+			contributors := "Top contributors: " + strings.Join(names, ", ")
+			htmlBuffer.WriteString("<br />" + html.EscapeString(contributors))
+			plainBuffer.WriteString("\n" + contributors)
+		}
+		if len(st.SlowestReviews) > 0 {
+			htmlBuffer.WriteString("<br />Slowest reviews:<ul>")
+			plainBuffer.WriteString("\nSlowest reviews:")
+			for _, w := range st.SlowestReviews {
+				wait := formatWait(w.Wait)
+				htmlBuffer.WriteString(fmt.Sprintf(`<li><a href="%s">#%d</a> %s: %s</li>`,
+					html.EscapeString(w.URL), w.Number, html.EscapeString(w.Title), wait))
+				plainBuffer.WriteString(fmt.Sprintf("\n - #%d %s: %s", w.Number, w.Title, wait))
+			}
+			htmlBuffer.WriteString("</ul>")
+		}
+	}
+
+	return mevt.MessageEventContent{
+		Body:          plainBuffer.String(),
+		MsgType:       mevt.MsgNotice,
+		Format:        mevt.FormatHTML,
+		FormattedBody: htmlBuffer.String(),
+	}
+}
+
+// formatWait rounds the wait to something readable, e.g. "3d 4h" or "25m".
+func formatWait(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	hours := int(d % (24 * time.Hour) / time.Hour)
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh", hours)
+	}
+	return fmt.Sprintf("%dm", int(d/time.Minute))
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &RepoStatsService{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, RepoStatsServiceType),
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package github
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/testutils"
+)
+
+func TestNextDigest(t *testing.T) {
+	// 2021-06-02 was a Wednesday
+	now := time.Date(2021, 6, 2, 10, 30, 0, 0, time.UTC)
+	testCases := []struct {
+		weekday string
+		hour    int
+		want    time.Time
+	}{
+		{"", 0, time.Date(2021, 6, 7, 0, 0, 0, 0, time.UTC)},
+		{"wednesday", 11, time.Date(2021, 6, 2, 11, 0, 0, 0, time.UTC)},
+		{"Wednesday", 10, time.Date(2021, 6, 9, 10, 0, 0, 0, time.UTC)},
+		{"Friday", 9, time.Date(2021, 6, 4, 9, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range testCases {
+		s := &RepoStatsService{Weekday: tc.weekday, Hour: tc.hour}
+		got, err := s.nextDigest(now)
+		if err != nil {
+			t.Errorf("nextDigest(%q, %d) failed: %s", tc.weekday, tc.hour, err)
+		} else if !got.Equal(tc.want) {
+			t.Errorf("nextDigest(%q, %d) = %s, want %s", tc.weekday, tc.hour, got, tc.want)
+		}
+	}
+	if _, err := (&RepoStatsService{Weekday: "Someday"}).nextDigest(now); err == nil {
+		t.Errorf("Expected an error for a bad weekday")
+	}
+}
+
+func TestFetchRepoStats(t *testing.T) {
+	since := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	until := since.AddDate(0, 0, 7)
+
+	responses := map[string]string{
+		"/repos/matrix-org/go-neb/stargazers?page=1": `[{"starred_at":"2021-06-02T10:00:00Z","user":{"login":"a"}}]`,
+		"/repos/matrix-org/go-neb/stargazers?page=2": `[{"starred_at":"2021-06-03T10:00:00Z","user":{"login":"b"}},` +
+			`{"starred_at":"2021-06-09T10:00:00Z","user":{"login":"c"}}]`,
+		"/repos/matrix-org/go-neb/pulls/1/reviews": `[{"user":{"login":"author"},"submitted_at":"2021-06-02T01:00:00Z"},` +
+			`{"user":{"login":"reviewer"},"submitted_at":"2021-06-04T03:00:00Z"}]`,
+		"/repos/matrix-org/go-neb/pulls/2/reviews": `[{"user":{"login":"reviewer"},"submitted_at":"2021-06-03T01:30:00Z"}]`,
+		"/repos/matrix-org/go-neb/pulls/3/reviews": `[]`,
+		"/repos/matrix-org/go-neb/commits": `[{"author":{"login":"alice"}},{"author":{"login":"bob"}},{"author":{"login":"alice"}},` +
+			`{"commit":{"author":{"name":"Carol"}}}]`,
+	}
+	searches := map[string]string{
+		"is:issue created:2021-06-01..2021-06-08": `{"total_count":4}`,
+		"is:issue closed:2021-06-01..2021-06-08":  `{"total_count":2}`,
+		"is:pr created:2021-06-01..2021-06-08":    `{"total_count":5}`,
+		"is:pr merged:2021-06-01..2021-06-08": `{"total_count":3,"items":[` +
+			`{"number":1,"title":"Slow","html_url":"https://github.com/matrix-org/go-neb/pull/1","created_at":"2021-06-01T00:00:00Z","user":{"login":"author"}},` +
+			`{"number":2,"title":"Fast","html_url":"https://github.com/matrix-org/go-neb/pull/2","created_at":"2021-06-03T00:00:00Z","user":{"login":"author"}},` +
+			`{"number":3,"title":"Unreviewed","created_at":"2021-06-03T00:00:00Z","user":{"login":"author"}}]}`,
+	}
+	cli := gogithub.NewClient(&http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var body string
+		var ok bool
+		if req.URL.Path == "/search/issues" {
+			body, ok = searches[strings.TrimPrefix(req.URL.Query().Get("q"), "repo:matrix-org/go-neb ")]
+		} else if req.URL.Path == "/repos/matrix-org/go-neb/stargazers" {
+			page := req.URL.Query().Get("page")
+			if page == "" {
+				page = "1"
+			}
+			body, ok = responses[req.URL.Path+"?page="+page]
+		} else {
+			body, ok = responses[req.URL.Path]
+		}
+		if !ok {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		header := http.Header{}
+		if req.URL.Path == "/repos/matrix-org/go-neb/stargazers" {
+			header.Set("Link", `<https://api.github.com/repositories/1/stargazers?page=2>; rel="last"`)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})})
+
+	st, err := fetchRepoStats(cli, "matrix-org", "go-neb", since, until)
+	if err != nil {
+		t.Fatalf("fetchRepoStats failed: %s", err)
+	}
+	if st.NewStars != 2 || st.OpenedIssues != 4 || st.ClosedIssues != 2 || st.OpenedPRs != 5 || st.MergedPRs != 3 {
+		t.Errorf("Bad counts: %+v", st)
+	}
+	if len(st.Contributors) != 3 || st.Contributors[0] != (contributorCount{"alice", 2}) ||
+		st.Contributors[1] != (contributorCount{"Carol", 1}) {
+		t.Errorf("Bad contributors: %+v", st.Contributors)
+	}
+	if len(st.SlowestReviews) != 2 || st.SlowestReviews[0].Number != 1 || st.SlowestReviews[0].Wait != 75*time.Hour ||
+		st.SlowestReviews[1].Number != 2 {
+		t.Errorf("Bad slowest reviews: %+v", st.SlowestReviews)
+	}
+
+	msg := digestMessage([]*repoStats{st}, since, until)
+	for _, want := range []string{"matrix-org/go-neb", "2 new stars", "4 issues opened, 2 closed", "alice (2)", "#1 Slow: 3d 3h"} {
+		if !strings.Contains(msg.Body, want) {
+			t.Errorf("Digest is missing %q: %s", want, msg.Body)
+		}
+	}
+}
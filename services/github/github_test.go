@@ -0,0 +1,75 @@
+package github
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearchQuery(t *testing.T) {
+	tests := []struct {
+		Args  []string
+		Query string
+	}{
+		{[]string{"memory", "leak"}, "memory leak"},
+		{[]string{"matrix-org/go-neb", "memory", "leak"}, "repo:matrix-org/go-neb memory leak"},
+		{[]string{"is:open label:bug"}, "is:open label:bug"},
+		{[]string{"and/or"}, "and/or"},
+	}
+	for _, test := range tests {
+		if query := searchQuery(test.Args); query != test.Query {
+			t.Errorf("searchQuery(%v) want '%s', got '%s'", test.Args, test.Query, query)
+		}
+	}
+}
+
+func TestGithubURLRegex(t *testing.T) {
+	tests := []struct {
+		Text   string
+		Groups []string // nil if it shouldn't match
+	}{
+		{"see https://github.com/matrix-org/go-neb/issues/12 please", []string{"matrix-org", "go-neb", "issues", "12", ""}},
+		{"https://github.com/matrix-org/go-neb/pull/34/files", []string{"matrix-org", "go-neb", "pull", "34", ""}},
+		{"https://github.com/matrix-org/go-neb/pull/34#issuecomment-5678", []string{"matrix-org", "go-neb", "pull", "34", "5678"}},
+		{"https://github.com/matrix-org/go-neb/commit/deadbeef1234", []string{"matrix-org", "go-neb", "commit", "deadbeef1234", ""}},
+		{"https://github.com/matrix-org/go-neb/discussions/9", []string{"matrix-org", "go-neb", "discussions", "9", ""}},
+		{"https://github.com/matrix-org/go-neb/blob/master/README.md", nil},
+		{"matrix-org/go-neb#12", nil},
+	}
+	for _, test := range tests {
+		groups := githubURLRegex.FindStringSubmatch(test.Text)
+		if test.Groups == nil {
+			if groups != nil {
+				t.Errorf("githubURLRegex matched '%s': %v", test.Text, groups)
+			}
+			continue
+		}
+		if groups == nil || strings.Join(groups[1:], " ") != strings.Join(test.Groups, " ") {
+			t.Errorf("githubURLRegex on '%s' => want %v, got %v", test.Text, test.Groups, groups)
+		}
+	}
+}
+
+func TestPreviewCard(t *testing.T) {
+	card := previewCard{
+		Ref:    "matrix-org/go-neb#12",
+		Kind:   "Pull request",
+		Title:  "Fix <everything>",
+		State:  "merged",
+		Author: "alice",
+		Labels: []string{"bug", "p1"},
+		URL:    "https://github.com/matrix-org/go-neb/pull/12",
+		Comment: &previewComment{
+			Author: "bob",
+			Body:   "LGTM\nShip it",
+			URL:    "https://github.com/matrix-org/go-neb/pull/12#issuecomment-1",
+		},
+	}
+	msg := card.message()
+	want := "matrix-org/go-neb#12: Fix <everything> [merged]\nPull request by alice · Labels: bug, p1\nbob commented:\n> LGTM\n> Ship it"
+	if msg.Body != want {
+		t.Errorf("Preview body: want '%s', got '%s'", want, msg.Body)
+	}
+	if !strings.Contains(msg.FormattedBody, "Fix &lt;everything&gt;") {
+		t.Errorf("Preview HTML wasn't escaped: %s", msg.FormattedBody)
+	}
+}
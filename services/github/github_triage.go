@@ -0,0 +1,312 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/realms/github"
+	"github.com/matrix-org/go-neb/services/github/client"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// TriageServiceType of the Github triage service.
+const TriageServiceType = "github-triage"
+
+// TriageService contains the Config fields for the Github triage service.
+//
+// Before you can set up this service, you need to set up a Github Realm.
+//
+// This service lets maintainers triage issues and pull requests from Matrix, by reacting to the
+// notifications the Github Webhook service sends about them. Each emoji in Reactions is mapped to
+// the labels to add and the milestone to set, which are applied with the Github credentials of
+// the person who reacted, so they need to have logged into Github with the realm and be allowed
+// to triage the repository. Removing a reaction doesn't undo what it did.
+//
+// The service needs to have the same service user ID as the Github Webhook service, so that it
+// knows which notifications are its own.
+//
+// Example request:
+//   {
+//       RealmID: "github-realm-id",
+//       Rooms: ["!qmElAGdFYCHoCJuaNt:localhost"],
+//       Reactions: {
+//           "🐛": {
+//               Labels: ["bug"]
+//           },
+//           "👍": {
+//               Labels: ["confirmed"]
+//           },
+//           "🚀": {
+//               Labels: ["release-blocker"],
+//               Milestone: "v1.0"
+//           }
+//       }
+//   }
+type TriageService struct {
+	types.DefaultService
+	// The ID of an existing "github" realm. This realm will be used to obtain the Github
+	// credentials of the people who react.
+	RealmID string
+	// The rooms in which notifications can be triaged.
+	Rooms []id.RoomID
+	// A map from emoji to what reacting with it does.
+	Reactions map[string]TriageAction
+}
+
+// TriageAction is what is done to an issue or pull request when its notification is reacted to.
+type TriageAction struct {
+	// The labels to add. Labels which the repository doesn't have yet are created.
+	Labels []string
+	// Optional. The title of the open milestone to set.
+	Milestone string
+}
+
+// triageTarget is the issue or pull request a notification is about.
+type triageTarget struct {
+	Owner  string
+	Repo   string
+	Number int
+}
+
+func (t *triageTarget) String() string {
+	return fmt.Sprintf("%s/%s#%d", t.Owner, t.Repo, t.Number)
+}
+
+// action returns what reacting with the emoji does, ignoring the variation selector some clients
+// add to emoji.
+func (s *TriageService) action(key string) (TriageAction, bool) {
+	key = strings.TrimSuffix(key, "\ufe0f")
+	for emoji, action := range s.Reactions {
+		if strings.TrimSuffix(emoji, "\ufe0f") == key {
+			return action, true
+		}
+	}
+	return TriageAction{}, false
+}
+
+func (s *TriageService) inRoom(roomID id.RoomID) bool {
+	for _, r := range s.Rooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// OnMessage triages the issue or pull request of a notification when it is reacted to with one of
+// the configured emoji.
+func (s *TriageService) OnMessage(cli types.MatrixClient, evt *mevt.Event) {
+	if evt.Type != mevt.EventReaction || !s.inRoom(evt.RoomID) {
+		return
+	}
+	rel, _ := evt.Content.Raw["m.relates_to"].(map[string]interface{})
+	if rel == nil || rel["rel_type"] != "m.annotation" {
+		return
+	}
+	key, _ := rel["key"].(string)
+	eventID, _ := rel["event_id"].(string)
+	action, ok := s.action(key)
+	if !ok || eventID == "" {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    evt.RoomID,
+		"event_id":   eventID,
+		"user_id":    evt.Sender,
+	})
+
+	target, err := s.notificationTarget(cli, evt.RoomID, id.EventID(eventID))
+	if err != nil {
+		logger.WithError(err).Error("Failed to fetch reacted to notification")
+		return
+	} else if target == nil {
+		// Not a notification about an issue or pull request
+		return
+	}
+
+	var res interface{}
+	ghCli := s.githubClientFor(evt.Sender)
+	if ghCli == nil {
+		res, err = s.starterLink(evt.Sender)
+	} else {
+		var done []string
+		if done, err = triage(ghCli, target, &action); err == nil {
+			logger.WithField("issue", target.String()).Info("Triaged issue")
+			res = &mevt.MessageEventContent{
+				MsgType: mevt.MsgNotice,
+				Body:    fmt.Sprintf("%s %s on %s", evt.Sender, strings.Join(done, " and "), target),
+			}
+		}
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to triage issue")
+		res = &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("Failed to triage %s for %s: %s", target, evt.Sender, err),
+		}
+	}
+	if _, err = cli.SendMessageEvent(evt.RoomID, mevt.EventMessage, res); err != nil {
+		logger.WithError(err).Error("Failed to send triage response")
+	}
+}
+
+// notificationTarget returns the issue or pull request which the event is a notification about,
+// or nil if it isn't a notification sent by this service's user about one.
+func (s *TriageService) notificationTarget(cli types.MatrixClient, roomID id.RoomID, eventID id.EventID) (*triageTarget, error) {
+	evCli, ok := cli.(types.EventGetter)
+	if !ok {
+		return nil, fmt.Errorf("Unable to fetch messages with this client")
+	}
+	original, err := evCli.GetEvent(roomID, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if original.Sender != s.ServiceUserID() || original.Type.Type != mevt.EventMessage.Type {
+		return nil, nil
+	}
+	original.Content.ParseRaw(mevt.EventMessage)
+	return parseTriageTarget(original.Content.AsMessage().Body), nil
+}
+
+// parseTriageTarget returns the first issue or pull request linked to in the text, or nil if there
+// isn't one.
+func parseTriageTarget(text string) *triageTarget {
+	for _, groups := range githubURLRegex.FindAllStringSubmatch(text, -1) {
+		if groups[3] != "issues" && groups[3] != "pull" {
+			continue
+		}
+		number, err := strconv.Atoi(groups[4])
+		if err != nil {
+			continue
+		}
+		return &triageTarget{Owner: groups[1], Repo: groups[2], Number: number}
+	}
+	return nil
+}
+
+// triage applies the action to the issue or pull request, returning what was done.
+func triage(cli *gogithub.Client, target *triageTarget, action *TriageAction) ([]string, error) {
+	var done []string
+	if len(action.Labels) > 0 {
+		if _, _, err := cli.Issues.AddLabelsToIssue(context.Background(), target.Owner, target.Repo, target.Number, action.Labels); err != nil {
+			return nil, err
+		}
+		done = append(done, "added "+strings.Join(action.Labels, ", "))
+	}
+	if action.Milestone != "" {
+		number, err := findMilestone(cli, target, action.Milestone)
+		if err != nil {
+			return done, err
+		}
+		if _, _, err = cli.Issues.Edit(context.Background(), target.Owner, target.Repo, target.Number, &gogithub.IssueRequest{
+			Milestone: &number,
+		}); err != nil {
+			return done, err
+		}
+		done = append(done, "set the milestone to "+action.Milestone)
+	}
+	return done, nil
+}
+
+// findMilestone returns the number of the repository's open milestone with the title, ignoring
+// case.
+func findMilestone(cli *gogithub.Client, target *triageTarget, title string) (int, error) {
+	opts := &gogithub.MilestoneListOptions{State: "open", ListOptions: gogithub.ListOptions{PerPage: 100}}
+	for {
+		milestones, res, err := cli.Issues.ListMilestones(context.Background(), target.Owner, target.Repo, opts)
+		if err != nil {
+			return 0, err
+		}
+		for _, m := range milestones {
+			if strings.EqualFold(m.GetTitle(), title) {
+				return m.GetNumber(), nil
+			}
+		}
+		if res.NextPage == 0 {
+			return 0, fmt.Errorf("%s/%s has no open milestone '%s'", target.Owner, target.Repo, title)
+		}
+		opts.Page = res.NextPage
+	}
+}
+
+func (s *TriageService) githubClientFor(userID id.UserID) *gogithub.Client {
+	token, err := getTokenForUser(s.RealmID, userID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"user_id":    userID,
+			"realm_id":   s.RealmID,
+		}).Print("Failed to get token for user")
+	}
+	if token == "" {
+		return nil
+	}
+	return client.New(token)
+}
+
+// starterLink returns a message asking the user to log into Github.
+func (s *TriageService) starterLink(userID id.UserID) (interface{}, error) {
+	r, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return nil, err
+	}
+	ghRealm, ok := r.(*github.Realm)
+	if !ok {
+		return nil, fmt.Errorf("Failed to cast realm %s into a GithubRealm", s.RealmID)
+	}
+	return matrix.StarterLinkMessage{
+		Body: fmt.Sprintf("%s, you need to log into Github before you can triage issues.", userID),
+		Link: ghRealm.StarterLink,
+	}, nil
+}
+
+// Register makes sure the realm and reactions are valid, and joins the rooms.
+func (s *TriageService) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.RealmID == "" {
+		return fmt.Errorf("RealmID is required")
+	}
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	if len(s.Reactions) == 0 {
+		return fmt.Errorf("At least one reaction is required")
+	}
+	for emoji, action := range s.Reactions {
+		if len(action.Labels) == 0 && action.Milestone == "" {
+			return fmt.Errorf("Reaction %s has neither labels nor a milestone", emoji)
+		}
+	}
+	realm, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return err
+	}
+	if realm.Type() != "github" {
+		return fmt.Errorf("Realm is of type '%s', not 'github'", realm.Type())
+	}
+	for _, roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &TriageService{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, TriageServiceType),
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package github
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/testutils"
+)
+
+func TestParseTriageTarget(t *testing.T) {
+	tests := []struct {
+		Text string
+		Want string // "" if there shouldn't be a target
+	}{
+		{"[matrix-org/go-neb] alice opened issue #12: Crash [open] - https://github.com/matrix-org/go-neb/issues/12",
+			"matrix-org/go-neb#12"},
+		{"[matrix-org/go-neb] bob opened pull request #34: Fix [open] - https://github.com/matrix-org/go-neb/pull/34",
+			"matrix-org/go-neb#34"},
+		{"see https://github.com/matrix-org/go-neb/commit/deadbeef then https://github.com/matrix-org/go-neb/issues/5",
+			"matrix-org/go-neb#5"},
+		{"[matrix-org/go-neb] alice pushed to master: Fix - https://github.com/matrix-org/go-neb/commit/deadbeef", ""},
+		{"matrix-org/go-neb#12", ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if target := parseTriageTarget(test.Text); target != nil {
+			got = target.String()
+		}
+		if got != test.Want {
+			t.Errorf("parseTriageTarget(%q) => want %q, got %q", test.Text, test.Want, got)
+		}
+	}
+}
+
+func TestTriage(t *testing.T) {
+	var requests []string
+	cli := gogithub.NewClient(&http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch req.Method + " " + req.URL.Path {
+		case "POST /repos/matrix-org/go-neb/issues/12/labels":
+			var labels []string
+			if err := json.NewDecoder(req.Body).Decode(&labels); err != nil {
+				return nil, err
+			}
+			requests = append(requests, "labels "+strings.Join(labels, ","))
+			body = `[{"name":"bug"},{"name":"confirmed"}]`
+		case "GET /repos/matrix-org/go-neb/milestones":
+			if req.URL.Query().Get("state") != "open" {
+				return nil, fmt.Errorf("Bad milestone query: %s", req.URL.RawQuery)
+			}
+			body = `[{"number":3,"title":"v0.9"},{"number":4,"title":"v1.0"}]`
+		case "PATCH /repos/matrix-org/go-neb/issues/12":
+			var edit struct {
+				Milestone int `json:"milestone"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&edit); err != nil {
+				return nil, err
+			}
+			requests = append(requests, fmt.Sprintf("milestone %d", edit.Milestone))
+			body = `{"number":12}`
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s %s", req.Method, req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})})
+	target := &triageTarget{Owner: "matrix-org", Repo: "go-neb", Number: 12}
+
+	done, err := triage(cli, target, &TriageAction{Labels: []string{"bug", "confirmed"}, Milestone: "V1.0"})
+	if err != nil {
+		t.Fatalf("triage failed: %s", err)
+	}
+	if got := strings.Join(done, " and "); got != "added bug, confirmed and set the milestone to V1.0" {
+		t.Errorf("Bad triage summary: %s", got)
+	}
+	if got := strings.Join(requests, "; "); got != "labels bug,confirmed; milestone 4" {
+		t.Errorf("Bad triage requests: %s", got)
+	}
+
+	if _, err = triage(cli, target, &TriageAction{Milestone: "v2.0"}); err == nil || !strings.Contains(err.Error(), "no open milestone") {
+		t.Errorf("Expected an unknown milestone to fail, got %v", err)
+	}
+}
@@ -1,19 +1,21 @@
 package github
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"sort"
 	"strings"
 
 	gogithub "github.com/google/go-github/github"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
 	"github.com/matrix-org/go-neb/services/github/client"
 	"github.com/matrix-org/go-neb/services/github/webhook"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
-	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -39,6 +41,10 @@ const WebhookServiceType = "github-webhook"
 //                   "matrix-org/go-neb": {
 //                       Events: ["push", "issues", "pull_request", "labels"]
 //                   }
+//               },
+//               Filter: {
+//                   Branches: ["main", "release/*"],
+//                   MuteBots: true
 //               }
 //           }
 //       }
@@ -67,6 +73,9 @@ type WebhookService struct {
 			// Most of these events are directly from: https://developer.github.com/webhooks/#events
 			Events []string
 		}
+		// Optional. Filters out notifications the room isn't interested in, e.g. pushes to
+		// feature branches. See WebhookFilter.
+		Filter WebhookFilter
 	}
 	// Optional. The secret token to supply when creating the webhook. If supplied,
 	// Go-NEB will perform security checks on incoming webhook requests using this token.
@@ -82,11 +91,20 @@ type WebhookService struct {
 // If the "owner/repo" string doesn't exist in this Service config, then the webhook will be deleted from
 // Github.
 func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	// Keep a copy of the body to work out which issue or pull request the event is about.
+	body, readErr := ioutil.ReadAll(req.Body)
+	if readErr != nil {
+		w.WriteHeader(400)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
 	evType, repo, msg, err := webhook.OnReceiveRequest(req, s.SecretToken)
 	if err != nil {
 		w.WriteHeader(err.Code)
 		return
 	}
+	correlationKey := webhook.CorrelationKey(body)
+	details := webhook.EventDetails(body)
 	logger := log.WithFields(log.Fields{
 		"event": evType,
 		"repo":  *repo.FullName,
@@ -105,12 +123,20 @@ func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Reque
 					break
 				}
 			}
+			if notifyRoom && !roomConfig.Filter.allows(evType, details) {
+				logger.WithField("room_id", roomID).Debug("Notification filtered out for room")
+				notifyRoom = false
+			}
 			if notifyRoom {
 				logger.WithFields(log.Fields{
 					"message": msg,
 					"room_id": roomID,
 				}).Print("Sending notification to room")
-				if _, e := cli.SendMessageEvent(roomID, event.EventMessage, msg); e != nil {
+				if _, e := notify.Send(cli, s, notify.Notification{
+					RoomID:         roomID,
+					Content:        *msg,
+					CorrelationKey: correlationKey,
+				}); e != nil {
 					logger.WithError(e).WithField("room_id", roomID).Print(
 						"Failed to send notification to room.")
 				}
@@ -149,6 +175,11 @@ func (s *WebhookService) Register(oldService types.Service, client types.MatrixC
 	if s.RealmID == "" || s.ClientUserID == "" {
 		return fmt.Errorf("RealmID and ClientUserID is required")
 	}
+	for roomID, roomConfig := range s.Rooms {
+		if err := roomConfig.Filter.check(); err != nil {
+			return fmt.Errorf("Bad filter for room %s: %s", roomID, err)
+		}
+	}
 	realm, err := s.loadRealm()
 	if err != nil {
 		return err
@@ -0,0 +1,118 @@
+package github
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/matrix-org/go-neb/services/github/webhook"
+)
+
+// WebhookFilter narrows down the notifications sent into a room, on top of the Events of each
+// repository. Every list is optional: an empty list allows everything. Filters only apply to
+// events which have the field being filtered on, so e.g. branch filters don't hide issues.
+//
+// Example:
+//   {
+//       ExcludeEvents: ["labels"],
+//       Branches: ["main", "release/*"],
+//       ExcludeAuthors: ["some-noisy-user"],
+//       Labels: ["bug", "security"],
+//       MuteBots: true
+//   }
+type WebhookFilter struct {
+	// Only send these event types into the room.
+	IncludeEvents []string
+	// Never send these event types into the room.
+	ExcludeEvents []string
+	// Only send pushes to, and pull requests against, branches matching these patterns. Patterns
+	// use shell glob syntax, e.g. "release/*".
+	Branches []string
+	// Never send pushes to, or pull requests against, branches matching these patterns.
+	ExcludeBranches []string
+	// Only send events caused by these Github users.
+	Authors []string
+	// Never send events caused by these Github users.
+	ExcludeAuthors []string
+	// Only send events about issues and pull requests with at least one of these labels.
+	Labels []string
+	// Never send events about issues and pull requests with any of these labels.
+	ExcludeLabels []string
+	// Don't send events caused by bots, e.g. dependabot[bot].
+	MuteBots bool
+}
+
+// check returns an error if a branch pattern is malformed.
+func (f *WebhookFilter) check() error {
+	for _, pattern := range append(f.Branches, f.ExcludeBranches...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Branch pattern '%s' is malformed: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// allows returns true if an event of the given type and details should be sent into the room.
+func (f *WebhookFilter) allows(evType string, d webhook.Details) bool {
+	if len(f.IncludeEvents) > 0 && !containsFold(f.IncludeEvents, evType) {
+		return false
+	}
+	if containsFold(f.ExcludeEvents, evType) {
+		return false
+	}
+	if f.MuteBots && d.SenderIsBot {
+		return false
+	}
+	if d.Sender != "" {
+		if len(f.Authors) > 0 && !containsFold(f.Authors, d.Sender) {
+			return false
+		}
+		if containsFold(f.ExcludeAuthors, d.Sender) {
+			return false
+		}
+	}
+	if d.Branch != "" {
+		if len(f.Branches) > 0 && !matchesAny(f.Branches, d.Branch) {
+			return false
+		}
+		if matchesAny(f.ExcludeBranches, d.Branch) {
+			return false
+		}
+	}
+	if len(f.Labels) > 0 && d.Number != 0 {
+		wanted := false
+		for _, label := range d.Labels {
+			if containsFold(f.Labels, label) {
+				wanted = true
+				break
+			}
+		}
+		if !wanted {
+			return false
+		}
+	}
+	for _, label := range d.Labels {
+		if containsFold(f.ExcludeLabels, label) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -11,6 +11,7 @@ import (
 	"testing"
 
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/github/webhook"
 	"github.com/matrix-org/go-neb/testutils"
 	"github.com/matrix-org/go-neb/types"
 	"maunium.net/go/mautrix"
@@ -222,6 +223,46 @@ func TestGithubWebhook(t *testing.T) {
 	}
 }
 
+func TestWebhookFilter(t *testing.T) {
+	push := webhook.Details{Sender: "alice", Branch: "feature/x"}
+	bugFix := webhook.Details{Sender: "bob", Branch: "main", Number: 4, Labels: []string{"Bug"}}
+	issue := webhook.Details{Sender: "alice", Number: 5}
+	botPR := webhook.Details{Sender: "dependabot[bot]", SenderIsBot: true, Branch: "main", Number: 6}
+
+	tests := []struct {
+		Filter  WebhookFilter
+		EvType  string
+		Details webhook.Details
+		Allowed bool
+	}{
+		{WebhookFilter{}, "push", push, true},
+		{WebhookFilter{IncludeEvents: []string{"issues"}}, "push", push, false},
+		{WebhookFilter{ExcludeEvents: []string{"push"}}, "push", push, false},
+		{WebhookFilter{Branches: []string{"main", "release/*"}}, "push", push, false},
+		{WebhookFilter{Branches: []string{"feature/*"}}, "push", push, true},
+		{WebhookFilter{Branches: []string{"main"}}, "issues", issue, true},
+		{WebhookFilter{ExcludeBranches: []string{"feature/*"}}, "push", push, false},
+		{WebhookFilter{Authors: []string{"Bob"}}, "pull_request", bugFix, true},
+		{WebhookFilter{ExcludeAuthors: []string{"alice"}}, "issues", issue, false},
+		{WebhookFilter{Labels: []string{"bug"}}, "pull_request", bugFix, true},
+		{WebhookFilter{Labels: []string{"bug"}}, "issues", issue, false},
+		{WebhookFilter{Labels: []string{"bug"}}, "push", push, true},
+		{WebhookFilter{ExcludeLabels: []string{"bug"}}, "pull_request", bugFix, false},
+		{WebhookFilter{MuteBots: true}, "pull_request", botPR, false},
+		{WebhookFilter{MuteBots: true}, "pull_request", bugFix, true},
+	}
+	for _, test := range tests {
+		if allowed := test.Filter.allows(test.EvType, test.Details); allowed != test.Allowed {
+			t.Errorf("%+v allows(%s, %+v) => want %v, got %v", test.Filter, test.EvType, test.Details, test.Allowed, allowed)
+		}
+	}
+
+	bad := WebhookFilter{Branches: []string{"release/["}}
+	if err := bad.check(); err == nil {
+		t.Error("Malformed branch pattern was accepted")
+	}
+}
+
 func makeService(t *testing.T) *WebhookService {
 	srv, err := types.CreateService("id", WebhookServiceType, "@ghwebhook:hyrule", []byte(
 		`{
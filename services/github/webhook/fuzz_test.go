@@ -0,0 +1,50 @@
+//go:build go1.18
+// +build go1.18
+
+package webhook
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func FuzzParseGithubEvent(f *testing.F) {
+	for _, gh := range ghtests {
+		f.Add(gh.eventType, []byte(gh.jsonBody))
+	}
+	f.Add("push", []byte(`{"ref":"refs/heads/master","repository":{}}`))
+	f.Add("issues", []byte(`{}`))
+
+	f.Fuzz(func(t *testing.T, eventType string, data []byte) {
+		htmlStr, repo, _, err := parseGithubEvent(eventType, data)
+		if err != nil {
+			return
+		}
+		if htmlStr == "" {
+			t.Errorf("parseGithubEvent returned no HTML for a %q event", eventType)
+		}
+		if repo == nil {
+			t.Errorf("parseGithubEvent returned no repository for a %q event", eventType)
+		}
+	})
+}
+
+func FuzzOnReceiveRequest(f *testing.F) {
+	f.Add("ping", "", "", []byte(`{}`))
+	f.Add("issues", "sha1=deadbeef", "secret", []byte(`{}`))
+	f.Add("issues", "malformed", "secret", []byte(`{}`))
+
+	f.Fuzz(func(t *testing.T, eventType, signature, secret string, body []byte) {
+		req, err := http.NewRequest("POST", "https://neb.somewhere/services/hooks/github", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-GitHub-Event", eventType)
+		req.Header.Set("X-Hub-Signature", signature)
+		_, _, msg, resErr := OnReceiveRequest(req, secret)
+		if msg == nil && resErr == nil {
+			t.Errorf("OnReceiveRequest returned neither a message nor an error")
+		}
+	})
+}
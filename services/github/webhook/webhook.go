@@ -13,6 +13,7 @@ import (
 
 	"github.com/google/go-github/github"
 	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/templates"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
@@ -34,7 +35,14 @@ func OnReceiveRequest(r *http.Request, secretToken string) (string, *github.Repo
 	}
 	// Verify request if a secret token has been supplied.
 	if secretToken != "" {
-		sigHex := strings.Split(signatureSHA1, "=")[1]
+		sigParts := strings.SplitN(signatureSHA1, "=", 2)
+		if len(sigParts) != 2 {
+			log.WithField("X-Hub-Signature", signatureSHA1).Print(
+				"Received Github event with a malformed signature.")
+			resErr := util.MessageResponse(400, "Failed to decode signature")
+			return "", nil, nil, &resErr
+		}
+		sigHex := sigParts[1]
 		var sigBytes []byte
 		sigBytes, err = hex.DecodeString(sigHex)
 		if err != nil {
@@ -74,10 +82,113 @@ func OnReceiveRequest(r *http.Request, secretToken string) (string, *github.Repo
 	}
 
 	msg := utils.StrippedHTMLMessage(mevt.MsgNotice, htmlStr)
+	msg = renderTemplate(eventType, content, msg)
 
 	return refinedType, repo, &msg, nil
 }
 
+// CorrelationKey returns a key identifying the issue or pull request which a webhook payload is
+// about, e.g. "github owner/repo#123", or "" if it isn't about one. Comments on a pull request
+// have the same key as the pull request itself.
+func CorrelationKey(content []byte) string {
+	var payload struct {
+		Repo struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+		Issue struct {
+			Number int `json:"number"`
+		} `json:"issue"`
+		PullRequest struct {
+			Number int `json:"number"`
+		} `json:"pull_request"`
+	}
+	if err := json.Unmarshal(content, &payload); err != nil || payload.Repo.FullName == "" {
+		return ""
+	}
+	number := payload.Issue.Number
+	if number == 0 {
+		number = payload.PullRequest.Number
+	}
+	if number == 0 {
+		return ""
+	}
+	return fmt.Sprintf("github %s#%d", strings.ToLower(payload.Repo.FullName), number)
+}
+
+// Details are the parts of a webhook payload which notifications can be filtered on.
+type Details struct {
+	// The login of the user who caused the event.
+	Sender string
+	// True if the sender is a Github App or bot account.
+	SenderIsBot bool
+	// The branch pushed to, or the base branch of a pull request. Empty for other events.
+	Branch string
+	// The number of the issue or pull request the event is about, or 0 if it isn't about one.
+	Number int
+	// The labels of the issue or pull request the event is about.
+	Labels []string
+}
+
+// EventDetails returns the details of a webhook payload. Fields which the payload doesn't have are
+// left empty.
+func EventDetails(content []byte) Details {
+	type label struct {
+		Name string `json:"name"`
+	}
+	var payload struct {
+		Ref    string `json:"ref"`
+		Sender struct {
+			Login string `json:"login"`
+			Type  string `json:"type"`
+		} `json:"sender"`
+		Issue struct {
+			Number int     `json:"number"`
+			Labels []label `json:"labels"`
+		} `json:"issue"`
+		PullRequest struct {
+			Number int `json:"number"`
+			Base   struct {
+				Ref string `json:"ref"`
+			} `json:"base"`
+			Labels []label `json:"labels"`
+		} `json:"pull_request"`
+	}
+	var d Details
+	if err := json.Unmarshal(content, &payload); err != nil {
+		return d
+	}
+	d.Sender = payload.Sender.Login
+	d.SenderIsBot = payload.Sender.Type == "Bot" || strings.HasSuffix(payload.Sender.Login, "[bot]")
+	if strings.HasPrefix(payload.Ref, "refs/heads/") {
+		d.Branch = strings.TrimPrefix(payload.Ref, "refs/heads/")
+	} else {
+		d.Branch = payload.PullRequest.Base.Ref
+	}
+	d.Number = payload.Issue.Number
+	if d.Number == 0 {
+		d.Number = payload.PullRequest.Number
+	}
+	for _, l := range append(payload.Issue.Labels, payload.PullRequest.Labels...) {
+		d.Labels = append(d.Labels, l.Name)
+	}
+	return d
+}
+
+// renderTemplate applies any template override for this event, named "github.<event>.<action>"
+// (e.g. "github.issues.closed"). The template is given the raw webhook payload, so its fields
+// are those documented by Github.
+func renderTemplate(eventType string, content []byte, msg mevt.MessageEventContent) mevt.MessageEventContent {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(content, &payload); err != nil {
+		return msg
+	}
+	name := "github." + eventType
+	if action, ok := payload["action"].(string); ok && action != "" {
+		name += "." + action
+	}
+	return templates.Render(name, payload, msg)
+}
+
 // checkMAC reports whether messageMAC is a valid HMAC tag for message.
 func checkMAC(message, messageMAC, key []byte) bool {
 	mac := hmac.New(sha1.New, key)
@@ -95,14 +206,14 @@ func parseGithubEvent(eventType string, data []byte) (string, *github.Repository
 			return "", nil, eventType, err
 		}
 		refinedEventType := refineEventType(eventType, ev.Action)
-		return pullRequestHTMLMessage(ev), ev.Repo, refinedEventType, nil
+		return withRepo(pullRequestHTMLMessage(ev), ev.Repo, refinedEventType)
 	} else if eventType == "issues" {
 		var ev github.IssuesEvent
 		if err := json.Unmarshal(data, &ev); err != nil {
 			return "", nil, eventType, err
 		}
 		refinedEventType := refineEventType(eventType, ev.Action)
-		return issueHTMLMessage(ev), ev.Repo, refinedEventType, nil
+		return withRepo(issueHTMLMessage(ev), ev.Repo, refinedEventType)
 	} else if eventType == "push" {
 		var ev github.PushEvent
 		if err := json.Unmarshal(data, &ev); err != nil {
@@ -110,6 +221,9 @@ func parseGithubEvent(eventType string, data []byte) (string, *github.Repository
 		}
 
 		// The 'push' event repository format is subtly different from normal, so munge the bits we need.
+		if ev.GetRepo().GetOwner().GetName() == "" || ev.GetRepo().GetName() == "" {
+			return "", nil, eventType, fmt.Errorf("Push event is missing repository owner or name")
+		}
 		fullName := *ev.Repo.Owner.Name + "/" + *ev.Repo.Name
 		repo := github.Repository{
 			Owner: &github.User{
@@ -124,17 +238,26 @@ func parseGithubEvent(eventType string, data []byte) (string, *github.Repository
 		if err := json.Unmarshal(data, &ev); err != nil {
 			return "", nil, eventType, err
 		}
-		return issueCommentHTMLMessage(ev), ev.Repo, eventType, nil
+		return withRepo(issueCommentHTMLMessage(ev), ev.Repo, eventType)
 	} else if eventType == "pull_request_review_comment" {
 		var ev github.PullRequestReviewCommentEvent
 		if err := json.Unmarshal(data, &ev); err != nil {
 			return "", nil, eventType, err
 		}
-		return prReviewCommentHTMLMessage(ev), ev.Repo, eventType, nil
+		return withRepo(prReviewCommentHTMLMessage(ev), ev.Repo, eventType)
 	}
 	return "", nil, eventType, fmt.Errorf("Unrecognized event type")
 }
 
+// withRepo returns the parsed event, or an error if the event is missing its repository, which
+// the service needs to route it.
+func withRepo(htmlStr string, repo *github.Repository, eventType string) (string, *github.Repository, string, error) {
+	if repo.GetFullName() == "" {
+		return "", nil, eventType, fmt.Errorf("Event is missing its repository")
+	}
+	return htmlStr, repo, eventType, nil
+}
+
 func refineEventType(eventType string, action *string) string {
 	if action == nil {
 		return eventType
@@ -152,47 +275,47 @@ func refineEventType(eventType string, action *string) string {
 
 func pullRequestHTMLMessage(p github.PullRequestEvent) string {
 	var actionTarget string
-	if p.PullRequest.Assignee != nil && p.PullRequest.Assignee.Login != nil {
-		actionTarget = fmt.Sprintf(" to %s", *p.PullRequest.Assignee.Login)
+	if login := p.GetPullRequest().GetAssignee().GetLogin(); login != "" {
+		actionTarget = fmt.Sprintf(" to %s", login)
 	}
 	return fmt.Sprintf(
 		"[<u>%s</u>] %s %s <b>pull request #%d</b>: %s [%s]%s - %s",
-		html.EscapeString(*p.Repo.FullName),
-		html.EscapeString(*p.Sender.Login),
-		html.EscapeString(*p.Action),
-		*p.Number,
-		html.EscapeString(*p.PullRequest.Title),
-		html.EscapeString(*p.PullRequest.State),
+		html.EscapeString(p.GetRepo().GetFullName()),
+		html.EscapeString(p.GetSender().GetLogin()),
+		html.EscapeString(p.GetAction()),
+		p.GetNumber(),
+		html.EscapeString(p.GetPullRequest().GetTitle()),
+		html.EscapeString(p.GetPullRequest().GetState()),
 		html.EscapeString(actionTarget),
-		html.EscapeString(*p.PullRequest.HTMLURL),
+		html.EscapeString(p.GetPullRequest().GetHTMLURL()),
 	)
 }
 
 func issueHTMLMessage(p github.IssuesEvent) string {
 	var actionTarget string
-	if p.Issue.Assignee != nil && p.Issue.Assignee.Login != nil {
-		actionTarget = fmt.Sprintf(" to %s", *p.Issue.Assignee.Login)
+	if login := p.GetIssue().GetAssignee().GetLogin(); login != "" {
+		actionTarget = fmt.Sprintf(" to %s", login)
 	}
-	action := html.EscapeString(*p.Action)
-	if p.Label != nil && (*p.Action == "labeled" || *p.Action == "unlabeled") {
-		action = *p.Action + " [" + html.EscapeString(*p.Label.Name) + "] to"
+	action := html.EscapeString(p.GetAction())
+	if p.Label != nil && (p.GetAction() == "labeled" || p.GetAction() == "unlabeled") {
+		action = p.GetAction() + " [" + html.EscapeString(p.GetLabel().GetName()) + "] to"
 	}
 	return fmt.Sprintf(
 		"[<u>%s</u>] %s %s <b>issue #%d</b>: %s [%s]%s - %s",
-		html.EscapeString(*p.Repo.FullName),
-		html.EscapeString(*p.Sender.Login),
+		html.EscapeString(p.GetRepo().GetFullName()),
+		html.EscapeString(p.GetSender().GetLogin()),
 		action,
-		*p.Issue.Number,
-		html.EscapeString(*p.Issue.Title),
-		html.EscapeString(*p.Issue.State),
+		p.GetIssue().GetNumber(),
+		html.EscapeString(p.GetIssue().GetTitle()),
+		html.EscapeString(p.GetIssue().GetState()),
 		html.EscapeString(actionTarget),
-		html.EscapeString(*p.Issue.HTMLURL),
+		html.EscapeString(p.GetIssue().GetHTMLURL()),
 	)
 }
 
 func issueCommentHTMLMessage(p github.IssueCommentEvent) string {
 	var kind string
-	if p.Issue.PullRequestLinks == nil {
+	if p.GetIssue().PullRequestLinks == nil {
 		kind = "issue"
 	} else {
 		kind = "pull request"
@@ -200,43 +323,43 @@ func issueCommentHTMLMessage(p github.IssueCommentEvent) string {
 
 	return fmt.Sprintf(
 		"[<u>%s</u>] %s commented on %s's <b>%s #%d</b>: %s - %s",
-		html.EscapeString(*p.Repo.FullName),
-		html.EscapeString(*p.Comment.User.Login),
-		html.EscapeString(*p.Issue.User.Login),
+		html.EscapeString(p.GetRepo().GetFullName()),
+		html.EscapeString(p.GetComment().GetUser().GetLogin()),
+		html.EscapeString(p.GetIssue().GetUser().GetLogin()),
 		kind,
-		*p.Issue.Number,
-		html.EscapeString(*p.Issue.Title),
-		html.EscapeString(*p.Issue.HTMLURL),
+		p.GetIssue().GetNumber(),
+		html.EscapeString(p.GetIssue().GetTitle()),
+		html.EscapeString(p.GetIssue().GetHTMLURL()),
 	)
 }
 
 func prReviewCommentHTMLMessage(p github.PullRequestReviewCommentEvent) string {
 	assignee := "None"
-	if p.PullRequest.Assignee != nil {
-		assignee = html.EscapeString(*p.PullRequest.Assignee.Login)
+	if p.GetPullRequest().Assignee != nil {
+		assignee = html.EscapeString(p.GetPullRequest().GetAssignee().GetLogin())
 	}
 	return fmt.Sprintf(
 		"[<u>%s</u>] %s made a line comment on %s's <b>pull request #%d</b> (assignee: %s): %s - %s",
-		html.EscapeString(*p.Repo.FullName),
-		html.EscapeString(*p.Sender.Login),
-		html.EscapeString(*p.PullRequest.User.Login),
-		*p.PullRequest.Number,
+		html.EscapeString(p.GetRepo().GetFullName()),
+		html.EscapeString(p.GetSender().GetLogin()),
+		html.EscapeString(p.GetPullRequest().GetUser().GetLogin()),
+		p.GetPullRequest().GetNumber(),
 		assignee,
-		html.EscapeString(*p.PullRequest.Title),
-		html.EscapeString(*p.Comment.HTMLURL),
+		html.EscapeString(p.GetPullRequest().GetTitle()),
+		html.EscapeString(p.GetComment().GetHTMLURL()),
 	)
 }
 
 func pushHTMLMessage(p github.PushEvent) string {
 	// /refs/heads/alice/branch-name => alice/branch-name
-	branch := strings.Replace(*p.Ref, "refs/heads/", "", -1)
+	branch := strings.Replace(p.GetRef(), "refs/heads/", "", -1)
 
 	// this branch was deleted, no HeadCommit object and deleted=true
-	if p.HeadCommit == nil && p.Deleted != nil && *p.Deleted {
+	if p.HeadCommit == nil && p.GetDeleted() {
 		return fmt.Sprintf(
 			`[<u>%s</u>] %s <b><font color="red">deleted</font> %s</b>`,
-			html.EscapeString(*p.Repo.FullName),
-			html.EscapeString(*p.Pusher.Name),
+			html.EscapeString(p.GetRepo().GetFullName()),
+			html.EscapeString(p.GetPusher().GetName()),
 			html.EscapeString(branch),
 		)
 	}
@@ -250,16 +373,16 @@ func pushHTMLMessage(p github.PushEvent) string {
 			cList = append(cList, fmt.Sprintf(
 				`%s: %s`,
 				html.EscapeString(nameForAuthor(c.Author)),
-				html.EscapeString(*c.Message),
+				html.EscapeString(c.GetMessage()),
 			))
 		}
 		return fmt.Sprintf(
 			`[<u>%s</u>] %s pushed %d commits to <b>%s</b>: %s<br>%s`,
-			html.EscapeString(*p.Repo.FullName),
-			html.EscapeString(nameForAuthor(p.HeadCommit.Committer)),
+			html.EscapeString(p.GetRepo().GetFullName()),
+			html.EscapeString(nameForAuthor(p.GetHeadCommit().GetCommitter())),
 			len(p.Commits),
 			html.EscapeString(branch),
-			html.EscapeString(*p.HeadCommit.URL),
+			html.EscapeString(p.GetHeadCommit().GetURL()),
 			strings.Join(cList, "<br>"),
 		)
 	}
@@ -268,11 +391,11 @@ func pushHTMLMessage(p github.PushEvent) string {
 	// [<repo>] <username> pushed to <branch>: <msg> - <git.io link>
 	return fmt.Sprintf(
 		`[<u>%s</u>] %s pushed to <b>%s</b>: %s  - %s`,
-		html.EscapeString(*p.Repo.FullName),
-		html.EscapeString(nameForAuthor(p.HeadCommit.Committer)),
+		html.EscapeString(p.GetRepo().GetFullName()),
+		html.EscapeString(nameForAuthor(p.GetHeadCommit().GetCommitter())),
 		html.EscapeString(branch),
-		html.EscapeString(*p.HeadCommit.Message),
-		html.EscapeString(*p.HeadCommit.URL),
+		html.EscapeString(p.GetHeadCommit().GetMessage()),
+		html.EscapeString(p.GetHeadCommit().GetURL()),
 	)
 }
 
@@ -283,5 +406,5 @@ func nameForAuthor(a *github.CommitAuthor) string {
 	if a.Login != nil { // prefer to use their GH username than the name they commited as
 		return *a.Login
 	}
-	return *a.Name
+	return a.GetName()
 }
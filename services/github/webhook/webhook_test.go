@@ -1526,3 +1526,34 @@ func TestParseGithubEvent(t *testing.T) {
 		}
 	}
 }
+
+func TestEventDetails(t *testing.T) {
+	tests := []struct {
+		Body    string
+		Details Details
+	}{
+		{
+			`{"ref":"refs/heads/release/1.0","sender":{"login":"alice","type":"User"}}`,
+			Details{Sender: "alice", Branch: "release/1.0"},
+		},
+		{
+			`{"ref":"refs/tags/v1.0","sender":{"login":"alice","type":"User"}}`,
+			Details{Sender: "alice"},
+		},
+		{
+			`{"pull_request":{"number":7,"base":{"ref":"main"},"labels":[{"name":"bug"},{"name":"p1"}]},"sender":{"login":"dependabot[bot]","type":"Bot"}}`,
+			Details{Sender: "dependabot[bot]", SenderIsBot: true, Branch: "main", Number: 7, Labels: []string{"bug", "p1"}},
+		},
+		{
+			`{"issue":{"number":3,"labels":[{"name":"question"}]},"sender":{"login":"bob","type":"User"}}`,
+			Details{Sender: "bob", Number: 3, Labels: []string{"question"}},
+		},
+	}
+	for _, test := range tests {
+		d := EventDetails([]byte(test.Body))
+		if d.Sender != test.Details.Sender || d.SenderIsBot != test.Details.SenderIsBot || d.Branch != test.Details.Branch || d.Number != test.Details.Number ||
+			strings.Join(d.Labels, ",") != strings.Join(test.Details.Labels, ",") {
+			t.Errorf("EventDetails(%s) => want %+v, got %+v", test.Body, test.Details, d)
+		}
+	}
+}
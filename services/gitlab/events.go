@@ -0,0 +1,237 @@
+package gitlab
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// The kinds of event which are announced, as given by the "object_kind" of their payloads
+const (
+	eventPush         = "push"
+	eventMergeRequest = "merge_request"
+	eventIssue        = "issue"
+	eventPipeline     = "pipeline"
+)
+
+// How many commits of a push are listed
+const maxCommits = 3
+
+// The commit ID GitLab gives for the "after" of a push which deleted a branch
+const deletedCommit = "0000000000000000000000000000000000000000"
+
+// payload is the parts of a webhook payload which the notices are made from. Each kind of event
+// only fills in some of it.
+type payload struct {
+	ObjectKind string `json:"object_kind"`
+	// Push events
+	Ref          string `json:"ref"`
+	After        string `json:"after"`
+	UserUsername string `json:"user_username"`
+	Commits      []struct {
+		Message string `json:"message"`
+		URL     string `json:"url"`
+		Author  struct {
+			Name string `json:"name"`
+		} `json:"author"`
+	} `json:"commits"`
+	TotalCommitsCount int `json:"total_commits_count"`
+	// Merge request, issue and pipeline events
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+	ObjectAttributes struct {
+		ID           int    `json:"id"`
+		IID          int    `json:"iid"`
+		Title        string `json:"title"`
+		URL          string `json:"url"`
+		Action       string `json:"action"`
+		State        string `json:"state"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+		// Pipelines only
+		Ref      string `json:"ref"`
+		Tag      bool   `json:"tag"`
+		Status   string `json:"status"`
+		Duration *int   `json:"duration"`
+	} `json:"object_attributes"`
+}
+
+func parsePayload(body []byte) (*payload, error) {
+	var p payload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	if p.ObjectKind == "" || p.Project.PathWithNamespace == "" {
+		return nil, fmt.Errorf("Payload is missing its object_kind or project")
+	}
+	return &p, nil
+}
+
+// branch returns the branch the event is about: the branch pushed to, the target branch of a merge
+// request or the branch a pipeline ran on. Empty for issues and tags.
+func (p *payload) branch() string {
+	switch p.ObjectKind {
+	case eventPush:
+		if strings.HasPrefix(p.Ref, "refs/heads/") {
+			return strings.TrimPrefix(p.Ref, "refs/heads/")
+		}
+	case eventMergeRequest:
+		return p.ObjectAttributes.TargetBranch
+	case eventPipeline:
+		if !p.ObjectAttributes.Tag {
+			return p.ObjectAttributes.Ref
+		}
+	}
+	return ""
+}
+
+// correlationKey identifies the merge request or issue the event is about, e.g.
+// "gitlab group/project!12", or "" if it isn't about one.
+func (p *payload) correlationKey() string {
+	project := strings.ToLower(p.Project.PathWithNamespace)
+	switch p.ObjectKind {
+	case eventMergeRequest:
+		return fmt.Sprintf("gitlab %s!%d", project, p.ObjectAttributes.IID)
+	case eventIssue:
+		return fmt.Sprintf("gitlab %s#%d", project, p.ObjectAttributes.IID)
+	}
+	return ""
+}
+
+// announced returns whether the event is worth a notice. Pipelines are only announced once they
+// have finished, and merge requests and issues aren't announced for every edit.
+func (p *payload) announced() bool {
+	switch p.ObjectKind {
+	case eventPush:
+		return true
+	case eventMergeRequest, eventIssue:
+		return p.ObjectAttributes.Action != "" && p.ObjectAttributes.Action != "update"
+	case eventPipeline:
+		switch p.ObjectAttributes.Status {
+		case "success", "failed", "canceled":
+			return true
+		}
+	}
+	return false
+}
+
+// htmlMessage returns the notice for the event, in the same form as the Github webhook service's.
+func (p *payload) htmlMessage() string {
+	project := fmt.Sprintf("[<u>%s</u>]", html.EscapeString(p.Project.PathWithNamespace))
+	attrs := &p.ObjectAttributes
+	switch p.ObjectKind {
+	case eventPush:
+		return p.pushHTMLMessage(project)
+	case eventMergeRequest:
+		return fmt.Sprintf("%s %s %s <b>merge request !%d</b>: %s [%s → %s] - %s",
+			project,
+			html.EscapeString(p.User.Username),
+			html.EscapeString(pastTense(attrs.Action)),
+			attrs.IID,
+			html.EscapeString(attrs.Title),
+			html.EscapeString(attrs.SourceBranch),
+			html.EscapeString(attrs.TargetBranch),
+			html.EscapeString(attrs.URL),
+		)
+	case eventIssue:
+		return fmt.Sprintf("%s %s %s <b>issue #%d</b>: %s [%s] - %s",
+			project,
+			html.EscapeString(p.User.Username),
+			html.EscapeString(pastTense(attrs.Action)),
+			attrs.IID,
+			html.EscapeString(attrs.Title),
+			html.EscapeString(attrs.State),
+			html.EscapeString(attrs.URL),
+		)
+	case eventPipeline:
+		status := map[string]string{
+			"success":  `<font color="green">passed</font>`,
+			"failed":   `<font color="red">failed</font>`,
+			"canceled": "was canceled",
+		}[attrs.Status]
+		var duration string
+		if attrs.Duration != nil {
+			duration = fmt.Sprintf(" in %s", time.Duration(*attrs.Duration)*time.Second)
+		}
+		url := attrs.URL
+		if url == "" {
+			url = fmt.Sprintf("%s/-/pipelines/%d", p.Project.WebURL, attrs.ID)
+		}
+		return fmt.Sprintf("%s <b>pipeline #%d</b> on %s %s%s (started by %s) - %s",
+			project,
+			attrs.ID,
+			html.EscapeString(attrs.Ref),
+			status,
+			duration,
+			html.EscapeString(p.User.Username),
+			html.EscapeString(url),
+		)
+	}
+	return ""
+}
+
+func (p *payload) pushHTMLMessage(project string) string {
+	branch := strings.TrimPrefix(p.Ref, "refs/heads/")
+	if p.After == deletedCommit {
+		return fmt.Sprintf(`%s %s <b><font color="red">deleted</font> %s</b>`,
+			project, html.EscapeString(p.UserUsername), html.EscapeString(branch))
+	}
+	if len(p.Commits) == 0 {
+		return fmt.Sprintf("%s %s pushed to <b>%s</b>", project, html.EscapeString(p.UserUsername), html.EscapeString(branch))
+	}
+	latest := p.Commits[len(p.Commits)-1]
+	if p.TotalCommitsCount <= 1 {
+		return fmt.Sprintf("%s %s pushed to <b>%s</b>: %s - %s",
+			project,
+			html.EscapeString(p.UserUsername),
+			html.EscapeString(branch),
+			html.EscapeString(firstLine(latest.Message)),
+			html.EscapeString(latest.URL),
+		)
+	}
+	// The commits are oldest first, so the latest are listed. The line breaks are kept in the
+	// plain text body too.
+	commits := p.Commits
+	if len(commits) > maxCommits {
+		commits = commits[len(commits)-maxCommits:]
+	}
+	var lines []string
+	for _, c := range commits {
+		lines = append(lines, fmt.Sprintf("%s: %s", html.EscapeString(c.Author.Name), html.EscapeString(firstLine(c.Message))))
+	}
+	if more := p.TotalCommitsCount - len(commits); more > 0 {
+		lines = append(lines, fmt.Sprintf("and %d more", more))
+	}
+	return fmt.Sprintf("%s %s pushed %d commits to <b>%s</b>: %s<br>\n%s",
+		project,
+		html.EscapeString(p.UserUsername),
+		p.TotalCommitsCount,
+		html.EscapeString(branch),
+		html.EscapeString(latest.URL),
+		strings.Join(lines, "<br>\n"),
+	)
+}
+
+// pastTense turns a merge request or issue action, e.g. "open" or "merge", into what was done.
+func pastTense(action string) string {
+	switch {
+	case action == "approval" || action == "unapproval":
+		return strings.TrimSuffix(action, "al") + "ed"
+	case strings.HasSuffix(action, "ed"):
+		return action
+	case strings.HasSuffix(action, "e"):
+		return action + "d"
+	}
+	return action + "ed"
+}
+
+func firstLine(s string) string {
+	return strings.TrimSpace(strings.SplitN(s, "\n", 2)[0])
+}
@@ -0,0 +1,236 @@
+// Package gitlab implements a Service which sends notices into rooms when GitLab sends webhook
+// events to it.
+package gitlab
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/templates"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the GitLab service.
+const ServiceType = "gitlab"
+
+// The biggest webhook payload which is read. GitLab lists at most 20 commits of a push, so real
+// payloads are far smaller.
+const maxPayloadSize = 5 * 1024 * 1024
+
+// Service contains the Config fields for the GitLab service.
+//
+// This service will send notices into a Matrix room when GitLab sends webhook events to it. It
+// requires a public domain which GitLab can reach. Notices will be sent as the service user ID.
+//
+// Go-NEB can't create the webhooks itself. Add a webhook to each project under Settings >
+// Webhooks, with the URL in webhook_url and the secret token from this config, and tick the
+// events to send: push, merge request, issue and pipeline events are announced. Pipelines are
+// announced once they have passed, failed or been canceled.
+//
+// Example JSON request:
+//   {
+//       "secret_token": "a long random string",
+//       "rooms": {
+//           "!ewfug483gsfe:localhost": {
+//               "projects": {
+//                   "my-group/my-project": {
+//                       "events": ["push", "merge_request", "pipeline"],
+//                       "branches": ["main", "release/*"]
+//                   }
+//               }
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL to add as the projects' webhook. Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The secret token the webhooks are set up with, which GitLab sends in the X-Gitlab-Token
+	// header. Requests without it are refused.
+	SecretToken string `json:"secret_token"`
+	// A map from Matrix room ID to the GitLab projects to announce events from.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is which events are announced in a room.
+type RoomConfig struct {
+	// A map of "group/project" paths, including any subgroups, to the events to announce.
+	Projects map[string]ProjectConfig `json:"projects"`
+}
+
+// ProjectConfig is which of a project's events are announced.
+type ProjectConfig struct {
+	// Optional. The events to announce: "push", "merge_request", "issue" and "pipeline".
+	// Defaults to all of them.
+	Events []string `json:"events"`
+	// Optional. Only announce pushes to, merge requests into and pipelines on branches matching
+	// these patterns, e.g. "release/*". Issues are always announced.
+	Branches []string `json:"branches"`
+}
+
+// allows returns whether the room wants to hear about the event.
+func (c *ProjectConfig) allows(p *payload) bool {
+	if len(c.Events) > 0 && !contains(c.Events, p.ObjectKind) {
+		return false
+	}
+	branch := p.branch()
+	if len(c.Branches) == 0 || branch == "" {
+		return true
+	}
+	for _, pattern := range c.Branches {
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// OnReceiveWebhook receives requests from GitLab and sends notices about them into the rooms of
+// their project.
+//
+// The request must have the secret token in its X-Gitlab-Token header. Events which aren't
+// announced, or are about projects which aren't configured, are acknowledged and ignored, so
+// that GitLab doesn't disable the webhook.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	token := req.Header.Get("X-Gitlab-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.SecretToken)) != 1 {
+		log.WithField("service_id", s.ServiceID()).Warn("Received GitLab webhook with a bad token")
+		w.WriteHeader(403)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxPayloadSize))
+	if err != nil {
+		log.WithError(err).Error("Failed to read GitLab webhook body")
+		w.WriteHeader(400)
+		return
+	}
+	p, err := parsePayload(body)
+	if err != nil {
+		log.WithError(err).WithField("event", req.Header.Get("X-Gitlab-Event")).Error("Failed to parse GitLab webhook")
+		w.WriteHeader(400)
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"event":   p.ObjectKind,
+		"project": p.Project.PathWithNamespace,
+	})
+	if !p.announced() {
+		logger.Debug("Ignoring GitLab event")
+		w.WriteHeader(200)
+		return
+	}
+
+	msg := utils.StrippedHTMLMessage(mevt.MsgNotice, p.htmlMessage())
+	msg = renderTemplate(p, body, msg)
+	for roomID, roomConfig := range s.Rooms {
+		for project, projectConfig := range roomConfig.Projects {
+			if !strings.EqualFold(project, p.Project.PathWithNamespace) {
+				continue
+			}
+			if !projectConfig.allows(p) {
+				logger.WithField("room_id", roomID).Debug("Notification filtered out for room")
+				continue
+			}
+			logger.WithFields(log.Fields{
+				"message": msg,
+				"room_id": roomID,
+			}).Print("Sending notification to room")
+			if _, e := notify.Send(cli, s, notify.Notification{
+				RoomID:         roomID,
+				Content:        msg,
+				CorrelationKey: p.correlationKey(),
+			}); e != nil {
+				logger.WithError(e).WithField("room_id", roomID).Print(
+					"Failed to send notification to room.")
+			}
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// renderTemplate applies any template override for this event, named "gitlab.<event>.<action>"
+// (e.g. "gitlab.merge_request.merge", or "gitlab.pipeline.failed" for pipelines). The template
+// is given the raw webhook payload, so its fields are those documented by GitLab.
+func renderTemplate(p *payload, body []byte, msg mevt.MessageEventContent) mevt.MessageEventContent {
+	var data map[string]interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return msg
+	}
+	name := "gitlab." + p.ObjectKind
+	if p.ObjectKind == eventPipeline {
+		name += "." + p.ObjectAttributes.Status
+	} else if p.ObjectAttributes.Action != "" {
+		name += "." + p.ObjectAttributes.Action
+	}
+	return templates.Render(name, data, msg)
+}
+
+// Register makes sure the Config information supplied is valid, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if s.SecretToken == "" {
+		return fmt.Errorf("A secret_token is required")
+	}
+	projects := 0
+	for roomID, roomConfig := range s.Rooms {
+		for project, projectConfig := range roomConfig.Projects {
+			if strings.Count(project, "/") == 0 || strings.HasPrefix(project, "/") || strings.HasSuffix(project, "/") {
+				return fmt.Errorf("Project '%s' in room %s is not a group/project path", project, roomID)
+			}
+			for _, event := range projectConfig.Events {
+				switch event {
+				case eventPush, eventMergeRequest, eventIssue, eventPipeline:
+				default:
+					return fmt.Errorf("Project '%s' in room %s has an unknown event '%s'", project, roomID, event)
+				}
+			}
+			for _, pattern := range projectConfig.Branches {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("Branch pattern '%s' is malformed: %s", pattern, err)
+				}
+			}
+			projects++
+		}
+	}
+	if projects == 0 {
+		return fmt.Errorf("At least one project is required")
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
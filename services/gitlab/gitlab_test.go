@@ -0,0 +1,186 @@
+package gitlab
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const (
+	pushEvent = `{
+		"object_kind": "push",
+		"ref": "refs/heads/main",
+		"after": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+		"user_username": "link",
+		"project": {"path_with_namespace": "hyrule/castle", "web_url": "https://gitlab.hyrule/hyrule/castle"},
+		"commits": [
+			{"message": "Open the gate\n\nThe guards were asleep", "url": "https://gitlab.hyrule/hyrule/castle/-/commit/b6568db1",
+				"author": {"name": "Link"}},
+			{"message": "Light the torches", "url": "https://gitlab.hyrule/hyrule/castle/-/commit/da156088",
+				"author": {"name": "Zelda"}}
+		],
+		"total_commits_count": 2
+	}`
+	mergeRequestEvent = `{
+		"object_kind": "merge_request",
+		"user": {"username": "zelda"},
+		"project": {"path_with_namespace": "hyrule/castle", "web_url": "https://gitlab.hyrule/hyrule/castle"},
+		"object_attributes": {"id": 99, "iid": 12, "title": "Repair the <bridge>", "action": "%s",
+			"state": "opened", "source_branch": "bridge", "target_branch": "%s",
+			"url": "https://gitlab.hyrule/hyrule/castle/-/merge_requests/12"}
+	}`
+	issueEvent = `{
+		"object_kind": "issue",
+		"user": {"username": "impa"},
+		"project": {"path_with_namespace": "hyrule/castle", "web_url": "https://gitlab.hyrule/hyrule/castle"},
+		"object_attributes": {"id": 301, "iid": 23, "title": "Moat is empty", "action": "close", "state": "closed",
+			"url": "https://gitlab.hyrule/hyrule/castle/-/issues/23"}
+	}`
+	pipelineEvent = `{
+		"object_kind": "pipeline",
+		"user": {"username": "link"},
+		"project": {"path_with_namespace": "hyrule/castle", "web_url": "https://gitlab.hyrule/hyrule/castle"},
+		"object_attributes": {"id": 31, "ref": "main", "tag": false, "status": "%s", "duration": 95}
+	}`
+)
+
+func TestWebhook(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.String(), "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, fmt.Sprintf("%s %s", room, msg.Body))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"secret_token": "triforce",
+		"rooms": {
+			"!castle:hyrule": {
+				"projects": {"Hyrule/Castle": {}}
+			},
+			"!builds:hyrule": {
+				"projects": {"hyrule/castle": {"events": ["merge_request", "pipeline"], "branches": ["main", "release/*"]}}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create gitlab service: ", err)
+	}
+	s := srv.(*Service)
+
+	for _, tc := range []struct {
+		token string
+		body  string
+		code  int
+	}{
+		{"triforce", pushEvent, 200},
+		{"triforce", fmt.Sprintf(mergeRequestEvent, "merge", "main"), 200},
+		{"triforce", fmt.Sprintf(mergeRequestEvent, "open", "feature"), 200},
+		// Edits aren't announced
+		{"triforce", fmt.Sprintf(mergeRequestEvent, "update", "main"), 200},
+		{"triforce", issueEvent, 200},
+		// Pipelines are only announced once they finish
+		{"triforce", fmt.Sprintf(pipelineEvent, "running"), 200},
+		{"triforce", fmt.Sprintf(pipelineEvent, "failed"), 200},
+		{"triforce", strings.Replace(pushEvent, "hyrule/castle", "termina/clock-town", 1), 200},
+		{"", pushEvent, 403},
+		{"ganon", pushEvent, 403},
+		{"triforce", `{"object_kind": "push"}`, 400},
+	} {
+		req := httptest.NewRequest("POST", "https://neb.endpoint/gitlab", strings.NewReader(tc.body))
+		req.Header.Set("X-Gitlab-Token", tc.token)
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, matrixCli)
+		if w.Code != tc.code {
+			t.Errorf("Bad response to %s with token %q: got %d, want %d", tc.body, tc.token, w.Code, tc.code)
+		}
+	}
+
+	want := map[string]bool{
+		"!castle:hyrule [hyrule/castle] link pushed 2 commits to main: https://gitlab.hyrule/hyrule/castle/-/commit/da156088\n" +
+			"Link: Open the gate\nZelda: Light the torches": true,
+		"!castle:hyrule [hyrule/castle] zelda merged merge request !12: Repair the <bridge> [bridge → main] - " +
+			"https://gitlab.hyrule/hyrule/castle/-/merge_requests/12": true,
+		"!builds:hyrule [hyrule/castle] zelda merged merge request !12: Repair the <bridge> [bridge → main] - " +
+			"https://gitlab.hyrule/hyrule/castle/-/merge_requests/12": true,
+		"!castle:hyrule [hyrule/castle] zelda opened merge request !12: Repair the <bridge> [bridge → feature] - " +
+			"https://gitlab.hyrule/hyrule/castle/-/merge_requests/12": true,
+		"!castle:hyrule [hyrule/castle] impa closed issue #23: Moat is empty [closed] - " +
+			"https://gitlab.hyrule/hyrule/castle/-/issues/23": true,
+		"!castle:hyrule [hyrule/castle] pipeline #31 on main failed in 1m35s (started by link) - " +
+			"https://gitlab.hyrule/hyrule/castle/-/pipelines/31": true,
+		"!builds:hyrule [hyrule/castle] pipeline #31 on main failed in 1m35s (started by link) - " +
+			"https://gitlab.hyrule/hyrule/castle/-/pipelines/31": true,
+	}
+	if len(sent) != len(want) {
+		t.Errorf("Bad number of notices: got %d, want %d: %q", len(sent), len(want), sent)
+	}
+	for _, msg := range sent {
+		if !want[msg] {
+			t.Errorf("Unexpected notice: %q", msg)
+		}
+	}
+}
+
+func TestPushHTMLMessage(t *testing.T) {
+	p, err := parsePayload([]byte(`{
+		"object_kind": "push",
+		"ref": "refs/heads/old-map",
+		"after": "0000000000000000000000000000000000000000",
+		"user_username": "link",
+		"project": {"path_with_namespace": "hyrule/castle"},
+		"total_commits_count": 0
+	}`))
+	if err != nil {
+		t.Fatal("Failed to parse payload: ", err)
+	}
+	want := `[<u>hyrule/castle</u>] link <b><font color="red">deleted</font> old-map</b>`
+	if got := p.htmlMessage(); got != want {
+		t.Errorf("Bad deleted branch message: got %q, want %q", got, want)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"rooms": {"!castle:hyrule": {"projects": {"hyrule/castle": {}}}}}`,
+		`{"secret_token": "triforce"}`,
+		`{"secret_token": "triforce", "rooms": {"!castle:hyrule": {"projects": {}}}}`,
+		`{"secret_token": "triforce", "rooms": {"!castle:hyrule": {"projects": {"castle": {}}}}}`,
+		`{"secret_token": "triforce", "rooms": {"!castle:hyrule": {"projects": {"hyrule/castle": {"events": ["tag_push"]}}}}}`,
+		`{"secret_token": "triforce", "rooms": {"!castle:hyrule": {"projects": {"hyrule/castle": {"branches": ["release/["]}}}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create gitlab service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -1,17 +1,22 @@
 // Package google implements a Service which adds !commands for Google custom search engine.
-// Initially this package just supports image search but could be expanded to provide other functionality provided by the Google custom search engine API - https://developers.google.com/custom-search/json-api/v1/overview
+// It supports web, image, news and YouTube search, and could be expanded to provide other functionality provided by the Google custom search engine API - https://developers.google.com/custom-search/json-api/v1/overview
 package google
 
 import (
 	"encoding/json"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"math"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/uploadcache"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -20,6 +25,11 @@ import (
 // ServiceType of the Google service
 const ServiceType = "google"
 
+// How many headlines "!google news" responds with
+const newsResults = 3
+
+var dateRestrictRegex = regexp.MustCompile(`^[dwmy][0-9]+$`)
+
 var httpClient = &http.Client{}
 
 type googleSearchResults struct {
@@ -55,20 +65,80 @@ type googleImage struct {
 //
 // Example request:
 //   {
-//			"api_key": "AIzaSyA4FD39..."
-//			"cx": "ASdsaijwdfASD..."
+//			"api_key": "AIzaSyA4FD39...",
+//			"cse_id": "ASdsaijwdfASD...",
+//			"safe_search": "active",
+//			"news_cse_id": "Qwertyuiop1234...",
+//			"date_restrict": "d1",
+//			"youtube_thumbnails": true,
+//			"cache_ttl_mins": 30
 //   }
 type Service struct {
 	types.DefaultService
 	// The Google API key to use when making HTTP requests to Google.
 	APIKey string `json:"api_key"`
 	// The Google custom search engine ID
+	CSEID string `json:"cse_id"`
+	// Deprecated: Use CSEID. The Google custom search engine ID, used if cse_id isn't set.
 	Cx string `json:"cx"`
+	// Optional. The SafeSearch level: "active" to filter explicit results, or "off". Defaults to
+	// Google's default, which is "off".
+	SafeSearch string `json:"safe_search"`
+	// Optional. A custom search engine which only searches news sites, for "!google news". Defaults
+	// to the main custom search engine.
+	NewsCSEID string `json:"news_cse_id"`
+	// Optional. How recent news results must be, as a number of days, weeks, months or years,
+	// e.g. "d1" for the last 24 hours or "w2" for the last fortnight. Defaults to "d1".
+	DateRestrict string `json:"date_restrict"`
+	// Optional. Post the thumbnail of videos found by "!google youtube" as an image too.
+	YouTubeThumbnails bool `json:"youtube_thumbnails"`
+	// Optional. Reuse the image uploaded for an image search when the same search is made again
+	// within this many minutes, rather than searching and uploading it again. Defaults to 0, which
+	// doesn't cache images.
+	CacheTTLMins int `json:"cache_ttl_mins"`
+}
+
+// cseID returns the custom search engine ID, from either of the fields it can be set in.
+func (s *Service) cseID() string {
+	if s.CSEID != "" {
+		return s.CSEID
+	}
+	return s.Cx
+}
+
+// checkConfig returns an error, which can be shown to users, if the service isn't set up properly.
+func (s *Service) checkConfig() error {
+	if s.APIKey == "" {
+		return fmt.Errorf("The Google service has no api_key. Ask the Go-NEB admin to configure one.")
+	}
+	if s.cseID() == "" {
+		return fmt.Errorf("The Google service has no cse_id (custom search engine ID). Ask the Go-NEB admin to configure one.")
+	}
+	if s.SafeSearch != "" && s.SafeSearch != "active" && s.SafeSearch != "off" {
+		return fmt.Errorf("The Google service has an unknown safe_search level '%s': must be active or off", s.SafeSearch)
+	}
+	if s.DateRestrict != "" && !dateRestrictRegex.MatchString(s.DateRestrict) {
+		return fmt.Errorf("The Google service has a bad date_restrict '%s': must be like d1, w2, m3 or y1", s.DateRestrict)
+	}
+	return nil
 }
 
 // Commands supported:
 //    !google image some_search_query_without_quotes
 // Responds with a suitable image into the same room as the command.
+//    !google image --size=medium --type=png some_search_query_without_quotes
+// Responds with an image of that size and file type. Sizes are icon, small, medium, large (the
+// default), xlarge, xxlarge and huge. Types are file extensions, e.g. jpg, png, gif or svg.
+//    !google web some_search_query_without_quotes
+//    !google some_search_query_without_quotes
+// Responds with the title, snippet and link of the top web result.
+//    !google news some_search_query_without_quotes
+// Responds with the top recent headlines and their links.
+//    !google youtube some_search_query_without_quotes
+// Responds with the title, channel, duration and link of the top video.
+//    !google next
+//    !google image next
+// Responds with the next result of the last search in the room.
 func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	return []types.Command{
 		{
@@ -77,16 +147,46 @@ func (s *Service) Commands(client types.MatrixClient) []types.Command {
 				return s.cmdGoogleImgSearch(client, roomID, userID, args)
 			},
 		},
+		{
+			Path: []string{"google", "web"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGoogleWebSearch(roomID, args)
+			},
+		},
+		{
+			Path: []string{"google", "news"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGoogleNewsSearch(args)
+			},
+		},
+		{
+			Path: []string{"google", "youtube"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGoogleYouTubeSearch(client, roomID, args)
+			},
+		},
 		{
 			Path: []string{"google", "help"},
 			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
 				return usageMessage(), nil
 			},
 		},
+		{
+			Path: []string{"google", "next"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGoogleNext(client, roomID, "")
+			},
+		},
+		{
+			Path: []string{"google", "image", "next"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGoogleNext(client, roomID, searchImage)
+			},
+		},
 		{
 			Path: []string{"google"},
 			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
-				return usageMessage(), nil
+				return s.cmdGoogleWebSearch(roomID, args)
 			},
 		},
 	}
@@ -96,25 +196,190 @@ func (s *Service) Commands(client types.MatrixClient) []types.Command {
 func usageMessage() *mevt.MessageEventContent {
 	return &mevt.MessageEventContent{
 		MsgType: mevt.MsgNotice,
-		Body:    `Usage: !google image image_search_text`,
+		Body:    "Usage: !google [web] search_text\n       !google image [--size=large] [--type=png] image_search_text\n       !google news news_search_text\n       !google youtube video_search_text\n       !google next",
+	}
+}
+
+func (s *Service) cmdGoogleWebSearch(roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) < 1 {
+		return usageMessage(), nil
+	}
+	return s.webResult(roomID, strings.Join(args, " "), 1)
+}
+
+// webResult responds with the web result at the 1-based start index.
+func (s *Service) webResult(roomID id.RoomID, querySentence string, start int) (interface{}, error) {
+	searchResult, err := s.text2webGoogle(querySentence, start)
+	if err != nil {
+		return nil, err
 	}
+	if searchResult == nil {
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "No results found!",
+		}, nil
+	}
+	s.storeLastSearch(roomID, lastSearch{Type: searchWeb, Query: querySentence, Start: start})
+
+	// Snippets are wrapped onto several lines
+	snippet := strings.Join(strings.Fields(searchResult.Snippet), " ")
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("%s\n%s\n%s", searchResult.Title, snippet, searchResult.Link),
+		Format:  mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf(
+			"<a href=\"%s\"><strong>%s</strong></a><br>%s",
+			html.EscapeString(searchResult.Link), html.EscapeString(searchResult.Title), html.EscapeString(snippet),
+		),
+	}, nil
+}
+
+func (s *Service) cmdGoogleNewsSearch(args []string) (interface{}, error) {
+	if len(args) < 1 {
+		return usageMessage(), nil
+	}
+	query := strings.Join(args, " ")
+	log.Info("Searching Google for news about ", query)
+
+	q := url.Values{}
+	q.Set("num", strconv.Itoa(newsResults))
+	q.Set("dateRestrict", s.DateRestrict)
+	if s.DateRestrict == "" {
+		q.Set("dateRestrict", "d1")
+	}
+	if s.NewsCSEID != "" {
+		q.Set("cx", s.NewsCSEID)
+	}
+	searchResults, err := s.search(query, 1, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(searchResults.Items) < 1 {
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "No recent news found!",
+		}, nil
+	}
+
+	var lines, items []string
+	for i, item := range searchResults.Items {
+		if i == newsResults {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s (%s)\n   %s", i+1, item.Title, item.DisplayLink, item.Link))
+		items = append(items, fmt.Sprintf(
+			"<li><a href=\"%s\">%s</a> <em>%s</em></li>",
+			html.EscapeString(item.Link), html.EscapeString(item.Title), html.EscapeString(item.DisplayLink),
+		))
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: "<ol>" + strings.Join(items, "") + "</ol>",
+	}, nil
 }
 
 func (s *Service) cmdGoogleImgSearch(client types.MatrixClient, roomID id.RoomID, userID id.UserID,
 	args []string) (interface{}, error) {
 
+	opts, args, err := parseImageFlags(args)
+	if err != nil {
+		return nil, err
+	}
 	if len(args) < 1 {
 		return usageMessage(), nil
 	}
 
 	// Get the query text to search for.
-	querySentence := strings.Join(args, " ")
+	return s.imgResult(client, roomID, strings.Join(args, " "), opts, 1)
+}
 
-	searchResult, err := s.text2imgGoogle(querySentence)
+// imageOptions restrict the images which image searches find.
+type imageOptions struct {
+	// The CSE imgSize, or "" for the default
+	Size string
+	// The CSE fileType, e.g. "png", or "" for any type
+	FileType string
+}
+
+// The sizes and file types which image searches can be restricted to
+var (
+	imageSizes     = []string{"icon", "small", "medium", "large", "xlarge", "xxlarge", "huge"}
+	imageFileTypes = []string{"jpg", "png", "gif", "bmp", "svg", "webp", "ico"}
+)
+
+// parseImageFlags takes the --size=X and --type=X flags out of the arguments of an image search.
+func parseImageFlags(args []string) (opts imageOptions, rest []string, err error) {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			rest = append(rest, arg)
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(arg, "--"), "=", 2)
+		if len(parts) != 2 {
+			return opts, nil, fmt.Errorf("Bad flag %s: use --size=X or --type=X", arg)
+		}
+		value := strings.ToLower(parts[1])
+		switch parts[0] {
+		case "size":
+			if !contains(imageSizes, value) {
+				return opts, nil, fmt.Errorf("Unknown image size '%s': must be one of %s", parts[1], strings.Join(imageSizes, ", "))
+			}
+			opts.Size = value
+		case "type":
+			value = strings.TrimPrefix(value, ".")
+			if value == "jpeg" {
+				value = "jpg"
+			}
+			if !contains(imageFileTypes, value) {
+				return opts, nil, fmt.Errorf("Unknown image type '%s': must be one of %s", parts[1], strings.Join(imageFileTypes, ", "))
+			}
+			opts.FileType = value
+		default:
+			return opts, nil, fmt.Errorf("Unknown flag %s: use --size=X or --type=X", arg)
+		}
+	}
+	return opts, rest, nil
+}
 
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// imgResult responds with the image result at the 1-based start index.
+func (s *Service) imgResult(client types.MatrixClient, roomID id.RoomID, querySentence string, opts imageOptions, start int) (interface{}, error) {
+	kind := fmt.Sprintf("image %d %s %s %s", start, s.SafeSearch, opts.Size, opts.FileType)
+	key := uploadcache.Key(s.ServiceID(), kind, querySentence)
+	cacheTTL := time.Duration(s.CacheTTLMins) * time.Minute
+	msg, err := uploadcache.Fetch(key, cacheTTL, func() (mevt.MessageEventContent, error) {
+		return s.uploadImgResult(client, querySentence, opts, start)
+	})
 	if err != nil {
 		return nil, err
 	}
+	s.storeLastSearch(roomID, lastSearch{
+		Type:      searchImage,
+		Query:     querySentence,
+		Start:     start,
+		ImageSize: opts.Size,
+		ImageType: opts.FileType,
+	})
+	return msg, nil
+}
+
+// uploadImgResult searches for the image at the 1-based start index and uploads it.
+func (s *Service) uploadImgResult(client types.MatrixClient, querySentence string, opts imageOptions, start int) (mevt.MessageEventContent, error) {
+	searchResult, err := s.text2imgGoogle(querySentence, opts, start)
+
+	if err != nil {
+		return mevt.MessageEventContent{}, err
+	}
 
 	var imgURL = searchResult.Link
 	if imgURL == "" {
@@ -127,7 +392,7 @@ func (s *Service) cmdGoogleImgSearch(client types.MatrixClient, roomID id.RoomID
 	// FIXME -- Sometimes upload fails with a cryptic error - "msg=Upload request failed code=400"
 	resUpload, err := client.UploadLink(imgURL)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to upload Google image at URL %s (content type %s) to matrix: %s", imgURL, searchResult.Mime, err.Error())
+		return mevt.MessageEventContent{}, fmt.Errorf("Failed to upload Google image at URL %s (content type %s) to matrix: %s", imgURL, searchResult.Mime, err.Error())
 	}
 
 	return mevt.MessageEventContent{
@@ -142,24 +407,69 @@ func (s *Service) cmdGoogleImgSearch(client types.MatrixClient, roomID id.RoomID
 	}, nil
 }
 
-// text2imgGoogle returns info about an image
-func (s *Service) text2imgGoogle(query string) (*googleSearchResult, error) {
+// text2imgGoogle returns info about the image at the 1-based start index
+func (s *Service) text2imgGoogle(query string, opts imageOptions, start int) (*googleSearchResult, error) {
 	log.Info("Searching Google for an image of a ", query)
 
+	q := url.Values{}
+	q.Set("imgSize", "large")    // Just search for medium size images
+	q.Set("searchType", "image") // Search for images
+	if opts.Size != "" {
+		q.Set("imgSize", opts.Size)
+	}
+	if opts.FileType != "" {
+		q.Set("fileType", opts.FileType)
+	}
+
+	searchResults, err := s.search(query, start, q)
+	if err != nil {
+		return nil, err
+	} else if len(searchResults.Items) < 1 {
+		return nil, fmt.Errorf("No images found")
+	}
+
+	// Return only the first search result
+	return &searchResults.Items[0], nil
+}
+
+// text2webGoogle returns the web result at the 1-based start index, or nil if there are none
+func (s *Service) text2webGoogle(query string, start int) (*googleSearchResult, error) {
+	log.Info("Searching Google for ", query)
+
+	searchResults, err := s.search(query, start, url.Values{})
+	if err != nil {
+		return nil, err
+	} else if len(searchResults.Items) < 1 {
+		return nil, nil
+	}
+	return &searchResults.Items[0], nil
+}
+
+// search runs the custom search for the query, asking for results from the 1-based start index.
+// The parameters choose the kind of search, and can ask for more than one result with "num" or
+// use another search engine with "cx".
+func (s *Service) search(query string, start int, q url.Values) (*googleSearchResults, error) {
+	if err := s.checkConfig(); err != nil {
+		return nil, err
+	}
 	u, err := url.Parse("https://www.googleapis.com/customsearch/v1")
 	if err != nil {
 		return nil, err
 	}
 
-	q := u.Query()
-	q.Set("q", query)            // String to search for
-	q.Set("num", "1")            // Just return 1 image result
-	q.Set("start", "1")          // No search result offset
-	q.Set("imgSize", "large")    // Just search for medium size images
-	q.Set("searchType", "image") // Search for images
+	q.Set("q", query)                   // String to search for
+	q.Set("start", strconv.Itoa(start)) // Search result offset
+	if q.Get("num") == "" {
+		q.Set("num", "1") // Just return 1 result
+	}
 
 	q.Set("key", s.APIKey) // Set the API key for the request
-	q.Set("cx", s.Cx)      // Set the custom search engine ID
+	if q.Get("cx") == "" {
+		q.Set("cx", s.cseID()) // Set the custom search engine ID
+	}
+	if s.SafeSearch != "" {
+		q.Set("safe", s.SafeSearch) // Filter explicit results
+	}
 
 	u.RawQuery = q.Encode()
 	// log.Info("Request URL: ", u)
@@ -179,12 +489,8 @@ func (s *Service) text2imgGoogle(query string) (*googleSearchResult, error) {
 	// log.Info(response2String(res))
 	if err := json.NewDecoder(res.Body).Decode(&searchResults); err != nil {
 		return nil, fmt.Errorf("ERROR - %s", err.Error())
-	} else if len(searchResults.Items) < 1 {
-		return nil, fmt.Errorf("No images found")
 	}
-
-	// Return only the first search result
-	return &searchResults.Items[0], nil
+	return &searchResults, nil
 }
 
 // response2String returns a string representation of an HTTP response body
@@ -197,6 +503,11 @@ func response2String(res *http.Response) string {
 	return str
 }
 
+// Register makes sure that the API key and custom search engine are configured.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	return s.checkConfig()
+}
+
 // Initialise the service
 func init() {
 	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
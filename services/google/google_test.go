@@ -8,11 +8,13 @@ import (
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/testutils"
 	"github.com/matrix-org/go-neb/types"
 	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
 )
 
 // TODO: It would be nice to tabularise this test so we can try failing different combinations of responses to make
@@ -39,6 +41,10 @@ func TestCommand(t *testing.T) {
 		if query.Get("key") != apiKey {
 			t.Fatalf("Bad apiKey: got %s want %s", query.Get("key"), apiKey)
 		}
+		// Check the search engine
+		if query.Get("cx") != "my-engine" {
+			t.Fatalf("Bad cx: got %s want my-engine", query.Get("cx"))
+		}
 		// Check the search query
 		var searchString = query.Get("q")
 		var searchStringLength = len(searchString)
@@ -78,7 +84,7 @@ func TestCommand(t *testing.T) {
 
 	// Create the Google service
 	srv, err := types.CreateService("id", ServiceType, "@googlebot:hyrule", []byte(
-		`{"api_key":"`+apiKey+`"}`,
+		`{"api_key":"`+apiKey+`","cse_id":"my-engine"}`,
 	))
 	if err != nil {
 		t.Fatal("Failed to create Google service: ", err)
@@ -106,7 +112,7 @@ func TestCommand(t *testing.T) {
 
 	// Execute the matrix !command
 	cmds := google.Commands(matrixCli)
-	if len(cmds) != 3 {
+	if len(cmds) != 8 {
 		t.Fatalf("Unexpected number of commands: %d", len(cmds))
 	}
 	cmd := cmds[0]
@@ -115,3 +121,351 @@ func TestCommand(t *testing.T) {
 		t.Fatalf("Failed to process command: %s", err.Error())
 	}
 }
+
+func TestWebSearch(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	// Mock the response from Google
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		query := req.URL.Query()
+		if query.Get("searchType") != "" {
+			t.Fatalf("Web searches shouldn't have a searchType, got %s", query.Get("searchType"))
+		}
+		if query.Get("cx") != "old-engine" || query.Get("safe") != "active" {
+			t.Fatalf("Bad cx or safe: got %s, %s", query.Get("cx"), query.Get("safe"))
+		}
+		if query.Get("q") == "nothing at all" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"searchInformation":{"totalResults":"0"}}`)),
+			}, nil
+		}
+		b, err := json.Marshal(googleSearchResults{Items: []googleSearchResult{{
+			Title:   "Matrix <Home>",
+			Link:    "https://matrix.org/",
+			Snippet: "An open network for secure,\ndecentralised communication.",
+		}}})
+		if err != nil {
+			t.Fatalf("Failed to marshal Google response - %s", err)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(b)),
+		}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@googlebot:hyrule", []byte(
+		`{"api_key":"secret","cx":"old-engine","safe_search":"active"}`,
+	))
+	if err != nil {
+		t.Fatal("Failed to create Google service: ", err)
+	}
+	google := srv.(*Service)
+
+	for _, args := range [][]string{{"google", "web", "matrix", "org"}, {"google", "matrix", "org"}} {
+		var cmd types.Command
+		for _, c := range google.Commands(nil) {
+			if c.Matches(args) && len(c.Path) > len(cmd.Path) {
+				cmd = c
+			}
+		}
+		res, err := cmd.Command("!someroom:hyrule", "@navi:hyrule", args[len(cmd.Path):])
+		if err != nil {
+			t.Fatalf("Failed to process command %v: %s", args, err)
+		}
+		content := res.(mevt.MessageEventContent)
+		if content.Body != "Matrix <Home>\nAn open network for secure, decentralised communication.\nhttps://matrix.org/" {
+			t.Errorf("Bad body for %v: %s", args, content.Body)
+		}
+		if content.FormattedBody != `<a href="https://matrix.org/"><strong>Matrix &lt;Home&gt;</strong></a><br>`+
+			`An open network for secure, decentralised communication.` {
+			t.Errorf("Bad formatted body for %v: %s", args, content.FormattedBody)
+		}
+	}
+
+	res, err := google.cmdGoogleWebSearch("!someroom:hyrule", []string{"nothing", "at", "all"})
+	if err != nil {
+		t.Fatalf("Failed to search for nothing: %s", err)
+	}
+	if content := res.(mevt.MessageEventContent); content.Body != "No results found!" {
+		t.Errorf("Expected no results, got %s", content.Body)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	testCases := map[string]bool{
+		`{"api_key":"secret","cse_id":"engine"}`:                      true,
+		`{"api_key":"secret","cx":"engine"}`:                          true,
+		`{"api_key":"secret","cse_id":"engine","safe_search":"off"}`:  true,
+		`{"cse_id":"engine"}`:                                         false,
+		`{"api_key":"secret"}`:                                        false,
+		`{"api_key":"secret","cse_id":"engine","safe_search":"high"}`: false,
+		`{"api_key":"secret","cse_id":"engine","date_restrict":"d7"}`: true,
+		`{"api_key":"secret","cse_id":"engine","date_restrict":"7d"}`: false,
+	}
+	for config, valid := range testCases {
+		srv, err := types.CreateService("id", ServiceType, "@googlebot:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create Google service: ", err)
+		}
+		if err = srv.Register(nil, nil); (err == nil) != valid {
+			t.Errorf("Register(%s) returned %v, want valid=%v", config, err, valid)
+		}
+	}
+
+	// Services which aren't set up tell the room why
+	srv, _ := types.CreateService("id", ServiceType, "@googlebot:hyrule", []byte(`{"api_key":"secret"}`))
+	_, err := srv.(*Service).cmdGoogleWebSearch("!someroom:hyrule", []string{"matrix"})
+	if err == nil || !strings.Contains(err.Error(), "cse_id") {
+		t.Errorf("Expected an error about the missing cse_id, got %v", err)
+	}
+}
+
+func TestNewsSearch(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		query := req.URL.Query()
+		if query.Get("cx") != "news-engine" || query.Get("num") != "3" || query.Get("dateRestrict") != "w1" {
+			t.Fatalf("Bad news search: %s", req.URL.RawQuery)
+		}
+		var items []googleSearchResult
+		for i := 1; i <= 3; i++ {
+			items = append(items, googleSearchResult{
+				Title:       fmt.Sprintf("Headline %d", i),
+				Link:        fmt.Sprintf("https://news.example/%d", i),
+				DisplayLink: "news.example",
+			})
+		}
+		b, err := json.Marshal(googleSearchResults{Items: items})
+		if err != nil {
+			t.Fatalf("Failed to marshal Google response - %s", err)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(b)),
+		}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@googlebot:hyrule", []byte(
+		`{"api_key":"secret","cse_id":"engine","news_cse_id":"news-engine","date_restrict":"w1"}`,
+	))
+	if err != nil {
+		t.Fatal("Failed to create Google service: ", err)
+	}
+	res, err := srv.(*Service).cmdGoogleNewsSearch([]string{"hyrule", "elections"})
+	if err != nil {
+		t.Fatalf("Failed to search the news: %s", err)
+	}
+	content := res.(mevt.MessageEventContent)
+	want := "1. Headline 1 (news.example)\n   https://news.example/1\n" +
+		"2. Headline 2 (news.example)\n   https://news.example/2\n" +
+		"3. Headline 3 (news.example)\n   https://news.example/3"
+	if content.Body != want {
+		t.Errorf("Bad body: got %q, want %q", content.Body, want)
+	}
+	if !strings.HasPrefix(content.FormattedBody, `<ol><li><a href="https://news.example/1">Headline 1</a> <em>news.example</em></li>`) {
+		t.Errorf("Bad formatted body: %s", content.FormattedBody)
+	}
+}
+
+func TestYouTubeSearch(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		query := req.URL.Query()
+		if query.Get("key") != "secret" {
+			t.Fatalf("Bad API key: %s", query.Get("key"))
+		}
+		var body string
+		switch req.URL.Path {
+		case "/youtube/v3/search":
+			if query.Get("q") != "never gonna" || query.Get("type") != "video" || query.Get("safeSearch") != "strict" {
+				t.Fatalf("Bad search: %s", req.URL.RawQuery)
+			}
+			body = `{"items":[{"id":{"videoId":"dQw4w9WgXcQ"},"snippet":{"title":"Never Gonna Give You Up &amp; More",
+				"channelTitle":"Rick Astley","thumbnails":{"default":{"url":"https://i.ytimg.com/vi/dQw4w9WgXcQ/default.jpg",
+				"width":120,"height":90},"high":{"url":"https://i.ytimg.com/vi/dQw4w9WgXcQ/hqdefault.jpg","width":480,"height":360}}}}]}`
+		case "/youtube/v3/videos":
+			if query.Get("id") != "dQw4w9WgXcQ" {
+				t.Fatalf("Bad video ID: %s", query.Get("id"))
+			}
+			body = `{"items":[{"contentDetails":{"duration":"PT3M33S"}}]}`
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	var thumbnail mevt.MessageEventContent
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() == "https://i.ytimg.com/vi/dQw4w9WgXcQ/hqdefault.jpg" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("some image data")),
+			}, nil
+		} else if strings.Contains(req.URL.String(), "_matrix/media/r0/upload") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://foo/bar"}`)),
+			}, nil
+		} else if strings.Contains(req.URL.String(), "/send/m.room.message/") {
+			if err := json.NewDecoder(req.Body).Decode(&thumbnail); err != nil {
+				t.Fatalf("Failed to decode thumbnail message: %s", err)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yt:hyrule"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@googlebot:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@googlebot:hyrule", []byte(
+		`{"api_key":"secret","cse_id":"engine","safe_search":"active","youtube_thumbnails":true}`,
+	))
+	if err != nil {
+		t.Fatal("Failed to create Google service: ", err)
+	}
+	res, err := srv.(*Service).cmdGoogleYouTubeSearch(matrixCli, "!someroom:hyrule", []string{"never", "gonna"})
+	if err != nil {
+		t.Fatalf("Failed to search YouTube: %s", err)
+	}
+	want := "Never Gonna Give You Up & More\nRick Astley · 3:33\nhttps://www.youtube.com/watch?v=dQw4w9WgXcQ"
+	if body := res.(mevt.MessageEventContent).Body; body != want {
+		t.Errorf("Bad body: got %q, want %q", body, want)
+	}
+	if thumbnail.MsgType != mevt.MsgImage || thumbnail.URL != "mxc://foo/bar" || thumbnail.Info.Width != 480 {
+		t.Errorf("Bad thumbnail: %+v", thumbnail)
+	}
+}
+
+func TestFormatYouTubeDuration(t *testing.T) {
+	testCases := map[string]string{
+		"PT4M13S":  "4:13",
+		"PT45S":    "0:45",
+		"PT1H2M3S": "1:02:03",
+		"P1DT2H":   "26:00:00",
+		"P0D":      "live",
+		"garbage":  "",
+	}
+	for iso, want := range testCases {
+		if got := formatYouTubeDuration(iso); got != want {
+			t.Errorf("formatYouTubeDuration(%s) = %q, want %q", iso, got, want)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	storage := testutils.NewStateStorage()
+	database.SetServiceDB(storage)
+
+	// Mock Google, which returns the start index as the title of the result
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		query := req.URL.Query()
+		b, err := json.Marshal(googleSearchResults{Items: []googleSearchResult{{
+			Title: query.Get("q") + " " + query.Get("searchType") + " " + query.Get("start"),
+			Link:  "https://example.com/",
+		}}})
+		if err != nil {
+			t.Fatalf("Failed to marshal Google response - %s", err)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(b)),
+		}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@googlebot:hyrule", []byte(`{"api_key":"secret","cse_id":"engine"}`))
+	if err != nil {
+		t.Fatal("Failed to create Google service: ", err)
+	}
+	google := srv.(*Service)
+	title := func(res interface{}, err error) string {
+		if err != nil {
+			t.Fatalf("Command failed: %s", err)
+		}
+		return strings.SplitN(res.(mevt.MessageEventContent).Body, "\n", 2)[0]
+	}
+
+	if got := title(google.cmdGoogleNext(nil, "!castle:hyrule", "")); !strings.HasPrefix(got, "There is no recent search") {
+		t.Errorf("Expected no search to continue, got %s", got)
+	}
+	title(google.cmdGoogleWebSearch("!castle:hyrule", []string{"ocarina"}))
+	title(google.cmdGoogleWebSearch("!forest:hyrule", []string{"deku", "tree"}))
+	if got := title(google.cmdGoogleNext(nil, "!castle:hyrule", "")); got != "ocarina  2" {
+		t.Errorf("Bad next result: %s", got)
+	}
+	if got := title(google.cmdGoogleNext(nil, "!castle:hyrule", "")); got != "ocarina  3" {
+		t.Errorf("Bad next result: %s", got)
+	}
+	if got := title(google.cmdGoogleNext(nil, "!forest:hyrule", "")); got != "deku tree  2" {
+		t.Errorf("Searches should be per room, got %s", got)
+	}
+	// The last search was a web search
+	if got := title(google.cmdGoogleNext(nil, "!castle:hyrule", searchImage)); !strings.HasPrefix(got, "There is no recent search") {
+		t.Errorf("Expected no image search to continue, got %s", got)
+	}
+
+	// Searches expire
+	google.storeLastSearch("!castle:hyrule", lastSearch{Type: searchWeb, Query: "ocarina", Start: 3})
+	last, _, _ := google.loadLastSearch("!castle:hyrule")
+	last.TimestampSecs -= int64(2 * searchExpiry / time.Second)
+	stateJSON, _ := json.Marshal(last)
+	storage.StoreServiceState("id", "search !castle:hyrule", stateJSON)
+	if got := title(google.cmdGoogleNext(nil, "!castle:hyrule", "")); !strings.HasPrefix(got, "There is no recent search") {
+		t.Errorf("Expected the search to have expired, got %s", got)
+	}
+	if _, ok := storage.State["id search !castle:hyrule"]; ok {
+		t.Errorf("Expected the expired search to be forgotten")
+	}
+}
+
+func TestImageFlags(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+
+	// Mock Google, recording the image search parameters. There is no image to upload.
+	var searches []string
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		query := req.URL.Query()
+		searches = append(searches, fmt.Sprintf("%s size=%s type=%s start=%s",
+			query.Get("q"), query.Get("imgSize"), query.Get("fileType"), query.Get("start")))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"items":[{"title":"nothing"}]}`)),
+		}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@googlebot:hyrule", []byte(`{"api_key":"secret","cse_id":"engine"}`))
+	if err != nil {
+		t.Fatal("Failed to create Google service: ", err)
+	}
+	google := srv.(*Service)
+
+	for _, args := range []string{"cat", "--size=medium cat --type=PNG", "--type=.jpeg cat"} {
+		if _, err = google.cmdGoogleImgSearch(nil, "!castle:hyrule", "@navi:hyrule", strings.Fields(args)); err != nil {
+			t.Fatalf("!google image %s failed: %s", args, err)
+		}
+	}
+	// The next result has the same size and type
+	if _, err = google.cmdGoogleNext(nil, "!castle:hyrule", searchImage); err != nil {
+		t.Fatalf("!google image next failed: %s", err)
+	}
+	want := []string{
+		"cat size=large type= start=1",
+		"cat size=medium type=png start=1",
+		"cat size=large type=jpg start=1",
+		"cat size=large type=jpg start=2",
+	}
+	if strings.Join(searches, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad image searches: got %q, want %q", searches, want)
+	}
+
+	for _, args := range []string{"--size=enormous cat", "--colour=red cat", "--type cat"} {
+		if _, err = google.cmdGoogleImgSearch(nil, "!castle:hyrule", "@navi:hyrule", strings.Fields(args)); err == nil {
+			t.Errorf("Expected !google image %s to fail", args)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package google
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The kinds of search which can be continued with !google next
+const (
+	searchWeb   = "web"
+	searchImage = "image"
+)
+
+// Searches older than this can't be continued, and are forgotten
+const searchExpiry = time.Hour
+
+// The custom search API only returns the first 100 results
+const maxStart = 100
+
+// lastSearch is the last search made in a room. It is stored in the service state under
+// "search <room ID>".
+type lastSearch struct {
+	Type  string `json:"type"`
+	Query string `json:"query"`
+	// The 1-based index of the result which was shown
+	Start         int   `json:"start"`
+	TimestampSecs int64 `json:"timestamp_secs"`
+	// The --size and --type flags of image searches
+	ImageSize string `json:"image_size,omitempty"`
+	ImageType string `json:"image_type,omitempty"`
+}
+
+// cmdGoogleNext responds with the result after the last one shown in the room. If searchType is
+// set, the last search must be of that type.
+func (s *Service) cmdGoogleNext(client types.MatrixClient, roomID id.RoomID, searchType string) (interface{}, error) {
+	last, ok, err := s.loadLastSearch(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || (searchType != "" && last.Type != searchType) {
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "There is no recent search to continue. Search with !google first.",
+		}, nil
+	}
+	if last.Start >= maxStart {
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "No more results!",
+		}, nil
+	}
+	if last.Type == searchImage {
+		opts := imageOptions{Size: last.ImageSize, FileType: last.ImageType}
+		return s.imgResult(client, roomID, last.Query, opts, last.Start+1)
+	}
+	return s.webResult(roomID, last.Query, last.Start+1)
+}
+
+// loadLastSearch returns the last search in the room, unless there wasn't one or it has expired.
+func (s *Service) loadLastSearch(roomID id.RoomID) (last lastSearch, ok bool, err error) {
+	db := database.GetServiceDB()
+	stateJSON, err := db.LoadServiceState(s.ServiceID(), "search "+roomID.String())
+	if err == sql.ErrNoRows {
+		return last, false, nil
+	} else if err != nil {
+		return last, false, err
+	}
+	if err = json.Unmarshal(stateJSON, &last); err != nil {
+		return last, false, err
+	}
+	if time.Since(time.Unix(last.TimestampSecs, 0)) > searchExpiry {
+		if err = db.DeleteServiceState(s.ServiceID(), "search "+roomID.String()); err != nil {
+			log.WithError(err).WithField("room_id", roomID).Error("Failed to forget expired search")
+		}
+		return last, false, nil
+	}
+	return last, true, nil
+}
+
+// storeLastSearch remembers the search so that it can be continued. Failing to is logged rather
+// than returned, because the search itself succeeded.
+func (s *Service) storeLastSearch(roomID id.RoomID, last lastSearch) {
+	last.TimestampSecs = time.Now().Unix()
+	stateJSON, err := json.Marshal(last)
+	if err == nil {
+		err = database.GetServiceDB().StoreServiceState(s.ServiceID(), "search "+roomID.String(), stateJSON)
+	}
+	if err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to store search")
+	}
+}
@@ -0,0 +1,201 @@
+package google
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The YouTube Data API. Overridden by tests.
+var youtubeURL = "https://www.googleapis.com/youtube/v3/"
+
+type youtubeSearchResults struct {
+	Items []struct {
+		ID struct {
+			VideoID string `json:"videoId"`
+		} `json:"id"`
+		Snippet youtubeSnippet `json:"snippet"`
+	} `json:"items"`
+}
+
+type youtubeSnippet struct {
+	Title        string `json:"title"`
+	ChannelTitle string `json:"channelTitle"`
+	Thumbnails   map[string]struct {
+		URL    string `json:"url"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+	} `json:"thumbnails"`
+}
+
+type youtubeVideos struct {
+	Items []struct {
+		ContentDetails struct {
+			// An ISO 8601 duration, e.g. "PT4M13S"
+			Duration string `json:"duration"`
+		} `json:"contentDetails"`
+	} `json:"items"`
+}
+
+// The YouTube API's names for the safe_search levels
+var youtubeSafeSearch = map[string]string{
+	"active": "strict",
+	"off":    "none",
+}
+
+func (s *Service) cmdGoogleYouTubeSearch(client types.MatrixClient, roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) < 1 {
+		return usageMessage(), nil
+	}
+	query := strings.Join(args, " ")
+	log.Info("Searching YouTube for ", query)
+
+	q := url.Values{}
+	q.Set("part", "snippet")
+	q.Set("type", "video")
+	q.Set("maxResults", "1")
+	q.Set("q", query)
+	if s.SafeSearch != "" {
+		q.Set("safeSearch", youtubeSafeSearch[s.SafeSearch])
+	}
+	var results youtubeSearchResults
+	if err := s.youtubeGet("search", q, &results); err != nil {
+		return nil, err
+	}
+	if len(results.Items) < 1 {
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "No videos found!",
+		}, nil
+	}
+	video := results.Items[0]
+
+	// Searches don't return the duration of videos
+	q = url.Values{}
+	q.Set("part", "contentDetails")
+	q.Set("id", video.ID.VideoID)
+	var videos youtubeVideos
+	if err := s.youtubeGet("videos", q, &videos); err != nil {
+		return nil, err
+	}
+	var duration string
+	if len(videos.Items) > 0 {
+		duration = formatYouTubeDuration(videos.Items[0].ContentDetails.Duration)
+	}
+
+	if s.YouTubeThumbnails {
+		s.sendThumbnail(client, roomID, video.Snippet)
+	}
+
+	link := "https://www.youtube.com/watch?v=" + url.QueryEscape(video.ID.VideoID)
+	// Titles have HTML entities in them, e.g. "&#39;"
+	title := html.UnescapeString(video.Snippet.Title)
+	channel := html.UnescapeString(video.Snippet.ChannelTitle)
+	if duration != "" {
+		channel += " · " + duration
+	}
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("%s\n%s\n%s", title, channel, link),
+		Format:  mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf(
+			"<a href=\"%s\"><strong>%s</strong></a><br>%s",
+			html.EscapeString(link), html.EscapeString(title), html.EscapeString(channel),
+		),
+	}, nil
+}
+
+// sendThumbnail uploads the largest thumbnail of the video and sends it to the room. Failures
+// are logged, because the search result is still worth sending.
+func (s *Service) sendThumbnail(client types.MatrixClient, roomID id.RoomID, snippet youtubeSnippet) {
+	var best string
+	for _, size := range []string{"high", "medium", "default"} {
+		if _, ok := snippet.Thumbnails[size]; ok {
+			best = size
+			break
+		}
+	}
+	if best == "" {
+		return
+	}
+	thumb := snippet.Thumbnails[best]
+	logger := log.WithFields(log.Fields{
+		"room_id": roomID,
+		"url":     thumb.URL,
+	})
+	resUpload, err := client.UploadLink(thumb.URL)
+	if err != nil {
+		logger.WithError(err).Error("Failed to upload YouTube thumbnail")
+		return
+	}
+	_, err = client.SendMessageEvent(roomID, mevt.EventMessage, mevt.MessageEventContent{
+		MsgType: mevt.MsgImage,
+		Body:    html.UnescapeString(snippet.Title),
+		URL:     resUpload.ContentURI.CUString(),
+		Info: &mevt.FileInfo{
+			Height:   thumb.Height,
+			Width:    thumb.Width,
+			MimeType: "image/jpeg",
+		},
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to send YouTube thumbnail")
+	}
+}
+
+// youtubeGet calls the YouTube Data API endpoint and decodes the response into out.
+func (s *Service) youtubeGet(endpoint string, q url.Values, out interface{}) error {
+	if s.APIKey == "" {
+		return fmt.Errorf("The Google service has no api_key. Ask the Go-NEB admin to configure one.")
+	}
+	q.Set("key", s.APIKey)
+	res, err := httpClient.Get(youtubeURL + endpoint + "?" + q.Encode())
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Request error: %d, %s", res.StatusCode, response2String(res))
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("ERROR - %s", err.Error())
+	}
+	return nil
+}
+
+var isoDurationRegex = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// formatYouTubeDuration formats an ISO 8601 duration like a video player, e.g. "PT1H2M3S" as
+// "1:02:03". Live streams have no duration, and are formatted as "live".
+func formatYouTubeDuration(iso string) string {
+	m := isoDurationRegex.FindStringSubmatch(iso)
+	if m == nil {
+		return ""
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		n, _ := strconv.Atoi(m[i+1])
+		d += time.Duration(n) * unit
+	}
+	if d == 0 {
+		return "live"
+	}
+	hours, mins, secs := int(d/time.Hour), int(d/time.Minute)%60, int(d/time.Second)%60
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", hours, mins, secs)
+	}
+	return fmt.Sprintf("%d:%02d", mins, secs)
+}
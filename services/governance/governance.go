@@ -0,0 +1,558 @@
+// Package governance implements a Service which lets rooms vote on inviting and banning users and
+// changing the topic.
+package governance
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Governance service
+const ServiceType = "governance"
+
+// How often the poller looks for proposals whose votes have closed at most.
+const pollInterval = 5 * time.Minute
+
+const (
+	defaultVotingWindowMins = 24 * 60
+	defaultMinVotes         = 3
+	defaultThresholdPercent = 50
+	// How many proposals can be open in a room at once, so that votes aren't spread too thin
+	maxOpenProposals = 10
+)
+
+// The actions which can be proposed
+const (
+	actionInvite = "invite"
+	actionBan    = "ban"
+	actionTopic  = "topic"
+)
+
+// Votes and OnPoll both update the proposals, so they are only loaded and stored while holding
+// this, lest a vote be lost as voting closes.
+var proposalsMutex sync.Mutex
+
+// Service contains the Config fields for the Governance service.
+//
+// Inviting and banning users and changing the topic of the rooms become a vote. Anyone in the
+// room can propose one of the allowed actions:
+//    !propose ban @spammer:example.com Posting links to scams
+//    !propose invite @alice:example.com
+//    !propose topic Welcome! Please read the rules before posting
+// and everyone else votes with "!proposal yes 3" or "!proposal no 3". Whoever proposed an action
+// votes for it, and people can change their vote until voting closes. Once the voting window is
+// over, the action is taken if at least "min_votes" people voted and more than
+// "threshold_percent" of them voted yes.
+//
+// Go-NEB needs the power level to invite, ban and set the topic in the rooms. Every proposal,
+// vote and outcome is logged, and also posted to the "audit_room" if there is one.
+//
+// Example JSON request:
+//   {
+//       "rooms": ["!community:localhost"],
+//       "actions": ["invite", "ban", "topic"],
+//       "voting_window_mins": 1440,
+//       "min_votes": 3,
+//       "threshold_percent": 50,
+//       "audit_room": "!moderators:localhost"
+//   }
+type Service struct {
+	types.DefaultService
+	// The rooms which are governed by votes.
+	Rooms []id.RoomID `json:"rooms"`
+	// The actions which can be proposed: "invite", "ban" and "topic".
+	Actions []string `json:"actions"`
+	// Optional. How long people have to vote on a proposal, in minutes. Defaults to a day.
+	VotingWindowMins int `json:"voting_window_mins"`
+	// Optional. How many people must vote for a proposal to pass. Defaults to 3.
+	MinVotes int `json:"min_votes"`
+	// Optional. The percentage of the votes which must be yes for a proposal to pass, which it
+	// must be more than. Defaults to 50, for a simple majority.
+	ThresholdPercent int `json:"threshold_percent"`
+	// Optional. The room to post every proposal, vote and outcome to.
+	AuditRoom id.RoomID `json:"audit_room"`
+}
+
+// proposals are a room's open proposals. They are stored in the service state under "proposals"
+// and the room ID.
+type proposals struct {
+	NextID int        `json:"next_id"`
+	Open   []proposal `json:"open"`
+}
+
+type proposal struct {
+	ID       int       `json:"id"`
+	Action   string    `json:"action"`
+	UserID   id.UserID `json:"user_id,omitempty"`
+	Topic    string    `json:"topic,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Proposer id.UserID `json:"proposer"`
+	// Whether each voter voted yes
+	Votes              map[id.UserID]bool `json:"votes"`
+	CloseTimestampSecs int64              `json:"close_timestamp_secs"`
+}
+
+func (p *proposal) closes() time.Time {
+	return time.Unix(p.CloseTimestampSecs, 0)
+}
+
+func (p *proposal) count() (yes, no int) {
+	for _, v := range p.Votes {
+		if v {
+			yes++
+		} else {
+			no++
+		}
+	}
+	return
+}
+
+// String describes the action, e.g. "ban @spammer:example.com (Posting links to scams)".
+func (p *proposal) String() string {
+	switch p.Action {
+	case actionTopic:
+		return fmt.Sprintf("change the topic to %q", p.Topic)
+	case actionBan:
+		if p.Reason != "" {
+			return fmt.Sprintf("ban %s (%s)", p.UserID, p.Reason)
+		}
+	}
+	return fmt.Sprintf("%s %s", p.Action, p.UserID)
+}
+
+// Commands supported:
+//    !propose invite|ban|topic ...
+// Proposes an action, which is taken if the vote on it passes.
+//    !proposal yes|no id
+// Votes on the proposal.
+//    !proposal list
+// Responds with the open proposals in the room and how the votes on them stand.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"propose"},
+			Arguments: []string{"invite|ban|topic", "..."},
+			Help:      "Propose inviting or banning a user, or changing the topic, and put it to a vote",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdPropose(cli, roomID, userID, args, time.Now())
+			},
+		},
+		{
+			Path:      []string{"proposal", "yes"},
+			Arguments: []string{"id"},
+			Help:      "Vote for a proposal",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdVote(cli, roomID, userID, args, true)
+			},
+		},
+		{
+			Path:      []string{"proposal", "no"},
+			Arguments: []string{"id"},
+			Help:      "Vote against a proposal",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdVote(cli, roomID, userID, args, false)
+			},
+		},
+		{
+			Path: []string{"proposal", "list"},
+			Help: "List the open proposals in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdList(roomID, time.Now())
+			},
+		},
+	}
+}
+
+func (s *Service) isGoverned(roomID id.RoomID) bool {
+	for _, r := range s.Rooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) isAllowed(action string) bool {
+	for _, a := range s.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProposal returns the proposal of the action in the arguments of !propose.
+func parseProposal(args []string) (*proposal, error) {
+	usage := fmt.Errorf("Usage: !propose invite @user:server, !propose ban @user:server [reason] or !propose topic new topic")
+	if len(args) < 2 {
+		return nil, usage
+	}
+	p := &proposal{Action: strings.ToLower(args[0])}
+	switch p.Action {
+	case actionInvite, actionBan:
+		p.UserID = id.UserID(args[1])
+		if _, _, err := p.UserID.Parse(); err != nil {
+			return nil, fmt.Errorf("'%s' isn't a user ID", args[1])
+		}
+		if p.Action == actionInvite && len(args) > 2 {
+			return nil, usage
+		}
+		p.Reason = strings.Join(args[2:], " ")
+	case actionTopic:
+		p.Topic = strings.Join(args[1:], " ")
+	default:
+		return nil, usage
+	}
+	return p, nil
+}
+
+func (s *Service) cmdPropose(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	if !s.isGoverned(roomID) {
+		return nil, fmt.Errorf("This room isn't governed by votes")
+	}
+	p, err := parseProposal(args)
+	if err != nil {
+		return nil, err
+	}
+	if !s.isAllowed(p.Action) {
+		return nil, fmt.Errorf("This room doesn't vote on %s", p.Action)
+	}
+	if p.UserID == s.ServiceUserID() {
+		return nil, fmt.Errorf("I can't %s myself", p.Action)
+	}
+
+	proposalsMutex.Lock()
+	defer proposalsMutex.Unlock()
+	state, err := s.loadProposals(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if len(state.Open) >= maxOpenProposals {
+		return nil, fmt.Errorf("There are already %d open proposals in this room", maxOpenProposals)
+	}
+	state.NextID++
+	p.ID = state.NextID
+	p.Proposer = userID
+	p.Votes = map[id.UserID]bool{userID: true}
+	p.CloseTimestampSecs = now.Add(s.votingWindow()).Unix()
+	state.Open = append(state.Open, *p)
+	if err = s.storeProposals(roomID, state); err != nil {
+		return nil, err
+	}
+	s.audit(cli, roomID, fmt.Sprintf("%s proposed #%d: %s", userID, p.ID, p), log.Fields{
+		"proposal_id": p.ID,
+		"action":      p.Action,
+		"user_id":     userID,
+	})
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgText,
+		Body: fmt.Sprintf("🗳️ Proposal #%d by %s: %s\nVote with !proposal yes %d or !proposal no %d before %s. "+
+			"It needs %d votes, and more than %d%% of them yes.", p.ID, userID, p, p.ID, p.ID,
+			p.closes().UTC().Format("2006-01-02 15:04 MST"), s.minVotes(), s.thresholdPercent()),
+	}, nil
+}
+
+func (s *Service) cmdVote(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string, yes bool) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !proposal yes id or !proposal no id")
+	}
+	proposalID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return nil, fmt.Errorf("Usage: !proposal yes id or !proposal no id")
+	}
+
+	proposalsMutex.Lock()
+	defer proposalsMutex.Unlock()
+	state, err := s.loadProposals(roomID)
+	if err != nil {
+		return nil, err
+	}
+	var p *proposal
+	for i := range state.Open {
+		if state.Open[i].ID == proposalID {
+			p = &state.Open[i]
+		}
+	}
+	if p == nil {
+		return nil, fmt.Errorf("There is no open proposal #%d in this room", proposalID)
+	}
+	p.Votes[userID] = yes
+	if err = s.storeProposals(roomID, state); err != nil {
+		return nil, err
+	}
+	vote := "no"
+	if yes {
+		vote = "yes"
+	}
+	s.audit(cli, roomID, fmt.Sprintf("%s voted %s on #%d", userID, vote, p.ID), log.Fields{
+		"proposal_id": p.ID,
+		"user_id":     userID,
+		"vote":        vote,
+	})
+	yesVotes, noVotes := p.count()
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("🗳️ %s voted %s on #%d. It stands at %d yes, %d no.", userID, vote, p.ID, yesVotes, noVotes),
+	}, nil
+}
+
+func (s *Service) cmdList(roomID id.RoomID, now time.Time) (interface{}, error) {
+	proposalsMutex.Lock()
+	state, err := s.loadProposals(roomID)
+	proposalsMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(state.Open) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "There are no open proposals in this room",
+		}, nil
+	}
+	var lines []string
+	for _, p := range state.Open {
+		yes, no := p.count()
+		lines = append(lines, fmt.Sprintf("#%d: %s – %d yes, %d no, closes in %s",
+			p.ID, &p, yes, no, p.closes().Sub(now).Round(time.Minute)))
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    strings.Join(lines, "\n"),
+	}, nil
+}
+
+// OnPoll closes the votes on the proposals whose voting windows are over, and takes the actions
+// which passed.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	now := time.Now()
+	next := s.closeDue(cli, now)
+	if next.IsZero() || next.After(now.Add(pollInterval)) {
+		return now.Add(pollInterval)
+	}
+	return next
+}
+
+// closeDue closes the proposals whose votes are over, and returns when the next vote closes, or
+// the zero time if there are no open proposals.
+func (s *Service) closeDue(cli types.MatrixClient, now time.Time) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	var next time.Time
+	for _, roomID := range s.Rooms {
+		due, open, err := s.takeDue(roomID, now)
+		if err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to close proposals")
+			continue
+		}
+		for _, p := range due {
+			s.close(cli, roomID, &p)
+		}
+		for _, p := range open {
+			if next.IsZero() || p.closes().Before(next) {
+				next = p.closes()
+			}
+		}
+	}
+	return next
+}
+
+// takeDue removes the proposals whose votes are over from the room, returning them and the
+// proposals which are still open.
+func (s *Service) takeDue(roomID id.RoomID, now time.Time) (due, open []proposal, err error) {
+	proposalsMutex.Lock()
+	defer proposalsMutex.Unlock()
+	state, err := s.loadProposals(roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range state.Open {
+		if now.Before(p.closes()) {
+			open = append(open, p)
+		} else {
+			due = append(due, p)
+		}
+	}
+	if len(due) == 0 {
+		return nil, open, nil
+	}
+	// Forget the proposals first, so that their actions can't be taken twice if storing fails
+	state.Open = open
+	if err = s.storeProposals(roomID, state); err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+	return due, open, nil
+}
+
+// close counts the votes on the proposal, takes its action if it passed and announces the outcome.
+func (s *Service) close(cli types.MatrixClient, roomID id.RoomID, p *proposal) {
+	yes, no := p.count()
+	tally := fmt.Sprintf("%d yes, %d no", yes, no)
+	var outcome string
+	switch {
+	case yes+no < s.minVotes():
+		outcome = fmt.Sprintf("❌ Proposal #%d to %s failed: only %d of the %d votes needed were cast (%s)",
+			p.ID, p, yes+no, s.minVotes(), tally)
+	case yes*100 <= (yes+no)*s.thresholdPercent():
+		outcome = fmt.Sprintf("❌ Proposal #%d to %s failed (%s)", p.ID, p, tally)
+	default:
+		if err := s.execute(cli, roomID, p); err != nil {
+			outcome = fmt.Sprintf("⚠️ Proposal #%d to %s passed (%s), but I couldn't do it: %s", p.ID, p, tally, err)
+		} else {
+			outcome = fmt.Sprintf("✅ Proposal #%d to %s passed (%s), and is done", p.ID, p, tally)
+		}
+	}
+	s.audit(cli, roomID, outcome, log.Fields{
+		"proposal_id": p.ID,
+		"yes":         yes,
+		"no":          no,
+	})
+	if _, err := cli.SendMessageEvent(roomID, mevt.EventMessage, &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    outcome,
+	}); err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to announce the outcome of a proposal")
+	}
+}
+
+// execute takes the proposal's action in the room.
+func (s *Service) execute(cli types.MatrixClient, roomID id.RoomID, p *proposal) error {
+	memberCli, canManage := cli.(types.MemberManager)
+	stateCli, canSendState := cli.(types.StateSender)
+	if !canManage || !canSendState {
+		return fmt.Errorf("Client cannot invite, ban or set topics")
+	}
+	var err error
+	switch p.Action {
+	case actionInvite:
+		_, err = memberCli.InviteUser(roomID, &mautrix.ReqInviteUser{UserID: p.UserID})
+	case actionBan:
+		reason := fmt.Sprintf("Voted for in proposal #%d", p.ID)
+		if p.Reason != "" {
+			reason += ": " + p.Reason
+		}
+		_, err = memberCli.BanUser(roomID, &mautrix.ReqBanUser{UserID: p.UserID, Reason: reason})
+	case actionTopic:
+		_, err = stateCli.SendStateEvent(roomID, mevt.StateTopic, "", map[string]string{"topic": p.Topic})
+	default:
+		err = fmt.Errorf("unknown action %s", p.Action)
+	}
+	return err
+}
+
+// audit logs what happened, and posts it to the audit room if there is one.
+func (s *Service) audit(cli types.MatrixClient, roomID id.RoomID, what string, fields log.Fields) {
+	fields["service_id"] = s.ServiceID()
+	fields["room_id"] = roomID
+	log.WithFields(fields).Info(what)
+	if s.AuditRoom == "" {
+		return
+	}
+	if _, err := cli.SendMessageEvent(s.AuditRoom, mevt.EventMessage, &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("%s: %s", roomID, what),
+	}); err != nil {
+		log.WithError(err).WithField("room_id", s.AuditRoom).Error("Failed to post to the audit room")
+	}
+}
+
+func (s *Service) votingWindow() time.Duration {
+	if s.VotingWindowMins <= 0 {
+		return defaultVotingWindowMins * time.Minute
+	}
+	return time.Duration(s.VotingWindowMins) * time.Minute
+}
+
+func (s *Service) minVotes() int {
+	if s.MinVotes <= 0 {
+		return defaultMinVotes
+	}
+	return s.MinVotes
+}
+
+func (s *Service) thresholdPercent() int {
+	if s.ThresholdPercent <= 0 {
+		return defaultThresholdPercent
+	}
+	return s.ThresholdPercent
+}
+
+// loadProposals returns the open proposals of the room.
+func (s *Service) loadProposals(roomID id.RoomID) (*proposals, error) {
+	state := &proposals{}
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "proposals "+roomID.String())
+	if err == sql.ErrNoRows {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(stateJSON, state)
+	return state, err
+}
+
+func (s *Service) storeProposals(roomID id.RoomID, state *proposals) error {
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "proposals "+roomID.String(), stateJSON)
+}
+
+// Register makes sure that the rooms and actions are configured, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	if len(s.Actions) == 0 {
+		return fmt.Errorf("At least one action is required")
+	}
+	for _, action := range s.Actions {
+		switch action {
+		case actionInvite, actionBan, actionTopic:
+		default:
+			return fmt.Errorf("Unknown action '%s': must be invite, ban or topic", action)
+		}
+	}
+	if s.VotingWindowMins < 0 || s.MinVotes < 0 {
+		return fmt.Errorf("voting_window_mins and min_votes must not be negative")
+	}
+	if s.ThresholdPercent < 0 || s.ThresholdPercent >= 100 {
+		return fmt.Errorf("threshold_percent must be from 0 to 99")
+	}
+	rooms := s.Rooms
+	if s.AuditRoom != "" {
+		rooms = append([]id.RoomID{s.AuditRoom}, rooms...)
+	}
+	for _, roomID := range rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package governance
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestGovernance(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+
+	var sent, actions []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		parts := strings.Split(req.URL.Path, "/")
+		switch {
+		case strings.Contains(req.URL.Path, "/join"):
+		case strings.Contains(req.URL.Path, "/send/m.room.message/"):
+			body, _ := ioutil.ReadAll(req.Body)
+			var msg mevt.MessageEventContent
+			if err := json.Unmarshal(body, &msg); err != nil {
+				t.Fatalf("Failed to decode message: %s", err)
+			}
+			sent = append(sent, parts[5]+" "+msg.Body)
+		default:
+			body, _ := ioutil.ReadAll(req.Body)
+			actions = append(actions, fmt.Sprintf("%s %s %s", parts[5], strings.Join(parts[6:], "/"), body))
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$event:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"rooms": ["!town:hyrule"],
+		"actions": ["ban", "topic"],
+		"voting_window_mins": 60,
+		"audit_room": "!council:hyrule"
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create governance service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register governance service: ", err)
+	}
+	s := srv.(*Service)
+
+	now := time.Date(2021, 3, 14, 12, 0, 0, 0, time.UTC)
+	res, err := s.cmdPropose(matrixCli, "!town:hyrule", "@zelda:hyrule", []string{"ban", "@ganon:hyrule", "Stole", "the", "Triforce"}, now)
+	if err != nil {
+		t.Fatalf("!propose ban failed: %s", err)
+	}
+	want := "🗳️ Proposal #1 by @zelda:hyrule: ban @ganon:hyrule (Stole the Triforce)\n" +
+		"Vote with !proposal yes 1 or !proposal no 1 before 2021-03-14 13:00 UTC. It needs 3 votes, and more than 50% of them yes."
+	if body := res.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("Bad proposal: got %q, want %q", body, want)
+	}
+	if _, err = s.cmdPropose(matrixCli, "!town:hyrule", "@link:hyrule", []string{"topic", "Welcome", "to", "Hyrule"}, now.Add(time.Minute)); err != nil {
+		t.Fatalf("!propose topic failed: %s", err)
+	}
+	for _, args := range [][]string{
+		{"invite", "@impa:hyrule"},
+		{"ban", "ganon"},
+		{"ban", "@neb:hyrule"},
+		{"kick", "@ganon:hyrule"},
+		{"topic"},
+	} {
+		if _, err = s.cmdPropose(matrixCli, "!town:hyrule", "@zelda:hyrule", args, now); err == nil {
+			t.Errorf("Expected !propose %v to fail", args)
+		}
+	}
+	if _, err = s.cmdPropose(matrixCli, "!elsewhere:hyrule", "@zelda:hyrule", []string{"topic", "Hi"}, now); err == nil {
+		t.Errorf("Expected !propose to fail in a room which isn't governed")
+	}
+
+	for _, v := range []struct {
+		user string
+		id   string
+		yes  bool
+	}{
+		{"@link:hyrule", "1", true},
+		{"@ganon:hyrule", "1", false},
+		{"@impa:hyrule", "#1", false},
+		// Votes can be changed
+		{"@impa:hyrule", "1", true},
+		{"@zelda:hyrule", "2", false},
+	} {
+		if _, err = s.cmdVote(matrixCli, "!town:hyrule", id.UserID(v.user), []string{v.id}, v.yes); err != nil {
+			t.Fatalf("!proposal vote failed: %s", err)
+		}
+	}
+	if _, err = s.cmdVote(matrixCli, "!town:hyrule", "@link:hyrule", []string{"3"}, true); err == nil {
+		t.Errorf("Expected voting on a proposal which doesn't exist to fail")
+	}
+	res, err = s.cmdList("!town:hyrule", now.Add(30*time.Minute))
+	if err != nil {
+		t.Fatalf("!proposal list failed: %s", err)
+	}
+	want = "#1: ban @ganon:hyrule (Stole the Triforce) – 3 yes, 1 no, closes in 30m0s\n" +
+		"#2: change the topic to \"Welcome to Hyrule\" – 1 yes, 1 no, closes in 31m0s"
+	if body := res.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("Bad list: got %q, want %q", body, want)
+	}
+
+	if next := s.closeDue(matrixCli, now.Add(30*time.Minute)); !next.Equal(now.Add(time.Hour)) || len(actions) != 0 {
+		t.Errorf("Expected nothing to be closed until %s, got %s and %v", now.Add(time.Hour), next, actions)
+	}
+	sent = nil
+	if next := s.closeDue(matrixCli, now.Add(2*time.Hour)); !next.IsZero() {
+		t.Errorf("Expected every proposal to be closed, the next closes at %s", next)
+	}
+	s.closeDue(matrixCli, now.Add(3*time.Hour))
+
+	wantActions := []string{`!town:hyrule ban {"reason":"Voted for in proposal #1: Stole the Triforce","user_id":"@ganon:hyrule"}`}
+	if strings.Join(actions, "\n") != strings.Join(wantActions, "\n") {
+		t.Errorf("Bad actions: got %q, want %q", actions, wantActions)
+	}
+	passed := "✅ Proposal #1 to ban @ganon:hyrule (Stole the Triforce) passed (3 yes, 1 no), and is done"
+	failed := "❌ Proposal #2 to change the topic to \"Welcome to Hyrule\" failed: only 2 of the 3 votes needed were cast (1 yes, 1 no)"
+	wantSent := []string{
+		"!council:hyrule !town:hyrule: " + passed,
+		"!town:hyrule " + passed,
+		"!council:hyrule !town:hyrule: " + failed,
+		"!town:hyrule " + failed,
+	}
+	if strings.Join(sent, "\n") != strings.Join(wantSent, "\n") {
+		t.Errorf("Bad messages: got %q, want %q", sent, wantSent)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"actions": ["ban"]}`,
+		`{"rooms": ["!town:hyrule"]}`,
+		`{"rooms": ["!town:hyrule"], "actions": ["kick"]}`,
+		`{"rooms": ["!town:hyrule"], "actions": ["ban"], "min_votes": -1}`,
+		`{"rooms": ["!town:hyrule"], "actions": ["ban"], "threshold_percent": 100}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create governance service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
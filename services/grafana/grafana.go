@@ -0,0 +1,321 @@
+// Package grafana implements a Service which sends Grafana alerts into rooms.
+package grafana
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/templates"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Grafana service
+const ServiceType = "grafana"
+
+// The biggest webhook payload which is read
+const maxPayloadSize = 1024 * 1024
+
+// Service contains the Config fields for the Grafana service.
+//
+// This service will send notices into Matrix rooms about the alerts of Grafana's unified
+// alerting. Add a webhook contact point in Grafana with the URL in webhook_url, and the token as
+// its "Authorization Header - Credentials" (or add "?token=" and the token to the URL).
+//
+// Each alert is sent to the rooms whose labels it has. Labels can be patterns, e.g.
+// "team": "payments-*". Rooms without labels are sent every alert. Rooms can also be sent the
+// image of the alert's panel, if Grafana is set up to take screenshots of alerts.
+//
+// Operators can change the notices with template overrides named "grafana.firing" and
+// "grafana.resolved" (see package "templates"), which are given the webhook payload with only the
+// alerts for the room.
+//
+// Example JSON request:
+//   {
+//       "token": "a_long_random_string",
+//       "rooms": {
+//           "!payments:localhost": {
+//               "labels": {"team": "payments"},
+//               "images": true
+//           },
+//           "!ops:localhost": {
+//               "labels": {"severity": "critical"}
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL to add as Grafana's webhook contact point. Populated by Go-NEB after Service
+	// registration.
+	WebhookURL string `json:"webhook_url"`
+	// The token which Grafana must send, so that nobody else can post alerts to rooms.
+	Token string `json:"token"`
+	// A map from Matrix room ID to which alerts are sent to the room.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is which alerts are sent to a room.
+type RoomConfig struct {
+	// Optional. Only send alerts which have all these labels, whose values can be patterns like
+	// "payments-*".
+	Labels map[string]string `json:"labels"`
+	// Optional. Upload the image of the alert's panel into the room, if Grafana took one.
+	Images bool `json:"images"`
+}
+
+// matches returns whether the alert is sent to the room.
+func (c *RoomConfig) matches(alert *Alert) bool {
+	for label, pattern := range c.Labels {
+		value, ok := alert.Labels[label]
+		if !ok {
+			return false
+		}
+		if matched, _ := path.Match(pattern, value); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// WebhookNotification is the payload of Grafana's webhook contact point.
+type WebhookNotification struct {
+	Receiver          string            `json:"receiver"`
+	Status            string            `json:"status"`
+	GroupKey          string            `json:"groupKey"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Title             string            `json:"title"`
+	Alerts            []Alert           `json:"alerts"`
+}
+
+// Alert is a single alert in a WebhookNotification.
+type Alert struct {
+	Status       string             `json:"status"`
+	Labels       map[string]string  `json:"labels"`
+	Annotations  map[string]string  `json:"annotations"`
+	StartsAt     string             `json:"startsAt"`
+	EndsAt       string             `json:"endsAt"`
+	Values       map[string]float64 `json:"values"`
+	GeneratorURL string             `json:"generatorURL"`
+	Fingerprint  string             `json:"fingerprint"`
+	SilenceURL   string             `json:"silenceURL"`
+	DashboardURL string             `json:"dashboardURL"`
+	PanelURL     string             `json:"panelURL"`
+	ImageURL     string             `json:"imageURL"`
+}
+
+// url returns the most specific link to the alert: its panel, dashboard or rule.
+func (a *Alert) url() string {
+	if a.PanelURL != "" {
+		return a.PanelURL
+	}
+	if a.DashboardURL != "" {
+		return a.DashboardURL
+	}
+	return a.GeneratorURL
+}
+
+// htmlLine returns the alert's line in a notice, e.g. "[FIRING] High memory usage: Memory is
+// over 90% (B=93.5) - https://grafana.example.com/d/...".
+func (a *Alert) htmlLine() string {
+	color := "red"
+	if a.Status == "resolved" {
+		color = "green"
+	}
+	line := fmt.Sprintf(`<font color="%s">[%s]</font> <b>%s</b>`, color, html.EscapeString(strings.ToUpper(a.Status)),
+		html.EscapeString(a.Labels["alertname"]))
+	if summary := a.Annotations["summary"]; summary != "" {
+		line += ": " + html.EscapeString(summary)
+	} else if description := a.Annotations["description"]; description != "" {
+		line += ": " + html.EscapeString(description)
+	}
+	if len(a.Values) > 0 {
+		var refIDs []string
+		for refID := range a.Values {
+			refIDs = append(refIDs, refID)
+		}
+		sort.Strings(refIDs)
+		values := make([]string, len(refIDs))
+		for i, refID := range refIDs {
+			values[i] = refID + "=" + strconv.FormatFloat(a.Values[refID], 'g', -1, 64)
+		}
+		line += " (" + html.EscapeString(strings.Join(values, ", ")) + ")"
+	}
+	if u := a.url(); u != "" {
+		line += " - " + html.EscapeString(u)
+	}
+	return line
+}
+
+// OnReceiveWebhook receives alerts from Grafana and sends them into the rooms which they are
+// routed to.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+		w.WriteHeader(403)
+		return
+	}
+	var notif WebhookNotification
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxPayloadSize)).Decode(&notif); err != nil {
+		log.WithError(err).Error("Grafana webhook received an invalid JSON payload")
+		w.WriteHeader(400)
+		return
+	}
+
+	// Images are uploaded once, however many rooms they are sent to
+	uploaded := make(map[string]*mevt.MessageEventContent)
+	for roomID, room := range s.Rooms {
+		roomNotif := notif
+		roomNotif.Alerts = nil
+		for i := range notif.Alerts {
+			if room.matches(&notif.Alerts[i]) {
+				roomNotif.Alerts = append(roomNotif.Alerts, notif.Alerts[i])
+			}
+		}
+		if len(roomNotif.Alerts) == 0 {
+			continue
+		}
+		logger := log.WithFields(log.Fields{
+			"service_id": s.ServiceID(),
+			"room_id":    roomID,
+		})
+		logger.Print("Sending Grafana alerts to room")
+		if _, err := notify.Send(cli, s, notify.Notification{
+			RoomID:         roomID,
+			Content:        roomNotif.message(),
+			Severity:       roomNotif.severity(),
+			CorrelationKey: "grafana " + notif.GroupKey,
+		}); err != nil {
+			logger.WithError(err).Error("Failed to send Grafana alerts to room")
+			continue
+		}
+		if !room.Images {
+			continue
+		}
+		for _, alert := range roomNotif.Alerts {
+			if alert.ImageURL == "" || alert.Status == "resolved" {
+				continue
+			}
+			img, ok := uploaded[alert.ImageURL]
+			if !ok {
+				img = uploadImage(cli, &alert)
+				uploaded[alert.ImageURL] = img
+			}
+			if img == nil {
+				continue
+			}
+			if _, err := cli.SendMessageEvent(roomID, mevt.EventMessage, img); err != nil {
+				logger.WithError(err).Error("Failed to send Grafana alert image to room")
+			}
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// message returns the notice about the alerts, or the operator's template override.
+func (notif *WebhookNotification) message() mevt.MessageEventContent {
+	lines := make([]string, len(notif.Alerts))
+	htmlLines := make([]string, len(notif.Alerts))
+	for i := range notif.Alerts {
+		htmlLines[i] = notif.Alerts[i].htmlLine()
+		lines[i] = utils.StrippedHTMLMessage(mevt.MsgNotice, htmlLines[i]).Body
+	}
+	msg := mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: strings.Join(htmlLines, "<br>"),
+	}
+	return templates.Render("grafana."+notif.Status, notif, msg)
+}
+
+// severity returns the most severe "severity" label of the alerts, so that critical alerts can
+// skip digests.
+func (notif *WebhookNotification) severity() notify.Severity {
+	var severity notify.Severity
+	for _, alert := range notif.Alerts {
+		if s := notify.Severity(strings.ToLower(alert.Labels["severity"])); s == notify.SeverityCritical {
+			return s
+		} else if severity == "" {
+			severity = s
+		}
+	}
+	return severity
+}
+
+// uploadImage downloads the image of the alert's panel and uploads it to the homeserver,
+// returning the message to send it in, or nil if it can't be uploaded.
+func uploadImage(cli types.MatrixClient, alert *Alert) *mevt.MessageEventContent {
+	resUpload, err := cli.UploadLink(alert.ImageURL)
+	if err != nil {
+		log.WithError(err).WithField("url", alert.ImageURL).Warn("Failed to upload Grafana alert image")
+		return nil
+	}
+	mimeType := mime.TypeByExtension(path.Ext(alert.ImageURL))
+	if mimeType == "" {
+		mimeType = "image/png"
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgImage,
+		Body:    alert.Labels["alertname"] + ".png",
+		URL:     resUpload.ContentURI.CUString(),
+		Info: &mevt.FileInfo{
+			MimeType: mimeType,
+		},
+	}
+}
+
+// Register makes sure the Config information supplied is valid, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if len(s.Token) < 16 {
+		return fmt.Errorf("A token of at least 16 characters is required")
+	}
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	for roomID, room := range s.Rooms {
+		for label, pattern := range room.Labels {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("Room %s has a malformed pattern '%s' for label %s: %s", roomID, pattern, label, err)
+			}
+		}
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
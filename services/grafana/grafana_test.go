@@ -0,0 +1,158 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const alertsJSON = `{
+	"receiver": "matrix",
+	"status": "firing",
+	"groupKey": "{}:{alertname=\"High memory usage\"}",
+	"externalURL": "https://grafana.hyrule/",
+	"alerts": [
+		{
+			"status": "firing",
+			"labels": {"alertname": "High memory usage", "team": "castle-guards", "severity": "critical"},
+			"annotations": {"summary": "Memory is over 90%"},
+			"values": {"C": 1, "B": 93.5},
+			"generatorURL": "https://grafana.hyrule/alerting/grafana/abc/view",
+			"panelURL": "https://grafana.hyrule/d/castle?viewPanel=2",
+			"imageURL": "https://images.hyrule/grafana/memory.png"
+		},
+		{
+			"status": "resolved",
+			"labels": {"alertname": "Disk full", "team": "termina"},
+			"annotations": {"description": "The disk is full"},
+			"generatorURL": "https://grafana.hyrule/alerting/grafana/def/view",
+			"imageURL": "https://images.hyrule/grafana/disk.png"
+		}
+	]
+}`
+
+func TestWebhook(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	var downloaded []string
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch {
+		case strings.HasPrefix(req.URL.String(), "https://images.hyrule/"):
+			downloaded = append(downloaded, req.URL.String())
+			body = "some image data"
+		case strings.Contains(req.URL.String(), "_matrix/media/r0/upload"):
+			body = `{"content_uri":"mxc://hyrule/memory"}`
+		case strings.Contains(req.URL.String(), "/send/m.room.message"):
+			var msg mevt.MessageEventContent
+			if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+				return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+			}
+			room := strings.Split(req.URL.Path, "/")[5]
+			if msg.MsgType == mevt.MsgImage {
+				sent = append(sent, fmt.Sprintf("%s image %s %s", room, msg.URL, msg.Info.MimeType))
+			} else {
+				sent = append(sent, fmt.Sprintf("%s %s", room, msg.Body))
+			}
+			body = `{"event_id":"$yup:event"}`
+		default:
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"token": "the_triforce_of_wisdom",
+		"rooms": {
+			"!castle:hyrule": {"labels": {"team": "castle-*"}, "images": true},
+			"!guards:hyrule": {"labels": {"team": "castle-guards", "severity": "critical"}, "images": true},
+			"!termina:hyrule": {"labels": {"team": "termina"}, "images": true},
+			"!ops:hyrule": {}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create grafana service: ", err)
+	}
+	s := srv.(*Service)
+
+	for _, tc := range []struct {
+		url           string
+		authorization string
+		body          string
+		code          int
+	}{
+		{"https://neb.endpoint/grafana", "Bearer the_triforce_of_wisdom", alertsJSON, 200},
+		{"https://neb.endpoint/grafana?token=the_triforce_of_wisdom", "", `{"status": "firing", "alerts": []}`, 200},
+		{"https://neb.endpoint/grafana", "Bearer the_triforce_of_power", alertsJSON, 403},
+		{"https://neb.endpoint/grafana", "", alertsJSON, 403},
+		{"https://neb.endpoint/grafana?token=the_triforce_of_wisdom", "", `not json`, 400},
+	} {
+		req := httptest.NewRequest("POST", tc.url, strings.NewReader(tc.body))
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, matrixCli)
+		if w.Code != tc.code {
+			t.Errorf("Bad response to %s: got %d, want %d", tc.url, w.Code, tc.code)
+		}
+	}
+
+	memory := "[FIRING] High memory usage: Memory is over 90% (B=93.5, C=1) - https://grafana.hyrule/d/castle?viewPanel=2"
+	disk := "[RESOLVED] Disk full: The disk is full - https://grafana.hyrule/alerting/grafana/def/view"
+	want := map[string]bool{
+		"!castle:hyrule " + memory:                           true,
+		"!castle:hyrule image mxc://hyrule/memory image/png": true,
+		"!guards:hyrule " + memory:                           true,
+		"!guards:hyrule image mxc://hyrule/memory image/png": true,
+		"!termina:hyrule " + disk:                            true,
+		"!ops:hyrule " + memory + "\n" + disk:                true,
+	}
+	if len(sent) != len(want) {
+		t.Errorf("Bad number of messages: got %d, want %d: %q", len(sent), len(want), sent)
+	}
+	for _, msg := range sent {
+		if !want[msg] {
+			t.Errorf("Unexpected message: %q", msg)
+		}
+	}
+	// The image is uploaded once for both rooms, and resolved alerts' images aren't sent
+	if len(downloaded) != 1 || downloaded[0] != "https://images.hyrule/grafana/memory.png" {
+		t.Errorf("Bad image downloads: %v", downloaded)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"rooms": {"!castle:hyrule": {}}}`,
+		`{"token": "short", "rooms": {"!castle:hyrule": {}}}`,
+		`{"token": "the_triforce_of_wisdom"}`,
+		`{"token": "the_triforce_of_wisdom", "rooms": {"!castle:hyrule": {"labels": {"team": "castle-["}}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create grafana service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
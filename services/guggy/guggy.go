@@ -9,8 +9,10 @@ import (
 	"math"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/uploadcache"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -39,12 +41,17 @@ type guggyGifResult struct {
 //
 // Example request:
 //   {
-//       "api_key": "fkweugfyuwegfweyg"
+//       "api_key": "fkweugfyuwegfweyg",
+//       "cache_ttl_mins": 30
 //   }
 type Service struct {
 	types.DefaultService
 	// The Guggy API key to use when making HTTP requests to Guggy.
 	APIKey string `json:"api_key"`
+	// Optional. Reuse the GIF uploaded for a query when the same query is made again within this
+	// many minutes, rather than asking Guggy and uploading it again. Defaults to 0, which doesn't
+	// cache GIFs.
+	CacheTTLMins int `json:"cache_ttl_mins"`
 }
 
 // Commands supported:
@@ -63,9 +70,21 @@ func (s *Service) Commands(client types.MatrixClient) []types.Command {
 func (s *Service) cmdGuggy(client types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
 	// only 1 arg which is the text to search for.
 	querySentence := strings.Join(args, " ")
+	key := uploadcache.Key(s.ServiceID(), "gif", querySentence)
+	msg, err := uploadcache.Fetch(key, time.Duration(s.CacheTTLMins)*time.Minute, func() (mevt.MessageEventContent, error) {
+		return s.uploadGuggy(client, querySentence)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// uploadGuggy finds a GIF for the query and uploads it.
+func (s *Service) uploadGuggy(client types.MatrixClient, querySentence string) (mevt.MessageEventContent, error) {
 	gifResult, err := s.text2gifGuggy(querySentence)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to query Guggy: %s", err.Error())
+		return mevt.MessageEventContent{}, fmt.Errorf("Failed to query Guggy: %s", err.Error())
 	}
 
 	if gifResult.GIF == "" {
@@ -77,7 +96,7 @@ func (s *Service) cmdGuggy(client types.MatrixClient, roomID id.RoomID, userID i
 
 	resUpload, err := client.UploadLink(gifResult.GIF)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to upload Guggy image to matrix: %s", err.Error())
+		return mevt.MessageEventContent{}, fmt.Errorf("Failed to upload Guggy image to matrix: %s", err.Error())
 	}
 
 	return mevt.MessageEventContent{
@@ -13,6 +13,7 @@ import (
 	"github.com/matrix-org/go-neb/testutils"
 	"github.com/matrix-org/go-neb/types"
 	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
 )
 
 // TODO: It would be nice to tabularise this test so we can try failing different combinations of responses to make
@@ -63,7 +64,7 @@ func TestCommand(t *testing.T) {
 
 	// Create the Guggy service
 	srv, err := types.CreateService("id", ServiceType, "@guggybot:hyrule", []byte(
-		`{"api_key":"`+apiKey+`"}`,
+		`{"api_key":"`+apiKey+`","cache_ttl_mins":5}`,
 	))
 	if err != nil {
 		t.Fatal("Failed to create Guggy service: ", err)
@@ -71,6 +72,7 @@ func TestCommand(t *testing.T) {
 	guggy := srv.(*Service)
 
 	// Mock the response from Matrix
+	uploads := 0
 	matrixTrans := struct{ testutils.MockTransport }{}
 	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
 		if req.URL.String() == guggyImageURL { // getting the guggy image
@@ -79,6 +81,7 @@ func TestCommand(t *testing.T) {
 				Body:       ioutil.NopCloser(bytes.NewBufferString("some image data")),
 			}, nil
 		} else if strings.Contains(req.URL.String(), "_matrix/media/r0/upload") { // uploading the image to matrix
+			uploads++
 			return &http.Response{
 				StatusCode: 200,
 				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://foo/bar"}`)),
@@ -99,4 +102,16 @@ func TestCommand(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to process command: %s", err.Error())
 	}
+
+	// The same query again reuses the uploaded GIF
+	res, err := cmd.Command("!someroom:hyrule", "@navi:hyrule", []string{"hey", "listen!"})
+	if err != nil {
+		t.Fatalf("Failed to process command: %s", err.Error())
+	}
+	if uploads != 1 {
+		t.Errorf("Expected the GIF to be uploaded once, got %d uploads", uploads)
+	}
+	if msg := res.(mevt.MessageEventContent); msg.URL != "mxc://foo/bar" {
+		t.Errorf("Bad cached GIF: got %s want mxc://foo/bar", msg.URL)
+	}
 }
@@ -0,0 +1,365 @@
+// Package hackernews implements a Service which posts popular Hacker News stories into rooms.
+package hackernews
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Hacker News service
+const ServiceType = "hackernews"
+
+const (
+	defaultPollInterval = 15 * time.Minute
+	minPollIntervalMins = 5
+	defaultMinScore     = 100
+	// How many of the top stories make up the front page
+	frontPageSize = 30
+	// How many stories are posted each poll, so that a room isn't flooded
+	maxStoriesPerPoll = 5
+	// How many stories !hn top shows by default, and at most
+	defaultTopCount = 5
+	maxTopCount     = 10
+	// How many seen story IDs are remembered. Stories rarely stay on the front page for long, so
+	// only the newest IDs are kept.
+	maxSeen = 1000
+)
+
+// The Hacker News API, and the website which discussions are linked to. Overridden by tests.
+var (
+	apiURL  = "https://hacker-news.firebaseio.com/v0/"
+	siteURL = "https://news.ycombinator.com/"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Service contains the Config fields for the Hacker News service.
+//
+// Stories on the front page are posted into the rooms once their score reaches "min_score". Each
+// story is only posted once, even after a restart. The stories already on the front page when
+// the service is created are not posted.
+//
+// Example JSON request:
+//   {
+//       "rooms": ["!news:localhost"],
+//       "min_score": 200,
+//       "poll_interval_mins": 15
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The rooms to post popular stories into.
+	Rooms []id.RoomID `json:"rooms"`
+	// Optional. The score a front page story needs to be posted. Defaults to 100.
+	MinScore int `json:"min_score"`
+	// Optional. How often to check the front page, in minutes. Defaults to 15.
+	PollIntervalMins int `json:"poll_interval_mins"`
+}
+
+// story is a Hacker News item.
+type story struct {
+	ID          int64  `json:"id"`
+	Type        string `json:"type"`
+	Title       string `json:"title"`
+	URL         string `json:"url"`
+	Score       int    `json:"score"`
+	By          string `json:"by"`
+	Descendants int    `json:"descendants"`
+	Dead        bool   `json:"dead"`
+	Deleted     bool   `json:"deleted"`
+}
+
+// discussionURL returns the link to the story's comments.
+func (st *story) discussionURL() string {
+	return siteURL + "item?id=" + strconv.FormatInt(st.ID, 10)
+}
+
+// link returns the story's link, or its discussion for Ask HN posts which don't have one.
+func (st *story) link() string {
+	if st.URL == "" {
+		return st.discussionURL()
+	}
+	return st.URL
+}
+
+func (s *Service) minScore() int {
+	if s.MinScore <= 0 {
+		return defaultMinScore
+	}
+	return s.MinScore
+}
+
+func (s *Service) pollInterval() time.Duration {
+	if s.PollIntervalMins <= 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(s.PollIntervalMins) * time.Minute
+}
+
+// Commands supported:
+//    !hn top [count]
+// Responds with the stories at the top of the front page.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"hn", "top"},
+			Arguments: []string{"[count]"},
+			Help:      "Show the top Hacker News stories",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdTop(args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdTop(args []string) (interface{}, error) {
+	count := defaultTopCount
+	if len(args) > 1 {
+		return nil, fmt.Errorf("Usage: !hn top [count]")
+	} else if len(args) == 1 {
+		var err error
+		if count, err = strconv.Atoi(args[0]); err != nil || count < 1 || count > maxTopCount {
+			return nil, fmt.Errorf("The count must be between 1 and %d", maxTopCount)
+		}
+	}
+	ids, err := fetchTopStories()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch the top stories: %s", err)
+	}
+	var stories []story
+	for _, storyID := range ids {
+		if len(stories) == count {
+			break
+		}
+		st, err := fetchStory(storyID)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to fetch story %d: %s", storyID, err)
+		}
+		if st != nil {
+			stories = append(stories, *st)
+		}
+	}
+	if len(stories) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "There are no stories on the front page",
+		}, nil
+	}
+	content := formatStories(stories)
+	return &content, nil
+}
+
+// OnPoll posts the front page stories which have reached the minimum score since the last poll.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	s.check(cli)
+	return time.Now().Add(s.pollInterval())
+}
+
+func (s *Service) check(cli types.MatrixClient) {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	if len(s.Rooms) == 0 {
+		return
+	}
+	seen, err := s.loadSeen()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load the seen stories")
+		return
+	}
+	ids, err := fetchTopStories()
+	if err != nil {
+		logger.WithError(err).Error("Failed to fetch the top stories")
+		return
+	}
+	if len(ids) > frontPageSize {
+		ids = ids[:frontPageSize]
+	}
+
+	var popular []story
+	for _, storyID := range ids {
+		if seen != nil && seen[storyID] {
+			continue
+		}
+		st, err := fetchStory(storyID)
+		if err != nil {
+			logger.WithError(err).WithField("story_id", storyID).Error("Failed to fetch story")
+			continue
+		}
+		// Stories below the score are left unseen, so that they are posted once they reach it
+		if st != nil && st.Score >= s.minScore() {
+			popular = append(popular, *st)
+		}
+	}
+	firstPoll := seen == nil
+	if firstPoll {
+		seen = make(map[int64]bool)
+	}
+	for _, st := range popular {
+		seen[st.ID] = true
+	}
+	// Remember the stories first, so that they aren't posted again if sending fails
+	if err = s.storeSeen(seen); err != nil {
+		logger.WithError(err).Error("Failed to store the seen stories")
+		return
+	}
+	if firstPoll || len(popular) == 0 {
+		return
+	}
+
+	if len(popular) > maxStoriesPerPoll {
+		popular = popular[:maxStoriesPerPoll]
+	}
+	content := formatStories(popular)
+	for _, roomID := range s.Rooms {
+		if _, err := notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: content}); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to send stories")
+		}
+	}
+}
+
+// formatStories returns a message listing the stories, with links to them and their comments.
+func formatStories(stories []story) mevt.MessageEventContent {
+	var lines, htmlLines []string
+	for _, st := range stories {
+		stats := fmt.Sprintf("%d points by %s", st.Score, st.By)
+		comments := fmt.Sprintf("%d comments", st.Descendants)
+		title := st.Title
+		if host := domain(st.URL); host != "" {
+			title += " (" + host + ")"
+		}
+		lines = append(lines, fmt.Sprintf("%s\n%s\n%s, %s: %s", title, st.link(), stats, comments, st.discussionURL()))
+		htmlLines = append(htmlLines, fmt.Sprintf(`<a href="%s">%s</a><br>%s, <a href="%s">%s</a>`,
+			html.EscapeString(st.link()), html.EscapeString(title), html.EscapeString(stats),
+			html.EscapeString(st.discussionURL()), comments))
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: strings.Join(htmlLines, "<br>"),
+	}
+}
+
+// domain returns the host of the link without "www.", or "" if it can't be parsed.
+func domain(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(u.Hostname(), "www.")
+}
+
+// fetchTopStories returns the IDs of the top stories, in the order they are on the front page.
+func fetchTopStories() ([]int64, error) {
+	var ids []int64
+	if err := getJSON(apiURL+"topstories.json", &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// fetchStory returns the story, or nil if it has been deleted, is dead or isn't a story.
+func fetchStory(storyID int64) (*story, error) {
+	var st *story
+	if err := getJSON(fmt.Sprintf("%sitem/%d.json", apiURL, storyID), &st); err != nil {
+		return nil, err
+	}
+	if st == nil || st.Deleted || st.Dead || st.Type != "story" {
+		return nil, nil
+	}
+	return st, nil
+}
+
+func getJSON(u string, v interface{}) error {
+	res, err := httpClient.Get(u)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// loadSeen returns the IDs of the stories which have been posted, or nil if the front page has
+// never been checked. They are stored in the service state under "seen".
+func (s *Service) loadSeen() (map[int64]bool, error) {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "seen")
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	if err = json.Unmarshal(stateJSON, &ids); err != nil {
+		return nil, err
+	}
+	seen := make(map[int64]bool)
+	for _, storyID := range ids {
+		seen[storyID] = true
+	}
+	return seen, nil
+}
+
+// storeSeen stores the newest maxSeen story IDs. Hacker News IDs only ever go up.
+func (s *Service) storeSeen(seen map[int64]bool) error {
+	ids := make([]int64, 0, len(seen))
+	for storyID := range seen {
+		ids = append(ids, storyID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > maxSeen {
+		ids = ids[len(ids)-maxSeen:]
+	}
+	stateJSON, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "seen", stateJSON)
+}
+
+// Register makes sure that the score and poll interval are sensible, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.MinScore < 0 {
+		return fmt.Errorf("min_score can't be negative")
+	}
+	if s.PollIntervalMins < 0 || (s.PollIntervalMins > 0 && s.PollIntervalMins < minPollIntervalMins) {
+		return fmt.Errorf("poll_interval_mins can't be less than %d", minPollIntervalMins)
+	}
+	for _, roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package hackernews
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestPoll(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	topStories := `[1, 2, 3]`
+	items := map[string]string{
+		"1": `{"id":1,"type":"story","title":"Hyrule Castle restored","url":"https://www.castle.hyrule/news","score":150,"by":"zelda","descendants":42}`,
+		"2": `{"id":2,"type":"story","title":"Ask HN: Where is the Master Sword?","score":50,"by":"link","descendants":7}`,
+		"3": `{"id":3,"type":"story","title":"Flagged","score":500,"by":"ganon","dead":true}`,
+		"4": `{"id":4,"type":"story","title":"Show HN: Rupee <tracker>","url":"https://rupees.hyrule/","score":120,"by":"tingle","descendants":3}`,
+	}
+	fetched := 0
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		body := ""
+		if req.URL.String() == "https://hacker-news.firebaseio.com/v0/topstories.json" {
+			body = topStories
+		} else if strings.HasPrefix(req.URL.String(), "https://hacker-news.firebaseio.com/v0/item/") {
+			fetched++
+			body = items[strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v0/item/"), ".json")]
+		}
+		if body == "" {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	var sent []mevt.MessageEventContent
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		sent = append(sent, msg)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$news:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"rooms": ["!news:hyrule"],
+		"min_score": 100
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create hackernews service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register hackernews service: ", err)
+	}
+	s := srv.(*Service)
+
+	s.check(matrixCli)
+	if len(sent) != 0 {
+		t.Errorf("Posted stories which were on the front page before the service was created: %v", sent)
+	}
+
+	// Story 2 reaches the score, and story 4 makes the front page
+	items["2"] = strings.Replace(items["2"], `"score":50`, `"score":101`, 1)
+	topStories = `[4, 1, 2, 3]`
+	fetched = 0
+	s.check(matrixCli)
+	if fetched != 3 {
+		t.Errorf("Expected the seen story not to be fetched again, fetched %d", fetched)
+	}
+	s.check(matrixCli)
+
+	if len(sent) != 1 {
+		t.Fatalf("Expected one message, got %v", sent)
+	}
+	wantBody := "Show HN: Rupee <tracker> (rupees.hyrule)\nhttps://rupees.hyrule/\n120 points by tingle, 3 comments: https://news.ycombinator.com/item?id=4\n" +
+		"Ask HN: Where is the Master Sword?\nhttps://news.ycombinator.com/item?id=2\n101 points by link, 7 comments: https://news.ycombinator.com/item?id=2"
+	if sent[0].Body != wantBody {
+		t.Errorf("Bad message: got %q, want %q", sent[0].Body, wantBody)
+	}
+	if !strings.Contains(sent[0].FormattedBody, `<a href="https://rupees.hyrule/">Show HN: Rupee &lt;tracker&gt; (rupees.hyrule)</a>`) {
+		t.Errorf("Bad HTML: %s", sent[0].FormattedBody)
+	}
+
+	// The seen stories survive a restart
+	srv, _ = types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"rooms": ["!news:hyrule"]}`))
+	srv.(*Service).check(matrixCli)
+	if len(sent) != 1 {
+		t.Errorf("Posted stories again after a restart: %v", sent[1:])
+	}
+}
+
+func TestTop(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		body := `[7, 8, 9]`
+		if strings.HasPrefix(req.URL.Path, "/v0/item/") {
+			var storyID int
+			fmt.Sscanf(req.URL.Path, "/v0/item/%d.json", &storyID)
+			body = fmt.Sprintf(`{"id":%d,"type":"story","title":"Story %d","url":"https://news.hyrule/%d","score":%d,"by":"impa"}`, storyID, storyID, storyID, storyID*10)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create hackernews service: ", err)
+	}
+	s := srv.(*Service)
+
+	res, err := s.cmdTop([]string{"2"})
+	if err != nil {
+		t.Fatal("Failed to show the top stories: ", err)
+	}
+	body := res.(*mevt.MessageEventContent).Body
+	if !strings.HasPrefix(body, "Story 7 (news.hyrule)\nhttps://news.hyrule/7\n70 points by impa") || !strings.Contains(body, "Story 8") || strings.Contains(body, "Story 9") {
+		t.Errorf("Bad top stories: %s", body)
+	}
+	for _, args := range [][]string{{"0"}, {"11"}, {"lots"}, {"1", "2"}} {
+		if _, err = s.cmdTop(args); err == nil {
+			t.Errorf("Expected %v to be refused", args)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"min_score": -1}`,
+		`{"poll_interval_mins": 1}`,
+		`{"poll_interval_mins": -5}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create hackernews service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Package homeassistant implements a Service which posts Home Assistant notifications into rooms,
+// and calls Home Assistant services from rooms.
+package homeassistant
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Home Assistant service
+const ServiceType = "homeassistant"
+
+// The most a webhook's body can be
+const maxWebhookSize = 1 << 20
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// A Home Assistant service, e.g. "light.toggle", or entity, e.g. "light.living_room"
+var serviceRegex = regexp.MustCompile(`^[a-z0-9_]+\.[a-z0-9_]+$`)
+
+// An allowed entity, e.g. "light.living_room" or "light.*"
+var allowedEntityRegex = regexp.MustCompile(`^[a-z0-9_]+\.([a-z0-9_]+|\*)$`)
+
+// Service contains the Config fields for the Home Assistant service.
+//
+// Home Assistant sends notifications to the webhook_url, with "?token=" and the token, from a
+// RESTful notifier:
+//   notify:
+//     - name: matrix
+//       platform: rest
+//       method: POST_JSON
+//       resource: "https://goneb.example.com/services/hooks/aG9tZWFzc2lzdGFudA?token=..."
+// The notification's title and message are posted into the rooms. If the notification has a
+// target, it is only posted into the targeted rooms.
+//
+// "!ha light.toggle living_room" calls a Home Assistant service for an entity, using a long-lived
+// access token from the Home Assistant user's profile. Only the entities in allowed_entities can be
+// used, either by entity ID or by every entity of a domain, e.g. "light.*". The domain of the
+// entity can be left out if it is the domain of the service.
+//
+// Example JSON request:
+//   {
+//       "server_url": "http://homeassistant.local:8123",
+//       "access_token": "eyJ0eXAiOiJKV1Qi...",
+//       "token": "a_long_random_string",
+//       "rooms": ["!home:localhost"],
+//       "allowed_entities": ["light.*", "switch.coffee_machine"]
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which Home Assistant should send notifications to, with "?token=" and the token.
+	// Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The token which notifications must have, so that nobody else can post to rooms.
+	Token string `json:"token"`
+	// The rooms to post notifications into.
+	Rooms []id.RoomID `json:"rooms"`
+	// Optional. The URL of Home Assistant. Required for calling services.
+	ServerURL string `json:"server_url"`
+	// Optional. A long-lived access token for Home Assistant. Required for calling services.
+	AccessToken string `json:"access_token"`
+	// Optional. The entities which services can be called for, e.g. "light.kitchen" or "light.*".
+	// No services can be called if this is empty.
+	AllowedEntities []string `json:"allowed_entities"`
+}
+
+// notification is the body of a RESTful notifier's request.
+type notification struct {
+	Message string `json:"message"`
+	Title   string `json:"title"`
+	// The targets of the notification, as a room ID or a list of them
+	Target interface{} `json:"target"`
+}
+
+// OnReceiveWebhook posts the Home Assistant notification into the rooms.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+		w.WriteHeader(403)
+		return
+	}
+	var n notification
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxWebhookSize)).Decode(&n); err != nil || n.Message == "" {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Warn("Bad Home Assistant notification")
+		w.WriteHeader(400)
+		return
+	}
+
+	content := mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    n.Message,
+	}
+	if n.Title != "" {
+		content.Body = n.Title + "\n" + n.Message
+		content.Format = mevt.FormatHTML
+		content.FormattedBody = fmt.Sprintf("<strong>%s</strong><br>%s",
+			htmlEscape(n.Title), htmlEscape(n.Message))
+	}
+	for _, roomID := range s.targetRooms(n.Target) {
+		if _, err := notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: content}); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"service_id": s.ServiceID(),
+				"room_id":    roomID,
+			}).Error("Failed to send Home Assistant notification")
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// targetRooms returns the configured rooms which the notification targets, or every room if it
+// has no target.
+func (s *Service) targetRooms(target interface{}) []id.RoomID {
+	var targets []string
+	switch t := target.(type) {
+	case string:
+		targets = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			if str, ok := v.(string); ok {
+				targets = append(targets, str)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return s.Rooms
+	}
+	var rooms []id.RoomID
+	for _, roomID := range s.Rooms {
+		for _, t := range targets {
+			if string(roomID) == t {
+				rooms = append(rooms, roomID)
+				break
+			}
+		}
+	}
+	return rooms
+}
+
+func htmlEscape(s string) string {
+	return strings.Replace(html.EscapeString(s), "\n", "<br>", -1)
+}
+
+// Commands supported:
+//    !ha domain.service entity
+// Calls the Home Assistant service for the entity, e.g. "!ha light.toggle living_room".
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"ha"},
+			Arguments: []string{"service", "entity"},
+			Help:      "Call a Home Assistant service, e.g. !ha light.toggle living_room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdCallService(userID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdCallService(userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("Usage: !ha service entity, e.g. !ha light.toggle living_room")
+	}
+	if s.ServerURL == "" || s.AccessToken == "" {
+		return nil, fmt.Errorf("Calling services isn't set up: the service needs a server_url and access_token")
+	}
+	service, entity := strings.ToLower(args[0]), strings.ToLower(args[1])
+	if !serviceRegex.MatchString(service) {
+		return nil, fmt.Errorf("'%s' is not a Home Assistant service, e.g. light.toggle", args[0])
+	}
+	domain := service[:strings.Index(service, ".")]
+	if !strings.Contains(entity, ".") {
+		entity = domain + "." + entity
+	}
+	if !serviceRegex.MatchString(entity) {
+		return nil, fmt.Errorf("'%s' is not a Home Assistant entity, e.g. light.living_room", args[1])
+	}
+	if !s.isAllowed(entity) {
+		return nil, fmt.Errorf("%s is not one of the allowed entities", entity)
+	}
+
+	reqBody, err := json.Marshal(map[string]string{"entity_id": entity})
+	if err != nil {
+		return nil, err
+	}
+	u := s.serverURL() + "/api/services/" + strings.Replace(service, ".", "/", 1)
+	req, err := http.NewRequest("POST", u, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to call %s: %s", service, err)
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, fmt.Errorf("Failed to call %s: the access_token was refused", service)
+	default:
+		var body struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(res.Body).Decode(&body) == nil && body.Message != "" {
+			return nil, fmt.Errorf("Failed to call %s: %s", service, body.Message)
+		}
+		return nil, fmt.Errorf("Failed to call %s: request error: %d", service, res.StatusCode)
+	}
+	// Home Assistant responds with the states which changed
+	var states []struct {
+		EntityID   string `json:"entity_id"`
+		State      string `json:"state"`
+		Attributes struct {
+			FriendlyName string `json:"friendly_name"`
+		} `json:"attributes"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&states); err != nil {
+		return nil, fmt.Errorf("Failed to call %s: %s", service, err)
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"user_id":    userID,
+		"service":    service,
+		"entity_id":  entity,
+	}).Info("Called Home Assistant service")
+
+	text := fmt.Sprintf("Called %s for %s", service, entity)
+	for _, st := range states {
+		if st.EntityID != entity {
+			continue
+		}
+		name := st.Attributes.FriendlyName
+		if name == "" {
+			name = st.EntityID
+		}
+		text += fmt.Sprintf(": %s is now %s", name, st.State)
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    text,
+	}, nil
+}
+
+// isAllowed returns true if services can be called for the entity.
+func (s *Service) isAllowed(entity string) bool {
+	for _, allowed := range s.AllowedEntities {
+		allowed = strings.ToLower(allowed)
+		if allowed == entity {
+			return true
+		}
+		if strings.HasSuffix(allowed, ".*") && strings.HasPrefix(entity, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) serverURL() string {
+	return strings.TrimSuffix(s.ServerURL, "/")
+}
+
+// Register makes sure the Config information supplied is valid, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if len(s.Token) < 16 {
+		return fmt.Errorf("A token of at least 16 characters is required")
+	}
+	if s.ServerURL != "" {
+		if u, err := url.Parse(s.ServerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Bad server_url '%s': must be an http or https URL", s.ServerURL)
+		}
+	}
+	if (s.ServerURL == "") != (s.AccessToken == "") {
+		return fmt.Errorf("A server_url and access_token are both required for calling services")
+	}
+	for _, entity := range s.AllowedEntities {
+		if !allowedEntityRegex.MatchString(strings.ToLower(entity)) {
+			return fmt.Errorf("Bad allowed entity '%s': must be e.g. light.kitchen or light.*", entity)
+		}
+	}
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	for _, roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
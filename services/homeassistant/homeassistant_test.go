@@ -0,0 +1,183 @@
+package homeassistant
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestWebhook(t *testing.T) {
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, room+" "+msg.Body+" "+msg.FormattedBody)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$ha:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"token": "the_master_sword_token",
+		"rooms": ["!castle:hyrule", "!village:hyrule"]
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create Home Assistant service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register Home Assistant service: ", err)
+	}
+
+	for _, tc := range []struct {
+		token string
+		body  string
+		code  int
+	}{
+		{"wrong", `{"message": "Hi"}`, 403},
+		{"the_master_sword_token", `{"title": "No message"}`, 400},
+		{"the_master_sword_token", `{"message": "The front door is open"}`, 200},
+		{"the_master_sword_token", `{"title": "Alarm <!>", "message": "Motion in\nthe garden", "target": ["!castle:hyrule", "!dungeon:hyrule"]}`, 200},
+		{"the_master_sword_token", `{"message": "Nobody is here", "target": "!dungeon:hyrule"}`, 200},
+	} {
+		req := httptest.NewRequest("POST", "https://neb.hyrule/services/hooks/aG9tZWFzc2lzdGFudA", strings.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		w := httptest.NewRecorder()
+		srv.OnReceiveWebhook(w, req, matrixCli)
+		if w.Code != tc.code {
+			t.Errorf("Webhook %s: got status %d, want %d", tc.body, w.Code, tc.code)
+		}
+	}
+
+	sort.Strings(sent)
+	want := []string{
+		"!castle:hyrule Alarm <!>\nMotion in\nthe garden <strong>Alarm &lt;!&gt;</strong><br>Motion in<br>the garden",
+		"!castle:hyrule The front door is open ",
+		"!village:hyrule The front door is open ",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad messages: got %q, want %q", sent, want)
+	}
+}
+
+func TestCallService(t *testing.T) {
+	var called []string
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Authorization") != "Bearer ha_token" {
+			return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewBufferString(""))}, nil
+		}
+		if !strings.HasPrefix(req.URL.String(), "http://ha.hyrule:8123/api/services/") {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		var body struct {
+			EntityID string `json:"entity_id"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		called = append(called, req.URL.Path+" "+body.EntityID)
+		if req.URL.Path == "/api/services/light/explode" {
+			return &http.Response{
+				StatusCode: 400,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"message": "Service not found."}`)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(`[{"entity_id": "` + body.EntityID +
+				`", "state": "on", "attributes": {"friendly_name": "Living Room"}}]`)),
+		}, nil
+	})}
+
+	s := &Service{
+		ServerURL:       "http://ha.hyrule:8123/",
+		AccessToken:     "ha_token",
+		AllowedEntities: []string{"light.*", "switch.Coffee_Machine"},
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"light.toggle", "living_room"}, "Called light.toggle for light.living_room: Living Room is now on"},
+		{[]string{"homeassistant.turn_on", "switch.coffee_machine"}, "Called homeassistant.turn_on for switch.coffee_machine: Living Room is now on"},
+	} {
+		res, err := s.cmdCallService("@link:hyrule", tc.args)
+		if err != nil {
+			t.Errorf("!ha %v failed: %s", tc.args, err)
+			continue
+		}
+		if body := res.(*mevt.MessageEventContent).Body; body != tc.want {
+			t.Errorf("!ha %v: got %q, want %q", tc.args, body, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"light.toggle"}, "Usage"},
+		{[]string{"toggle", "living_room"}, "not a Home Assistant service"},
+		{[]string{"switch.turn_on", "sword_forge"}, "not one of the allowed entities"},
+		{[]string{"lock.unlock", "light.living_room/../../lock"}, "not a Home Assistant entity"},
+		{[]string{"light.explode", "living_room"}, "Service not found."},
+	} {
+		if _, err := s.cmdCallService("@link:hyrule", tc.args); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("!ha %v: expected error containing %q, got %v", tc.args, tc.wantErr, err)
+		}
+	}
+
+	wantCalled := []string{
+		"/api/services/light/toggle light.living_room",
+		"/api/services/homeassistant/turn_on switch.coffee_machine",
+		"/api/services/light/explode light.living_room",
+	}
+	if strings.Join(called, "|") != strings.Join(wantCalled, "|") {
+		t.Errorf("Bad calls: got %q, want %q", called, wantCalled)
+	}
+
+	s.AccessToken = "wrong"
+	if _, err := s.cmdCallService("@link:hyrule", []string{"light.toggle", "living_room"}); err == nil || !strings.Contains(err.Error(), "access_token was refused") {
+		t.Errorf("Expected a bad access token to be reported, got %v", err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"token": "short", "rooms": ["!castle:hyrule"]}`,
+		`{"token": "the_master_sword_token"}`,
+		`{"token": "the_master_sword_token", "rooms": ["!castle:hyrule"], "server_url": "http://ha.hyrule:8123"}`,
+		`{"token": "the_master_sword_token", "rooms": ["!castle:hyrule"], "server_url": "ha.hyrule", "access_token": "ha_token"}`,
+		`{"token": "the_master_sword_token", "rooms": ["!castle:hyrule"], "allowed_entities": ["*"]}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create Home Assistant service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
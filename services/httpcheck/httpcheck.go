@@ -0,0 +1,234 @@
+// Package httpcheck implements a Service which makes HTTP requests from chat, like curl.
+package httpcheck
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the HTTP check service
+const ServiceType = "httpcheck"
+
+const (
+	defaultTimeout        = 10 * time.Second
+	defaultMaxBodySize    = 1024 * 1024
+	defaultMaxBodyDisplay = 1000
+	maxRedirects          = 5
+)
+
+var defaultMethods = []string{"GET", "HEAD", "OPTIONS"}
+
+// Service contains the Config fields for the HTTP check service.
+//
+// This service makes HTTP requests and posts the status, how long it took and the start of the
+// body, which is useful for checking that something is up without leaving chat:
+//    !http GET https://api.example.com/health
+//
+// Only hosts on the allowlist can be requested. Entries can start with "*." to match subdomains,
+// or be "*" to allow any host. Requests to private, loopback and link-local addresses are refused
+// (whatever the hostname resolves to) unless allow_private_networks is set.
+//
+// Example JSON request:
+//   {
+//       "allowed_domains": ["example.com", "*.example.com"],
+//       "allowed_methods": ["GET", "HEAD"],
+//       "timeout": "5s"
+//   }
+type Service struct {
+	types.DefaultService
+	// The hosts which may be requested.
+	AllowedDomains []string `json:"allowed_domains"`
+	// Optional. The methods which may be used. Defaults to GET, HEAD and OPTIONS.
+	AllowedMethods []string `json:"allowed_methods"`
+	// Optional. Allow requests to private networks, e.g. to check internal services. Defaults to false.
+	AllowPrivateNetworks bool `json:"allow_private_networks"`
+	// Optional. How long a request may take, e.g. "30s". Defaults to 10 seconds.
+	Timeout string `json:"timeout"`
+	// Optional. The most bytes of the body to download. Defaults to 1 MB.
+	MaxBodySize int64 `json:"max_body_size"`
+	// Optional. The most characters of the body to post. Defaults to 1000.
+	MaxBodyDisplay int `json:"max_body_display"`
+}
+
+// Commands supported:
+//    !http [METHOD] URL
+// Makes the request and responds with the status, latency and the start of the body. The method
+// defaults to GET.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"http"},
+			Arguments: []string{"[method]", "url"},
+			Help:      "Make an HTTP request",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdHTTP(args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdHTTP(args []string) (interface{}, error) {
+	var method, rawURL string
+	switch len(args) {
+	case 1:
+		method, rawURL = "GET", args[0]
+	case 2:
+		method, rawURL = strings.ToUpper(args[0]), args[1]
+	default:
+		return nil, fmt.Errorf("Usage: !http [method] url")
+	}
+	if !s.methodAllowed(method) {
+		return nil, fmt.Errorf("%s requests are not allowed", method)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("'%s' is not an http or https URL", rawURL)
+	}
+	if !s.hostAllowed(u.Hostname()) {
+		return nil, fmt.Errorf("%s is not on the allowlist", u.Hostname())
+	}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Go-NEB")
+	client, err := s.newClient()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %s", method, u, err)
+	}
+	defer res.Body.Close()
+	maxSize := s.MaxBodySize
+	if maxSize <= 0 {
+		maxSize = defaultMaxBodySize
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSize))
+	latency := time.Since(start)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the response body: %s", err)
+	}
+	return s.responseMessage(method, u, res, body, latency), nil
+}
+
+// responseMessage describes the response, with the start of the body as a code block.
+func (s *Service) responseMessage(method string, u *url.URL, res *http.Response, body []byte, latency time.Duration) *mevt.MessageEventContent {
+	summary := fmt.Sprintf("%s %s: %s in %dms", method, u, res.Status, latency.Milliseconds())
+	if ct := res.Header.Get("Content-Type"); ct != "" {
+		summary += "\nContent-Type: " + ct
+	}
+	content := &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          summary,
+		Format:        mevt.FormatHTML,
+		FormattedBody: strings.Replace(html.EscapeString(summary), "\n", "<br>", -1),
+	}
+	if len(body) == 0 {
+		return content
+	}
+	var text string
+	if utf8.Valid(body) {
+		text = s.truncate(string(body))
+	} else {
+		text = fmt.Sprintf("(%d bytes of binary data)", len(body))
+	}
+	content.Body += "\n```\n" + text + "\n```"
+	content.FormattedBody += "<pre><code>" + html.EscapeString(text) + "</code></pre>"
+	return content
+}
+
+func (s *Service) truncate(text string) string {
+	max := s.MaxBodyDisplay
+	if max <= 0 {
+		max = defaultMaxBodyDisplay
+	}
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:max]) + "…"
+}
+
+func (s *Service) methodAllowed(method string) bool {
+	methods := s.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultMethods
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) hostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range s.AllowedDomains {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// newClient returns an HTTP client which enforces the timeout, address checks and allowlist.
+func (s *Service) newClient() (*http.Client, error) {
+	timeout := defaultTimeout
+	if s.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(s.Timeout); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("Bad timeout '%s'", s.Timeout)
+		}
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: utils.PublicHTTPTransport(timeout, s.AllowPrivateNetworks),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if !s.hostAllowed(req.URL.Hostname()) {
+				return fmt.Errorf("redirected to %s, which is not on the allowlist", req.URL.Hostname())
+			}
+			return nil
+		},
+	}, nil
+}
+
+// Register makes sure that the configuration is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.AllowedDomains) == 0 {
+		return fmt.Errorf("At least one allowed domain is required, or \"*\" to allow any")
+	}
+	_, err := s.newClient()
+	return err
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
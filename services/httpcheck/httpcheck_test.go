@@ -0,0 +1,90 @@
+package httpcheck
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func createService(t *testing.T, config string) *Service {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+	if err != nil {
+		t.Fatal("Failed to create httpcheck service: ", err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register httpcheck service: ", err)
+	}
+	return srv.(*Service)
+}
+
+func TestRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://elsewhere.example/", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "Hey! Listen!")
+	}))
+	defer server.Close()
+
+	s := createService(t, `{
+		"allowed_domains": ["127.0.0.1"],
+		"allow_private_networks": true,
+		"max_body_display": 4
+	}`)
+	res, err := s.cmdHTTP([]string{"get", server.URL + "/health"})
+	if err != nil {
+		t.Fatalf("!http failed: %s", err)
+	}
+	body := res.(*mevt.MessageEventContent).Body
+	if !strings.HasPrefix(body, "GET "+server.URL+"/health: 200 OK in ") {
+		t.Errorf("Bad status line: %s", body)
+	}
+	if !strings.HasSuffix(body, "ms\nContent-Type: text/plain\n```\nHey!…\n```") {
+		t.Errorf("Bad body: %s", body)
+	}
+
+	badCommands := [][]string{
+		{"POST", server.URL},                        // method not allowed
+		{"http://example.com/"},                     // not on the allowlist
+		{"ftp://127.0.0.1/"},                        // not http
+		{server.URL + "/redirect"},                  // redirected off the allowlist
+		{"GET", server.URL, "and", "other", "args"}, // bad usage
+	}
+	for _, args := range badCommands {
+		if _, err = s.cmdHTTP(args); err == nil {
+			t.Errorf("Expected %v to fail", args)
+		}
+	}
+
+	// Private addresses are refused, even when the host is allowed
+	s = createService(t, `{"allowed_domains": ["*"]}`)
+	if _, err = s.cmdHTTP([]string{server.URL}); err == nil || !strings.Contains(err.Error(), "private address") {
+		t.Errorf("Expected a request to a private address to be refused, got %v", err)
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	s := &Service{AllowedDomains: []string{"example.com", "*.matrix.org"}}
+	testCases := map[string]bool{
+		"example.com":         true,
+		"EXAMPLE.com.":        true,
+		"api.example.com":     false,
+		"matrix.org":          false,
+		"element.matrix.org":  true,
+		"a.b.matrix.org":      true,
+		"evilmatrix.org":      false,
+		"example.com.evil.io": false,
+	}
+	for host, want := range testCases {
+		if got := s.hostAllowed(host); got != want {
+			t.Errorf("hostAllowed(%s) = %v, want %v", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package imgur
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Matches album and gallery links, e.g. https://imgur.com/a/AbC12 or
+// https://imgur.com/gallery/some-title-AbC12. The ID is whatever follows the last hyphen.
+var albumURLRegex = regexp.MustCompile(`https?://(?:www\.|m\.)?imgur\.com/(a|gallery)/([A-Za-z0-9-]+)`)
+
+// How long the images of a previewed album can be picked from with !imgur album N
+const albumTimeout = time.Hour
+
+// Imgur response for a single image or album
+type imgurItemResponse struct {
+	Data    json.RawMessage `json:"data"`
+	Success *bool           `json:"success"`
+	Status  int             `json:"status"`
+}
+
+type previewedAlbum struct {
+	album   *imgurGalleryAlbum
+	expires time.Time
+}
+
+// The last album previewed in each room, which !imgur album picks images from.
+var (
+	albumsMutex sync.Mutex
+	albums      = make(map[id.RoomID]previewedAlbum)
+)
+
+// expandAlbum previews the album or gallery post linked to. Gallery posts of a single image are
+// expanded into the image itself.
+func (s *Service) expandAlbum(client types.MatrixClient, roomID id.RoomID, matchingGroups []string) interface{} {
+	kind, albumID := matchingGroups[1], matchingGroups[2]
+	if i := strings.LastIndex(albumID, "-"); i >= 0 {
+		albumID = albumID[i+1:]
+	}
+	logger := log.WithFields(log.Fields{
+		"room_id":  roomID,
+		"album_id": albumID,
+	})
+	image, album, err := s.fetchAlbum(kind, albumID)
+	if err != nil {
+		logger.WithError(err).Print("Failed to fetch Imgur album")
+		return nil
+	}
+	var content interface{}
+	if album != nil {
+		content, err = s.albumPreview(client, roomID, album)
+	} else {
+		content, err = imageMessage(client, image, image.Title)
+	}
+	if err != nil {
+		logger.WithError(err).Print("Failed to preview Imgur album")
+		return nil
+	}
+	return content
+}
+
+// fetchAlbum returns the album, or the image if a gallery post turns out to be a single image
+func (s *Service) fetchAlbum(kind, albumID string) (*imgurGalleryImage, *imgurGalleryAlbum, error) {
+	urlString := "https://api.imgur.com/3/album/" + albumID
+	if kind == "gallery" {
+		urlString = "https://api.imgur.com/3/gallery/" + albumID
+	}
+	b, err := getImgur(urlString, s.ClientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var res imgurItemResponse
+	if err = json.Unmarshal(b, &res); err != nil {
+		return nil, nil, err
+	}
+	var album imgurGalleryAlbum
+	if err = json.Unmarshal(res.Data, &album); err != nil {
+		return nil, nil, err
+	}
+	// Albums fetched through the album endpoint don't say that they're albums
+	if kind == "gallery" && (album.IsAlbum == nil || !*album.IsAlbum) {
+		var image imgurGalleryImage
+		if err = json.Unmarshal(res.Data, &image); err != nil {
+			return nil, nil, err
+		}
+		return &image, nil, nil
+	}
+	if len(album.Images) == 0 {
+		return nil, nil, fmt.Errorf("Album %s has no images", albumID)
+	}
+	return nil, &album, nil
+}
+
+// albumPreview sends the cover of the album into the room and returns a summary of it. The album
+// is remembered so that its other images can be picked with !imgur album N.
+func (s *Service) albumPreview(client types.MatrixClient, roomID id.RoomID, album *imgurGalleryAlbum) (interface{}, error) {
+	if len(album.Images) == 0 {
+		// Search results don't always include an album's images
+		_, fetched, err := s.fetchAlbum("a", album.ID)
+		if err != nil {
+			return nil, err
+		}
+		album = fetched
+	}
+	cover := &album.Images[0]
+	for i := range album.Images {
+		if album.Images[i].ID == album.Cover {
+			cover = &album.Images[i]
+			break
+		}
+	}
+	title := album.Title
+	if title == "" {
+		title = "Untitled album"
+	}
+	coverMsg, err := imageMessage(client, cover, title)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = client.SendMessageEvent(roomID, mevt.EventMessage, coverMsg); err != nil {
+		return nil, err
+	}
+
+	albumsMutex.Lock()
+	albums[roomID] = previewedAlbum{album, time.Now().Add(albumTimeout)}
+	albumsMutex.Unlock()
+
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body: fmt.Sprintf("%s (%d images) %s\nSay !imgur album 1-%d to see one of its images.",
+			title, len(album.Images), album.Link, len(album.Images)),
+	}, nil
+}
+
+// cmdAlbumImage responds with an image from the album last previewed in the room
+func (s *Service) cmdAlbumImage(client types.MatrixClient, roomID id.RoomID, args []string) (interface{}, error) {
+	albumsMutex.Lock()
+	previewed, ok := albums[roomID]
+	albumsMutex.Unlock()
+	if !ok || time.Now().After(previewed.expires) {
+		return nil, fmt.Errorf("No Imgur album has been previewed in this room recently")
+	}
+	images := previewed.album.Images
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !imgur album 1-%d", len(images))
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 || n > len(images) {
+		return nil, fmt.Errorf("Pick an image between 1 and %d", len(images))
+	}
+	image := &images[n-1]
+	body := image.Title
+	if body == "" {
+		body = fmt.Sprintf("%s (%d/%d)", previewed.album.Title, n, len(images))
+	}
+	return imageMessage(client, image, body)
+}
@@ -10,6 +10,8 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/realms/imgur"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
@@ -99,10 +101,14 @@ type imgurSearchResponse struct {
 
 // Service contains the Config fields for the Imgur service.
 //
+// To upload images to Imgur, users log in through an "imgur" realm. Without a realm_id the
+// service can only search and preview.
+//
 // Example request:
 //   {
 //			"client_id": "AIzaSyA4FD39..."
 //			"client_secret": "ASdsaijwdfASD..."
+//			"realm_id": "imgur-realm-id"
 //   }
 type Service struct {
 	types.DefaultService
@@ -110,11 +116,18 @@ type Service struct {
 	ClientID string `json:"client_id"`
 	// The API key to use when making HTTP requests to Imgur.
 	ClientSecret string `json:"client_secret"`
+	// Optional. The ID of an existing "imgur" realm, used to obtain the credentials of users
+	// when they upload images.
+	RealmID string `json:"realm_id"`
 }
 
 // Commands supported:
 //    !imgur some_search_query_without_quotes
 // Responds with a suitable image into the same room as the command.
+//    !imgur album 3
+// Responds with the 3rd image of the album which was last previewed in the room.
+//    !imgur upload
+// Sent in reply to an image message, uploads the image to the sender's Imgur account and responds with the link.
 func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	return []types.Command{
 		{
@@ -129,14 +142,55 @@ func (s *Service) Commands(client types.MatrixClient) []types.Command {
 				return s.cmdImgSearch(client, roomID, userID, args)
 			},
 		},
+		{
+			Path: []string{"imgur", "album"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdAlbumImage(client, roomID, args)
+			},
+		},
+		{
+			Path: []string{"imgur", "upload"},
+			EventCommand: func(evt *mevt.Event, args []string) (interface{}, error) {
+				return s.cmdUpload(client, evt)
+			},
+		},
+	}
+}
+
+// Expansions expands imgur album and gallery links into a preview of the album.
+func (s *Service) Expansions(client types.MatrixClient) []types.Expansion {
+	return []types.Expansion{
+		{
+			Regexp: albumURLRegex,
+			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+				return s.expandAlbum(client, roomID, matchingGroups)
+			},
+		},
+	}
+}
+
+// Register makes sure that the given realm ID, if any, maps to an imgur realm.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.RealmID == "" {
+		return nil
+	}
+	realm, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return err
+	}
+	if realm.Type() != imgur.RealmType {
+		return fmt.Errorf("Realm is of type '%s', not '%s'", realm.Type(), imgur.RealmType)
 	}
+	return nil
 }
 
 // usageMessage returns a matrix TextMessage representation of the service usage
 func usageMessage() *mevt.MessageEventContent {
 	return &mevt.MessageEventContent{
 		MsgType: mevt.MsgNotice,
-		Body:    "Usage: !imgur image_search_text",
+		Body: "Usage: !imgur image_search_text\n" +
+			"       !imgur album image_number\n" +
+			"       !imgur upload (in reply to an image)",
 	}
 }
 
@@ -156,36 +210,15 @@ func (s *Service) cmdImgSearch(client types.MatrixClient, roomID id.RoomID, user
 
 	// Image returned
 	if searchResultImage != nil {
-		var imgURL = searchResultImage.Link
-		if imgURL == "" {
+		if searchResultImage.Link == "" {
 			return mevt.MessageEventContent{
 				MsgType: mevt.MsgNotice,
 				Body:    "No image found!",
 			}, nil
 		}
-
-		// Upload image
-		resUpload, err := client.UploadLink(imgURL)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to upload Imgur image (%s) to matrix: %s", imgURL, err.Error())
-		}
-
-		// Return image message
-		return mevt.MessageEventContent{
-			MsgType: "m.image",
-			Body:    querySentence,
-			URL:     resUpload.ContentURI.CUString(),
-			Info: &mevt.FileInfo{
-				Height:   searchResultImage.Height,
-				Width:    searchResultImage.Width,
-				MimeType: searchResultImage.Type,
-			},
-		}, nil
+		return imageMessage(client, searchResultImage, querySentence)
 	} else if searchResultAlbum != nil {
-		return mevt.MessageEventContent{
-			MsgType: mevt.MsgNotice,
-			Body:    "Search returned an album - Not currently supported",
-		}, nil
+		return s.albumPreview(client, roomID, searchResultAlbum)
 	} else {
 		return mevt.MessageEventContent{
 			MsgType: mevt.MsgNotice,
@@ -194,6 +227,26 @@ func (s *Service) cmdImgSearch(client types.MatrixClient, roomID id.RoomID, user
 	}
 }
 
+// imageMessage uploads the image to matrix and returns an image message for it
+func imageMessage(client types.MatrixClient, image *imgurGalleryImage, body string) (interface{}, error) {
+	resUpload, err := client.UploadLink(image.Link)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to upload Imgur image (%s) to matrix: %s", image.Link, err.Error())
+	}
+
+	// Return image message
+	return mevt.MessageEventContent{
+		MsgType: "m.image",
+		Body:    body,
+		URL:     resUpload.ContentURI.CUString(),
+		Info: &mevt.FileInfo{
+			Height:   image.Height,
+			Width:    image.Width,
+			MimeType: image.Type,
+		},
+	}, nil
+}
+
 // text2img returns info about an image or an album
 func (s *Service) text2img(query string) (*imgurGalleryImage, *imgurGalleryAlbum, error) {
 	log.Info("Searching Imgur for an image of a ", query)
@@ -211,12 +264,21 @@ func (s *Service) text2img(query string) (*imgurGalleryImage, *imgurGalleryAlbum
 	}
 
 	log.Printf("%d results were returned from Imgur", len(searchResults.Data))
-	// Return a random image result
+	// Return a random image result, or the first album if there are only albums
 	var images []imgurGalleryImage
+	var album *imgurGalleryAlbum
 	for i := 0; i < len(searchResults.Data); i++ {
 		var image imgurGalleryImage
-		if err := json.Unmarshal(searchResults.Data[i], &image); err == nil && !*(image.IsAlbum) {
+		if err := json.Unmarshal(searchResults.Data[i], &image); err != nil {
+			continue
+		}
+		if image.IsAlbum == nil || !*image.IsAlbum {
 			images = append(images, image)
+		} else if album == nil {
+			album = &imgurGalleryAlbum{}
+			if err := json.Unmarshal(searchResults.Data[i], album); err != nil {
+				album = nil
+			}
 		}
 	}
 	if len(images) > 0 {
@@ -226,6 +288,9 @@ func (s *Service) text2img(query string) (*imgurGalleryImage, *imgurGalleryAlbum
 		}
 		return &images[r], nil, nil
 	}
+	if album != nil {
+		return nil, album, nil
+	}
 
 	return nil, nil, fmt.Errorf("No images found")
 }
@@ -240,6 +305,11 @@ func queryImgur(query, clientID string) ([]byte, error) {
 	var page = 1
 	var urlString = fmt.Sprintf("https://api.imgur.com/3/gallery/search/%s/%s/%d?q=%s", sort, window, page, query)
 
+	return getImgur(urlString, clientID)
+}
+
+// getImgur makes an anonymous request to the Imgur API and returns the response body or error
+func getImgur(urlString, clientID string) ([]byte, error) {
 	u, err := url.Parse(urlString)
 	if err != nil {
 		return nil, err
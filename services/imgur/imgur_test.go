@@ -2,6 +2,7 @@ package imgur
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,9 +11,13 @@ import (
 	"testing"
 
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	imgurrealm "github.com/matrix-org/go-neb/realms/imgur"
 	"github.com/matrix-org/go-neb/testutils"
 	"github.com/matrix-org/go-neb/types"
 	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 func TestCommand(t *testing.T) {
@@ -111,7 +116,7 @@ func TestCommand(t *testing.T) {
 
 	// Execute the matrix !command
 	cmds := imgur.Commands(matrixCli)
-	if len(cmds) != 2 {
+	if len(cmds) != 4 {
 		t.Fatalf("Unexpected number of commands: %d", len(cmds))
 	}
 	cmd := cmds[1]
@@ -120,3 +125,234 @@ func TestCommand(t *testing.T) {
 		t.Fatalf("Failed to process command: %s", err.Error())
 	}
 }
+
+func TestAlbumExpansion(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	coverURL := "http://i.imgur.com/cover.jpg"
+	secondURL := "http://i.imgur.com/second.jpg"
+
+	imgurTrans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "https://api.imgur.com/3/gallery/AbC12" {
+			t.Fatalf("Bad URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(`{"success":true,"status":200,"data":{
+				"id":"AbC12","title":"Cats","is_album":true,"cover":"cover","link":"https://imgur.com/a/AbC12",
+				"images":[
+					{"id":"first","link":"http://i.imgur.com/first.jpg","type":"image/jpeg"},
+					{"id":"cover","link":"` + coverURL + `","type":"image/jpeg"},
+					{"id":"second","title":"A second cat","link":"` + secondURL + `","type":"image/jpeg"}
+				]}}`)),
+		}, nil
+	})
+	httpClient = &http.Client{Transport: imgurTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@imgurbot:hyrule", []byte(`{"client_id":"My ID"}`))
+	if err != nil {
+		t.Fatal("Failed to create imgur service: ", err)
+	}
+	imgur := srv.(*Service)
+
+	// Mock the response from Matrix, recording the images uploaded and messages sent
+	var uploaded []string
+	var sent []map[string]interface{}
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.HasPrefix(req.URL.String(), "http://i.imgur.com/") {
+			uploaded = append(uploaded, req.URL.String())
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("some image data")),
+			}, nil
+		} else if strings.Contains(req.URL.String(), "_matrix/media/r0/upload") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://foo/bar"}`)),
+			}, nil
+		} else if strings.Contains(req.URL.String(), "/send/m.room.message/") {
+			var content map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+				t.Fatalf("Failed to decode sent message: %s", err)
+			}
+			sent = append(sent, content)
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$cover"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@imgurbot:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	expansions := imgur.Expansions(matrixCli)
+	body := "look at these https://imgur.com/gallery/cute-cats-AbC12"
+	matches := expansions[0].Regexp.FindStringSubmatch(body)
+	if matches == nil {
+		t.Fatalf("Expansion did not match %s", body)
+	}
+	res := expansions[0].Expand("!someroom:hyrule", "@navi:hyrule", matches)
+	summary, ok := res.(mevt.MessageEventContent)
+	if !ok || !strings.HasPrefix(summary.Body, "Cats (3 images)") {
+		t.Fatalf("Bad album summary: %+v", res)
+	}
+	if len(uploaded) != 1 || uploaded[0] != coverURL {
+		t.Errorf("Expected the cover to be uploaded, got %v", uploaded)
+	}
+	if len(sent) != 1 || sent[0]["msgtype"] != "m.image" || sent[0]["body"] != "Cats" {
+		t.Errorf("Expected the cover to be sent, got %v", sent)
+	}
+
+	// Pick another image from the album
+	var albumCmd types.Command
+	for _, cmd := range imgur.Commands(matrixCli) {
+		if strings.Join(cmd.Path, " ") == "imgur album" {
+			albumCmd = cmd
+		}
+	}
+	res, err = albumCmd.Command("!someroom:hyrule", "@navi:hyrule", []string{"3"})
+	if err != nil {
+		t.Fatalf("Failed to pick an album image: %s", err)
+	}
+	image, ok := res.(mevt.MessageEventContent)
+	if !ok || image.MsgType != mevt.MsgImage || image.Body != "A second cat" || uploaded[len(uploaded)-1] != secondURL {
+		t.Errorf("Bad album image: %+v", res)
+	}
+	if _, err = albumCmd.Command("!someroom:hyrule", "@navi:hyrule", []string{"4"}); err == nil {
+		t.Errorf("Picked an image which isn't in the album")
+	}
+	if _, err = albumCmd.Command("!otherroom:hyrule", "@navi:hyrule", []string{"1"}); err == nil {
+		t.Errorf("Picked an image from an album previewed in another room")
+	}
+}
+
+// authStorage returns the realm and session which it was created with
+type authStorage struct {
+	database.NopStorage
+	realm   types.AuthRealm
+	session types.AuthSession
+}
+
+func (s *authStorage) LoadAuthRealm(realmID string) (types.AuthRealm, error) {
+	return s.realm, nil
+}
+
+func (s *authStorage) LoadAuthSessionByUser(realmID string, userID id.UserID) (types.AuthSession, error) {
+	if s.session == nil || s.session.UserID() != userID {
+		return nil, sql.ErrNoRows
+	}
+	return s.session, nil
+}
+
+func TestUpload(t *testing.T) {
+	realm, err := types.CreateAuthRealm("imgur-realm", imgurrealm.RealmType, []byte(
+		`{"ClientID":"My ID","ClientSecret":"shh","StarterLink":"https://example.com/login"}`,
+	))
+	if err != nil {
+		t.Fatal("Failed to create imgur realm: ", err)
+	}
+	session := realm.AuthSession("session", "@navi:hyrule", "imgur-realm").(*imgurrealm.Session)
+	session.AccessToken = "navis_token"
+	database.SetServiceDB(&authStorage{realm: realm, session: session})
+
+	imgurTrans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "POST" || req.URL.String() != "https://api.imgur.com/3/image" {
+			t.Fatalf("Bad request: %s %s", req.Method, req.URL.String())
+		}
+		if auth := req.Header.Get("Authorization"); auth != "Bearer navis_token" {
+			t.Fatalf("Bad Authorization header: %s", auth)
+		}
+		file, _, err := req.FormFile("image")
+		if err != nil {
+			t.Fatalf("Failed to read uploaded image: %s", err)
+		}
+		if data, _ := ioutil.ReadAll(file); string(data) != "cat pixels" {
+			t.Fatalf("Bad image data: %s", string(data))
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(
+				`{"success":true,"status":200,"data":{"id":"cat","link":"https://i.imgur.com/cat.jpg"}}`,
+			)),
+		}, nil
+	})
+	httpClient = &http.Client{Transport: imgurTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@imgurbot:hyrule", []byte(
+		`{"client_id":"My ID","realm_id":"imgur-realm"}`,
+	))
+	if err != nil {
+		t.Fatal("Failed to create imgur service: ", err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register imgur service: ", err)
+	}
+	imgur := srv.(*Service)
+
+	// Mock the response from Matrix: the image message being replied to and its media
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/event/$image") {
+			return &http.Response{
+				StatusCode: 200,
+				Body: ioutil.NopCloser(bytes.NewBufferString(`{
+					"type":"m.room.message","event_id":"$image","room_id":"!someroom:hyrule","sender":"@link:hyrule",
+					"content":{"msgtype":"m.image","body":"cat.jpg","url":"mxc://hyrule/cat"}}`)),
+			}, nil
+		} else if strings.Contains(req.URL.Path, "_matrix/media/r0/download/hyrule/cat") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("cat pixels")),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@imgurbot:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	var uploadCmd types.Command
+	for _, cmd := range imgur.Commands(matrixCli) {
+		if strings.Join(cmd.Path, " ") == "imgur upload" {
+			uploadCmd = cmd
+		}
+	}
+	replyFrom := func(sender id.UserID) *mevt.Event {
+		content := mevt.Content{Raw: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "!imgur upload",
+			"m.relates_to": map[string]interface{}{
+				"m.in_reply_to": map[string]interface{}{"event_id": "$image"},
+			},
+		}}
+		if veryRaw, err := content.MarshalJSON(); err != nil {
+			t.Fatalf("Error marshalling JSON: %s", err)
+		} else {
+			content.VeryRaw = veryRaw
+		}
+		content.ParseRaw(mevt.EventMessage)
+		return &mevt.Event{
+			Type:    mevt.EventMessage,
+			Sender:  sender,
+			RoomID:  "!someroom:hyrule",
+			Content: content,
+		}
+	}
+
+	res, err := uploadCmd.EventCommand(replyFrom("@navi:hyrule"), []string{})
+	if err != nil {
+		t.Fatalf("Failed to upload image: %s", err)
+	}
+	if content, ok := res.(*mevt.MessageEventContent); !ok || content.Body != "https://i.imgur.com/cat.jpg" {
+		t.Errorf("Bad upload response: %+v", res)
+	}
+
+	// Users who haven't logged into Imgur are asked to
+	res, err = uploadCmd.EventCommand(replyFrom("@link:hyrule"), []string{})
+	if err != nil {
+		t.Fatalf("Failed to respond to logged out user: %s", err)
+	}
+	if msg, ok := res.(matrix.StarterLinkMessage); !ok || msg.Link != "https://example.com/login" {
+		t.Errorf("Expected a starter link, got %+v", res)
+	}
+}
@@ -0,0 +1,155 @@
+package imgur
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/realms/imgur"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The largest image imgur accepts, in bytes
+const maxUploadSize = 20 * 1024 * 1024
+
+// Imgur response to an image upload
+type imgurUploadResponse struct {
+	Data    imgurGalleryImage `json:"data"`
+	Success *bool             `json:"success"`
+	Status  int               `json:"status"`
+}
+
+// cmdUpload uploads the image which the command is a reply to, to the sender's Imgur account
+func (s *Service) cmdUpload(client types.MatrixClient, evt *mevt.Event) (interface{}, error) {
+	replyTo := evt.Content.AsMessage().GetReplyTo()
+	if replyTo == "" {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Reply to an image with !imgur upload to upload it to Imgur.",
+		}, nil
+	}
+	if s.RealmID == "" {
+		return nil, fmt.Errorf("Uploading to Imgur has not been set up")
+	}
+	token, resp, err := s.requireAccessTokenFor(evt.Sender)
+	if err != nil || resp != nil {
+		return resp, err
+	}
+
+	evCli, canGet := client.(types.EventGetter)
+	dlCli, canDownload := client.(types.MediaDownloader)
+	if !canGet || !canDownload {
+		return nil, fmt.Errorf("Unable to download images with this client")
+	}
+	original, err := evCli.GetEvent(evt.RoomID, replyTo)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch the image message: %s", err)
+	}
+	original.Content.ParseRaw(mevt.EventMessage)
+	msg := original.Content.AsMessage()
+	if msg.MsgType != mevt.MsgImage {
+		return nil, fmt.Errorf("Only images can be uploaded to Imgur")
+	}
+	if msg.URL == "" {
+		return nil, fmt.Errorf("Encrypted images can't be uploaded to Imgur")
+	}
+	mxcURL, err := msg.URL.Parse()
+	if err != nil {
+		return nil, err
+	}
+	data, err := dlCli.Download(mxcURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download the image: %s", err)
+	}
+	defer data.Close()
+
+	image, err := uploadImage(token, msg.Body, data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to upload the image to Imgur: %s", err)
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    image.Link,
+	}, nil
+}
+
+// requireAccessTokenFor returns the user's Imgur access token, or a message asking them to log
+// in if they haven't yet.
+func (s *Service) requireAccessTokenFor(userID id.UserID) (token string, resp interface{}, err error) {
+	realm, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return "", nil, err
+	}
+	imgurRealm, ok := realm.(*imgur.Realm)
+	if !ok {
+		return "", nil, fmt.Errorf("Failed to cast realm %s into an ImgurRealm", s.RealmID)
+	}
+	loginMsg := matrix.StarterLinkMessage{
+		Body: "You need to log into Imgur before you can upload images.",
+		Link: imgurRealm.StarterLink,
+	}
+	session, err := database.GetServiceDB().LoadAuthSessionByUser(s.RealmID, userID)
+	if err != nil {
+		return "", loginMsg, nil
+	}
+	imgurSession, ok := session.(*imgur.Session)
+	if !ok || !imgurSession.Authenticated() {
+		return "", loginMsg, nil
+	}
+	token, err = imgurRealm.AccessToken(imgurSession)
+	return token, nil, err
+}
+
+// uploadImage uploads the image data to the account with the access token
+func uploadImage(token, title string, data io.Reader) (*imgurGalleryImage, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("image", title)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(part, io.LimitReader(data, maxUploadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > maxUploadSize {
+		return nil, fmt.Errorf("Image is larger than %d MB", maxUploadSize/1024/1024)
+	}
+	form.WriteField("type", "file")
+	form.WriteField("title", title)
+	if err = form.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", "https://api.imgur.com/3/image", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("Request error: %d, %s", res.StatusCode, response2String(res))
+	}
+	var uploadRes imgurUploadResponse
+	if err = json.NewDecoder(res.Body).Decode(&uploadRes); err != nil {
+		return nil, err
+	}
+	if uploadRes.Data.Link == "" {
+		return nil, fmt.Errorf("Imgur did not return a link to the image")
+	}
+	return &uploadRes.Data, nil
+}
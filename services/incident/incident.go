@@ -0,0 +1,415 @@
+// Package incident implements a Service which runs incidents in their own rooms.
+package incident
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Incident service
+const ServiceType = "incident"
+
+// The severities incidents can be declared with if none are configured
+var defaultSeverities = []string{"SEV1", "SEV2", "SEV3"}
+
+// Commands in the parent and incident rooms both update incidents, so they are only loaded and
+// stored while holding this.
+var incidentsMutex sync.Mutex
+
+// Service contains the Config fields for the Incident service.
+//
+// Anyone in one of the rooms can declare an incident:
+//    !incident declare SEV1 Checkout is returning errors
+// which creates a private room for the incident and invites whoever declared it and the room's
+// on-call list. A status message is pinned in the incident room, and kept up to date as people
+// post updates with "!incident update Failing over to the replica" in the incident room. Once
+// "!incident resolve" is run in the incident room, a summary of the incident's timeline is posted
+// back to the room it was declared in.
+//
+// Go-NEB needs to be able to create rooms, and pins the status message with the power level it is
+// given in the rooms it creates.
+//
+// Example JSON request:
+//   {
+//       "rooms": {
+//           "!ops:localhost": {
+//               "on_call": ["@alice:localhost", "@bob:localhost"]
+//           }
+//       },
+//       "severities": ["SEV1", "SEV2", "SEV3"]
+//   }
+type Service struct {
+	types.DefaultService
+	// The rooms in which incidents can be declared.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+	// Optional. The severities incidents can be declared with, most severe first. Defaults to
+	// SEV1, SEV2 and SEV3.
+	Severities []string `json:"severities"`
+}
+
+// RoomConfig is how incidents declared in a room are run.
+type RoomConfig struct {
+	// The people to invite to the incident rooms of incidents declared in the room.
+	OnCall []id.UserID `json:"on_call"`
+}
+
+// incident is an open incident. It is stored in the service state under "incident" and the ID of
+// the incident room.
+type incident struct {
+	Severity              string          `json:"severity"`
+	Title                 string          `json:"title"`
+	ParentRoomID          id.RoomID       `json:"parent_room_id"`
+	StatusEventID         id.EventID      `json:"status_event_id"`
+	DeclaredBy            id.UserID       `json:"declared_by"`
+	DeclaredTimestampSecs int64           `json:"declared_timestamp_secs"`
+	Timeline              []timelineEntry `json:"timeline"`
+	Resolved              bool            `json:"resolved"`
+}
+
+// timelineEntry is an update posted about an incident.
+type timelineEntry struct {
+	TimestampSecs int64     `json:"timestamp_secs"`
+	UserID        id.UserID `json:"user_id"`
+	Text          string    `json:"text"`
+}
+
+func (e *timelineEntry) String() string {
+	return fmt.Sprintf("%s %s: %s", formatTime(time.Unix(e.TimestampSecs, 0)), e.UserID, e.Text)
+}
+
+// Commands supported:
+//    !incident declare severity title
+// Creates an incident room, invites the on-call list to it and pins its status message.
+//    !incident update text
+// Adds the update to the timeline of the incident in this room and its status message.
+//    !incident resolve [text]
+// Resolves the incident in this room, and posts its timeline to the room it was declared in.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"incident", "declare"},
+			Arguments: []string{"severity", "title"},
+			Help:      "Declare an incident and create a room for it",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdDeclare(cli, roomID, userID, args, time.Now())
+			},
+		},
+		{
+			Path:      []string{"incident", "update"},
+			Arguments: []string{"text"},
+			Help:      "Post an update on the incident in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdUpdate(cli, roomID, userID, args, time.Now())
+			},
+		},
+		{
+			Path:      []string{"incident", "resolve"},
+			Arguments: []string{"[text]"},
+			Help:      "Resolve the incident in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdResolve(cli, roomID, userID, args, time.Now())
+			},
+		},
+	}
+}
+
+func (s *Service) severities() []string {
+	if len(s.Severities) == 0 {
+		return defaultSeverities
+	}
+	return s.Severities
+}
+
+// severity returns the configured severity matching the name, ignoring case.
+func (s *Service) severity(name string) (string, bool) {
+	for _, sev := range s.severities() {
+		if strings.EqualFold(sev, name) {
+			return sev, true
+		}
+	}
+	return "", false
+}
+
+func (s *Service) cmdDeclare(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	roomConfig, ok := s.Rooms[roomID]
+	if !ok {
+		return nil, fmt.Errorf("Incidents can't be declared in this room")
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("Usage: !incident declare %s title", strings.Join(s.severities(), "|"))
+	}
+	severity, ok := s.severity(args[0])
+	if !ok {
+		return nil, fmt.Errorf("Unknown severity '%s': must be one of %s", args[0], strings.Join(s.severities(), ", "))
+	}
+	roomCli, canCreate := cli.(types.RoomCreator)
+	stateCli, canSendState := cli.(types.StateSender)
+	if !canCreate || !canSendState {
+		return nil, fmt.Errorf("Client cannot create rooms")
+	}
+	inc := &incident{
+		Severity:              severity,
+		Title:                 strings.Join(args[1:], " "),
+		ParentRoomID:          roomID,
+		DeclaredBy:            userID,
+		DeclaredTimestampSecs: now.Unix(),
+		Timeline: []timelineEntry{
+			{TimestampSecs: now.Unix(), UserID: userID, Text: "declared the incident"},
+		},
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    roomID,
+		"user_id":    userID,
+	})
+
+	invite := []id.UserID{userID}
+	for _, u := range roomConfig.OnCall {
+		if u != userID && u != s.ServiceUserID() {
+			invite = append(invite, u)
+		}
+	}
+	resp, err := roomCli.CreateRoom(&mautrix.ReqCreateRoom{
+		Preset: "private_chat",
+		Name:   fmt.Sprintf("%s: %s", inc.Severity, inc.Title),
+		Topic:  fmt.Sprintf("%s incident declared by %s at %s", inc.Severity, userID, formatTime(now)),
+		Invite: invite,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create incident room: %s", err)
+	}
+	incidentRoomID := resp.RoomID
+	logger = logger.WithField("incident_room_id", incidentRoomID)
+
+	sent, err := cli.SendMessageEvent(incidentRoomID, mevt.EventMessage, inc.statusMessage())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to send the status message of incident room %s: %s", incidentRoomID, err)
+	}
+	inc.StatusEventID = sent.EventID
+	if _, err = stateCli.SendStateEvent(incidentRoomID, mevt.StatePinnedEvents, "", map[string][]id.EventID{
+		"pinned": {sent.EventID},
+	}); err != nil {
+		// The status message is still there to be found, just not pinned
+		logger.WithError(err).Error("Failed to pin incident status message")
+	}
+
+	incidentsMutex.Lock()
+	defer incidentsMutex.Unlock()
+	if err = s.storeIncident(incidentRoomID, inc); err != nil {
+		return nil, err
+	}
+	logger.WithField("severity", inc.Severity).Info("Declared incident")
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgText,
+		Body: fmt.Sprintf("🚨 %s declared a %s incident: %s\nThe incident is being handled in %s",
+			userID, inc.Severity, inc.Title, incidentRoomID),
+		Format: mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf(`🚨 %s declared a <b>%s</b> incident: %s<br>The incident is being handled in <a href="https://matrix.to/#/%s">%s</a>`,
+			html.EscapeString(userID.String()), html.EscapeString(inc.Severity), html.EscapeString(inc.Title),
+			html.EscapeString(incidentRoomID.String()), html.EscapeString(incidentRoomID.String())),
+	}, nil
+}
+
+func (s *Service) cmdUpdate(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Usage: !incident update text")
+	}
+	incidentsMutex.Lock()
+	defer incidentsMutex.Unlock()
+	inc, err := s.loadIncident(roomID)
+	if err != nil {
+		return nil, err
+	}
+	inc.Timeline = append(inc.Timeline, timelineEntry{
+		TimestampSecs: now.Unix(),
+		UserID:        userID,
+		Text:          strings.Join(args, " "),
+	})
+	if err = s.editStatus(cli, roomID, inc); err != nil {
+		return nil, err
+	}
+	if err = s.storeIncident(roomID, inc); err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    "Updated the incident status",
+	}, nil
+}
+
+func (s *Service) cmdResolve(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	incidentsMutex.Lock()
+	defer incidentsMutex.Unlock()
+	inc, err := s.loadIncident(roomID)
+	if err != nil {
+		return nil, err
+	}
+	text := "resolved the incident"
+	if len(args) > 0 {
+		text += ": " + strings.Join(args, " ")
+	}
+	inc.Timeline = append(inc.Timeline, timelineEntry{TimestampSecs: now.Unix(), UserID: userID, Text: text})
+	inc.Resolved = true
+	if err = s.editStatus(cli, roomID, inc); err != nil {
+		return nil, err
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id":       s.ServiceID(),
+		"room_id":          inc.ParentRoomID,
+		"incident_room_id": roomID,
+	})
+	if _, err = cli.SendMessageEvent(inc.ParentRoomID, mevt.EventMessage, inc.summary(now)); err != nil {
+		// Resolve the incident anyway, the timeline is still in the incident room
+		logger.WithError(err).Error("Failed to post incident summary")
+	}
+	if err = database.GetServiceDB().DeleteServiceState(s.ServiceID(), "incident "+roomID.String()); err != nil {
+		logger.WithError(err).Error("Failed to forget resolved incident")
+	}
+	logger.Info("Resolved incident")
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Resolved the incident after %s", formatDuration(now.Sub(inc.declared()))),
+	}, nil
+}
+
+// editStatus replaces the incident's pinned status message with its current status.
+func (s *Service) editStatus(cli types.MatrixClient, roomID id.RoomID, inc *incident) error {
+	content, err := notify.EditContent(inc.StatusEventID, inc.statusMessage())
+	if err == nil {
+		_, err = cli.SendMessageEvent(roomID, mevt.EventMessage, content)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to update the status message: %s", err)
+	}
+	return nil
+}
+
+func (inc *incident) declared() time.Time {
+	return time.Unix(inc.DeclaredTimestampSecs, 0)
+}
+
+// statusMessage is the message pinned in the incident room, with the latest update.
+func (inc *incident) statusMessage() mevt.MessageEventContent {
+	heading := "🚨 " + inc.Severity + " incident"
+	if inc.Resolved {
+		heading = "✅ Resolved " + inc.Severity + " incident"
+	}
+	declared := fmt.Sprintf("Declared by %s at %s", inc.DeclaredBy, formatTime(inc.declared()))
+	body := fmt.Sprintf("%s: %s\n%s", heading, inc.Title, declared)
+	formatted := fmt.Sprintf("<b>%s</b>: %s<br>%s", html.EscapeString(heading), html.EscapeString(inc.Title), html.EscapeString(declared))
+	if len(inc.Timeline) > 1 {
+		latest := inc.Timeline[len(inc.Timeline)-1]
+		body += "\nLatest update: " + latest.String()
+		formatted += "<br>Latest update: " + html.EscapeString(latest.String())
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          body,
+		Format:        mevt.FormatHTML,
+		FormattedBody: formatted,
+	}
+}
+
+// summary is the message posted to the parent room when the incident is resolved.
+func (inc *incident) summary(now time.Time) mevt.MessageEventContent {
+	heading := fmt.Sprintf("✅ Resolved %s incident: %s (lasted %s)", inc.Severity, inc.Title, formatDuration(now.Sub(inc.declared())))
+	lines := []string{heading, "Timeline:"}
+	items := make([]string, 0, len(inc.Timeline))
+	for _, e := range inc.Timeline {
+		lines = append(lines, " - "+e.String())
+		items = append(items, "<li>"+html.EscapeString(e.String())+"</li>")
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf("<b>%s</b><br>Timeline:<ul>%s</ul>", html.EscapeString(heading), strings.Join(items, "")),
+	}
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("Mon 2 Jan 15:04 MST")
+}
+
+// formatDuration returns the duration to the minute, e.g. "1h25m".
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return "less than a minute"
+	}
+	return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+}
+
+// loadIncident returns the open incident which the room is for.
+func (s *Service) loadIncident(roomID id.RoomID) (*incident, error) {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "incident "+roomID.String())
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("This room isn't for an open incident")
+	} else if err != nil {
+		return nil, err
+	}
+	inc := &incident{}
+	err = json.Unmarshal(stateJSON, inc)
+	return inc, err
+}
+
+func (s *Service) storeIncident(roomID id.RoomID, inc *incident) error {
+	stateJSON, err := json.Marshal(inc)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "incident "+roomID.String(), stateJSON)
+}
+
+// Register makes sure that the rooms and severities are configured, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	for i, sev := range s.Severities {
+		if sev == "" || strings.ContainsAny(sev, " \t\n") {
+			return fmt.Errorf("Severity '%s' must be a single word", sev)
+		}
+		for _, other := range s.Severities[:i] {
+			if strings.EqualFold(sev, other) {
+				return fmt.Errorf("Severity '%s' is listed twice", sev)
+			}
+		}
+	}
+	for roomID, roomConfig := range s.Rooms {
+		for _, userID := range roomConfig.OnCall {
+			if _, _, err := userID.Parse(); err != nil {
+				return fmt.Errorf("On-call '%s' of room %s isn't a user ID", userID, roomID)
+			}
+		}
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package incident
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestIncident(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+
+	var sent, actions []string
+	var created mautrix.ReqCreateRoom
+	events := 0
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		parts := strings.Split(req.URL.Path, "/")
+		var body []byte
+		if req.Body != nil {
+			body, _ = ioutil.ReadAll(req.Body)
+		}
+		resBody := `{}`
+		switch {
+		case strings.Contains(req.URL.Path, "/join"):
+		case strings.HasSuffix(req.URL.Path, "/createRoom"):
+			if err := json.Unmarshal(body, &created); err != nil {
+				t.Fatalf("Failed to decode room creation: %s", err)
+			}
+			resBody = `{"room_id":"!incident:hyrule"}`
+		case strings.Contains(req.URL.Path, "/send/m.room.message/"):
+			var msg struct {
+				mevt.MessageEventContent
+				NewContent *mevt.MessageEventContent `json:"m.new_content"`
+			}
+			if err := json.Unmarshal(body, &msg); err != nil {
+				t.Fatalf("Failed to decode message: %s", err)
+			}
+			if msg.NewContent != nil {
+				sent = append(sent, fmt.Sprintf("%s edit %s: %s", parts[5], msg.RelatesTo.EventID, msg.NewContent.Body))
+			} else {
+				sent = append(sent, parts[5]+" "+msg.Body)
+			}
+			events++
+			resBody = fmt.Sprintf(`{"event_id":"$%d:hyrule"}`, events)
+		default:
+			actions = append(actions, fmt.Sprintf("%s %s %s", parts[5], strings.Join(parts[6:], "/"), body))
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(resBody)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"rooms": {
+			"!castle:hyrule": {"on_call": ["@impa:hyrule", "@link:hyrule", "@neb:hyrule"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create incident service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register incident service: ", err)
+	}
+	s := srv.(*Service)
+	declared := time.Date(2021, 6, 7, 9, 0, 0, 0, time.UTC)
+
+	if _, err = s.cmdDeclare(matrixCli, "!castle:hyrule", "@zelda:hyrule", []string{"sev9", "Ganon"}, declared); err == nil {
+		t.Error("Expected an unknown severity to be refused")
+	}
+	if _, err = s.cmdDeclare(matrixCli, "!termina:hyrule", "@zelda:hyrule", []string{"sev1", "Ganon"}, declared); err == nil {
+		t.Error("Expected declaring in an unconfigured room to be refused")
+	}
+	res, err := s.cmdDeclare(matrixCli, "!castle:hyrule", "@zelda:hyrule", strings.Fields("sev1 Ganon has taken the castle"), declared)
+	if err != nil {
+		t.Fatal("Failed to declare incident: ", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "🚨 @zelda:hyrule declared a SEV1 incident: Ganon has taken the castle\n"+
+		"The incident is being handled in !incident:hyrule" {
+		t.Errorf("Bad declaration: %q", got)
+	}
+	if created.Name != "SEV1: Ganon has taken the castle" || fmt.Sprint(created.Invite) != "[@zelda:hyrule @impa:hyrule @link:hyrule]" {
+		t.Errorf("Bad incident room: %+v", created)
+	}
+
+	if _, err = s.cmdUpdate(matrixCli, "!incident:hyrule", "@impa:hyrule", strings.Fields("Evacuating the town"), declared.Add(10*time.Minute)); err != nil {
+		t.Fatal("Failed to update incident: ", err)
+	}
+	if _, err = s.cmdUpdate(matrixCli, "!castle:hyrule", "@impa:hyrule", strings.Fields("Wrong room"), declared); err == nil {
+		t.Error("Expected updating outside an incident room to be refused")
+	}
+	res, err = s.cmdResolve(matrixCli, "!incident:hyrule", "@link:hyrule", strings.Fields("Ganon is sealed"), declared.Add(85*time.Minute))
+	if err != nil {
+		t.Fatal("Failed to resolve incident: ", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "Resolved the incident after 1h25m" {
+		t.Errorf("Bad resolution: %q", got)
+	}
+	if _, err = s.cmdResolve(matrixCli, "!incident:hyrule", "@link:hyrule", nil, declared.Add(90*time.Minute)); err == nil {
+		t.Error("Expected resolving a resolved incident to be refused")
+	}
+
+	wantSent := []string{
+		"!incident:hyrule 🚨 SEV1 incident: Ganon has taken the castle\nDeclared by @zelda:hyrule at Mon 7 Jun 09:00 UTC",
+		"!incident:hyrule edit $1:hyrule: 🚨 SEV1 incident: Ganon has taken the castle\nDeclared by @zelda:hyrule at Mon 7 Jun 09:00 UTC\n" +
+			"Latest update: Mon 7 Jun 09:10 UTC @impa:hyrule: Evacuating the town",
+		"!incident:hyrule edit $1:hyrule: ✅ Resolved SEV1 incident: Ganon has taken the castle\nDeclared by @zelda:hyrule at Mon 7 Jun 09:00 UTC\n" +
+			"Latest update: Mon 7 Jun 10:25 UTC @link:hyrule: resolved the incident: Ganon is sealed",
+		"!castle:hyrule ✅ Resolved SEV1 incident: Ganon has taken the castle (lasted 1h25m)\nTimeline:\n" +
+			" - Mon 7 Jun 09:00 UTC @zelda:hyrule: declared the incident\n" +
+			" - Mon 7 Jun 09:10 UTC @impa:hyrule: Evacuating the town\n" +
+			" - Mon 7 Jun 10:25 UTC @link:hyrule: resolved the incident: Ganon is sealed",
+	}
+	if strings.Join(sent, "\n\n") != strings.Join(wantSent, "\n\n") {
+		t.Errorf("Bad messages:\ngot  %q\nwant %q", sent, wantSent)
+	}
+	wantActions := []string{
+		`!incident:hyrule state/m.room.pinned_events/ {"pinned":["$1:hyrule"]}`,
+	}
+	if strings.Join(actions, "\n") != strings.Join(wantActions, "\n") {
+		t.Errorf("Bad actions:\ngot  %q\nwant %q", actions, wantActions)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"rooms": {"!castle:hyrule": {"on_call": ["impa"]}}}`,
+		`{"rooms": {"!castle:hyrule": {}}, "severities": ["high", "very high"]}`,
+		`{"rooms": {"!castle:hyrule": {}}, "severities": ["high", "HIGH"]}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create incident service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// Package ipinfo implements a Service which looks up who owns IP addresses and where they are.
+package ipinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the IP info service
+const ServiceType = "ipinfo"
+
+// The provider APIs. Overridden by tests.
+var (
+	ipinfoURL = "https://ipinfo.io/"
+	ipAPIURL  = "http://ip-api.com/json/"
+)
+
+var httpClient = &http.Client{}
+
+// DNS lookups, overridden by tests
+var (
+	lookupIP   = net.LookupIP
+	lookupAddr = net.LookupAddr
+)
+
+// Service contains the Config fields for the IP info service.
+//
+// This service looks up IP addresses: "!ip 8.8.8.8" responds with the AS number, organisation,
+// location and reverse DNS name of the address. Hostnames are resolved first.
+//
+// "!ip me" looks up the public IP address of the Go-NEB host. It is disabled by default because it
+// reveals where Go-NEB runs to everyone in the room.
+//
+// The lookups use either ipinfo.io, which needs an api_token for more than a few requests a day,
+// or ip-api.com, which is free for non-commercial use.
+//
+// Example JSON request:
+//   {
+//       "provider": "ipinfo",
+//       "api_token": "1a2b3c4d5e6f7a",
+//       "allow_me": false
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The lookup provider: "ipinfo" or "ip-api". Defaults to "ipinfo".
+	Provider string `json:"provider"`
+	// Optional. The ipinfo.io API token.
+	APIToken string `json:"api_token"`
+	// Optional. Allow "!ip me" to look up the Go-NEB host's address. Defaults to false.
+	AllowMe bool `json:"allow_me"`
+}
+
+// ipResult is what the providers know about an address.
+type ipResult struct {
+	IP       string
+	Hostname string
+	// The AS number and organisation, e.g. "AS15169 Google LLC"
+	ASOrg   string
+	City    string
+	Region  string
+	Country string
+}
+
+// Commands supported:
+//    !ip address_or_hostname
+// Responds with the ASN, organisation, location and reverse DNS of the address.
+//    !ip me
+// Responds with the same for the Go-NEB host, if allowed.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"ip"},
+			Arguments: []string{"address"},
+			Help:      "Look up an IP address",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				if len(args) != 1 {
+					return nil, fmt.Errorf("Usage: !ip address_or_hostname")
+				}
+				return s.cmdIP(args[0])
+			},
+		},
+	}
+}
+
+func (s *Service) cmdIP(arg string) (interface{}, error) {
+	var ip string
+	if strings.EqualFold(arg, "me") {
+		if !s.AllowMe {
+			return nil, fmt.Errorf("Looking up the address of Go-NEB is disabled")
+		}
+	} else {
+		addr := net.ParseIP(arg)
+		if addr == nil {
+			addrs, err := lookupIP(arg)
+			if err != nil || len(addrs) == 0 {
+				return nil, fmt.Errorf("'%s' is not an IP address or a hostname which resolves", arg)
+			}
+			addr = addrs[0]
+		}
+		if !isPublic(addr) {
+			return nil, fmt.Errorf("%s is not a public address", addr)
+		}
+		ip = addr.String()
+	}
+
+	var res *ipResult
+	var err error
+	if s.Provider == "ip-api" {
+		res, err = s.lookupIPAPI(ip)
+	} else {
+		res, err = s.lookupIPInfo(ip)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up %s: %s", arg, err)
+	}
+	if res.Hostname == "" {
+		if names, err := lookupAddr(res.IP); err == nil && len(names) > 0 {
+			res.Hostname = strings.TrimSuffix(names[0], ".")
+		}
+	}
+	return resultMessage(res), nil
+}
+
+// isPublic returns false for loopback, private, link-local and other addresses which providers
+// don't know anything about.
+func isPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func resultMessage(res *ipResult) *mevt.MessageEventContent {
+	title := res.IP
+	if res.Hostname != "" {
+		title += " (" + res.Hostname + ")"
+	}
+	lines := []string{title}
+	if res.ASOrg != "" {
+		lines = append(lines, res.ASOrg)
+	}
+	var place []string
+	for _, p := range []string{res.City, res.Region, res.Country} {
+		if p != "" {
+			place = append(place, p)
+		}
+	}
+	if len(place) > 0 {
+		lines = append(lines, strings.Join(place, ", "))
+	}
+	htmlLines := make([]string, len(lines))
+	for i, l := range lines {
+		htmlLines[i] = html.EscapeString(l)
+	}
+	htmlLines[0] = "<strong>" + htmlLines[0] + "</strong>"
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: strings.Join(htmlLines, "<br>"),
+	}
+}
+
+// lookupIPInfo looks up the address with ipinfo.io. An empty address looks up the Go-NEB host.
+func (s *Service) lookupIPInfo(ip string) (*ipResult, error) {
+	u := ipinfoURL + url.PathEscape(ip)
+	if ip != "" {
+		u += "/"
+	}
+	u += "json"
+	if s.APIToken != "" {
+		u += "?token=" + url.QueryEscape(s.APIToken)
+	}
+	var r struct {
+		IP       string `json:"ip"`
+		Hostname string `json:"hostname"`
+		City     string `json:"city"`
+		Region   string `json:"region"`
+		Country  string `json:"country"`
+		Org      string `json:"org"`
+		Error    *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := getJSON(u, &r); err != nil {
+		return nil, err
+	}
+	if r.Error != nil {
+		return nil, fmt.Errorf("%s", r.Error.Message)
+	}
+	return &ipResult{
+		IP:       r.IP,
+		Hostname: r.Hostname,
+		ASOrg:    r.Org,
+		City:     r.City,
+		Region:   r.Region,
+		Country:  r.Country,
+	}, nil
+}
+
+// lookupIPAPI looks up the address with ip-api.com. An empty address looks up the Go-NEB host.
+func (s *Service) lookupIPAPI(ip string) (*ipResult, error) {
+	u := ipAPIURL + url.PathEscape(ip) + "?fields=status,message,query,reverse,as,city,regionName,country"
+	var r struct {
+		Status     string `json:"status"`
+		Message    string `json:"message"`
+		Query      string `json:"query"`
+		Reverse    string `json:"reverse"`
+		AS         string `json:"as"`
+		City       string `json:"city"`
+		RegionName string `json:"regionName"`
+		Country    string `json:"country"`
+	}
+	if err := getJSON(u, &r); err != nil {
+		return nil, err
+	}
+	if r.Status != "success" {
+		return nil, fmt.Errorf("%s", r.Message)
+	}
+	return &ipResult{
+		IP:       r.Query,
+		Hostname: r.Reverse,
+		ASOrg:    r.AS,
+		City:     r.City,
+		Region:   r.RegionName,
+		Country:  r.Country,
+	}, nil
+}
+
+func getJSON(u string, out interface{}) error {
+	res, err := httpClient.Get(u)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	// Both providers describe errors in the body
+	if err = json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("Request error: %d, %s", res.StatusCode, err)
+	}
+	return nil
+}
+
+// Register makes sure that the provider is known.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.Provider != "" && s.Provider != "ipinfo" && s.Provider != "ip-api" {
+		return fmt.Errorf("Unknown provider '%s': must be ipinfo or ip-api", s.Provider)
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package ipinfo
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestLookups(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch req.URL.String() {
+		case "https://ipinfo.io/8.8.8.8/json?token=secret":
+			body = `{"ip":"8.8.8.8","hostname":"dns.google","city":"Mountain View","region":"California",
+				"country":"US","org":"AS15169 Google LLC"}`
+		case "https://ipinfo.io/json?token=secret":
+			body = `{"ip":"203.0.113.7","country":"GB"}`
+		case "http://ip-api.com/json/1.1.1.1?fields=status,message,query,reverse,as,city,regionName,country":
+			body = `{"status":"success","query":"1.1.1.1","as":"AS13335 Cloudflare, Inc.","city":"Sydney",
+				"regionName":"New South Wales","country":"Australia"}`
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+	lookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "dns.google":
+			return []net.IP{net.ParseIP("8.8.8.8")}, nil
+		case "localhost":
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+	lookupAddr = func(addr string) ([]string, error) {
+		if addr == "1.1.1.1" {
+			return []string{"one.one.one.one."}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	createService := func(config string) *Service {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create ipinfo service: ", err)
+		}
+		if err = srv.Register(nil, nil); err != nil {
+			t.Fatal("Failed to register ipinfo service: ", err)
+		}
+		return srv.(*Service)
+	}
+	ipinfo := createService(`{"api_token":"secret"}`)
+	ipAPI := createService(`{"provider":"ip-api"}`)
+
+	testCases := []struct {
+		s    *Service
+		arg  string
+		want string
+	}{
+		{ipinfo, "8.8.8.8", "8.8.8.8 (dns.google)\nAS15169 Google LLC\nMountain View, California, US"},
+		{ipinfo, "dns.google", "8.8.8.8 (dns.google)\nAS15169 Google LLC\nMountain View, California, US"},
+		{ipAPI, "1.1.1.1", "1.1.1.1 (one.one.one.one)\nAS13335 Cloudflare, Inc.\nSydney, New South Wales, Australia"},
+	}
+	for _, tc := range testCases {
+		res, err := tc.s.cmdIP(tc.arg)
+		if err != nil {
+			t.Errorf("!ip %s failed: %s", tc.arg, err)
+		} else if body := res.(*mevt.MessageEventContent).Body; body != tc.want {
+			t.Errorf("!ip %s = %q, want %q", tc.arg, body, tc.want)
+		}
+	}
+
+	for _, arg := range []string{"me", "localhost", "192.168.1.1", "nowhere.invalid"} {
+		if _, err := ipinfo.cmdIP(arg); err == nil {
+			t.Errorf("Expected !ip %s to fail", arg)
+		}
+	}
+	ipinfo.AllowMe = true
+	if res, err := ipinfo.cmdIP("me"); err != nil || res.(*mevt.MessageEventContent).Body != "203.0.113.7\nGB" {
+		t.Errorf("Bad !ip me: %+v, %v", res, err)
+	}
+}
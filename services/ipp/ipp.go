@@ -0,0 +1,344 @@
+// Package ipp implements a Service which prints documents posted in rooms on IPP and CUPS printers.
+package ipp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the IPP service
+const ServiceType = "ipp"
+
+const (
+	// The largest document which is downloaded by default, in bytes
+	defaultMaxFileSize = 20 * 1024 * 1024
+	// The most copies which can be asked for
+	maxCopies = 20
+)
+
+// The document formats which are printed. Printers which can't print them themselves rely on
+// CUPS to convert them.
+var printableFormats = map[string]bool{
+	"application/pdf": true,
+	"image/jpeg":      true,
+	"image/png":       true,
+}
+
+var httpClient = &http.Client{Timeout: 2 * time.Minute}
+
+// Service contains the Config fields for the IPP service.
+//
+// Reply to a PDF, JPEG or PNG with "!print" to print it. The number of copies and "duplex" or
+// "simplex" can be given, e.g. "!print 2 duplex", and default to one copy on one side of the
+// page. The printer's job ID is replied with, and "!print status <job>" shows how the job is
+// getting on. Only the allowed users can print.
+//
+// The printer is an IPP printer, e.g. "ipp://printer.local/ipp/print", or a CUPS queue, e.g.
+// "ipps://cups.example.com/printers/Office" with the username and password of a CUPS user.
+//
+// Example JSON request:
+//   {
+//       "printer_url": "ipp://cups.local/printers/Office",
+//       "allowed_users": ["@alice:localhost", "@bob:localhost"],
+//       "max_file_size": 10485760
+//   }
+type Service struct {
+	types.DefaultService
+	// The printer's ipp://, ipps://, http:// or https:// URL.
+	PrinterURL string `json:"printer_url"`
+	// Optional. The username and password to print with, if the printer needs them.
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// The users who can print.
+	AllowedUsers []id.UserID `json:"allowed_users"`
+	// Optional. The largest document to print, in bytes. Defaults to 20 MB.
+	MaxFileSize int64 `json:"max_file_size"`
+}
+
+// printOptions are the job attributes asked for in !print.
+type printOptions struct {
+	copies int
+	// "one-sided" or "two-sided-long-edge"
+	sides string
+}
+
+func (o *printOptions) String() string {
+	s := "1 copy"
+	if o.copies > 1 {
+		s = fmt.Sprintf("%d copies", o.copies)
+	}
+	if o.sides == "two-sided-long-edge" {
+		s += ", duplex"
+	}
+	return s
+}
+
+// Commands supported:
+//    !print [copies] [duplex|simplex]
+// Sent in reply to a PDF or image, prints it.
+//    !print status job
+// Responds with the state of the print job.
+func (s *Service) Commands(client types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"print", "status"},
+			Arguments: []string{"job"},
+			Help:      "Show the state of a print job",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdStatus(userID, args)
+			},
+		},
+		{
+			Path:      []string{"print"},
+			Arguments: []string{"[copies]", "[duplex|simplex]"},
+			Help:      "Reply to a PDF or image to print it",
+			EventCommand: func(evt *mevt.Event, args []string) (interface{}, error) {
+				return s.cmdPrint(client, evt, args)
+			},
+		},
+	}
+}
+
+func (s *Service) isAllowed(userID id.UserID) bool {
+	for _, allowed := range s.AllowedUsers {
+		if allowed == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePrintOptions(args []string) (*printOptions, error) {
+	opts := &printOptions{copies: 1, sides: "one-sided"}
+	for _, arg := range args {
+		switch strings.ToLower(arg) {
+		case "duplex":
+			opts.sides = "two-sided-long-edge"
+		case "simplex":
+			opts.sides = "one-sided"
+		default:
+			copies, err := strconv.Atoi(arg)
+			if err != nil || copies < 1 || copies > maxCopies {
+				return nil, fmt.Errorf("Usage: !print [copies] [duplex|simplex], with 1 to %d copies", maxCopies)
+			}
+			opts.copies = copies
+		}
+	}
+	return opts, nil
+}
+
+func (s *Service) cmdPrint(client types.MatrixClient, evt *mevt.Event, args []string) (interface{}, error) {
+	if !s.isAllowed(evt.Sender) {
+		return nil, fmt.Errorf("You aren't allowed to print")
+	}
+	opts, err := parsePrintOptions(args)
+	if err != nil {
+		return nil, err
+	}
+	replyTo := evt.Content.AsMessage().GetReplyTo()
+	if replyTo == "" {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Reply to a PDF or image with !print to print it.",
+		}, nil
+	}
+	evCli, canGet := client.(types.EventGetter)
+	dlCli, canDownload := client.(types.MediaDownloader)
+	if !canGet || !canDownload {
+		return nil, fmt.Errorf("Unable to download documents with this client")
+	}
+	original, err := evCli.GetEvent(evt.RoomID, replyTo)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch the document message: %s", err)
+	}
+	original.Content.ParseRaw(mevt.EventMessage)
+	msg := original.Content.AsMessage()
+	if msg.MsgType != mevt.MsgFile && msg.MsgType != mevt.MsgImage {
+		return nil, fmt.Errorf("Only PDFs and images can be printed")
+	}
+	if msg.URL == "" {
+		return nil, fmt.Errorf("Encrypted documents can't be printed")
+	}
+	maxSize := s.maxFileSize()
+	info := msg.GetInfo()
+	if info != nil && int64(info.Size) > maxSize {
+		return nil, fmt.Errorf("Document is larger than %d bytes", maxSize)
+	}
+	mxcURL, err := msg.URL.Parse()
+	if err != nil {
+		return nil, err
+	}
+	data, err := dlCli.Download(mxcURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download the document: %s", err)
+	}
+	defer data.Close()
+	// The size in the event is only a hint, so don't trust it
+	document, err := ioutil.ReadAll(io.LimitReader(data, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download the document: %s", err)
+	}
+	if int64(len(document)) > maxSize {
+		return nil, fmt.Errorf("Document is larger than %d bytes", maxSize)
+	}
+	// Trust what the document looks like over what the event says it is
+	format := http.DetectContentType(document)
+	if !printableFormats[format] {
+		return nil, fmt.Errorf("Only PDFs, JPEGs and PNGs can be printed, not %s", format)
+	}
+
+	name := msg.Body
+	if name == "" {
+		name = "Document"
+	}
+	jobID, state, err := s.printJob(document, format, name, evt.Sender, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to print %s: %s", name, err)
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("🖨️ Printing %s (%s): job %d is %s", name, opts, jobID, state),
+	}, nil
+}
+
+func (s *Service) cmdStatus(userID id.UserID, args []string) (interface{}, error) {
+	if !s.isAllowed(userID) {
+		return nil, fmt.Errorf("You aren't allowed to print")
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !print status job")
+	}
+	jobID, err := strconv.Atoi(args[0])
+	if err != nil || jobID < 1 {
+		return nil, fmt.Errorf("Usage: !print status job")
+	}
+	state, reasons, err := s.jobState(jobID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the state of job %d: %s", jobID, err)
+	}
+	body := fmt.Sprintf("Job %d is %s", jobID, state)
+	if len(reasons) > 0 {
+		body += " (" + strings.Join(reasons, ", ") + ")"
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}, nil
+}
+
+// printJob sends the document to the printer, and returns its job ID and state.
+func (s *Service) printJob(document []byte, format, name string, userID id.UserID, opts *printOptions) (int, string, error) {
+	req := newIPPRequest(opPrintJob, s.printerURI())
+	req.addString(tagNameWithoutLanguage, "requesting-user-name", userID.String())
+	req.addString(tagNameWithoutLanguage, "job-name", name)
+	req.addString(tagMimeMediaType, "document-format", format)
+	req.startGroup(tagJobAttributes)
+	req.addInteger(tagInteger, "copies", opts.copies)
+	req.addString(tagKeyword, "sides", opts.sides)
+	res, err := s.sendIPP(req.body(document))
+	if err != nil {
+		return 0, "", err
+	}
+	if !res.ok() {
+		return 0, "", fmt.Errorf("%s", res.statusMessage())
+	}
+	jobID, ok := res.integer("job-id")
+	if !ok {
+		return 0, "", fmt.Errorf("The printer didn't say what the job's ID is")
+	}
+	return jobID, stateName(res), nil
+}
+
+// jobState returns the state of the job, and the reasons for it.
+func (s *Service) jobState(jobID int, userID id.UserID) (string, []string, error) {
+	req := newIPPRequest(opGetJobAttributes, s.printerURI())
+	req.addInteger(tagInteger, "job-id", jobID)
+	req.addString(tagNameWithoutLanguage, "requesting-user-name", userID.String())
+	req.addString(tagKeyword, "requested-attributes", "job-state", "job-state-reasons")
+	res, err := s.sendIPP(req.body(nil))
+	if err != nil {
+		return "", nil, err
+	}
+	if !res.ok() {
+		if res.status == 0x0406 {
+			return "", nil, fmt.Errorf("No such job")
+		}
+		return "", nil, fmt.Errorf("%s", res.statusMessage())
+	}
+	var reasons []string
+	for _, reason := range res.strings("job-state-reasons") {
+		if reason != "none" {
+			reasons = append(reasons, reason)
+		}
+	}
+	return stateName(res), reasons, nil
+}
+
+func stateName(res *ippResponse) string {
+	state, _ := res.integer("job-state")
+	if name, ok := jobStates[state]; ok {
+		return name
+	}
+	return "pending"
+}
+
+// printerURI returns the printer's URL as an ipp:// or ipps:// URI, which printers identify
+// themselves by.
+func (s *Service) printerURI() string {
+	u, err := url.Parse(s.PrinterURL)
+	if err != nil {
+		return s.PrinterURL
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ipp"
+	case "https":
+		u.Scheme = "ipps"
+	}
+	return u.String()
+}
+
+func (s *Service) maxFileSize() int64 {
+	if s.MaxFileSize <= 0 {
+		return defaultMaxFileSize
+	}
+	return s.MaxFileSize
+}
+
+// Register makes sure that the printer and allowed users are configured.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	u, err := url.Parse(s.PrinterURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("Bad printer_url '%s'", s.PrinterURL)
+	}
+	switch u.Scheme {
+	case "ipp", "ipps", "http", "https":
+	default:
+		return fmt.Errorf("Bad printer_url '%s': must be an ipp, ipps, http or https URL", s.PrinterURL)
+	}
+	if len(s.AllowedUsers) == 0 {
+		return fmt.Errorf("At least one allowed user is required")
+	}
+	if s.MaxFileSize < 0 {
+		return fmt.Errorf("max_file_size must not be negative")
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
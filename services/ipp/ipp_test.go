@@ -0,0 +1,226 @@
+package ipp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const pdf = "%PDF-1.4\nA map of Hyrule"
+
+// matrixClient returns a client which serves a file message with the given type, and the file.
+func matrixClient(msgType string, document string) *mautrix.Client {
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/event/$document") {
+			return &http.Response{
+				StatusCode: 200,
+				Body: ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`{
+					"type":"m.room.message","event_id":"$document","room_id":"!office:hyrule","sender":"@impa:hyrule",
+					"content":{"msgtype":"%s","body":"map.pdf","url":"mxc://hyrule/map","info":{"size":%d}}}`, msgType, len(document)))),
+			}, nil
+		} else if strings.Contains(req.URL.Path, "_matrix/media/r0/download/hyrule/map") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(document)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+	return matrixCli
+}
+
+func printCommand(t *testing.T, sender id.UserID, replyTo bool) *mevt.Event {
+	raw := map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "!print",
+	}
+	if replyTo {
+		raw["m.relates_to"] = map[string]interface{}{
+			"m.in_reply_to": map[string]interface{}{"event_id": "$document"},
+		}
+	}
+	content := mevt.Content{Raw: raw}
+	if veryRaw, err := content.MarshalJSON(); err != nil {
+		t.Fatalf("Error marshalling JSON: %s", err)
+	} else {
+		content.VeryRaw = veryRaw
+	}
+	content.ParseRaw(mevt.EventMessage)
+	return &mevt.Event{
+		Type:    mevt.EventMessage,
+		Sender:  sender,
+		RoomID:  "!office:hyrule",
+		Content: content,
+	}
+}
+
+// ippPrinter returns a client which answers IPP requests like a printer, recording the requests.
+func ippPrinter(t *testing.T, requests *[]*ippResponse, documents *[]string) *http.Client {
+	return &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "http://cups.hyrule:631/printers/Office" || req.Header.Get("Content-Type") != "application/ipp" {
+			return nil, fmt.Errorf("Bad request: %s %v", req.URL.String(), req.Header)
+		}
+		if user, pass, _ := req.BasicAuth(); user != "impa" || pass != "sheikah" {
+			return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewBufferString(""))}, nil
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		// Requests are laid out like responses, with the operation in place of the status
+		parsed, err := parseIPPResponse(body)
+		if err != nil {
+			t.Fatalf("Bad IPP request: %s", err)
+		}
+		*requests = append(*requests, parsed)
+		if i := bytes.Index(body, []byte("%PDF")); i >= 0 {
+			*documents = append(*documents, string(body[i:]))
+		}
+
+		res := newIPPRequest(0x0000, "")
+		res.startGroup(tagJobAttributes)
+		switch parsed.status {
+		case opPrintJob:
+			res.addInteger(tagInteger, "job-id", 42)
+			res.addInteger(tagEnum, "job-state", 3)
+		case opGetJobAttributes:
+			if jobID, _ := parsed.integer("job-id"); jobID != 42 {
+				res = newIPPRequest(0x0406, "")
+				break
+			}
+			res.addInteger(tagEnum, "job-state", 6)
+			res.addString(tagKeyword, "job-state-reasons", "media-empty", "printer-stopped")
+		}
+		resBody, _ := ioutil.ReadAll(res.body(nil))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(resBody)),
+		}, nil
+	})}
+}
+
+func createService(t *testing.T) *Service {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"printer_url": "ipp://cups.hyrule/printers/Office",
+		"username": "impa",
+		"password": "sheikah",
+		"allowed_users": ["@zelda:hyrule"]
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create ipp service: ", err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register ipp service: ", err)
+	}
+	return srv.(*Service)
+}
+
+func TestPrint(t *testing.T) {
+	var requests []*ippResponse
+	var documents []string
+	httpClient = ippPrinter(t, &requests, &documents)
+	s := createService(t)
+
+	res, err := s.cmdPrint(matrixClient("m.file", pdf), printCommand(t, "@zelda:hyrule", true), []string{"2", "duplex"})
+	if err != nil {
+		t.Fatalf("!print failed: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "🖨️ Printing map.pdf (2 copies, duplex): job 42 is pending" {
+		t.Errorf("Bad reply: %s", body)
+	}
+	if len(requests) != 1 || len(documents) != 1 || documents[0] != pdf {
+		t.Fatalf("Expected the document to be printed, got %d requests and %v", len(requests), documents)
+	}
+	req := requests[0]
+	if copies, _ := req.integer("copies"); copies != 2 {
+		t.Errorf("Bad copies: %d", copies)
+	}
+	for name, want := range map[string]string{
+		"printer-uri":          "ipp://cups.hyrule/printers/Office",
+		"requesting-user-name": "@zelda:hyrule",
+		"job-name":             "map.pdf",
+		"document-format":      "application/pdf",
+		"sides":                "two-sided-long-edge",
+	} {
+		if got := req.strings(name); len(got) != 1 || got[0] != want {
+			t.Errorf("Bad %s: got %v, want %s", name, got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		client *mautrix.Client
+		evt    *mevt.Event
+		args   []string
+	}{
+		// Not allowed to print
+		{matrixClient("m.file", pdf), printCommand(t, "@ganon:hyrule", true), nil},
+		// Bad options
+		{matrixClient("m.file", pdf), printCommand(t, "@zelda:hyrule", true), []string{"99"}},
+		{matrixClient("m.file", pdf), printCommand(t, "@zelda:hyrule", true), []string{"triplex"}},
+		// Not a PDF or image
+		{matrixClient("m.file", "PK\x03\x04 a zip file"), printCommand(t, "@zelda:hyrule", true), nil},
+		{matrixClient("m.text", pdf), printCommand(t, "@zelda:hyrule", true), nil},
+	} {
+		if _, err = s.cmdPrint(tc.client, tc.evt, tc.args); err == nil {
+			t.Errorf("Expected !print %v from %s to fail", tc.args, tc.evt.Sender)
+		}
+	}
+	if len(requests) != 1 {
+		t.Errorf("Expected nothing else to be printed, got %d requests", len(requests))
+	}
+
+	res, err = s.cmdPrint(matrixClient("m.file", pdf), printCommand(t, "@zelda:hyrule", false), nil)
+	if err != nil || !strings.HasPrefix(res.(*mevt.MessageEventContent).Body, "Reply to a PDF") {
+		t.Errorf("Expected to be told to reply to a document, got %v %v", res, err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	var requests []*ippResponse
+	var documents []string
+	httpClient = ippPrinter(t, &requests, &documents)
+	s := createService(t)
+
+	res, err := s.cmdStatus("@zelda:hyrule", []string{"42"})
+	if err != nil {
+		t.Fatalf("!print status failed: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "Job 42 is stopped (media-empty, printer-stopped)" {
+		t.Errorf("Bad status: %s", body)
+	}
+	if attrs := requests[0].strings("requested-attributes"); strings.Join(attrs, ",") != "job-state,job-state-reasons" {
+		t.Errorf("Bad requested-attributes: %v", attrs)
+	}
+	if _, err = s.cmdStatus("@zelda:hyrule", []string{"7"}); err == nil || !strings.Contains(err.Error(), "No such job") {
+		t.Errorf("Expected an unknown job to fail, got %v", err)
+	}
+	if _, err = s.cmdStatus("@ganon:hyrule", []string{"42"}); err == nil {
+		t.Errorf("Expected a user who isn't allowed to print to be refused")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"allowed_users": ["@zelda:hyrule"]}`,
+		`{"printer_url": "lpd://printer.hyrule/queue", "allowed_users": ["@zelda:hyrule"]}`,
+		`{"printer_url": "ipp://printer.hyrule/ipp/print"}`,
+		`{"printer_url": "ipp://printer.hyrule/ipp/print", "allowed_users": ["@zelda:hyrule"], "max_file_size": -1}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create ipp service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package ipp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// IPP operations, from RFC 8011
+const (
+	opPrintJob         = 0x0002
+	opGetJobAttributes = 0x0009
+)
+
+// IPP delimiter and value tags
+const (
+	tagOperationAttributes = 0x01
+	tagJobAttributes       = 0x02
+	tagEndOfAttributes     = 0x03
+	tagInteger             = 0x21
+	tagEnum                = 0x23
+	tagNameWithoutLanguage = 0x42
+	tagKeyword             = 0x44
+	tagURI                 = 0x45
+	tagCharset             = 0x47
+	tagNaturalLanguage     = 0x48
+	tagMimeMediaType       = 0x49
+)
+
+// The states of print jobs, from RFC 8011
+var jobStates = map[int]string{
+	3: "pending",
+	4: "held",
+	5: "printing",
+	6: "stopped",
+	7: "canceled",
+	8: "aborted",
+	9: "completed",
+}
+
+// The most of a response which is read. Responses only have the attributes of one job.
+const maxResponseSize = 1 << 20
+
+// ippRequest builds the body of an IPP request.
+type ippRequest struct {
+	buf bytes.Buffer
+}
+
+// newIPPRequest starts an IPP/1.1 request for the operation, with the operation attributes every
+// request needs.
+func newIPPRequest(operation uint16, printerURI string) *ippRequest {
+	r := &ippRequest{}
+	binary.Write(&r.buf, binary.BigEndian, uint16(0x0101))
+	binary.Write(&r.buf, binary.BigEndian, operation)
+	// Only one request is sent per connection, so the ID doesn't matter
+	binary.Write(&r.buf, binary.BigEndian, uint32(1))
+	r.buf.WriteByte(tagOperationAttributes)
+	r.add(tagCharset, "attributes-charset", []byte("utf-8"))
+	r.add(tagNaturalLanguage, "attributes-natural-language", []byte("en"))
+	r.add(tagURI, "printer-uri", []byte(printerURI))
+	return r
+}
+
+// add adds an attribute with the values to the current group.
+func (r *ippRequest) add(tag byte, name string, values ...[]byte) {
+	for i, value := range values {
+		r.buf.WriteByte(tag)
+		// Additional values of the same attribute have no name
+		if i > 0 {
+			name = ""
+		}
+		binary.Write(&r.buf, binary.BigEndian, uint16(len(name)))
+		r.buf.WriteString(name)
+		binary.Write(&r.buf, binary.BigEndian, uint16(len(value)))
+		r.buf.Write(value)
+	}
+}
+
+func (r *ippRequest) addString(tag byte, name string, values ...string) {
+	var raw [][]byte
+	for _, v := range values {
+		raw = append(raw, []byte(v))
+	}
+	r.add(tag, name, raw...)
+}
+
+func (r *ippRequest) addInteger(tag byte, name string, value int) {
+	raw := make([]byte, 4)
+	binary.BigEndian.PutUint32(raw, uint32(int32(value)))
+	r.add(tag, name, raw)
+}
+
+// startGroup starts a new group of attributes, e.g. the job attributes.
+func (r *ippRequest) startGroup(tag byte) {
+	r.buf.WriteByte(tag)
+}
+
+// body ends the attributes, and returns the request's body followed by the document, if any.
+func (r *ippRequest) body(document []byte) io.Reader {
+	r.buf.WriteByte(tagEndOfAttributes)
+	return io.MultiReader(&r.buf, bytes.NewReader(document))
+}
+
+// ippResponse is the status and attributes of an IPP response, keyed by name. Attributes in
+// different groups are merged, as responses only describe one printer or job.
+type ippResponse struct {
+	status     uint16
+	attributes map[string][][]byte
+}
+
+// ok returns whether the request succeeded, which it did if the status is 0x00XX.
+func (r *ippResponse) ok() bool {
+	return r.status < 0x0100
+}
+
+func (r *ippResponse) integer(name string) (int, bool) {
+	values := r.attributes[name]
+	if len(values) == 0 || len(values[0]) != 4 {
+		return 0, false
+	}
+	return int(int32(binary.BigEndian.Uint32(values[0]))), true
+}
+
+func (r *ippResponse) strings(name string) []string {
+	var values []string
+	for _, v := range r.attributes[name] {
+		values = append(values, string(v))
+	}
+	return values
+}
+
+// statusMessage returns what went wrong with a request which failed.
+func (r *ippResponse) statusMessage() string {
+	if msg := r.strings("status-message"); len(msg) > 0 {
+		return msg[0]
+	}
+	switch r.status {
+	case 0x0401:
+		return "forbidden"
+	case 0x0402, 0x0403:
+		return "not authorised"
+	case 0x0406:
+		return "printer not found"
+	case 0x040A:
+		return "document format not supported"
+	case 0x0506:
+		return "printer is busy"
+	case 0x0507:
+		return "printer is not accepting jobs"
+	}
+	return fmt.Sprintf("status 0x%04x", r.status)
+}
+
+// parseIPPResponse reads the status and attributes of an IPP response.
+func parseIPPResponse(data []byte) (*ippResponse, error) {
+	if len(data) < 9 {
+		return nil, fmt.Errorf("IPP response is too short")
+	}
+	res := &ippResponse{
+		status:     binary.BigEndian.Uint16(data[2:4]),
+		attributes: make(map[string][][]byte),
+	}
+	pos := 8
+	var name string
+	for pos < len(data) {
+		tag := data[pos]
+		pos++
+		if tag == tagEndOfAttributes {
+			return res, nil
+		}
+		// Other delimiters start groups
+		if tag < 0x10 {
+			continue
+		}
+		if pos+2 > len(data) {
+			break
+		}
+		nameLen := int(binary.BigEndian.Uint16(data[pos:]))
+		pos += 2
+		if pos+nameLen+2 > len(data) {
+			break
+		}
+		if nameLen > 0 {
+			name = string(data[pos : pos+nameLen])
+		}
+		pos += nameLen
+		valueLen := int(binary.BigEndian.Uint16(data[pos:]))
+		pos += 2
+		if pos+valueLen > len(data) {
+			break
+		}
+		res.attributes[name] = append(res.attributes[name], data[pos:pos+valueLen])
+		pos += valueLen
+	}
+	return nil, fmt.Errorf("IPP response is truncated")
+}
+
+// sendIPP sends the request to the printer, and returns the printer's response.
+func (s *Service) sendIPP(body io.Reader) (*ippResponse, error) {
+	req, err := http.NewRequest("POST", s.httpURL(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ipp")
+	if s.Username != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("The printer refused the username and password")
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseIPPResponse(data)
+}
+
+// httpURL returns the URL which IPP requests are posted to: the printer's URL with ipp:// as
+// http:// and ipps:// as https://, on port 631 unless it has another.
+func (s *Service) httpURL() string {
+	u, err := url.Parse(s.PrinterURL)
+	if err != nil {
+		return s.PrinterURL
+	}
+	switch u.Scheme {
+	case "ipp":
+		u.Scheme = "http"
+	case "ipps":
+		u.Scheme = "https"
+	default:
+		return s.PrinterURL
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "631")
+	}
+	return u.String()
+}
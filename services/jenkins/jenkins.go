@@ -0,0 +1,273 @@
+// Package jenkins implements a Service which sends notices into rooms when Jenkins builds start and
+// finish.
+package jenkins
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/templates"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Jenkins service.
+const ServiceType = "jenkins"
+
+// The biggest webhook payload which is read. Payloads can include the end of the build log.
+const maxPayloadSize = 5 * 1024 * 1024
+
+// The build phases which are announced. Jenkins also sends QUEUED, and FINALIZED after COMPLETED.
+const (
+	phaseStarted   = "STARTED"
+	phaseCompleted = "COMPLETED"
+)
+
+// What each build result is announced as, and its colour.
+var statuses = map[string]struct {
+	Text  string
+	Color string
+}{
+	"SUCCESS":   {"succeeded", "green"},
+	"FAILURE":   {"failed", "red"},
+	"UNSTABLE":  {"is unstable", "orange"},
+	"ABORTED":   {"was aborted", "gray"},
+	"NOT_BUILT": {"was not built", "gray"},
+}
+
+// Service contains the Config fields for the Jenkins service.
+//
+// This service will send notices into a Matrix room when builds of Jenkins jobs start and finish.
+// It requires a public domain which Jenkins can reach. Notices will be sent as the service user ID.
+//
+// Go-NEB can't set up Jenkins itself. Install the Notification plugin, and add an endpoint to each
+// job with the JSON format, the HTTP protocol, and the URL in webhook_url followed by "?token=" and
+// the token.
+//
+// Operators can change the notices with template overrides named "jenkins.started" and
+// "jenkins.completed" (see package "templates"), which are given the Notification plugin's
+// payload, e.g. {{.build.full_url}}.
+//
+// Example JSON request:
+//   {
+//       "token": "a long random string",
+//       "rooms": {
+//           "!ewfug483gsfe:localhost": {
+//               "jobs": {
+//                   "go-neb": {
+//                       "started": true
+//                   },
+//                   "release-*": {}
+//               }
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL to add as the jobs' notification endpoint. Populated by Go-NEB after Service
+	// registration.
+	WebhookURL string `json:"webhook_url"`
+	// Required. Go-NEB will only accept notifications with this token in their "token" query
+	// parameter, as Jenkins can't sign them.
+	Token string `json:"token"`
+	// A map from Matrix room ID to the Jenkins jobs to announce builds of.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is which builds are announced in a room.
+type RoomConfig struct {
+	// A map of job names, or patterns matching them like "release-*", to how their builds are
+	// announced.
+	Jobs map[string]JobConfig `json:"jobs"`
+}
+
+// JobConfig is how the builds of a job are announced.
+type JobConfig struct {
+	// Optional. Also announce when builds start, rather than only when they finish.
+	Started bool `json:"started"`
+}
+
+// notification is the payload which the Notification plugin sends.
+type notification struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Build       struct {
+		FullURL string `json:"full_url"`
+		Number  int    `json:"number"`
+		Phase   string `json:"phase"`
+		Status  string `json:"status"`
+		// Milliseconds. Only set once the build has completed.
+		Duration int64 `json:"duration"`
+		SCM      struct {
+			Branch string `json:"branch"`
+			Commit string `json:"commit"`
+		} `json:"scm"`
+	} `json:"build"`
+}
+
+// jobName is the name the job is announced with.
+func (n *notification) jobName() string {
+	if n.DisplayName != "" {
+		return n.DisplayName
+	}
+	return n.Name
+}
+
+// branch returns the branch which was built, without the remote, e.g. "main" rather than
+// "origin/main".
+func (n *notification) branch() string {
+	branch := strings.TrimPrefix(n.Build.SCM.Branch, "refs/heads/")
+	if i := strings.Index(branch, "/"); i >= 0 && strings.HasPrefix(branch, "origin/") {
+		branch = branch[i+1:]
+	}
+	return branch
+}
+
+// htmlMessage returns the notice for the build, coloured by how it went.
+func (n *notification) htmlMessage() string {
+	msg := fmt.Sprintf("[<u>%s</u>] build #%d", html.EscapeString(n.jobName()), n.Build.Number)
+	if branch := n.branch(); branch != "" {
+		msg += " of " + html.EscapeString(branch)
+	}
+	if n.Build.Phase == phaseStarted {
+		msg += " started"
+	} else {
+		status, ok := statuses[n.Build.Status]
+		if !ok {
+			status.Text = "finished"
+		}
+		if status.Color != "" {
+			msg += fmt.Sprintf(` <font color="%s">%s</font>`, status.Color, status.Text)
+		} else {
+			msg += " " + status.Text
+		}
+		if n.Build.Duration > 0 {
+			msg += " in " + (time.Duration(n.Build.Duration) * time.Millisecond).Round(time.Second).String()
+		}
+	}
+	if n.Build.FullURL != "" {
+		msg += " - " + html.EscapeString(n.Build.FullURL)
+	}
+	return msg
+}
+
+// OnReceiveWebhook receives notifications from the Jenkins Notification plugin and sends notices
+// about them into the rooms of their job.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	if s.Token == "" || subtle.ConstantTimeCompare([]byte(req.URL.Query().Get("token")), []byte(s.Token)) != 1 {
+		log.WithField("service_id", s.ServiceID()).Warn("Received Jenkins notification with a bad token")
+		w.WriteHeader(403)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxPayloadSize))
+	if err != nil {
+		log.WithError(err).Error("Failed to read Jenkins notification")
+		w.WriteHeader(400)
+		return
+	}
+	var n notification
+	if err = json.Unmarshal(body, &n); err != nil {
+		log.WithError(err).Error("Jenkins sent an invalid JSON notification")
+		w.WriteHeader(400)
+		return
+	}
+	if n.Name == "" || n.Build.Number == 0 {
+		log.WithField("name", n.Name).Error("Jenkins notification is missing its job or build")
+		w.WriteHeader(400)
+		return
+	}
+	if n.Build.Phase != phaseStarted && n.Build.Phase != phaseCompleted {
+		w.WriteHeader(200)
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"job":   n.Name,
+		"build": n.Build.Number,
+		"phase": n.Build.Phase,
+	})
+
+	msg := utils.StrippedHTMLMessage(mevt.MsgNotice, n.htmlMessage())
+	var data map[string]interface{}
+	if err = json.Unmarshal(body, &data); err == nil {
+		msg = templates.Render("jenkins."+strings.ToLower(n.Build.Phase), data, msg)
+	}
+	for roomID, roomConfig := range s.Rooms {
+		jobConfig, ok := roomConfig.job(n.Name)
+		if !ok || (n.Build.Phase == phaseStarted && !jobConfig.Started) {
+			continue
+		}
+		logger.WithField("room_id", roomID).Print("Sending Jenkins notification to room")
+		if _, e := notify.Send(cli, s, notify.Notification{
+			RoomID:         roomID,
+			Content:        msg,
+			CorrelationKey: fmt.Sprintf("jenkins %s#%d", n.Name, n.Build.Number),
+		}); e != nil {
+			logger.WithError(e).WithField("room_id", roomID).Print(
+				"Failed to send Jenkins notification to room.")
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// job returns how the builds of the job are announced in the room, if they are.
+func (c *RoomConfig) job(name string) (JobConfig, bool) {
+	if jobConfig, ok := c.Jobs[name]; ok {
+		return jobConfig, true
+	}
+	for pattern, jobConfig := range c.Jobs {
+		if ok, _ := path.Match(pattern, name); ok {
+			return jobConfig, true
+		}
+	}
+	return JobConfig{}, false
+}
+
+// Register makes sure the Config information supplied is valid, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if s.Token == "" {
+		return fmt.Errorf("A token is required, as anyone could send notifications otherwise")
+	}
+	jobs := 0
+	for roomID, roomConfig := range s.Rooms {
+		for pattern := range roomConfig.Jobs {
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return fmt.Errorf("Job '%s' in room %s is not a valid job name or pattern", pattern, roomID)
+			}
+			jobs++
+		}
+	}
+	if jobs == 0 {
+		return fmt.Errorf("At least one job is required")
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package jenkins
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const buildNotification = `{
+	"name": "%s",
+	"display_name": "%s",
+	"url": "job/castle/",
+	"build": {
+		"full_url": "https://jenkins.hyrule/job/castle/31/",
+		"number": 31,
+		"phase": "%s",
+		"status": "%s",
+		"duration": %d,
+		"url": "job/castle/31/",
+		"scm": {"url": "https://git.hyrule/castle.git", "branch": "origin/main", "commit": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7"}
+	}
+}`
+
+func TestWebhook(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.String(), "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, fmt.Sprintf("%s %s", room, msg.Body))
+		if strings.Contains(msg.Body, "failed") && !strings.Contains(msg.FormattedBody, `<font color="red">failed</font>`) {
+			t.Errorf("Failure isn't coloured red: %s", msg.FormattedBody)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"token": "triforce",
+		"rooms": {
+			"!castle:hyrule": {
+				"jobs": {"castle": {"started": true}}
+			},
+			"!releases:hyrule": {
+				"jobs": {"release-*": {}}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create jenkins service: ", err)
+	}
+	s := srv.(*Service)
+
+	for _, tc := range []struct {
+		token string
+		body  string
+		code  int
+	}{
+		{"triforce", fmt.Sprintf(buildNotification, "castle", "Hyrule Castle", "QUEUED", "", 0), 200},
+		{"triforce", fmt.Sprintf(buildNotification, "castle", "Hyrule Castle", "STARTED", "", 0), 200},
+		{"triforce", fmt.Sprintf(buildNotification, "castle", "Hyrule Castle", "COMPLETED", "FAILURE", 95400), 200},
+		// Jenkins sends FINALIZED after COMPLETED, which would be announcing the build twice
+		{"triforce", fmt.Sprintf(buildNotification, "castle", "Hyrule Castle", "FINALIZED", "FAILURE", 95400), 200},
+		{"triforce", fmt.Sprintf(buildNotification, "release-1.2", "", "STARTED", "", 0), 200},
+		{"triforce", fmt.Sprintf(buildNotification, "release-1.2", "", "COMPLETED", "SUCCESS", 3000), 200},
+		{"triforce", fmt.Sprintf(buildNotification, "termina", "", "COMPLETED", "SUCCESS", 3000), 200},
+		{"", fmt.Sprintf(buildNotification, "castle", "", "COMPLETED", "SUCCESS", 3000), 403},
+		{"ganon", fmt.Sprintf(buildNotification, "castle", "", "COMPLETED", "SUCCESS", 3000), 403},
+		{"triforce", `{"name": "castle"}`, 400},
+		{"triforce", `not json`, 400},
+	} {
+		req := httptest.NewRequest("POST", "https://neb.endpoint/jenkins?token="+tc.token, strings.NewReader(tc.body))
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, matrixCli)
+		if w.Code != tc.code {
+			t.Errorf("Bad response to %s with token %q: got %d, want %d", tc.body, tc.token, w.Code, tc.code)
+		}
+	}
+
+	want := []string{
+		"!castle:hyrule [Hyrule Castle] build #31 of main started - https://jenkins.hyrule/job/castle/31/",
+		"!castle:hyrule [Hyrule Castle] build #31 of main failed in 1m35s - https://jenkins.hyrule/job/castle/31/",
+		"!releases:hyrule [release-1.2] build #31 of main succeeded in 3s - https://jenkins.hyrule/job/castle/31/",
+	}
+	if strings.Join(sent, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Bad notices:\ngot  %q\nwant %q", sent, want)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"token": "triforce"}`,
+		`{"token": "triforce", "rooms": {"!castle:hyrule": {"jobs": {}}}}`,
+		`{"token": "triforce", "rooms": {"!castle:hyrule": {"jobs": {"release-[": {}}}}}`,
+		`{"rooms": {"!castle:hyrule": {"jobs": {"castle": {}}}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create jenkins service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+//go:build go1.18
+// +build go1.18
+
+package jira
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/go-neb/services/jira/webhook"
+)
+
+func FuzzWebhook(f *testing.F) {
+	f.Add([]byte(`{"webhookEvent":"jira:issue_created","user":{"name":"alice"},"issue":{"key":"NEB-1",` +
+		`"self":"https://jira.somewhere/rest/api/2/issue/10000","fields":{"summary":"Flibble Wibble",` +
+		`"status":{"name":"Open"},"priority":{"name":"P1"}}}}`))
+	f.Add([]byte(`{"webhookEvent":"jira:issue_updated","issue":{"key":"NEB-2"}}`))
+	f.Add([]byte(`{"webhookEvent":"jira:issue_deleted","issue":{"fields":{}}}`))
+	f.Add([]byte(`{"webhookEvent":"sprint_started","sprint":{"name":"Sprint 1","endDate":"2020-05-19T09:00:00.000Z"}}`))
+	f.Add([]byte(`not json`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		req, err := http.NewRequest("POST", "https://neb.somewhere/services/hooks/jira", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, event, resErr := webhook.OnReceiveRequest(req)
+		if resErr != nil {
+			return
+		}
+		htmlForEvent(event, "NEB", "https://jira.somewhere/")
+	})
+}
+
+func FuzzIssueKeyRegex(f *testing.F) {
+	f.Add("Have you seen NEB-123 and MATRIX-4?")
+	f.Add("no-issues here")
+
+	f.Fuzz(func(t *testing.T, body string) {
+		for _, groups := range issueKeyRegex.FindAllStringSubmatch(body, -1) {
+			if len(groups) != 3 {
+				t.Fatalf("issueKeyRegex matched %d groups, want 3", len(groups))
+			}
+			if !projectKeyRegex.MatchString(groups[1]) {
+				t.Errorf("issueKeyRegex matched project key %q which is not a valid project key", groups[1])
+			}
+		}
+	})
+}
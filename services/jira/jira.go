@@ -15,10 +15,12 @@ import (
 	gojira "github.com/andygrunwald/go-jira"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/notify"
 	"github.com/matrix-org/go-neb/realms/jira"
 	"github.com/matrix-org/go-neb/realms/jira/urls"
 	"github.com/matrix-org/go-neb/services/jira/webhook"
 	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/templates"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
@@ -44,7 +46,8 @@ var projectKeyRegex = regexp.MustCompile("^[A-z]+$")
 //                   "jira-realm-id": {
 //                       Projects: {
 //                           "SYN": { Expand: true },
-//                           "BOTS": { Expand: true, Track: true }
+//                           "BOTS": { Expand: true, Track: true },
+//                           "NEB": { Track: true, Events: ["issue_created", "version_released"], IssueTypes: ["Bug"] }
 //                       }
 //                   }
 //               }
@@ -68,6 +71,15 @@ type Service struct {
 				Expand bool
 				// True to add a webhook to this project and send updates into the room.
 				Track bool
+				// Optional. The webhook events to send into the room. Defaults to all of:
+				//    issue_created, issue_updated, issue_deleted : When an issue is changed.
+				//    comment_created, comment_updated : When an issue is commented on.
+				//    version_released : When a version of the project is released.
+				//    sprint_started, sprint_closed : When a sprint of the project's board starts or ends.
+				Events []string
+				// Optional. Only send events about issues of these types, e.g. "Bug". Defaults to
+				// all issue types.
+				IssueTypes []string
 			}
 		}
 	}
@@ -278,19 +290,36 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		return
 	}
 	// grab base jira url
-	jurl, err := urls.ParseJIRAURL(event.Issue.Self)
+	jurl, err := urls.ParseJIRAURL(event.Self())
 	if err != nil {
 		log.WithError(err).Print("Failed to parse base JIRA URL")
 		w.WriteHeader(500)
 		return
 	}
+	if eventProjectKey == "" {
+		if eventProjectKey, err = s.resolveProjectKey(jurl, event); err != nil {
+			log.WithError(err).WithField("event", event.WebhookEvent).Print("Failed to work out the project of event")
+			w.WriteHeader(200)
+			return
+		}
+	}
 	// work out the HTML to send
-	htmlText := htmlForEvent(event, jurl.Base)
+	htmlText := htmlForEvent(event, eventProjectKey, jurl.Base)
 	if htmlText == "" {
 		log.WithField("project", eventProjectKey).Print("Unable to process event for project")
 		w.WriteHeader(200)
 		return
 	}
+	// Operators can override the message with a template named after the event, e.g.
+	// "jira.issue_created". The template is given the webhook event and the JIRA base URL.
+	msg := templates.Render("jira."+event.Name(), struct {
+		*webhook.Event
+		BaseURL string
+	}{event, jurl.Base}, utils.StrippedHTMLMessage(mevt.MsgNotice, htmlText))
+	var correlationKey string
+	if event.Issue.Key != "" {
+		correlationKey = "jira " + event.Issue.Key
+	}
 	// send message into each configured room
 	for roomID, roomConfig := range s.Rooms {
 		for _, realmConfig := range roomConfig.Realms {
@@ -298,9 +327,14 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 				if pkey != eventProjectKey || !projectConfig.Track {
 					continue
 				}
-				_, msgErr := cli.SendMessageEvent(
-					roomID, mevt.EventMessage, utils.StrippedHTMLMessage(mevt.MsgNotice, htmlText),
-				)
+				if !tracksEvent(projectConfig.Events, projectConfig.IssueTypes, event) {
+					continue
+				}
+				_, msgErr := notify.Send(cli, s, notify.Notification{
+					RoomID:         roomID,
+					Content:        msg,
+					CorrelationKey: correlationKey,
+				})
 				if msgErr != nil {
 					log.WithFields(log.Fields{
 						log.ErrorKey: msgErr,
@@ -408,7 +442,13 @@ func projectsAndRealmsToTrack(s *Service) map[string][]string {
 func htmlSummaryForIssue(issue *gojira.Issue) string {
 	// form a summary of the issue being affected e.g:
 	//   "Flibble Wibble [P1, In Progress]"
-	status := html.EscapeString(issue.Fields.Status.Name)
+	var status, priority string
+	if issue.Fields.Status != nil {
+		status = html.EscapeString(issue.Fields.Status.Name)
+	}
+	if issue.Fields.Priority != nil {
+		priority = html.EscapeString(issue.Fields.Priority.Name)
+	}
 	if issue.Fields.Resolution != nil {
 		status = fmt.Sprintf(
 			"%s (%s)",
@@ -418,34 +458,154 @@ func htmlSummaryForIssue(issue *gojira.Issue) string {
 	return fmt.Sprintf(
 		"%s [%s, %s]",
 		html.EscapeString(issue.Fields.Summary),
-		html.EscapeString(issue.Fields.Priority.Name),
+		priority,
 		status,
 	)
 }
 
+// tracksEvent returns true if a project tracking the given events and issue types wants the event.
+// Empty lists allow everything.
+func tracksEvent(events, issueTypes []string, whe *webhook.Event) bool {
+	if len(events) > 0 && !containsFold(events, whe.Name()) {
+		return false
+	}
+	if len(issueTypes) > 0 && whe.Issue.Fields != nil && whe.Issue.Fields.Type.Name != "" &&
+		!containsFold(issueTypes, whe.Issue.Fields.Type.Name) {
+		return false
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// The longest field value or comment included in a notification
+const maxValueLength = 200
+
 // htmlForEvent formats a webhook event as HTML. Returns an empty string if there is nothing to send/cannot
 // be parsed.
-func htmlForEvent(whe *webhook.Event, jiraBaseURL string) string {
-	action := ""
-	if whe.WebhookEvent == "jira:issue_updated" {
-		action = "updated"
-	} else if whe.WebhookEvent == "jira:issue_deleted" {
-		action = "deleted"
-	} else if whe.WebhookEvent == "jira:issue_created" {
-		action = "created"
-	} else {
+func htmlForEvent(whe *webhook.Event, projectKey, jiraBaseURL string) string {
+	switch whe.Name() {
+	case "issue_created", "issue_updated", "issue_deleted":
+		return htmlForIssueEvent(whe, jiraBaseURL)
+	case "comment_created", "comment_updated":
+		return htmlForCommentEvent(whe, jiraBaseURL)
+	case "version_released":
+		if whe.Version == nil {
+			return ""
+		}
+		text := fmt.Sprintf("Version <b>%s</b> of %s was released",
+			html.EscapeString(whe.Version.Name), html.EscapeString(projectKey))
+		if whe.Version.Description != "" {
+			text += ": " + html.EscapeString(whe.Version.Description)
+		}
+		return text + " " + html.EscapeString(fmt.Sprintf("%sprojects/%s/versions/%s", jiraBaseURL, projectKey, whe.Version.ID))
+	case "sprint_started", "sprint_closed":
+		if whe.Sprint == nil {
+			return ""
+		}
+		text := fmt.Sprintf("Sprint <b>%s</b> of %s ", html.EscapeString(whe.Sprint.Name), html.EscapeString(projectKey))
+		if whe.Name() == "sprint_started" {
+			text += "started"
+			if end := dateOf(whe.Sprint.EndDate); end != "" {
+				text += ", ending " + html.EscapeString(end)
+			}
+		} else {
+			text += "was closed"
+		}
+		if whe.Sprint.Goal != "" {
+			text += ". Goal: " + html.EscapeString(whe.Sprint.Goal)
+		}
+		return text + " " + html.EscapeString(fmt.Sprintf("%ssecure/RapidBoard.jspa?rapidView=%d", jiraBaseURL, whe.Sprint.OriginBoardID))
+	}
+	return ""
+}
+
+func htmlForIssueEvent(whe *webhook.Event, jiraBaseURL string) string {
+	if whe.Issue.Fields == nil {
+		return ""
+	}
+	var changes []webhook.ChangelogItem
+	if whe.Changelog != nil {
+		changes = whe.Changelog.Items
+	}
+	if whe.Name() == "issue_updated" && len(changes) == 0 && strings.Contains(whe.IssueEventTypeName, "comment") {
+		// JIRA sends comment events for these too, which are more useful.
 		return ""
 	}
+	action := strings.TrimPrefix(whe.Name(), "issue_")
 
 	summaryHTML := htmlSummaryForIssue(&whe.Issue)
 
-	return fmt.Sprintf("%s %s <b>%s</b> - %s %s",
-		html.EscapeString(whe.User.Name),
+	text := fmt.Sprintf("%s %s <b>%s</b> - %s %s",
+		html.EscapeString(userName(whe.User)),
 		html.EscapeString(action),
 		html.EscapeString(whe.Issue.Key),
 		summaryHTML,
 		html.EscapeString(jiraBaseURL+"browse/"+whe.Issue.Key),
 	)
+	// e.g. "status: Open → In Progress"
+	for _, item := range changes {
+		text += fmt.Sprintf("<br>\n<b>%s</b>: %s → %s",
+			html.EscapeString(item.Field),
+			html.EscapeString(changelogValue(item.FromString)),
+			html.EscapeString(changelogValue(item.ToString)),
+		)
+	}
+	return text
+}
+
+func htmlForCommentEvent(whe *webhook.Event, jiraBaseURL string) string {
+	if whe.Comment == nil || whe.Issue.Fields == nil {
+		return ""
+	}
+	author, action := userName(whe.Comment.Author), "commented on"
+	if whe.Name() == "comment_updated" {
+		author, action = userName(whe.Comment.UpdateAuthor), "edited a comment on"
+	}
+	return fmt.Sprintf("%s %s <b>%s</b> - %s %s<blockquote>%s</blockquote>",
+		html.EscapeString(author),
+		action,
+		html.EscapeString(whe.Issue.Key),
+		htmlSummaryForIssue(&whe.Issue),
+		html.EscapeString(jiraBaseURL+"browse/"+whe.Issue.Key),
+		strings.Replace(html.EscapeString(truncate(whe.Comment.Body)), "\n", "<br>\n", -1),
+	)
+}
+
+// userName returns the username of the user, or their display name on JIRA installations which
+// don't reveal usernames.
+func userName(u gojira.User) string {
+	if u.Name != "" {
+		return u.Name
+	}
+	return u.DisplayName
+}
+
+func changelogValue(v string) string {
+	if v == "" {
+		return "None"
+	}
+	return truncate(strings.Replace(v, "\n", " ", -1))
+}
+
+func truncate(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) <= maxValueLength {
+		return s
+	}
+	return strings.TrimSpace(strings.ToValidUTF8(s[:maxValueLength], "")) + "…"
+}
+
+// dateOf returns the date part of a JIRA timestamp, e.g. "2020-05-19" from "2020-05-19T09:00:00.000Z".
+func dateOf(timestamp string) string {
+	return strings.SplitN(timestamp, "T", 2)[0]
 }
 
 func init() {
@@ -0,0 +1,67 @@
+package jira
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/go-neb/services/jira/webhook"
+)
+
+var jiraEventTests = []struct {
+	Event    string
+	HTML     string
+	Tracked  bool // by a project tracking comment_created and sprint_started events for bugs
+	Filtered bool // true if there is no notification at all
+}{
+	{
+		`{"webhookEvent":"jira:issue_updated","issue_event_type_name":"issue_generic","user":{"name":"alice"},
+			"issue":{"key":"NEB-1","fields":{"summary":"Flibble","issuetype":{"name":"Bug"},"status":{"name":"In Progress"},"priority":{"name":"P1"}}},
+			"changelog":{"items":[{"field":"status","fromString":"Open","toString":"In Progress"},{"field":"assignee","fromString":null,"toString":"Bob"}]}}`,
+		"alice updated <b>NEB-1</b> - Flibble [P1, In Progress] https://jira.somewhere/browse/NEB-1<br>\n" +
+			"<b>status</b>: Open → In Progress<br>\n<b>assignee</b>: None → Bob",
+		false, false,
+	},
+	{
+		`{"webhookEvent":"jira:issue_updated","issue_event_type_name":"issue_commented","user":{"name":"alice"},
+			"issue":{"key":"NEB-1","fields":{"summary":"Flibble"}},"comment":{"body":"Hi"}}`,
+		"", false, true,
+	},
+	{
+		`{"webhookEvent":"comment_created","comment":{"author":{"displayName":"Bob Smith"},"body":"Looks <good>\nto me"},
+			"issue":{"key":"NEB-2","fields":{"summary":"Wibble","issuetype":{"name":"Story"},"status":{"name":"Open"},"priority":{"name":"P2"}}}}`,
+		"Bob Smith commented on <b>NEB-2</b> - Wibble [P2, Open] https://jira.somewhere/browse/NEB-2" +
+			"<blockquote>Looks &lt;good&gt;<br>\nto me</blockquote>",
+		false, false,
+	},
+	{
+		`{"webhookEvent":"jira:version_released","version":{"id":"10001","name":"1.2","description":"Bug fixes","projectId":10000}}`,
+		"Version <b>1.2</b> of NEB was released: Bug fixes https://jira.somewhere/projects/NEB/versions/10001",
+		false, false,
+	},
+	{
+		`{"webhookEvent":"sprint_started","sprint":{"name":"Sprint 4","goal":"Ship it","endDate":"2020-05-19T09:00:00.000Z","originBoardId":5}}`,
+		"Sprint <b>Sprint 4</b> of NEB started, ending 2020-05-19. Goal: Ship it https://jira.somewhere/secure/RapidBoard.jspa?rapidView=5",
+		true, false,
+	},
+}
+
+func TestHTMLForEvent(t *testing.T) {
+	for _, test := range jiraEventTests {
+		var whe webhook.Event
+		if err := json.Unmarshal([]byte(test.Event), &whe); err != nil {
+			t.Fatalf("Bad test event %s: %s", test.Event, err)
+		}
+		if html := htmlForEvent(&whe, "NEB", "https://jira.somewhere/"); html != test.HTML {
+			t.Errorf("htmlForEvent(%s) => want\n%s\ngot\n%s", whe.WebhookEvent, test.HTML, html)
+		}
+		if !test.Filtered {
+			tracked := tracksEvent([]string{"comment_created", "sprint_started"}, []string{"bug"}, &whe)
+			if tracked != test.Tracked {
+				t.Errorf("tracksEvent(%s) => want %v, got %v", whe.WebhookEvent, test.Tracked, tracked)
+			}
+			if !tracksEvent(nil, nil, &whe) {
+				t.Errorf("tracksEvent(%s) with no filters => false", whe.WebhookEvent)
+			}
+		}
+	}
+}
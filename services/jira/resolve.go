@@ -0,0 +1,118 @@
+package jira
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	gojira "github.com/andygrunwald/go-jira"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/realms/jira"
+	"github.com/matrix-org/go-neb/realms/jira/urls"
+	"github.com/matrix-org/go-neb/services/jira/webhook"
+)
+
+// Matches the issue ID in a comment's REST URL, e.g. https://matrix.org/jira/rest/api/2/issue/10000/comment/10100
+var commentIssueIDRegex = regexp.MustCompile(`/rest/api/2/issue/([0-9]+)/comment/`)
+
+// Projects and boards never move between projects, so their keys are remembered.
+var (
+	projectKeysMutex sync.Mutex
+	projectKeys      = make(map[string]string) // "$URL_KEY project 10000" or "$URL_KEY board 5" => project key
+)
+
+// resolveProjectKey works out which project an event which isn't about an issue belongs to, by
+// asking the JIRA installation it came from. Comment events without an issue have it filled in.
+func (s *Service) resolveProjectKey(jurl urls.JIRAURL, whe *webhook.Event) (string, error) {
+	var cacheKey, path string
+	var res struct {
+		Key      string `json:"key"` // projects
+		Location struct {
+			ProjectKey string `json:"projectKey"`
+		} `json:"location"` // boards
+	}
+	switch {
+	case whe.Comment != nil:
+		return s.resolveCommentIssue(jurl, whe)
+	case whe.Version != nil:
+		cacheKey = fmt.Sprintf("%s project %d", jurl.Key, whe.Version.ProjectID)
+		path = "rest/api/2/project/" + strconv.Itoa(whe.Version.ProjectID)
+	case whe.Sprint != nil:
+		cacheKey = fmt.Sprintf("%s board %d", jurl.Key, whe.Sprint.OriginBoardID)
+		path = "rest/agile/1.0/board/" + strconv.Itoa(whe.Sprint.OriginBoardID)
+	default:
+		return "", fmt.Errorf("Event %s has no project", whe.WebhookEvent)
+	}
+
+	projectKeysMutex.Lock()
+	pkey, ok := projectKeys[cacheKey]
+	projectKeysMutex.Unlock()
+	if ok {
+		return pkey, nil
+	}
+
+	cli, err := s.clientForJIRA(jurl)
+	if err != nil {
+		return "", err
+	}
+	req, err := cli.NewRequest("GET", path, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err = cli.Do(req, &res); err != nil {
+		return "", err
+	}
+	pkey = res.Key
+	if pkey == "" {
+		pkey = res.Location.ProjectKey
+	}
+	if pkey == "" {
+		return "", fmt.Errorf("JIRA did not say which project %s belongs to", path)
+	}
+	pkey = strings.ToUpper(pkey)
+
+	projectKeysMutex.Lock()
+	projectKeys[cacheKey] = pkey
+	projectKeysMutex.Unlock()
+	return pkey, nil
+}
+
+// resolveCommentIssue fetches the issue of a comment event which doesn't include it, as older
+// JIRA installations send.
+func (s *Service) resolveCommentIssue(jurl urls.JIRAURL, whe *webhook.Event) (string, error) {
+	match := commentIssueIDRegex.FindStringSubmatch(whe.Comment.Self)
+	if match == nil {
+		return "", fmt.Errorf("Failed to find the issue of comment %s", whe.Comment.Self)
+	}
+	cli, err := s.clientForJIRA(jurl)
+	if err != nil {
+		return "", err
+	}
+	issue, _, err := cli.Issue.Get(match[1], nil)
+	if err != nil {
+		return "", err
+	}
+	whe.Issue = *issue
+	return strings.ToUpper(strings.Split(issue.Key, "-")[0]), nil
+}
+
+// clientForJIRA returns a client for the JIRA installation, using the realm for it which this
+// service is configured with.
+func (s *Service) clientForJIRA(jurl urls.JIRAURL) (*gojira.Client, error) {
+	for _, roomConfig := range s.Rooms {
+		for realmID := range roomConfig.Realms {
+			realm, err := database.GetServiceDB().LoadAuthRealm(realmID)
+			if err != nil {
+				continue
+			}
+			jrealm, ok := realm.(*jira.Realm)
+			if !ok || !urls.SameJIRAURL(jrealm.JIRAEndpoint, jurl.Base) {
+				continue
+			}
+			return jrealm.JIRAClient(s.ClientUserID, true)
+		}
+	}
+	return nil, fmt.Errorf("No realm is configured for JIRA at %s", jurl.Base)
+}
@@ -21,15 +21,93 @@ type jiraWebhook struct {
 	Filter  string   `json:"jqlFilter"`
 	Exclude bool     `json:"excludeIssueDetails"`
 	// These fields are populated on GET
-	Enabled bool `json:"enabled"`
+	Enabled bool   `json:"enabled"`
+	Self    string `json:"self,omitempty"`
+}
+
+// Events is the list of webhook events which Go-NEB registers for.
+var Events = []string{
+	"jira:issue_created", "jira:issue_deleted", "jira:issue_updated",
+	"comment_created", "comment_updated",
+	"jira:version_released", "sprint_started", "sprint_closed",
 }
 
 // Event represents an incoming JIRA webhook event
 type Event struct {
-	WebhookEvent string       `json:"webhookEvent"`
-	Timestamp    int64        `json:"timestamp"`
-	User         gojira.User  `json:"user"`
-	Issue        gojira.Issue `json:"issue"`
+	WebhookEvent string `json:"webhookEvent"`
+	// What happened to the issue in a jira:issue_updated event, e.g. "issue_generic" or "issue_commented"
+	IssueEventTypeName string       `json:"issue_event_type_name"`
+	Timestamp          int64        `json:"timestamp"`
+	User               gojira.User  `json:"user"`
+	Issue              gojira.Issue `json:"issue"`
+	// The fields which were changed, for jira:issue_updated events
+	Changelog *Changelog `json:"changelog"`
+	// The comment, for comment events
+	Comment *gojira.Comment `json:"comment"`
+	// The version, for version events
+	Version *Version `json:"version"`
+	// The sprint, for sprint events
+	Sprint *Sprint `json:"sprint"`
+}
+
+// Changelog lists the changes made to an issue.
+type Changelog struct {
+	ID    string          `json:"id"`
+	Items []ChangelogItem `json:"items"`
+}
+
+// ChangelogItem is a change to one field of an issue.
+type ChangelogItem struct {
+	Field      string `json:"field"`
+	FieldType  string `json:"fieldtype"`
+	From       string `json:"from"`
+	FromString string `json:"fromString"`
+	To         string `json:"to"`
+	ToString   string `json:"toString"`
+}
+
+// Version is a version of a JIRA project.
+type Version struct {
+	Self        string `json:"self"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Released    bool   `json:"released"`
+	ReleaseDate string `json:"releaseDate"`
+	ProjectID   int    `json:"projectId"`
+}
+
+// Sprint is a JIRA Software sprint.
+type Sprint struct {
+	Self          string `json:"self"`
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	State         string `json:"state"`
+	Goal          string `json:"goal"`
+	StartDate     string `json:"startDate"`
+	EndDate       string `json:"endDate"`
+	CompleteDate  string `json:"completeDate"`
+	OriginBoardID int    `json:"originBoardId"`
+}
+
+// Name returns the name of the event without the "jira:" prefix, e.g. "issue_created" or "sprint_started".
+func (e *Event) Name() string {
+	return strings.TrimPrefix(e.WebhookEvent, "jira:")
+}
+
+// Self returns the REST URL of what the event is about, which identifies the JIRA installation it came from.
+func (e *Event) Self() string {
+	switch {
+	case e.Issue.Self != "":
+		return e.Issue.Self
+	case e.Comment != nil && e.Comment.Self != "":
+		return e.Comment.Self
+	case e.Version != nil:
+		return e.Version.Self
+	case e.Sprint != nil:
+		return e.Sprint.Self
+	}
+	return ""
 }
 
 // RegisterHook checks to see if this user is allowed to track the given projects and then tracks them.
@@ -95,13 +173,19 @@ func RegisterHook(jrealm *jira.Realm, projects []string, userID id.UserID, webho
 
 	if wh != nil {
 		logger.Print("Webhook already exists")
+		// Webhooks made by older versions of Go-NEB don't listen for every event
+		if missing := missingEvents(wh); len(missing) > 0 {
+			logger.WithField("events", missing).Print("Adding missing events to webhook")
+			return updateWebhookEvents(cli, wh)
+		}
 		return nil // we already have a NEB webhook :D
 	}
 	return createWebhook(jrealm, webhookEndpointURL, userID)
 }
 
 // OnReceiveRequest is called when JIRA hits NEB with an update.
-// Returns the project key and webhook event, or an error.
+// Returns the project key and webhook event, or an error. The project key is empty if the event
+// isn't about an issue.
 func OnReceiveRequest(req *http.Request) (string, *Event, *util.JSONResponse) {
 	// extract the JIRA webhook event JSON
 	defer req.Body.Close()
@@ -116,6 +200,7 @@ func OnReceiveRequest(req *http.Request) (string, *Event, *util.JSONResponse) {
 		resErr := util.MessageResponse(400, "Failed to parse JIRA URL")
 		return "", nil, &resErr
 	}
+	// Events which aren't about an issue have no project key. Their project has to be looked up.
 	projKey := strings.Split(whe.Issue.Key, "-")[0]
 	projKey = strings.ToUpper(projKey)
 	return projKey, &whe, nil
@@ -130,7 +215,7 @@ func createWebhook(jrealm *jira.Realm, webhookEndpointURL string, userID id.User
 	req, err := cli.NewRequest("POST", "rest/webhooks/1.0/webhook", jiraWebhook{
 		Name:    "Go-NEB",
 		URL:     webhookEndpointURL,
-		Events:  []string{"jira:issue_created", "jira:issue_deleted", "jira:issue_updated"},
+		Events:  Events,
 		Filter:  "",
 		Exclude: false,
 	})
@@ -156,6 +241,48 @@ func createWebhook(jrealm *jira.Realm, webhookEndpointURL string, userID id.User
 	return err
 }
 
+// missingEvents returns the events which Go-NEB needs that the webhook doesn't listen for.
+func missingEvents(wh *jiraWebhook) (missing []string) {
+	for _, ev := range Events {
+		found := false
+		for _, whEv := range wh.Events {
+			if whEv == ev {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, ev)
+		}
+	}
+	return
+}
+
+// updateWebhookEvents makes the webhook listen for all the events Go-NEB needs.
+func updateWebhookEvents(cli *gojira.Client, wh *jiraWebhook) error {
+	if wh.Self == "" {
+		return fmt.Errorf("Cannot update webhook without a self URL")
+	}
+	req, err := cli.NewRequest("PUT", wh.Self, jiraWebhook{
+		Name:    wh.Name,
+		URL:     wh.URL,
+		Events:  Events,
+		Filter:  wh.Filter,
+		Exclude: wh.Exclude,
+	})
+	if err != nil {
+		return err
+	}
+	res, err := cli.Do(req, nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Updating webhook returned HTTP %d", res.StatusCode)
+	}
+	return nil
+}
+
 // Get an existing JIRA webhook. Returns the hook if it exists, or an error along with a bool
 // which indicates if the request to retrieve the hook is not 2xx. If it is not 2xx, it is
 // forbidden (different JIRA deployments return different codes ranging from 401/403/404/500).
@@ -0,0 +1,223 @@
+// Package karma implements a Service which keeps score of "name++" and "name--" in rooms.
+package karma
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Karma service
+const ServiceType = "karma"
+
+// How many names "!karma top" lists
+const topCount = 10
+
+// The longest name which karma is kept for, so that pasted text doesn't become a name
+const maxNameLength = 64
+
+// A word which ends in "++" or "--", possibly followed by punctuation. The word can't start with
+// a space, so each one starts after the previous match or a space.
+var karmaRegex = regexp.MustCompile(`(\S+?)(\+\+|--)[!?.,:]*(?:\s|$)`)
+
+// Messages from several rooms can arrive at once, and each one updates the stored scores.
+var scoresMutex sync.Mutex
+
+// Service contains the Config fields for the Karma service.
+//
+// Anyone in a room can give karma with "name++" and take it away with "name--" anywhere in a
+// message, e.g. "thanks alice++ for the review". Names are case-insensitive, and a leading "@"
+// and a Matrix user's server are left out, so "@alice:localhost++" and "Alice++" both count
+// for "alice". Each room keeps its own scores. Users can't change their own karma.
+//
+// Example JSON request:
+//   {}
+type Service struct {
+	types.DefaultService
+}
+
+// Commands supported:
+//    !karma name
+// Responds with the name's karma in the room.
+//    !karma top
+// Responds with the names with the most karma in the room.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"karma"},
+			Arguments: []string{"name"},
+			Help:      "Show someone's karma in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdKarma(roomID, args)
+			},
+		},
+		{
+			Path: []string{"karma", "top"},
+			Help: "Show who has the most karma in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdTop(roomID)
+			},
+		},
+	}
+}
+
+// Expansions gives or takes away karma for every "name++" or "name--" in a message.
+func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
+	return []types.Expansion{
+		{
+			Regexp: karmaRegex,
+			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+				return s.expandKarma(roomID, userID, matchingGroups[1], matchingGroups[2])
+			},
+		},
+	}
+}
+
+func (s *Service) expandKarma(roomID id.RoomID, userID id.UserID, word, op string) interface{} {
+	name := normaliseName(word)
+	if name == "" {
+		return nil
+	}
+	if name == normaliseName(userID.String()) {
+		return notice(fmt.Sprintf("%s can't change their own karma", userID))
+	}
+	delta := 1
+	if op == "--" {
+		delta = -1
+	}
+
+	scoresMutex.Lock()
+	defer scoresMutex.Unlock()
+	scores, err := s.loadScores(roomID)
+	if err != nil {
+		return notice(fmt.Sprintf("Failed to load karma: %s", err))
+	}
+	scores[name] += delta
+	score := scores[name]
+	if score == 0 {
+		// Keep the scores small: a missing name has no karma anyway
+		delete(scores, name)
+	}
+	if err = s.storeScores(roomID, scores); err != nil {
+		return notice(fmt.Sprintf("Failed to store karma: %s", err))
+	}
+	return notice(fmt.Sprintf("%s now has %d karma", name, score))
+}
+
+func (s *Service) cmdKarma(roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !karma name|top")
+	}
+	name := normaliseName(args[0])
+	if name == "" {
+		return nil, fmt.Errorf("'%s' can't have karma", args[0])
+	}
+	scoresMutex.Lock()
+	scores, err := s.loadScores(roomID)
+	scoresMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return notice(fmt.Sprintf("%s has %d karma", name, scores[name])), nil
+}
+
+func (s *Service) cmdTop(roomID id.RoomID) (interface{}, error) {
+	scoresMutex.Lock()
+	scores, err := s.loadScores(roomID)
+	scoresMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(scores) == 0 {
+		return notice("Nobody has any karma in this room yet"), nil
+	}
+	var names []string
+	for name := range scores {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if scores[names[i]] != scores[names[j]] {
+			return scores[names[i]] > scores[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > topCount {
+		names = names[:topCount]
+	}
+	lines := []string{"🏆 Most karma:"}
+	for i, name := range names {
+		lines = append(lines, fmt.Sprintf("%d. %s (%d)", i+1, name, scores[name]))
+	}
+	return notice(strings.Join(lines, "\n")), nil
+}
+
+// normaliseName returns the name which karma is kept under for a word, e.g. "alice" for
+// "@Alice:localhost", or "" if the word isn't a name.
+func normaliseName(word string) string {
+	name := strings.ToLower(strings.TrimPrefix(word, "@"))
+	if i := strings.Index(name, ":"); i > 0 {
+		name = name[:i]
+	}
+	name = strings.TrimFunc(name, func(r rune) bool {
+		return (unicode.IsPunct(r) || unicode.IsSymbol(r)) && r != '_'
+	})
+	if name == "" || utf8.RuneCountInString(name) > maxNameLength {
+		return ""
+	}
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return name
+		}
+	}
+	return ""
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+// loadScores returns the karma of every name in the room. It is stored in the service state
+// under "scores <room ID>".
+func (s *Service) loadScores(roomID id.RoomID) (map[string]int, error) {
+	scores := make(map[string]int)
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "scores "+roomID.String())
+	if err == sql.ErrNoRows {
+		return scores, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, &scores); err != nil {
+		return nil, err
+	}
+	return scores, nil
+}
+
+func (s *Service) storeScores(roomID id.RoomID, scores map[string]int) error {
+	stateJSON, err := json.Marshal(scores)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "scores "+roomID.String(), stateJSON)
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
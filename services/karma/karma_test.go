@@ -0,0 +1,74 @@
+package karma
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestKarma(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create karma service: ", err)
+	}
+	s := srv.(*Service)
+	expansion := s.Expansions(nil)[0]
+
+	// send runs the expansion on every match in the message, and returns the responses
+	send := func(roomID id.RoomID, userID id.UserID, body string) []string {
+		var responses []string
+		for _, groups := range expansion.Regexp.FindAllStringSubmatch(body, -1) {
+			if res := expansion.Expand(roomID, userID, groups); res != nil {
+				responses = append(responses, res.(*mevt.MessageEventContent).Body)
+			}
+		}
+		return responses
+	}
+
+	for _, tc := range []struct {
+		roomID id.RoomID
+		userID id.UserID
+		body   string
+		want   []string
+	}{
+		{"!team:hyrule", "@bob:hyrule", "thanks alice++ for the review", []string{"alice now has 1 karma"}},
+		{"!team:hyrule", "@bob:hyrule", "@Alice:hyrule++ and zelda++!", []string{"alice now has 2 karma", "zelda now has 1 karma"}},
+		{"!team:hyrule", "@bob:hyrule", "mondays--", []string{"mondays now has -1 karma"}},
+		{"!team:hyrule", "@alice:hyrule", "alice++", []string{"@alice:hyrule can't change their own karma"}},
+		{"!team:hyrule", "@bob:hyrule", "x -- y, a++b, ---, +++", nil},
+		{"!other:hyrule", "@bob:hyrule", "alice--", []string{"alice now has -1 karma"}},
+		{"!other:hyrule", "@bob:hyrule", "alice++", []string{"alice now has 0 karma"}},
+	} {
+		if got := send(tc.roomID, tc.userID, tc.body); strings.Join(got, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("%s: got %q, want %q", tc.body, got, tc.want)
+		}
+	}
+
+	res, err := s.cmdKarma("!team:hyrule", []string{"@alice:hyrule"})
+	if err != nil {
+		t.Fatal("Failed to get karma: ", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "alice has 2 karma" {
+		t.Errorf("Bad karma: %s", got)
+	}
+	res, err = s.cmdTop("!team:hyrule")
+	if err != nil {
+		t.Fatal("Failed to get top karma: ", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "🏆 Most karma:\n1. alice (2)\n2. zelda (1)\n3. mondays (-1)" {
+		t.Errorf("Bad top karma: %s", got)
+	}
+	res, err = s.cmdTop("!other:hyrule")
+	if err != nil {
+		t.Fatal("Failed to get top karma: ", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "Nobody has any karma in this room yet" {
+		t.Errorf("Bad top karma for a room without any: %s", got)
+	}
+}
@@ -0,0 +1,149 @@
+package langfilter
+
+import (
+	"strings"
+	"unicode"
+)
+
+// The languages which can be detected, by ISO 639-1 code
+var languageNames = map[string]string{
+	"ar": "Arabic",
+	"de": "German",
+	"el": "Greek",
+	"en": "English",
+	"es": "Spanish",
+	"fr": "French",
+	"he": "Hebrew",
+	"hi": "Hindi",
+	"it": "Italian",
+	"ja": "Japanese",
+	"ko": "Korean",
+	"nl": "Dutch",
+	"pt": "Portuguese",
+	"ru": "Russian",
+	"th": "Thai",
+	"uk": "Ukrainian",
+	"zh": "Chinese",
+}
+
+// The languages which are only written in their own script
+var scriptLanguages = []struct {
+	script   *unicode.RangeTable
+	language string
+}{
+	{unicode.Arabic, "ar"},
+	{unicode.Greek, "el"},
+	{unicode.Hebrew, "he"},
+	{unicode.Devanagari, "hi"},
+	{unicode.Hangul, "ko"},
+	{unicode.Thai, "th"},
+}
+
+// The most common words of the languages written in the Latin alphabet, which tell them apart
+var stopWords = map[string][]string{
+	"en": {"the", "and", "is", "are", "was", "you", "that", "this", "with", "have", "for", "not", "what", "of",
+		"to", "it", "they", "we", "my", "your", "will", "would", "can", "there", "just", "about", "but"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ich", "ein", "eine", "zu", "mit", "sich", "auf", "für",
+		"du", "wir", "sie", "es", "auch", "noch", "wie", "aber", "oder", "wenn", "dass", "haben", "sind"},
+	"fr": {"le", "les", "et", "est", "un", "une", "des", "du", "je", "tu", "il", "nous", "vous", "pas", "qui",
+		"pour", "dans", "avec", "sur", "ce", "cette", "mais", "ou", "sont", "être", "avoir", "c'est"},
+	"es": {"el", "los", "las", "y", "es", "que", "de", "no", "por", "para", "con", "está", "pero", "yo", "tú",
+		"muy", "como", "más", "qué", "lo", "su", "hay", "del", "una", "estoy", "tengo"},
+	"pt": {"o", "os", "as", "é", "um", "uma", "não", "com", "mas", "eu", "você", "muito", "mais", "isso", "do",
+		"da", "são", "tem", "em", "está", "estou", "obrigado", "também"},
+	"it": {"il", "gli", "è", "che", "non", "per", "sono", "ma", "io", "molto", "come", "più", "questo", "della",
+		"ho", "ci", "anche", "di", "una", "mi", "ti", "perché", "cosa"},
+	"nl": {"het", "een", "en", "niet", "ik", "je", "dat", "die", "van", "met", "voor", "op", "maar", "ook",
+		"zijn", "wat", "er", "als", "nog", "wel", "hij", "we", "zo", "heb"},
+}
+
+var stopWordLanguages = make(map[string][]string)
+
+func init() {
+	for language, words := range stopWords {
+		for _, word := range words {
+			stopWordLanguages[word] = append(stopWordLanguages[word], language)
+		}
+	}
+}
+
+// words splits the text into its lower case words.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '\''
+	})
+}
+
+// detectLanguage returns the ISO 639-1 code of the language the text is written in, or "" if it
+// can't tell, e.g. because the text is too short.
+func detectLanguage(text string) string {
+	// Languages with their own scripts can be told by the script most of the letters are in
+	var letters, latin, cyrillic, kana, han int
+	scripts := make(map[string]int)
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana++
+		case unicode.Is(unicode.Han, r):
+			han++
+		default:
+			for _, sl := range scriptLanguages {
+				if unicode.Is(sl.script, r) {
+					scripts[sl.language]++
+				}
+			}
+		}
+	}
+	if letters == 0 {
+		return ""
+	}
+	for language, n := range scripts {
+		if n*2 > letters {
+			return language
+		}
+	}
+	switch {
+	case cyrillic*2 > letters:
+		// Ukrainian has letters which Russian doesn't
+		if strings.ContainsAny(strings.ToLower(text), "іїєґ") {
+			return "uk"
+		}
+		return "ru"
+	// Japanese mixes kana with Chinese characters
+	case (kana+han)*2 > letters && kana > 0:
+		return "ja"
+	case han*2 > letters:
+		return "zh"
+	case latin*2 <= letters:
+		return ""
+	}
+
+	counts := make(map[string]int)
+	for _, word := range words(text) {
+		for _, language := range stopWordLanguages[word] {
+			counts[language]++
+		}
+	}
+	var best, second int
+	var language string
+	for l, n := range counts {
+		if n > best {
+			best, second, language = n, best, l
+		} else if n > second {
+			second = n
+		}
+	}
+	// Too few words to tell, or a tie
+	if best < minStopWords || best == second {
+		return ""
+	}
+	return language
+}
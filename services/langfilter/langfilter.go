@@ -0,0 +1,251 @@
+// Package langfilter implements a Service which reminds people of the language of a room, and
+// filters out profanity.
+package langfilter
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Language filter service
+const ServiceType = "langfilter"
+
+const (
+	// How many of a language's common words a message needs for its language to be detected
+	minStopWords = 2
+	// How long after reminding someone of a room's language they aren't reminded again
+	reminderCooldown = 10 * time.Minute
+)
+
+// Profanity actions
+const (
+	actionWarn   = "warn"
+	actionRedact = "redact"
+)
+
+// When people were last reminded of a room's language, keyed by the service ID, room ID and user
+// ID. Reminders don't need to survive restarts, so this isn't stored.
+var (
+	remindedMutex sync.Mutex
+	reminded      = make(map[string]time.Time)
+)
+
+// Service contains the Config fields for the Language filter service.
+//
+// Each room can have a language, given as an ISO 639-1 code like "en" or "de". People who write
+// in another language are reminded which language the room is in, at most every 10 minutes.
+// Only messages with enough common words of a language are checked, so short messages, names
+// and links are left alone. Languages written in the Latin alphabet are told apart for English,
+// German, French, Spanish, Portuguese, Italian and Dutch, and the languages with their own
+// scripts, like Russian, Greek, Arabic, Japanese and Korean, are told by their script.
+//
+// Each room can also have a list of words which aren't allowed, matched whole and ignoring case.
+// A word ending in "*" matches every word starting with it. Messages with them get a warning, or
+// are redacted, for which Go-NEB needs the power level to redact other people's messages.
+//
+// Example JSON request:
+//   {
+//       "rooms": {
+//           "!lobby:localhost": {
+//               "language": "en",
+//               "language_reminder": "Please keep to English here, or join #international:localhost",
+//               "banned_words": ["heck", "darn*"],
+//               "profanity_action": "redact"
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// The rooms to filter messages in.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is how a room's messages are filtered.
+type RoomConfig struct {
+	// Optional. The ISO 639-1 code of the language the room is in. Messages aren't checked for
+	// their language if it isn't set.
+	Language string `json:"language"`
+	// Optional. What people who write in another language are told. Defaults to asking them to
+	// write in the room's language.
+	LanguageReminder string `json:"language_reminder"`
+	// Optional. The words which aren't allowed in the room.
+	BannedWords []string `json:"banned_words"`
+	// Optional. What to do with messages with banned words: "warn" or "redact". Defaults to "warn".
+	ProfanityAction string `json:"profanity_action"`
+}
+
+// hasBannedWord returns whether any of the words isn't allowed in the room.
+func (r *RoomConfig) hasBannedWord(words []string) bool {
+	for _, word := range words {
+		for _, banned := range r.BannedWords {
+			banned = strings.ToLower(banned)
+			if prefix := strings.TrimSuffix(banned, "*"); prefix != banned {
+				if strings.HasPrefix(word, prefix) {
+					return true
+				}
+			} else if word == banned {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// OnMessage checks the language and words of the messages sent in the configured rooms. Notices,
+// which are sent by bots, aren't checked.
+func (s *Service) OnMessage(cli types.MatrixClient, evt *mevt.Event) {
+	if evt.Type != mevt.EventMessage {
+		return
+	}
+	room, ok := s.Rooms[evt.RoomID]
+	if !ok {
+		return
+	}
+	content := evt.Content.Raw
+	// Edits are checked by what they change the message to
+	if newContent, ok := content["m.new_content"].(map[string]interface{}); ok {
+		content = newContent
+	}
+	if msgType, _ := content["msgtype"].(string); msgType == string(mevt.MsgNotice) {
+		return
+	}
+	body, _ := content["body"].(string)
+	if body == "" {
+		return
+	}
+	body = stripReplyFallback(body)
+
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    evt.RoomID,
+		"event_id":   evt.ID,
+	})
+	if room.hasBannedWord(words(body)) {
+		if err := s.filterProfanity(cli, evt, &room); err != nil {
+			logger.WithError(err).Error("Failed to filter profanity")
+		}
+		return
+	}
+	if room.Language == "" {
+		return
+	}
+	if language := detectLanguage(body); language != "" && language != room.Language && s.shouldRemind(evt, time.Now()) {
+		reminder := room.LanguageReminder
+		if reminder == "" {
+			reminder = fmt.Sprintf("please write in %s in this room.", languageNames[room.Language])
+		}
+		if _, err := cli.SendMessageEvent(evt.RoomID, mevt.EventMessage, mentionMessage("💬", evt.Sender, reminder)); err != nil {
+			logger.WithError(err).Error("Failed to send language reminder")
+		}
+	}
+}
+
+// filterProfanity warns the sender of a message with a banned word, or redacts it.
+func (s *Service) filterProfanity(cli types.MatrixClient, evt *mevt.Event, room *RoomConfig) error {
+	if room.ProfanityAction != actionRedact {
+		_, err := cli.SendMessageEvent(evt.RoomID, mevt.EventMessage,
+			mentionMessage("⚠️", evt.Sender, "please mind your language."))
+		return err
+	}
+	rcli, ok := cli.(types.EventRedacter)
+	if !ok {
+		return fmt.Errorf("Client cannot redact events")
+	}
+	if _, err := rcli.RedactEvent(evt.RoomID, evt.ID, mautrix.ReqRedact{Reason: "Language"}); err != nil {
+		return err
+	}
+	_, err := cli.SendMessageEvent(evt.RoomID, mevt.EventMessage,
+		mentionMessage("🚫", evt.Sender, "your message was removed for its language."))
+	return err
+}
+
+// shouldRemind returns whether the sender should be reminded of the room's language, which they
+// are unless they were reminded recently.
+func (s *Service) shouldRemind(evt *mevt.Event, now time.Time) bool {
+	key := s.ServiceID() + " " + evt.RoomID.String() + " " + evt.Sender.String()
+	remindedMutex.Lock()
+	defer remindedMutex.Unlock()
+	if last, ok := reminded[key]; ok && now.Sub(last) < reminderCooldown {
+		return false
+	}
+	reminded[key] = now
+	// Forget the reminders which have cooled down, so that the map doesn't grow forever
+	for k, last := range reminded {
+		if now.Sub(last) >= reminderCooldown {
+			delete(reminded, k)
+		}
+	}
+	return true
+}
+
+// mentionMessage returns a notice which mentions the user, so that they are notified.
+func mentionMessage(emoji string, userID id.UserID, text string) *mevt.MessageEventContent {
+	pill := fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, userID, html.EscapeString(userID.String()))
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          fmt.Sprintf("%s %s, %s", emoji, userID, text),
+		Format:        mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf("%s %s, %s", emoji, pill, html.EscapeString(text)),
+	}
+}
+
+// stripReplyFallback removes the quote of the message replied to from the body of a reply, so
+// that only what the sender wrote is checked.
+func stripReplyFallback(body string) string {
+	lines := strings.Split(body, "\n")
+	for len(lines) > 0 && strings.HasPrefix(lines[0], "> ") {
+		lines = lines[1:]
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// Register makes sure that the rooms' languages and actions are valid, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	for roomID, room := range s.Rooms {
+		if room.Language == "" && len(room.BannedWords) == 0 {
+			return fmt.Errorf("Room %s has neither a language nor banned words", roomID)
+		}
+		if _, ok := languageNames[room.Language]; room.Language != "" && !ok {
+			return fmt.Errorf("Room %s has a language which can't be detected: %s", roomID, room.Language)
+		}
+		switch room.ProfanityAction {
+		case "", actionWarn, actionRedact:
+		default:
+			return fmt.Errorf("Room %s has a bad profanity_action '%s': must be warn or redact", roomID, room.ProfanityAction)
+		}
+		for _, word := range room.BannedWords {
+			if strings.TrimSuffix(word, "*") == "" {
+				return fmt.Errorf("Room %s has an empty banned word", roomID)
+			}
+		}
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package langfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	for text, want := range map[string]string{
+		"Has anyone seen the Master Sword? I think it is in the woods":      "en",
+		"Ich habe das Schwert nicht gesehen, aber es ist im Wald":           "de",
+		"Je ne sais pas où est la princesse, mais elle est dans le château": "fr",
+		"No sé dónde está la espada, pero creo que está en el bosque":       "es",
+		"Eu não sei onde está a espada, mas acho que é muito longe":         "pt",
+		"Non so dove sia la spada, ma penso che sia nella foresta":          "it",
+		"Ik weet niet waar het zwaard is, maar het is in het bos":           "nl",
+		"Я не знаю, где меч":                                                "ru",
+		"Я не знаю, де їхній меч":                                           "uk",
+		"Το σπαθί είναι στο δάσος":                                          "el",
+		"剣はどこにありますか":                                                        "ja",
+		"剑在森林里":                                                             "zh",
+		"검은 숲에 있어요":                                                         "ko",
+		// Too short to tell
+		"ok thanks": "",
+		"Link":      "",
+		"👍":         "",
+	} {
+		if got := detectLanguage(text); got != want {
+			t.Errorf("detectLanguage(%q): got %q, want %q", text, got, want)
+		}
+	}
+}
+
+func message(roomID id.RoomID, sender id.UserID, eventID id.EventID, raw map[string]interface{}) *mevt.Event {
+	return &mevt.Event{
+		Type:    mevt.EventMessage,
+		ID:      eventID,
+		Sender:  sender,
+		RoomID:  roomID,
+		Content: mevt.Content{Raw: raw},
+	}
+}
+
+func TestOnMessage(t *testing.T) {
+	reminded = make(map[string]time.Time)
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		parts := strings.Split(req.URL.Path, "/")
+		if parts[6] == "redact" {
+			sent = append(sent, fmt.Sprintf("%s redacted %s", parts[5], parts[7]))
+		} else {
+			var msg mevt.MessageEventContent
+			if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+				t.Fatalf("Failed to decode message: %s", err)
+			}
+			sent = append(sent, parts[5]+" "+msg.Body)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$notice:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"rooms": {
+			"!castle:hyrule": {"language": "en", "banned_words": ["Moblin*"]},
+			"!village:hyrule": {"language": "de", "language_reminder": "bitte schreib auf Deutsch.", "banned_words": ["ganon"], "profanity_action": "redact"},
+			"!elsewhere:hyrule": {"banned_words": ["ganon"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create langfilter service: ", err)
+	}
+	s := srv.(*Service)
+
+	german := "Ich habe das Schwert nicht gesehen, aber es ist im Wald"
+	for _, evt := range []*mevt.Event{
+		message("!castle:hyrule", "@link:hyrule", "$1", map[string]interface{}{"msgtype": "m.text", "body": "Where is the Master Sword? I think it is in the woods"}),
+		message("!castle:hyrule", "@link:hyrule", "$2", map[string]interface{}{"msgtype": "m.text", "body": german}),
+		// Reminded recently
+		message("!castle:hyrule", "@link:hyrule", "$3", map[string]interface{}{"msgtype": "m.text", "body": german}),
+		message("!castle:hyrule", "@impa:hyrule", "$4", map[string]interface{}{"msgtype": "m.notice", "body": german}),
+		message("!castle:hyrule", "@impa:hyrule", "$5", map[string]interface{}{"msgtype": "m.text", "body": "Those MOBLINS are back!"}),
+		// Only what the reply says is checked
+		message("!castle:hyrule", "@zelda:hyrule", "$6", map[string]interface{}{"msgtype": "m.text",
+			"body": "> <@link:hyrule> " + german + "\n\nWhat is that in English?"}),
+		message("!village:hyrule", "@zelda:hyrule", "$7", map[string]interface{}{"msgtype": "m.text", "body": "Where is the sword? It is in the woods"}),
+		message("!village:hyrule", "@zelda:hyrule", "$8", map[string]interface{}{"msgtype": "m.text", "body": "* Ganon!", "m.new_content": map[string]interface{}{
+			"msgtype": "m.text", "body": "Ganon!"}}),
+		message("!elsewhere:hyrule", "@zelda:hyrule", "$9", map[string]interface{}{"msgtype": "m.text", "body": german}),
+		message("!nowhere:hyrule", "@zelda:hyrule", "$10", map[string]interface{}{"msgtype": "m.text", "body": "ganon"}),
+	} {
+		s.OnMessage(matrixCli, evt)
+	}
+
+	want := []string{
+		"!castle:hyrule 💬 @link:hyrule, please write in English in this room.",
+		"!castle:hyrule ⚠️ @impa:hyrule, please mind your language.",
+		"!village:hyrule 💬 @zelda:hyrule, bitte schreib auf Deutsch.",
+		"!village:hyrule redacted $8",
+		"!village:hyrule 🚫 @zelda:hyrule, your message was removed for its language.",
+	}
+	if strings.Join(sent, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Bad messages: got %q, want %q", sent, want)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"rooms": {"!castle:hyrule": {}}}`,
+		`{"rooms": {"!castle:hyrule": {"language": "hylian"}}}`,
+		`{"rooms": {"!castle:hyrule": {"banned_words": ["ganon"], "profanity_action": "ban"}}}`,
+		`{"rooms": {"!castle:hyrule": {"banned_words": ["*"]}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create langfilter service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package logalert
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// graylogNotification is sent by a Graylog HTTP notification when an event definition fires.
+type graylogNotification struct {
+	EventDefinitionTitle       string `json:"event_definition_title"`
+	EventDefinitionDescription string `json:"event_definition_description"`
+	Event                      struct {
+		Message        string   `json:"message"`
+		Streams        []string `json:"streams"`
+		SourceStreams  []string `json:"source_streams"`
+		TimerangeStart string   `json:"timerange_start"`
+		TimerangeEnd   string   `json:"timerange_end"`
+	} `json:"event"`
+	// The messages which matched, if the notification is set to include them
+	Backlog []struct {
+		Message   string `json:"message"`
+		Source    string `json:"source"`
+		Timestamp string `json:"timestamp"`
+	} `json:"backlog"`
+}
+
+// alert returns the alert to post. The link searches the event's streams over its time range.
+func (n *graylogNotification) alert(graylogURL string) (*alert, error) {
+	title := n.EventDefinitionTitle
+	if title == "" {
+		title = n.Event.Message
+	}
+	if title == "" {
+		return nil, fmt.Errorf("event_definition_title is required")
+	}
+	a := &alert{
+		Title:       title,
+		Description: n.EventDefinitionDescription,
+		Streams:     n.Event.SourceStreams,
+	}
+	if len(a.Streams) == 0 {
+		a.Streams = n.Event.Streams
+	}
+	for _, m := range n.Backlog {
+		line := m.Message
+		if m.Source != "" {
+			line = m.Source + " " + line
+		}
+		if m.Timestamp != "" {
+			line = m.Timestamp + " " + line
+		}
+		a.Lines = append(a.Lines, line)
+	}
+	if graylogURL != "" {
+		q := url.Values{}
+		if n.Event.TimerangeStart != "" && n.Event.TimerangeEnd != "" {
+			q.Set("rangetype", "absolute")
+			q.Set("from", n.Event.TimerangeStart)
+			q.Set("to", n.Event.TimerangeEnd)
+		}
+		if len(a.Streams) > 0 {
+			q.Set("streams", strings.Join(a.Streams, ","))
+		}
+		a.URL = strings.TrimSuffix(graylogURL, "/") + "/search?" + q.Encode()
+	}
+	return a, nil
+}
@@ -0,0 +1,265 @@
+// Package logalert implements a Service which posts Graylog and Loki log alerts into rooms.
+package logalert
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Log alert service
+const ServiceType = "logalert"
+
+const (
+	// The most a webhook's body can be
+	maxWebhookSize  = 1 << 20
+	defaultMaxLines = 10
+	// Longer log lines are cut short
+	maxLineLength = 300
+)
+
+// alert is a Graylog event or Loki alert, in the form the service posts it.
+type alert struct {
+	Title string
+	// Optional. What the alert means
+	Description string
+	// The Graylog stream IDs or Loki "stream" label the alert is from, for routing to rooms
+	Streams []string
+	// The log lines which matched
+	Lines []string
+	// Optional. A link to the query in Graylog, or to the rule's query for Loki
+	URL string
+}
+
+// Service contains the Config fields for the Log alert service.
+//
+// Graylog sends events to the graylog_webhook_url from an HTTP notification, and Alertmanager
+// sends alerts from Loki's ruler to the loki_webhook_url, with "&token=" and the token added.
+// Resolved Loki alerts aren't posted.
+//
+// Each alert is posted with its log lines as a code block: the backlog of a Graylog event,
+// which the event definition must be set to include, or the latest lines which match the log
+// query in a Loki rule, looked up in Loki if loki_url is set. At most max_lines are posted.
+//
+// Rooms can be sent the alerts of only some streams: Graylog stream IDs, or for Loki the value
+// of a "stream" label added to the rule. Rooms with no streams are sent every alert.
+//
+// Example JSON request:
+//   {
+//       "token": "a_long_random_string",
+//       "graylog_url": "https://graylog.example.com",
+//       "loki_url": "http://loki:3100",
+//       "rooms": {
+//           "!web:localhost": {
+//               "streams": ["5f3a9c0e1b2c3d4e5f6a7b8c", "web"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which Graylog should send events to. Populated by Go-NEB after Service registration.
+	GraylogWebhookURL string `json:"graylog_webhook_url"`
+	// The URL which Alertmanager should send Loki's alerts to. Populated by Go-NEB after Service
+	// registration.
+	LokiWebhookURL string `json:"loki_webhook_url"`
+	// The token which alerts must have, so that nobody else can post to rooms.
+	Token string `json:"token"`
+	// Optional. The URL of Graylog's web interface, for links to the matching messages.
+	GraylogURL string `json:"graylog_url"`
+	// Optional. The URL of Loki's API, for looking up the lines which matched a Loki alert.
+	LokiURL string `json:"loki_url"`
+	// Optional. The most log lines to post with each alert. Defaults to 10.
+	MaxLines int `json:"max_lines"`
+	// The rooms to post alerts into.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is which alerts a room is sent.
+type RoomConfig struct {
+	// Optional. The streams whose alerts are sent to the room. Defaults to every stream.
+	Streams []string `json:"streams"`
+}
+
+func (r *RoomConfig) wants(a *alert) bool {
+	if len(r.Streams) == 0 {
+		return true
+	}
+	for _, want := range r.Streams {
+		for _, stream := range a.Streams {
+			if want == stream {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// OnReceiveWebhook posts the Graylog or Loki alerts into the rooms which want them.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+		w.WriteHeader(403)
+		return
+	}
+
+	logger := log.WithField("service_id", s.ServiceID())
+	body := io.LimitReader(req.Body, maxWebhookSize)
+	var alerts []*alert
+	var err error
+	switch source := req.URL.Query().Get("source"); source {
+	case "graylog":
+		var n graylogNotification
+		if err = json.NewDecoder(body).Decode(&n); err == nil {
+			var a *alert
+			if a, err = n.alert(s.GraylogURL); err == nil {
+				alerts = []*alert{a}
+			}
+		}
+	case "loki":
+		var n lokiNotification
+		if err = json.NewDecoder(body).Decode(&n); err == nil {
+			alerts = n.alerts(s.LokiURL, s.maxLines())
+		}
+	default:
+		err = fmt.Errorf("Unknown source '%s'", source)
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Bad log alert webhook")
+		w.WriteHeader(400)
+		return
+	}
+
+	for _, a := range alerts {
+		content := s.alertContent(a)
+		for roomID, room := range s.Rooms {
+			if !room.wants(a) {
+				continue
+			}
+			_, err := notify.Send(cli, s, notify.Notification{
+				RoomID:   roomID,
+				Content:  content,
+				Severity: notify.SeverityWarning,
+			})
+			if err != nil {
+				logger.WithError(err).WithField("room_id", roomID).Error("Failed to send log alert")
+			}
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// alertContent is the message an alert is posted in: its title, description, lines and link.
+func (s *Service) alertContent(a *alert) mevt.MessageEventContent {
+	body := "🪵 " + a.Title
+	formatted := "🪵 <strong>" + html.EscapeString(a.Title) + "</strong>"
+	if a.URL != "" {
+		formatted = fmt.Sprintf(`🪵 <strong><a href="%s">%s</a></strong>`, html.EscapeString(a.URL), html.EscapeString(a.Title))
+	}
+	if a.Description != "" {
+		body += "\n" + a.Description
+		formatted += "<br>" + html.EscapeString(a.Description)
+	}
+	if len(a.Lines) > 0 {
+		lines := a.Lines
+		more := 0
+		if max := s.maxLines(); len(lines) > max {
+			// Keep the latest lines
+			more = len(lines) - max
+			lines = lines[more:]
+		}
+		var text []string
+		if more > 0 {
+			text = append(text, fmt.Sprintf("... %d earlier lines", more))
+		}
+		for _, line := range lines {
+			text = append(text, truncate(line))
+		}
+		block := strings.Join(text, "\n")
+		body += "\n```\n" + block + "\n```"
+		formatted += "<pre><code>" + html.EscapeString(block) + "</code></pre>"
+	}
+	if a.URL != "" {
+		body += "\n" + a.URL
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          body,
+		Format:        mevt.FormatHTML,
+		FormattedBody: formatted,
+	}
+}
+
+// truncate returns the first line of the log line, cut short if it is too long.
+func truncate(line string) string {
+	if i := strings.IndexAny(line, "\r\n"); i >= 0 {
+		line = line[:i] + " …"
+	}
+	if utf8.RuneCountInString(line) > maxLineLength {
+		line = string([]rune(line)[:maxLineLength-1]) + "…"
+	}
+	return line
+}
+
+func (s *Service) maxLines() int {
+	if s.MaxLines == 0 {
+		return defaultMaxLines
+	}
+	return s.MaxLines
+}
+
+// Register makes sure the Config information supplied is valid, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.GraylogWebhookURL = s.webhookEndpointURL + "?source=graylog"
+	s.LokiWebhookURL = s.webhookEndpointURL + "?source=loki"
+	if len(s.Token) < 16 {
+		return fmt.Errorf("A token of at least 16 characters is required")
+	}
+	for name, u := range map[string]string{"graylog_url": s.GraylogURL, "loki_url": s.LokiURL} {
+		if u == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("Bad %s '%s': must be an http or https URL", name, u)
+		}
+	}
+	if s.MaxLines < 0 {
+		return fmt.Errorf("max_lines must not be negative")
+	}
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package logalert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestWebhook(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if !strings.HasPrefix(req.URL.String(), "http://loki.hyrule:3100/loki/api/v1/query_range?") {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		q := req.URL.Query()
+		if q.Get("query") != `{app="castle"} |= "error"` || q.Get("start") != "1615802400000000000" {
+			return nil, fmt.Errorf("Bad query: %s", req.URL.String())
+		}
+		// Each stream's lines are newest first
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(`{"data":{"result":[
+				{"values":[["1615802460000000000","error: moat drained"],["1615802400000000000","error: drawbridge stuck"]]},
+				{"values":[["1615802430000000000","error: guard asleep"]]}
+			]}}`)),
+		}, nil
+	})}
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, room+" "+msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$log:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"token": "the_master_sword_token",
+		"graylog_url": "https://graylog.hyrule/",
+		"loki_url": "http://loki.hyrule:3100",
+		"max_lines": 2,
+		"rooms": {
+			"!castle:hyrule": {"streams": ["castle"]},
+			"!village:hyrule": {"streams": ["5f3a9c0e"]},
+			"!everything:hyrule": {}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create log alert service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register log alert service: ", err)
+	}
+
+	graylog := `{
+		"event_definition_title": "Cucco attacks",
+		"event_definition_description": "Someone is hitting the cuccos",
+		"event": {"message": "Cucco attacks", "streams": ["5f3a9c0e"],
+			"timerange_start": "2021-03-15T10:00:00.000Z", "timerange_end": "2021-03-15T10:05:00.000Z"},
+		"backlog": [
+			{"message": "hit cucco", "source": "kakariko", "timestamp": "2021-03-15T10:01:00.000Z"},
+			{"message": "hit cucco again\nand again", "source": "kakariko", "timestamp": "2021-03-15T10:02:00.000Z"}
+		]
+	}`
+	loki := `{"status": "firing", "alerts": [
+		{"status": "firing", "labels": {"alertname": "CastleErrors", "stream": "castle"},
+			"annotations": {"summary": "Errors in the castle"}, "startsAt": "2021-03-15T10:00:00Z",
+			"generatorURL": "http://loki.hyrule/graph?g0.expr=sum%28rate%28%7Bapp%3D%22castle%22%7D+%7C%3D+%22error%22+%5B5m%5D%29%29+%3E+0&g0.tab=1"},
+		{"status": "resolved", "labels": {"alertname": "OldErrors"}}
+	]}`
+	for _, tc := range []struct {
+		query string
+		body  string
+		code  int
+	}{
+		{"?source=graylog&token=wrong", graylog, 403},
+		{"?source=splunk&token=the_master_sword_token", `{}`, 400},
+		{"?source=graylog&token=the_master_sword_token", `{"event": {}}`, 400},
+		{"?source=graylog&token=the_master_sword_token", graylog, 200},
+		{"?source=loki&token=the_master_sword_token", loki, 200},
+	} {
+		req := httptest.NewRequest("POST", "https://neb.hyrule/services/hooks/bG9nYWxlcnQ"+tc.query, strings.NewReader(tc.body))
+		w := httptest.NewRecorder()
+		srv.OnReceiveWebhook(w, req, matrixCli)
+		if w.Code != tc.code {
+			t.Errorf("Webhook %s: got status %d, want %d", tc.query, w.Code, tc.code)
+		}
+	}
+
+	graylogMsg := "🪵 Cucco attacks\nSomeone is hitting the cuccos\n```\n" +
+		"2021-03-15T10:01:00.000Z kakariko hit cucco\n2021-03-15T10:02:00.000Z kakariko hit cucco again …\n```\n" +
+		"https://graylog.hyrule/search?from=2021-03-15T10%3A00%3A00.000Z&rangetype=absolute&streams=5f3a9c0e&to=2021-03-15T10%3A05%3A00.000Z"
+	lokiMsg := "🪵 CastleErrors\nErrors in the castle\n```\n" +
+		"2021-03-15T10:00:30Z error: guard asleep\n2021-03-15T10:01:00Z error: moat drained\n```\n" +
+		"http://loki.hyrule/graph?g0.expr=sum%28rate%28%7Bapp%3D%22castle%22%7D+%7C%3D+%22error%22+%5B5m%5D%29%29+%3E+0&g0.tab=1"
+	want := []string{
+		"!castle:hyrule " + lokiMsg,
+		"!everything:hyrule " + lokiMsg,
+		"!everything:hyrule " + graylogMsg,
+		"!village:hyrule " + graylogMsg,
+	}
+	sort.Strings(sent)
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad messages:\ngot  %q\nwant %q", sent, want)
+	}
+}
+
+func TestLogQuery(t *testing.T) {
+	for expr, want := range map[string]string{
+		`sum(rate({app="web"} |= "error" [5m])) > 10`:                     `{app="web"} |= "error"`,
+		`count_over_time({job="a", env=~"p.*"} |~ "fail(ed)?[0-9]" [1h])`: `{job="a", env=~"p.*"} |~ "fail(ed)?[0-9]"`,
+		`absent_over_time({app="web"}[10m])`:                              `{app="web"}`,
+		`vector(1)`:                                                       ``,
+	} {
+		u := "http://loki/graph?g0.expr=" + strings.NewReplacer("{", "%7B", "}", "%7D", "+", "%2B", " ", "+", "\"", "%22", "|", "%7C", "[", "%5B", "]", "%5D").Replace(expr)
+		if got := logQuery(u); got != want {
+			t.Errorf("logQuery(%s): got %q, want %q", expr, got, want)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"token": "short", "rooms": {"!castle:hyrule": {}}}`,
+		`{"token": "the_master_sword_token"}`,
+		`{"token": "the_master_sword_token", "loki_url": "loki:3100", "rooms": {"!castle:hyrule": {}}}`,
+		`{"token": "the_master_sword_token", "max_lines": -1, "rooms": {"!castle:hyrule": {}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create log alert service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package logalert
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// lokiNotification is sent by Alertmanager for alerts from Loki's ruler.
+type lokiNotification struct {
+	Alerts []struct {
+		Status       string            `json:"status"`
+		Labels       map[string]string `json:"labels"`
+		Annotations  map[string]string `json:"annotations"`
+		StartsAt     time.Time         `json:"startsAt"`
+		GeneratorURL string            `json:"generatorURL"`
+	} `json:"alerts"`
+}
+
+// alerts returns the firing alerts to post. Their lines are looked up in Loki, if it is
+// configured, using the log query in the alert's rule.
+func (n *lokiNotification) alerts(lokiURL string, maxLines int) []*alert {
+	var alerts []*alert
+	for _, la := range n.Alerts {
+		if la.Status != "firing" {
+			continue
+		}
+		a := &alert{
+			Title:       la.Labels["alertname"],
+			Description: la.Annotations["summary"],
+			URL:         la.GeneratorURL,
+		}
+		if a.Title == "" {
+			a.Title = "Loki alert"
+		}
+		if a.Description == "" {
+			a.Description = la.Annotations["description"]
+		}
+		if stream := la.Labels["stream"]; stream != "" {
+			a.Streams = []string{stream}
+		}
+		if lokiURL != "" {
+			if query := logQuery(la.GeneratorURL); query != "" {
+				lines, err := queryLines(lokiURL, query, la.StartsAt, maxLines)
+				if err != nil {
+					a.Lines = []string{fmt.Sprintf("Failed to look up the log lines: %s", err)}
+				} else {
+					a.Lines = lines
+				}
+			}
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts
+}
+
+// logQuery returns the log query inside the metric query of an alert's generator URL, e.g.
+// `{app="web"} |= "error"` for `sum(rate({app="web"} |= "error" [5m])) > 10`, or "" if there
+// isn't one.
+func logQuery(generatorURL string) string {
+	u, err := url.Parse(generatorURL)
+	if err != nil {
+		return ""
+	}
+	expr := u.Query().Get("g0.expr")
+	start := strings.Index(expr, "{")
+	if start < 0 {
+		return ""
+	}
+	depth := 0
+	var quote rune
+	for i, r := range expr[start:] {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '`':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			if depth == 0 {
+				return strings.TrimSpace(expr[start : start+i])
+			}
+			depth--
+		case r == '[' && depth == 0:
+			return strings.TrimSpace(expr[start : start+i])
+		}
+	}
+	return strings.TrimSpace(expr[start:])
+}
+
+// queryLines returns the latest lines which match the log query since the time.
+func queryLines(lokiURL, query string, since time.Time, limit int) ([]string, error) {
+	q := url.Values{}
+	q.Set("query", query)
+	q.Set("limit", strconv.Itoa(limit))
+	q.Set("direction", "backward")
+	if !since.IsZero() {
+		q.Set("start", strconv.FormatInt(since.UnixNano(), 10))
+	}
+	res, err := httpClient.Get(strings.TrimSuffix(lokiURL, "/") + "/loki/api/v1/query_range?" + q.Encode())
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var body struct {
+		Data struct {
+			Result []struct {
+				// Pairs of the timestamp in nanoseconds and the line
+				Values [][2]string `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	type entry struct {
+		ts   int64
+		line string
+	}
+	var entries []entry
+	for _, stream := range body.Data.Result {
+		for _, v := range stream.Values {
+			ts, _ := strconv.ParseInt(v[0], 10, 64)
+			entries = append(entries, entry{ts, v[1]})
+		}
+	}
+	// Each stream's lines are newest first, and the streams need merging
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ts > entries[j].ts })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		// Oldest first, as in a log file
+		lines[len(entries)-1-i] = time.Unix(0, e.ts).UTC().Format(time.RFC3339) + " " + e.line
+	}
+	return lines, nil
+}
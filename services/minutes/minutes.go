@@ -0,0 +1,528 @@
+// Package minutes implements a Service which takes the minutes of meetings and tracks their action
+// items.
+package minutes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Minutes service
+const ServiceType = "minutes"
+
+const (
+	// How many minutes of past meetings are kept for each room
+	maxMinutes = 50
+	// How many outstanding action items a room can have
+	maxActions = 200
+	// How many notes a meeting can have
+	maxNotes = 200
+)
+
+// The kinds of note which are taken during meetings
+const (
+	kindAction   = "action"
+	kindDecision = "decision"
+)
+
+var (
+	tagRegex = regexp.MustCompile(`(?i)(^|\s)#(action|decision)\b:?`)
+	// Matches user IDs, including those in the links of mention pills
+	userIDRegex = regexp.MustCompile(`@[a-zA-Z0-9._=\-/]+:[a-zA-Z0-9.\-]+(?::[0-9]+)?`)
+	dueRegex    = regexp.MustCompile(`(?i)\b(?:due|by):? (\d{4}-\d{2}-\d{2})\b`)
+)
+
+// Commands and OnMessage both update the meetings, so they are only loaded and stored while
+// holding this, lest a message be dropped from the minutes as the meeting ends.
+var meetingsMutex sync.Mutex
+
+// Service contains the Config fields for the Minutes service.
+//
+// Anyone in one of the rooms can start a meeting with "!meeting start". Until "!meeting end",
+// messages tagged with #action or #decision are noted down:
+//    #decision We ship the release on Friday
+//    #action @link:example.com writes the release notes, due 2021-06-10
+// When the meeting ends, its minutes are posted to the room and kept, so that "!meeting last"
+// can post them again. Action items are assigned to the users mentioned in them, and can have
+// a due date written as "due YYYY-MM-DD" or "by YYYY-MM-DD". They stay outstanding until
+// "!actions done N", and "!actions" lists them.
+//
+// Example JSON request:
+//   {
+//       "rooms": ["!team:localhost"]
+//   }
+type Service struct {
+	types.DefaultService
+	// The rooms in which meetings can be held.
+	Rooms []id.RoomID `json:"rooms"`
+}
+
+// note is a decision or action item taken down during a meeting.
+type note struct {
+	Kind          string    `json:"kind"`
+	Text          string    `json:"text"`
+	UserID        id.UserID `json:"user_id"`
+	TimestampSecs int64     `json:"timestamp_secs"`
+	// Action items only
+	ActionID  int         `json:"action_id,omitempty"`
+	Assignees []id.UserID `json:"assignees,omitempty"`
+	Due       string      `json:"due,omitempty"`
+}
+
+// meeting is a meeting which is being held or has ended. The room's current meeting is stored in
+// the service state under "meeting" and the room ID, and the minutes of its past meetings under
+// "minutes" and the room ID, oldest first.
+type meeting struct {
+	StartedBy            id.UserID `json:"started_by"`
+	StartedTimestampSecs int64     `json:"started_timestamp_secs"`
+	EndedTimestampSecs   int64     `json:"ended_timestamp_secs,omitempty"`
+	Notes                []note    `json:"notes"`
+}
+
+// actions are a room's outstanding action items. They are stored in the service state under
+// "actions" and the room ID.
+type actions struct {
+	NextID int    `json:"next_id"`
+	Open   []note `json:"open"`
+}
+
+// Commands supported:
+//    !meeting start
+// Starts taking the minutes of a meeting in this room.
+//    !meeting end
+// Ends the meeting, and responds with its minutes.
+//    !meeting last
+// Responds with the minutes of the last meeting in this room.
+//    !actions
+// Responds with the outstanding action items of this room.
+//    !actions done N
+// Marks action item N as done.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"meeting", "start"},
+			Help: "Start taking the minutes of a meeting, noting messages tagged #action or #decision",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdStart(roomID, userID, time.Now())
+			},
+		},
+		{
+			Path: []string{"meeting", "end"},
+			Help: "End the meeting and post its minutes",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdEnd(roomID, time.Now())
+			},
+		},
+		{
+			Path: []string{"meeting", "last"},
+			Help: "Post the minutes of the last meeting",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdLast(roomID)
+			},
+		},
+		{
+			Path: []string{"actions"},
+			Help: "List the outstanding action items",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdActions(roomID, time.Now())
+			},
+		},
+		{
+			Path:      []string{"actions", "done"},
+			Arguments: []string{"N"},
+			Help:      "Mark an action item as done",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdDone(roomID, userID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) inRoom(roomID id.RoomID) bool {
+	for _, r := range s.Rooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) cmdStart(roomID id.RoomID, userID id.UserID, now time.Time) (interface{}, error) {
+	if !s.inRoom(roomID) {
+		return nil, fmt.Errorf("Meetings can't be held in this room")
+	}
+	meetingsMutex.Lock()
+	defer meetingsMutex.Unlock()
+	m, err := s.loadMeeting(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		return nil, fmt.Errorf("A meeting started by %s is already being held. End it with !meeting end", m.StartedBy)
+	}
+	m = &meeting{StartedBy: userID, StartedTimestampSecs: now.Unix()}
+	if err = s.storeMeeting(roomID, m); err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    "📝 Taking the minutes. Tag messages with #action or #decision to note them down, and end the meeting with !meeting end",
+	}, nil
+}
+
+func (s *Service) cmdEnd(roomID id.RoomID, now time.Time) (interface{}, error) {
+	meetingsMutex.Lock()
+	defer meetingsMutex.Unlock()
+	m, err := s.loadMeeting(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("No meeting is being held in this room")
+	}
+	m.EndedTimestampSecs = now.Unix()
+
+	past, err := s.loadMinutes(roomID)
+	if err != nil {
+		return nil, err
+	}
+	past = append(past, *m)
+	if len(past) > maxMinutes {
+		past = past[len(past)-maxMinutes:]
+	}
+	if err = s.storeMinutes(roomID, past); err != nil {
+		return nil, err
+	}
+	if err = database.GetServiceDB().DeleteServiceState(s.ServiceID(), "meeting "+roomID.String()); err != nil {
+		return nil, err
+	}
+	return m.summary(), nil
+}
+
+func (s *Service) cmdLast(roomID id.RoomID) (interface{}, error) {
+	meetingsMutex.Lock()
+	past, err := s.loadMinutes(roomID)
+	meetingsMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(past) == 0 {
+		return nil, fmt.Errorf("No meetings have been held in this room")
+	}
+	return past[len(past)-1].summary(), nil
+}
+
+func (s *Service) cmdActions(roomID id.RoomID, now time.Time) (interface{}, error) {
+	meetingsMutex.Lock()
+	state, err := s.loadActions(roomID)
+	meetingsMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(state.Open) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "There are no outstanding action items in this room",
+		}, nil
+	}
+	lines := []string{fmt.Sprintf("Outstanding action items (%d):", len(state.Open))}
+	today := now.UTC().Format("2006-01-02")
+	for _, a := range state.Open {
+		line := a.actionString()
+		if a.Due != "" && a.Due < today {
+			line += " (overdue)"
+		}
+		lines = append(lines, line)
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    strings.Join(lines, "\n"),
+	}, nil
+}
+
+func (s *Service) cmdDone(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !actions done N")
+	}
+	actionID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return nil, fmt.Errorf("Usage: !actions done N")
+	}
+	meetingsMutex.Lock()
+	defer meetingsMutex.Unlock()
+	state, err := s.loadActions(roomID)
+	if err != nil {
+		return nil, err
+	}
+	for i, a := range state.Open {
+		if a.ActionID != actionID {
+			continue
+		}
+		state.Open = append(state.Open[:i], state.Open[i+1:]...)
+		if err = s.storeActions(roomID, state); err != nil {
+			return nil, err
+		}
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("✅ %s marked #%d as done: %s", userID, a.ActionID, a.Text),
+		}, nil
+	}
+	return nil, fmt.Errorf("There is no outstanding action item #%d in this room", actionID)
+}
+
+// OnMessage notes down the messages tagged with #action or #decision during a meeting.
+func (s *Service) OnMessage(cli types.MatrixClient, evt *mevt.Event) {
+	if evt.Type != mevt.EventMessage || !s.inRoom(evt.RoomID) {
+		return
+	}
+	msg := evt.Content.AsMessage()
+	if msg.MsgType != mevt.MsgText || strings.HasPrefix(msg.Body, "!") {
+		return
+	}
+	// Edits repeat the tags of the message they edit
+	if rel := msg.RelatesTo; rel != nil && rel.Type == mevt.RelReplace {
+		return
+	}
+	n := parseNote(msg, evt.Sender, time.Unix(0, evt.Timestamp*int64(time.Millisecond)))
+	if n == nil {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    evt.RoomID,
+		"user_id":    evt.Sender,
+	})
+
+	meetingsMutex.Lock()
+	defer meetingsMutex.Unlock()
+	m, err := s.loadMeeting(evt.RoomID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load meeting")
+		return
+	}
+	if m == nil || len(m.Notes) >= maxNotes {
+		return
+	}
+	if n.Kind == kindAction {
+		state, err := s.loadActions(evt.RoomID)
+		if err != nil {
+			logger.WithError(err).Error("Failed to load action items")
+			return
+		}
+		if len(state.Open) >= maxActions {
+			logger.Warn("Too many outstanding action items to add another")
+			return
+		}
+		state.NextID++
+		n.ActionID = state.NextID
+		state.Open = append(state.Open, *n)
+		if err = s.storeActions(evt.RoomID, state); err != nil {
+			logger.WithError(err).Error("Failed to store action items")
+			return
+		}
+	}
+	m.Notes = append(m.Notes, *n)
+	if err = s.storeMeeting(evt.RoomID, m); err != nil {
+		logger.WithError(err).Error("Failed to store meeting")
+	}
+}
+
+// parseNote returns the note of a message tagged with #action or #decision, or nil if it isn't
+// tagged.
+func parseNote(msg *mevt.MessageEventContent, sender id.UserID, sent time.Time) *note {
+	match := tagRegex.FindStringSubmatch(msg.Body)
+	if match == nil {
+		return nil
+	}
+	text := strings.Join(strings.Fields(tagRegex.ReplaceAllString(msg.Body, "$1")), " ")
+	if text == "" {
+		return nil
+	}
+	n := &note{
+		Kind:          strings.ToLower(match[2]),
+		Text:          text,
+		UserID:        sender,
+		TimestampSecs: sent.Unix(),
+	}
+	if n.Kind != kindAction {
+		return n
+	}
+	seen := make(map[id.UserID]bool)
+	for _, u := range userIDRegex.FindAllString(msg.Body+" "+msg.FormattedBody, -1) {
+		userID := id.UserID(strings.TrimRight(u, ".-"))
+		if !seen[userID] {
+			seen[userID] = true
+			n.Assignees = append(n.Assignees, userID)
+		}
+	}
+	if due := dueRegex.FindStringSubmatch(msg.Body); due != nil {
+		if _, err := time.Parse("2006-01-02", due[1]); err == nil {
+			n.Due = due[1]
+		}
+	}
+	return n
+}
+
+// actionString returns the action item on one line, e.g.
+// "#3 Write the release notes – @link:example.com, due 2021-06-10".
+func (n *note) actionString() string {
+	s := fmt.Sprintf("#%d %s", n.ActionID, n.Text)
+	var who []string
+	for _, u := range n.Assignees {
+		who = append(who, string(u))
+	}
+	if len(who) == 0 {
+		who = append(who, "unassigned")
+	}
+	s += " – " + strings.Join(who, ", ")
+	if n.Due != "" {
+		s += ", due " + n.Due
+	}
+	return s
+}
+
+// summary is the minutes of the meeting.
+func (m *meeting) summary() *mevt.MessageEventContent {
+	started := time.Unix(m.StartedTimestampSecs, 0)
+	duration := "under a minute"
+	if d := time.Unix(m.EndedTimestampSecs, 0).Sub(started); d >= time.Minute {
+		duration = strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+	}
+	heading := fmt.Sprintf("📝 Minutes of the meeting started by %s at %s (%s)",
+		m.StartedBy, started.UTC().Format("Mon 2 Jan 15:04 MST"), duration)
+	lines := []string{heading}
+	formatted := "<b>" + html.EscapeString(heading) + "</b>"
+	for _, section := range []struct {
+		Kind  string
+		Title string
+	}{
+		{kindDecision, "Decisions"},
+		{kindAction, "Action items"},
+	} {
+		var items []string
+		for _, n := range m.Notes {
+			if n.Kind != section.Kind {
+				continue
+			}
+			if n.Kind == kindAction {
+				items = append(items, n.actionString())
+			} else {
+				items = append(items, fmt.Sprintf("%s (%s)", n.Text, n.UserID))
+			}
+		}
+		if len(items) == 0 {
+			continue
+		}
+		lines = append(lines, section.Title+":")
+		formatted += "<br>" + section.Title + ":<ul>"
+		for _, item := range items {
+			lines = append(lines, " - "+item)
+			formatted += "<li>" + html.EscapeString(item) + "</li>"
+		}
+		formatted += "</ul>"
+	}
+	if len(m.Notes) == 0 {
+		lines = append(lines, "No decisions or action items were noted.")
+		formatted += "<br>No decisions or action items were noted."
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: formatted,
+	}
+}
+
+// loadMeeting returns the meeting being held in the room, or nil if there isn't one.
+func (s *Service) loadMeeting(roomID id.RoomID) (*meeting, error) {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "meeting "+roomID.String())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m := &meeting{}
+	err = json.Unmarshal(stateJSON, m)
+	return m, err
+}
+
+func (s *Service) storeMeeting(roomID id.RoomID, m *meeting) error {
+	return s.storeState("meeting "+roomID.String(), m)
+}
+
+func (s *Service) loadMinutes(roomID id.RoomID) ([]meeting, error) {
+	var past []meeting
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "minutes "+roomID.String())
+	if err == sql.ErrNoRows {
+		return past, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(stateJSON, &past)
+	return past, err
+}
+
+func (s *Service) storeMinutes(roomID id.RoomID, past []meeting) error {
+	return s.storeState("minutes "+roomID.String(), past)
+}
+
+func (s *Service) loadActions(roomID id.RoomID) (*actions, error) {
+	state := &actions{}
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "actions "+roomID.String())
+	if err == sql.ErrNoRows {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(stateJSON, state)
+	return state, err
+}
+
+func (s *Service) storeActions(roomID id.RoomID, state *actions) error {
+	return s.storeState("actions "+roomID.String(), state)
+}
+
+func (s *Service) storeState(key string, v interface{}) error {
+	stateJSON, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), key, stateJSON)
+}
+
+// Register makes sure that rooms are configured, and joins them.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	for _, roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package minutes
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func message(roomID id.RoomID, sender id.UserID, sent time.Time, content mevt.MessageEventContent) *mevt.Event {
+	evt := &mevt.Event{
+		Type:      mevt.EventMessage,
+		RoomID:    roomID,
+		Sender:    sender,
+		Timestamp: sent.UnixNano() / int64(time.Millisecond),
+	}
+	evt.Content.Parsed = &content
+	return evt
+}
+
+func TestParseNote(t *testing.T) {
+	sent := time.Date(2021, 6, 7, 9, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		msg  mevt.MessageEventContent
+		want string // "" if it isn't a note
+	}{
+		{mevt.MessageEventContent{Body: "#decision We ship on Friday"}, "decision|We ship on Friday|[]|"},
+		{mevt.MessageEventContent{Body: "We ship on Friday #DECISION"}, "decision|We ship on Friday|[]|"},
+		{mevt.MessageEventContent{Body: "#action: @link:hyrule and @zelda:hyrule write the notes, due 2021-06-10."},
+			"action|@link:hyrule and @zelda:hyrule write the notes, due 2021-06-10.|[@link:hyrule @zelda:hyrule]|2021-06-10"},
+		// Not a real date
+		{mevt.MessageEventContent{
+			Body:          "#action Link: fix the gate by 2021-02-30",
+			FormattedBody: `#action <a href="https://matrix.to/#/@link:hyrule">Link</a>: fix the gate by 2021-02-30`,
+		}, "action|Link: fix the gate by 2021-02-30|[@link:hyrule]|"},
+		{mevt.MessageEventContent{Body: "We need more #actionable items"}, ""},
+		{mevt.MessageEventContent{Body: "#action"}, ""},
+	} {
+		got := ""
+		if n := parseNote(&tc.msg, "@impa:hyrule", sent); n != nil {
+			got = fmt.Sprintf("%s|%s|%v|%s", n.Kind, n.Text, n.Assignees, n.Due)
+		}
+		if got != tc.want {
+			t.Errorf("parseNote(%q) => got %q, want %q", tc.msg.Body, got, tc.want)
+		}
+	}
+}
+
+func TestMeeting(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"rooms": ["!castle:hyrule"]}`))
+	if err != nil {
+		t.Fatal("Failed to create minutes service: ", err)
+	}
+	s := srv.(*Service)
+	start := time.Date(2021, 6, 7, 9, 0, 0, 0, time.UTC)
+
+	// Nothing is noted outside meetings
+	s.OnMessage(nil, message("!castle:hyrule", "@impa:hyrule", start, mevt.MessageEventContent{
+		MsgType: mevt.MsgText, Body: "#decision Nobody is listening",
+	}))
+	if _, err = s.cmdStart("!termina:hyrule", "@zelda:hyrule", start); err == nil {
+		t.Error("Expected a meeting outside the rooms to be refused")
+	}
+	if _, err = s.cmdStart("!castle:hyrule", "@zelda:hyrule", start); err != nil {
+		t.Fatal("Failed to start meeting: ", err)
+	}
+	if _, err = s.cmdStart("!castle:hyrule", "@link:hyrule", start); err == nil {
+		t.Error("Expected a second meeting to be refused")
+	}
+	for _, msg := range []struct {
+		sender  id.UserID
+		content mevt.MessageEventContent
+	}{
+		{"@zelda:hyrule", mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "#decision Seal Ganon in the castle"}},
+		{"@impa:hyrule", mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "Sounds good to me"}},
+		{"@impa:hyrule", mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "#decision Notices are ignored"}},
+		{"@zelda:hyrule", mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "#action @link:hyrule finds the Master Sword, due 2021-06-01"}},
+		{"@zelda:hyrule", mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "#action Gather the sages"}},
+	} {
+		s.OnMessage(nil, message("!castle:hyrule", msg.sender, start.Add(5*time.Minute), msg.content))
+	}
+
+	res, err := s.cmdEnd("!castle:hyrule", start.Add(45*time.Minute))
+	if err != nil {
+		t.Fatal("Failed to end meeting: ", err)
+	}
+	want := "📝 Minutes of the meeting started by @zelda:hyrule at Mon 7 Jun 09:00 UTC (45m)\n" +
+		"Decisions:\n" +
+		" - Seal Ganon in the castle (@zelda:hyrule)\n" +
+		"Action items:\n" +
+		" - #1 @link:hyrule finds the Master Sword, due 2021-06-01 – @link:hyrule, due 2021-06-01\n" +
+		" - #2 Gather the sages – unassigned"
+	if got := res.(*mevt.MessageEventContent).Body; got != want {
+		t.Errorf("Bad minutes:\ngot  %q\nwant %q", got, want)
+	}
+	if res, err = s.cmdLast("!castle:hyrule"); err != nil || res.(*mevt.MessageEventContent).Body != want {
+		t.Errorf("Bad last minutes: %v, %v", res, err)
+	}
+	if _, err = s.cmdEnd("!castle:hyrule", start.Add(time.Hour)); err == nil {
+		t.Error("Expected ending a meeting which has ended to fail")
+	}
+
+	res, err = s.cmdActions("!castle:hyrule", start.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal("Failed to list action items: ", err)
+	}
+	want = "Outstanding action items (2):\n" +
+		"#1 @link:hyrule finds the Master Sword, due 2021-06-01 – @link:hyrule, due 2021-06-01 (overdue)\n" +
+		"#2 Gather the sages – unassigned"
+	if got := res.(*mevt.MessageEventContent).Body; got != want {
+		t.Errorf("Bad action items:\ngot  %q\nwant %q", got, want)
+	}
+	if _, err = s.cmdDone("!castle:hyrule", "@link:hyrule", []string{"#1"}); err != nil {
+		t.Fatal("Failed to mark action item as done: ", err)
+	}
+	if _, err = s.cmdDone("!castle:hyrule", "@link:hyrule", []string{"1"}); err == nil {
+		t.Error("Expected marking an action item as done twice to fail")
+	}
+	res, _ = s.cmdActions("!castle:hyrule", start)
+	if got := res.(*mevt.MessageEventContent).Body; got != "Outstanding action items (1):\n#2 Gather the sages – unassigned" {
+		t.Errorf("Bad action items after marking one as done: %q", got)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create minutes service: ", err)
+	}
+	if err = srv.Register(nil, nil); err == nil {
+		t.Error("Expected a service without rooms to be refused")
+	}
+}
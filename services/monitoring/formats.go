@@ -0,0 +1,173 @@
+package monitoring
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/go-neb/notify"
+)
+
+// The kinds of event which are posted.
+const (
+	kindProblem  = "problem"
+	kindRecovery = "recovery"
+)
+
+// event is a Zabbix or Icinga notification, in the form the service posts it.
+type event struct {
+	// kindProblem or kindRecovery
+	Kind string
+	// Identifies the problem, so that its recovery can be matched with it
+	Key      string
+	Severity notify.Severity
+	// The label shown for the severity, e.g. "High" or "CRITICAL"
+	SeverityLabel string
+	Host          string
+	// What the problem is, e.g. "Disk space is low" or the name of the Icinga service
+	Name string
+	// Optional. More about the problem, e.g. the output of the check
+	Details string
+	// Optional. A link to the problem in the monitoring system's web interface
+	URL string
+}
+
+// zabbixWebhook is sent by a Zabbix webhook media type whose parameters are named after the
+// macros they hold, e.g. "event_id" for {EVENT.ID}.
+type zabbixWebhook struct {
+	EventID string `json:"event_id"`
+	// "1" for a problem and "0" for a recovery
+	EventValue string `json:"event_value"`
+	// "1" when the problem has been updated, e.g. acknowledged
+	EventUpdateStatus string `json:"event_update_status"`
+	EventName         string `json:"event_name"`
+	// The severity from 0 (not classified) to 5 (disaster)
+	EventNSeverity  string `json:"event_nseverity"`
+	EventSeverity   string `json:"event_severity"`
+	HostName        string `json:"host_name"`
+	TriggerID       string `json:"trigger_id"`
+	OperationalData string `json:"event_opdata"`
+	ZabbixURL       string `json:"zabbix_url"`
+}
+
+// event returns the event to post, or nil if it isn't a problem or recovery.
+func (z *zabbixWebhook) event() (*event, error) {
+	if z.EventID == "" || z.EventName == "" {
+		return nil, fmt.Errorf("event_id and event_name are required")
+	}
+	if z.EventUpdateStatus == "1" {
+		return nil, nil
+	}
+	ev := &event{
+		Key:           "zabbix " + z.EventID,
+		Host:          z.HostName,
+		Name:          z.EventName,
+		Details:       z.OperationalData,
+		SeverityLabel: z.EventSeverity,
+	}
+	switch z.EventValue {
+	case "1":
+		ev.Kind = kindProblem
+	case "0":
+		ev.Kind = kindRecovery
+	default:
+		return nil, nil
+	}
+	n, _ := strconv.Atoi(z.EventNSeverity)
+	switch {
+	case n >= 4:
+		ev.Severity = notify.SeverityCritical
+	case n >= 2:
+		ev.Severity = notify.SeverityWarning
+	default:
+		ev.Severity = notify.SeverityInfo
+	}
+	if ev.SeverityLabel == "" {
+		ev.SeverityLabel = string(ev.Severity)
+	}
+	if z.ZabbixURL != "" && z.TriggerID != "" {
+		ev.URL = strings.TrimSuffix(z.ZabbixURL, "/") + "/tr_events.php?" + url.Values{
+			"triggerid": {z.TriggerID},
+			"eventid":   {z.EventID},
+		}.Encode()
+	}
+	return ev, nil
+}
+
+// icingaWebhook is sent by an Icinga 2 notification command whose arguments are named after the
+// runtime macros they hold, e.g. "service_state" for $service.state$.
+type icingaWebhook struct {
+	// e.g. "PROBLEM", "RECOVERY" or "ACKNOWLEDGEMENT"
+	NotificationType string `json:"notification_type"`
+	HostName         string `json:"host_name"`
+	HostDisplayName  string `json:"host_display_name"`
+	// "UP", "DOWN" or "UNREACHABLE"
+	HostState   string `json:"host_state"`
+	HostOutput  string `json:"host_output"`
+	ServiceName string `json:"service_name"`
+	// Optional, for notifications about hosts rather than services
+	ServiceDisplayName string `json:"service_display_name"`
+	// "OK", "WARNING", "CRITICAL" or "UNKNOWN"
+	ServiceState  string `json:"service_state"`
+	ServiceOutput string `json:"service_output"`
+	// Optional. The URL of Icinga Web 2, e.g. "https://monitoring.example.com/icingaweb2"
+	IcingaWeb2URL string `json:"icingaweb2_url"`
+}
+
+// event returns the event to post, or nil if it isn't a problem or recovery.
+func (i *icingaWebhook) event() (*event, error) {
+	if i.HostName == "" {
+		return nil, fmt.Errorf("host_name is required")
+	}
+	ev := &event{
+		Host: i.HostDisplayName,
+	}
+	if ev.Host == "" {
+		ev.Host = i.HostName
+	}
+	switch strings.ToUpper(i.NotificationType) {
+	case "PROBLEM":
+		ev.Kind = kindProblem
+	case "RECOVERY":
+		ev.Kind = kindRecovery
+	default:
+		return nil, nil
+	}
+
+	webPath, webQuery := "/monitoring/host/show", url.Values{"host": {i.HostName}}
+	if i.ServiceName != "" {
+		ev.Key = "icinga " + i.HostName + "!" + i.ServiceName
+		ev.Name = i.ServiceDisplayName
+		if ev.Name == "" {
+			ev.Name = i.ServiceName
+		}
+		ev.Details = i.ServiceOutput
+		ev.SeverityLabel = strings.ToUpper(i.ServiceState)
+		switch ev.SeverityLabel {
+		case "CRITICAL":
+			ev.Severity = notify.SeverityCritical
+		case "WARNING", "UNKNOWN":
+			ev.Severity = notify.SeverityWarning
+		default:
+			ev.Severity = notify.SeverityInfo
+		}
+		webPath = "/monitoring/service/show"
+		webQuery.Set("service", i.ServiceName)
+	} else {
+		ev.Key = "icinga " + i.HostName
+		ev.Name = "Host " + strings.ToLower(i.HostState)
+		ev.Details = i.HostOutput
+		ev.SeverityLabel = strings.ToUpper(i.HostState)
+		switch ev.SeverityLabel {
+		case "DOWN", "UNREACHABLE":
+			ev.Severity = notify.SeverityCritical
+		default:
+			ev.Severity = notify.SeverityInfo
+		}
+	}
+	if i.IcingaWeb2URL != "" {
+		ev.URL = strings.TrimSuffix(i.IcingaWeb2URL, "/") + webPath + "?" + webQuery.Encode()
+	}
+	return ev, nil
+}
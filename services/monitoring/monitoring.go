@@ -0,0 +1,340 @@
+// Package monitoring implements a Service which posts Zabbix and Icinga 2 notifications into
+// rooms.
+package monitoring
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Monitoring service
+const ServiceType = "monitoring"
+
+// The most a webhook's body can be
+const maxWebhookSize = 1 << 20
+
+// The values of on_recovery.
+const (
+	recoveryEdit    = "edit"
+	recoveryThread  = "thread"
+	recoveryMessage = "message"
+)
+
+// How important each severity is, for routing by min_severity
+var severityRank = map[notify.Severity]int{
+	notify.SeverityInfo:     0,
+	notify.SeverityWarning:  1,
+	notify.SeverityCritical: 2,
+}
+
+// timeNow is replaced in tests.
+var timeNow = time.Now
+
+// Service contains the Config fields for the Monitoring service.
+//
+// Zabbix and Icinga 2 send notifications to the zabbix_webhook_url and icinga_webhook_url, with
+// "&token=" and the token added. Zabbix sends them from a webhook media type, and Icinga from a
+// notification command, as JSON objects whose fields are named after the macros they hold:
+//   Zabbix: event_id, event_value, event_update_status, event_name, event_nseverity,
+//           event_severity, event_opdata, host_name, trigger_id and zabbix_url
+//   Icinga: notification_type, host_name, host_display_name, host_state, host_output,
+//           service_name, service_display_name, service_state, service_output and icingaweb2_url
+//
+// Problems are posted into the rooms whose min_severity they meet. Zabbix's "Warning" and
+// "Average" severities are "warning", and "High" and "Disaster" are "critical". Icinga's WARNING
+// and UNKNOWN states are "warning", and CRITICAL, DOWN and UNREACHABLE are "critical".
+//
+// When a problem recovers, the message it was posted in is edited to say so. Set on_recovery to
+// "thread" to reply to the message instead, or to "message" to post a new message.
+//
+// Example JSON request:
+//   {
+//       "token": "a_long_random_string",
+//       "rooms": {
+//           "!ops:localhost": {
+//               "min_severity": "warning"
+//           },
+//           "!oncall:localhost": {
+//               "min_severity": "critical",
+//               "on_recovery": "thread"
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which Zabbix should send notifications to. Populated by Go-NEB after Service
+	// registration.
+	ZabbixWebhookURL string `json:"zabbix_webhook_url"`
+	// The URL which Icinga should send notifications to. Populated by Go-NEB after Service
+	// registration.
+	IcingaWebhookURL string `json:"icinga_webhook_url"`
+	// The token which notifications must have, so that nobody else can post to rooms.
+	Token string `json:"token"`
+	// The rooms to post notifications into.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is which notifications a room is sent, and how.
+type RoomConfig struct {
+	// Optional. The least severe problems to post: "info", "warning" or "critical". Defaults to
+	// "info".
+	MinSeverity notify.Severity `json:"min_severity"`
+	// Optional. What to do when a problem which was posted in the room recovers: "edit" the
+	// message (the default), reply to it in a "thread", or send a new "message".
+	OnRecovery string `json:"on_recovery"`
+}
+
+func (r *RoomConfig) wants(severity notify.Severity) bool {
+	return severityRank[severity] >= severityRank[r.MinSeverity]
+}
+
+// sentProblem is stored for each problem which was posted in a room, until it recovers.
+type sentProblem struct {
+	// The message the problem was posted in.
+	EventID id.EventID
+	Content mevt.MessageEventContent
+	// When the problem was posted.
+	Sent time.Time
+}
+
+func problemStateKey(roomID id.RoomID, key string) string {
+	return "problem " + roomID.String() + " " + key
+}
+
+// OnReceiveWebhook posts the Zabbix or Icinga notification into the rooms which want it.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+		w.WriteHeader(403)
+		return
+	}
+
+	logger := log.WithField("service_id", s.ServiceID())
+	body := io.LimitReader(req.Body, maxWebhookSize)
+	var ev *event
+	var err error
+	switch source := req.URL.Query().Get("source"); source {
+	case "zabbix":
+		var hook zabbixWebhook
+		if err = json.NewDecoder(body).Decode(&hook); err == nil {
+			ev, err = hook.event()
+		}
+	case "icinga":
+		var hook icingaWebhook
+		if err = json.NewDecoder(body).Decode(&hook); err == nil {
+			ev, err = hook.event()
+		}
+	default:
+		err = fmt.Errorf("Unknown source '%s'", source)
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Bad monitoring webhook")
+		w.WriteHeader(400)
+		return
+	}
+	if ev == nil {
+		// Not an event which is posted, e.g. an acknowledgement
+		w.WriteHeader(200)
+		return
+	}
+
+	for roomID, room := range s.Rooms {
+		if ev.Kind == kindRecovery && room.OnRecovery != recoveryMessage && s.recoverSentProblem(cli, roomID, room, ev) {
+			continue
+		}
+		if !room.wants(ev.Severity) {
+			continue
+		}
+		content := problemContent(ev)
+		eventID, err := notify.Send(cli, s, notify.Notification{
+			RoomID:         roomID,
+			Content:        content,
+			Severity:       ev.Severity,
+			CorrelationKey: ev.Key,
+		})
+		if err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to send monitoring notification")
+			continue
+		}
+		if ev.Kind == kindProblem && eventID != "" && room.OnRecovery != recoveryMessage {
+			s.trackProblem(roomID, ev.Key, sentProblem{eventID, content, timeNow()})
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// problemContent is the message which a problem or recovery is posted in.
+func problemContent(ev *event) mevt.MessageEventContent {
+	icon := "ℹ️"
+	switch {
+	case ev.Kind == kindRecovery:
+		icon = "✅"
+	case ev.Severity == notify.SeverityCritical:
+		icon = "🔥"
+	case ev.Severity == notify.SeverityWarning:
+		icon = "⚠️"
+	}
+	label := ev.SeverityLabel
+	if ev.Kind == kindRecovery {
+		label = "RECOVERED"
+	}
+	title := ev.Name
+	if ev.Host != "" {
+		title = ev.Host + ": " + ev.Name
+	}
+	body := fmt.Sprintf("%s [%s] %s", icon, label, title)
+	formatted := fmt.Sprintf("%s <strong>[%s]</strong> %s", icon, html.EscapeString(label), html.EscapeString(title))
+	if ev.URL != "" {
+		formatted = fmt.Sprintf(`%s <strong>[%s]</strong> <a href="%s">%s</a>`,
+			icon, html.EscapeString(label), html.EscapeString(ev.URL), html.EscapeString(title))
+	}
+	if ev.Details != "" {
+		body += "\n" + ev.Details
+		formatted += "<br>" + html.EscapeString(ev.Details)
+	}
+	if ev.URL != "" {
+		body += "\n" + ev.URL
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          body,
+		Format:        mevt.FormatHTML,
+		FormattedBody: formatted,
+	}
+}
+
+// trackProblem remembers which message the problem was posted in, so that it can be marked as
+// recovered. Problems which are posted again, e.g. by escalations, keep their first message.
+func (s *Service) trackProblem(roomID id.RoomID, key string, sent sentProblem) {
+	stateKey := problemStateKey(roomID, key)
+	if _, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), stateKey); err != sql.ErrNoRows {
+		return
+	}
+	stateJSON, err := json.Marshal(sent)
+	if err == nil {
+		err = database.GetServiceDB().StoreServiceState(s.ServiceID(), stateKey, stateJSON)
+	}
+	if err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to store monitoring problem")
+	}
+}
+
+// recoverSentProblem returns true if the problem was posted in the room and has now been marked
+// as recovered, by editing or replying to its message.
+func (s *Service) recoverSentProblem(cli types.MatrixClient, roomID id.RoomID, room RoomConfig, ev *event) bool {
+	logger := log.WithFields(log.Fields{
+		"room_id": roomID,
+		"key":     ev.Key,
+	})
+	stateKey := problemStateKey(roomID, ev.Key)
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), stateKey)
+	if err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		logger.WithError(err).Error("Failed to load monitoring problem")
+		return false
+	}
+	var sent sentProblem
+	if err = json.Unmarshal(stateJSON, &sent); err != nil {
+		logger.WithError(err).Error("Failed to load monitoring problem")
+		return false
+	}
+
+	line := "✅ Recovered after " + formatDuration(timeNow().Sub(sent.Sent))
+	var content map[string]interface{}
+	if room.OnRecovery == recoveryThread {
+		content, err = notify.ThreadReplyContent(sent.EventID, sent.EventID, mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    line,
+		})
+	} else {
+		edited := sent.Content
+		edited.Body += "\n\n" + line
+		if edited.FormattedBody != "" {
+			edited.FormattedBody += "<br><br>" + html.EscapeString(line)
+		}
+		content, err = notify.EditContent(sent.EventID, edited)
+	}
+	if err == nil {
+		_, err = cli.SendMessageEvent(roomID, mevt.EventMessage, content)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to mark monitoring problem as recovered")
+		return false
+	}
+	if err = database.GetServiceDB().DeleteServiceState(s.ServiceID(), stateKey); err != nil {
+		logger.WithError(err).Error("Failed to forget recovered monitoring problem")
+	}
+	return true
+}
+
+// formatDuration returns a short form of the duration, e.g. "1h23m".
+func formatDuration(d time.Duration) string {
+	mins := int(d.Round(time.Minute).Minutes())
+	switch {
+	case mins < 1:
+		return "less than a minute"
+	case mins < 60:
+		return fmt.Sprintf("%dm", mins)
+	case mins < 24*60:
+		return fmt.Sprintf("%dh%dm", mins/60, mins%60)
+	default:
+		return fmt.Sprintf("%dd%dh", mins/(24*60), mins%(24*60)/60)
+	}
+}
+
+// Register makes sure the Config information supplied is valid, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.ZabbixWebhookURL = s.webhookEndpointURL + "?source=zabbix"
+	s.IcingaWebhookURL = s.webhookEndpointURL + "?source=icinga"
+	if len(s.Token) < 16 {
+		return fmt.Errorf("A token of at least 16 characters is required")
+	}
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	for roomID, room := range s.Rooms {
+		if _, ok := severityRank[room.MinSeverity]; !ok && room.MinSeverity != "" {
+			return fmt.Errorf("Bad min_severity '%s' for room %s: must be info, warning or critical", room.MinSeverity, roomID)
+		}
+		switch room.OnRecovery {
+		case "", recoveryEdit, recoveryThread, recoveryMessage:
+		default:
+			return fmt.Errorf("Bad on_recovery '%s' for room %s: must be edit, thread or message", room.OnRecovery, roomID)
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
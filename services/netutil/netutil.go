@@ -0,0 +1,335 @@
+// Package netutil implements a Service which does DNS and WHOIS lookups.
+package netutil
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Net util service
+const ServiceType = "netutil"
+
+const (
+	defaultMaxOutputLines = 30
+	lookupTimeout         = 10 * time.Second
+	// The WHOIS server which knows the WHOIS server of every TLD
+	ianaWhoisServer = "whois.iana.org"
+)
+
+// A DNS name or WHOIS server, e.g. "matrix.org" or "_matrix._tcp.matrix.org"
+var hostnameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]([a-zA-Z0-9_-]*[a-zA-Z0-9_])?(\.[a-zA-Z0-9_]([a-zA-Z0-9_-]*[a-zA-Z0-9_])?)*\.?$`)
+
+// The lines of WHOIS responses which refer to another server
+var whoisReferRegex = regexp.MustCompile(`(?im)^\s*(?:refer|whois|registrar whois server):\s*(?:whois://)?(\S+)\s*$`)
+
+// resolver is the part of net.Resolver used by !dig.
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupCNAME(ctx context.Context, host string) (string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupNS(ctx context.Context, name string) ([]*net.NS, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// newResolver returns a resolver which asks the DNS server at the address, or the system's
+// resolver if the address is empty. Overridden by tests.
+var newResolver = func(address string) resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// whoisQuery sends the query to the WHOIS server and returns its response. Overridden by tests.
+var whoisQuery = func(server, query string) (string, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(server, "43"), lookupTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(lookupTimeout))
+	if _, err = conn.Write([]byte(query + "\r\n")); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	buf := make([]byte, 4096)
+	for b.Len() < 1<<20 {
+		n, err := conn.Read(buf)
+		b.Write(buf[:n])
+		if err != nil {
+			break
+		}
+	}
+	return b.String(), nil
+}
+
+// Service contains the Config fields for the Net util service.
+//
+// "!dig matrix.org MX" looks up DNS records, using the system's resolver unless another DNS server
+// is configured. "!whois matrix.org" asks IANA for the WHOIS server of the TLD, and follows its
+// referral to the registrar's WHOIS server if there is one. Results are posted as code blocks,
+// cut short after max_output_lines.
+//
+// Example JSON request:
+//   {
+//       "resolver": "1.1.1.1",
+//       "max_output_lines": 20
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The DNS server to use, as "host" or "host:port". Defaults to the system's resolver.
+	Resolver string `json:"resolver"`
+	// Optional. The most lines of output to post. Defaults to 30.
+	MaxOutputLines int `json:"max_output_lines"`
+}
+
+// Commands supported:
+//    !dig name [type]
+// Responds with the DNS records of the name. The type is one of A, AAAA, CNAME, MX, NS, TXT, SRV
+// or PTR, and defaults to A, or PTR if the name is an IP address.
+//    !whois domain
+// Responds with the WHOIS record of the domain.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"dig"},
+			Arguments: []string{"name", "[type]"},
+			Help:      "Look up DNS records, e.g. !dig matrix.org MX",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdDig(args)
+			},
+		},
+		{
+			Path:      []string{"whois"},
+			Arguments: []string{"domain"},
+			Help:      "Look up who a domain is registered to",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdWhois(args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdDig(args []string) (interface{}, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("Usage: !dig name [type]")
+	}
+	name := args[0]
+	recordType := "A"
+	if net.ParseIP(name) != nil {
+		recordType = "PTR"
+	} else if !hostnameRegex.MatchString(name) || len(name) > 253 {
+		return nil, fmt.Errorf("'%s' is not a DNS name", name)
+	}
+	if len(args) == 2 {
+		recordType = strings.ToUpper(args[1])
+	}
+	if recordType == "PTR" && net.ParseIP(name) == nil {
+		return nil, fmt.Errorf("PTR lookups need an IP address")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	r := newResolver(s.resolverAddress())
+	var records []string
+	var err error
+	switch recordType {
+	case "A", "AAAA":
+		var addrs []net.IPAddr
+		addrs, err = r.LookupIPAddr(ctx, name)
+		for _, a := range addrs {
+			if (a.IP.To4() != nil) == (recordType == "A") {
+				records = append(records, a.IP.String())
+			}
+		}
+	case "CNAME":
+		var cname string
+		cname, err = r.LookupCNAME(ctx, name)
+		if cname != "" && !strings.EqualFold(strings.TrimSuffix(cname, "."), strings.TrimSuffix(name, ".")) {
+			records = append(records, cname)
+		}
+	case "MX":
+		var mxs []*net.MX
+		mxs, err = r.LookupMX(ctx, name)
+		for _, mx := range mxs {
+			records = append(records, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	case "NS":
+		var nss []*net.NS
+		nss, err = r.LookupNS(ctx, name)
+		for _, ns := range nss {
+			records = append(records, ns.Host)
+		}
+		sort.Strings(records)
+	case "TXT":
+		var txts []string
+		txts, err = r.LookupTXT(ctx, name)
+		for _, txt := range txts {
+			records = append(records, strconv.Quote(txt))
+		}
+	case "SRV":
+		var srvs []*net.SRV
+		_, srvs, err = r.LookupSRV(ctx, "", "", name)
+		for _, srv := range srvs {
+			records = append(records, fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target))
+		}
+	case "PTR":
+		records, err = r.LookupAddr(ctx, name)
+	default:
+		return nil, fmt.Errorf("Unknown record type '%s': must be A, AAAA, CNAME, MX, NS, TXT, SRV or PTR", recordType)
+	}
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up %s: %s", name, err)
+	}
+	if len(records) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("No %s records found for %s", recordType, name),
+		}, nil
+	}
+
+	lines := make([]string, len(records))
+	for i, record := range records {
+		lines[i] = fmt.Sprintf("%s\t%s\t%s", name, recordType, record)
+	}
+	return s.codeMessage(lines), nil
+}
+
+func (s *Service) cmdWhois(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !whois domain")
+	}
+	domain := strings.ToLower(strings.TrimSuffix(args[0], "."))
+	if !hostnameRegex.MatchString(domain) || !strings.Contains(domain, ".") || len(domain) > 253 {
+		return nil, fmt.Errorf("'%s' is not a domain name", args[0])
+	}
+
+	// IANA refers to the TLD's server, which for some TLDs refers to the registrar's server.
+	server := ianaWhoisServer
+	var record string
+	for i := 0; i < 3; i++ {
+		res, err := whoisQuery(server, domain)
+		if err != nil {
+			if record != "" {
+				// The registrar's server is often less reliable, and the registry's record will do
+				break
+			}
+			return nil, fmt.Errorf("Failed to query %s: %s", server, err)
+		}
+		record = res
+		m := whoisReferRegex.FindStringSubmatch(res)
+		if m == nil {
+			break
+		}
+		next := strings.ToLower(strings.TrimSuffix(m[1], "."))
+		if next == server || !hostnameRegex.MatchString(next) {
+			break
+		}
+		server = next
+	}
+
+	lines := whoisLines(record)
+	if len(lines) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("No WHOIS record found for %s", domain),
+		}, nil
+	}
+	return s.codeMessage(lines), nil
+}
+
+// whoisLines returns the lines of the WHOIS record, without comments, blank lines and the
+// terms of use which follow the record.
+func whoisLines(record string) []string {
+	var lines []string
+	for _, line := range strings.Split(record, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, ">>>") || strings.HasPrefix(trimmed, "NOTICE:") || strings.HasPrefix(trimmed, "TERMS OF USE:") {
+			break
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "%") || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// codeMessage returns a notice with the lines formatted as a code block, cut short after the
+// service's maximum number of lines.
+func (s *Service) codeMessage(lines []string) *mevt.MessageEventContent {
+	max := s.MaxOutputLines
+	if max == 0 {
+		max = defaultMaxOutputLines
+	}
+	if len(lines) > max {
+		more := len(lines) - max
+		lines = append(lines[:max:max], fmt.Sprintf("... %d more lines", more))
+	}
+	text := strings.Join(lines, "\n")
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          "```\n" + text + "\n```",
+		Format:        mevt.FormatHTML,
+		FormattedBody: "<pre><code>" + html.EscapeString(text) + "</code></pre>",
+	}
+}
+
+// resolverAddress returns the configured DNS server as "host:port", or "" for the system's resolver.
+func (s *Service) resolverAddress() string {
+	if s.Resolver == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(s.Resolver); err == nil {
+		return s.Resolver
+	}
+	return net.JoinHostPort(strings.Trim(s.Resolver, "[]"), "53")
+}
+
+// Register makes sure that the resolver and output limit are valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.Resolver != "" {
+		host, port, err := net.SplitHostPort(s.resolverAddress())
+		if err != nil || (net.ParseIP(host) == nil && !hostnameRegex.MatchString(host)) {
+			return fmt.Errorf("Bad resolver '%s': must be a host or host:port", s.Resolver)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			return fmt.Errorf("Bad resolver port '%s'", port)
+		}
+	}
+	if s.MaxOutputLines < 0 {
+		return fmt.Errorf("max_output_lines must not be negative")
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package netutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+// fakeResolver knows the records of hyrule.com.
+type fakeResolver struct{}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if host != "hyrule.com" {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}, nil
+}
+
+func (r *fakeResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	return "castle.hyrule.com.", nil
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return []*net.MX{{Host: "owl.hyrule.com.", Pref: 10}, {Host: "crow.hyrule.com.", Pref: 20}}, nil
+}
+
+func (r *fakeResolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	return []*net.NS{{Host: "ns2.hyrule.com."}, {Host: "ns1.hyrule.com."}}, nil
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return []string{`v=spf1 -all`, `triforce="courage"`}, nil
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return "", []*net.SRV{{Target: "castle.hyrule.com.", Port: 8448, Priority: 10, Weight: 5}}, nil
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return []string{"castle.hyrule.com."}, nil
+}
+
+func TestDig(t *testing.T) {
+	var resolverAddress string
+	newResolver = func(address string) resolver {
+		resolverAddress = address
+		return &fakeResolver{}
+	}
+	s := &Service{Resolver: "9.9.9.9"}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"hyrule.com"}, "```\nhyrule.com\tA\t192.0.2.1\n```"},
+		{[]string{"hyrule.com", "aaaa"}, "```\nhyrule.com\tAAAA\t2001:db8::1\n```"},
+		{[]string{"www.hyrule.com", "CNAME"}, "```\nwww.hyrule.com\tCNAME\tcastle.hyrule.com.\n```"},
+		{[]string{"hyrule.com", "MX"}, "```\nhyrule.com\tMX\t10 owl.hyrule.com.\nhyrule.com\tMX\t20 crow.hyrule.com.\n```"},
+		{[]string{"hyrule.com", "NS"}, "```\nhyrule.com\tNS\tns1.hyrule.com.\nhyrule.com\tNS\tns2.hyrule.com.\n```"},
+		{[]string{"hyrule.com", "TXT"}, "```\nhyrule.com\tTXT\t\"v=spf1 -all\"\nhyrule.com\tTXT\t\"triforce=\\\"courage\\\"\"\n```"},
+		{[]string{"_matrix._tcp.hyrule.com", "SRV"}, "```\n_matrix._tcp.hyrule.com\tSRV\t10 5 8448 castle.hyrule.com.\n```"},
+		{[]string{"192.0.2.1"}, "```\n192.0.2.1\tPTR\tcastle.hyrule.com.\n```"},
+		{[]string{"lost.woods"}, "No A records found for lost.woods"},
+	} {
+		res, err := s.cmdDig(tc.args)
+		if err != nil {
+			t.Errorf("!dig %v failed: %s", tc.args, err)
+			continue
+		}
+		if body := res.(*mevt.MessageEventContent).Body; body != tc.want {
+			t.Errorf("!dig %v: got %q, want %q", tc.args, body, tc.want)
+		}
+	}
+	if resolverAddress != "9.9.9.9:53" {
+		t.Errorf("Bad resolver address: %s", resolverAddress)
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"hyrule..com"},
+		{"hyrule.com", "ANY"},
+		{"hyrule.com", "PTR"},
+	} {
+		if _, err := s.cmdDig(args); err == nil {
+			t.Errorf("Expected !dig %v to fail", args)
+		}
+	}
+}
+
+func TestWhois(t *testing.T) {
+	responses := map[string]string{
+		"whois.iana.org": "% IANA WHOIS server\n\ndomain:       COM\nrefer:        whois.verisign-grs.com\n",
+		"whois.verisign-grs.com": "   Domain Name: HYRULE.COM\n   Registrar WHOIS Server: whois.gorons.example\n" +
+			"   Name Server: NS1.HYRULE.COM\n>>> Last update of whois database <<<\n\nNOTICE: blah",
+		"whois.gorons.example": "Domain Name: hyrule.com\nRegistrar WHOIS Server: whois.gorons.example\n" +
+			"# Contact details\nRegistrant Name: Zelda\nName Server: ns1.hyrule.com\nName Server: ns2.hyrule.com\n" +
+			">>> Last update of WHOIS database <<<\nTerms of use: lots",
+	}
+	var asked []string
+	whoisQuery = func(server, query string) (string, error) {
+		if query != "hyrule.com" {
+			return "", fmt.Errorf("Bad query: %s", query)
+		}
+		asked = append(asked, server)
+		res, ok := responses[server]
+		if !ok {
+			return "", fmt.Errorf("Unknown server: %s", server)
+		}
+		return res, nil
+	}
+
+	s := &Service{MaxOutputLines: 4}
+	res, err := s.cmdWhois([]string{"Hyrule.com."})
+	if err != nil {
+		t.Fatal("!whois failed: ", err)
+	}
+	want := "```\nDomain Name: hyrule.com\nRegistrar WHOIS Server: whois.gorons.example\nRegistrant Name: Zelda\n" +
+		"Name Server: ns1.hyrule.com\n... 1 more lines\n```"
+	if body := res.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("Bad whois: got %q, want %q", body, want)
+	}
+	if strings.Join(asked, " ") != "whois.iana.org whois.verisign-grs.com whois.gorons.example" {
+		t.Errorf("Asked the wrong servers: %v", asked)
+	}
+
+	// The registry's record is used if the registrar's server is down
+	delete(responses, "whois.gorons.example")
+	res, err = s.cmdWhois([]string{"hyrule.com"})
+	if err != nil {
+		t.Fatal("!whois failed: ", err)
+	}
+	want = "```\n   Domain Name: HYRULE.COM\n   Registrar WHOIS Server: whois.gorons.example\n   Name Server: NS1.HYRULE.COM\n```"
+	if body := res.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("Bad whois: got %q, want %q", body, want)
+	}
+
+	if _, err = s.cmdWhois([]string{"localhost"}); err == nil {
+		t.Errorf("Expected a name without a TLD to be refused")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"resolver": "not a resolver"}`,
+		`{"resolver": "1.1.1.1:99999"}`,
+		`{"max_output_lines": -1}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create netutil service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+	for _, config := range []string{`{}`, `{"resolver": "2606:4700:4700::1111"}`, `{"resolver": "[::1]:5353"}`, `{"resolver": "dns.hyrule"}`} {
+		srv, _ := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err := srv.Register(nil, nil); err != nil {
+			t.Errorf("Expected config to be accepted: %s: %s", config, err)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+// Package nextcloud implements a Service which posts Nextcloud events into rooms, and searches
+// Nextcloud for files.
+package nextcloud
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Nextcloud service
+const ServiceType = "nextcloud"
+
+// The kinds of event which rooms can be sent
+const (
+	kindFiles    = "files"
+	kindShares   = "shares"
+	kindCalendar = "calendar"
+	kindDeck     = "deck"
+)
+
+const (
+	// The most a webhook's body can be
+	maxWebhookSize = 1 << 20
+	// How many files "!nc search" lists
+	searchLimit = 5
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Service contains the Config fields for the Nextcloud service.
+//
+// Nextcloud sends events to the webhook_url, with "?token=" and the token, from a Flow webhook or
+// from the webhook_listeners app, e.g. when a file is added, a file is shared, a calendar event is
+// created, or a Deck card is moved. Each event is posted into the rooms which want its kind:
+// "files", "shares", "calendar" or "deck". Rooms with no kinds are sent every event.
+//
+// "!nc search" searches the files of the Nextcloud user, logged in with an app password from
+// Settings → Security.
+//
+// Example JSON request:
+//   {
+//       "server_url": "https://cloud.example.com",
+//       "token": "a_long_random_string",
+//       "username": "neb",
+//       "app_password": "xxxxx-xxxxx-xxxxx-xxxxx-xxxxx",
+//       "rooms": {
+//           "!team:localhost": {
+//               "kinds": ["shares", "deck"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which Nextcloud should send events to, with "?token=" and the token. Populated by
+	// Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The URL of the Nextcloud server.
+	ServerURL string `json:"server_url"`
+	// The token which Nextcloud's webhooks must have, so that nobody else can post to rooms.
+	Token string `json:"token"`
+	// Optional. The user whose files "!nc search" searches. Required for searching.
+	Username string `json:"username"`
+	// Optional. The user's app password. Required for searching.
+	AppPassword string `json:"app_password"`
+	// The rooms to post events into.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is which events a room is sent.
+type RoomConfig struct {
+	// Optional. The kinds of events to send: "files", "shares", "calendar" and "deck". Defaults
+	// to every kind.
+	Kinds []string `json:"kinds"`
+}
+
+func (r *RoomConfig) wants(kind string) bool {
+	if len(r.Kinds) == 0 {
+		return true
+	}
+	for _, k := range r.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// webhook is the body of a Nextcloud webhook.
+type webhook struct {
+	User struct {
+		UID         string `json:"uid"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	Event struct {
+		// The PHP class of the event, e.g. "OCP\Files\Events\Node\NodeCreatedEvent"
+		Class string `json:"class"`
+		Node  *struct {
+			ID   int64  `json:"id"`
+			Path string `json:"path"`
+		} `json:"node"`
+		Share *struct {
+			Target                string `json:"target"`
+			ShareType             int    `json:"shareType"`
+			SharedWith            string `json:"sharedWith"`
+			SharedWithDisplayName string `json:"sharedWithDisplayName"`
+		} `json:"share"`
+		CalendarData *struct {
+			DisplayName string `json:"{DAV:}displayname"`
+		} `json:"calendarData"`
+		ObjectData *struct {
+			CalendarData string `json:"calendardata"`
+		} `json:"objectData"`
+		Card *struct {
+			Title string `json:"title"`
+		} `json:"card"`
+		Stack *struct {
+			Title string `json:"title"`
+		} `json:"stack"`
+		Board *struct {
+			Title string `json:"title"`
+		} `json:"board"`
+	} `json:"event"`
+}
+
+// The share types which are shown differently
+const (
+	shareTypeGroup = 1
+	shareTypeLink  = 3
+	shareTypeEmail = 4
+)
+
+// OnReceiveWebhook posts the Nextcloud event into the rooms which want it.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+		w.WriteHeader(403)
+		return
+	}
+	var hook webhook
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxWebhookSize)).Decode(&hook); err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Warn("Bad Nextcloud webhook")
+		w.WriteHeader(400)
+		return
+	}
+	kind, text := s.describe(&hook)
+	if text == "" {
+		// Not an event which is posted
+		w.WriteHeader(200)
+		return
+	}
+	for roomID, room := range s.Rooms {
+		if !room.wants(kind) {
+			continue
+		}
+		_, err := notify.Send(cli, s, notify.Notification{
+			RoomID: roomID,
+			Content: mevt.MessageEventContent{
+				MsgType: mevt.MsgNotice,
+				Body:    text,
+			},
+		})
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"service_id": s.ServiceID(),
+				"room_id":    roomID,
+			}).Error("Failed to send Nextcloud event")
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// describe returns the kind of the event and what happened, or "" if it isn't posted.
+func (s *Service) describe(hook *webhook) (string, string) {
+	who := hook.User.DisplayName
+	if who == "" {
+		who = hook.User.UID
+	}
+	if who == "" {
+		who = "Someone"
+	}
+	ev := &hook.Event
+	class := ev.Class[strings.LastIndex(ev.Class, `\`)+1:]
+
+	switch {
+	case ev.Node != nil && strings.HasPrefix(class, "Node"):
+		path := filePath(ev.Node.Path)
+		var verb string
+		switch class {
+		case "NodeCreatedEvent":
+			verb = "added"
+		case "NodeWrittenEvent":
+			verb = "updated"
+		case "NodeDeletedEvent":
+			verb = "deleted"
+		default:
+			return "", ""
+		}
+		text := fmt.Sprintf("📄 %s %s %s", who, verb, path)
+		if verb != "deleted" && ev.Node.ID != 0 {
+			text += fmt.Sprintf("\n%s/f/%d", s.serverURL(), ev.Node.ID)
+		}
+		return kindFiles, text
+
+	case ev.Share != nil && class == "ShareCreatedEvent":
+		with := ev.Share.SharedWithDisplayName
+		if with == "" {
+			with = ev.Share.SharedWith
+		}
+		switch ev.Share.ShareType {
+		case shareTypeLink:
+			with = "as a public link"
+		case shareTypeGroup:
+			with = "with the group " + with
+		case shareTypeEmail:
+			with = "by email with " + with
+		default:
+			with = "with " + with
+		}
+		return kindShares, fmt.Sprintf("🔗 %s shared %s %s", who, strings.TrimPrefix(ev.Share.Target, "/"), with)
+
+	case ev.ObjectData != nil && strings.HasPrefix(class, "CalendarObject"):
+		var verb string
+		switch class {
+		case "CalendarObjectCreatedEvent":
+			verb = "New event"
+		case "CalendarObjectUpdatedEvent":
+			verb = "Changed event"
+		case "CalendarObjectDeletedEvent":
+			verb = "Cancelled event"
+		default:
+			return "", ""
+		}
+		summary, start := parseEvent(ev.ObjectData.CalendarData)
+		if summary == "" {
+			// e.g. a task rather than an event
+			return "", ""
+		}
+		text := "📅 " + verb
+		if ev.CalendarData != nil && ev.CalendarData.DisplayName != "" {
+			text += " in " + ev.CalendarData.DisplayName
+		}
+		text += ": " + summary
+		if start != "" {
+			text += ", " + start
+		}
+		return kindCalendar, text
+
+	case ev.Card != nil && strings.HasPrefix(class, "Card"):
+		text := fmt.Sprintf("🗂️ %s ", who)
+		switch class {
+		case "CardCreatedEvent":
+			text += fmt.Sprintf("added the card '%s'", ev.Card.Title)
+		case "CardUpdatedEvent":
+			if ev.Stack != nil && ev.Stack.Title != "" {
+				text += fmt.Sprintf("moved the card '%s' to %s", ev.Card.Title, ev.Stack.Title)
+			} else {
+				text += fmt.Sprintf("updated the card '%s'", ev.Card.Title)
+			}
+		case "CardDeletedEvent":
+			text += fmt.Sprintf("deleted the card '%s'", ev.Card.Title)
+		default:
+			return "", ""
+		}
+		if ev.Board != nil && ev.Board.Title != "" {
+			text += " on " + ev.Board.Title
+		}
+		return kindDeck, text
+	}
+	return "", ""
+}
+
+// filePath returns the path of the file in its owner's files, e.g. "Documents/report.odt" for
+// "/alice/files/Documents/report.odt".
+func filePath(path string) string {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	if len(parts) == 3 && parts[1] == "files" {
+		return parts[2]
+	}
+	return path
+}
+
+// parseEvent returns the summary and start of the first event in the iCalendar data, e.g.
+// "Team meeting" and "2021-03-15 10:00".
+func parseEvent(ical string) (string, string) {
+	var summary, start string
+	inEvent := false
+	// Long lines are folded onto lines starting with a space
+	ical = strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(ical)
+	for _, line := range strings.Split(ical, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "BEGIN:VEVENT":
+			inEvent = true
+		case line == "END:VEVENT":
+			return summary, start
+		case !inEvent:
+		case strings.HasPrefix(line, "SUMMARY"):
+			if i := strings.Index(line, ":"); i >= 0 {
+				summary = strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\\`, `\`).Replace(line[i+1:])
+			}
+		case strings.HasPrefix(line, "DTSTART"):
+			if i := strings.Index(line, ":"); i >= 0 {
+				start = formatICalTime(line[i+1:])
+			}
+		}
+	}
+	return summary, start
+}
+
+// formatICalTime returns an iCalendar date or time in a readable form, e.g. "2021-03-15 10:00"
+// for "20210315T100000".
+func formatICalTime(value string) string {
+	for _, layout := range []struct{ in, out string }{
+		{"20060102T150405Z", "2006-01-02 15:04 UTC"},
+		{"20060102T150405", "2006-01-02 15:04"},
+		{"20060102", "2006-01-02"},
+	} {
+		if t, err := time.Parse(layout.in, value); err == nil {
+			return t.Format(layout.out)
+		}
+	}
+	return value
+}
+
+// Commands supported:
+//    !nc search query
+// Responds with the files which match the query.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"nc", "search"},
+			Arguments: []string{"query"},
+			Help:      "Search for files on Nextcloud",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSearch(args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdSearch(args []string) (interface{}, error) {
+	query := strings.Join(args, " ")
+	if query == "" {
+		return nil, fmt.Errorf("Usage: !nc search query")
+	}
+	if s.Username == "" || s.AppPassword == "" {
+		return nil, fmt.Errorf("Searching isn't set up: the service needs a username and app_password")
+	}
+	u := s.serverURL() + "/ocs/v2.php/search/providers/files/search?" + url.Values{
+		"term":  {query},
+		"limit": {fmt.Sprint(searchLimit)},
+	}.Encode()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(s.Username, s.AppPassword)
+	req.Header.Set("OCS-APIRequest", "true")
+	req.Header.Set("Accept", "application/json")
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to search Nextcloud: %s", err)
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("Failed to search Nextcloud: the username or app_password is wrong")
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to search Nextcloud: request error: %d", res.StatusCode)
+	}
+	var body struct {
+		OCS struct {
+			Data struct {
+				Entries []struct {
+					Title       string `json:"title"`
+					Subline     string `json:"subline"`
+					ResourceURL string `json:"resourceUrl"`
+				} `json:"entries"`
+			} `json:"data"`
+		} `json:"ocs"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Failed to search Nextcloud: %s", err)
+	}
+	entries := body.OCS.Data.Entries
+	if len(entries) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("No files found for '%s'", query),
+		}, nil
+	}
+	var lines []string
+	for _, e := range entries {
+		line := e.Title
+		if e.Subline != "" {
+			line += " (" + e.Subline + ")"
+		}
+		if e.ResourceURL != "" {
+			line += "\n" + e.ResourceURL
+		}
+		lines = append(lines, line)
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    strings.Join(lines, "\n"),
+	}, nil
+}
+
+func (s *Service) serverURL() string {
+	return strings.TrimSuffix(s.ServerURL, "/")
+}
+
+// Register makes sure the Config information supplied is valid, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if u, err := url.Parse(s.ServerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Bad server_url '%s': must be an http or https URL", s.ServerURL)
+	}
+	if len(s.Token) < 16 {
+		return fmt.Errorf("A token of at least 16 characters is required")
+	}
+	if (s.Username == "") != (s.AppPassword == "") {
+		return fmt.Errorf("A username and app_password are both required for searching")
+	}
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	for roomID, room := range s.Rooms {
+		for _, kind := range room.Kinds {
+			switch kind {
+			case kindFiles, kindShares, kindCalendar, kindDeck:
+			default:
+				return fmt.Errorf("Bad kind '%s' for room %s: must be files, shares, calendar or deck", kind, roomID)
+			}
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
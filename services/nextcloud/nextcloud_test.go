@@ -0,0 +1,157 @@
+package nextcloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestWebhook(t *testing.T) {
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, room+" "+msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$nc:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"server_url": "https://cloud.hyrule/",
+		"token": "the_master_sword_token",
+		"rooms": {
+			"!everything:hyrule": {},
+			"!deck:hyrule": {"kinds": ["deck"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create Nextcloud service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register Nextcloud service: ", err)
+	}
+
+	ical := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nDTSTART;TZID=Europe/London:20210315T100000\r\nSUMMARY:Meeting with the\r\n  Great Deku Tree\\, briefly\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	calendarHook, _ := json.Marshal(map[string]interface{}{
+		"user": map[string]string{"uid": "impa"},
+		"event": map[string]interface{}{
+			"class":        `OCA\DAV\Events\CalendarObjectCreatedEvent`,
+			"calendarData": map[string]string{"{DAV:}displayname": "Council"},
+			"objectData":   map[string]string{"calendardata": ical},
+		},
+	})
+	for _, tc := range []struct {
+		query string
+		body  string
+		code  int
+	}{
+		{"?token=wrong", `{}`, 403},
+		{"?token=the_master_sword_token", `not json`, 400},
+		{"?token=the_master_sword_token", `{"user":{"uid":"link","displayName":"Link"},
+			"event":{"class":"OCP\\Files\\Events\\Node\\NodeCreatedEvent","node":{"id":42,"path":"/link/files/Maps/Hyrule.png"}}}`, 200},
+		{"?token=the_master_sword_token", `{"user":{"uid":"zelda","displayName":"Zelda"},
+			"event":{"class":"OCP\\Share\\Events\\ShareCreatedEvent","share":{"target":"/Plans.odt","shareType":1,"sharedWith":"sages"}}}`, 200},
+		{"?token=the_master_sword_token", string(calendarHook), 200},
+		{"?token=the_master_sword_token", `{"user":{"uid":"zelda","displayName":"Zelda"},
+			"event":{"class":"OCA\\Deck\\Event\\CardUpdatedEvent","card":{"title":"Find the Triforce"},"stack":{"title":"Done"},"board":{"title":"Quests"}}}`, 200},
+		{"?token=the_master_sword_token", `{"event":{"class":"OCP\\User\\Events\\UserLoggedInEvent"}}`, 200},
+	} {
+		req := httptest.NewRequest("POST", "https://neb.hyrule/services/hooks/bmV4dGNsb3Vk"+tc.query, strings.NewReader(tc.body))
+		w := httptest.NewRecorder()
+		srv.OnReceiveWebhook(w, req, matrixCli)
+		if w.Code != tc.code {
+			t.Errorf("Webhook %s: got status %d, want %d", tc.body, w.Code, tc.code)
+		}
+	}
+
+	sort.Strings(sent)
+	want := []string{
+		"!deck:hyrule 🗂️ Zelda moved the card 'Find the Triforce' to Done on Quests",
+		"!everything:hyrule 📄 Link added Maps/Hyrule.png\nhttps://cloud.hyrule/f/42",
+		"!everything:hyrule 📅 New event in Council: Meeting with the Great Deku Tree, briefly, 2021-03-15 10:00",
+		"!everything:hyrule 🔗 Zelda shared Plans.odt with the group sages",
+		"!everything:hyrule 🗂️ Zelda moved the card 'Find the Triforce' to Done on Quests",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad messages: got %q, want %q", sent, want)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if !strings.HasPrefix(req.URL.String(), "https://cloud.hyrule/ocs/v2.php/search/providers/files/search?") {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		if user, pass, ok := req.BasicAuth(); !ok || user != "neb" || pass != "app-password" || req.Header.Get("OCS-APIRequest") != "true" {
+			return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewBufferString(""))}, nil
+		}
+		body := `{"ocs":{"data":{"entries":[]}}}`
+		if req.URL.Query().Get("term") == "hyrule map" {
+			body = `{"ocs":{"data":{"entries":[{"title":"Hyrule map.png","subline":"in Maps","resourceUrl":"https://cloud.hyrule/f/42"}]}}}`
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	s := &Service{ServerURL: "https://cloud.hyrule", Username: "neb", AppPassword: "app-password"}
+	res, err := s.cmdSearch([]string{"hyrule", "map"})
+	if err != nil {
+		t.Fatal("Search failed: ", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "Hyrule map.png (in Maps)\nhttps://cloud.hyrule/f/42" {
+		t.Errorf("Bad search results: %q", body)
+	}
+	res, err = s.cmdSearch([]string{"ganon"})
+	if err != nil || res.(*mevt.MessageEventContent).Body != "No files found for 'ganon'" {
+		t.Errorf("Expected no results, got %v, %v", res, err)
+	}
+	s.AppPassword = "wrong"
+	if _, err = s.cmdSearch([]string{"ganon"}); err == nil || !strings.Contains(err.Error(), "app_password is wrong") {
+		t.Errorf("Expected a bad password to be reported, got %v", err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"token": "the_master_sword_token", "rooms": {"!a:hyrule": {}}}`,
+		`{"server_url": "https://cloud.hyrule", "token": "short", "rooms": {"!a:hyrule": {}}}`,
+		`{"server_url": "https://cloud.hyrule", "token": "the_master_sword_token"}`,
+		`{"server_url": "https://cloud.hyrule", "token": "the_master_sword_token", "username": "neb", "rooms": {"!a:hyrule": {}}}`,
+		`{"server_url": "https://cloud.hyrule", "token": "the_master_sword_token", "rooms": {"!a:hyrule": {"kinds": ["talk"]}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create Nextcloud service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
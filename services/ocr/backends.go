@@ -0,0 +1,134 @@
+package ocr
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// How long text recognition may take before it is given up on
+const recogniseTimeout = 30 * time.Second
+
+// A backend recognises the text in images.
+type backend interface {
+	// recognise returns the text in the image. The languages are hints, and may be empty.
+	recognise(image []byte, languages []string) (string, error)
+}
+
+// tesseractBackend runs the tesseract command line tool.
+type tesseractBackend struct {
+	path string
+}
+
+func (b *tesseractBackend) recognise(image []byte, languages []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), recogniseTimeout)
+	defer cancel()
+	args := []string{"stdin", "stdout"}
+	if len(languages) > 0 {
+		args = append(args, "-l", strings.Join(languages, "+"))
+	}
+	cmd := exec.CommandContext(ctx, b.path, args...)
+	cmd.Stdin = bytes.NewReader(image)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %s", err, msg)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// visionBackend calls the Google Cloud Vision API.
+type visionBackend struct {
+	apiKey string
+}
+
+type visionRequest struct {
+	Requests []visionImageRequest `json:"requests"`
+}
+
+type visionImageRequest struct {
+	Image struct {
+		Content string `json:"content"`
+	} `json:"image"`
+	Features     []visionFeature     `json:"features"`
+	ImageContext *visionImageContext `json:"imageContext,omitempty"`
+}
+
+type visionFeature struct {
+	Type string `json:"type"`
+}
+
+type visionImageContext struct {
+	LanguageHints []string `json:"languageHints"`
+}
+
+type visionResponse struct {
+	Responses []struct {
+		FullTextAnnotation struct {
+			Text string `json:"text"`
+		} `json:"fullTextAnnotation"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"responses"`
+}
+
+func (b *visionBackend) recognise(image []byte, languages []string) (string, error) {
+	var imageReq visionImageRequest
+	imageReq.Image.Content = base64.StdEncoding.EncodeToString(image)
+	imageReq.Features = []visionFeature{{Type: "DOCUMENT_TEXT_DETECTION"}}
+	if len(languages) > 0 {
+		imageReq.ImageContext = &visionImageContext{LanguageHints: languages}
+	}
+	body, err := json.Marshal(visionRequest{Requests: []visionImageRequest{imageReq}})
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), recogniseTimeout)
+	defer cancel()
+	u, err := url.Parse(visionURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("key", b.apiKey)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	var visionRes visionResponse
+	if err = json.NewDecoder(res.Body).Decode(&visionRes); err != nil {
+		return "", fmt.Errorf("Bad response from Cloud Vision, status %d: %s", res.StatusCode, err)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return "", fmt.Errorf("Cloud Vision returned status %d", res.StatusCode)
+	}
+	if len(visionRes.Responses) == 0 {
+		return "", nil
+	}
+	if e := visionRes.Responses[0].Error; e != nil {
+		return "", fmt.Errorf("%s", e.Message)
+	}
+	return visionRes.Responses[0].FullTextAnnotation.Text, nil
+}
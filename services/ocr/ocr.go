@@ -0,0 +1,205 @@
+// Package ocr implements a Service which extracts the text from images posted in Matrix rooms.
+package ocr
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the OCR service
+const ServiceType = "ocr"
+
+// The largest image which is downloaded by default, in bytes
+const defaultMaxImageSize = 10 * 1024 * 1024
+
+// The Google Cloud Vision API endpoint. Overridden by tests.
+var visionURL = "https://vision.googleapis.com/v1/images:annotate"
+
+var httpClient = &http.Client{}
+
+// Service contains the Config fields for the OCR service.
+//
+// This service reads the text in images. Reply to an image with "!ocr" and the text is posted as
+// a code block. Languages the text is in can be given as arguments, e.g. "!ocr deu eng", which
+// helps the backend recognise it; they default to the configured languages.
+//
+// The text is recognised by either the "tesseract" command line tool, which must be installed on
+// the Go-NEB host, or the Google Cloud Vision API. Tesseract languages are 3-letter codes like
+// "eng", Cloud Vision languages are BCP-47 codes like "en".
+//
+// Example JSON request:
+//   {
+//       "backend": "tesseract",
+//       "languages": ["eng"],
+//       "max_image_size": 5242880
+//   }
+// Or:
+//   {
+//       "backend": "google_vision",
+//       "google_api_key": "AIzaSy..."
+//   }
+type Service struct {
+	types.DefaultService
+	// The backend which recognises text: "tesseract" or "google_vision".
+	Backend string `json:"backend"`
+	// Optional. The path to the tesseract binary. Defaults to finding "tesseract" on the PATH.
+	TesseractPath string `json:"tesseract_path"`
+	// The API key for the Google Cloud Vision API. Required for the google_vision backend.
+	GoogleAPIKey string `json:"google_api_key"`
+	// Optional. The languages to expect, if the command doesn't say.
+	Languages []string `json:"languages"`
+	// Optional. The largest image to download, in bytes. Defaults to 10 MB.
+	MaxImageSize int64 `json:"max_image_size"`
+}
+
+// Commands supported:
+//    !ocr [language...]
+// Sent in reply to an image message, responds with the text in the image.
+func (s *Service) Commands(client types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"ocr"},
+			Arguments: []string{"[language...]"},
+			Help:      "Reply to an image to read the text in it",
+			EventCommand: func(evt *mevt.Event, args []string) (interface{}, error) {
+				return s.cmdOCR(client, evt, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdOCR(client types.MatrixClient, evt *mevt.Event, args []string) (interface{}, error) {
+	replyTo := evt.Content.AsMessage().GetReplyTo()
+	if replyTo == "" {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Reply to an image with !ocr to read the text in it.",
+		}, nil
+	}
+	evCli, canGet := client.(types.EventGetter)
+	dlCli, canDownload := client.(types.MediaDownloader)
+	if !canGet || !canDownload {
+		return nil, fmt.Errorf("Unable to download images with this client")
+	}
+	original, err := evCli.GetEvent(evt.RoomID, replyTo)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch the image message: %s", err)
+	}
+	original.Content.ParseRaw(mevt.EventMessage)
+	msg := original.Content.AsMessage()
+	if msg.MsgType != mevt.MsgImage {
+		return nil, fmt.Errorf("Text can only be read from images")
+	}
+	if msg.URL == "" {
+		return nil, fmt.Errorf("Text can't be read from encrypted images")
+	}
+	maxSize := s.maxImageSize()
+	if info := msg.GetInfo(); info != nil && int64(info.Size) > maxSize {
+		return nil, fmt.Errorf("Image is larger than %s", formatSize(maxSize))
+	}
+	mxcURL, err := msg.URL.Parse()
+	if err != nil {
+		return nil, err
+	}
+	data, err := dlCli.Download(mxcURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download the image: %s", err)
+	}
+	defer data.Close()
+	// The size in the event is only a hint, so don't trust it
+	image, err := ioutil.ReadAll(io.LimitReader(data, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download the image: %s", err)
+	}
+	if int64(len(image)) > maxSize {
+		return nil, fmt.Errorf("Image is larger than %s", formatSize(maxSize))
+	}
+
+	languages := args
+	if len(languages) == 0 {
+		languages = s.Languages
+	}
+	text, err := s.backend().recognise(image, languages)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the text in the image: %s", err)
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "No text found in the image",
+		}, nil
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          "```\n" + text + "\n```",
+		Format:        mevt.FormatHTML,
+		FormattedBody: "<pre><code>" + html.EscapeString(text) + "</code></pre>",
+	}, nil
+}
+
+func (s *Service) maxImageSize() int64 {
+	if s.MaxImageSize <= 0 {
+		return defaultMaxImageSize
+	}
+	return s.MaxImageSize
+}
+
+func (s *Service) backend() backend {
+	if s.Backend == "google_vision" {
+		return &visionBackend{apiKey: s.GoogleAPIKey}
+	}
+	return &tesseractBackend{path: s.tesseractPath()}
+}
+
+func (s *Service) tesseractPath() string {
+	if s.TesseractPath == "" {
+		return "tesseract"
+	}
+	return s.TesseractPath
+}
+
+// formatSize returns the number of bytes in a human-readable way, e.g. "10 MB".
+func formatSize(n int64) string {
+	if n >= 1024*1024 {
+		return fmt.Sprintf("%d MB", n/1024/1024)
+	}
+	if n >= 1024 {
+		return fmt.Sprintf("%d KB", n/1024)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// Register makes sure that the backend is configured.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	switch s.Backend {
+	case "tesseract":
+		if _, err := exec.LookPath(s.tesseractPath()); err != nil {
+			return fmt.Errorf("Cannot find tesseract: %s", err)
+		}
+	case "google_vision":
+		if s.GoogleAPIKey == "" {
+			return fmt.Errorf("A google_api_key is required for the google_vision backend")
+		}
+	default:
+		return fmt.Errorf("Unknown backend '%s': must be tesseract or google_vision", s.Backend)
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,157 @@
+package ocr
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+// matrixClient returns a client which serves an image message with the given size, and the image.
+func matrixClient(size int, pixels string) *mautrix.Client {
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/event/$image") {
+			return &http.Response{
+				StatusCode: 200,
+				Body: ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`{
+					"type":"m.room.message","event_id":"$image","room_id":"!someroom:hyrule","sender":"@link:hyrule",
+					"content":{"msgtype":"m.image","body":"sign.png","url":"mxc://hyrule/sign","info":{"size":%d}}}`, size))),
+			}, nil
+		} else if strings.Contains(req.URL.Path, "_matrix/media/r0/download/hyrule/sign") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(pixels)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@ocr:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+	return matrixCli
+}
+
+func replyToImage(t *testing.T) *mevt.Event {
+	content := mevt.Content{Raw: map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "!ocr",
+		"m.relates_to": map[string]interface{}{
+			"m.in_reply_to": map[string]interface{}{"event_id": "$image"},
+		},
+	}}
+	if veryRaw, err := content.MarshalJSON(); err != nil {
+		t.Fatalf("Error marshalling JSON: %s", err)
+	} else {
+		content.VeryRaw = veryRaw
+	}
+	content.ParseRaw(mevt.EventMessage)
+	return &mevt.Event{
+		Type:    mevt.EventMessage,
+		Sender:  "@zelda:hyrule",
+		RoomID:  "!someroom:hyrule",
+		Content: content,
+	}
+}
+
+func createService(t *testing.T, config string) *Service {
+	srv, err := types.CreateService("id", ServiceType, "@ocr:hyrule", []byte(config))
+	if err != nil {
+		t.Fatal("Failed to create ocr service: ", err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register ocr service: ", err)
+	}
+	return srv.(*Service)
+}
+
+func TestTesseract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A fake tesseract which echoes its language and input
+	tesseract := filepath.Join(dir, "tesseract")
+	if err = ioutil.WriteFile(tesseract, []byte("#!/bin/sh\necho \"$4\"\ncat\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := createService(t, `{"backend":"tesseract","tesseract_path":"`+tesseract+`","languages":["eng"]}`)
+
+	res, err := s.cmdOCR(matrixClient(12, "<It's a secret to everybody>"), replyToImage(t), []string{"deu", "eng"})
+	if err != nil {
+		t.Fatalf("!ocr failed: %s", err)
+	}
+	content := res.(*mevt.MessageEventContent)
+	if content.Body != "```\ndeu+eng\n<It's a secret to everybody>\n```" {
+		t.Errorf("Bad body: %s", content.Body)
+	}
+	if content.FormattedBody != "<pre><code>deu+eng\n&lt;It&#39;s a secret to everybody&gt;</code></pre>" {
+		t.Errorf("Bad formatted body: %s", content.FormattedBody)
+	}
+
+	res, err = s.cmdOCR(matrixClient(12, "Dodongo"), replyToImage(t), nil)
+	if err != nil || !strings.HasPrefix(res.(*mevt.MessageEventContent).Body, "```\neng\n") {
+		t.Errorf("Expected the configured language to be used, got %+v, %v", res, err)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	s := createService(t, `{"backend":"google_vision","google_api_key":"secret","max_image_size":10}`)
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		t.Fatalf("Images which are too large shouldn't be sent to Cloud Vision")
+		return nil, nil
+	})}
+	// The image is too large according to its event
+	if _, err := s.cmdOCR(matrixClient(11, "tiny"), replyToImage(t), nil); err == nil {
+		t.Errorf("Expected the image to be too large")
+	}
+	// The event says the image is small, but it isn't
+	if _, err := s.cmdOCR(matrixClient(4, "not tiny at all"), replyToImage(t), nil); err == nil {
+		t.Errorf("Expected the download to be too large")
+	}
+}
+
+func TestGoogleVision(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host != "vision.googleapis.com" || req.URL.Query().Get("key") != "secret" {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		var visionReq visionRequest
+		if err := json.NewDecoder(req.Body).Decode(&visionReq); err != nil {
+			return nil, err
+		}
+		image, _ := base64.StdEncoding.DecodeString(visionReq.Requests[0].Image.Content)
+		if string(image) != "sign pixels" {
+			return nil, fmt.Errorf("Bad image: %s", image)
+		}
+		if ctx := visionReq.Requests[0].ImageContext; ctx == nil || len(ctx.LanguageHints) != 1 || ctx.LanguageHints[0] != "en" {
+			return nil, fmt.Errorf("Bad language hints: %+v", ctx)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(
+				`{"responses":[{"fullTextAnnotation":{"text":"Lost Woods\n"}}]}`,
+			)),
+		}, nil
+	})}
+	s := createService(t, `{"backend":"google_vision","google_api_key":"secret"}`)
+
+	res, err := s.Commands(matrixClient(11, "sign pixels"))[0].EventCommand(replyToImage(t), []string{"en"})
+	if err != nil {
+		t.Fatalf("!ocr failed: %s", err)
+	}
+	if content := res.(*mevt.MessageEventContent); content.Body != "```\nLost Woods\n```" {
+		t.Errorf("Bad body: %s", content.Body)
+	}
+}
@@ -0,0 +1,414 @@
+// Package oncall implements a Service which announces on-call rotations.
+package oncall
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/templates"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the On-call service
+const ServiceType = "oncall"
+
+// How often rotations imported from PagerDuty or Opsgenie are checked for handovers, as they can
+// be overridden at any time.
+const importPollInterval = 5 * time.Minute
+
+// How many upcoming shifts !oncall schedule lists
+const numberUpcomingShifts = 5
+
+// Service contains the Config fields for the On-call service.
+//
+// This service announces on-call handovers in Matrix rooms, and answers "!oncall" with who is
+// on call. Each room has a rotation, which is either built in - a list of people taking shifts of
+// the same length in turn - or imported from a PagerDuty or Opsgenie schedule. The room topic can
+// be kept up to date with who is on call, which requires the service user to be able to change it.
+//
+// People in built-in rotations can be Matrix user IDs, who are mentioned when their shift starts,
+// or any other name.
+//
+// Operators can change the handover announcement with a template override named
+// "oncall.handover" (see package "templates"), which is given a Handover.
+//
+// Example JSON request:
+//   {
+//       "rooms": {
+//           "!ops:localhost": {
+//               "rotation": ["@alice:localhost", "@bob:localhost", "Carol"],
+//               "start": "2021-06-07T09:00:00Z",
+//               "shift_length": "168h",
+//               "topic": "On call: {{.OnCall}}"
+//           },
+//           "!sre:localhost": {
+//               "pagerduty": {
+//                   "api_token": "y_NbAkKc66ryYTWUXYEu",
+//                   "schedule_id": "PI7DH85"
+//               }
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	Rooms map[id.RoomID]Rotation `json:"rooms"`
+}
+
+// Rotation is who is on call for a room. Exactly one of Rotation, PagerDuty and Opsgenie is required.
+type Rotation struct {
+	// The people who take turns to be on call, in order.
+	Rotation []string `json:"rotation"`
+	// When the first person in the rotation starts their shift. Required with Rotation.
+	Start time.Time `json:"start"`
+	// How long each shift lasts, e.g. "24h". Defaults to a week.
+	ShiftLength string `json:"shift_length"`
+	// Import the rotation from a PagerDuty schedule.
+	PagerDuty *PagerDutySchedule `json:"pagerduty"`
+	// Import the rotation from an Opsgenie schedule.
+	Opsgenie *OpsgenieSchedule `json:"opsgenie"`
+	// Optional. A Go text/template for the room topic, which is set at each handover. It is given
+	// a Handover. The topic isn't changed if this is empty.
+	Topic string `json:"topic"`
+	// Optional. Don't announce handovers, only update the topic.
+	Quiet bool `json:"quiet"`
+	// Who was on call when the rotation was last checked. Populated by Go-NEB.
+	OnCall string `json:"on_call"`
+}
+
+// Shift is a period of time which someone is on call for.
+type Shift struct {
+	OnCall string
+	// Zero if the end of the shift isn't known.
+	Until time.Time
+}
+
+// Handover is the data which topic templates and "oncall.handover" template overrides are given.
+type Handover struct {
+	RoomID   id.RoomID
+	Previous string
+	OnCall   string
+	Until    time.Time
+}
+
+// Commands supported:
+//    !oncall
+// Responds with who is on call in this room, and until when.
+//    !oncall schedule
+// Responds with the upcoming shifts of a built-in rotation.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"oncall"},
+			Help: "Show who is on call",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdOnCall(roomID)
+			},
+		},
+		{
+			Path: []string{"oncall", "schedule"},
+			Help: "Show the upcoming on-call shifts",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSchedule(roomID)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdOnCall(roomID id.RoomID) (interface{}, error) {
+	r, ok := s.Rooms[roomID]
+	if !ok {
+		return nil, fmt.Errorf("This room has no on-call rotation")
+	}
+	shift, err := r.current(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if shift.OnCall == "" {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Nobody is on call",
+		}, nil
+	}
+	body := fmt.Sprintf("%s is on call", shift.OnCall)
+	if !shift.Until.IsZero() {
+		body += " until " + shift.Until.UTC().Format("Mon 2 Jan 15:04 MST")
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}, nil
+}
+
+func (s *Service) cmdSchedule(roomID id.RoomID) (interface{}, error) {
+	r, ok := s.Rooms[roomID]
+	if !ok {
+		return nil, fmt.Errorf("This room has no on-call rotation")
+	}
+	if len(r.Rotation) == 0 {
+		return nil, fmt.Errorf("The schedule of this room is kept in PagerDuty or Opsgenie")
+	}
+	shiftLength, err := r.shiftLength()
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{"Upcoming shifts:"}
+	for _, shift := range r.upcoming(time.Now(), numberUpcomingShifts) {
+		lines = append(lines, fmt.Sprintf(" - %s: %s", shift.Until.Add(-shiftLength).UTC().Format("Mon 2 Jan 15:04 MST"), shift.OnCall))
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    strings.Join(lines, "\n"),
+	}, nil
+}
+
+// OnPoll announces handovers and updates room topics, and returns when the next handover is due.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	now := time.Now()
+	next := now.Add(24 * time.Hour)
+	changed := false
+	for roomID, r := range s.Rooms {
+		shift, err := r.current(now)
+		if err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to find out who is on call")
+			next = earliest(next, now.Add(importPollInterval))
+			continue
+		}
+		if r.imported() {
+			next = earliest(next, now.Add(importPollInterval))
+		}
+		if !shift.Until.IsZero() {
+			next = earliest(next, shift.Until)
+		}
+		if shift.OnCall == r.OnCall {
+			continue
+		}
+		s.handover(cli, roomID, r, Handover{
+			RoomID:   roomID,
+			Previous: r.OnCall,
+			OnCall:   shift.OnCall,
+			Until:    shift.Until,
+		})
+		r.OnCall = shift.OnCall
+		s.Rooms[roomID] = r
+		changed = true
+	}
+	if changed {
+		// Persist the service to save who is on call
+		if _, err := database.GetServiceDB().StoreService(s); err != nil {
+			logger.WithError(err).Error("Failed to persist on-call state for service")
+		}
+	}
+	return next
+}
+
+// handover announces the handover in the room and updates its topic.
+func (s *Service) handover(cli types.MatrixClient, roomID id.RoomID, r Rotation, h Handover) {
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    roomID,
+	})
+	if !r.Quiet && h.OnCall != "" {
+		content := templates.Render("oncall.handover", h, handoverMessage(h))
+		if _, err := notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: content}); err != nil {
+			logger.WithError(err).Error("Failed to announce handover")
+		}
+	}
+	if r.Topic == "" {
+		return
+	}
+	topic, err := renderTopic(r.Topic, h)
+	if err != nil {
+		logger.WithError(err).Error("Failed to render topic")
+		return
+	}
+	tcli, ok := cli.(types.StateSender)
+	if !ok {
+		logger.Error("Client cannot set room topics")
+		return
+	}
+	if _, err = tcli.SendStateEvent(roomID, mevt.StateTopic, "", map[string]string{"topic": topic}); err != nil {
+		logger.WithError(err).Error("Failed to set topic")
+	}
+}
+
+// handoverMessage is the default announcement of a handover, which mentions the person now on
+// call if they are a Matrix user.
+func handoverMessage(h Handover) mevt.MessageEventContent {
+	onCallHTML := html.EscapeString(h.OnCall)
+	if strings.HasPrefix(h.OnCall, "@") {
+		onCallHTML = fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, onCallHTML, onCallHTML)
+	}
+	body := fmt.Sprintf("%s is now on call", h.OnCall)
+	formatted := fmt.Sprintf("📟 %s is now on call", onCallHTML)
+	if h.Previous != "" {
+		body += fmt.Sprintf(", taking over from %s", h.Previous)
+		formatted += fmt.Sprintf(", taking over from %s", html.EscapeString(h.Previous))
+	}
+	if !h.Until.IsZero() {
+		until := h.Until.UTC().Format("Mon 2 Jan 15:04 MST")
+		body += " until " + until
+		formatted += " until " + until
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          body,
+		Format:        mevt.FormatHTML,
+		FormattedBody: formatted,
+	}
+}
+
+func renderTopic(text string, h Handover) (string, error) {
+	t, err := template.New("topic").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, h); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// current returns the shift which is happening now.
+func (r *Rotation) current(now time.Time) (Shift, error) {
+	switch {
+	case r.PagerDuty != nil:
+		return r.PagerDuty.current()
+	case r.Opsgenie != nil:
+		return r.Opsgenie.current()
+	}
+	shifts := r.upcoming(now, 1)
+	if len(shifts) == 0 {
+		return Shift{}, nil
+	}
+	if r.Start.After(now) {
+		// The rotation hasn't started yet
+		return Shift{Until: r.Start}, nil
+	}
+	return shifts[0], nil
+}
+
+// upcoming returns the next n shifts of a built-in rotation, starting with the current one.
+func (r *Rotation) upcoming(now time.Time, n int) (shifts []Shift) {
+	shiftLength, err := r.shiftLength()
+	if err != nil || len(r.Rotation) == 0 {
+		return
+	}
+	i := 0
+	if now.After(r.Start) {
+		i = int(now.Sub(r.Start) / shiftLength)
+	}
+	for ; len(shifts) < n; i++ {
+		shifts = append(shifts, Shift{
+			OnCall: r.Rotation[i%len(r.Rotation)],
+			Until:  r.Start.Add(time.Duration(i+1) * shiftLength),
+		})
+	}
+	return
+}
+
+func (r *Rotation) shiftLength() (time.Duration, error) {
+	if r.ShiftLength == "" {
+		return 7 * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(r.ShiftLength)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Hour {
+		return 0, fmt.Errorf("Shifts must be at least an hour long, not %s", d)
+	}
+	return d, nil
+}
+
+func (r *Rotation) imported() bool {
+	return r.PagerDuty != nil || r.Opsgenie != nil
+}
+
+// check returns an error if the rotation is misconfigured.
+func (r *Rotation) check() error {
+	sources := 0
+	if len(r.Rotation) > 0 {
+		sources++
+		if r.Start.IsZero() {
+			return fmt.Errorf("A start time is required with a rotation")
+		}
+		if _, err := r.shiftLength(); err != nil {
+			return err
+		}
+	}
+	if r.PagerDuty != nil {
+		sources++
+		if r.PagerDuty.APIToken == "" || r.PagerDuty.ScheduleID == "" {
+			return fmt.Errorf("PagerDuty schedules need an api_token and schedule_id")
+		}
+	}
+	if r.Opsgenie != nil {
+		sources++
+		if r.Opsgenie.APIKey == "" || r.Opsgenie.ScheduleID == "" {
+			return fmt.Errorf("Opsgenie schedules need an api_key and schedule_id")
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("Exactly one of rotation, pagerduty and opsgenie is required")
+	}
+	if r.Topic != "" {
+		if _, err := template.New("topic").Parse(r.Topic); err != nil {
+			return fmt.Errorf("Bad topic template: %s", err)
+		}
+	}
+	return nil
+}
+
+func earliest(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// Register checks the rotation of each room and joins them. Who is on call carries over from the
+// old service, so that handovers aren't announced again when the service is reconfigured.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	old, _ := oldService.(*Service)
+	for roomID, r := range s.Rooms {
+		if err := r.check(); err != nil {
+			return fmt.Errorf("Bad rotation for room %s: %s", roomID, err)
+		}
+		if old != nil {
+			r.OnCall = old.Rooms[roomID].OnCall
+			s.Rooms[roomID] = r
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
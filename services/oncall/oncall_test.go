@@ -0,0 +1,146 @@
+package oncall
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestBuiltInRotation(t *testing.T) {
+	start := time.Date(2021, 6, 7, 9, 0, 0, 0, time.UTC)
+	r := Rotation{
+		Rotation:    []string{"@alice:hyrule", "@bob:hyrule", "Carol"},
+		Start:       start,
+		ShiftLength: "24h",
+	}
+	if err := r.check(); err != nil {
+		t.Fatalf("Rotation failed check: %s", err)
+	}
+	testCases := []struct {
+		now       time.Time
+		wantName  string
+		wantUntil time.Time
+	}{
+		{start.Add(-time.Hour), "", start},
+		{start, "@alice:hyrule", start.Add(24 * time.Hour)},
+		{start.Add(25 * time.Hour), "@bob:hyrule", start.Add(48 * time.Hour)},
+		{start.Add(72 * time.Hour), "@alice:hyrule", start.Add(96 * time.Hour)},
+	}
+	for _, tc := range testCases {
+		shift, err := r.current(tc.now)
+		if err != nil {
+			t.Errorf("current(%s) failed: %s", tc.now, err)
+		} else if shift.OnCall != tc.wantName || !shift.Until.Equal(tc.wantUntil) {
+			t.Errorf("current(%s) = %+v, want %s until %s", tc.now, shift, tc.wantName, tc.wantUntil)
+		}
+	}
+
+	bad := []Rotation{
+		{Rotation: []string{"@alice:hyrule"}},
+		{Rotation: []string{"@alice:hyrule"}, Start: start, ShiftLength: "5m"},
+		{Rotation: []string{"@alice:hyrule"}, Start: start, PagerDuty: &PagerDutySchedule{APIToken: "t", ScheduleID: "P1"}},
+		{},
+	}
+	for _, r := range bad {
+		if err := r.check(); err == nil {
+			t.Errorf("Expected rotation %+v to fail check", r)
+		}
+	}
+}
+
+func TestHandovers(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	onCall := "Zelda"
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/oncalls" || req.URL.Query().Get("schedule_ids[]") != "PSCHED" {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		if req.Header.Get("Authorization") != "Token token=secret" {
+			return nil, fmt.Errorf("Bad Authorization header: %s", req.Header.Get("Authorization"))
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(
+				`{"oncalls":[{"user":{"summary":"` + onCall + `"},"end":"2030-01-01T00:00:00Z"}]}`)),
+		}, nil
+	})}
+
+	var messages []string
+	var topics []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			return nil, err
+		}
+		if strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			messages = append(messages, content["body"].(string))
+		} else if strings.Contains(req.URL.Path, "/state/m.room.topic") {
+			topics = append(topics, content["topic"].(string))
+		} else {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"rooms": {
+			"!castle:hyrule": {
+				"pagerduty": {"api_token": "secret", "schedule_id": "PSCHED"},
+				"topic": "On call: {{.OnCall}}"
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create oncall service: ", err)
+	}
+	poller := srv.(types.Poller)
+
+	next := poller.OnPoll(matrixCli)
+	if len(messages) != 1 || messages[0] != "Zelda is now on call until Tue 1 Jan 00:00 UTC" {
+		t.Errorf("Bad first handover: %v", messages)
+	}
+	if len(topics) != 1 || topics[0] != "On call: Zelda" {
+		t.Errorf("Bad topic: %v", topics)
+	}
+	if next.After(time.Now().Add(importPollInterval)) {
+		t.Errorf("Expected PagerDuty to be polled again within %s, got %s", importPollInterval, next)
+	}
+
+	// Nothing changed
+	poller.OnPoll(matrixCli)
+	if len(messages) != 1 || len(topics) != 1 {
+		t.Errorf("Announced a handover when nothing changed: %v %v", messages, topics)
+	}
+
+	onCall = "Link"
+	poller.OnPoll(matrixCli)
+	if len(messages) != 2 || messages[1] != "Link is now on call, taking over from Zelda until Tue 1 Jan 00:00 UTC" {
+		t.Errorf("Bad handover: %v", messages)
+	}
+
+	res, err := srv.Commands(matrixCli)[0].Command(id.RoomID("!castle:hyrule"), "@link:hyrule", nil)
+	if err != nil {
+		t.Fatalf("!oncall failed: %s", err)
+	}
+	if body := fmt.Sprintf("%+v", res); !strings.Contains(body, "Link is on call until") {
+		t.Errorf("Bad !oncall response: %s", body)
+	}
+}
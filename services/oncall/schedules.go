@@ -0,0 +1,111 @@
+package oncall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 20 * time.Second}
+
+// The base URLs of the PagerDuty and Opsgenie APIs
+var (
+	pagerDutyURL = "https://api.pagerduty.com"
+	opsgenieURL  = "https://api.opsgenie.com"
+)
+
+// PagerDutySchedule is a schedule in PagerDuty, see https://support.pagerduty.com/docs/schedule-basics
+type PagerDutySchedule struct {
+	// A read-only REST API key.
+	APIToken string `json:"api_token"`
+	// The ID of the schedule, e.g. PI7DH85.
+	ScheduleID string `json:"schedule_id"`
+}
+
+// OpsgenieSchedule is a schedule in Opsgenie, see https://support.atlassian.com/opsgenie/docs/what-are-on-call-schedules-and-rotations/
+type OpsgenieSchedule struct {
+	// An API key with read access.
+	APIKey string `json:"api_key"`
+	// The ID or name of the schedule.
+	ScheduleID string `json:"schedule_id"`
+	// Optional. The Opsgenie API to use, e.g. "https://api.eu.opsgenie.com" for accounts hosted
+	// in the EU.
+	APIURL string `json:"api_url"`
+}
+
+// current returns who is on call according to PagerDuty. If several people are, because the
+// schedule has several layers, they are all listed.
+func (p *PagerDutySchedule) current() (Shift, error) {
+	var res struct {
+		OnCalls []struct {
+			User struct {
+				Summary string `json:"summary"`
+			} `json:"user"`
+			End *time.Time `json:"end"`
+		} `json:"oncalls"`
+	}
+	u := fmt.Sprintf("%s/oncalls?schedule_ids[]=%s&earliest=true", pagerDutyURL, url.QueryEscape(p.ScheduleID))
+	if err := getJSON(u, "Token token="+p.APIToken, &res); err != nil {
+		return Shift{}, err
+	}
+	var shift Shift
+	var names []string
+	for _, oc := range res.OnCalls {
+		names = append(names, oc.User.Summary)
+		if oc.End != nil && (shift.Until.IsZero() || oc.End.Before(shift.Until)) {
+			shift.Until = *oc.End
+		}
+	}
+	shift.OnCall = strings.Join(names, ", ")
+	return shift, nil
+}
+
+// current returns who is on call according to Opsgenie.
+func (o *OpsgenieSchedule) current() (Shift, error) {
+	var res struct {
+		Data struct {
+			OnCallRecipients []string `json:"onCallRecipients"`
+		} `json:"data"`
+	}
+	apiURL := opsgenieURL
+	if o.APIURL != "" {
+		apiURL = strings.TrimSuffix(o.APIURL, "/")
+	}
+	u := fmt.Sprintf("%s/v2/schedules/%s/on-calls?identifierType=%s&flat=true", apiURL, url.PathEscape(o.ScheduleID), o.identifierType())
+	if err := getJSON(u, "GenieKey "+o.APIKey, &res); err != nil {
+		return Shift{}, err
+	}
+	// Opsgenie doesn't say when the shift ends, so it is polled for changes.
+	return Shift{OnCall: strings.Join(res.Data.OnCallRecipients, ", ")}, nil
+}
+
+// identifierType is whether the ScheduleID is an ID or a name. Opsgenie IDs are UUIDs.
+func (o *OpsgenieSchedule) identifierType() string {
+	if len(o.ScheduleID) == 36 && strings.Count(o.ScheduleID, "-") == 4 {
+		return "id"
+	}
+	return "name"
+}
+
+func getJSON(u, authorization string, out interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Accept", "application/json")
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("%s responded with HTTP %d", req.URL.Host, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,275 @@
+// Package osm implements a Service which looks up places on OpenStreetMap.
+package osm
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the OSM service
+const ServiceType = "osm"
+
+const (
+	defaultNominatimURL = "https://nominatim.openstreetmap.org/search"
+	defaultTileURL      = "https://tile.openstreetmap.org/{z}/{x}/{y}.png"
+	// The size of map tiles, in pixels
+	tileSize = 256
+	// The zooms the map tile is shown at: whole countries down to streets
+	minZoom = 3
+	maxZoom = 17
+)
+
+var httpClient = &http.Client{}
+
+// Service contains the Config fields for the OSM service.
+//
+// This service searches OpenStreetMap's Nominatim geocoder for places and addresses, and responds
+// with the place's coordinates, a link to it on openstreetmap.org and a map tile around it. No API
+// key is needed, but the public Nominatim and tile servers only allow light use, so busy bots
+// should point the service at their own servers.
+//
+// Example JSON request:
+//   {
+//       "nominatim_url": "https://nominatim.openstreetmap.org/search",
+//       "tile_url": "https://tile.openstreetmap.org/{z}/{x}/{y}.png",
+//       "language": "en"
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The Nominatim search endpoint. Defaults to the public OpenStreetMap server.
+	NominatimURL string `json:"nominatim_url"`
+	// Optional. The map tiles, with "{z}", "{x}" and "{y}" in place of the zoom and the tile's
+	// coordinates. Defaults to the public OpenStreetMap tiles. Set to "none" to not send a map.
+	TileURL string `json:"tile_url"`
+	// Optional. The language to name places in, e.g. "de". Defaults to the local language of
+	// each place.
+	Language string `json:"language"`
+}
+
+// place is a Nominatim search result.
+type place struct {
+	DisplayName string `json:"display_name"`
+	Lat         string `json:"lat"`
+	Lon         string `json:"lon"`
+	// The south, north, west and east edges of the place
+	BoundingBox []string `json:"boundingbox"`
+	Category    string   `json:"category"`
+	Type        string   `json:"type"`
+}
+
+// Commands supported:
+//    !osm place
+// Responds with the place's coordinates, a link to it and a map of it.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"osm"},
+			Arguments: []string{"place"},
+			Help:      "Find a place on OpenStreetMap",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdOSM(cli, roomID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdOSM(cli types.MatrixClient, roomID id.RoomID, args []string) (interface{}, error) {
+	query := strings.TrimSpace(strings.Join(args, " "))
+	if query == "" {
+		return nil, fmt.Errorf("Usage: !osm place")
+	}
+	p, err := s.search(query)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to search OpenStreetMap: %s", err)
+	}
+	if p == nil {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("No places found for '%s'", query),
+		}, nil
+	}
+	lat, err1 := strconv.ParseFloat(p.Lat, 64)
+	lon, err2 := strconv.ParseFloat(p.Lon, 64)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("OpenStreetMap returned bad coordinates for %s", p.DisplayName)
+	}
+	zoom := p.zoom()
+
+	if tile := s.tileURL(lat, lon, zoom); tile != "" {
+		if err := sendTile(cli, roomID, tile, p.DisplayName); err != nil {
+			log.WithError(err).WithField("tile", tile).Warn("Failed to send map tile")
+		}
+	}
+
+	text := fmt.Sprintf("📍 %s\n%.5f, %.5f", p.DisplayName, lat, lon)
+	if p.Type != "" && p.Type != "yes" {
+		text += " (" + strings.Replace(p.Type, "_", " ", -1) + ")"
+	}
+	text += fmt.Sprintf("\nhttps://www.openstreetmap.org/?mlat=%.5f&mlon=%.5f#map=%d/%.5f/%.5f", lat, lon, zoom, lat, lon)
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    text,
+	}, nil
+}
+
+// search returns the best match for the query, or nil if nothing matches.
+func (s *Service) search(query string) (*place, error) {
+	base := s.NominatimURL
+	if base == "" {
+		base = defaultNominatimURL
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("q", query)
+	q.Set("format", "jsonv2")
+	q.Set("limit", "1")
+	if s.Language != "" {
+		q.Set("accept-language", s.Language)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Nominatim's usage policy requires a User-Agent which identifies the application
+	req.Header.Set("User-Agent", "Go-NEB")
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var places []place
+	if err = json.NewDecoder(res.Body).Decode(&places); err != nil {
+		return nil, err
+	}
+	if len(places) == 0 {
+		return nil, nil
+	}
+	return &places[0], nil
+}
+
+// zoom returns the closest zoom at which the place fits on one map tile.
+func (p *place) zoom() int {
+	if len(p.BoundingBox) != 4 {
+		return maxZoom
+	}
+	var edges [4]float64
+	for i, edge := range p.BoundingBox {
+		var err error
+		if edges[i], err = strconv.ParseFloat(edge, 64); err != nil {
+			return maxZoom
+		}
+	}
+	// At zoom z the world is 2^z tiles across, so a tile covers 360/2^z degrees of longitude.
+	// Latitude is stretched by the projection, so compare the place's size in projected units.
+	width := math.Abs(edges[3]-edges[2]) / 360
+	height := math.Abs(mercatorY(edges[1]) - mercatorY(edges[0]))
+	span := math.Max(width, height)
+	if span <= 0 {
+		return maxZoom
+	}
+	zoom := int(math.Floor(math.Log2(1 / span)))
+	if zoom < minZoom {
+		return minZoom
+	} else if zoom > maxZoom {
+		return maxZoom
+	}
+	return zoom
+}
+
+// mercatorY returns how far down the Web Mercator map the latitude is, from 0 at the top to 1
+// at the bottom.
+func mercatorY(lat float64) float64 {
+	// The projection stops at about 85 degrees
+	lat = math.Max(-85.0511, math.Min(85.0511, lat))
+	rad := lat * math.Pi / 180
+	return (1 - math.Log(math.Tan(rad)+1/math.Cos(rad))/math.Pi) / 2
+}
+
+// tileURL returns the URL of the map tile with the coordinates on it, or "" if maps are turned off.
+func (s *Service) tileURL(lat, lon float64, zoom int) string {
+	template := s.TileURL
+	if template == "" {
+		template = defaultTileURL
+	} else if template == "none" {
+		return ""
+	}
+	n := math.Exp2(float64(zoom))
+	x := int(math.Floor((lon + 180) / 360 * n))
+	y := int(math.Floor(mercatorY(lat) * n))
+	// Places on the eastern or southern edge of the map are on the last tile
+	if x >= int(n) {
+		x = int(n) - 1
+	}
+	if y >= int(n) {
+		y = int(n) - 1
+	}
+	return strings.NewReplacer(
+		"{z}", strconv.Itoa(zoom),
+		"{x}", strconv.Itoa(x),
+		"{y}", strconv.Itoa(y),
+	).Replace(template)
+}
+
+// sendTile uploads the map tile to Matrix and sends it into the room.
+func sendTile(client types.MatrixClient, roomID id.RoomID, tile, name string) error {
+	resUpload, err := client.UploadLink(tile)
+	if err != nil {
+		return err
+	}
+	_, err = client.SendMessageEvent(roomID, mevt.EventMessage, mevt.MessageEventContent{
+		MsgType: mevt.MsgImage,
+		Body:    "Map of " + name,
+		URL:     resUpload.ContentURI.CUString(),
+		Info: &mevt.FileInfo{
+			Width:    tileSize,
+			Height:   tileSize,
+			MimeType: "image/png",
+		},
+	})
+	return err
+}
+
+// Register makes sure that the tile URL has the tile's coordinates in it.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.NominatimURL != "" {
+		if u, err := url.Parse(s.NominatimURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("Bad nominatim_url '%s': must be an http or https URL", s.NominatimURL)
+		}
+	}
+	if s.TileURL != "" && s.TileURL != "none" {
+		for _, placeholder := range []string{"{z}", "{x}", "{y}"} {
+			if !strings.Contains(s.TileURL, placeholder) {
+				return fmt.Errorf("Bad tile_url '%s': it needs %s in it", s.TileURL, placeholder)
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package osm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestCommand(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		q := req.URL.Query()
+		if req.URL.Host != "nominatim.openstreetmap.org" || q.Get("format") != "jsonv2" {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		if req.Header.Get("User-Agent") == "" {
+			return nil, fmt.Errorf("No User-Agent")
+		}
+		body := `[]`
+		if strings.EqualFold(q.Get("q"), "hyrule castle") {
+			body = `[{"display_name":"Hyrule Castle, Central Hyrule","lat":"51.50141","lon":"-0.14189",
+				"boundingbox":["51.49951","51.50331","-0.14599","-0.13799"],"category":"historic","type":"castle"}]`
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	var images []mevt.MessageEventContent
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "tile.openstreetmap.org" {
+			if req.URL.Path != "/15/16371/10897.png" {
+				return nil, fmt.Errorf("Wrong tile: %s", req.URL.String())
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Type": {"image/png"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString("not really a PNG")),
+			}, nil
+		}
+		if strings.Contains(req.URL.Path, "/upload") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://hyrule/map"}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, err
+		}
+		images = append(images, msg)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$map:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create OSM service: ", err)
+	}
+	s := srv.(*Service)
+
+	res, err := s.cmdOSM(matrixCli, "!hyrule:hyrule", []string{"Hyrule", "castle"})
+	if err != nil {
+		t.Fatal("Failed to find place: ", err)
+	}
+	want := "📍 Hyrule Castle, Central Hyrule\n51.50141, -0.14189 (castle)\n" +
+		"https://www.openstreetmap.org/?mlat=51.50141&mlon=-0.14189#map=15/51.50141/-0.14189"
+	if got := res.(*mevt.MessageEventContent).Body; got != want {
+		t.Errorf("Bad response: got %q, want %q", got, want)
+	}
+	if len(images) != 1 || images[0].MsgType != mevt.MsgImage || images[0].URL != "mxc://hyrule/map" {
+		t.Errorf("Bad map: %+v", images)
+	}
+
+	s.TileURL = "none"
+	images = nil
+	if _, err = s.cmdOSM(matrixCli, "!hyrule:hyrule", []string{"hyrule castle"}); err != nil {
+		t.Fatal("Failed to find place: ", err)
+	}
+	if len(images) != 0 {
+		t.Errorf("Sent a map when maps are turned off: %+v", images)
+	}
+
+	res, err = s.cmdOSM(matrixCli, "!hyrule:hyrule", []string{"termina"})
+	if err != nil {
+		t.Fatal("Failed to search: ", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "No places found for 'termina'" {
+		t.Errorf("Bad response for unknown place: %s", got)
+	}
+	if _, err = s.cmdOSM(matrixCli, "!hyrule:hyrule", nil); err == nil {
+		t.Error("Expected an error without a place")
+	}
+}
+
+func TestTileURL(t *testing.T) {
+	s := &Service{}
+	for _, tc := range []struct {
+		lat, lon float64
+		zoom     int
+		want     string
+	}{
+		{51.50141, -0.14189, 15, "https://tile.openstreetmap.org/15/16371/10897.png"},
+		{0, 0, 3, "https://tile.openstreetmap.org/3/4/4.png"},
+		{-90, 180, 3, "https://tile.openstreetmap.org/3/7/7.png"},
+	} {
+		if got := s.tileURL(tc.lat, tc.lon, tc.zoom); got != tc.want {
+			t.Errorf("tileURL(%v, %v, %d): got %s, want %s", tc.lat, tc.lon, tc.zoom, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		boundingBox []string
+		want        int
+	}{
+		{[]string{"51.49951", "51.50331", "-0.14599", "-0.13799"}, 15},
+		{[]string{"-90", "90", "-180", "180"}, minZoom},
+		{[]string{"51.5", "51.5", "-0.1", "-0.1"}, maxZoom},
+		{nil, maxZoom},
+	} {
+		p := place{BoundingBox: tc.boundingBox}
+		if got := p.zoom(); got != tc.want {
+			t.Errorf("zoom(%v): got %d, want %d", tc.boundingBox, got, tc.want)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"nominatim_url": "ftp://nominatim.hyrule"}`,
+		`{"tile_url": "https://tiles.hyrule/{z}/{x}.png"}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create OSM service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+// Package pagerduty implements a Service which sends notices into rooms about PagerDuty incidents,
+// and acknowledges and resolves them from rooms.
+package pagerduty
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/templates"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the PagerDuty service.
+const ServiceType = "pagerduty"
+
+// The biggest webhook payload which is read
+const maxPayloadSize = 1024 * 1024
+
+// The PagerDuty REST API
+const apiURL = "https://api.pagerduty.com"
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// A PagerDuty incident ID, e.g. "PGR0VU2", or the incident's URL
+var incidentRegex = regexp.MustCompile(`^(?:https://[^/]+\.pagerduty\.com/incidents/)?([A-Z0-9]+)$`)
+
+// The events which can be announced
+const (
+	eventTriggered    = "triggered"
+	eventAcknowledged = "acknowledged"
+	eventResolved     = "resolved"
+)
+
+// The webhook event types of each event
+var eventTypes = map[string]string{
+	"incident.triggered":    eventTriggered,
+	"incident.acknowledged": eventAcknowledged,
+	"incident.resolved":     eventResolved,
+}
+
+// The colour of each urgency
+var urgencyColors = map[string]string{
+	"high": "red",
+	"low":  "orange",
+}
+
+// Service contains the Config fields for the PagerDuty service.
+//
+// This service will send notices into a Matrix room when PagerDuty incidents are triggered,
+// acknowledged and resolved. It requires a public domain which PagerDuty can reach. Notices will be
+// sent as the service user ID.
+//
+// Go-NEB can't set up the webhooks itself. Add a generic V3 webhook subscription under
+// Integrations > Generic Webhooks (v3), with the URL in webhook_url, and put the secret which
+// PagerDuty shows into this config.
+//
+// Incidents can be acknowledged and resolved from the rooms with "!pd ack PGR0VU2" and
+// "!pd resolve PGR0VU2" when the config has a REST API token. PagerDuty records the changes as
+// made by the user with the "from" email address.
+//
+// Operators can change the notices with template overrides named "pagerduty.triggered",
+// "pagerduty.acknowledged" and "pagerduty.resolved" (see package "templates"), which are given the
+// webhook payload, e.g. {{.event.data.html_url}}.
+//
+// Example JSON request:
+//   {
+//       "secret": "a secret from PagerDuty",
+//       "api_token": "y_NbAkKc66ryYTWUXYEu",
+//       "from": "ops@example.com",
+//       "rooms": {
+//           "!ewfug483gsfe:localhost": {
+//               "services": ["PF9KMXH"],
+//               "events": ["triggered", "resolved"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL to add as the webhook subscription. Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The secret of the webhook subscription, which PagerDuty signs its requests with.
+	Secret string `json:"secret"`
+	// Optional. A PagerDuty REST API token. Required for the !pd commands.
+	APIToken string `json:"api_token"`
+	// Optional. The email address of the PagerDuty user who commands act as. Required with an
+	// api_token.
+	From string `json:"from"`
+	// A map from Matrix room ID to what is announced in the room. The !pd commands can be used in
+	// these rooms.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is which incidents are announced in a room.
+type RoomConfig struct {
+	// Optional. Only announce incidents of these PagerDuty services, by ID or name. Defaults to
+	// every service.
+	Services []string `json:"services"`
+	// Optional. What to announce: "triggered", "acknowledged" and "resolved". Defaults to all of
+	// them.
+	Events []string `json:"events"`
+}
+
+// allows returns whether the event is announced.
+func (c *RoomConfig) allows(event string, service reference) bool {
+	if len(c.Events) > 0 && !contains(c.Events, event) {
+		return false
+	}
+	if len(c.Services) == 0 {
+		return true
+	}
+	for _, s := range c.Services {
+		if s == service.ID || strings.EqualFold(s, service.Summary) {
+			return true
+		}
+	}
+	return false
+}
+
+// reference is a reference to another PagerDuty object, like a user or service.
+type reference struct {
+	ID      string `json:"id"`
+	Summary string `json:"summary"`
+}
+
+// payload is the parts of a webhook payload which the notices are made from.
+type payload struct {
+	Event struct {
+		EventType string     `json:"event_type"`
+		Agent     *reference `json:"agent"`
+		Data      struct {
+			ID      string    `json:"id"`
+			Number  int       `json:"number"`
+			Title   string    `json:"title"`
+			HTMLURL string    `json:"html_url"`
+			Urgency string    `json:"urgency"`
+			Service reference `json:"service"`
+		} `json:"data"`
+	} `json:"event"`
+}
+
+// htmlMessage returns the notice for the event, coloured by the incident's urgency.
+func (p *payload) htmlMessage(event string) string {
+	incident := p.Event.Data
+	color := urgencyColors[incident.Urgency]
+	if event == eventResolved {
+		color = "green"
+	}
+	msg := fmt.Sprintf("[<u>%s</u>] #%d <b>%s</b>: ", html.EscapeString(incident.Service.Summary), incident.Number,
+		html.EscapeString(incident.Title))
+	if color != "" {
+		msg += fmt.Sprintf(`<font color="%s">%s</font>`, color, event)
+	} else {
+		msg += event
+	}
+	if event == eventTriggered && incident.Urgency != "" {
+		msg += fmt.Sprintf(" (%s urgency)", html.EscapeString(incident.Urgency))
+	} else if p.Event.Agent != nil && p.Event.Agent.Summary != "" {
+		msg += " by " + html.EscapeString(p.Event.Agent.Summary)
+	}
+	if incident.HTMLURL != "" {
+		msg += " - " + html.EscapeString(incident.HTMLURL)
+	}
+	return msg
+}
+
+// OnReceiveWebhook receives requests from PagerDuty and sends notices about incidents into the
+// rooms which announce them.
+//
+// Requests must be signed with the secret. Other events, like incidents being reassigned, are
+// acknowledged and ignored.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxPayloadSize))
+	if err != nil {
+		log.WithError(err).Error("Failed to read PagerDuty webhook body")
+		w.WriteHeader(400)
+		return
+	}
+	if !checkSignature(body, req.Header.Get("X-PagerDuty-Signature"), s.Secret) {
+		log.WithFields(log.Fields{
+			"service_id":            s.ServiceID(),
+			"x-pagerduty-signature": req.Header.Get("X-PagerDuty-Signature"),
+		}).Warn("Received PagerDuty webhook which failed the signature check")
+		w.WriteHeader(403)
+		return
+	}
+	var p payload
+	if err = json.Unmarshal(body, &p); err != nil {
+		log.WithError(err).Error("PagerDuty webhook received an invalid JSON payload")
+		w.WriteHeader(400)
+		return
+	}
+	event, ok := eventTypes[p.Event.EventType]
+	if !ok {
+		log.WithField("event_type", p.Event.EventType).Debug("Ignoring PagerDuty event")
+		w.WriteHeader(200)
+		return
+	}
+	if p.Event.Data.ID == "" {
+		log.Error("PagerDuty webhook is missing its incident")
+		w.WriteHeader(400)
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"incident":   p.Event.Data.ID,
+		"event_type": p.Event.EventType,
+	})
+
+	msg := utils.StrippedHTMLMessage(mevt.MsgNotice, p.htmlMessage(event))
+	var data map[string]interface{}
+	if err = json.Unmarshal(body, &data); err == nil {
+		msg = templates.Render("pagerduty."+event, data, msg)
+	}
+	for roomID, roomConfig := range s.Rooms {
+		if !roomConfig.allows(event, p.Event.Data.Service) {
+			continue
+		}
+		logger.WithField("room_id", roomID).Print("Sending PagerDuty notification to room")
+		if _, e := notify.Send(cli, s, notify.Notification{
+			RoomID:         roomID,
+			Content:        msg,
+			CorrelationKey: "pagerduty " + p.Event.Data.ID,
+		}); e != nil {
+			logger.WithError(e).WithField("room_id", roomID).Print(
+				"Failed to send PagerDuty notification to room.")
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// checkSignature reports whether the X-PagerDuty-Signature header has a "v1=<hex>" signature which
+// is the HMAC of the body with the secret. The header has several comma-separated signatures while
+// the secret is being rotated.
+func checkSignature(body []byte, header, secret string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	want := mac.Sum(nil)
+	for _, sig := range strings.Split(header, ",") {
+		sig = strings.TrimSpace(sig)
+		sigHex := strings.TrimPrefix(sig, "v1=")
+		if sigHex == sig {
+			continue
+		}
+		if got, err := hex.DecodeString(sigHex); err == nil && hmac.Equal(got, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// Commands supported:
+//    !pd ack incident
+// Acknowledges the PagerDuty incident, by ID or URL.
+//    !pd resolve incident
+// Resolves the PagerDuty incident, by ID or URL.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"pd", "ack"},
+			Arguments: []string{"incident"},
+			Help:      "Acknowledge a PagerDuty incident",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdUpdate(roomID, userID, args, eventAcknowledged)
+			},
+		},
+		{
+			Path:      []string{"pd", "resolve"},
+			Arguments: []string{"incident"},
+			Help:      "Resolve a PagerDuty incident",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdUpdate(roomID, userID, args, eventResolved)
+			},
+		},
+	}
+}
+
+// cmdUpdate changes the status of an incident to acknowledged or resolved.
+func (s *Service) cmdUpdate(roomID id.RoomID, userID id.UserID, args []string, status string) (interface{}, error) {
+	verb, done := "ack", "Acknowledged"
+	if status == eventResolved {
+		verb, done = "resolve", "Resolved"
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !pd %s incident", verb)
+	}
+	if _, ok := s.Rooms[roomID]; !ok {
+		return nil, fmt.Errorf("PagerDuty incidents can't be changed from this room")
+	}
+	if s.APIToken == "" {
+		return nil, fmt.Errorf("Changing incidents isn't set up: the service needs an api_token")
+	}
+	m := incidentRegex.FindStringSubmatch(args[0])
+	if m == nil {
+		return nil, fmt.Errorf("'%s' is not a PagerDuty incident ID, e.g. PGR0VU2", args[0])
+	}
+	incidentID := m[1]
+
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"incident": map[string]string{
+			"type":   "incident_reference",
+			"status": status,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("PUT", apiURL+"/incidents/"+incidentID, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Token token="+s.APIToken)
+	req.Header.Set("Accept", "application/vnd.pagerduty+json;version=2")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("From", s.From)
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to %s %s: %s", verb, incidentID, err)
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, fmt.Errorf("Failed to %s %s: the api_token was refused", verb, incidentID)
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("There is no PagerDuty incident %s", incidentID)
+	default:
+		var body struct {
+			Error struct {
+				Message string   `json:"message"`
+				Errors  []string `json:"errors"`
+			} `json:"error"`
+		}
+		if json.NewDecoder(res.Body).Decode(&body) == nil && body.Error.Message != "" {
+			msg := body.Error.Message
+			if len(body.Error.Errors) > 0 {
+				msg += ": " + strings.Join(body.Error.Errors, ", ")
+			}
+			return nil, fmt.Errorf("Failed to %s %s: %s", verb, incidentID, msg)
+		}
+		return nil, fmt.Errorf("Failed to %s %s: request error: %d", verb, incidentID, res.StatusCode)
+	}
+	var incident struct {
+		Incident struct {
+			Number int    `json:"incident_number"`
+			Title  string `json:"title"`
+		} `json:"incident"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&incident); err != nil {
+		return nil, fmt.Errorf("Failed to %s %s: %s", verb, incidentID, err)
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"user_id":    userID,
+		"incident":   incidentID,
+		"status":     status,
+	}).Info("Changed PagerDuty incident")
+
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("%s #%d: %s", done, incident.Incident.Number, incident.Incident.Title),
+	}, nil
+}
+
+// Register makes sure the Config information supplied is valid, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if s.Secret == "" {
+		return fmt.Errorf("A secret is required")
+	}
+	if s.APIToken != "" && !strings.Contains(s.From, "@") {
+		return fmt.Errorf("The email address of a PagerDuty user is required in from with an api_token")
+	}
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	for roomID, roomConfig := range s.Rooms {
+		for _, event := range roomConfig.Events {
+			if event != eventTriggered && event != eventAcknowledged && event != eventResolved {
+				return fmt.Errorf("Room %s has an unknown event '%s'", roomID, event)
+			}
+		}
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
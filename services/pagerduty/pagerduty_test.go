@@ -0,0 +1,226 @@
+package pagerduty
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const incidentEvent = `{
+	"event": {
+		"id": "01BZ",
+		"event_type": "incident.%s",
+		"resource_type": "incident",
+		"agent": {"id": "PLINK01", "summary": "Link", "type": "user_reference"},
+		"data": {
+			"id": "PGR0VU2",
+			"type": "incident",
+			"number": 2,
+			"status": "%[1]s",
+			"title": "Ganon has escaped",
+			"html_url": "https://hyrule.pagerduty.com/incidents/PGR0VU2",
+			"urgency": "%s",
+			"service": {"id": "PCASTLE", "summary": "Castle", "type": "service_reference"}
+		}
+	}
+}`
+
+func sign(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhook(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.String(), "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, fmt.Sprintf("%s %s", room, msg.Body))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"secret": "triforce",
+		"rooms": {
+			"!castle:hyrule": {"services": ["castle"]},
+			"!termina:hyrule": {"services": ["PCLOCK"]},
+			"!ops:hyrule": {"events": ["triggered"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create pagerduty service: ", err)
+	}
+	s := srv.(*Service)
+
+	for _, tc := range []struct {
+		body      string
+		signature string // defaults to the body signed with the secret
+		code      int
+	}{
+		{fmt.Sprintf(incidentEvent, "triggered", "high"), "", 200},
+		{fmt.Sprintf(incidentEvent, "acknowledged", "high"), "", 200},
+		{fmt.Sprintf(incidentEvent, "resolved", "low"), "", 200},
+		{fmt.Sprintf(incidentEvent, "annotated", "high"), "", 200},
+		{`{"event": {"event_type": "pagey.ping"}}`, "", 200},
+		{fmt.Sprintf(incidentEvent, "triggered", "high"), "none", 403},
+		{fmt.Sprintf(incidentEvent, "triggered", "high"), sign("{}", "triforce"), 403},
+		{fmt.Sprintf(incidentEvent, "triggered", "high"), sign(fmt.Sprintf(incidentEvent, "triggered", "high"), "ganon"), 403},
+		{`{"event": {"event_type": "incident.triggered"}}`, "", 400},
+		{`not json`, "", 400},
+	} {
+		req := httptest.NewRequest("POST", "https://neb.endpoint/pagerduty", strings.NewReader(tc.body))
+		switch tc.signature {
+		case "":
+			// PagerDuty signs with both secrets while one is being rotated
+			req.Header.Set("X-PagerDuty-Signature", sign(tc.body, "old")+","+sign(tc.body, "triforce"))
+		case "none":
+		default:
+			req.Header.Set("X-PagerDuty-Signature", tc.signature)
+		}
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, matrixCli)
+		if w.Code != tc.code {
+			t.Errorf("Bad response to %s: got %d, want %d", tc.body, w.Code, tc.code)
+		}
+	}
+
+	url := " - https://hyrule.pagerduty.com/incidents/PGR0VU2"
+	want := map[string]bool{
+		"!castle:hyrule [Castle] #2 Ganon has escaped: triggered (high urgency)" + url: true,
+		"!ops:hyrule [Castle] #2 Ganon has escaped: triggered (high urgency)" + url:    true,
+		"!castle:hyrule [Castle] #2 Ganon has escaped: acknowledged by Link" + url:     true,
+		"!castle:hyrule [Castle] #2 Ganon has escaped: resolved by Link" + url:         true,
+	}
+	if len(sent) != len(want) {
+		t.Errorf("Bad number of notices: got %d, want %d: %q", len(sent), len(want), sent)
+	}
+	for _, msg := range sent {
+		if !want[msg] {
+			t.Errorf("Unexpected notice: %q", msg)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	var updated []string
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Authorization") != "Token token=pd_token" {
+			return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewBufferString(""))}, nil
+		}
+		if req.Method != "PUT" || !strings.HasPrefix(req.URL.String(), "https://api.pagerduty.com/incidents/") {
+			return nil, fmt.Errorf("Unknown request: %s %s", req.Method, req.URL.String())
+		}
+		var body struct {
+			Incident struct {
+				Status string `json:"status"`
+			} `json:"incident"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		updated = append(updated, fmt.Sprintf("%s %s %s", req.URL.Path, body.Incident.Status, req.Header.Get("From")))
+		switch req.URL.Path {
+		case "/incidents/PMISSING":
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		case "/incidents/PDONE":
+			return &http.Response{
+				StatusCode: 400,
+				Body: ioutil.NopCloser(bytes.NewBufferString(
+					`{"error": {"message": "Invalid Input Provided", "errors": ["Incident Already Resolved"]}}`)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(
+				`{"incident": {"id": "PGR0VU2", "incident_number": 2, "title": "Ganon has escaped"}}`)),
+		}, nil
+	})}
+
+	s := &Service{
+		APIToken: "pd_token",
+		From:     "zelda@hyrule.example",
+		Rooms:    map[id.RoomID]RoomConfig{"!castle:hyrule": {}},
+	}
+	res, err := s.cmdUpdate("!castle:hyrule", "@link:hyrule", []string{"PGR0VU2"}, eventAcknowledged)
+	if err != nil {
+		t.Fatal("!pd ack failed: ", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "Acknowledged #2: Ganon has escaped" {
+		t.Errorf("Bad !pd ack response: %q", body)
+	}
+	res, err = s.cmdUpdate("!castle:hyrule", "@link:hyrule", []string{"https://hyrule.pagerduty.com/incidents/PGR0VU2"}, eventResolved)
+	if err != nil {
+		t.Fatal("!pd resolve failed: ", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "Resolved #2: Ganon has escaped" {
+		t.Errorf("Bad !pd resolve response: %q", body)
+	}
+	wantUpdated := "/incidents/PGR0VU2 acknowledged zelda@hyrule.example|/incidents/PGR0VU2 resolved zelda@hyrule.example"
+	if got := strings.Join(updated, "|"); got != wantUpdated {
+		t.Errorf("Bad incident updates: got %q, want %q", got, wantUpdated)
+	}
+
+	for _, tc := range []struct {
+		roomID  id.RoomID
+		args    []string
+		wantErr string
+	}{
+		{"!castle:hyrule", []string{}, "Usage: !pd resolve incident"},
+		{"!castle:hyrule", []string{"ganon"}, "'ganon' is not a PagerDuty incident ID, e.g. PGR0VU2"},
+		{"!termina:hyrule", []string{"PGR0VU2"}, "PagerDuty incidents can't be changed from this room"},
+		{"!castle:hyrule", []string{"PMISSING"}, "There is no PagerDuty incident PMISSING"},
+		{"!castle:hyrule", []string{"PDONE"}, "Failed to resolve PDONE: Invalid Input Provided: Incident Already Resolved"},
+	} {
+		_, err := s.cmdUpdate(tc.roomID, "@link:hyrule", tc.args, eventResolved)
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("!pd resolve %v: got error %v, want %q", tc.args, err, tc.wantErr)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"rooms": {"!castle:hyrule": {}}}`,
+		`{"secret": "triforce"}`,
+		`{"secret": "triforce", "api_token": "pd_token", "rooms": {"!castle:hyrule": {}}}`,
+		`{"secret": "triforce", "rooms": {"!castle:hyrule": {"events": ["annotated"]}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create pagerduty service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
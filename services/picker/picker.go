@@ -0,0 +1,372 @@
+// Package picker implements a Service which picks one of a room's options at random, e.g. where
+// to go for lunch.
+package picker
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Picker service
+const ServiceType = "picker"
+
+// Limits on lists, so that they stay readable
+const (
+	maxOptions = 100
+	maxWeight  = 10
+)
+
+var listNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// Picks options at random. Overridden by tests.
+var randIntn = rand.Intn
+
+// Service contains the Config fields for the Picker service.
+//
+// Each list becomes a command which rooms use to keep their own options for the list and pick
+// one of them at random. For example, with a "lunch" list:
+//   !lunch add Thai Palace
+//   !lunch weight 3 Thai Palace
+//   !lunch pick
+// Options with a higher weight are picked more often, and the most recent picks are avoided so
+// that rooms get some variety. "!pick a, b, c" picks one of the options given.
+//
+// Example JSON request:
+//   {
+//       "lists": ["lunch", "film"],
+//       "avoid_recent": 2
+//   }
+type Service struct {
+	types.DefaultService
+	// The names of the lists, which are the commands for them, e.g. "lunch" for "!lunch pick".
+	Lists []string `json:"lists"`
+	// Optional. How many of the most recent picks aren't picked again, unless there is nothing
+	// else to pick. Defaults to 1. Set to -1 to allow the same option to be picked twice in a row.
+	AvoidRecent int `json:"avoid_recent"`
+}
+
+// pickList is a room's options for a list. It is stored in the service state under
+// "list <room ID> <list name>".
+type pickList struct {
+	Options []option `json:"options"`
+	// The names of the most recent picks, oldest first
+	Recent []string `json:"recent"`
+}
+
+type option struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+func (o *option) weight() int {
+	if o.Weight < 1 {
+		return 1
+	}
+	return o.Weight
+}
+
+// find returns the index of the option with the name, ignoring case, or -1.
+func (l *pickList) find(name string) int {
+	for i, o := range l.Options {
+		if strings.EqualFold(o.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// pick returns a random option, weighted by the options' weights, which isn't one of the last
+// avoidRecent picks if there are others, and remembers it.
+func (l *pickList) pick(avoidRecent int) option {
+	var candidates []option
+	for _, o := range l.Options {
+		recent := false
+		for i := len(l.Recent) - 1; i >= 0 && i >= len(l.Recent)-avoidRecent; i-- {
+			if strings.EqualFold(l.Recent[i], o.Name) {
+				recent = true
+			}
+		}
+		if !recent {
+			candidates = append(candidates, o)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = l.Options
+	}
+	total := 0
+	for _, o := range candidates {
+		total += o.weight()
+	}
+	n := randIntn(total)
+	picked := candidates[len(candidates)-1]
+	for _, o := range candidates {
+		if n -= o.weight(); n < 0 {
+			picked = o
+			break
+		}
+	}
+	l.Recent = append(l.Recent, picked.Name)
+	if len(l.Recent) > avoidRecent {
+		l.Recent = l.Recent[len(l.Recent)-avoidRecent:]
+	}
+	return picked
+}
+
+// Commands supported:
+//    !pick option1, option2, ...
+// Responds with one of the options.
+//    !<list> add option
+//    !<list> remove option
+// Adds or removes an option from the room's list.
+//    !<list> weight N option
+// Makes the option N times as likely to be picked as an option with the default weight of 1.
+//    !<list> list
+// Responds with the options on the room's list.
+//    !<list> pick
+// Responds with one of the options on the room's list.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	cmds := []types.Command{
+		{
+			Path:      []string{"pick"},
+			Arguments: []string{"option1, option2, ..."},
+			Help:      "Pick one of the options",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdPickOneOf(args)
+			},
+		},
+	}
+	for _, name := range s.Lists {
+		list := name
+		cmds = append(cmds, []types.Command{
+			{
+				Path:      []string{list, "add"},
+				Arguments: []string{"option"},
+				Help:      fmt.Sprintf("Add an option to the %s list", list),
+				Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+					return s.cmdAdd(roomID, list, args)
+				},
+			},
+			{
+				Path:      []string{list, "remove"},
+				Arguments: []string{"option"},
+				Help:      fmt.Sprintf("Remove an option from the %s list", list),
+				Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+					return s.cmdRemove(roomID, list, args)
+				},
+			},
+			{
+				Path:      []string{list, "weight"},
+				Arguments: []string{"N", "option"},
+				Help:      fmt.Sprintf("Make an option on the %s list N times as likely to be picked", list),
+				Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+					return s.cmdWeight(roomID, list, args)
+				},
+			},
+			{
+				Path: []string{list, "list"},
+				Help: fmt.Sprintf("Show the options on the %s list", list),
+				Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+					return s.cmdList(roomID, list)
+				},
+			},
+			{
+				Path: []string{list, "pick"},
+				Help: fmt.Sprintf("Pick an option from the %s list", list),
+				Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+					return s.cmdPick(roomID, list)
+				},
+			},
+		}...)
+	}
+	return cmds
+}
+
+func (s *Service) cmdPickOneOf(args []string) (interface{}, error) {
+	var options []option
+	for _, name := range strings.Split(strings.Join(args, " "), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			options = append(options, option{Name: name, Weight: 1})
+		}
+	}
+	if len(options) < 2 {
+		return nil, fmt.Errorf("Usage: !pick option1, option2, ...")
+	}
+	l := pickList{Options: options}
+	return notice("🎲 " + l.pick(0).Name), nil
+}
+
+func (s *Service) cmdAdd(roomID id.RoomID, list string, args []string) (interface{}, error) {
+	name := strings.Join(args, " ")
+	if name == "" {
+		return nil, fmt.Errorf("Usage: !%s add option", list)
+	}
+	l, err := s.loadList(roomID, list)
+	if err != nil {
+		return nil, err
+	}
+	if l.find(name) >= 0 {
+		return notice(fmt.Sprintf("%s is already on the %s list", name, list)), nil
+	}
+	if len(l.Options) >= maxOptions {
+		return nil, fmt.Errorf("The %s list is full: it can have up to %d options", list, maxOptions)
+	}
+	l.Options = append(l.Options, option{Name: name, Weight: 1})
+	if err = s.storeList(roomID, list, l); err != nil {
+		return nil, err
+	}
+	return notice(fmt.Sprintf("Added %s to the %s list", name, list)), nil
+}
+
+func (s *Service) cmdRemove(roomID id.RoomID, list string, args []string) (interface{}, error) {
+	name := strings.Join(args, " ")
+	l, err := s.loadList(roomID, list)
+	if err != nil {
+		return nil, err
+	}
+	i := l.find(name)
+	if i < 0 {
+		return notice(fmt.Sprintf("%s isn't on the %s list", name, list)), nil
+	}
+	removed := l.Options[i].Name
+	l.Options = append(l.Options[:i], l.Options[i+1:]...)
+	if err = s.storeList(roomID, list, l); err != nil {
+		return nil, err
+	}
+	return notice(fmt.Sprintf("Removed %s from the %s list", removed, list)), nil
+}
+
+func (s *Service) cmdWeight(roomID id.RoomID, list string, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("Usage: !%s weight N option", list)
+	}
+	weight, err := strconv.Atoi(args[0])
+	if err != nil || weight < 1 || weight > maxWeight {
+		return nil, fmt.Errorf("The weight must be a number from 1 to %d", maxWeight)
+	}
+	name := strings.Join(args[1:], " ")
+	l, err := s.loadList(roomID, list)
+	if err != nil {
+		return nil, err
+	}
+	i := l.find(name)
+	if i < 0 {
+		return notice(fmt.Sprintf("%s isn't on the %s list", name, list)), nil
+	}
+	l.Options[i].Weight = weight
+	if err = s.storeList(roomID, list, l); err != nil {
+		return nil, err
+	}
+	return notice(fmt.Sprintf("%s now has a weight of %d", l.Options[i].Name, weight)), nil
+}
+
+func (s *Service) cmdList(roomID id.RoomID, list string) (interface{}, error) {
+	l, err := s.loadList(roomID, list)
+	if err != nil {
+		return nil, err
+	}
+	if len(l.Options) == 0 {
+		return notice(fmt.Sprintf("The %s list is empty. Add options with !%s add option", list, list)), nil
+	}
+	var names []string
+	for _, o := range l.Options {
+		if o.Weight > 1 {
+			names = append(names, fmt.Sprintf("%s (×%d)", o.Name, o.Weight))
+		} else {
+			names = append(names, o.Name)
+		}
+	}
+	body := fmt.Sprintf("The %s list: %s", list, strings.Join(names, ", "))
+	if len(l.Recent) > 0 {
+		body += "\nRecently picked: " + strings.Join(l.Recent, ", ")
+	}
+	return notice(body), nil
+}
+
+func (s *Service) cmdPick(roomID id.RoomID, list string) (interface{}, error) {
+	l, err := s.loadList(roomID, list)
+	if err != nil {
+		return nil, err
+	}
+	if len(l.Options) == 0 {
+		return notice(fmt.Sprintf("The %s list is empty. Add options with !%s add option", list, list)), nil
+	}
+	picked := l.pick(s.avoidRecent())
+	if err = s.storeList(roomID, list, l); err != nil {
+		return nil, err
+	}
+	return notice(fmt.Sprintf("🎲 %s: %s", list, picked.Name)), nil
+}
+
+func (s *Service) avoidRecent() int {
+	if s.AvoidRecent < 0 {
+		return 0
+	} else if s.AvoidRecent == 0 {
+		return 1
+	}
+	return s.AvoidRecent
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func (s *Service) loadList(roomID id.RoomID, list string) (*pickList, error) {
+	var l pickList
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "list "+roomID.String()+" "+list)
+	if err == sql.ErrNoRows {
+		return &l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (s *Service) storeList(roomID id.RoomID, list string, l *pickList) error {
+	stateJSON, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "list "+roomID.String()+" "+list, stateJSON)
+}
+
+// Register makes sure that the lists have names which can be used as commands.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	seen := make(map[string]bool)
+	for _, list := range s.Lists {
+		if !listNameRegex.MatchString(list) {
+			return fmt.Errorf("Bad list name '%s': must be lowercase letters, digits, - and _", list)
+		}
+		if list == "pick" {
+			return fmt.Errorf("A list can't be called pick, because !pick picks from the options given")
+		}
+		if seen[list] {
+			return fmt.Errorf("The list '%s' is configured twice", list)
+		}
+		seen[list] = true
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
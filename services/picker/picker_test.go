@@ -0,0 +1,131 @@
+package picker
+
+import (
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestPick(t *testing.T) {
+	var rolls []int
+	randIntn = func(n int) int {
+		roll := rolls[0]
+		rolls = rolls[1:]
+		if roll >= n {
+			t.Fatalf("Roll %d is out of range for %d", roll, n)
+		}
+		return roll
+	}
+	l := pickList{Options: []option{{"Thai Palace", 3}, {"Burger Barn", 1}, {"Noodle Bar", 1}}}
+
+	testCases := []struct {
+		avoidRecent int
+		roll        int
+		want        string
+	}{
+		// Thai Palace takes up the first 3 of 5
+		{2, 2, "Thai Palace"},
+		// Without Thai Palace, Burger Barn and Noodle Bar are the 2
+		{2, 1, "Noodle Bar"},
+		// Only Burger Barn hasn't been picked recently
+		{2, 0, "Burger Barn"},
+		// Thai Palace can be picked again
+		{2, 2, "Thai Palace"},
+		// Without avoiding recent picks, everything can be picked
+		{0, 2, "Thai Palace"},
+	}
+	for i, tc := range testCases {
+		rolls = []int{tc.roll}
+		if got := l.pick(tc.avoidRecent).Name; got != tc.want {
+			t.Errorf("Pick %d: got %s, want %s", i, got, tc.want)
+		}
+	}
+
+	// When everything has been picked recently, anything can be picked
+	l = pickList{Options: []option{{"Heads", 1}, {"Tails", 1}}}
+	rolls = []int{0, 0, 0}
+	for _, want := range []string{"Heads", "Tails", "Heads"} {
+		if got := l.pick(5).Name; got != want {
+			t.Errorf("Got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	randIntn = func(n int) int { return n - 1 }
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"lists":["lunch"]}`))
+	if err != nil {
+		t.Fatal("Failed to create picker service: ", err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register picker service: ", err)
+	}
+	s := srv.(*Service)
+	if cmds := s.Commands(nil); len(cmds) != 6 {
+		t.Fatalf("Unexpected number of commands: %d", len(cmds))
+	}
+
+	body := func(res interface{}, err error) string {
+		if err != nil {
+			t.Fatalf("Command failed: %s", err)
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+	add := func(args ...string) (interface{}, error) { return s.cmdAdd("!office:hyrule", "lunch", args) }
+
+	if got := body(s.cmdPick("!office:hyrule", "lunch")); got != "The lunch list is empty. Add options with !lunch add option" {
+		t.Errorf("Bad empty pick: %s", got)
+	}
+	body(add("Thai", "Palace"))
+	body(add("Burger", "Barn"))
+	if got := body(add("thai", "palace")); got != "thai palace is already on the lunch list" {
+		t.Errorf("Bad duplicate add: %s", got)
+	}
+	if got := body(s.cmdWeight("!office:hyrule", "lunch", []string{"3", "THAI", "PALACE"})); got != "Thai Palace now has a weight of 3" {
+		t.Errorf("Bad weight: %s", got)
+	}
+	if _, err = s.cmdWeight("!office:hyrule", "lunch", []string{"11", "Thai", "Palace"}); err == nil {
+		t.Errorf("Expected a weight of 11 to be refused")
+	}
+	if got := body(s.cmdPick("!office:hyrule", "lunch")); got != "🎲 lunch: Burger Barn" {
+		t.Errorf("Bad pick: %s", got)
+	}
+	// Burger Barn was just picked
+	if got := body(s.cmdPick("!office:hyrule", "lunch")); got != "🎲 lunch: Thai Palace" {
+		t.Errorf("Bad pick: %s", got)
+	}
+	if got := body(s.cmdList("!office:hyrule", "lunch")); got != "The lunch list: Thai Palace (×3), Burger Barn\nRecently picked: Thai Palace" {
+		t.Errorf("Bad list: %s", got)
+	}
+	// Lists are per room
+	if got := body(s.cmdList("!other:hyrule", "lunch")); got != "The lunch list is empty. Add options with !lunch add option" {
+		t.Errorf("Bad list for another room: %s", got)
+	}
+	if got := body(s.cmdRemove("!office:hyrule", "lunch", []string{"burger", "barn"})); got != "Removed Burger Barn from the lunch list" {
+		t.Errorf("Bad remove: %s", got)
+	}
+
+	if got := body(s.cmdPickOneOf([]string{"tea,", "coffee,", "hot", "chocolate"})); got != "🎲 hot chocolate" {
+		t.Errorf("Bad !pick: %s", got)
+	}
+	if _, err = s.cmdPickOneOf([]string{"tea"}); err == nil {
+		t.Errorf("Expected !pick with one option to fail")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{`{"lists":["Lunch"]}`, `{"lists":["pick"]}`, `{"lists":["lunch","lunch"]}`} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create picker service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected Register(%s) to fail", config)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Package plugin implements a Service which forwards commands, expansions and webhooks to an
+// out-of-process plugin, so services can be written in any language without recompiling Go-NEB.
+//
+// Protocol
+//
+// The plugin is started as a long-running child process. Go-NEB writes one JSON request per
+// line to its stdin and the plugin writes one JSON response per line to its stdout:
+//
+//    > {"id":1,"method":"init","params":{"service_id":"weather","service_user_id":"@neb:localhost","webhook_url":"...","config":{...}}}
+//    < {"id":1,"result":null}
+//    > {"id":2,"method":"describe"}
+//    < {"id":2,"result":{"commands":[{"path":["weather"],"arguments":["city"],"help":"Show the weather"}],"expansions":[{"regexp":"\\bMSC[0-9]+\\b"}]}}
+//    > {"id":3,"method":"command","params":{"path":["weather"],"args":["london"],"room_id":"!a:localhost","user_id":"@b:localhost"}}
+//    < {"id":3,"result":{"msgtype":"m.notice","body":"Raining, obviously."}}
+//
+// Failures are reported with an "error" string instead of a "result". Anything the plugin writes
+// to stderr is logged. The methods are:
+//
+//    init      Sent once when the plugin starts. Params: service_id, service_user_id, webhook_url, config.
+//    describe  Result: the commands and expansions the plugin handles.
+//    command   Params: path, args, room_id, user_id. Result: the message content to reply with, or null.
+//    expand    Params: regexp (index into the described expansions), groups, room_id, user_id.
+//              Result: the message content to reply with, or null.
+//    webhook   Params: method, path, query, headers, body. Result: {"code":200,"body":"...","messages":[{"room_id":"...","content":{...}}]}
+//              The messages are sent into their rooms by Go-NEB.
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Plugin service
+const ServiceType = "plugin"
+
+// How long to wait for a plugin to respond if the service doesn't say otherwise.
+const defaultTimeout = 10 * time.Second
+
+// Service contains the Config fields for the Plugin service.
+//
+// Example request:
+//   {
+//       "command": ["python3", "/opt/neb-plugins/weather.py"],
+//       "working_dir": "/opt/neb-plugins",
+//       "timeout_secs": 5,
+//       "config": {
+//           "api_key": "abc123"
+//       },
+//       "rooms": ["!qmElAGdFYCHoCJuaNt:localhost"]
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which should be given to the plugin's webhook sender - Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The program to run and its arguments.
+	Command []string `json:"command"`
+	// Optional. The directory to run the plugin in.
+	WorkingDir string `json:"working_dir"`
+	// Optional. How long to wait for the plugin to respond to each request. Defaults to 10 seconds.
+	TimeoutSecs int `json:"timeout_secs"`
+	// Optional. Arbitrary plugin-specific configuration, which is passed to the plugin when it starts.
+	Config json.RawMessage `json:"config"`
+	// Optional. Rooms for the bot to join, e.g. so the plugin can post webhook notifications into them.
+	Rooms []id.RoomID `json:"rooms"`
+}
+
+type initParams struct {
+	ServiceID     string          `json:"service_id"`
+	ServiceUserID id.UserID       `json:"service_user_id"`
+	WebhookURL    string          `json:"webhook_url"`
+	Config        json.RawMessage `json:"config"`
+}
+
+type description struct {
+	Commands []struct {
+		Path      []string `json:"path"`
+		Arguments []string `json:"arguments"`
+		Help      string   `json:"help"`
+	} `json:"commands"`
+	Expansions []struct {
+		Regexp string `json:"regexp"`
+	} `json:"expansions"`
+}
+
+type commandParams struct {
+	Path   []string  `json:"path"`
+	Args   []string  `json:"args"`
+	RoomID id.RoomID `json:"room_id"`
+	UserID id.UserID `json:"user_id"`
+}
+
+type expandParams struct {
+	Regexp int       `json:"regexp"`
+	Groups []string  `json:"groups"`
+	RoomID id.RoomID `json:"room_id"`
+	UserID id.UserID `json:"user_id"`
+}
+
+type webhookParams struct {
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Query   string              `json:"query"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+}
+
+type webhookResult struct {
+	Code     int    `json:"code"`
+	Body     string `json:"body"`
+	Messages []struct {
+		RoomID  id.RoomID       `json:"room_id"`
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+}
+
+// processKey identifies the configuration a plugin was started with, so that it can be restarted
+// when that changes.
+func (s *Service) processKey() (string, error) {
+	b, err := json.Marshal(struct {
+		Command    []string
+		WorkingDir string
+		Timeout    int
+		Config     json.RawMessage
+		UserID     id.UserID
+	}{s.Command, s.WorkingDir, s.TimeoutSecs, s.Config, s.ServiceUserID()})
+	return string(b), err
+}
+
+// call makes a request to this service's plugin, starting it if needed.
+func (s *Service) call(method string, params interface{}, result interface{}) error {
+	p, err := processFor(s)
+	if err != nil {
+		return err
+	}
+	res, err := p.call(method, params)
+	if err != nil {
+		return err
+	}
+	if result == nil || len(res) == 0 {
+		return nil
+	}
+	return json.Unmarshal(res, result)
+}
+
+func (s *Service) describe() (*description, error) {
+	p, err := processFor(s)
+	if err != nil {
+		return nil, err
+	}
+	return p.describe()
+}
+
+// contentOrNil returns nil for an absent or null plugin result so that no reply is sent.
+func contentOrNil(res json.RawMessage) interface{} {
+	if len(res) == 0 || string(res) == "null" {
+		return nil
+	}
+	return res
+}
+
+// Commands returns the commands described by the plugin. Each one is forwarded to the plugin
+// and its result sent back to the room.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	desc, err := s.describe()
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to describe plugin commands")
+		return []types.Command{}
+	}
+	var cmds []types.Command
+	for _, c := range desc.Commands {
+		path := c.Path
+		cmds = append(cmds, types.Command{
+			Path:      path,
+			Arguments: c.Arguments,
+			Help:      c.Help,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				var res json.RawMessage
+				err := s.call("command", commandParams{path, args, roomID, userID}, &res)
+				if err != nil {
+					return nil, fmt.Errorf("Plugin failed to run !%s: %s", strings.Join(path, " "), err)
+				}
+				return contentOrNil(res), nil
+			},
+		})
+	}
+	return cmds
+}
+
+// Expansions returns the expansions described by the plugin. Matches are forwarded to the
+// plugin and its result sent back to the room.
+func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
+	desc, err := s.describe()
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to describe plugin expansions")
+		return []types.Expansion{}
+	}
+	var expansions []types.Expansion
+	for i, e := range desc.Expansions {
+		re, err := regexp.Compile(e.Regexp)
+		if err != nil {
+			log.WithError(err).WithField("regexp", e.Regexp).Error("Plugin described an invalid expansion")
+			continue
+		}
+		index := i
+		expansions = append(expansions, types.Expansion{
+			Regexp: re,
+			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+				var res json.RawMessage
+				if err := s.call("expand", expandParams{index, matchingGroups, roomID, userID}, &res); err != nil {
+					log.WithError(err).WithField("service_id", s.ServiceID()).Error("Plugin failed to expand")
+					return nil
+				}
+				return contentOrNil(res)
+			},
+		})
+	}
+	return expansions
+}
+
+// OnReceiveWebhook forwards the request to the plugin, sends any messages it returns and
+// responds with the plugin's chosen status code and body.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := log.WithField("service_id", s.ServiceID())
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithError(err).Error("Failed to read plugin webhook body")
+		w.WriteHeader(400)
+		return
+	}
+	var res webhookResult
+	err = s.call("webhook", webhookParams{
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Query:   req.URL.RawQuery,
+		Headers: req.Header,
+		Body:    string(body),
+	}, &res)
+	if err != nil {
+		logger.WithError(err).Error("Plugin failed to handle webhook")
+		w.WriteHeader(500)
+		return
+	}
+	for _, msg := range res.Messages {
+		if _, err := cli.SendMessageEvent(msg.RoomID, mevt.EventMessage, msg.Content); err != nil {
+			logger.WithError(err).WithField("room_id", msg.RoomID).Error("Failed to send plugin message")
+		}
+	}
+	if res.Code == 0 {
+		res.Code = 200
+	}
+	w.WriteHeader(res.Code)
+	w.Write([]byte(res.Body))
+}
+
+// Register starts the plugin and makes sure that it describes itself correctly.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Command) == 0 {
+		return errors.New("Missing plugin command")
+	}
+	s.WebhookURL = s.webhookEndpointURL
+	desc, err := s.describe()
+	if err != nil {
+		return fmt.Errorf("Failed to start plugin: %s", err)
+	}
+	for _, e := range desc.Expansions {
+		if _, err := regexp.Compile(e.Regexp); err != nil {
+			return fmt.Errorf("Plugin expansion regexp %q is invalid: %s", e.Regexp, err)
+		}
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+func (s *Service) joinRooms(client types.MatrixClient) {
+	for _, roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
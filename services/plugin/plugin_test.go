@@ -0,0 +1,174 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+// TestHelperPlugin isn't a real test. It is run as a child process by TestPlugin to act as the plugin.
+func TestHelperPlugin(t *testing.T) {
+	if os.Getenv("GO_NEB_TEST_PLUGIN") != "1" {
+		return
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req struct {
+			ID     int             `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		json.Unmarshal(scanner.Bytes(), &req)
+		var result interface{}
+		switch req.Method {
+		case "describe":
+			result = map[string]interface{}{
+				"commands":   []interface{}{map[string]interface{}{"path": []string{"shout"}, "help": "Shout things"}},
+				"expansions": []interface{}{map[string]interface{}{"regexp": `MSC([0-9]+)`}},
+			}
+		case "command":
+			var p commandParams
+			json.Unmarshal(req.Params, &p)
+			result = mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: strings.ToUpper(strings.Join(p.Args, " "))}
+		case "expand":
+			var p expandParams
+			json.Unmarshal(req.Params, &p)
+			result = mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Proposal " + p.Groups[1]}
+		case "webhook":
+			var p webhookParams
+			json.Unmarshal(req.Params, &p)
+			result = map[string]interface{}{
+				"code": 202,
+				"messages": []interface{}{map[string]interface{}{
+					"room_id": "!plugin:hyrule",
+					"content": mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: p.Body},
+				}},
+			}
+		}
+		b, _ := json.Marshal(map[string]interface{}{"id": req.ID, "result": result})
+		fmt.Println(string(b))
+	}
+	os.Exit(0)
+}
+
+func TestPlugin(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	os.Setenv("GO_NEB_TEST_PLUGIN", "1")
+	defer os.Unsetenv("GO_NEB_TEST_PLUGIN")
+
+	cmd, _ := json.Marshal([]string{os.Args[0], "-test.run=TestHelperPlugin"})
+	srv, err := types.CreateService("plugintest", ServiceType, "@pluginbot:hyrule", []byte(
+		`{"command":`+string(cmd)+`}`,
+	))
+	if err != nil {
+		t.Fatal("Failed to create plugin service: ", err)
+	}
+	plugin := srv.(*Service)
+
+	var sentMsgs []mevt.MessageEventContent
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.String(), "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		sentMsgs = append(sentMsgs, msg)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hs", "@pluginbot:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	if err := plugin.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register plugin service: ", err)
+	}
+
+	// Commands are forwarded to the plugin
+	cmds := plugin.Commands(matrixCli)
+	if len(cmds) != 1 || cmds[0].Path[0] != "shout" {
+		t.Fatalf("Expected a single !shout command, got %+v", cmds)
+	}
+	content, err := cmds[0].Command("!room:hyrule", "@alice:hyrule", []string{"hey", "listen"})
+	if err != nil {
+		t.Fatal("Failed to run plugin command: ", err)
+	}
+	assertBody(t, content, "HEY LISTEN")
+
+	// Expansions are forwarded to the plugin
+	expans := plugin.Expansions(matrixCli)
+	if len(expans) != 1 {
+		t.Fatalf("Expected a single expansion, got %d", len(expans))
+	}
+	groups := expans[0].Regexp.FindStringSubmatch("Have you read MSC1234?")
+	assertBody(t, expans[0].Expand("!room:hyrule", "@alice:hyrule", groups), "Proposal 1234")
+
+	// Webhooks are forwarded to the plugin, which can send messages
+	req := httptest.NewRequest("POST", "https://neb/services/hooks/cGx1Z2ludGVzdA", bytes.NewBufferString("deployed"))
+	w := httptest.NewRecorder()
+	plugin.OnReceiveWebhook(w, req, matrixCli)
+	if w.Code != 202 {
+		t.Errorf("Expected webhook response code 202, got %d", w.Code)
+	}
+	if len(sentMsgs) != 1 || sentMsgs[0].Body != "deployed" {
+		t.Errorf("Expected the plugin to send a 'deployed' message, got %+v", sentMsgs)
+	}
+
+	p, err := processFor(plugin)
+	if err != nil {
+		t.Fatal("Failed to get plugin process: ", err)
+	}
+
+	// The plugin is stopped once its service is deleted
+	database.SetServiceDB(&deletedStorage{})
+	reapProcesses()
+	if _, ok := processes["plugintest"]; ok {
+		t.Errorf("Expected the plugin of the deleted service to be forgotten")
+	}
+	select {
+	case <-p.exited:
+	default:
+		t.Errorf("Expected the plugin of the deleted service to have exited")
+	}
+}
+
+// deletedStorage has no services.
+type deletedStorage struct {
+	database.NopStorage
+}
+
+func (s *deletedStorage) LoadService(serviceID string) (types.Service, error) {
+	return nil, sql.ErrNoRows
+}
+
+func assertBody(t *testing.T, content interface{}, want string) {
+	raw, ok := content.(json.RawMessage)
+	if !ok {
+		t.Fatalf("Expected plugin to return raw JSON content, got %T", content)
+	}
+	var msg mevt.MessageEventContent
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		t.Fatalf("Failed to decode plugin content: %s", err)
+	}
+	if msg.Body != want {
+		t.Errorf("Expected body %q, got %q", want, msg.Body)
+	}
+}
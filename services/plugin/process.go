@@ -0,0 +1,286 @@
+package plugin
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// request is a single line sent to a plugin's stdin.
+type request struct {
+	ID     int         `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params,omitempty"`
+}
+
+// response is a single line read from a plugin's stdout.
+type response struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+// process is a running plugin. Calls are made one at a time.
+type process struct {
+	key     string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	lines   chan []byte
+	done    chan struct{}
+	exited  chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	nextID  int
+	timeout time.Duration
+	dead    bool
+	descMu  sync.Mutex
+	desc    *description
+}
+
+// Running plugins, keyed off service ID. Services are loaded from the database afresh for every
+// message, so the processes must outlive them.
+var (
+	processMutex sync.Mutex
+	processes    = make(map[string]*process)
+)
+
+// How often the running plugins are checked against the database, to stop the plugins of
+// services which have been deleted or replaced by another type of service.
+const reapInterval = time.Minute
+
+// How long a killed plugin is given to exit.
+const exitTimeout = 5 * time.Second
+
+var startReaper sync.Once
+
+// processFor returns the running process for this service, starting it if it isn't running or if
+// the service's command or config has changed since it was started.
+func processFor(s *Service) (*process, error) {
+	key, err := s.processKey()
+	if err != nil {
+		return nil, err
+	}
+	processMutex.Lock()
+	defer processMutex.Unlock()
+	if p := processes[s.ServiceID()]; p != nil {
+		if p.key == key && !p.isDead() {
+			return p, nil
+		}
+		p.kill()
+		delete(processes, s.ServiceID())
+	}
+	p, err := startProcess(s, key)
+	if err != nil {
+		return nil, err
+	}
+	processes[s.ServiceID()] = p
+	startReaper.Do(func() {
+		go func() {
+			for {
+				time.Sleep(reapInterval)
+				reapProcesses()
+			}
+		}()
+	})
+	return p, nil
+}
+
+// reapProcesses stops the plugins of services which are no longer plugin services in the
+// database. Nothing else tells the plugin package that a service has gone.
+func reapProcesses() {
+	processMutex.Lock()
+	defer processMutex.Unlock()
+	for serviceID, p := range processes {
+		service, err := database.GetServiceDB().LoadService(serviceID)
+		if err != nil && err != sql.ErrNoRows {
+			log.WithError(err).WithField("service_id", serviceID).Warn("Failed to check whether plugin service exists")
+			continue
+		}
+		if err == nil && service != nil && service.ServiceType() == ServiceType {
+			continue
+		}
+		log.WithField("service_id", serviceID).Info("Stopping plugin of deleted service")
+		p.stop()
+		delete(processes, serviceID)
+	}
+}
+
+func startProcess(s *Service, key string) (*process, error) {
+	if len(s.Command) == 0 {
+		return nil, errors.New("plugin command is missing")
+	}
+	cmd := exec.Command(s.Command[0], s.Command[1:]...)
+	cmd.Dir = s.WorkingDir
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"command":    s.Command,
+		"pid":        cmd.Process.Pid,
+	})
+	logger.Info("Started plugin")
+
+	timeout := time.Duration(s.TimeoutSecs) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	p := &process{
+		key:     key,
+		cmd:     cmd,
+		stdin:   stdin,
+		lines:   make(chan []byte),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+		timeout: timeout,
+	}
+
+	// Anything the plugin writes to stderr goes into our logs.
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			logger.WithField("stderr", scanner.Text()).Info("Plugin output")
+		}
+	}()
+	go func() {
+		reader := bufio.NewReader(stdout)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(line) > 0 {
+				select {
+				case p.lines <- line:
+				case <-p.done:
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		close(p.lines)
+		err := cmd.Wait()
+		logger.WithError(err).Info("Plugin exited")
+		close(p.exited)
+	}()
+
+	if _, err := p.call("init", initParams{
+		ServiceID:     s.ServiceID(),
+		ServiceUserID: s.ServiceUserID(),
+		WebhookURL:    s.webhookEndpointURL,
+		Config:        s.Config,
+	}); err != nil {
+		p.kill()
+		return nil, fmt.Errorf("plugin failed to initialise: %s", err)
+	}
+	return p, nil
+}
+
+// call sends a request to the plugin and waits for the response with the same ID. If the plugin
+// doesn't respond in time it is killed, and will be restarted on the next call.
+func (p *process) call(method string, params interface{}) (json.RawMessage, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dead {
+		return nil, errors.New("plugin is not running")
+	}
+	p.nextID++
+	reqID := p.nextID
+	b, err := json.Marshal(request{reqID, method, params})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = p.stdin.Write(append(b, '\n')); err != nil {
+		p.dead = true
+		return nil, fmt.Errorf("failed to write to plugin: %s", err)
+	}
+	deadline := time.After(p.timeout)
+	for {
+		select {
+		case line, ok := <-p.lines:
+			if !ok {
+				p.dead = true
+				return nil, errors.New("plugin exited")
+			}
+			var res response
+			if err := json.Unmarshal(line, &res); err != nil {
+				log.WithError(err).WithField("line", string(line)).Warn("Ignoring malformed plugin response")
+				continue
+			}
+			if res.ID != reqID {
+				continue // a late response to a request which timed out
+			}
+			if res.Error != "" {
+				return nil, errors.New(res.Error)
+			}
+			return res.Result, nil
+		case <-deadline:
+			p.dead = true
+			p.kill()
+			return nil, fmt.Errorf("plugin did not respond to %q within %s", method, p.timeout)
+		}
+	}
+}
+
+// describe asks the plugin which commands and expansions it handles. The answer is cached for
+// the lifetime of the process.
+func (p *process) describe() (*description, error) {
+	p.descMu.Lock()
+	defer p.descMu.Unlock()
+	if p.desc != nil {
+		return p.desc, nil
+	}
+	res, err := p.call("describe", nil)
+	if err != nil {
+		return nil, err
+	}
+	var desc description
+	if err := json.Unmarshal(res, &desc); err != nil {
+		return nil, fmt.Errorf("plugin returned a malformed description: %s", err)
+	}
+	p.desc = &desc
+	return p.desc, nil
+}
+
+func (p *process) isDead() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dead
+}
+
+func (p *process) kill() {
+	p.once.Do(func() {
+		close(p.done)
+		p.stdin.Close()
+		p.cmd.Process.Kill()
+	})
+}
+
+// stop kills the plugin and waits for it to exit, so that it doesn't linger as a zombie.
+func (p *process) stop() {
+	p.kill()
+	select {
+	case <-p.exited:
+	case <-time.After(exitTimeout):
+		log.WithField("pid", p.cmd.Process.Pid).Warn("Plugin did not exit after being killed")
+	}
+}
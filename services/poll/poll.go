@@ -0,0 +1,381 @@
+// Package poll implements a Service which runs polls in rooms.
+package poll
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Poll service
+const ServiceType = "poll"
+
+const maxOptions = 10
+
+// The reactions which vote for each option, without the variation selector which some clients
+// add to them
+var numberReactions = []string{
+	"1\u20e3", "2\u20e3", "3\u20e3", "4\u20e3", "5\u20e3", "6\u20e3", "7\u20e3", "8\u20e3", "9\u20e3", "\U0001f51f",
+}
+
+// Votes arrive as reactions while !poll close may be tallying them, so polls are only loaded and
+// stored while holding this.
+var pollsMutex sync.Mutex
+
+// Service contains the Config fields for the Poll service.
+//
+// Each room can have one open poll at a time:
+//    !poll start "Where should we go for lunch?" pizza sushi tacos
+// People vote by saying "!vote 2", or by reacting to the poll with 2️⃣. Each person has one vote,
+// and voting again changes it. Removing the reaction takes the vote back. Whoever started the
+// poll closes it with "!poll close", which posts the results as a table.
+//
+// Polls are kept in the service's state, so they stay open if Go-NEB is restarted. Reactions sent
+// while it was down aren't counted.
+//
+// The service has no configuration.
+//
+// Example JSON request:
+//   {}
+type Service struct {
+	types.DefaultService
+}
+
+// poll is the open poll of a room. It is stored in the service state under "poll" and the room ID.
+type poll struct {
+	Question  string    `json:"question"`
+	Options   []string  `json:"options"`
+	CreatorID id.UserID `json:"creator_id"`
+	// The message announcing the poll, which people react to
+	EventID            id.EventID         `json:"event_id"`
+	Votes              map[id.UserID]vote `json:"votes"`
+	StartTimestampSecs int64              `json:"start_timestamp_secs"`
+}
+
+type vote struct {
+	// The index of the option voted for
+	Option int `json:"option"`
+	// The reaction the vote was made with, if it was
+	ReactionEventID id.EventID `json:"reaction_event_id,omitempty"`
+}
+
+// Commands supported:
+//    !poll start "question" option1 option2 ...
+// Starts a poll in the room. Options with spaces must be quoted.
+//    !vote number
+// Votes for the option with the number.
+//    !poll close
+// Closes the poll, if the sender started it, and responds with the results.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"poll", "start"},
+			Arguments: []string{`"question"`, "option1", "option2", "..."},
+			Help:      "Start a poll in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdStart(cli, roomID, userID, args, time.Now())
+			},
+		},
+		{
+			Path:      []string{"vote"},
+			Arguments: []string{"number"},
+			Help:      "Vote in the poll in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdVote(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"poll", "close"},
+			Help: "Close your poll in this room and show the results",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdClose(roomID, userID)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdStart(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf(`Usage: !poll start "question" option1 option2 ...`)
+	}
+	if len(args)-1 > maxOptions {
+		return nil, fmt.Errorf("Polls can have at most %d options", maxOptions)
+	}
+
+	pollsMutex.Lock()
+	defer pollsMutex.Unlock()
+	p, err := s.loadPoll(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		return nil, fmt.Errorf("There is already a poll in this room: %s. %s can close it with !poll close",
+			p.Question, p.CreatorID)
+	}
+	p = &poll{
+		Question:           args[0],
+		Options:            args[1:],
+		CreatorID:          userID,
+		Votes:              make(map[id.UserID]vote),
+		StartTimestampSecs: now.Unix(),
+	}
+	// The poll is sent here rather than as the command's response, so that reactions to it can be
+	// told apart from reactions to other messages.
+	resp, err := cli.SendMessageEvent(roomID, mevt.EventMessage, pollMessage(p))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to send the poll: %s", err)
+	}
+	p.EventID = resp.EventID
+	if err = s.storePoll(roomID, p); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (s *Service) cmdVote(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !vote number")
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("Usage: !vote number")
+	}
+
+	pollsMutex.Lock()
+	defer pollsMutex.Unlock()
+	p, err := s.loadPoll(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, fmt.Errorf(`There is no poll in this room. Start one with !poll start "question" option1 option2 ...`)
+	}
+	if n < 1 || n > len(p.Options) {
+		return nil, fmt.Errorf("Vote for an option from 1 to %d", len(p.Options))
+	}
+	p.Votes[userID] = vote{Option: n - 1}
+	if err = s.storePoll(roomID, p); err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("🗳️ %s voted for %s", userID, p.Options[n-1]),
+	}, nil
+}
+
+func (s *Service) cmdClose(roomID id.RoomID, userID id.UserID) (interface{}, error) {
+	pollsMutex.Lock()
+	defer pollsMutex.Unlock()
+	p, err := s.loadPoll(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, fmt.Errorf("There is no poll in this room")
+	}
+	if p.CreatorID != userID {
+		return nil, fmt.Errorf("Only %s, who started the poll, can close it", p.CreatorID)
+	}
+	if err = s.storePoll(roomID, nil); err != nil {
+		return nil, err
+	}
+	return resultsMessage(p), nil
+}
+
+// OnMessage counts reactions to the room's poll as votes, and takes the votes back when the
+// reactions are removed.
+func (s *Service) OnMessage(cli types.MatrixClient, evt *mevt.Event) {
+	var update func(p *poll) bool
+	switch evt.Type {
+	case mevt.EventReaction:
+		rel, _ := evt.Content.Raw["m.relates_to"].(map[string]interface{})
+		if rel == nil || rel["rel_type"] != "m.annotation" {
+			return
+		}
+		key, _ := rel["key"].(string)
+		eventID, _ := rel["event_id"].(string)
+		option := reactionOption(key)
+		if option < 0 || eventID == "" {
+			return
+		}
+		update = func(p *poll) bool {
+			if p.EventID != id.EventID(eventID) || option >= len(p.Options) {
+				return false
+			}
+			p.Votes[evt.Sender] = vote{Option: option, ReactionEventID: evt.ID}
+			return true
+		}
+	case mevt.EventRedaction:
+		update = func(p *poll) bool {
+			v, ok := p.Votes[evt.Sender]
+			if !ok || v.ReactionEventID == "" || v.ReactionEventID != evt.Redacts {
+				return false
+			}
+			delete(p.Votes, evt.Sender)
+			return true
+		}
+	default:
+		return
+	}
+
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    evt.RoomID,
+	})
+	pollsMutex.Lock()
+	defer pollsMutex.Unlock()
+	p, err := s.loadPoll(evt.RoomID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load poll")
+		return
+	}
+	if p == nil || !update(p) {
+		return
+	}
+	if err = s.storePoll(evt.RoomID, p); err != nil {
+		logger.WithError(err).Error("Failed to store vote")
+	}
+}
+
+// reactionOption returns the index of the option which the reaction votes for, or -1 if it isn't a
+// number.
+func reactionOption(key string) int {
+	key = strings.Replace(key, "\ufe0f", "", -1)
+	for i, reaction := range numberReactions {
+		if key == reaction {
+			return i
+		}
+	}
+	return -1
+}
+
+func pollMessage(p *poll) *mevt.MessageEventContent {
+	lines := []string{"📊 " + p.Question}
+	htmlLines := []string{"📊 <b>" + html.EscapeString(p.Question) + "</b>"}
+	for i, option := range p.Options {
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, option))
+		htmlLines = append(htmlLines, fmt.Sprintf("%d. %s", i+1, html.EscapeString(option)))
+	}
+	footer := fmt.Sprintf("Vote with !vote 1 to %d, or by reacting with the number.", len(p.Options))
+	lines = append(lines, footer)
+	htmlLines = append(htmlLines, "<i>"+footer+"</i>")
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgText,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: strings.Join(htmlLines, "<br>"),
+	}
+}
+
+// resultsMessage returns the results of the poll as a table, with the options with the most votes
+// first.
+func resultsMessage(p *poll) *mevt.MessageEventContent {
+	counts := make([]int, len(p.Options))
+	for _, v := range p.Votes {
+		counts[v.Option]++
+	}
+	order := make([]int, len(p.Options))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return counts[order[a]] > counts[order[b]] })
+
+	width := utf8.RuneCountInString("Option")
+	for _, option := range p.Options {
+		if w := utf8.RuneCountInString(option); w > width {
+			width = w
+		}
+	}
+	pad := func(text string) string {
+		return text + strings.Repeat(" ", width-utf8.RuneCountInString(text))
+	}
+	lines := []string{
+		"📊 Results: " + p.Question,
+		pad("Option") + " | Votes |    %",
+	}
+	rows := []string{"<tr><th>Option</th><th>Votes</th><th>%</th></tr>"}
+	for _, i := range order {
+		percent := 0
+		if len(p.Votes) > 0 {
+			percent = counts[i] * 100 / len(p.Votes)
+		}
+		lines = append(lines, fmt.Sprintf("%s | %5d | %3d%%", pad(p.Options[i]), counts[i], percent))
+		rows = append(rows, fmt.Sprintf("<tr><td>%s</td><td>%d</td><td>%d%%</td></tr>",
+			html.EscapeString(p.Options[i]), counts[i], percent))
+	}
+
+	var outcome string
+	if len(p.Votes) == 0 {
+		outcome = "Nobody voted."
+	} else {
+		var winners []string
+		for _, i := range order {
+			if counts[i] == counts[order[0]] {
+				winners = append(winners, p.Options[i])
+			}
+		}
+		noun := "votes"
+		if len(p.Votes) == 1 {
+			noun = "vote"
+		}
+		if len(winners) == 1 {
+			outcome = fmt.Sprintf("%s wins, with %d of %d %s.", winners[0], counts[order[0]], len(p.Votes), noun)
+		} else {
+			outcome = fmt.Sprintf("It's a tie between %s, with %d of %d %s each.",
+				strings.Join(winners, " and "), counts[order[0]], len(p.Votes), noun)
+		}
+	}
+	lines = append(lines, outcome)
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    strings.Join(lines, "\n"),
+		Format:  mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf("📊 <b>Results: %s</b><table>%s</table>%s", html.EscapeString(p.Question),
+			strings.Join(rows, ""), html.EscapeString(outcome)),
+	}
+}
+
+// loadPoll returns the open poll of the room, or nil if there isn't one.
+func (s *Service) loadPoll(roomID id.RoomID) (*poll, error) {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "poll "+roomID.String())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var p *poll
+	if err = json.Unmarshal(stateJSON, &p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// storePoll stores the open poll of the room, which is nil once it is closed.
+func (s *Service) storePoll(roomID id.RoomID, p *poll) error {
+	stateJSON, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "poll "+roomID.String(), stateJSON)
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
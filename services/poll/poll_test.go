@@ -0,0 +1,126 @@
+package poll
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestPoll(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$poll:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create poll service: ", err)
+	}
+	s := srv.(*Service)
+
+	const roomID = id.RoomID("!lunch:hyrule")
+	now := time.Now()
+	body := func(res interface{}, err error) string {
+		if err != nil {
+			t.Fatalf("Command failed: %s", err)
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+	react := func(sender, eventID, key, reactionID string) {
+		s.OnMessage(matrixCli, &mevt.Event{
+			Type:   mevt.EventReaction,
+			ID:     id.EventID(reactionID),
+			Sender: id.UserID(sender),
+			RoomID: roomID,
+			Content: mevt.Content{Raw: map[string]interface{}{
+				"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": eventID, "key": key},
+			}},
+		})
+	}
+
+	if _, err = s.cmdStart(matrixCli, roomID, "@link:hyrule", []string{"Lunch?", "pizza"}, now); err == nil {
+		t.Errorf("Expected a poll with one option to be refused")
+	}
+	if res, err := s.cmdStart(matrixCli, roomID, "@link:hyrule", []string{"Lunch?", "pizza", "sushi", "tacos"}, now); res != nil || err != nil {
+		t.Fatalf("Bad start: %v %v", res, err)
+	}
+	if len(sent) != 1 || sent[0] != "📊 Lunch?\n1. pizza\n2. sushi\n3. tacos\n"+
+		"Vote with !vote 1 to 3, or by reacting with the number." {
+		t.Errorf("Bad poll message: %q", sent)
+	}
+	if _, err = s.cmdStart(matrixCli, roomID, "@zelda:hyrule", []string{"Dinner?", "soup", "salad"}, now); err == nil {
+		t.Errorf("Expected a second poll in the room to be refused")
+	}
+
+	if got := body(s.cmdVote(roomID, "@zelda:hyrule", []string{"2"})); got != "🗳️ @zelda:hyrule voted for sushi" {
+		t.Errorf("Bad vote response: %s", got)
+	}
+	if _, err = s.cmdVote(roomID, "@zelda:hyrule", []string{"4"}); err == nil {
+		t.Errorf("Expected a vote for a missing option to be refused")
+	}
+	body(s.cmdVote(roomID, "@link:hyrule", []string{"3"}))
+	react("@impa:hyrule", "$poll:hyrule", "1️⃣", "$r1")
+	react("@ganon:hyrule", "$poll:hyrule", "2⃣", "$r2")
+	react("@mido:hyrule", "$other:hyrule", "2️⃣", "$r3")
+	react("@saria:hyrule", "$poll:hyrule", "🔟", "$r4")
+	react("@zelda:hyrule", "$poll:hyrule", "1️⃣", "$r5")
+	s.OnMessage(matrixCli, &mevt.Event{
+		Type:    mevt.EventRedaction,
+		ID:      "$redact",
+		Sender:  "@ganon:hyrule",
+		RoomID:  roomID,
+		Redacts: "$r2",
+	})
+
+	if _, err = s.cmdClose(roomID, "@zelda:hyrule"); err == nil {
+		t.Errorf("Expected closing someone else's poll to fail")
+	}
+	if got := body(s.cmdClose(roomID, "@link:hyrule")); got != "📊 Results: Lunch?\n"+
+		"Option | Votes |    %\n"+
+		"pizza  |     2 |  66%\n"+
+		"tacos  |     1 |  33%\n"+
+		"sushi  |     0 |   0%\n"+
+		"pizza wins, with 2 of 3 votes." {
+		t.Errorf("Bad results: %s", got)
+	}
+	if _, err = s.cmdVote(roomID, "@zelda:hyrule", []string{"1"}); err == nil {
+		t.Errorf("Expected voting in a closed poll to fail")
+	}
+}
+
+func TestResultsTie(t *testing.T) {
+	p := &poll{
+		Question: "Tabs or spaces?",
+		Options:  []string{"tabs", "spaces"},
+		Votes: map[id.UserID]vote{
+			"@link:hyrule":  {Option: 0},
+			"@zelda:hyrule": {Option: 1},
+		},
+	}
+	if got := resultsMessage(p).Body; !strings.HasSuffix(got, "\nIt's a tie between tabs and spaces, with 1 of 2 votes each.") {
+		t.Errorf("Bad tie: %s", got)
+	}
+}
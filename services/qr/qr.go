@@ -0,0 +1,275 @@
+// Package qr implements a Service which generates and decodes QR codes.
+package qr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	qrcode "github.com/skip2/go-qrcode"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the QR service
+const ServiceType = "qr"
+
+// The size of generated QR codes by default, in pixels
+const defaultSize = 256
+
+// The largest image which is downloaded for decoding by default, in bytes
+const defaultMaxImageSize = 5 * 1024 * 1024
+
+// How long decoding may take before it is given up on
+const decodeTimeout = 30 * time.Second
+
+// zbarimg exits with this status when the image has no codes in it
+const zbarNoSymbols = 4
+
+var recoveryLevels = map[string]qrcode.RecoveryLevel{
+	"low":     qrcode.Low,
+	"medium":  qrcode.Medium,
+	"high":    qrcode.High,
+	"highest": qrcode.Highest,
+}
+
+// Service contains the Config fields for the QR service.
+//
+// This service turns text into QR codes, which is handy for getting links onto phones: "!qr
+// https://matrix.org" posts a QR code image of the link. Replying to an image with "!qr decode"
+// posts the text of the QR codes in it.
+//
+// Decoding uses the "zbarimg" command line tool from the ZBar project, which must be installed on
+// the Go-NEB host. Generating QR codes works without it.
+//
+// Example JSON request:
+//   {
+//       "size": 512,
+//       "recovery_level": "high"
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The width and height of generated QR codes, in pixels. Defaults to 256.
+	Size int `json:"size"`
+	// Optional. How much of a generated QR code can be damaged and still be read: "low", "medium",
+	// "high" or "highest". Higher levels make denser codes. Defaults to "medium".
+	RecoveryLevel string `json:"recovery_level"`
+	// Optional. The path to the zbarimg binary. Defaults to finding "zbarimg" on the PATH.
+	ZbarimgPath string `json:"zbarimg_path"`
+	// Optional. The largest image to download for decoding, in bytes. Defaults to 5 MB.
+	MaxImageSize int64 `json:"max_image_size"`
+}
+
+// Commands supported:
+//    !qr some text or a URL
+// Responds with a QR code image of the text.
+//    !qr decode
+// Sent in reply to an image message, responds with the text of the QR codes in the image.
+func (s *Service) Commands(client types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"qr"},
+			Arguments: []string{"text"},
+			Help:      "Generate a QR code",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGenerate(client, args)
+			},
+		},
+		{
+			Path: []string{"qr", "decode"},
+			Help: "Reply to an image to decode the QR codes in it",
+			EventCommand: func(evt *mevt.Event, args []string) (interface{}, error) {
+				return s.cmdDecode(client, evt)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdGenerate(client types.MatrixClient, args []string) (interface{}, error) {
+	text := strings.Join(args, " ")
+	if text == "" {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Usage: !qr some text or a URL, or reply to an image with !qr decode",
+		}, nil
+	}
+	code, err := qrcode.New(text, s.recoveryLevel())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to make a QR code: %s", err)
+	}
+	size := s.Size
+	if size <= 0 {
+		size = defaultSize
+	}
+	png, err := code.PNG(size)
+	if err != nil {
+		return nil, err
+	}
+	mediaCli, ok := client.(types.MediaUploader)
+	if !ok {
+		return nil, fmt.Errorf("Unable to upload images with this client")
+	}
+	resp, err := mediaCli.UploadBytes(png, "image/png")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to upload the QR code: %s", err)
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgImage,
+		Body:    text,
+		URL:     resp.ContentURI.CUString(),
+		Info: &mevt.FileInfo{
+			MimeType: "image/png",
+			Width:    size,
+			Height:   size,
+			Size:     len(png),
+		},
+	}, nil
+}
+
+func (s *Service) cmdDecode(client types.MatrixClient, evt *mevt.Event) (interface{}, error) {
+	replyTo := evt.Content.AsMessage().GetReplyTo()
+	if replyTo == "" {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Reply to an image with !qr decode to decode the QR codes in it.",
+		}, nil
+	}
+	if _, err := exec.LookPath(s.zbarimgPath()); err != nil {
+		return nil, fmt.Errorf("Decoding QR codes has not been set up")
+	}
+	evCli, canGet := client.(types.EventGetter)
+	dlCli, canDownload := client.(types.MediaDownloader)
+	if !canGet || !canDownload {
+		return nil, fmt.Errorf("Unable to download images with this client")
+	}
+	original, err := evCli.GetEvent(evt.RoomID, replyTo)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch the image message: %s", err)
+	}
+	original.Content.ParseRaw(mevt.EventMessage)
+	msg := original.Content.AsMessage()
+	if msg.MsgType != mevt.MsgImage {
+		return nil, fmt.Errorf("QR codes can only be decoded from images")
+	}
+	if msg.URL == "" {
+		return nil, fmt.Errorf("QR codes can't be decoded from encrypted images")
+	}
+	maxSize := s.MaxImageSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxImageSize
+	}
+	if info := msg.GetInfo(); info != nil && int64(info.Size) > maxSize {
+		return nil, fmt.Errorf("Image is larger than %d KB", maxSize/1024)
+	}
+	mxcURL, err := msg.URL.Parse()
+	if err != nil {
+		return nil, err
+	}
+	data, err := dlCli.Download(mxcURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download the image: %s", err)
+	}
+	defer data.Close()
+	image, err := ioutil.ReadAll(io.LimitReader(data, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download the image: %s", err)
+	}
+	if int64(len(image)) > maxSize {
+		return nil, fmt.Errorf("Image is larger than %d KB", maxSize/1024)
+	}
+
+	texts, err := s.decode(image)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode the image: %s", err)
+	}
+	if len(texts) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "No QR codes found in the image",
+		}, nil
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    strings.Join(texts, "\n"),
+	}, nil
+}
+
+// decode returns the text of each QR code in the image.
+func (s *Service) decode(image []byte) ([]string, error) {
+	// zbarimg only reads files
+	f, err := ioutil.TempFile("", "go-neb-qr")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(image)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), decodeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.zbarimgPath(), "--quiet", "--raw", "-Sdisable", "-Sqrcode.enable", f.Name())
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == zbarNoSymbols {
+			return nil, nil
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", err, msg)
+		}
+		return nil, err
+	}
+	var texts []string
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		if line != "" {
+			texts = append(texts, line)
+		}
+	}
+	return texts, nil
+}
+
+func (s *Service) recoveryLevel() qrcode.RecoveryLevel {
+	if level, ok := recoveryLevels[s.RecoveryLevel]; ok {
+		return level
+	}
+	return qrcode.Medium
+}
+
+func (s *Service) zbarimgPath() string {
+	if s.ZbarimgPath == "" {
+		return "zbarimg"
+	}
+	return s.ZbarimgPath
+}
+
+// Register makes sure that the recovery level is known.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if _, ok := recoveryLevels[s.RecoveryLevel]; s.RecoveryLevel != "" && !ok {
+		return fmt.Errorf("Unknown recovery_level '%s': must be low, medium, high or highest", s.RecoveryLevel)
+	}
+	if s.Size < 0 {
+		return fmt.Errorf("size must be positive")
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func matrixClient(t *testing.T, uploaded *[]byte) *mautrix.Client {
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "_matrix/media/r0/upload") {
+			*uploaded, _ = ioutil.ReadAll(req.Body)
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://hyrule/qr"}`)),
+			}, nil
+		} else if strings.Contains(req.URL.Path, "/event/$image") {
+			return &http.Response{
+				StatusCode: 200,
+				Body: ioutil.NopCloser(bytes.NewBufferString(`{
+					"type":"m.room.message","event_id":"$image","room_id":"!someroom:hyrule","sender":"@link:hyrule",
+					"content":{"msgtype":"m.image","body":"code.png","url":"mxc://hyrule/code"}}`)),
+			}, nil
+		} else if strings.Contains(req.URL.Path, "_matrix/media/r0/download/hyrule/code") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("code pixels")),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@qr:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+	return matrixCli
+}
+
+func replyToImage(t *testing.T) *mevt.Event {
+	content := mevt.Content{Raw: map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "!qr decode",
+		"m.relates_to": map[string]interface{}{
+			"m.in_reply_to": map[string]interface{}{"event_id": "$image"},
+		},
+	}}
+	if veryRaw, err := content.MarshalJSON(); err != nil {
+		t.Fatalf("Error marshalling JSON: %s", err)
+	} else {
+		content.VeryRaw = veryRaw
+	}
+	content.ParseRaw(mevt.EventMessage)
+	return &mevt.Event{
+		Type:    mevt.EventMessage,
+		Sender:  "@zelda:hyrule",
+		RoomID:  "!someroom:hyrule",
+		Content: content,
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	srv, err := types.CreateService("id", ServiceType, "@qr:hyrule", []byte(`{"size":128,"recovery_level":"high"}`))
+	if err != nil {
+		t.Fatal("Failed to create qr service: ", err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register qr service: ", err)
+	}
+	var uploaded []byte
+	res, err := srv.Commands(matrixClient(t, &uploaded))[0].Command("!someroom:hyrule", "@zelda:hyrule", []string{"https://matrix.org"})
+	if err != nil {
+		t.Fatalf("!qr failed: %s", err)
+	}
+	content := res.(*mevt.MessageEventContent)
+	if content.MsgType != mevt.MsgImage || content.URL != "mxc://hyrule/qr" || content.Body != "https://matrix.org" {
+		t.Errorf("Bad QR code message: %+v", content)
+	}
+	img, err := png.Decode(bytes.NewReader(uploaded))
+	if err != nil {
+		t.Fatalf("Uploaded QR code isn't a PNG: %s", err)
+	}
+	if b := img.Bounds(); b.Dx() != 128 || b.Dy() != 128 {
+		t.Errorf("Expected a 128x128 QR code, got %s", b)
+	}
+
+	bad, _ := types.CreateService("id", ServiceType, "@qr:hyrule", []byte(`{"recovery_level":"lots"}`))
+	if err = bad.Register(nil, nil); err == nil {
+		t.Errorf("Expected an unknown recovery level to fail")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A fake zbarimg which finds codes in "code pixels", and nothing in anything else
+	zbarimg := filepath.Join(dir, "zbarimg")
+	script := "#!/bin/sh\n" +
+		"if [ \"$(cat \"$5\")\" = \"code pixels\" ]; then echo https://matrix.org; echo hello; else exit 4; fi\n"
+	if err = ioutil.WriteFile(zbarimg, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := types.CreateService("id", ServiceType, "@qr:hyrule", []byte(`{"zbarimg_path":"`+zbarimg+`"}`))
+	if err != nil {
+		t.Fatal("Failed to create qr service: ", err)
+	}
+	s := srv.(*Service)
+
+	var uploaded []byte
+	res, err := s.cmdDecode(matrixClient(t, &uploaded), replyToImage(t))
+	if err != nil {
+		t.Fatalf("!qr decode failed: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "https://matrix.org\nhello" {
+		t.Errorf("Bad decoded text: %s", body)
+	}
+
+	texts, err := s.decode([]byte("a cat"))
+	if err != nil || len(texts) != 0 {
+		t.Errorf("Expected no codes, got %v, %v", texts, err)
+	}
+}
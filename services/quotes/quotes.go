@@ -0,0 +1,347 @@
+// Package quotes implements a Service which keeps a room's memorable messages, to be quoted later.
+package quotes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Quotes service
+const ServiceType = "quotes"
+
+// Limits on quotes, so that rooms' quotes stay readable
+const (
+	defaultMaxQuotes = 1000
+	maxQuoteLength   = 1000
+	// How many quotes "!quote search" lists
+	searchCount = 10
+	// How much of a quote is shown when listing it
+	maxSummaryLength = 80
+)
+
+// Picks quotes at random. Overridden by tests.
+var randIntn = rand.Intn
+
+// Commands from several rooms can arrive at once, and adding a quote updates the stored quotes.
+var quotesMutex sync.Mutex
+
+// Service contains the Config fields for the Quotes service.
+//
+// Each room keeps its own quotes, which are numbered in the order they are added. Quotes are added
+// with "!quote add" and the text, or by replying to a message with "!quote add", which quotes the
+// message and who sent it.
+//
+// Example JSON request:
+//   {
+//       "max_quotes": 1000
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. How many quotes each room can have. Defaults to 1000.
+	MaxQuotes int `json:"max_quotes"`
+}
+
+// quoteList is a room's quotes, oldest first. It is stored in the service state under
+// "quotes <room ID>".
+type quoteList struct {
+	Quotes []quote `json:"quotes"`
+	// The number of the last quote added, so that numbers aren't reused
+	LastID int `json:"last_id"`
+}
+
+type quote struct {
+	ID   int    `json:"id"`
+	Text string `json:"text"`
+	// Who said it, if the quote was added by replying to their message
+	Author             id.UserID `json:"author,omitempty"`
+	AddedBy            id.UserID `json:"added_by"`
+	AddedTimestampSecs int64     `json:"added_timestamp_secs"`
+}
+
+// find returns the quote with the number, or nil.
+func (l *quoteList) find(quoteID int) *quote {
+	for i := range l.Quotes {
+		if l.Quotes[i].ID == quoteID {
+			return &l.Quotes[i]
+		}
+	}
+	return nil
+}
+
+// format returns the quote as a message, e.g. "#3: “Ship it” – @alice:localhost", or with who
+// added it if it isn't known who said it.
+func (q *quote) format() string {
+	text := fmt.Sprintf("#%d: “%s”", q.ID, q.Text)
+	if q.Author != "" {
+		text += " – " + q.Author.String()
+	} else if q.AddedBy != "" {
+		text += " – added by " + q.AddedBy.String()
+	}
+	return text
+}
+
+// summary returns the quote on one line, shortened if it is long.
+func (q *quote) summary() string {
+	text := strings.Join(strings.Fields(q.Text), " ")
+	if runes := []rune(text); len(runes) > maxSummaryLength {
+		text = string(runes[:maxSummaryLength]) + "…"
+	}
+	return fmt.Sprintf("#%d: %s", q.ID, text)
+}
+
+// Commands supported:
+//    !quote add text
+// Adds the text to the room's quotes. Sent in reply to a message with no text, adds the message.
+//    !quote N
+// Responds with the room's quote numbered N.
+//    !quote random
+// Responds with one of the room's quotes at random.
+//    !quote search words
+// Responds with the room's quotes which contain all the words.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"quote", "add"},
+			Arguments: []string{"text"},
+			Help:      "Save a quote, or reply to a message to quote it",
+			EventCommand: func(evt *mevt.Event, args []string) (interface{}, error) {
+				return s.cmdAdd(cli, evt, time.Now())
+			},
+		},
+		{
+			Path:      []string{"quote"},
+			Arguments: []string{"N"},
+			Help:      "Show one of this room's quotes",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdQuote(roomID, args)
+			},
+		},
+		{
+			Path: []string{"quote", "random"},
+			Help: "Show one of this room's quotes at random",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdRandom(roomID)
+			},
+		},
+		{
+			Path:      []string{"quote", "search"},
+			Arguments: []string{"words"},
+			Help:      "Search this room's quotes",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSearch(roomID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdAdd(cli types.MatrixClient, evt *mevt.Event, now time.Time) (interface{}, error) {
+	q := quote{
+		Text:               rawText(evt, 2),
+		AddedBy:            evt.Sender,
+		AddedTimestampSecs: now.Unix(),
+	}
+	if q.Text == "" {
+		replyTo := evt.Content.AsMessage().GetReplyTo()
+		if replyTo == "" {
+			return nil, fmt.Errorf("Usage: !quote add text, or reply to a message with !quote add")
+		}
+		sender, body, err := fetchMessage(cli, evt.RoomID, replyTo)
+		if err != nil {
+			return nil, err
+		}
+		q.Text = strings.TrimSpace(body)
+		q.Author = sender
+	}
+	if q.Text == "" {
+		return nil, fmt.Errorf("There is nothing to quote")
+	}
+	if utf8.RuneCountInString(q.Text) > maxQuoteLength {
+		return nil, fmt.Errorf("Quotes can't be longer than %d characters", maxQuoteLength)
+	}
+
+	quotesMutex.Lock()
+	defer quotesMutex.Unlock()
+	quotes, err := s.loadQuotes(evt.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if len(quotes.Quotes) >= s.maxQuotes() {
+		return nil, fmt.Errorf("This room has %d quotes, which is the most it can have", len(quotes.Quotes))
+	}
+	quotes.LastID++
+	q.ID = quotes.LastID
+	quotes.Quotes = append(quotes.Quotes, q)
+	if err = s.storeQuotes(evt.RoomID, quotes); err != nil {
+		return nil, err
+	}
+	return notice(fmt.Sprintf("Added quote #%d", q.ID)), nil
+}
+
+func (s *Service) cmdQuote(roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !quote N|random|add|search")
+	}
+	quoteID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return nil, fmt.Errorf("Usage: !quote N|random|add|search")
+	}
+	quotes, err := s.loadQuotes(roomID)
+	if err != nil {
+		return nil, err
+	}
+	q := quotes.find(quoteID)
+	if q == nil {
+		return nil, fmt.Errorf("There is no quote #%d", quoteID)
+	}
+	return notice(q.format()), nil
+}
+
+func (s *Service) cmdRandom(roomID id.RoomID) (interface{}, error) {
+	quotes, err := s.loadQuotes(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if len(quotes.Quotes) == 0 {
+		return notice("This room has no quotes yet. Add one with !quote add"), nil
+	}
+	q := quotes.Quotes[randIntn(len(quotes.Quotes))]
+	return notice(q.format()), nil
+}
+
+func (s *Service) cmdSearch(roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Usage: !quote search words")
+	}
+	quotes, err := s.loadQuotes(roomID)
+	if err != nil {
+		return nil, err
+	}
+	var found []quote
+	for _, q := range quotes.Quotes {
+		text := strings.ToLower(q.Text + " " + q.Author.String())
+		matches := true
+		for _, word := range args {
+			if !strings.Contains(text, strings.ToLower(word)) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			found = append(found, q)
+		}
+	}
+	if len(found) == 0 {
+		return notice(fmt.Sprintf("No quotes contain '%s'", strings.Join(args, " "))), nil
+	}
+	if len(found) == 1 {
+		return notice(found[0].format()), nil
+	}
+
+	heading := fmt.Sprintf("%d quotes contain '%s':", len(found), strings.Join(args, " "))
+	if len(found) > searchCount {
+		heading = fmt.Sprintf("%d quotes contain '%s', the latest %d are:", len(found), strings.Join(args, " "), searchCount)
+		found = found[len(found)-searchCount:]
+	}
+	lines := []string{heading}
+	for _, q := range found {
+		lines = append(lines, q.summary())
+	}
+	return notice(strings.Join(lines, "\n")), nil
+}
+
+// fetchMessage returns who sent the text message with the ID, and its text.
+func fetchMessage(cli types.MatrixClient, roomID id.RoomID, eventID id.EventID) (id.UserID, string, error) {
+	evCli, ok := cli.(types.EventGetter)
+	if !ok {
+		return "", "", fmt.Errorf("Unable to fetch messages with this client")
+	}
+	original, err := evCli.GetEvent(roomID, eventID)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to fetch the message: %s", err)
+	}
+	if original.Type.Type == mevt.EventEncrypted.Type {
+		return "", "", fmt.Errorf("Encrypted messages can't be quoted by replying to them")
+	} else if original.Type.Type != mevt.EventMessage.Type {
+		return "", "", fmt.Errorf("Only messages can be quoted")
+	}
+	original.Content.ParseRaw(mevt.EventMessage)
+	msg := original.Content.AsMessage()
+	if msg.MsgType != mevt.MsgText && msg.MsgType != mevt.MsgEmote && msg.MsgType != mevt.MsgNotice {
+		return "", "", fmt.Errorf("Only text messages can be quoted")
+	}
+	msg.RemoveReplyFallback()
+	return original.Sender, msg.Body, nil
+}
+
+// rawText returns the body of the command message after the first n words, so that text is used
+// as it was sent rather than split into arguments.
+func rawText(evt *mevt.Event, n int) string {
+	body, _ := evt.Content.Raw["body"].(string)
+	body = mevt.TrimReplyFallbackText(body)
+	body = strings.TrimLeftFunc(body, unicode.IsSpace)
+	for i := 0; i < n; i++ {
+		end := strings.IndexFunc(body, unicode.IsSpace)
+		if end == -1 {
+			return ""
+		}
+		body = strings.TrimLeftFunc(body[end:], unicode.IsSpace)
+	}
+	return strings.TrimSpace(body)
+}
+
+func (s *Service) maxQuotes() int {
+	if s.MaxQuotes <= 0 {
+		return defaultMaxQuotes
+	}
+	return s.MaxQuotes
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func (s *Service) loadQuotes(roomID id.RoomID) (*quoteList, error) {
+	var quotes quoteList
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "quotes "+roomID.String())
+	if err == sql.ErrNoRows {
+		return &quotes, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, &quotes); err != nil {
+		return nil, err
+	}
+	return &quotes, nil
+}
+
+func (s *Service) storeQuotes(roomID id.RoomID, quotes *quoteList) error {
+	stateJSON, err := json.Marshal(quotes)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "quotes "+roomID.String(), stateJSON)
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package quotes
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// commandEvent returns a message with the body, which replies to the event if it is given.
+func commandEvent(t *testing.T, roomID id.RoomID, body string, replyTo id.EventID) *mevt.Event {
+	raw := map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    body,
+	}
+	if replyTo != "" {
+		raw["m.relates_to"] = map[string]interface{}{
+			"m.in_reply_to": map[string]interface{}{"event_id": replyTo},
+		}
+	}
+	content := mevt.Content{Raw: raw}
+	if veryRaw, err := content.MarshalJSON(); err != nil {
+		t.Fatalf("Error marshalling JSON: %s", err)
+	} else {
+		content.VeryRaw = veryRaw
+	}
+	content.ParseRaw(mevt.EventMessage)
+	return &mevt.Event{
+		Type:    mevt.EventMessage,
+		Sender:  "@zelda:hyrule",
+		RoomID:  roomID,
+		Content: content,
+	}
+}
+
+func TestQuotes(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/event/$wisdom") {
+			return &http.Response{
+				StatusCode: 200,
+				Body: ioutil.NopCloser(bytes.NewBufferString(`{
+					"type":"m.room.message","event_id":"$wisdom","room_id":"!team:hyrule","sender":"@link:hyrule",
+					"content":{"msgtype":"m.text","body":"It's dangerous to go alone! Take this."}}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"max_quotes": 3}`))
+	if err != nil {
+		t.Fatal("Failed to create quotes service: ", err)
+	}
+	s := srv.(*Service)
+	now := time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC)
+
+	respond := func(res interface{}, err error) string {
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+	for _, tc := range []struct {
+		body    string
+		replyTo id.EventID
+		want    string
+	}{
+		{"!quote add   Ship it,   they said ", "", "Added quote #1"},
+		{"!quote add", "$wisdom", "Added quote #2"},
+		{"!quote add", "", "error: Usage: !quote add text, or reply to a message with !quote add"},
+		{"!quote add " + strings.Repeat("a", maxQuoteLength+1), "", "error: Quotes can't be longer than 1000 characters"},
+		{"!quote add Excuse me, princess!", "", "Added quote #3"},
+		{"!quote add One too many", "", "error: This room has 3 quotes, which is the most it can have"},
+	} {
+		if got := respond(s.cmdAdd(matrixCli, commandEvent(t, "!team:hyrule", tc.body, tc.replyTo), now)); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.body, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		got, want string
+	}{
+		{respond(s.cmdQuote("!team:hyrule", []string{"1"})), "#1: “Ship it,   they said” – added by @zelda:hyrule"},
+		{respond(s.cmdQuote("!team:hyrule", []string{"#2"})), "#2: “It's dangerous to go alone! Take this.” – @link:hyrule"},
+		{respond(s.cmdQuote("!team:hyrule", []string{"4"})), "error: There is no quote #4"},
+		{respond(s.cmdQuote("!other:hyrule", []string{"1"})), "error: There is no quote #1"},
+		{respond(s.cmdSearch("!team:hyrule", []string{"DANGEROUS"})), "#2: “It's dangerous to go alone! Take this.” – @link:hyrule"},
+		{respond(s.cmdSearch("!team:hyrule", []string{"i"})), "3 quotes contain 'i':\n#1: Ship it, they said\n#2: It's dangerous to go alone! Take this.\n#3: Excuse me, princess!"},
+		{respond(s.cmdSearch("!team:hyrule", []string{"ganon"})), "No quotes contain 'ganon'"},
+		{respond(s.cmdRandom("!other:hyrule")), "This room has no quotes yet. Add one with !quote add"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("Got %q, want %q", tc.got, tc.want)
+		}
+	}
+
+	randIntn = func(n int) int { return n - 1 }
+	if got := respond(s.cmdRandom("!team:hyrule")); got != "#3: “Excuse me, princess!” – added by @zelda:hyrule" {
+		t.Errorf("Bad random quote: %s", got)
+	}
+}
@@ -0,0 +1,164 @@
+package reddit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reddit's APIs, and the website posts are linked to. Overridden by tests.
+var (
+	tokenURL = "https://www.reddit.com/api/v1/access_token"
+	apiURL   = "https://oauth.reddit.com/"
+	siteURL  = "https://www.reddit.com"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Reddit refuses requests with generic User-Agents
+const userAgent = "go-neb:reddit:v1 (+https://github.com/matrix-org/go-neb)"
+
+// The access tokens which have been granted, keyed by service ID, along with the client ID they
+// were granted to so that a change of credentials gets a new token.
+var (
+	tokenMutex sync.Mutex
+	tokens     = make(map[string]accessToken)
+)
+
+type accessToken struct {
+	clientID string
+	token    string
+	expires  time.Time
+}
+
+// post is a Reddit link or text post.
+type post struct {
+	// The post's "fullname", e.g. "t3_abc123"
+	Name        string  `json:"name"`
+	Title       string  `json:"title"`
+	Author      string  `json:"author"`
+	Subreddit   string  `json:"subreddit"`
+	Permalink   string  `json:"permalink"`
+	URL         string  `json:"url"`
+	IsSelf      bool    `json:"is_self"`
+	Score       int     `json:"score"`
+	NumComments int     `json:"num_comments"`
+	Over18      bool    `json:"over_18"`
+	Stickied    bool    `json:"stickied"`
+	CreatedUTC  float64 `json:"created_utc"`
+}
+
+// commentsURL returns the link to the post on Reddit.
+func (p *post) commentsURL() string {
+	return siteURL + p.Permalink
+}
+
+type listing struct {
+	Data struct {
+		Children []struct {
+			Data post `json:"data"`
+		} `json:"children"`
+	} `json:"data"`
+}
+
+// fetchToken returns an application-only access token for the app, granting a new one if the
+// last one has expired.
+func (s *Service) fetchToken(now time.Time) (string, error) {
+	tokenMutex.Lock()
+	defer tokenMutex.Unlock()
+	if t, ok := tokens[s.ServiceID()]; ok && t.clientID == s.ClientID && now.Before(t.expires) {
+		return t.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(s.ClientID, s.ClientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		return "", fmt.Errorf("Reddit refused the client_id and client_secret")
+	} else if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Error != "" || body.AccessToken == "" {
+		return "", fmt.Errorf("Failed to get an access token: %s", body.Error)
+	}
+	// Grant a new token a minute early, rather than have requests refused
+	tokens[s.ServiceID()] = accessToken{
+		clientID: s.ClientID,
+		token:    body.AccessToken,
+		expires:  now.Add(time.Duration(body.ExpiresIn)*time.Second - time.Minute),
+	}
+	return body.AccessToken, nil
+}
+
+// fetchPosts returns the subreddit's posts in the listing, e.g. "new" or "hot". It returns an
+// error if the subreddit doesn't exist or is private.
+func (s *Service) fetchPosts(subreddit, sort string, limit int) ([]post, error) {
+	token, err := s.fetchToken(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("%sr/%s/%s?limit=%d&raw_json=1", apiURL, url.PathEscape(subreddit), sort, limit)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("User-Agent", userAgent)
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		// Forget the token, in case it was revoked
+		tokenMutex.Lock()
+		delete(tokens, s.ServiceID())
+		tokenMutex.Unlock()
+		return nil, fmt.Errorf("Reddit refused the access token")
+	case http.StatusForbidden, http.StatusNotFound:
+		return nil, fmt.Errorf("r/%s doesn't exist or is private", subreddit)
+	default:
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	// Reddit redirects searches for subreddits which don't exist, rather than saying so
+	if res.Request != nil && res.Request.URL.Path != req.URL.Path {
+		return nil, fmt.Errorf("r/%s doesn't exist", subreddit)
+	}
+	var body listing
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	var posts []post
+	for _, child := range body.Data.Children {
+		posts = append(posts, child.Data)
+	}
+	return posts, nil
+}
@@ -0,0 +1,314 @@
+// Package reddit implements a Service which posts new Reddit posts into rooms.
+package reddit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Reddit service
+const ServiceType = "reddit"
+
+const (
+	defaultPollInterval = 10 * time.Minute
+	minPollIntervalMins = 2
+	// How many of a subreddit's newest posts are checked each poll
+	fetchLimit = 100
+	// How many posts are announced to a room each poll, so that busy subreddits don't flood it
+	maxPostsPerPoll = 5
+	// How many seen post IDs are remembered for each room and subreddit. Posts have left the
+	// newest fetchLimit posts long before this many more have been posted.
+	maxSeen = 500
+)
+
+var subredditRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_]{1,20}$`)
+
+// Service contains the Config fields for the Reddit service.
+//
+// Reddit's API needs the credentials of an app, which can be created at
+// https://www.reddit.com/prefs/apps. A "script" app works, and only its client ID and secret are
+// used, as Go-NEB only reads public posts.
+//
+// New posts in each room's subreddits are announced once their score reaches the room's
+// "min_score". Each post is only announced once, even after a restart, and the posts made before
+// a subreddit was added are not announced. NSFW posts are left out unless "nsfw" is set.
+//
+// Example JSON request:
+//   {
+//       "client_id": "p-jcoLKBynTLew",
+//       "client_secret": "gko_LXELoV07ZBNUXrvWZfzE3aI",
+//       "poll_interval_mins": 10,
+//       "rooms": {
+//           "!golang:localhost": {
+//               "subreddits": ["golang", "programming"],
+//               "min_score": 50
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// The client ID of the Reddit app.
+	ClientID string `json:"client_id"`
+	// The secret of the Reddit app.
+	ClientSecret string `json:"client_secret"`
+	// Optional. How often to check the subreddits for new posts, in minutes. Defaults to 10.
+	PollIntervalMins int `json:"poll_interval_mins"`
+	// Optional. The rooms to announce new posts to.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is which posts are announced to a room.
+type RoomConfig struct {
+	// The subreddits to announce new posts in, without "r/".
+	Subreddits []string `json:"subreddits"`
+	// Optional. The score a post needs to be announced. Defaults to 0, for every post.
+	MinScore int `json:"min_score"`
+	// Optional. Announce posts marked NSFW. Defaults to false.
+	NSFW bool `json:"nsfw"`
+}
+
+func (s *Service) pollInterval() time.Duration {
+	if s.PollIntervalMins <= 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(s.PollIntervalMins) * time.Minute
+}
+
+// Commands supported:
+//    !reddit subreddit
+// Responds with the post at the top of the subreddit's hot posts.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"reddit"},
+			Arguments: []string{"subreddit"},
+			Help:      "Show the top post in a subreddit, e.g. !reddit golang",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdReddit(args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdReddit(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !reddit subreddit")
+	}
+	subreddit := normaliseSubreddit(args[0])
+	if !subredditRegex.MatchString(subreddit) {
+		return nil, fmt.Errorf("'%s' isn't a subreddit", args[0])
+	}
+	// A few more than one, in case the top posts are pinned announcements
+	posts, err := s.fetchPosts(subreddit, "hot", 5)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch r/%s: %s", subreddit, err)
+	}
+	for _, p := range posts {
+		if !p.Stickied {
+			content := postsContent([]post{p})
+			return &content, nil
+		}
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("There are no posts in r/%s", subreddit),
+	}, nil
+}
+
+// OnPoll announces the new posts in the subreddits to the rooms.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	s.check(cli)
+	return time.Now().Add(s.pollInterval())
+}
+
+func (s *Service) check(cli types.MatrixClient) {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	// Each subreddit is only fetched once, however many rooms it is announced to
+	newPosts := make(map[string][]post)
+	for _, room := range s.Rooms {
+		for _, subreddit := range room.Subreddits {
+			newPosts[normaliseSubreddit(subreddit)] = nil
+		}
+	}
+	for subreddit := range newPosts {
+		posts, err := s.fetchPosts(subreddit, "new", fetchLimit)
+		if err != nil {
+			logger.WithError(err).WithField("subreddit", subreddit).Error("Failed to fetch new posts")
+			delete(newPosts, subreddit)
+			continue
+		}
+		// Oldest first
+		sort.Slice(posts, func(i, j int) bool { return posts[i].CreatedUTC < posts[j].CreatedUTC })
+		newPosts[subreddit] = posts
+	}
+
+	for roomID, room := range s.Rooms {
+		for _, subreddit := range room.Subreddits {
+			subreddit = normaliseSubreddit(subreddit)
+			posts, ok := newPosts[subreddit]
+			if !ok {
+				continue
+			}
+			if err := s.announce(cli, roomID, &room, subreddit, posts); err != nil {
+				logger.WithError(err).WithFields(log.Fields{
+					"room_id":   roomID,
+					"subreddit": subreddit,
+				}).Error("Failed to announce new posts")
+			}
+		}
+	}
+}
+
+// announce sends the room the subreddit's posts which it hasn't been sent and which have
+// reached its minimum score.
+func (s *Service) announce(cli types.MatrixClient, roomID id.RoomID, room *RoomConfig, subreddit string, posts []post) error {
+	stateKey := "seen " + roomID.String() + " " + subreddit
+	seen, err := s.loadSeen(stateKey)
+	if err != nil {
+		return err
+	}
+	firstPoll := seen == nil
+	var seenIDs []string
+	seenSet := make(map[string]bool)
+	for _, postID := range seen {
+		seenSet[postID] = true
+	}
+	var unseen []post
+	for _, p := range posts {
+		if seenSet[p.Name] || p.Score < room.MinScore || (p.Over18 && !room.NSFW) {
+			continue
+		}
+		unseen = append(unseen, p)
+		seenIDs = append(seenIDs, p.Name)
+	}
+	if !firstPoll && len(unseen) == 0 {
+		return nil
+	}
+	seen = append(seen, seenIDs...)
+	if len(seen) > maxSeen {
+		seen = seen[len(seen)-maxSeen:]
+	}
+	// Remember the posts first, so that they aren't announced again if sending fails
+	if err = s.storeSeen(stateKey, seen); err != nil {
+		return err
+	}
+	if firstPoll || len(unseen) == 0 {
+		return nil
+	}
+	if len(unseen) > maxPostsPerPoll {
+		unseen = unseen[len(unseen)-maxPostsPerPoll:]
+	}
+	_, err = notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: postsContent(unseen)})
+	return err
+}
+
+// postsContent returns a message listing the posts, with links to them and their comments.
+func postsContent(posts []post) mevt.MessageEventContent {
+	var lines, htmlLines []string
+	for _, p := range posts {
+		title := p.Title
+		if p.Over18 {
+			title = "[NSFW] " + title
+		}
+		stats := fmt.Sprintf("r/%s · %d points · %d comments · u/%s", p.Subreddit, p.Score, p.NumComments, p.Author)
+		line := fmt.Sprintf("%s\n%s", title, stats)
+		htmlLine := fmt.Sprintf(`<a href="%s">%s</a><br>%s`, html.EscapeString(p.commentsURL()), html.EscapeString(title), html.EscapeString(stats))
+		if !p.IsSelf && p.URL != "" {
+			line += "\n" + p.URL
+			htmlLine += fmt.Sprintf(` · <a href="%s">link</a>`, html.EscapeString(p.URL))
+		}
+		lines = append(lines, line+"\n"+p.commentsURL())
+		htmlLines = append(htmlLines, htmlLine)
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: strings.Join(htmlLines, "<br>"),
+	}
+}
+
+// normaliseSubreddit returns the subreddit's name without "r/" or "/r/". Reddit treats names
+// case-insensitively.
+func normaliseSubreddit(subreddit string) string {
+	subreddit = strings.TrimPrefix(strings.TrimPrefix(subreddit, "/"), "r/")
+	return strings.ToLower(subreddit)
+}
+
+// loadSeen returns the IDs of the posts the room has been sent from a subreddit, oldest first,
+// or nil if the subreddit has never been checked for it.
+func (s *Service) loadSeen(stateKey string) ([]string, error) {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), stateKey)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	seen := []string{}
+	err = json.Unmarshal(stateJSON, &seen)
+	return seen, err
+}
+
+func (s *Service) storeSeen(stateKey string, seen []string) error {
+	if seen == nil {
+		seen = []string{}
+	}
+	stateJSON, err := json.Marshal(seen)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), stateKey, stateJSON)
+}
+
+// Register makes sure that the app and subreddits are configured, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.ClientID == "" || s.ClientSecret == "" {
+		return fmt.Errorf("A client_id and client_secret are required")
+	}
+	if s.PollIntervalMins < 0 || (s.PollIntervalMins > 0 && s.PollIntervalMins < minPollIntervalMins) {
+		return fmt.Errorf("poll_interval_mins can't be less than %d", minPollIntervalMins)
+	}
+	for roomID, room := range s.Rooms {
+		if len(room.Subreddits) == 0 {
+			return fmt.Errorf("Room %s has no subreddits", roomID)
+		}
+		for _, subreddit := range room.Subreddits {
+			if !subredditRegex.MatchString(normaliseSubreddit(subreddit)) {
+				return fmt.Errorf("Bad subreddit '%s' for room %s", subreddit, roomID)
+			}
+		}
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package reddit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func postJSON(name, title string, score int, created int, extra string) string {
+	return fmt.Sprintf(`{"data":{"name":"%s","title":"%s","author":"zelda","subreddit":"hyrule","permalink":"/r/hyrule/comments/%s/",`+
+		`"url":"https://www.reddit.com/r/hyrule/comments/%s/","is_self":true,"score":%d,"num_comments":3,"created_utc":%d%s}}`,
+		name, title, name, name, score, created, extra)
+}
+
+// mockReddit answers token requests and the listings in the posts map, counting the tokens granted.
+func mockReddit(posts map[string][]string, granted *int) *http.Client {
+	return &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("User-Agent") != userAgent {
+			return nil, fmt.Errorf("Bad User-Agent: %s", req.Header.Get("User-Agent"))
+		}
+		if req.URL.String() == "https://www.reddit.com/api/v1/access_token" {
+			if user, pass, _ := req.BasicAuth(); user != "zelda_app" || pass != "triforce_secret" {
+				return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+			}
+			*granted++
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"access_token":"master_key","token_type":"bearer","expires_in":86400}`)),
+			}, nil
+		}
+		if req.Header.Get("Authorization") != "bearer master_key" {
+			return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		children, ok := posts[strings.TrimPrefix(req.URL.Path, "/")]
+		if !strings.HasPrefix(req.URL.String(), "https://oauth.reddit.com/r/") || !ok {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"data":{"children":[` + strings.Join(children, ",") + `]}}`)),
+		}, nil
+	})}
+}
+
+func TestPoll(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	tokens = make(map[string]accessToken)
+	granted := 0
+	posts := map[string][]string{
+		"r/hyrule/new": {postJSON("t3_a", "Old news", 500, 100, "")},
+	}
+	httpClient = mockReddit(posts, &granted)
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, room+" "+msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$post:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"client_id": "zelda_app",
+		"client_secret": "triforce_secret",
+		"rooms": {
+			"!all:hyrule": {"subreddits": ["r/Hyrule"]},
+			"!best:hyrule": {"subreddits": ["hyrule"], "min_score": 100}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create reddit service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register reddit service: ", err)
+	}
+	s := srv.(*Service)
+
+	s.check(matrixCli)
+	if len(sent) != 0 {
+		t.Errorf("Announced posts made before the subreddit was added: %v", sent)
+	}
+
+	// Newest first, as Reddit lists them
+	posts["r/hyrule/new"] = []string{
+		postJSON("t3_d", "Cucco spotted", 2, 400, `,"over_18":true`),
+		postJSON("t3_c", "Lost <Woods> map", 5, 300, ""),
+		postJSON("t3_b", "Castle tour", 150, 200, ""),
+		postJSON("t3_a", "Old news", 500, 100, ""),
+	}
+	s.check(matrixCli)
+	// Another post reaches the minimum score
+	posts["r/hyrule/new"][1] = postJSON("t3_c", "Lost <Woods> map", 120, 300, "")
+	s.check(matrixCli)
+
+	if granted != 1 {
+		t.Errorf("Expected the access token to be reused, %d were granted", granted)
+	}
+	castle := "Castle tour\nr/hyrule · 150 points · 3 comments · u/zelda\nhttps://www.reddit.com/r/hyrule/comments/t3_b/"
+	woods := "Lost <Woods> map\nr/hyrule · %d points · 3 comments · u/zelda\nhttps://www.reddit.com/r/hyrule/comments/t3_c/"
+	var all, best []string
+	for _, msg := range sent {
+		if strings.HasPrefix(msg, "!all:hyrule ") {
+			all = append(all, strings.TrimPrefix(msg, "!all:hyrule "))
+		} else {
+			best = append(best, strings.TrimPrefix(msg, "!best:hyrule "))
+		}
+	}
+	wantAll := []string{castle + "\n" + fmt.Sprintf(woods, 5)}
+	wantBest := []string{castle, fmt.Sprintf(woods, 120)}
+	if strings.Join(all, "\n\n") != strings.Join(wantAll, "\n\n") {
+		t.Errorf("Bad messages to !all: got %q, want %q", all, wantAll)
+	}
+	if strings.Join(best, "\n\n") != strings.Join(wantBest, "\n\n") {
+		t.Errorf("Bad messages to !best: got %q, want %q", best, wantBest)
+	}
+}
+
+func TestReddit(t *testing.T) {
+	tokens = make(map[string]accessToken)
+	granted := 0
+	httpClient = mockReddit(map[string][]string{
+		"r/hyrule/hot": {
+			postJSON("t3_rules", "Read the rules", 10, 100, `,"stickied":true`),
+			postJSON("t3_top", "Found the Master Sword", 900, 200, `,"is_self":false,"url":"https://imgur.hyrule/sword.png"`),
+		},
+	}, &granted)
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"client_id": "zelda_app",
+		"client_secret": "triforce_secret"
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create reddit service: ", err)
+	}
+	s := srv.(*Service)
+
+	res, err := s.cmdReddit([]string{"/r/Hyrule"})
+	if err != nil {
+		t.Fatal("Failed to show the top post: ", err)
+	}
+	want := "Found the Master Sword\nr/hyrule · 900 points · 3 comments · u/zelda\nhttps://imgur.hyrule/sword.png\nhttps://www.reddit.com/r/hyrule/comments/t3_top/"
+	if body := res.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("Bad top post: got %q, want %q", body, want)
+	}
+	for _, args := range [][]string{{}, {"a"}, {"../admin"}, {"gerudo"}} {
+		if _, err = s.cmdReddit(args); err == nil {
+			t.Errorf("Expected %v to fail", args)
+		}
+	}
+
+	s.ClientSecret = "wrong"
+	s.ClientID = "ganon_app"
+	if _, err = s.cmdReddit([]string{"hyrule"}); err == nil {
+		t.Errorf("Expected the wrong credentials to be refused")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"client_id": "zelda_app"}`,
+		`{"client_id": "zelda_app", "client_secret": "triforce_secret", "poll_interval_mins": 1}`,
+		`{"client_id": "zelda_app", "client_secret": "triforce_secret", "rooms": {"!all:hyrule": {}}}`,
+		`{"client_id": "zelda_app", "client_secret": "triforce_secret", "rooms": {"!all:hyrule": {"subreddits": ["hy rule"]}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create reddit service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+// Package relay implements a Service which relays messages between rooms in different languages,
+// translating them.
+package relay
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/translate"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Relay service
+const ServiceType = "relay"
+
+// The longest message which is translated, as providers charge by the character. Longer messages
+// are relayed untranslated.
+const maxTextLength = 2000
+
+// A language code like "de", "pt-BR" or "zh-Hant"
+var languageRegex = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z]{2,4})?$`)
+
+// translateText is replaced in tests.
+var translateText = translate.Text
+
+// How long after a message is relayed its edits, replies and redactions are still relayed
+const relayMemory = 30 * 24 * time.Hour
+
+// relayedState forgets relayed messages after relayMemory.
+var relayedState = &utils.ExpiringState{IndexKey: "relayed.index", TTL: relayMemory}
+
+// Service contains the Config fields for the Relay service.
+//
+// Messages sent into each of the rooms are relayed into the others, translated into their
+// languages, so that e.g. an English room and a Japanese room can talk to each other. Relayed
+// messages say who sent them. Edits, replies and redactions are relayed too, and messages which
+// are already in a room's language are relayed as they are.
+//
+// Text messages and emotes are relayed. Notices aren't, so that bots in the rooms don't talk to
+// each other through the relay.
+//
+// Translations come from Google or DeepL, configured as in the Translate service.
+//
+// Example JSON request:
+//   {
+//       "provider": "deepl",
+//       "api_key": "00000000-0000-0000-0000-000000000000:fx",
+//       "rooms": {
+//           "!english:localhost": {"language": "en"},
+//           "!japanese:localhost": {"language": "ja"}
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The provider of translations: "google" or "deepl". Defaults to "google".
+	Provider string `json:"provider"`
+	// The provider's API key.
+	APIKey string `json:"api_key"`
+	// A map from Matrix room ID to the room's config. There must be at least two rooms.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is the config of one of the relayed rooms.
+type RoomConfig struct {
+	// The language which messages are translated into for the room, e.g. "en" or "pt-BR".
+	Language string `json:"language"`
+}
+
+// relayedMessage is a message and its copies in the other rooms. It is stored in the service
+// state under "relayed" and the ID of each of the events, so that edits, replies and redactions
+// of any of them can be relayed.
+type relayedMessage struct {
+	// The event which was relayed
+	Original id.EventID `json:"original"`
+	// The events in each room, including the original's
+	Events map[id.RoomID]id.EventID `json:"events"`
+}
+
+// OnMessage relays messages, edits and redactions in the rooms to the other rooms.
+func (s *Service) OnMessage(cli types.MatrixClient, evt *mevt.Event) {
+	if _, ok := s.Rooms[evt.RoomID]; !ok || evt.Sender == s.ServiceUserID() {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    evt.RoomID,
+		"event_id":   evt.ID,
+	})
+	var err error
+	if evt.Type == mevt.EventRedaction {
+		err = s.relayRedaction(cli, evt)
+	} else if evt.Type == mevt.EventMessage {
+		err = s.relayMessage(cli, evt)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to relay event")
+	}
+}
+
+func (s *Service) relayMessage(cli types.MatrixClient, evt *mevt.Event) error {
+	msgType, _ := evt.Content.Raw["msgtype"].(string)
+	if mevt.MessageType(msgType) != mevt.MsgText && mevt.MessageType(msgType) != mevt.MsgEmote {
+		return nil
+	}
+	relType, relatedID := relation(evt.Content.Raw)
+	body, _ := evt.Content.Raw["body"].(string)
+	name := displayName(cli, evt.RoomID, evt.Sender)
+
+	if relType == "m.replace" {
+		if newContent, ok := evt.Content.Raw["m.new_content"].(map[string]interface{}); ok {
+			body, _ = newContent["body"].(string)
+		}
+		relayed, ok, err := s.loadRelayed(relatedID)
+		// Only edits of the original are relayed, as the copies are the bot's messages
+		if err != nil || !ok || relayed.Original != relatedID {
+			return err
+		}
+		for roomID, eventID := range relayed.Events {
+			if roomID == evt.RoomID {
+				continue
+			}
+			content := s.relayContent(roomID, name, mevt.MessageType(msgType), body)
+			if _, err = cli.SendMessageEvent(roomID, mevt.EventMessage, editContent(content, eventID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Replies are relayed as replies to the copies of the message, without the quote of it
+	var replyTo relayedMessage
+	if replyID := inReplyTo(evt.Content.Raw); replyID != "" {
+		body = mevt.TrimReplyFallbackText(body)
+		var err error
+		if replyTo, _, err = s.loadRelayed(replyID); err != nil {
+			return err
+		}
+	}
+	relayed := relayedMessage{
+		Original: evt.ID,
+		Events:   map[id.RoomID]id.EventID{evt.RoomID: evt.ID},
+	}
+	for roomID := range s.Rooms {
+		if roomID == evt.RoomID {
+			continue
+		}
+		var content interface{} = s.relayContent(roomID, name, mevt.MessageType(msgType), body)
+		if replyID, ok := replyTo.Events[roomID]; ok {
+			content = replyContent(content.(*mevt.MessageEventContent), replyID)
+		}
+		resp, err := cli.SendMessageEvent(roomID, mevt.EventMessage, content)
+		if err != nil {
+			log.WithError(err).WithField("room_id", roomID).Error("Failed to relay message")
+			continue
+		}
+		relayed.Events[roomID] = resp.EventID
+	}
+	return s.storeRelayed(relayed)
+}
+
+// relayContent returns the message to relay into the room, translated into its language and
+// attributed to the sender.
+func (s *Service) relayContent(roomID id.RoomID, name string, msgType mevt.MessageType, body string) *mevt.MessageEventContent {
+	text := s.translate(body, s.Rooms[roomID].Language)
+	if msgType == mevt.MsgEmote {
+		return &mevt.MessageEventContent{
+			MsgType:       mevt.MsgText,
+			Body:          fmt.Sprintf("* %s %s", name, text),
+			Format:        mevt.FormatHTML,
+			FormattedBody: fmt.Sprintf("* <strong>%s</strong> %s", html.EscapeString(name), html.EscapeString(text)),
+		}
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgText,
+		Body:          fmt.Sprintf("%s: %s", name, text),
+		Format:        mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf("<strong>%s</strong>: %s", html.EscapeString(name), html.EscapeString(text)),
+	}
+}
+
+// translate returns the text in the language. The text is returned as it is if it can't be
+// translated, so that the message is still relayed.
+func (s *Service) translate(text, language string) string {
+	if utf8.RuneCountInString(text) > maxTextLength {
+		return text
+	}
+	translated, source, err := translateText(s.Provider, s.APIKey, text, language)
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Warn("Failed to translate message")
+		return text
+	}
+	// Providers "translate" text which is already in the language, sometimes changing it
+	if baseLanguage(source) == baseLanguage(language) {
+		return text
+	}
+	return translated
+}
+
+func (s *Service) relayRedaction(cli types.MatrixClient, evt *mevt.Event) error {
+	relayed, ok, err := s.loadRelayed(evt.Redacts)
+	// Only redactions of the original are relayed, as the copies are the bot's messages
+	if err != nil || !ok || relayed.Original != evt.Redacts {
+		return err
+	}
+	redacter, ok := cli.(types.EventRedacter)
+	if !ok {
+		return fmt.Errorf("Client cannot redact events")
+	}
+	for roomID, eventID := range relayed.Events {
+		if eventID == relayed.Original {
+			continue
+		}
+		if _, err = redacter.RedactEvent(roomID, eventID); err != nil {
+			return err
+		}
+	}
+	s.forgetRelayed(relayed)
+	return nil
+}
+
+// baseLanguage returns the language without its region or script, e.g. "pt" for "pt-BR".
+func baseLanguage(language string) string {
+	return strings.ToLower(strings.SplitN(language, "-", 2)[0])
+}
+
+// displayName returns the display name of the room member, falling back to their user ID.
+func displayName(cli types.MatrixClient, roomID id.RoomID, userID id.UserID) string {
+	var member struct {
+		Displayname string `json:"displayname"`
+	}
+	scli, ok := cli.(types.StateGetter)
+	if !ok {
+		return userID.String()
+	}
+	if err := scli.StateEvent(roomID, mevt.StateMember, userID.String(), &member); err != nil || member.Displayname == "" {
+		return userID.String()
+	}
+	return member.Displayname
+}
+
+// relation returns the type of the event's m.relates_to and the event it relates to, if any.
+func relation(content map[string]interface{}) (string, id.EventID) {
+	rel, ok := content["m.relates_to"].(map[string]interface{})
+	if !ok {
+		return "", ""
+	}
+	relType, _ := rel["rel_type"].(string)
+	eventID, _ := rel["event_id"].(string)
+	return relType, id.EventID(eventID)
+}
+
+// inReplyTo returns the event which the event replies to, if any.
+func inReplyTo(content map[string]interface{}) id.EventID {
+	rel, ok := content["m.relates_to"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	reply, ok := rel["m.in_reply_to"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	eventID, _ := reply["event_id"].(string)
+	return id.EventID(eventID)
+}
+
+// replyContent returns the content of a reply to the event.
+func replyContent(content *mevt.MessageEventContent, eventID id.EventID) map[string]interface{} {
+	return map[string]interface{}{
+		"msgtype":        content.MsgType,
+		"body":           content.Body,
+		"format":         content.Format,
+		"formatted_body": content.FormattedBody,
+		"m.relates_to": map[string]interface{}{
+			"m.in_reply_to": map[string]interface{}{
+				"event_id": eventID,
+			},
+		},
+	}
+}
+
+// editContent returns the content of an m.replace edit of the event.
+func editContent(content *mevt.MessageEventContent, eventID id.EventID) map[string]interface{} {
+	return map[string]interface{}{
+		"msgtype":        content.MsgType,
+		"body":           "* " + content.Body,
+		"format":         content.Format,
+		"formatted_body": "* " + content.FormattedBody,
+		"m.new_content":  content,
+		"m.relates_to": map[string]interface{}{
+			"rel_type": "m.replace",
+			"event_id": eventID,
+		},
+	}
+}
+
+func (s *Service) loadRelayed(eventID id.EventID) (msg relayedMessage, ok bool, err error) {
+	if eventID == "" {
+		return
+	}
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "relayed "+eventID.String())
+	if err == sql.ErrNoRows {
+		return msg, false, nil
+	} else if err != nil {
+		return
+	}
+	return msg, true, json.Unmarshal(stateJSON, &msg)
+}
+
+// storeRelayed remembers the message under the IDs of each of its events, for relayMemory.
+func (s *Service) storeRelayed(msg relayedMessage) error {
+	stateJSON, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	var stateKeys []string
+	for _, eventID := range msg.Events {
+		stateKeys = append(stateKeys, "relayed "+eventID.String())
+	}
+	return relayedState.Store(s.ServiceID(), time.Now(), stateJSON, stateKeys...)
+}
+
+func (s *Service) forgetRelayed(msg relayedMessage) {
+	for _, eventID := range msg.Events {
+		if err := database.GetServiceDB().DeleteServiceState(s.ServiceID(), "relayed "+eventID.String()); err != nil {
+			log.WithError(err).Error("Failed to forget relayed message")
+		}
+	}
+}
+
+// Register makes sure that the provider and rooms are configured, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	switch s.Provider {
+	case "", "google", "deepl":
+	default:
+		return fmt.Errorf("Unknown provider '%s': must be google or deepl", s.Provider)
+	}
+	if s.APIKey == "" {
+		return fmt.Errorf("An api_key is required")
+	}
+	if len(s.Rooms) < 2 {
+		return fmt.Errorf("At least two rooms are required")
+	}
+	for roomID, room := range s.Rooms {
+		if !languageRegex.MatchString(room.Language) {
+			return fmt.Errorf("Room %s has a bad language '%s': must be a code like en, de or pt-BR", roomID, room.Language)
+		}
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
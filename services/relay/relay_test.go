@@ -0,0 +1,235 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/translate"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type sentEvent struct {
+	roomID  string
+	eventID string
+	content map[string]interface{}
+}
+
+func TestRelay(t *testing.T) {
+	store := testutils.NewStateStorage()
+	database.SetServiceDB(store)
+
+	// Text with anything but ASCII in it is Japanese, and the rest is English
+	translateText = func(provider, apiKey, text, target string) (string, string, error) {
+		if provider != "deepl" || apiKey != "the_lens_of_truth" {
+			t.Errorf("Bad provider config: %s %s", provider, apiKey)
+		}
+		if text == "Hyaaa!" {
+			return "", "", fmt.Errorf("Quota used up")
+		}
+		source := "en"
+		for _, r := range text {
+			if r > 127 {
+				source = "ja"
+			}
+		}
+		return fmt.Sprintf("(%s) %s", target, text), source, nil
+	}
+	defer func() { translateText = translate.Text }()
+
+	var sent []sentEvent
+	var redacted []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		body := ""
+		switch {
+		case strings.Contains(req.URL.Path, "/state/m.room.member/"):
+			names := map[string]string{"@link:hyrule": "Link", "@impa:hyrule": "Impa"}
+			parts := strings.Split(req.URL.Path, "/")
+			name, ok := names[parts[len(parts)-1]]
+			if !ok {
+				return &http.Response{
+					StatusCode: 404,
+					Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_NOT_FOUND"}`)),
+				}, nil
+			}
+			body = fmt.Sprintf(`{"displayname":"%s"}`, name)
+		case strings.Contains(req.URL.Path, "/send/m.room.message/"):
+			var content map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+				return nil, err
+			}
+			eventID := fmt.Sprintf("$%d", len(sent)+1)
+			sent = append(sent, sentEvent{strings.Split(req.URL.Path, "/")[5], eventID, content})
+			body = fmt.Sprintf(`{"event_id":"%s"}`, eventID)
+		case strings.Contains(req.URL.Path, "/redact/"):
+			redacted = append(redacted, strings.Split(req.URL.Path, "/")[5]+" "+strings.Split(req.URL.Path, "/")[7])
+			body = `{"event_id":"$redaction"}`
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"provider": "deepl",
+		"api_key": "the_lens_of_truth",
+		"rooms": {
+			"!castle:hyrule": {"language": "en"},
+			"!kakariko:hyrule": {"language": "ja"},
+			"!gerudo:hyrule": {"language": "en-GB"}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create relay service: ", err)
+	}
+	observer := srv.(types.MessageObserver)
+	matrixEvent := func(evType mevt.Type, roomID, sender, eventID, redacts string, content map[string]interface{}) {
+		observer.OnMessage(matrixCli, &mevt.Event{
+			Type:    evType,
+			ID:      id.EventID(eventID),
+			RoomID:  id.RoomID(roomID),
+			Sender:  id.UserID(sender),
+			Redacts: id.EventID(redacts),
+			Content: mevt.Content{Raw: content},
+		})
+	}
+	// sentTo returns the events sent since the last call, by room.
+	next := 0
+	sentTo := func() map[string]sentEvent {
+		byRoom := make(map[string]sentEvent)
+		for _, evt := range sent[next:] {
+			byRoom[evt.roomID] = evt
+		}
+		next = len(sent)
+		return byRoom
+	}
+
+	// English is translated into Japanese, and relayed as it is into the other English room
+	matrixEvent(mevt.EventMessage, "!castle:hyrule", "@link:hyrule", "$hey", "", map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "Hey, <listen>",
+	})
+	hey := sentTo()
+	if len(hey) != 2 || hey["!kakariko:hyrule"].content["body"] != "Link: (ja) Hey, <listen>" ||
+		hey["!kakariko:hyrule"].content["formatted_body"] != "<strong>Link</strong>: (ja) Hey, &lt;listen&gt;" ||
+		hey["!gerudo:hyrule"].content["body"] != "Link: Hey, <listen>" {
+		t.Fatalf("Bad relayed messages: %v", hey)
+	}
+
+	// Replies are relayed as replies to the message in each room, without the quote
+	matrixEvent(mevt.EventMessage, "!kakariko:hyrule", "@impa:hyrule", "$reply", "", map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "> <@neb:hyrule> Link: (ja) Hey, <listen>\n\nはい",
+		"m.relates_to": map[string]interface{}{
+			"m.in_reply_to": map[string]interface{}{"event_id": hey["!kakariko:hyrule"].eventID},
+		},
+	})
+	reply := sentTo()
+	for roomID, want := range map[string]struct{ body, replyTo string }{
+		"!castle:hyrule": {"Impa: (en) はい", "$hey"},
+		"!gerudo:hyrule": {"Impa: (en-GB) はい", hey["!gerudo:hyrule"].eventID},
+	} {
+		evt := reply[roomID]
+		relatesTo, _ := evt.content["m.relates_to"].(map[string]interface{})
+		inReplyTo, _ := relatesTo["m.in_reply_to"].(map[string]interface{})
+		if evt.content["body"] != want.body || inReplyTo["event_id"] != want.replyTo {
+			t.Errorf("Bad reply in %s: got %v, want %q in reply to %s", roomID, evt.content, want.body, want.replyTo)
+		}
+	}
+
+	// Edits of the message edit each of the relayed messages
+	matrixEvent(mevt.EventMessage, "!castle:hyrule", "@link:hyrule", "$edit", "", map[string]interface{}{
+		"msgtype":       "m.text",
+		"body":          "* Hey, look",
+		"m.new_content": map[string]interface{}{"msgtype": "m.text", "body": "Hey, look"},
+		"m.relates_to":  map[string]interface{}{"rel_type": "m.replace", "event_id": "$hey"},
+	})
+	edit := sentTo()
+	for roomID, body := range map[string]string{"!kakariko:hyrule": "Link: (ja) Hey, look", "!gerudo:hyrule": "Link: Hey, look"} {
+		evt := edit[roomID]
+		relatesTo, _ := evt.content["m.relates_to"].(map[string]interface{})
+		newContent, _ := evt.content["m.new_content"].(map[string]interface{})
+		if relatesTo["rel_type"] != "m.replace" || relatesTo["event_id"] != hey[roomID].eventID || newContent["body"] != body {
+			t.Errorf("Bad edit in %s: got %v, want an edit of %s to %q", roomID, evt.content, hey[roomID].eventID, body)
+		}
+	}
+
+	// Emotes, from people without display names, and messages which can't be translated
+	matrixEvent(mevt.EventMessage, "!castle:hyrule", "@zelda:hyrule", "$wave", "", map[string]interface{}{
+		"msgtype": "m.emote",
+		"body":    "waves",
+	})
+	if wave := sentTo(); wave["!kakariko:hyrule"].content["body"] != "* @zelda:hyrule (ja) waves" {
+		t.Errorf("Bad relayed emote: %v", wave)
+	}
+	matrixEvent(mevt.EventMessage, "!castle:hyrule", "@link:hyrule", "$shout", "", map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "Hyaaa!",
+	})
+	if shout := sentTo(); shout["!kakariko:hyrule"].content["body"] != "Link: Hyaaa!" {
+		t.Errorf("Expected the untranslated message to be relayed: %v", shout)
+	}
+
+	// Notices, the service's own messages and messages in other rooms aren't relayed
+	matrixEvent(mevt.EventMessage, "!castle:hyrule", "@navi:hyrule", "$notice", "", map[string]interface{}{
+		"msgtype": "m.notice",
+		"body":    "Beep",
+	})
+	matrixEvent(mevt.EventMessage, "!gerudo:hyrule", "@neb:hyrule", "$echo", "", map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "Link: Hey, <listen>",
+	})
+	matrixEvent(mevt.EventMessage, "!lostwoods:hyrule", "@link:hyrule", "$lost", "", map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "Hello?",
+	})
+	if others := sentTo(); len(others) != 0 {
+		t.Errorf("Expected no more messages, got %v", others)
+	}
+
+	// Redactions of the message redact each of the relayed messages
+	matrixEvent(mevt.EventRedaction, "!castle:hyrule", "@link:hyrule", "$redact", "$hey", map[string]interface{}{})
+	want := map[string]bool{
+		"!kakariko:hyrule " + hey["!kakariko:hyrule"].eventID: true,
+		"!gerudo:hyrule " + hey["!gerudo:hyrule"].eventID:     true,
+	}
+	if len(redacted) != len(want) || !want[redacted[0]] || !want[redacted[1]] {
+		t.Errorf("Bad redactions: got %v, want %v", redacted, want)
+	}
+	if _, ok := store.State["id relayed $hey"]; ok {
+		t.Errorf("Expected the redacted message to be forgotten")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"rooms": {"!castle:hyrule": {"language": "en"}, "!kakariko:hyrule": {"language": "ja"}}}`,
+		`{"api_key": "k", "provider": "hylian", "rooms": {"!castle:hyrule": {"language": "en"}, "!kakariko:hyrule": {"language": "ja"}}}`,
+		`{"api_key": "k", "rooms": {"!castle:hyrule": {"language": "en"}}}`,
+		`{"api_key": "k", "rooms": {"!castle:hyrule": {"language": "en"}, "!kakariko:hyrule": {}}}`,
+		`{"api_key": "k", "rooms": {"!castle:hyrule": {"language": "en"}, "!kakariko:hyrule": {"language": "Sheikah"}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create relay service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
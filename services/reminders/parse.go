@@ -0,0 +1,222 @@
+package reminders
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The hour of the day reminders are due at when only the day is given, e.g. "tomorrow"
+const defaultHour = 9
+
+var units = map[string]time.Duration{
+	"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hrs": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour, "wk": 7 * 24 * time.Hour, "wks": 7 * 24 * time.Hour,
+	"week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+}
+
+// Durations written as one word, like "2h", "1h30m" or "90mins"
+var compactRegex = regexp.MustCompile(`^(?:[0-9]+(?:\.[0-9]+)?[a-z]+)+$`)
+var compactPartRegex = regexp.MustCompile(`([0-9]+(?:\.[0-9]+)?)([a-z]+)`)
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+// parseReminder works out when a reminder is due and what it is about from the words after
+// "!remind me", which can say when first or last:
+//    in 2 hours to deploy
+//    at 3pm to call Bob
+//    tomorrow at 9:30 to water the plants
+//    on friday to send the newsletter
+//    on 2021-03-14 at 18:00 to buy a cake
+//    to deploy in 2h
+// Times of day are in the location, and "to" is optional.
+func parseReminder(words []string, now time.Time, loc *time.Location) (time.Time, string, error) {
+	lower := make([]string, len(words))
+	for i, w := range words {
+		lower[i] = strings.TrimRight(strings.ToLower(w), ",")
+	}
+	due, n, err := parseWhen(lower, now, loc)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	var text []string
+	if n > 0 {
+		text = words[n:]
+	} else {
+		// Look for "in <duration>" at the end instead
+		for i := len(lower) - 2; i > 0; i-- {
+			if lower[i] != "in" {
+				continue
+			}
+			if d, m := parseDuration(lower[i+1:]); m == len(lower)-i-1 {
+				due = now.Add(d)
+				text = words[:i]
+				break
+			}
+		}
+		if text == nil {
+			return time.Time{}, "", fmt.Errorf("When? Try e.g. !remind me in 2h to deploy")
+		}
+	}
+	if len(text) > 0 && strings.ToLower(text[0]) == "to" {
+		text = text[1:]
+	}
+	if len(text) == 0 {
+		return time.Time{}, "", fmt.Errorf("What should the reminder say? Try e.g. !remind me in 2h to deploy")
+	}
+	return due, strings.Join(text, " "), nil
+}
+
+// parseWhen parses the time at the start of the words, returning when it is and how many words
+// it took up. It returns 0 words if they don't start with a time.
+func parseWhen(words []string, now time.Time, loc *time.Location) (time.Time, int, error) {
+	if len(words) == 0 {
+		return time.Time{}, 0, nil
+	}
+	local := now.In(loc)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	switch w := words[0]; {
+	case w == "in":
+		d, n := parseDuration(words[1:])
+		if n == 0 {
+			return time.Time{}, 0, fmt.Errorf("Bad duration: use e.g. 2h, 90 minutes or 1 day and 3 hours")
+		}
+		return now.Add(d), n + 1, nil
+	case w == "at":
+		clock, err := parseClock(words[1:])
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		due := today.Add(clock)
+		if !due.After(now) {
+			due = today.AddDate(0, 0, 1).Add(clock)
+		}
+		return due, 2, nil
+	case w == "today" || w == "tomorrow":
+		day := today
+		if w == "tomorrow" {
+			day = today.AddDate(0, 0, 1)
+		}
+		return atClock(day, words, 1)
+	case w == "on" && len(words) > 1:
+		day, err := parseDay(words[1], today)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		return atClock(day, words, 2)
+	}
+	if _, ok := weekdays[words[0]]; ok {
+		day, _ := parseDay(words[0], today)
+		return atClock(day, words, 1)
+	}
+	return time.Time{}, 0, nil
+}
+
+// atClock returns the time on the day given by "at <time>" after the first n words, or the
+// default hour if there isn't one.
+func atClock(day time.Time, words []string, n int) (time.Time, int, error) {
+	if len(words) > n && words[n] == "at" {
+		clock, err := parseClock(words[n+1:])
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		return day.Add(clock), n + 2, nil
+	}
+	return day.Add(defaultHour * time.Hour), n, nil
+}
+
+// parseDay parses a weekday, which is the next one after today, or a date like "2021-03-14".
+func parseDay(word string, today time.Time) (time.Time, error) {
+	if weekday, ok := weekdays[word]; ok {
+		days := (int(weekday)-int(today.Weekday())+6)%7 + 1
+		return today.AddDate(0, 0, days), nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", word, today.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Bad day '%s': use a weekday or a date like 2021-03-14", word)
+	}
+	return day, nil
+}
+
+// parseClock parses the time of day in the first word, like "15:30", "3pm" or "3:30pm", returning
+// how long after midnight it is.
+func parseClock(words []string) (time.Duration, error) {
+	if len(words) == 0 {
+		return 0, fmt.Errorf("At what time? Use e.g. 15:30 or 3:30pm")
+	}
+	for _, layout := range []string{"15:04", "3pm", "3:04pm"} {
+		if t, err := time.Parse(layout, words[0]); err == nil {
+			return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+		}
+	}
+	return 0, fmt.Errorf("Bad time '%s': use e.g. 15:30 or 3:30pm", words[0])
+}
+
+// parseDuration parses a duration at the start of the words, like "2h", "1h30m", "90 minutes",
+// "an hour", "half an hour" or "1 day and 3 hours", returning how many words it took up.
+func parseDuration(words []string) (time.Duration, int) {
+	var total time.Duration
+	n := 0
+	for i := 0; i < len(words); {
+		// "and" only belongs to the duration if more of it follows
+		if words[i] == "and" && n > 0 {
+			i++
+		}
+		if i >= len(words) {
+			break
+		}
+		d, m := parseDurationPart(words[i:])
+		if m == 0 {
+			break
+		}
+		total += d
+		i += m
+		n = i
+	}
+	return total, n
+}
+
+func parseDurationPart(words []string) (time.Duration, int) {
+	w := words[0]
+	if len(words) >= 3 && w == "half" && (words[1] == "an" || words[1] == "a") {
+		if unit, ok := units[words[2]]; ok {
+			return unit / 2, 3
+		}
+	}
+	if compactRegex.MatchString(w) {
+		var total time.Duration
+		for _, part := range compactPartRegex.FindAllStringSubmatch(w, -1) {
+			count, _ := strconv.ParseFloat(part[1], 64)
+			unit, ok := units[part[2]]
+			if !ok {
+				return 0, 0
+			}
+			total += time.Duration(count * float64(unit))
+		}
+		return total, 1
+	}
+	if len(words) < 2 {
+		return 0, 0
+	}
+	unit, ok := units[words[1]]
+	if !ok {
+		return 0, 0
+	}
+	if w == "a" || w == "an" {
+		return unit, 2
+	}
+	count, err := strconv.ParseFloat(w, 64)
+	if err != nil || count < 0 {
+		return 0, 0
+	}
+	return time.Duration(count * float64(unit)), 2
+}
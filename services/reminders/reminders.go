@@ -0,0 +1,392 @@
+// Package reminders implements a Service which reminds people of things at the time they ask for.
+package reminders
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Reminders service
+const ServiceType = "reminders"
+
+// How often the poller looks for due reminders at most. Reminders due sooner than this also get
+// a timer of their own, so that they are sent on time.
+const pollInterval = time.Hour
+
+const (
+	defaultMaxRemindersPerUser = 10
+	defaultMaxDays             = 365
+)
+
+// Commands and OnPoll both update the reminders, so they are only loaded and stored while holding
+// this, lest a reminder which is due be sent twice or a new one be lost.
+var remindersMutex sync.Mutex
+
+// Service contains the Config fields for the Reminders service.
+//
+// "!remind me in 2h to deploy" reminds the sender in the same room 2 hours later, mentioning them
+// so that they are notified. Reminders can also be set for a time, like "at 3pm", "tomorrow at
+// 9:30", "on friday" or "on 2021-03-14 at 18:00", which are in the configured timezone, or say
+// when last, like "!remind me to deploy in 2h".
+//
+// Reminders are kept in the service's state, so they survive Go-NEB being restarted. The poller
+// sends them in the background, late if Go-NEB was down when they were due.
+//
+// Example JSON request:
+//   {
+//       "timezone": "Europe/London",
+//       "max_reminders_per_user": 10,
+//       "max_days": 365
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The IANA timezone times of day are in, e.g. "America/New_York". Defaults to UTC.
+	Timezone string `json:"timezone"`
+	// Optional. How many reminders each user can have at once. Defaults to 10.
+	MaxRemindersPerUser int `json:"max_reminders_per_user"`
+	// Optional. How many days ahead reminders can be set. Defaults to 365.
+	MaxDays int `json:"max_days"`
+}
+
+// reminderState is every reminder which hasn't been sent yet. It is stored in the service state
+// under "reminders".
+type reminderState struct {
+	NextID    int        `json:"next_id"`
+	Reminders []reminder `json:"reminders"`
+}
+
+type reminder struct {
+	ID               int       `json:"id"`
+	RoomID           id.RoomID `json:"room_id"`
+	UserID           id.UserID `json:"user_id"`
+	Text             string    `json:"text"`
+	SetTimestampSecs int64     `json:"set_timestamp_secs"`
+	DueTimestampSecs int64     `json:"due_timestamp_secs"`
+}
+
+func (r *reminder) due() time.Time {
+	return time.Unix(r.DueTimestampSecs, 0)
+}
+
+// Commands supported:
+//    !remind me when [to] text
+// Sets a reminder, e.g. "!remind me in 2h to deploy" or "!remind me tomorrow at 9am to call Bob".
+//    !remind list
+// Responds with the sender's reminders in the room.
+//    !remind cancel ID
+// Cancels one of the sender's reminders.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"remind", "me"},
+			Arguments: []string{"when", "[to]", "text"},
+			Help:      "Set a reminder, e.g. !remind me in 2h to deploy",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdRemind(cli, roomID, userID, args, time.Now())
+			},
+		},
+		{
+			Path: []string{"remind", "list"},
+			Help: "Show your reminders in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdList(roomID, userID)
+			},
+		},
+		{
+			Path:      []string{"remind", "cancel"},
+			Arguments: []string{"ID"},
+			Help:      "Cancel one of your reminders",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdCancel(userID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdRemind(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	now = now.Truncate(time.Second)
+	due, text, err := parseReminder(args, now, loc)
+	if err != nil {
+		return nil, err
+	}
+	due = due.Truncate(time.Second)
+	if !due.After(now) {
+		return nil, fmt.Errorf("That's in the past")
+	}
+	if maxDays := s.maxDays(); due.After(now.AddDate(0, 0, maxDays)) {
+		return nil, fmt.Errorf("Reminders can be set at most %d days ahead", maxDays)
+	}
+
+	remindersMutex.Lock()
+	defer remindersMutex.Unlock()
+	state, err := s.loadReminders()
+	if err != nil {
+		return nil, err
+	}
+	count := 0
+	for _, r := range state.Reminders {
+		if r.UserID == userID {
+			count++
+		}
+	}
+	if count >= s.maxRemindersPerUser() {
+		return nil, fmt.Errorf("You already have %d reminders. Cancel one with !remind cancel ID", count)
+	}
+	state.NextID++
+	r := reminder{
+		ID:               state.NextID,
+		RoomID:           roomID,
+		UserID:           userID,
+		Text:             text,
+		SetTimestampSecs: now.Unix(),
+		DueTimestampSecs: due.Unix(),
+	}
+	state.Reminders = append(state.Reminders, r)
+	if err = s.storeReminders(state); err != nil {
+		return nil, err
+	}
+	// The poller might be asleep for up to pollInterval, so send reminders due before then without
+	// it. If Go-NEB is restarted first, the poller sends them instead.
+	if d := due.Sub(now); d < pollInterval {
+		time.AfterFunc(d, func() {
+			s.sendDue(cli, time.Now())
+		})
+	}
+
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body: fmt.Sprintf("⏰ Reminder %d set for %s (in %s): %s", r.ID, due.In(loc).Format("Mon 2 Jan 15:04 MST"),
+			formatDuration(due.Sub(now)), text),
+	}, nil
+}
+
+func (s *Service) cmdList(roomID id.RoomID, userID id.UserID) (interface{}, error) {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	remindersMutex.Lock()
+	state, err := s.loadReminders()
+	remindersMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var mine []reminder
+	for _, r := range state.Reminders {
+		if r.RoomID == roomID && r.UserID == userID {
+			mine = append(mine, r)
+		}
+	}
+	if len(mine) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "You have no reminders in this room",
+		}, nil
+	}
+	sort.Slice(mine, func(i, j int) bool { return mine[i].DueTimestampSecs < mine[j].DueTimestampSecs })
+	lines := []string{"Your reminders:"}
+	for _, r := range mine {
+		lines = append(lines, fmt.Sprintf("%d. %s – %s", r.ID, r.due().In(loc).Format("Mon 2 Jan 15:04 MST"), r.Text))
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    strings.Join(lines, "\n"),
+	}, nil
+}
+
+func (s *Service) cmdCancel(userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !remind cancel ID")
+	}
+	reminderID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return nil, fmt.Errorf("Bad reminder ID '%s'", args[0])
+	}
+
+	remindersMutex.Lock()
+	defer remindersMutex.Unlock()
+	state, err := s.loadReminders()
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range state.Reminders {
+		// Only the user who set a reminder can cancel it
+		if r.ID != reminderID || r.UserID != userID {
+			continue
+		}
+		state.Reminders = append(state.Reminders[:i], state.Reminders[i+1:]...)
+		if err = s.storeReminders(state); err != nil {
+			return nil, err
+		}
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("Cancelled reminder %d: %s", r.ID, r.Text),
+		}, nil
+	}
+	return nil, fmt.Errorf("You have no reminder %d", reminderID)
+}
+
+// OnPoll sends the reminders which are due, including any which were due while Go-NEB wasn't
+// running, and returns when the next one is due.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	now := time.Now()
+	next := s.sendDue(cli, now)
+	if next.IsZero() || next.After(now.Add(pollInterval)) {
+		return now.Add(pollInterval)
+	}
+	return next
+}
+
+// sendDue sends the reminders which are due, forgets them, and returns when the next reminder is
+// due, or the zero time if there are no more.
+func (s *Service) sendDue(cli types.MatrixClient, now time.Time) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	remindersMutex.Lock()
+	defer remindersMutex.Unlock()
+	state, err := s.loadReminders()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load reminders")
+		return time.Time{}
+	}
+
+	var due, pending []reminder
+	for _, r := range state.Reminders {
+		if now.Before(r.due()) {
+			pending = append(pending, r)
+		} else {
+			due = append(due, r)
+		}
+	}
+	if len(due) > 0 {
+		// Forget the reminders first, so that they can't be sent twice if storing fails
+		state.Reminders = pending
+		if err = s.storeReminders(state); err != nil {
+			logger.WithError(err).Error("Failed to store reminders")
+			return time.Time{}
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].DueTimestampSecs < due[j].DueTimestampSecs })
+	for _, r := range due {
+		if _, err := cli.SendMessageEvent(r.RoomID, mevt.EventMessage, reminderMessage(r, now)); err != nil {
+			logger.WithError(err).WithField("room_id", r.RoomID).Error("Failed to send reminder")
+		}
+	}
+
+	var next time.Time
+	for _, r := range pending {
+		if next.IsZero() || r.due().Before(next) {
+			next = r.due()
+		}
+	}
+	return next
+}
+
+// reminderMessage mentions the user who set the reminder, so that they are notified.
+func reminderMessage(r reminder, now time.Time) *mevt.MessageEventContent {
+	set := fmt.Sprintf(" (set %s ago)", formatDuration(now.Sub(time.Unix(r.SetTimestampSecs, 0))))
+	if lateness := now.Sub(r.due()); lateness >= time.Minute {
+		set += fmt.Sprintf(" – %s late, sorry!", formatDuration(lateness))
+	}
+	pill := fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, r.UserID, html.EscapeString(r.UserID.String()))
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgText,
+		Body:          fmt.Sprintf("⏰ %s: %s%s", r.UserID, r.Text, set),
+		Format:        mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf("⏰ %s: %s%s", pill, html.EscapeString(r.Text), html.EscapeString(set)),
+	}
+}
+
+// formatDuration returns the duration to the minute, e.g. "2d3h" or "45m", or in seconds if it is
+// shorter than a minute.
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	d = d.Round(time.Minute)
+	var parts []string
+	if days := d / (24 * time.Hour); days > 0 {
+		parts = append(parts, fmt.Sprintf("%dd", days))
+	}
+	if h := (d % (24 * time.Hour)) / time.Hour; h > 0 {
+		parts = append(parts, fmt.Sprintf("%dh", h))
+	}
+	if m := (d % time.Hour) / time.Minute; m > 0 {
+		parts = append(parts, fmt.Sprintf("%dm", m))
+	}
+	return strings.Join(parts, "")
+}
+
+func (s *Service) maxRemindersPerUser() int {
+	if s.MaxRemindersPerUser <= 0 {
+		return defaultMaxRemindersPerUser
+	}
+	return s.MaxRemindersPerUser
+}
+
+func (s *Service) maxDays() int {
+	if s.MaxDays <= 0 {
+		return defaultMaxDays
+	}
+	return s.MaxDays
+}
+
+func (s *Service) loadReminders() (*reminderState, error) {
+	var state reminderState
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "reminders")
+	if err == sql.ErrNoRows {
+		return &state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (s *Service) storeReminders(state *reminderState) error {
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "reminders", stateJSON)
+}
+
+// Register makes sure that the timezone and limits are valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("Bad timezone '%s': %s", s.Timezone, err)
+	}
+	if s.MaxRemindersPerUser < 0 || s.MaxDays < 0 {
+		return fmt.Errorf("max_reminders_per_user and max_days can't be negative")
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
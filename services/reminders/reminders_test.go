@@ -0,0 +1,149 @@
+package reminders
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestParseReminder(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Monday 15 March 2021, before the clocks go forward
+	now := time.Date(2021, 3, 15, 10, 0, 0, 0, time.UTC)
+	testCases := map[string]string{
+		"in 2h to deploy":                      "2021-03-15 12:00 deploy",
+		"in 1h30m stretch":                     "2021-03-15 11:30 stretch",
+		"in 1 day and 3 hours to check the CI": "2021-03-16 13:00 check the CI",
+		"in half an hour to stretch":           "2021-03-15 10:30 stretch",
+		"in an hour, 30 minutes to make tea":   "2021-03-15 11:30 make tea",
+		"at 3pm to call Bob":                   "2021-03-15 15:00 call Bob",
+		"at 9:30 to stand up":                  "2021-03-16 09:30 stand up",
+		"tomorrow to water the plants":         "2021-03-16 09:00 water the plants",
+		"tomorrow at 18:15 to go home":         "2021-03-16 18:15 go home",
+		"on friday at 5pm to send the news":    "2021-03-19 17:00 send the news",
+		"monday to plan the week":              "2021-03-22 09:00 plan the week",
+		"on 2021-04-01 to prank":               "2021-04-01 08:00 prank",
+		"to deploy in 2 hours":                 "2021-03-15 12:00 deploy",
+		"To Deploy the site IN 2H":             "2021-03-15 12:00 Deploy the site",
+	}
+	for input, want := range testCases {
+		due, text, err := parseReminder(strings.Fields(input), now, loc)
+		if err != nil {
+			t.Errorf("parseReminder(%s) failed: %s", input, err)
+			continue
+		}
+		if got := due.UTC().Format("2006-01-02 15:04") + " " + text; got != want {
+			t.Errorf("parseReminder(%s): got %s, want %s", input, got, want)
+		}
+	}
+
+	for _, input := range []string{
+		"in soon to deploy",
+		"at noon to eat",
+		"on someday to relax",
+		"in 2h",
+		"to check in with Bob",
+		"",
+	} {
+		if _, _, err := parseReminder(strings.Fields(input), now, loc); err == nil {
+			t.Errorf("Expected parseReminder(%s) to fail", input)
+		}
+	}
+}
+
+func TestReminders(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		roomID := strings.Split(strings.TrimPrefix(req.URL.Path, "/_matrix/client/r0/rooms/"), "/")[0]
+		sent = append(sent, roomID+" "+msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$reminder:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"max_reminders_per_user":2,"max_days":30}`))
+	if err != nil {
+		t.Fatal("Failed to create reminders service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register reminders service: ", err)
+	}
+	s := srv.(*Service)
+
+	body := func(res interface{}, err error) string {
+		if err != nil {
+			t.Fatalf("Command failed: %s", err)
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+	// Far enough ahead that the reminders don't get timers of their own
+	now := time.Date(2021, 3, 15, 10, 0, 0, 0, time.UTC)
+	set := func(userID string, args string) (interface{}, error) {
+		return s.cmdRemind(matrixCli, "!ops:hyrule", id.UserID("@"+userID+":hyrule"), strings.Fields(args), now)
+	}
+
+	if got := body(set("link", "in 2h to deploy")); got != "⏰ Reminder 1 set for Mon 15 Mar 12:00 UTC (in 2h): deploy" {
+		t.Errorf("Bad confirmation: %s", got)
+	}
+	body(set("link", "tomorrow at 8am to check the deploy"))
+	if _, err = set("link", "in 3h to relax"); err == nil {
+		t.Errorf("Expected a third reminder to be refused")
+	}
+	if _, err = set("zelda", "in 31 days to renew the domain"); err == nil {
+		t.Errorf("Expected a reminder beyond max_days to be refused")
+	}
+	body(set("zelda", "in 90 minutes to review"))
+
+	if got := body(s.cmdList("!ops:hyrule", "@link:hyrule")); got != "Your reminders:\n"+
+		"1. Mon 15 Mar 12:00 UTC – deploy\n"+
+		"2. Tue 16 Mar 08:00 UTC – check the deploy" {
+		t.Errorf("Bad list: %s", got)
+	}
+	if got := body(s.cmdList("!dev:hyrule", "@link:hyrule")); got != "You have no reminders in this room" {
+		t.Errorf("Bad list for another room: %s", got)
+	}
+	if _, err = s.cmdCancel("@zelda:hyrule", []string{"2"}); err == nil {
+		t.Errorf("Expected cancelling someone else's reminder to fail")
+	}
+	if got := body(s.cmdCancel("@link:hyrule", []string{"#2"})); got != "Cancelled reminder 2: check the deploy" {
+		t.Errorf("Bad cancel: %s", got)
+	}
+
+	// Reminders are only sent once, and late ones say so
+	next := s.sendDue(matrixCli, now.Add(time.Hour))
+	if !next.Equal(now.Add(90 * time.Minute)) {
+		t.Errorf("Bad next reminder: got %s", next)
+	}
+	s.sendDue(matrixCli, now.Add(125*time.Minute))
+	s.sendDue(matrixCli, now.Add(125*time.Minute))
+	want := []string{
+		"!ops:hyrule ⏰ @zelda:hyrule: review (set 2h5m ago) – 35m late, sorry!",
+		"!ops:hyrule ⏰ @link:hyrule: deploy (set 2h5m ago) – 5m late, sorry!",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad reminders sent: got %q, want %q", sent, want)
+	}
+}
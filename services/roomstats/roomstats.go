@@ -0,0 +1,535 @@
+// Package roomstats implements a Service which keeps statistics about how active rooms are.
+package roomstats
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Room Stats service
+const ServiceType = "roomstats"
+
+// How many days of activity are kept by default, and at most
+const (
+	defaultWindowDays = 30
+	maxWindowDays     = 90
+)
+
+// How many days the weekly digest covers
+const digestDays = 7
+
+// How many of the most active hours and posters are listed
+const (
+	topHours   = 3
+	topPosters = 5
+)
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// Messages from several rooms can arrive at once, and each one updates the stored activity.
+var activityMutex sync.Mutex
+
+// Service contains the Config fields for the Room Stats service.
+//
+// Rooms opt in to statistics by being configured here. The number of messages sent in the room
+// is counted by hour, and counts older than the window are thrown away. "!stats" summarises
+// them: messages per day, the busiest day, the most active hours of the day and, if the room
+// allows it, the members who post the most. Members can keep their name out of the statistics
+// of every room with "!stats hide", after which their messages are only counted anonymously.
+//
+// Rooms can also have a digest of the last 7 days' activity posted each week.
+//
+// Example JSON request:
+//   {
+//       "window_days": 30,
+//       "rooms": {
+//           "!team:localhost": {
+//               "timezone": "Europe/London",
+//               "show_posters": true,
+//               "digest_day": "monday",
+//               "digest_at": "09:00"
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. How many days of activity are kept. Defaults to 30, and can't be more than 90.
+	WindowDays int `json:"window_days"`
+	// The rooms to keep statistics for.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is the settings of a room.
+type RoomConfig struct {
+	// Optional. The IANA timezone which days and hours are counted in, e.g. "America/New_York".
+	// Defaults to UTC.
+	Timezone string `json:"timezone"`
+	// Optional. List the members who post the most. Defaults to false.
+	ShowPosters bool `json:"show_posters"`
+	// Optional. The day of the week to post the digest on, e.g. "friday". No digest is posted by
+	// default.
+	DigestDay string `json:"digest_day"`
+	// Optional. The time of day to post the digest at, as "15:04". Defaults to "09:00".
+	DigestAt string `json:"digest_at"`
+}
+
+func (r *RoomConfig) location() *time.Location {
+	if loc, err := time.LoadLocation(r.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+func (r *RoomConfig) digestAt() string {
+	if r.DigestAt == "" {
+		return "09:00"
+	}
+	return r.DigestAt
+}
+
+// check returns an error if the room is misconfigured.
+func (r *RoomConfig) check() error {
+	if _, err := time.LoadLocation(r.Timezone); err != nil {
+		return err
+	}
+	if _, err := time.Parse("15:04", r.digestAt()); err != nil {
+		return fmt.Errorf("Bad digest_at '%s': must be like 09:00", r.DigestAt)
+	}
+	if _, ok := weekdays[strings.ToLower(r.DigestDay)]; !ok && r.DigestDay != "" {
+		return fmt.Errorf("Bad digest_day '%s': must be a day of the week", r.DigestDay)
+	}
+	return nil
+}
+
+// hourCount is how many messages each member sent in a room in an hour. Messages from members
+// who have hidden themselves are counted under the empty user ID.
+type hourCount struct {
+	HourTimestampSecs int64             `json:"hour_ts"`
+	Senders           map[id.UserID]int `json:"senders"`
+}
+
+// Commands supported:
+//    !stats [days]
+// Responds with the activity in the room over the window, or the last few days of it.
+//    !stats hide
+// Stops naming the sender in the statistics of every room.
+//    !stats show
+// Names the sender in the statistics again, from now on.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"stats"},
+			Arguments: []string{"[days]"},
+			Help:      "Show how active this room has been",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdStats(roomID, args, time.Now())
+			},
+		},
+		{
+			Path: []string{"stats", "hide"},
+			Help: "Keep your name out of room statistics",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdHide(userID, true)
+			},
+		},
+		{
+			Path: []string{"stats", "show"},
+			Help: "Allow your name in room statistics",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdHide(userID, false)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdStats(roomID id.RoomID, args []string, now time.Time) (interface{}, error) {
+	room, ok := s.Rooms[roomID]
+	if !ok {
+		return nil, fmt.Errorf("Statistics aren't kept for this room")
+	}
+	days := s.windowDays()
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 || len(args) > 1 {
+			return nil, fmt.Errorf("Usage: !stats [days]")
+		}
+		if n > days {
+			return nil, fmt.Errorf("Only the last %d days are kept", days)
+		}
+		days = n
+	}
+	hours, err := s.loadActivity(roomID)
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := s.loadHidden()
+	if err != nil {
+		return nil, err
+	}
+	heading := fmt.Sprintf("📊 Activity in the last %d days:", days)
+	if days == 1 {
+		heading = "📊 Activity in the last day:"
+	}
+	return notice(summarise(heading, hours, days, now, &room, hidden)), nil
+}
+
+func (s *Service) cmdHide(userID id.UserID, hide bool) (interface{}, error) {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+	hidden, err := s.loadHidden()
+	if err != nil {
+		return nil, err
+	}
+	if !hide {
+		delete(hidden, userID)
+		if err = s.storeHidden(hidden); err != nil {
+			return nil, err
+		}
+		return notice(fmt.Sprintf("%s will be named in room statistics from now on", userID)), nil
+	}
+
+	hidden[userID] = true
+	if err = s.storeHidden(hidden); err != nil {
+		return nil, err
+	}
+	// Anonymise what has already been counted, as well as what will be
+	for roomID := range s.Rooms {
+		hours, err := s.loadActivity(roomID)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hours {
+			if n, ok := h.Senders[userID]; ok {
+				h.Senders[""] += n
+				delete(h.Senders, userID)
+			}
+		}
+		if err = s.storeActivity(roomID, hours); err != nil {
+			return nil, err
+		}
+	}
+	return notice(fmt.Sprintf("%s won't be named in room statistics", userID)), nil
+}
+
+// OnMessage counts the messages sent in the configured rooms. Notices, which are sent by bots,
+// and edits aren't counted.
+func (s *Service) OnMessage(cli types.MatrixClient, evt *mevt.Event) {
+	if evt.Type != mevt.EventMessage {
+		return
+	}
+	if _, ok := s.Rooms[evt.RoomID]; !ok {
+		return
+	}
+	if msgType, _ := evt.Content.Raw["msgtype"].(string); msgType == string(mevt.MsgNotice) {
+		return
+	}
+	if rel, ok := evt.Content.Raw["m.relates_to"].(map[string]interface{}); ok && rel["rel_type"] == "m.replace" {
+		return
+	}
+	ts := time.Now()
+	if evt.Timestamp > 0 {
+		ts = time.Unix(0, evt.Timestamp*int64(time.Millisecond))
+	}
+	if err := s.record(evt.RoomID, evt.Sender, ts); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    evt.RoomID,
+			"service_id": s.ServiceID(),
+		}).Error("Failed to record room activity")
+	}
+}
+
+// record counts a message sent in the room at the time, and forgets counts which have left the
+// window.
+func (s *Service) record(roomID id.RoomID, sender id.UserID, ts time.Time) error {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+	hidden, err := s.loadHidden()
+	if err != nil {
+		return err
+	}
+	if hidden[sender] {
+		sender = ""
+	}
+	hours, err := s.loadActivity(roomID)
+	if err != nil {
+		return err
+	}
+
+	hour := ts.Truncate(time.Hour).Unix()
+	cutoff := ts.AddDate(0, 0, -s.windowDays()).Unix()
+	var kept []hourCount
+	found := false
+	for _, h := range hours {
+		if h.HourTimestampSecs < cutoff {
+			continue
+		}
+		if h.HourTimestampSecs == hour {
+			h.Senders[sender]++
+			found = true
+		}
+		kept = append(kept, h)
+	}
+	if !found {
+		kept = append(kept, hourCount{hour, map[id.UserID]int{sender: 1}})
+		sort.Slice(kept, func(i, j int) bool { return kept[i].HourTimestampSecs < kept[j].HourTimestampSecs })
+	}
+	return s.storeActivity(roomID, kept)
+}
+
+// summarise describes the activity in the last few days before now.
+func summarise(heading string, hours []hourCount, days int, now time.Time, room *RoomConfig, hidden map[id.UserID]bool) string {
+	loc := room.location()
+	since := now.AddDate(0, 0, -days).Truncate(time.Hour)
+	total := 0
+	perDay := make(map[string]int)
+	perHour := make(map[int]int)
+	perSender := make(map[id.UserID]int)
+	for _, h := range hours {
+		t := time.Unix(h.HourTimestampSecs, 0).In(loc)
+		if t.Before(since) || t.After(now) {
+			continue
+		}
+		for sender, n := range h.Senders {
+			total += n
+			perDay[t.Format("2006-01-02")] += n
+			perHour[t.Hour()] += n
+			if sender != "" && !hidden[sender] {
+				perSender[sender] += n
+			}
+		}
+	}
+	if total == 0 {
+		return heading + "\nNo messages"
+	}
+
+	lines := []string{
+		heading,
+		fmt.Sprintf("%d messages, %.1f a day", total, float64(total)/float64(days)),
+	}
+	busiest := ""
+	for day, n := range perDay {
+		if n > perDay[busiest] || (n == perDay[busiest] && day > busiest) {
+			busiest = day
+		}
+	}
+	busiestDay, _ := time.ParseInLocation("2006-01-02", busiest, loc)
+	lines = append(lines, fmt.Sprintf("Busiest day: %s (%s)", busiestDay.Format("Mon 2 Jan"), plural(perDay[busiest], "message")))
+
+	var hourList []int
+	for hour := range perHour {
+		hourList = append(hourList, hour)
+	}
+	sort.Slice(hourList, func(i, j int) bool {
+		if perHour[hourList[i]] != perHour[hourList[j]] {
+			return perHour[hourList[i]] > perHour[hourList[j]]
+		}
+		return hourList[i] < hourList[j]
+	})
+	var hourTexts []string
+	for i := 0; i < len(hourList) && i < topHours; i++ {
+		hourTexts = append(hourTexts, fmt.Sprintf("%02d:00 (%d)", hourList[i], perHour[hourList[i]]))
+	}
+	lines = append(lines, fmt.Sprintf("Most active hours (%s): %s", loc, strings.Join(hourTexts, ", ")))
+
+	if room.ShowPosters && len(perSender) > 0 {
+		var senders []id.UserID
+		for sender := range perSender {
+			senders = append(senders, sender)
+		}
+		sort.Slice(senders, func(i, j int) bool {
+			if perSender[senders[i]] != perSender[senders[j]] {
+				return perSender[senders[i]] > perSender[senders[j]]
+			}
+			return senders[i] < senders[j]
+		})
+		var senderTexts []string
+		for i := 0; i < len(senders) && i < topPosters; i++ {
+			senderTexts = append(senderTexts, fmt.Sprintf("%s (%d)", senders[i], perSender[senders[i]]))
+		}
+		lines = append(lines, "Top posters: "+strings.Join(senderTexts, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// OnPoll posts the weekly digests of the rooms whose time to post has come. It returns when the
+// next room's time to post comes.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	return s.post(cli, time.Now())
+}
+
+func (s *Service) post(cli types.MatrixClient, now time.Time) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	next := now.Add(24 * time.Hour)
+	posted, err := s.loadPosted()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load when digests were posted")
+		return next
+	}
+	hidden, err := s.loadHidden()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load hidden members")
+		return next
+	}
+
+	for roomID, room := range s.Rooms {
+		weekday, ok := weekdays[strings.ToLower(room.DigestDay)]
+		if !ok {
+			continue
+		}
+		local := now.In(room.location())
+		at, _ := time.Parse("15:04", room.digestAt())
+		postAt := time.Date(local.Year(), local.Month(), local.Day(), at.Hour(), at.Minute(), 0, 0, local.Location())
+		if now.Before(postAt) {
+			if postAt.Before(next) {
+				next = postAt
+			}
+			continue
+		}
+		if tomorrow := postAt.AddDate(0, 0, 1); tomorrow.Before(next) {
+			next = tomorrow
+		}
+		date := local.Format("2006-01-02")
+		if local.Weekday() != weekday || posted[roomID.String()] == date {
+			continue
+		}
+
+		hours, err := s.loadActivity(roomID)
+		if err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to load room activity")
+			continue
+		}
+		msg := notice(summarise("📊 Activity this week:", hours, digestDays, now, &room, hidden))
+		if _, err := cli.SendMessageEvent(roomID, mevt.EventMessage, msg); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to post digest")
+			continue
+		}
+		posted[roomID.String()] = date
+	}
+
+	if err = s.storePosted(posted); err != nil {
+		logger.WithError(err).Error("Failed to store when digests were posted")
+	}
+	return next
+}
+
+func (s *Service) windowDays() int {
+	if s.WindowDays <= 0 {
+		return defaultWindowDays
+	}
+	if s.WindowDays > maxWindowDays {
+		return maxWindowDays
+	}
+	return s.WindowDays
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+func (s *Service) loadActivity(roomID id.RoomID) ([]hourCount, error) {
+	var hours []hourCount
+	err := s.loadState("activity "+roomID.String(), &hours)
+	return hours, err
+}
+
+func (s *Service) storeActivity(roomID id.RoomID, hours []hourCount) error {
+	return s.storeState("activity "+roomID.String(), hours)
+}
+
+func (s *Service) loadHidden() (map[id.UserID]bool, error) {
+	hidden := make(map[id.UserID]bool)
+	return hidden, s.loadState("hidden", &hidden)
+}
+
+func (s *Service) storeHidden(hidden map[id.UserID]bool) error {
+	return s.storeState("hidden", hidden)
+}
+
+// loadPosted returns the local date each room's digest was last posted on.
+func (s *Service) loadPosted() (map[string]string, error) {
+	posted := make(map[string]string)
+	return posted, s.loadState("posted", &posted)
+}
+
+func (s *Service) storePosted(posted map[string]string) error {
+	return s.storeState("posted", posted)
+}
+
+// loadState unmarshals the state into v, leaving v alone if there isn't any.
+func (s *Service) loadState(key string, v interface{}) error {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), key)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(stateJSON, v)
+}
+
+func (s *Service) storeState(key string, v interface{}) error {
+	stateJSON, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), key, stateJSON)
+}
+
+// Register makes sure that the rooms are configured properly, and joins them.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	for roomID, room := range s.Rooms {
+		if err := room.check(); err != nil {
+			return fmt.Errorf("Room %s: %s", roomID, err)
+		}
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package roomstats
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func message(roomID id.RoomID, sender id.UserID, ts time.Time, content map[string]interface{}) *mevt.Event {
+	return &mevt.Event{
+		Type:      mevt.EventMessage,
+		RoomID:    roomID,
+		Sender:    sender,
+		Timestamp: ts.UnixNano() / int64(time.Millisecond),
+		Content:   mevt.Content{Raw: content},
+	}
+}
+
+func TestRoomStats(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$stats:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"window_days": 14,
+		"rooms": {
+			"!team:hyrule": {"show_posters": true, "digest_day": "monday"},
+			"!quiet:hyrule": {}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create room stats service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register room stats service: ", err)
+	}
+	s := srv.(*Service)
+
+	// Monday 15 March 2021
+	now := time.Date(2021, 3, 15, 12, 0, 0, 0, time.UTC)
+	text := map[string]interface{}{"msgtype": "m.text", "body": "hello"}
+	for _, m := range []struct {
+		sender id.UserID
+		ago    time.Duration
+	}{
+		{"@alice:hyrule", 30 * 24 * time.Hour}, // Outside the window
+		{"@alice:hyrule", 2 * time.Hour},
+		{"@alice:hyrule", 2 * time.Hour},
+		{"@alice:hyrule", 26 * time.Hour},
+		{"@bob:hyrule", 26 * time.Hour},
+		{"@bob:hyrule", 3 * 24 * time.Hour},
+	} {
+		s.OnMessage(matrixCli, message("!team:hyrule", m.sender, now.Add(-m.ago), text))
+	}
+	// Notices, edits, unconfigured rooms and other events aren't counted
+	s.OnMessage(matrixCli, message("!team:hyrule", "@bot:hyrule", now, map[string]interface{}{"msgtype": "m.notice", "body": "beep"}))
+	s.OnMessage(matrixCli, message("!team:hyrule", "@bob:hyrule", now, map[string]interface{}{
+		"msgtype": "m.text", "body": "* hi", "m.relates_to": map[string]interface{}{"rel_type": "m.replace", "event_id": "$old"},
+	}))
+	s.OnMessage(matrixCli, message("!other:hyrule", "@bob:hyrule", now, text))
+	reaction := message("!team:hyrule", "@bob:hyrule", now, nil)
+	reaction.Type = mevt.EventReaction
+	s.OnMessage(matrixCli, reaction)
+
+	body := func(res interface{}, err error) string {
+		if err != nil {
+			t.Fatalf("Command failed: %s", err)
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+	want := "📊 Activity in the last 14 days:\n" +
+		"5 messages, 0.4 a day\n" +
+		"Busiest day: Mon 15 Mar (2 messages)\n" +
+		"Most active hours (UTC): 10:00 (4), 12:00 (1)\n" +
+		"Top posters: @alice:hyrule (3), @bob:hyrule (2)"
+	if got := body(s.cmdStats("!team:hyrule", nil, now)); got != want {
+		t.Errorf("Bad stats: got %q want %q", got, want)
+	}
+	if got := body(s.cmdStats("!quiet:hyrule", nil, now)); got != "📊 Activity in the last 14 days:\nNo messages" {
+		t.Errorf("Bad stats for a quiet room: %q", got)
+	}
+	if _, err = s.cmdStats("!other:hyrule", nil, now); err == nil {
+		t.Errorf("Expected stats for an unconfigured room to be refused")
+	}
+	if _, err = s.cmdStats("!team:hyrule", []string{"15"}, now); err == nil {
+		t.Errorf("Expected stats beyond the window to be refused")
+	}
+
+	// Hidden members are only counted anonymously
+	body(s.cmdHide("@alice:hyrule", true))
+	s.OnMessage(matrixCli, message("!team:hyrule", "@alice:hyrule", now.Add(-time.Hour), text))
+	if got := body(s.cmdStats("!team:hyrule", []string{"1"}, now)); !strings.HasSuffix(got, "3 messages, 3.0 a day\n"+
+		"Busiest day: Mon 15 Mar (3 messages)\nMost active hours (UTC): 10:00 (2), 11:00 (1)") {
+		t.Errorf("Bad stats with a hidden member: %q", got)
+	}
+	if got := body(s.cmdStats("!team:hyrule", nil, now)); !strings.HasSuffix(got, "Top posters: @bob:hyrule (2)") {
+		t.Errorf("Hidden member was named: %q", got)
+	}
+
+	// The digest is posted once, on the digest day, to the rooms which want it
+	if next := s.post(matrixCli, now.Add(-4*time.Hour)); !next.Equal(time.Date(2021, 3, 15, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("Bad next digest time: %s", next)
+	}
+	s.post(matrixCli, now)
+	s.post(matrixCli, now.Add(time.Hour))
+	if len(sent) != 1 || !strings.HasPrefix(sent[0], "📊 Activity this week:\n6 messages, 0.9 a day\n") {
+		t.Errorf("Bad digests: %q", sent)
+	}
+}
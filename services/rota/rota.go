@@ -0,0 +1,467 @@
+// Package rota implements a Service which rotates recurring duties among people.
+package rota
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Rota service
+const ServiceType = "rota"
+
+// Commands such as !rota swap and OnPoll both update the rotas, so they are only loaded and
+// stored while holding this.
+var rotasMutex sync.Mutex
+
+// Service contains the Config fields for the Rota service.
+//
+// Each rota hands a recurring duty, like being release manager or taking out the bins, to the
+// next of its members on a schedule, and announces it in the rota's room:
+//    This week's release manager is @alice:localhost
+// People can check who is on duty with "!rota", pass the duty on to the next member with
+// "!rota skip", or swap turns with another member with "!rota swap @bob:localhost". Swapping
+// changes the order the rota goes round in from then on. Where the rota has got to is kept
+// across restarts and changes to the config.
+//
+// Members can be Matrix user IDs, who are mentioned when it is their turn, or any other name.
+//
+// Example JSON request:
+//   {
+//       "rotas": {
+//           "release": {
+//               "room_id": "!team:localhost",
+//               "duty": "release manager",
+//               "members": ["@alice:localhost", "@bob:localhost", "Carol"],
+//               "start": "2021-06-07T09:00:00Z",
+//               "every": "168h"
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// A map from the name of each rota to its config. The names are used in commands.
+	Rotas map[string]Rota `json:"rotas"`
+}
+
+// Rota is a duty which people take turns at.
+type Rota struct {
+	// The room to announce whose turn it is in, and in which the rota's commands are run.
+	RoomID id.RoomID `json:"room_id"`
+	// Optional. What the duty is called in announcements. Defaults to the rota's name.
+	Duty string `json:"duty"`
+	// The people who take turns, in order.
+	Members []string `json:"members"`
+	// When the first turn starts.
+	Start time.Time `json:"start"`
+	// Optional. How long each turn lasts, e.g. "24h". Defaults to a week.
+	Every string `json:"every"`
+}
+
+// position is where a rota has got to. It is stored in the service state under "rota" and the
+// rota's name.
+type position struct {
+	// The members in the order they take turns, which swaps change
+	Order []string `json:"order"`
+	// Whose turn it is, as an index into Order
+	Index int `json:"index"`
+	// The number of the turn which was last handed over, counting from Start, or -1 if none has
+	Turn int64 `json:"turn"`
+}
+
+// current returns whose turn it is.
+func (p *position) current() string {
+	return p.Order[p.Index]
+}
+
+// next returns whose turn is next.
+func (p *position) next() string {
+	return p.Order[(p.Index+1)%len(p.Order)]
+}
+
+// reconcile updates the order after the members have been changed in the config. Members who have
+// been removed are dropped and new members join the end, keeping whose turn it is if they are
+// still a member.
+func (p *position) reconcile(members []string) {
+	isMember := make(map[string]bool, len(members))
+	for _, m := range members {
+		isMember[m] = true
+	}
+	var order []string
+	inOrder := make(map[string]bool, len(members))
+	index := p.Index
+	for i, m := range p.Order {
+		if !isMember[m] {
+			if i < p.Index {
+				index--
+			}
+			continue
+		}
+		order = append(order, m)
+		inOrder[m] = true
+	}
+	for _, m := range members {
+		if !inOrder[m] {
+			order = append(order, m)
+		}
+	}
+	p.Order = order
+	if index < 0 || index >= len(order) {
+		index = 0
+	}
+	p.Index = index
+}
+
+func (r *Rota) every() (time.Duration, error) {
+	if r.Every == "" {
+		return 7 * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(r.Every)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Hour {
+		return 0, fmt.Errorf("Turns must be at least an hour long, not %s", d)
+	}
+	return d, nil
+}
+
+// turn returns the number of the turn which is happening now, counting from Start, and when it
+// ends. The turn is -1 before the rota starts.
+func (r *Rota) turn(now time.Time) (int64, time.Time) {
+	every, err := r.every()
+	if err != nil {
+		return -1, time.Time{}
+	}
+	if now.Before(r.Start) {
+		return -1, r.Start
+	}
+	turn := int64(now.Sub(r.Start) / every)
+	return turn, r.Start.Add(time.Duration(turn+1) * every)
+}
+
+// duty returns the name of the rota's duty.
+func (r *Rota) duty(name string) string {
+	if r.Duty == "" {
+		return name
+	}
+	return r.Duty
+}
+
+// Commands supported:
+//    !rota [name]
+// Responds with whose turn it is.
+//    !rota skip [name]
+// Passes the duty on to the next member.
+//    !rota swap [name] member
+// Swaps turns between whoever is on duty and the member.
+// The rota's name can be left out when the room has one rota.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"rota"},
+			Arguments: []string{"[name]"},
+			Help:      "Show whose turn it is",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdShow(roomID, args, time.Now())
+			},
+		},
+		{
+			Path:      []string{"rota", "skip"},
+			Arguments: []string{"[name]"},
+			Help:      "Pass the duty on to the next person",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSkip(roomID, userID, args, time.Now())
+			},
+		},
+		{
+			Path:      []string{"rota", "swap"},
+			Arguments: []string{"[name]", "member"},
+			Help:      "Swap turns with someone else",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSwap(roomID, userID, args, time.Now())
+			},
+		},
+	}
+}
+
+// rotaFor returns the name of the rota which the command arguments are about, and the rest of the
+// arguments.
+func (s *Service) rotaFor(roomID id.RoomID, args []string) (string, []string, error) {
+	if len(args) > 0 {
+		if r, ok := s.Rotas[args[0]]; ok && r.RoomID == roomID {
+			return args[0], args[1:], nil
+		}
+	}
+	var names []string
+	for name, r := range s.Rotas {
+		if r.RoomID == roomID {
+			names = append(names, name)
+		}
+	}
+	switch len(names) {
+	case 0:
+		return "", nil, fmt.Errorf("This room has no rotas")
+	case 1:
+		return names[0], args, nil
+	}
+	return "", nil, fmt.Errorf("This room has several rotas, so say which: %s", strings.Join(names, ", "))
+}
+
+func (s *Service) cmdShow(roomID id.RoomID, args []string, now time.Time) (interface{}, error) {
+	name, args, err := s.rotaFor(roomID, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 0 {
+		return nil, fmt.Errorf("Usage: !rota [name]")
+	}
+	r := s.Rotas[name]
+	rotasMutex.Lock()
+	defer rotasMutex.Unlock()
+	p, err := s.loadPosition(name, &r, now)
+	if err != nil {
+		return nil, err
+	}
+	turn, ends := r.turn(now)
+	if turn < 0 {
+		return notice(fmt.Sprintf("The %s rota starts at %s with %s", r.duty(name), formatTime(ends), p.current())), nil
+	}
+	return notice(fmt.Sprintf("%s is %s until %s, then %s", p.current(), r.duty(name), formatTime(ends), p.next())), nil
+}
+
+func (s *Service) cmdSkip(roomID id.RoomID, userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	name, args, err := s.rotaFor(roomID, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 0 {
+		return nil, fmt.Errorf("Usage: !rota skip [name]")
+	}
+	r := s.Rotas[name]
+	rotasMutex.Lock()
+	defer rotasMutex.Unlock()
+	p, err := s.loadPosition(name, &r, now)
+	if err != nil {
+		return nil, err
+	}
+	skipped := p.current()
+	p.Index = (p.Index + 1) % len(p.Order)
+	if err = s.storePosition(name, p); err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"rota":       name,
+		"user_id":    userID,
+	}).Info("Skipped rota turn")
+	return announcement(fmt.Sprintf("%s skipped %s's turn, so ", userID, skipped), p.current(), " is now "+r.duty(name)), nil
+}
+
+func (s *Service) cmdSwap(roomID id.RoomID, userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	name, args, err := s.rotaFor(roomID, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !rota swap [name] member")
+	}
+	r := s.Rotas[name]
+	rotasMutex.Lock()
+	defer rotasMutex.Unlock()
+	p, err := s.loadPosition(name, &r, now)
+	if err != nil {
+		return nil, err
+	}
+	other := -1
+	for i, m := range p.Order {
+		if m == args[0] {
+			other = i
+		}
+	}
+	if other < 0 {
+		return nil, fmt.Errorf("%s isn't on the %s rota", args[0], r.duty(name))
+	}
+	if other == p.Index {
+		return nil, fmt.Errorf("It is already %s's turn", args[0])
+	}
+	swapped := p.current()
+	p.Order[p.Index], p.Order[other] = p.Order[other], p.Order[p.Index]
+	if err = s.storePosition(name, p); err != nil {
+		return nil, err
+	}
+	return announcement(fmt.Sprintf("%s swapped turns with %s, so ", swapped, args[0]), p.current(), " is now "+r.duty(name)), nil
+}
+
+// OnPoll hands each rota's duty to the next member when their turn starts, and returns when the
+// next turn starts.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	return s.handOver(cli, time.Now())
+}
+
+func (s *Service) handOver(cli types.MatrixClient, now time.Time) time.Time {
+	rotasMutex.Lock()
+	defer rotasMutex.Unlock()
+	next := now.Add(24 * time.Hour)
+	for name, r := range s.Rotas {
+		logger := log.WithFields(log.Fields{
+			"service_id": s.ServiceID(),
+			"rota":       name,
+			"room_id":    r.RoomID,
+		})
+		turn, ends := r.turn(now)
+		if !ends.IsZero() && ends.Before(next) {
+			next = ends
+		}
+		if turn < 0 {
+			continue
+		}
+		p, err := s.loadPosition(name, &r, now)
+		if err != nil {
+			logger.WithError(err).Error("Failed to load rota position")
+			continue
+		}
+		if turn <= p.Turn {
+			continue
+		}
+		if p.Turn >= 0 {
+			p.Index = int((int64(p.Index) + turn - p.Turn) % int64(len(p.Order)))
+		}
+		p.Turn = turn
+		if err = s.storePosition(name, p); err != nil {
+			logger.WithError(err).Error("Failed to store rota position")
+			continue
+		}
+		every, _ := r.every()
+		if _, err = cli.SendMessageEvent(r.RoomID, mevt.EventMessage, announcement(turnName(every, r.duty(name))+" is ", p.current(), "")); err != nil {
+			logger.WithError(err).Error("Failed to announce rota turn")
+		}
+	}
+	return next
+}
+
+// turnName returns what a turn at the duty is called in announcements, e.g. "This week's release
+// manager".
+func turnName(every time.Duration, duty string) string {
+	switch every {
+	case 24 * time.Hour:
+		return "Today's " + duty
+	case 7 * 24 * time.Hour:
+		return "This week's " + duty
+	}
+	return "The " + duty
+}
+
+// announcement says who is now on duty, mentioning them if they are a Matrix user, e.g.
+// "This week's release manager is @alice:localhost".
+func announcement(before, member, after string) *mevt.MessageEventContent {
+	memberHTML := html.EscapeString(member)
+	if strings.HasPrefix(member, "@") {
+		memberHTML = fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, memberHTML, memberHTML)
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgText,
+		Body:          before + member + after,
+		Format:        mevt.FormatHTML,
+		FormattedBody: html.EscapeString(before) + memberHTML + html.EscapeString(after),
+	}
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("Mon 2 Jan 15:04 MST")
+}
+
+// loadPosition returns where the rota has got to. Rotas which haven't been handed over yet start
+// with the member whose turn it would be if nobody had skipped or swapped.
+func (s *Service) loadPosition(name string, r *Rota, now time.Time) (*position, error) {
+	p := &position{}
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "rota "+name)
+	if err == sql.ErrNoRows {
+		p.Order = append([]string(nil), r.Members...)
+		p.Turn = -1
+		if turn, _ := r.turn(now); turn > 0 {
+			p.Index = int(turn % int64(len(r.Members)))
+		}
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, p); err != nil {
+		return nil, err
+	}
+	p.reconcile(r.Members)
+	return p, nil
+}
+
+func (s *Service) storePosition(name string, p *position) error {
+	stateJSON, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "rota "+name, stateJSON)
+}
+
+// Register makes sure the rotas are configured properly, and joins their rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Rotas) == 0 {
+		return fmt.Errorf("At least one rota is required")
+	}
+	for name, r := range s.Rotas {
+		if name == "" || strings.ContainsAny(name, " \t\n") || name == "skip" || name == "swap" {
+			return fmt.Errorf("Rota name '%s' must be a single word other than skip and swap", name)
+		}
+		if r.RoomID == "" {
+			return fmt.Errorf("Rota '%s' needs a room_id", name)
+		}
+		if len(r.Members) == 0 {
+			return fmt.Errorf("Rota '%s' needs at least one member", name)
+		}
+		seen := make(map[string]bool)
+		for _, m := range r.Members {
+			if seen[m] {
+				return fmt.Errorf("%s is a member of rota '%s' twice", m, name)
+			}
+			seen[m] = true
+		}
+		if r.Start.IsZero() {
+			return fmt.Errorf("Rota '%s' needs a start time", name)
+		}
+		if _, err := r.every(); err != nil {
+			return fmt.Errorf("Bad every for rota '%s': %s", name, err)
+		}
+	}
+	for _, r := range s.Rotas {
+		if _, err := client.JoinRoom(r.RoomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    r.RoomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package rota
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestRota(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.String(), "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, fmt.Sprintf("%s %s", room, msg.Body))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"rotas": {
+			"guard": {
+				"room_id": "!castle:hyrule",
+				"duty": "castle guard",
+				"members": ["@link:hyrule", "@impa:hyrule", "Darunia"],
+				"start": "2021-06-07T09:00:00Z"
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create rota service: ", err)
+	}
+	s := srv.(*Service)
+	start := time.Date(2021, 6, 7, 9, 0, 0, 0, time.UTC)
+	week := 7 * 24 * time.Hour
+
+	show := func(now time.Time) string {
+		res, err := s.cmdShow("!castle:hyrule", nil, now)
+		if err != nil {
+			t.Fatal("Failed to show rota: ", err)
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+
+	// Nothing is announced before the rota starts
+	if next := s.handOver(matrixCli, start.Add(-time.Hour)); !next.Equal(start) {
+		t.Errorf("Bad next poll before the rota starts: got %s, want %s", next, start)
+	}
+	if got := show(start.Add(-time.Hour)); got != "The castle guard rota starts at Mon 7 Jun 09:00 UTC with @link:hyrule" {
+		t.Errorf("Bad rota before it starts: %q", got)
+	}
+	s.handOver(matrixCli, start)
+	s.handOver(matrixCli, start.Add(time.Hour))
+	s.handOver(matrixCli, start.Add(week))
+	if got := show(start.Add(week)); got != "@impa:hyrule is castle guard until Mon 21 Jun 09:00 UTC, then Darunia" {
+		t.Errorf("Bad rota in the second week: %q", got)
+	}
+
+	res, err := s.cmdSkip("!castle:hyrule", "@zelda:hyrule", nil, start.Add(week))
+	if err != nil {
+		t.Fatal("Failed to skip turn: ", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "@zelda:hyrule skipped @impa:hyrule's turn, so Darunia is now castle guard" {
+		t.Errorf("Bad skip response: %q", got)
+	}
+	res, err = s.cmdSwap("!castle:hyrule", "@zelda:hyrule", []string{"guard", "@link:hyrule"}, start.Add(week))
+	if err != nil {
+		t.Fatal("Failed to swap turns: ", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "Darunia swapped turns with @link:hyrule, so @link:hyrule is now castle guard" {
+		t.Errorf("Bad swap response: %q", got)
+	}
+	for _, args := range [][]string{{"@link:hyrule"}, {"@ganon:hyrule"}, {}} {
+		if _, err = s.cmdSwap("!castle:hyrule", "@zelda:hyrule", args, start.Add(week)); err == nil {
+			t.Errorf("Expected swap with %v to fail", args)
+		}
+	}
+	if _, err = s.cmdShow("!termina:hyrule", nil, start); err == nil {
+		t.Error("Expected a room without rotas to be refused")
+	}
+
+	// Darunia has swapped into Link's place in the order, which comes next
+	s.handOver(matrixCli, start.Add(2*week))
+
+	// The position is kept when the members change
+	s.Rotas["guard"] = Rota{
+		RoomID:  "!castle:hyrule",
+		Duty:    "castle guard",
+		Members: []string{"@impa:hyrule", "@link:hyrule", "@zelda:hyrule"},
+		Start:   start,
+	}
+	if got := show(start.Add(2 * week)); got != "@impa:hyrule is castle guard until Mon 28 Jun 09:00 UTC, then @link:hyrule" {
+		t.Errorf("Bad rota after changing the members: %q", got)
+	}
+	s.handOver(matrixCli, start.Add(3*week))
+
+	want := []string{
+		"!castle:hyrule This week's castle guard is @link:hyrule",
+		"!castle:hyrule This week's castle guard is @impa:hyrule",
+		"!castle:hyrule This week's castle guard is Darunia",
+		"!castle:hyrule This week's castle guard is @link:hyrule",
+	}
+	if strings.Join(sent, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Bad announcements:\ngot  %q\nwant %q", sent, want)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	for _, tc := range []struct {
+		order   []string
+		index   int
+		members []string
+		want    string
+	}{
+		{[]string{"a", "b", "c"}, 1, []string{"a", "b", "c", "d"}, "[a b c d] b"},
+		{[]string{"a", "b", "c"}, 1, []string{"b", "c"}, "[b c] b"},
+		{[]string{"a", "b", "c"}, 1, []string{"a", "c"}, "[a c] c"},
+		{[]string{"a", "b", "c"}, 2, []string{"a", "b"}, "[a b] a"},
+		{[]string{"c", "a", "b"}, 0, []string{"a", "b", "c"}, "[c a b] c"},
+	} {
+		p := &position{Order: tc.order, Index: tc.index}
+		p.reconcile(tc.members)
+		if got := fmt.Sprintf("%v %s", p.Order, p.current()); got != tc.want {
+			t.Errorf("reconcile(%v, %d, %v) => got %q, want %q", tc.order, tc.index, tc.members, got, tc.want)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"rotas": {"guard": {"members": ["Link"], "start": "2021-06-07T09:00:00Z"}}}`,
+		`{"rotas": {"guard": {"room_id": "!castle:hyrule", "start": "2021-06-07T09:00:00Z"}}}`,
+		`{"rotas": {"guard": {"room_id": "!castle:hyrule", "members": ["Link", "Link"], "start": "2021-06-07T09:00:00Z"}}}`,
+		`{"rotas": {"guard": {"room_id": "!castle:hyrule", "members": ["Link"]}}}`,
+		`{"rotas": {"guard": {"room_id": "!castle:hyrule", "members": ["Link"], "start": "2021-06-07T09:00:00Z", "every": "1m"}}}`,
+		`{"rotas": {"castle guard": {"room_id": "!castle:hyrule", "members": ["Link"], "start": "2021-06-07T09:00:00Z"}}}`,
+		`{"rotas": {"skip": {"room_id": "!castle:hyrule", "members": ["Link"], "start": "2021-06-07T09:00:00Z"}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create rota service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -14,7 +14,9 @@ import (
 	"github.com/die-net/lrucache"
 	"github.com/gregjones/httpcache"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
 	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/templates"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/mmcdole/gofeed"
 	"github.com/prometheus/client_golang/prometheus"
@@ -413,8 +415,14 @@ func (s *Service) sendToRooms(cli types.MatrixClient, feedURL string, feed *gofe
 		"guid":     item.GUID,
 	})
 	logger.Info("Sending new feed item")
+	// Operators can override the message with a template named "rssbot.item", which is given
+	// the feed and the item.
+	msg := templates.Render("rssbot.item", struct {
+		Feed *gofeed.Feed
+		Item gofeed.Item
+	}{feed, item}, itemToHTML(feed, item))
 	for _, roomID := range s.Feeds[feedURL].Rooms {
-		if _, err := cli.SendMessageEvent(roomID, mevt.EventMessage, itemToHTML(feed, item)); err != nil {
+		if _, err := notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: msg}); err != nil {
 			logger.WithError(err).WithField("room_id", roomID).Error("Failed to send to room")
 		}
 	}
@@ -0,0 +1,112 @@
+package s3events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// SNS subscription confirmations are only followed to Amazon SNS itself, so that a forged one
+// can't make Go-NEB request other URLs.
+var snsHostRegex = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// s3Event is the body of an S3 bucket notification. MinIO sends the same records, with
+// "EventName" and "Key" summarising them.
+type s3Event struct {
+	Records []record `json:"Records"`
+	// Set instead of the records by the test event S3 sends when notifications are configured
+	Event string `json:"Event"`
+}
+
+// record is one change to a bucket.
+type record struct {
+	EventName string `json:"eventName"`
+	EventTime string `json:"eventTime"`
+	// Who made the change, e.g. "AWS:AIDAEXAMPLE" or a MinIO access key
+	UserIdentity struct {
+		PrincipalID string `json:"principalId"`
+	} `json:"userIdentity"`
+	S3 struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			// URL-encoded, with spaces as "+"
+			Key  string `json:"key"`
+			Size int64  `json:"size"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// change is an upload or deletion, in the form the service posts it.
+type change struct {
+	// "created" or "removed"
+	Kind   string
+	Bucket string
+	Key    string
+	// The object's size in bytes, for uploads
+	Size int64
+	User string
+}
+
+// changes returns the uploads and deletions in the records. Other events, e.g. restores from
+// Glacier, are left out.
+func (e *s3Event) changes() ([]change, error) {
+	var changes []change
+	for _, r := range e.Records {
+		name := strings.TrimPrefix(r.EventName, "s3:")
+		var kind string
+		switch {
+		case strings.HasPrefix(name, "ObjectCreated:"):
+			kind = "created"
+		case strings.HasPrefix(name, "ObjectRemoved:"):
+			kind = "removed"
+		default:
+			continue
+		}
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Bad object key '%s': %s", r.S3.Object.Key, err)
+		}
+		if r.S3.Bucket.Name == "" || key == "" {
+			return nil, fmt.Errorf("Record has no bucket or key")
+		}
+		changes = append(changes, change{
+			Kind:   kind,
+			Bucket: r.S3.Bucket.Name,
+			Key:    key,
+			Size:   r.S3.Object.Size,
+			User:   r.UserIdentity.PrincipalID,
+		})
+	}
+	return changes, nil
+}
+
+// snsMessage is what Amazon SNS posts to HTTP subscriptions. Notifications have the S3 event as
+// a JSON string in "Message".
+type snsMessage struct {
+	Type         string `json:"Type"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+	TopicArn     string `json:"TopicArn"`
+}
+
+// subscribeURL returns the URL which confirms the subscription, if it is Amazon's.
+func (m *snsMessage) subscribeURL() (string, error) {
+	u, err := url.Parse(m.SubscribeURL)
+	if err != nil || u.Scheme != "https" || !snsHostRegex.MatchString(u.Hostname()) {
+		return "", fmt.Errorf("Bad SubscribeURL '%s'", m.SubscribeURL)
+	}
+	return u.String(), nil
+}
+
+// event returns the S3 event in the notification.
+func (m *snsMessage) event() (*s3Event, error) {
+	var e s3Event
+	if err := json.Unmarshal([]byte(m.Message), &e); err != nil {
+		return nil, fmt.Errorf("Bad S3 event in SNS message: %s", err)
+	}
+	return &e, nil
+}
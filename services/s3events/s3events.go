@@ -0,0 +1,280 @@
+// Package s3events implements a Service which posts uploads to and deletions from S3 and MinIO
+// buckets into rooms.
+package s3events
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the S3 events service
+const ServiceType = "s3events"
+
+const (
+	// The most a webhook's body can be
+	maxWebhookSize = 1 << 20
+	// How many changes are listed in a message, so that bulk uploads don't flood rooms
+	maxChangesPerMessage = 10
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Service contains the Config fields for the S3 events service.
+//
+// Amazon S3 bucket notifications are sent through an SNS topic, which is subscribed to the
+// sns_webhook_url with "&token=" and the token added. The subscription is confirmed
+// automatically. MinIO sends them to the minio_webhook_url, from a webhook target whose
+// auth_token is the token.
+//
+// Each room is sent the uploads and deletions in its buckets under its prefixes, e.g. for
+// tracking when builds or reports are dropped off. Rooms with no buckets or prefixes are sent
+// every change. "events" can be "created" or "removed", and defaults to both.
+//
+// Example JSON request:
+//   {
+//       "token": "a_long_random_string",
+//       "rooms": {
+//           "!releases:localhost": {
+//               "buckets": ["artifacts"],
+//               "prefixes": ["releases/", "nightly/"],
+//               "events": ["created"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which the SNS topic should be subscribed to. Populated by Go-NEB after Service
+	// registration.
+	SNSWebhookURL string `json:"sns_webhook_url"`
+	// The URL which MinIO's webhook target should send events to. Populated by Go-NEB after
+	// Service registration.
+	MinIOWebhookURL string `json:"minio_webhook_url"`
+	// The token which notifications must have, so that nobody else can post to rooms.
+	Token string `json:"token"`
+	// The rooms to post changes into.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is which changes a room is sent.
+type RoomConfig struct {
+	// Optional. The buckets whose changes are sent to the room. Defaults to every bucket.
+	Buckets []string `json:"buckets"`
+	// Optional. The key prefixes of the objects whose changes are sent. Defaults to every object.
+	Prefixes []string `json:"prefixes"`
+	// Optional. "created" for uploads and "removed" for deletions. Defaults to both.
+	Events []string `json:"events"`
+}
+
+func (r *RoomConfig) wants(c *change) bool {
+	return matchesAny(r.Buckets, func(b string) bool { return b == c.Bucket }) &&
+		matchesAny(r.Prefixes, func(p string) bool { return strings.HasPrefix(c.Key, p) }) &&
+		matchesAny(r.Events, func(e string) bool { return e == c.Kind })
+}
+
+// matchesAny returns whether any of the filters match, or true if there are none.
+func matchesAny(filters []string, match func(string) bool) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, f := range filters {
+		if match(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// OnReceiveWebhook posts the uploads and deletions in an S3 or MinIO notification into the rooms
+// which want them.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+		w.WriteHeader(403)
+		return
+	}
+
+	logger := log.WithField("service_id", s.ServiceID())
+	body := io.LimitReader(req.Body, maxWebhookSize)
+	var event *s3Event
+	var err error
+	switch source := req.URL.Query().Get("source"); source {
+	case "sns":
+		var msg snsMessage
+		if err = json.NewDecoder(body).Decode(&msg); err != nil {
+			break
+		}
+		switch msg.Type {
+		case "SubscriptionConfirmation":
+			err = confirmSubscription(&msg)
+			if err == nil {
+				logger.WithField("topic", msg.TopicArn).Info("Confirmed SNS subscription")
+			}
+		case "Notification":
+			event, err = msg.event()
+		}
+	case "minio":
+		event = &s3Event{}
+		err = json.NewDecoder(body).Decode(event)
+	default:
+		err = fmt.Errorf("Unknown source '%s'", source)
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Bad S3 events webhook")
+		w.WriteHeader(400)
+		return
+	}
+	if event == nil || event.Event == "s3:TestEvent" {
+		w.WriteHeader(200)
+		return
+	}
+	changes, err := event.changes()
+	if err != nil {
+		logger.WithError(err).Warn("Bad S3 events webhook")
+		w.WriteHeader(400)
+		return
+	}
+
+	var roomIDs []id.RoomID
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Slice(roomIDs, func(i, j int) bool { return roomIDs[i] < roomIDs[j] })
+	for _, roomID := range roomIDs {
+		room := s.Rooms[roomID]
+		var wanted []change
+		for i := range changes {
+			if room.wants(&changes[i]) {
+				wanted = append(wanted, changes[i])
+			}
+		}
+		if len(wanted) == 0 {
+			continue
+		}
+		if _, err := notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: changesContent(wanted)}); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to send S3 events")
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// confirmSubscription confirms that the SNS topic may send notifications to Go-NEB.
+func confirmSubscription(msg *snsMessage) error {
+	u, err := msg.subscribeURL()
+	if err != nil {
+		return err
+	}
+	res, err := httpClient.Get(u)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to confirm SNS subscription: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// changesContent returns a message listing the changes, up to maxChangesPerMessage of them.
+func changesContent(changes []change) mevt.MessageEventContent {
+	var more int
+	if len(changes) > maxChangesPerMessage {
+		more = len(changes) - maxChangesPerMessage
+		changes = changes[:maxChangesPerMessage]
+	}
+	var lines, htmlLines []string
+	for _, c := range changes {
+		emoji, verb := "📥", "Uploaded"
+		if c.Kind == "removed" {
+			emoji, verb = "🗑️", "Deleted"
+		}
+		details := "in " + c.Bucket
+		if c.Kind == "created" {
+			details += ", " + formatSize(c.Size)
+		}
+		if c.User != "" {
+			details += ", by " + c.User
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s (%s)", emoji, verb, c.Key, details))
+		htmlLines = append(htmlLines, fmt.Sprintf("%s %s <code>%s</code> (%s)", emoji, verb, html.EscapeString(c.Key), html.EscapeString(details)))
+	}
+	if more > 0 {
+		line := fmt.Sprintf("…and %d more", more)
+		lines = append(lines, line)
+		htmlLines = append(htmlLines, html.EscapeString(line))
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: strings.Join(htmlLines, "<br>"),
+	}
+}
+
+// formatSize returns the number of bytes in a human-readable way, e.g. "1.5 MB".
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// Register makes sure the Config information supplied is valid, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.SNSWebhookURL = s.webhookEndpointURL + "?source=sns"
+	s.MinIOWebhookURL = s.webhookEndpointURL + "?source=minio"
+	if len(s.Token) < 16 {
+		return fmt.Errorf("A token of at least 16 characters is required")
+	}
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("At least one room is required")
+	}
+	for roomID, room := range s.Rooms {
+		for _, e := range room.Events {
+			if e != "created" && e != "removed" {
+				return fmt.Errorf("Bad event '%s' for room %s: must be created or removed", e, roomID)
+			}
+		}
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package s3events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const uploadRecords = `{"Records": [
+	{"eventName": "ObjectCreated:Put", "userIdentity": {"principalId": "AWS:ZELDA"},
+		"s3": {"bucket": {"name": "artifacts"}, "object": {"key": "releases/hyrule+v1.2.tar.gz", "size": 1572864}}},
+	{"eventName": "ObjectCreated:Put",
+		"s3": {"bucket": {"name": "artifacts"}, "object": {"key": "scratch/%3Ctmp%3E", "size": 12}}},
+	{"eventName": "ObjectRestore:Completed",
+		"s3": {"bucket": {"name": "artifacts"}, "object": {"key": "releases/old.tar.gz", "size": 100}}}
+]}`
+
+const minioRecords = `{"EventName": "s3:ObjectRemoved:Delete", "Key": "reports/q1.pdf", "Records": [
+	{"eventName": "s3:ObjectRemoved:Delete", "userIdentity": {"principalId": "impa"},
+		"s3": {"bucket": {"name": "reports"}, "object": {"key": "q1.pdf"}}}
+]}`
+
+func TestWebhook(t *testing.T) {
+	confirmed := 0
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "https://sns.eu-west-1.amazonaws.com/?Action=ConfirmSubscription&Token=triforce" {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		confirmed++
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`<ConfirmSubscriptionResponse/>`)),
+		}, nil
+	})}
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, room+" "+msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$s3:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"token": "the_master_sword_token",
+		"rooms": {
+			"!releases:hyrule": {"buckets": ["artifacts"], "prefixes": ["releases/"], "events": ["created"]},
+			"!everything:hyrule": {}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create S3 events service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register S3 events service: ", err)
+	}
+	if s := srv.(*Service); !strings.HasSuffix(s.SNSWebhookURL, "?source=sns") || !strings.HasSuffix(s.MinIOWebhookURL, "?source=minio") {
+		t.Errorf("Bad webhook URLs: %s %s", s.SNSWebhookURL, s.MinIOWebhookURL)
+	}
+
+	snsNotification, _ := json.Marshal(map[string]string{
+		"Type":    "Notification",
+		"Message": uploadRecords,
+	})
+	for _, tc := range []struct {
+		query  string
+		header string
+		body   string
+		code   int
+	}{
+		{"?source=minio", "Bearer wrong", minioRecords, 403},
+		{"?source=ftp&token=the_master_sword_token", "", `{}`, 400},
+		{"?source=sns&token=the_master_sword_token", "", `{"Type": "SubscriptionConfirmation", "SubscribeURL": "https://evil.hyrule/?Token=triforce"}`, 400},
+		{"?source=sns&token=the_master_sword_token", "", `{"Type": "SubscriptionConfirmation", "SubscribeURL": "https://sns.eu-west-1.amazonaws.com/?Action=ConfirmSubscription&Token=triforce"}`, 200},
+		{"?source=sns&token=the_master_sword_token", "", `{"Type": "Notification", "Message": "{\"Service\":\"Amazon S3\",\"Event\":\"s3:TestEvent\"}"}`, 200},
+		{"?source=sns&token=the_master_sword_token", "", string(snsNotification), 200},
+		{"?source=minio", "Bearer the_master_sword_token", minioRecords, 200},
+	} {
+		req := httptest.NewRequest("POST", "https://neb.hyrule/services/hooks/czNldmVudHM"+tc.query, strings.NewReader(tc.body))
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		w := httptest.NewRecorder()
+		srv.OnReceiveWebhook(w, req, matrixCli)
+		if w.Code != tc.code {
+			t.Errorf("Webhook %s: got status %d, want %d", tc.query, w.Code, tc.code)
+		}
+	}
+
+	if confirmed != 1 {
+		t.Errorf("Expected the subscription to be confirmed once, was confirmed %d times", confirmed)
+	}
+	want := []string{
+		"!everything:hyrule 📥 Uploaded releases/hyrule v1.2.tar.gz (in artifacts, 1.5 MB, by AWS:ZELDA)\n📥 Uploaded scratch/<tmp> (in artifacts, 12 bytes)",
+		"!releases:hyrule 📥 Uploaded releases/hyrule v1.2.tar.gz (in artifacts, 1.5 MB, by AWS:ZELDA)",
+		"!everything:hyrule 🗑️ Deleted q1.pdf (in reports, by impa)",
+	}
+	if strings.Join(sent, "\n\n") != strings.Join(want, "\n\n") {
+		t.Errorf("Bad messages: got %q, want %q", sent, want)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"rooms": {"!s3:hyrule": {}}}`,
+		`{"token": "short", "rooms": {"!s3:hyrule": {}}}`,
+		`{"token": "the_master_sword_token"}`,
+		`{"token": "the_master_sword_token", "rooms": {"!s3:hyrule": {"events": ["uploaded"]}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create S3 events service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
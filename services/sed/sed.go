@@ -0,0 +1,194 @@
+// Package sed implements a Service which corrects messages with sed-style "s/typo/fix/" messages.
+package sed
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Sed service
+const ServiceType = "sed"
+
+const (
+	// The longest pattern which is used, so that pasted text isn't compiled
+	maxPatternLength = 200
+	// Longer corrections are cut short
+	maxCorrectionLength = 2000
+)
+
+// A correction, optionally addressed to someone, e.g. "zelda: s/colour/color/g". The parts may
+// contain escaped slashes.
+var sedRegex = regexp.MustCompile(`^(?:(\S+?)[:,]\s+)?s/((?:\\.|[^\\/])+)/((?:\\.|[^\\/])*)/([gi]*)\s*$`)
+
+// Service contains the Config fields for the Sed service.
+//
+// Anyone in a room can correct their last message by sending "s/typo/fix/", and the bot replies to
+// it with the corrected text. Prefixing the correction with someone's name, e.g.
+// "zelda: s/typo/fix/", corrects their last message instead. The pattern is a regular expression,
+// "\1" and "&" in the replacement are the matched groups and text, and the flags "g" and "i"
+// replace every match and ignore case.
+//
+// Only the messages the bot has seen since it started can be corrected, up to the last 50 in
+// each room.
+//
+// Example JSON request:
+//   {}
+type Service struct {
+	types.DefaultService
+}
+
+// Expansions corrects an earlier message for every "s/typo/fix/" message.
+func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
+	return []types.Expansion{
+		{
+			Regexp: sedRegex,
+			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+				return s.expandSed(cli, roomID, userID, matchingGroups)
+			},
+		},
+	}
+}
+
+func (s *Service) expandSed(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+	lister, ok := cli.(types.RecentMessageLister)
+	if !ok {
+		return nil
+	}
+	target, pattern, replacement, flags := matchingGroups[1], matchingGroups[2], matchingGroups[3], matchingGroups[4]
+	if len(pattern) > maxPatternLength {
+		return nil
+	}
+	if strings.Contains(flags, "i") {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(unescapeSlashes(pattern))
+	if err != nil {
+		return nil
+	}
+	template := sedTemplate(unescapeSlashes(replacement))
+
+	messages := lister.RecentMessages(roomID)
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := messages[i]
+		if sedRegex.MatchString(m.Body) {
+			continue
+		}
+		if target == "" && m.Sender != userID || target != "" && !isUser(m.Sender, target) {
+			continue
+		}
+		if !re.MatchString(m.Body) {
+			continue
+		}
+		corrected := replace(re, m.Body, template, strings.Contains(flags, "g"))
+		content, err := notify.ReplyContent(m.EventID, correctionContent(userID, m.Sender, corrected))
+		if err != nil {
+			log.WithError(err).Error("Failed to make sed correction")
+			return nil
+		}
+		return content
+	}
+	return nil
+}
+
+// correctionContent says what the sender of the message meant to say.
+func correctionContent(corrector, sender id.UserID, corrected string) mevt.MessageEventContent {
+	if utf8.RuneCountInString(corrected) > maxCorrectionLength {
+		corrected = string([]rune(corrected)[:maxCorrectionLength-1]) + "…"
+	}
+	senderLink := fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, html.EscapeString(sender.String()), html.EscapeString(sender.String()))
+	intro, htmlIntro := sender.String()+" meant to say:", senderLink+" meant to say:"
+	if corrector != sender {
+		intro = corrector.String() + " thinks " + intro
+		htmlIntro = html.EscapeString(corrector.String()) + " thinks " + htmlIntro
+	}
+	lines := strings.Split(corrected, "\n")
+	quoted := make([]string, len(lines))
+	for i, line := range lines {
+		quoted[i] = "> " + line
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          intro + "\n" + strings.Join(quoted, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: htmlIntro + "<blockquote>" + strings.Replace(html.EscapeString(corrected), "\n", "<br>", -1) + "</blockquote>",
+	}
+}
+
+// replace replaces the first match of the pattern in the text, or every match, using the
+// regexp.Expand template.
+func replace(re *regexp.Regexp, text, template string, all bool) string {
+	if all {
+		return re.ReplaceAllString(text, template)
+	}
+	match := re.FindStringSubmatchIndex(text)
+	if match == nil {
+		return text
+	}
+	result := re.ExpandString(nil, template, text, match)
+	return text[:match[0]] + string(result) + text[match[1]:]
+}
+
+// sedTemplate turns a sed replacement into a regexp.Expand template: "\1" is the first group, "&"
+// is the whole match, and a backslash escapes the next character.
+func sedTemplate(replacement string) string {
+	var b strings.Builder
+	for i := 0; i < len(replacement); i++ {
+		c := replacement[i]
+		switch {
+		case c == '\\' && i+1 < len(replacement):
+			i++
+			next := replacement[i]
+			if next >= '0' && next <= '9' {
+				b.WriteString("${" + strconv.Itoa(int(next-'0')) + "}")
+			} else if next == '$' {
+				b.WriteString("$$")
+			} else if next == 'n' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(next)
+			}
+		case c == '&':
+			b.WriteString("${0}")
+		case c == '$':
+			b.WriteString("$$")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeSlashes replaces the escaped slashes in a part of the correction with slashes.
+func unescapeSlashes(s string) string {
+	return strings.Replace(s, `\/`, "/", -1)
+}
+
+// isUser returns true if the name is the user's ID or localpart, e.g. "zelda" or
+// "@zelda:hyrule" for "@zelda:hyrule".
+func isUser(userID id.UserID, name string) bool {
+	name = strings.ToLower(strings.TrimPrefix(name, "@"))
+	full := strings.ToLower(strings.TrimPrefix(userID.String(), "@"))
+	localpart := full
+	if i := strings.Index(full, ":"); i >= 0 {
+		localpart = full[:i]
+	}
+	return name == full || name == localpart
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
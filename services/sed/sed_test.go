@@ -0,0 +1,94 @@
+package sed
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/id"
+)
+
+// recentClient is a matrix client which remembers some messages.
+type recentClient struct {
+	types.MatrixClient
+	messages []types.RecentMessage
+}
+
+func (c *recentClient) RecentMessages(roomID id.RoomID) []types.RecentMessage {
+	if roomID != "!castle:hyrule" {
+		return nil
+	}
+	return c.messages
+}
+
+func TestSed(t *testing.T) {
+	cli := &recentClient{messages: []types.RecentMessage{
+		{EventID: "$1", Sender: "@zelda:hyrule", Body: "The Triforce of Widsom is mine"},
+		{EventID: "$2", Sender: "@link:hyrule", Body: "I found a heart piece and a heart piece"},
+		{EventID: "$3", Sender: "@link:hyrule", Body: "The cost is $5 for 1/2 a sword"},
+		{EventID: "$4", Sender: "@link:hyrule", Body: "s/ham/sword/"},
+		{EventID: "$5", Sender: "@ganon:hyrule", Body: "Nothing to see here"},
+	}}
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create sed service: ", err)
+	}
+	expansions := srv.Expansions(cli)
+	if len(expansions) != 1 {
+		t.Fatalf("Expected 1 expansion, got %d", len(expansions))
+	}
+	expand := func(roomID id.RoomID, userID id.UserID, body string) map[string]interface{} {
+		m := expansions[0].Regexp.FindStringSubmatch(body)
+		if m == nil {
+			return nil
+		}
+		res, _ := expansions[0].Expand(roomID, userID, m).(map[string]interface{})
+		return res
+	}
+
+	for _, tc := range []struct {
+		userID  id.UserID
+		body    string
+		replyTo string
+		want    string
+	}{
+		{"@link:hyrule", "s/heart piece/rupee/", "$2", "@link:hyrule meant to say:\n> I found a rupee and a heart piece"},
+		{"@link:hyrule", "s/HEART (piece)/big \\1/gi ", "$2", "@link:hyrule meant to say:\n> I found a big piece and a big piece"},
+		{"@link:hyrule", `s/1\/2/[&]/`, "$3", "@link:hyrule meant to say:\n> The cost is $5 for [1/2] a sword"},
+		{"@link:hyrule", `s/\$5/$10/`, "$3", "@link:hyrule meant to say:\n> The cost is $10 for 1/2 a sword"},
+		{"@link:hyrule", "zelda: s/Widsom/Wisdom/", "$1", "@link:hyrule thinks @zelda:hyrule meant to say:\n> The Triforce of Wisdom is mine"},
+		{"@ganon:hyrule", "@zelda:hyrule, s/is mine/is yours/", "$1", "@ganon:hyrule thinks @zelda:hyrule meant to say:\n> The Triforce of Widsom is yours"},
+		{"@link:hyrule", "s/ham/sword/", "", ""},
+		{"@link:hyrule", "s/Triforce/Master Sword/", "", ""},
+		{"@link:hyrule", "s/(unclosed/x/", "", ""},
+		{"@impa:hyrule", "s/Nothing/Everything/", "", ""},
+	} {
+		res := expand("!castle:hyrule", tc.userID, tc.body)
+		if tc.want == "" {
+			if res != nil {
+				t.Errorf("%s: expected no correction, got %v", tc.body, res)
+			}
+			continue
+		}
+		if res == nil {
+			t.Errorf("%s: expected a correction", tc.body)
+			continue
+		}
+		if body := res["body"]; body != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.body, body, tc.want)
+		}
+		relatesTo, _ := res["m.relates_to"].(map[string]interface{})
+		inReplyTo, _ := relatesTo["m.in_reply_to"].(map[string]interface{})
+		if inReplyTo["event_id"] != id.EventID(tc.replyTo) {
+			t.Errorf("%s: expected a reply to %s, got %v", tc.body, tc.replyTo, relatesTo)
+		}
+	}
+
+	res := expand("!castle:hyrule", "@link:hyrule", "s/ a / <b> /")
+	if html, _ := res["formatted_body"].(string); !strings.Contains(html, "<blockquote>The cost is $5 for 1/2 &lt;b&gt; sword</blockquote>") {
+		t.Errorf("Bad HTML: %v", res["formatted_body"])
+	}
+	if res = expand("!dungeon:hyrule", "@link:hyrule", "s/heart/rupee/"); res != nil {
+		t.Errorf("Expected no correction in another room, got %v", res)
+	}
+}
@@ -0,0 +1,288 @@
+package shortener
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"maunium.net/go/mautrix/id"
+)
+
+// The Bitly API. Overridden by tests.
+var bitlyURL = "https://api-ssl.bitly.com/v4"
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// The characters of built-in slugs, and how many there are in each
+const (
+	slugChars  = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	slugLength = 6
+)
+
+// A backend makes short links and counts their clicks.
+type backend interface {
+	shorten(longURL string, userID id.UserID) (*link, error)
+	stats(slug string) (*link, error)
+}
+
+// builtinLink is a short link which Go-NEB redirects itself. Each is stored in the service state
+// under "link" and its slug.
+type builtinLink struct {
+	URL              string    `json:"url"`
+	Creator          id.UserID `json:"creator"`
+	CreatedTimestamp int64     `json:"created_ts"`
+	Clicks           int64     `json:"clicks"`
+}
+
+// builtinBackend stores links in the database, and the service redirects them.
+type builtinBackend struct {
+	serviceID string
+	// What slugs are added to for a short link
+	prefix string
+}
+
+func (b *builtinBackend) shorten(longURL string, userID id.UserID) (*link, error) {
+	linksMutex.Lock()
+	defer linksMutex.Unlock()
+	// Slugs are random rather than counted, so that links can't be looked through in order
+	for i := 0; i < 5; i++ {
+		slug, err := randomSlug()
+		if err != nil {
+			return nil, err
+		}
+		existing, err := b.load(slug)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			continue
+		}
+		l := &builtinLink{URL: longURL, Creator: userID, CreatedTimestamp: timeNow().Unix()}
+		if err = b.store(slug, l); err != nil {
+			return nil, err
+		}
+		return &link{Slug: slug, ShortURL: b.prefix + slug, LongURL: longURL}, nil
+	}
+	return nil, fmt.Errorf("No unused slug was found")
+}
+
+func (b *builtinBackend) stats(slug string) (*link, error) {
+	linksMutex.Lock()
+	defer linksMutex.Unlock()
+	l, err := b.load(slug)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return nil, fmt.Errorf("There is no short link %s", slug)
+	}
+	return &link{Slug: slug, ShortURL: b.prefix + slug, LongURL: l.URL, Clicks: l.Clicks}, nil
+}
+
+// load returns the link with the slug, or nil if there isn't one.
+func (b *builtinBackend) load(slug string) (*builtinLink, error) {
+	if slug == "" {
+		return nil, nil
+	}
+	linkJSON, err := database.GetServiceDB().LoadServiceState(b.serviceID, "link "+slug)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var l builtinLink
+	if err = json.Unmarshal(linkJSON, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (b *builtinBackend) store(slug string, l *builtinLink) error {
+	linkJSON, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(b.serviceID, "link "+slug, linkJSON)
+}
+
+// randomSlug returns a slug of random characters which are hard to mistake for each other.
+func randomSlug() (string, error) {
+	slug := make([]byte, slugLength)
+	for i := range slug {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(slugChars))))
+		if err != nil {
+			return "", err
+		}
+		slug[i] = slugChars[n.Int64()]
+	}
+	return string(slug), nil
+}
+
+// bitlyBackend uses the Bitly API (v4), with an access token.
+type bitlyBackend struct {
+	accessToken string
+	domain      string
+	groupGUID   string
+}
+
+func (b *bitlyBackend) shorten(longURL string, userID id.UserID) (*link, error) {
+	reqBody := map[string]string{"long_url": longURL}
+	if b.domain != "" {
+		reqBody["domain"] = b.domain
+	}
+	if b.groupGUID != "" {
+		reqBody["group_guid"] = b.groupGUID
+	}
+	var res struct {
+		ID      string `json:"id"`
+		Link    string `json:"link"`
+		LongURL string `json:"long_url"`
+	}
+	if err := b.request("POST", "/shorten", reqBody, &res); err != nil {
+		return nil, err
+	}
+	return &link{Slug: res.ID, ShortURL: res.Link, LongURL: res.LongURL}, nil
+}
+
+func (b *bitlyBackend) stats(slug string) (*link, error) {
+	// Bitly's IDs for links are their domain and slug, e.g. "bit.ly/3xYz"
+	if !strings.Contains(slug, "/") {
+		domain := b.domain
+		if domain == "" {
+			domain = "bit.ly"
+		}
+		slug = domain + "/" + slug
+	}
+	var res struct {
+		TotalClicks int64 `json:"total_clicks"`
+	}
+	if err := b.request("GET", "/bitlinks/"+slug+"/clicks/summary?unit=month&units=-1", nil, &res); err != nil {
+		return nil, err
+	}
+	return &link{Slug: slug, ShortURL: "https://" + slug, Clicks: res.TotalClicks}, nil
+}
+
+// request makes a request to the Bitly API, decoding the response into res.
+func (b *bitlyBackend) request(method, path string, reqBody, res interface{}) error {
+	var body bytes.Buffer
+	if reqBody != nil {
+		if err := json.NewEncoder(&body).Encode(reqBody); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, bitlyURL+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	r, err := httpClient.Do(req)
+	if r != nil {
+		defer r.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	switch r.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusForbidden:
+		return fmt.Errorf("The Bitly access_token was refused")
+	case http.StatusNotFound:
+		return fmt.Errorf("Bitly doesn't know that link")
+	default:
+		var errBody struct {
+			Description string `json:"description"`
+			Message     string `json:"message"`
+		}
+		if json.NewDecoder(r.Body).Decode(&errBody) == nil && errBody.Description != "" {
+			return fmt.Errorf("%s", errBody.Description)
+		} else if errBody.Message != "" {
+			return fmt.Errorf("%s", errBody.Message)
+		}
+		return fmt.Errorf("Request error: %d", r.StatusCode)
+	}
+	return json.NewDecoder(r.Body).Decode(res)
+}
+
+// yourlsBackend uses the API of a YOURLS install, with a signature token.
+type yourlsBackend struct {
+	url       string
+	signature string
+}
+
+func (b *yourlsBackend) shorten(longURL string, userID id.UserID) (*link, error) {
+	var res struct {
+		ShortURL string `json:"shorturl"`
+		URL      struct {
+			Keyword string `json:"keyword"`
+		} `json:"url"`
+	}
+	if err := b.request(url.Values{"action": {"shorturl"}, "url": {longURL}}, &res); err != nil {
+		return nil, err
+	}
+	return &link{Slug: res.URL.Keyword, ShortURL: res.ShortURL, LongURL: longURL}, nil
+}
+
+func (b *yourlsBackend) stats(slug string) (*link, error) {
+	// YOURLS only knows its links by keyword, so the domain is dropped from e.g. "sho.rt/abc"
+	if i := strings.LastIndex(slug, "/"); i >= 0 {
+		slug = slug[i+1:]
+	}
+	var res struct {
+		Link struct {
+			ShortURL string      `json:"shorturl"`
+			URL      string      `json:"url"`
+			Clicks   json.Number `json:"clicks"`
+		} `json:"link"`
+	}
+	if err := b.request(url.Values{"action": {"url-stats"}, "shorturl": {slug}}, &res); err != nil {
+		return nil, err
+	}
+	clicks, _ := res.Link.Clicks.Int64()
+	return &link{Slug: slug, ShortURL: res.Link.ShortURL, LongURL: res.Link.URL, Clicks: clicks}, nil
+}
+
+// request calls an action of the YOURLS API, decoding the response into res.
+func (b *yourlsBackend) request(params url.Values, res interface{}) error {
+	params.Set("signature", b.signature)
+	params.Set("format", "json")
+	r, err := httpClient.PostForm(b.url+"/yourls-api.php", params)
+	if r != nil {
+		defer r.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if r.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("The YOURLS signature was refused")
+	}
+	var body bytes.Buffer
+	if _, err = body.ReadFrom(r.Body); err != nil {
+		return err
+	}
+	// Failures have a message, except that URLs which were shortened before are failures with
+	// their existing short link, which is just as good.
+	var status struct {
+		Status   string `json:"status"`
+		Message  string `json:"message"`
+		ShortURL string `json:"shorturl"`
+	}
+	if err = json.Unmarshal(body.Bytes(), &status); err != nil {
+		return fmt.Errorf("Request error: %d", r.StatusCode)
+	}
+	if (status.Status == "fail" || r.StatusCode >= 400) && status.ShortURL == "" {
+		if status.Message != "" {
+			return fmt.Errorf("%s", status.Message)
+		}
+		return fmt.Errorf("Request error: %d", r.StatusCode)
+	}
+	return json.Unmarshal(body.Bytes(), res)
+}
@@ -0,0 +1,272 @@
+// Package shortener implements a Service which makes short links and counts their clicks.
+package shortener
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Shortener service
+const ServiceType = "shortener"
+
+// The longest URL which will be shortened
+const maxURLLength = 2048
+
+// The slug of a short link, e.g. "aZ3kq9" or "bit.ly/3xYz"
+var slugRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]+(/[a-zA-Z0-9_-]+)?$`)
+
+// timeNow is replaced in tests.
+var timeNow = time.Now
+
+// Commands and redirects both update the built-in links, e.g. to count clicks, so the links are
+// only loaded and stored while holding this.
+var linksMutex sync.Mutex
+
+// Service contains the Config fields for the Shortener service.
+//
+// "!shorten https://example.com/a/very/long/url" responds with a short link, and
+// "!shorten stats aZ3kq9" with how many times it has been clicked.
+//
+// By default Go-NEB redirects the short links itself. They are the webhook URL with "?s=" and the
+// link's slug, e.g.
+//    https://neb.example.com/services/hooks/c2hvcnRlbmVy?s=aZ3kq9
+// so Go-NEB must be reachable by the people clicking them. A reverse proxy can serve shorter URLs
+// for them, which are given as the short_url_prefix.
+//
+// The links can instead be made by Bitly (https://dev.bitly.com), with an access token, or by a
+// self-hosted YOURLS (https://yourls.org), with the signature token from its admin's Tools page.
+//
+// Example JSON request:
+//   {
+//       "backend": "yourls",
+//       "yourls": {
+//           "url": "https://sho.rt",
+//           "signature": "1002a612b4"
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which the built-in short links redirect from, with "?s=" and the slug. Populated by
+	// Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// Optional. What makes the short links: "builtin", "bitly" or "yourls". Defaults to "builtin".
+	Backend string `json:"backend"`
+	// Optional. For the built-in backend, what the slug is added to for a short link, e.g.
+	// "https://sho.rt/" if a reverse proxy redirects it to the webhook_url. Defaults to the
+	// webhook_url and "?s=".
+	ShortURLPrefix string `json:"short_url_prefix"`
+	// The Bitly config, required for the "bitly" backend.
+	Bitly struct {
+		// A Bitly access token.
+		AccessToken string `json:"access_token"`
+		// Optional. The domain of the short links, e.g. a branded domain. Defaults to "bit.ly".
+		Domain string `json:"domain"`
+		// Optional. The GUID of the Bitly group which the links are made in. Defaults to the
+		// token user's default group.
+		GroupGUID string `json:"group_guid"`
+	} `json:"bitly"`
+	// The YOURLS config, required for the "yourls" backend.
+	YOURLS struct {
+		// The URL of the YOURLS install, e.g. "https://sho.rt".
+		URL string `json:"url"`
+		// The signature token of the YOURLS API.
+		Signature string `json:"signature"`
+	} `json:"yourls"`
+}
+
+// link is a short link.
+type link struct {
+	Slug     string
+	ShortURL string
+	// The URL the short link goes to, if the backend says
+	LongURL string
+	Clicks  int64
+}
+
+// Commands supported:
+//    !shorten url
+// Responds with a short link to the URL.
+//    !shorten stats slug
+// Responds with how many times the short link has been clicked.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"shorten"},
+			Arguments: []string{"url"},
+			Help:      "Make a short link",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdShorten(userID, args)
+			},
+		},
+		{
+			Path:      []string{"shorten", "stats"},
+			Arguments: []string{"slug"},
+			Help:      "Show how many times a short link has been clicked",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdStats(args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdShorten(userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !shorten url")
+	}
+	longURL := args[0]
+	if len(longURL) > maxURLLength {
+		return nil, fmt.Errorf("The URL is too long: the limit is %d characters", maxURLLength)
+	}
+	if u, err := url.Parse(longURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("'%s' is not an http or https URL", longURL)
+	}
+	l, err := s.backend().shorten(longURL, userID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to shorten the URL: %s", err)
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"user_id":    userID,
+		"slug":       l.Slug,
+	}).Info("Shortened URL")
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    l.ShortURL,
+	}, nil
+}
+
+func (s *Service) cmdStats(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !shorten stats slug")
+	}
+	// People will paste the whole short link, so it is reduced to the slug
+	slug := args[0]
+	if prefix := s.shortURLPrefix(); s.backendName() == "builtin" && strings.HasPrefix(slug, prefix) {
+		slug = strings.TrimPrefix(slug, prefix)
+	}
+	slug = strings.TrimPrefix(strings.TrimPrefix(slug, "https://"), "http://")
+	if !slugRegex.MatchString(slug) {
+		return nil, fmt.Errorf("'%s' is not a short link", args[0])
+	}
+	l, err := s.backend().stats(slug)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the stats of %s: %s", slug, err)
+	}
+	clicks := fmt.Sprintf("%d times", l.Clicks)
+	if l.Clicks == 1 {
+		clicks = "once"
+	}
+	text := fmt.Sprintf("%s has been clicked %s", l.ShortURL, clicks)
+	if l.LongURL != "" {
+		text = fmt.Sprintf("%s (%s) has been clicked %s", l.ShortURL, l.LongURL, clicks)
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    text,
+	}, nil
+}
+
+// OnReceiveWebhook redirects built-in short links to their URLs, counting the clicks.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	if s.backendName() != "builtin" || (req.Method != "GET" && req.Method != "HEAD") {
+		w.WriteHeader(404)
+		return
+	}
+	slug := req.URL.Query().Get("s")
+	linksMutex.Lock()
+	defer linksMutex.Unlock()
+	b := s.builtin()
+	l, err := b.load(slug)
+	if err != nil {
+		log.WithError(err).WithField("slug", slug).Error("Failed to load short link")
+		w.WriteHeader(500)
+		return
+	}
+	if l == nil {
+		w.WriteHeader(404)
+		return
+	}
+	// Link checkers and previews often make HEAD requests, which aren't people clicking
+	if req.Method == "GET" {
+		l.Clicks++
+		if err = b.store(slug, l); err != nil {
+			log.WithError(err).WithField("slug", slug).Error("Failed to count short link click")
+		}
+	}
+	http.Redirect(w, req, l.URL, http.StatusFound)
+}
+
+func (s *Service) backendName() string {
+	if s.Backend == "" {
+		return "builtin"
+	}
+	return s.Backend
+}
+
+func (s *Service) backend() backend {
+	switch s.backendName() {
+	case "bitly":
+		return &bitlyBackend{accessToken: s.Bitly.AccessToken, domain: s.Bitly.Domain, groupGUID: s.Bitly.GroupGUID}
+	case "yourls":
+		return &yourlsBackend{url: strings.TrimSuffix(s.YOURLS.URL, "/"), signature: s.YOURLS.Signature}
+	}
+	return s.builtin()
+}
+
+func (s *Service) builtin() *builtinBackend {
+	return &builtinBackend{serviceID: s.ServiceID(), prefix: s.shortURLPrefix()}
+}
+
+func (s *Service) shortURLPrefix() string {
+	if s.ShortURLPrefix != "" {
+		return s.ShortURLPrefix
+	}
+	return s.WebhookURL + "?s="
+}
+
+// Register makes sure that the backend is configured.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	switch s.backendName() {
+	case "builtin":
+		if s.ShortURLPrefix != "" {
+			if u, err := url.Parse(s.ShortURLPrefix); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("Bad short_url_prefix '%s': must be an http or https URL", s.ShortURLPrefix)
+			}
+		}
+	case "bitly":
+		if s.Bitly.AccessToken == "" {
+			return fmt.Errorf("The bitly backend needs an access_token")
+		}
+	case "yourls":
+		if u, err := url.Parse(s.YOURLS.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Bad YOURLS url '%s': must be an http or https URL", s.YOURLS.URL)
+		}
+		if s.YOURLS.Signature == "" {
+			return fmt.Errorf("The yourls backend needs a signature")
+		}
+	default:
+		return fmt.Errorf("Unknown backend '%s': must be builtin, bitly or yourls", s.Backend)
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
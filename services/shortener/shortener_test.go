@@ -0,0 +1,208 @@
+package shortener
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestBuiltin(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create shortener service: ", err)
+	}
+	s := srv.(*Service)
+	s.WebhookURL = "https://neb.hyrule/services/hooks/aWQ"
+
+	res, err := s.cmdShorten("@link:hyrule", []string{"https://hyrule.example/castle?room=throne"})
+	if err != nil {
+		t.Fatal("Failed to shorten URL: ", err)
+	}
+	shortURL := res.(*mevt.MessageEventContent).Body
+	slug := strings.TrimPrefix(shortURL, "https://neb.hyrule/services/hooks/aWQ?s=")
+	if len(slug) != slugLength {
+		t.Fatalf("Bad short link: %s", shortURL)
+	}
+
+	for _, tc := range []struct {
+		method string
+		slug   string
+		code   int
+	}{
+		{"GET", slug, 302},
+		{"HEAD", slug, 302},
+		{"GET", slug, 302},
+		{"POST", slug, 404},
+		{"GET", "missing", 404},
+		{"GET", "", 404},
+	} {
+		req := httptest.NewRequest(tc.method, "https://neb.hyrule/services/hooks/aWQ?s="+tc.slug, nil)
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, nil)
+		if w.Code != tc.code {
+			t.Errorf("Bad response to %s %s: got %d, want %d", tc.method, tc.slug, w.Code, tc.code)
+		}
+		if tc.code == 302 && w.Header().Get("Location") != "https://hyrule.example/castle?room=throne" {
+			t.Errorf("Bad redirect of %s: %s", tc.slug, w.Header().Get("Location"))
+		}
+	}
+
+	// HEAD requests aren't clicks
+	res, err = s.cmdStats([]string{shortURL})
+	if err != nil {
+		t.Fatal("Failed to get stats: ", err)
+	}
+	want := shortURL + " (https://hyrule.example/castle?room=throne) has been clicked 2 times"
+	if got := res.(*mevt.MessageEventContent).Body; got != want {
+		t.Errorf("Bad stats: got %q, want %q", got, want)
+	}
+
+	for _, args := range [][]string{{"ftp://hyrule.example/castle"}, {"hyrule.example"}, {}} {
+		if _, err = s.cmdShorten("@link:hyrule", args); err == nil {
+			t.Errorf("Expected shortening %v to fail", args)
+		}
+	}
+	for _, args := range [][]string{{"missing"}, {"<script>"}, {}} {
+		if _, err = s.cmdStats(args); err == nil {
+			t.Errorf("Expected stats of %v to fail", args)
+		}
+	}
+}
+
+func TestBackends(t *testing.T) {
+	bitlyURL = "https://bitly.hyrule/v4"
+	var requests []string
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		body := ""
+		switch req.URL.Host {
+		case "bitly.hyrule":
+			if req.Header.Get("Authorization") != "Bearer triforce" {
+				return &http.Response{StatusCode: 403, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+			}
+			switch req.URL.Path {
+			case "/v4/shorten":
+				var reqBody map[string]string
+				if err := json.NewDecoder(req.Body).Decode(&reqBody); err != nil {
+					return nil, err
+				}
+				requests = append(requests, fmt.Sprintf("bitly shorten %s %s", reqBody["long_url"], reqBody["domain"]))
+				body = `{"id": "hyr.ly/3xYz", "link": "https://hyr.ly/3xYz", "long_url": "` + reqBody["long_url"] + `"}`
+			case "/v4/bitlinks/hyr.ly/3xYz/clicks/summary":
+				requests = append(requests, "bitly stats")
+				body = `{"total_clicks": 1, "units": -1, "unit": "month"}`
+			default:
+				return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+			}
+		case "yourls.hyrule":
+			if err := req.ParseForm(); err != nil {
+				return nil, err
+			}
+			if req.PostForm.Get("signature") != "triforce" {
+				return &http.Response{StatusCode: 403, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+			}
+			requests = append(requests, "yourls "+req.PostForm.Get("action"))
+			switch req.PostForm.Get("action") {
+			case "shorturl":
+				// The URL has been shortened before
+				return &http.Response{
+					StatusCode: 400,
+					Body: ioutil.NopCloser(bytes.NewBufferString(`{"status": "fail", "code": "error:url",
+						"message": "https://hyrule.example/castle already exists in database",
+						"shorturl": "https://yourls.hyrule/castle", "url": {"keyword": "castle"}}`)),
+				}, nil
+			case "url-stats":
+				if req.PostForm.Get("shorturl") != "castle" {
+					return &http.Response{
+						StatusCode: 404,
+						Body:       ioutil.NopCloser(bytes.NewBufferString(`{"statusCode": 404, "message": "Error: short URL not found"}`)),
+					}, nil
+				}
+				body = `{"statusCode": 200, "message": "success", "link": {"shorturl": "https://yourls.hyrule/castle",
+					"url": "https://hyrule.example/castle", "clicks": "7"}}`
+			}
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	for _, tc := range []struct {
+		config    string
+		wantShort string
+		statsSlug string
+		wantStats string
+	}{
+		{
+			`{"backend": "bitly", "bitly": {"access_token": "triforce", "domain": "hyr.ly"}}`,
+			"https://hyr.ly/3xYz",
+			"3xYz",
+			"https://hyr.ly/3xYz has been clicked once",
+		},
+		{
+			`{"backend": "yourls", "yourls": {"url": "https://yourls.hyrule/", "signature": "triforce"}}`,
+			"https://yourls.hyrule/castle",
+			"https://yourls.hyrule/castle",
+			"https://yourls.hyrule/castle (https://hyrule.example/castle) has been clicked 7 times",
+		},
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(tc.config))
+		if err != nil {
+			t.Fatal("Failed to create shortener service: ", err)
+		}
+		s := srv.(*Service)
+		if err = s.Register(nil, nil); err != nil {
+			t.Fatalf("Failed to register %s: %s", tc.config, err)
+		}
+		res, err := s.cmdShorten("@link:hyrule", []string{"https://hyrule.example/castle"})
+		if err != nil {
+			t.Errorf("Failed to shorten with %s: %s", s.Backend, err)
+		} else if got := res.(*mevt.MessageEventContent).Body; got != tc.wantShort {
+			t.Errorf("Bad short link from %s: got %q, want %q", s.Backend, got, tc.wantShort)
+		}
+		res, err = s.cmdStats([]string{tc.statsSlug})
+		if err != nil {
+			t.Errorf("Failed to get stats from %s: %s", s.Backend, err)
+		} else if got := res.(*mevt.MessageEventContent).Body; got != tc.wantStats {
+			t.Errorf("Bad stats from %s: got %q, want %q", s.Backend, got, tc.wantStats)
+		}
+		if _, err = s.cmdStats([]string{"missing"}); err == nil {
+			t.Errorf("Expected stats of a missing link from %s to fail", s.Backend)
+		}
+	}
+	want := "bitly shorten https://hyrule.example/castle hyr.ly|bitly stats|yourls shorturl|yourls url-stats|yourls url-stats"
+	if got := strings.Join(requests, "|"); got != want {
+		t.Errorf("Bad requests: got %q, want %q", got, want)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"backend": "tinyurl"}`,
+		`{"short_url_prefix": "sho.rt/"}`,
+		`{"backend": "bitly"}`,
+		`{"backend": "yourls", "yourls": {"url": "https://sho.rt"}}`,
+		`{"backend": "yourls", "yourls": {"url": "sho.rt", "signature": "triforce"}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create shortener service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
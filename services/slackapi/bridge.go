@@ -0,0 +1,634 @@
+package slackapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/russross/blackfriday"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The base URL of the Slack Web API
+var slackAPIURL = "https://slack.com/api/"
+
+// Slack retries requests which it signed more than this long ago, so older ones are replays.
+const maxRequestAge = 5 * time.Minute
+
+// How long the names of Slack users are remembered for
+const userCacheTTL = time.Hour
+
+// How long after a message is bridged its edits and deletions are still bridged, and how long
+// Slack events are remembered for, to drop their retries.
+const bridgeMemory = 30 * 24 * time.Hour
+
+// bridgedState forgets bridged messages and received events after bridgeMemory.
+var bridgedState = &utils.ExpiringState{IndexKey: "bridged", TTL: bridgeMemory}
+
+// bridging is the Slack events being bridged in the background. Tests wait for them.
+var bridging sync.WaitGroup
+
+// A request from the Slack Events API, see https://api.slack.com/apis/connections/events-api
+type slackEventRequest struct {
+	Type      string     `json:"type"`
+	Challenge string     `json:"challenge"`
+	EventID   string     `json:"event_id"`
+	Event     slackEvent `json:"event"`
+}
+
+// A message event, see https://api.slack.com/events/message
+type slackEvent struct {
+	Type            string      `json:"type"`
+	Subtype         string      `json:"subtype"`
+	Channel         string      `json:"channel"`
+	User            string      `json:"user"`
+	BotID           string      `json:"bot_id"`
+	Text            string      `json:"text"`
+	TS              string      `json:"ts"`
+	ThreadTS        string      `json:"thread_ts"`
+	DeletedTS       string      `json:"deleted_ts"`
+	Message         *slackEvent `json:"message"`          // message_changed
+	PreviousMessage *slackEvent `json:"previous_message"` // message_deleted
+}
+
+// bridgedMessage is a message which is in both Slack and Matrix. It is stored under the Slack
+// timestamp and the Matrix event ID, so that edits and deletions can be bridged either way.
+type bridgedMessage struct {
+	TS      string     `json:"ts"`
+	EventID id.EventID `json:"event_id"`
+}
+
+// The identity of the Slack app which the service posts as, so that its own messages aren't
+// bridged back into Matrix.
+type slackIdentity struct {
+	UserID string `json:"user_id"`
+	BotID  string `json:"bot_id"`
+}
+
+type cachedSlackUser struct {
+	name    string
+	fetched time.Time
+}
+
+var (
+	slackIdentitiesMutex sync.Mutex
+	slackIdentities      = make(map[string]slackIdentity) // Slack token => identity
+	slackUsersMutex      sync.Mutex
+	slackUsers           = make(map[string]cachedSlackUser) // Slack token + user ID => name
+)
+
+// isEventRequest returns true if the body is a request from the Slack Events API, rather than from
+// an outgoing webhook.
+func isEventRequest(body []byte) bool {
+	var req struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(body, &req) != nil {
+		return false
+	}
+	return req.Type == "url_verification" || req.Type == "event_callback"
+}
+
+// verifySignature checks that Slack signed the request with the service's signing secret, see
+// https://api.slack.com/authentication/verifying-requests-from-slack
+func (s *Service) verifySignature(header http.Header, body []byte, now time.Time) error {
+	if s.SigningSecret == "" {
+		return fmt.Errorf("No signing secret is configured")
+	}
+	ts := header.Get("X-Slack-Request-Timestamp")
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Bad X-Slack-Request-Timestamp '%s'", ts)
+	}
+	if age := now.Sub(time.Unix(secs, 0)); age > maxRequestAge || age < -maxRequestAge {
+		return fmt.Errorf("Request was signed %s ago", age)
+	}
+	mac := hmac.New(sha256.New, []byte(s.SigningSecret))
+	mac.Write([]byte("v0:" + ts + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("Bad X-Slack-Signature")
+	}
+	return nil
+}
+
+// onSlackEvent handles a request from the Slack Events API.
+func (s *Service) onSlackEvent(w http.ResponseWriter, req *http.Request, body []byte, cli types.MatrixClient) {
+	if err := s.verifySignature(req.Header, body, time.Now()); err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Warn("Rejecting Slack event")
+		w.WriteHeader(401)
+		return
+	}
+	var evReq slackEventRequest
+	if err := json.Unmarshal(body, &evReq); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	if evReq.Type == "url_verification" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(evReq.Challenge))
+		return
+	}
+	// Slack retries events which aren't acknowledged within 3 seconds, so always acknowledge them
+	// before bridging them.
+	w.WriteHeader(200)
+
+	ev := evReq.Event
+	if ev.Type != "message" || ev.Channel != s.SlackChannel {
+		return
+	}
+	if s.isRetried(evReq.EventID, req.Header.Get("X-Slack-Retry-Num")) {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"subtype":    ev.Subtype,
+		"ts":         ev.TS,
+	})
+	bridging.Add(1)
+	go func() {
+		defer bridging.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				logger.WithField("panic", r).Errorf("Bridging Slack message panicked!\n%s", debug.Stack())
+			}
+		}()
+		if err := s.bridgeSlackEvent(ev, cli); err != nil {
+			logger.WithError(err).Error("Failed to bridge Slack message")
+		}
+	}()
+}
+
+// isRetried returns true if Slack is retrying an event which has already been received, e.g.
+// because its acknowledgement was lost. Otherwise the event is remembered, to recognise its retries.
+func (s *Service) isRetried(eventID, retryNum string) bool {
+	if eventID == "" {
+		return false
+	}
+	stateKey := "event " + eventID
+	if retryNum != "" {
+		if _, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), stateKey); err == nil {
+			log.WithFields(log.Fields{
+				"service_id": s.ServiceID(),
+				"event_id":   eventID,
+				"retry_num":  retryNum,
+			}).Info("Dropping retried Slack event")
+			return true
+		}
+	}
+	if err := bridgedState.Store(s.ServiceID(), time.Now(), []byte(`true`), stateKey); err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to remember Slack event")
+	}
+	return false
+}
+
+// bridgeSlackEvent sends a Slack message, edit or deletion into the Matrix room.
+func (s *Service) bridgeSlackEvent(ev slackEvent, cli types.MatrixClient) error {
+	switch ev.Subtype {
+	case "message_changed":
+		if ev.Message == nil || s.isOwnMessage(*ev.Message) {
+			return nil
+		}
+		original, ok, err := s.loadBridged("slack", ev.Message.TS)
+		if err != nil || !ok {
+			return err
+		}
+		content, err := s.matrixContent(*ev.Message)
+		if err != nil {
+			return err
+		}
+		_, err = cli.SendMessageEvent(s.RoomID, mevt.EventMessage, editContent(content, original.EventID))
+		return err
+	case "message_deleted":
+		if ev.PreviousMessage != nil && s.isOwnMessage(*ev.PreviousMessage) {
+			return nil
+		}
+		original, ok, err := s.loadBridged("slack", ev.DeletedTS)
+		if err != nil || !ok {
+			return err
+		}
+		redacter, ok := cli.(types.EventRedacter)
+		if !ok {
+			return fmt.Errorf("Client cannot redact events")
+		}
+		if _, err = redacter.RedactEvent(s.RoomID, original.EventID); err != nil {
+			return err
+		}
+		s.forgetBridged(original)
+		return nil
+	case "", "bot_message", "me_message", "file_share", "thread_broadcast":
+		if s.isOwnMessage(ev) {
+			return nil
+		}
+		content, err := s.matrixContent(ev)
+		if err != nil {
+			return err
+		}
+		var relatedContent interface{} = content
+		if ev.ThreadTS != "" && ev.ThreadTS != ev.TS {
+			root, ok, err := s.loadBridged("slack", ev.ThreadTS)
+			if err != nil {
+				return err
+			}
+			if ok {
+				relatedContent = threadContent(content, root.EventID)
+			}
+		}
+		resp, err := cli.SendMessageEvent(s.RoomID, mevt.EventMessage, relatedContent)
+		if err != nil {
+			return err
+		}
+		s.storeBridged(bridgedMessage{TS: ev.TS, EventID: resp.EventID})
+		return nil
+	}
+	// Channel joins, topic changes etc. aren't bridged.
+	return nil
+}
+
+// isOwnMessage returns true if the Slack message was posted by the service.
+func (s *Service) isOwnMessage(ev slackEvent) bool {
+	if s.SlackToken == "" {
+		return false
+	}
+	self, err := s.slackIdentity()
+	if err != nil {
+		log.WithError(err).Warn("Failed to find out who the Slack token belongs to")
+		return false
+	}
+	return (self.BotID != "" && ev.BotID == self.BotID) || (self.UserID != "" && ev.User == self.UserID)
+}
+
+// matrixContent renders a Slack message as a Matrix message, attributed to the Slack user.
+func (s *Service) matrixContent(ev slackEvent) (mevt.MessageEventContent, error) {
+	name := ev.User
+	if ev.User != "" && s.SlackToken != "" {
+		var err error
+		if name, err = s.slackUserName(ev.User); err != nil {
+			log.WithError(err).WithField("slack_user", ev.User).Warn("Failed to look up Slack user")
+			name = ev.User
+		}
+	}
+	messageType := s.MessageType
+	if messageType == "" {
+		messageType = mevt.MsgText
+	}
+	text := html.UnescapeString(ev.Text)
+	formatted := strings.TrimSpace(string(blackfriday.MarkdownBasic([]byte(linkifyString(ev.Text)))))
+	formatted = strings.TrimSuffix(strings.TrimPrefix(formatted, "<p>"), "</p>")
+	if name == "" {
+		return mevt.MessageEventContent{
+			MsgType:       messageType,
+			Body:          text,
+			Format:        mevt.FormatHTML,
+			FormattedBody: formatted,
+		}, nil
+	}
+	return mevt.MessageEventContent{
+		MsgType:       messageType,
+		Body:          fmt.Sprintf("%s: %s", name, text),
+		Format:        mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf("<strong>%s</strong>: %s", html.EscapeString(name), formatted),
+	}, nil
+}
+
+// editContent returns the content of an m.replace edit of the event.
+func editContent(content mevt.MessageEventContent, eventID id.EventID) map[string]interface{} {
+	return map[string]interface{}{
+		"msgtype":        content.MsgType,
+		"body":           "* " + content.Body,
+		"format":         content.Format,
+		"formatted_body": "* " + content.FormattedBody,
+		"m.new_content":  content,
+		"m.relates_to": map[string]interface{}{
+			"rel_type": "m.replace",
+			"event_id": eventID,
+		},
+	}
+}
+
+// threadContent returns the content of a message in the thread started by the root event. Clients
+// without threads see it as a reply to the root.
+func threadContent(content mevt.MessageEventContent, rootID id.EventID) map[string]interface{} {
+	return map[string]interface{}{
+		"msgtype":        content.MsgType,
+		"body":           content.Body,
+		"format":         content.Format,
+		"formatted_body": content.FormattedBody,
+		"m.relates_to": map[string]interface{}{
+			"rel_type":        "m.thread",
+			"event_id":        rootID,
+			"is_falling_back": true,
+			"m.in_reply_to": map[string]interface{}{
+				"event_id": rootID,
+			},
+		},
+	}
+}
+
+// OnMessage relays messages sent into the room by Matrix users to the Slack channel, as the Matrix
+// user who sent them. Edits and redactions are relayed too.
+func (s *Service) OnMessage(cli types.MatrixClient, evt *mevt.Event) {
+	if evt.RoomID != s.RoomID || s.SlackToken == "" || s.SlackChannel == "" {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"event_id":   evt.ID,
+	})
+	var err error
+	if evt.Type == mevt.EventRedaction {
+		err = s.relayRedaction(evt)
+	} else if evt.Type == mevt.EventMessage {
+		err = s.relayMessage(cli, evt)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to relay Matrix event to Slack")
+	}
+}
+
+func (s *Service) relayMessage(cli types.MatrixClient, evt *mevt.Event) error {
+	relType, relatedID := relation(evt.Content.Raw)
+	body, _ := evt.Content.Raw["body"].(string)
+	if relType == "m.replace" {
+		if newContent, ok := evt.Content.Raw["m.new_content"].(map[string]interface{}); ok {
+			body, _ = newContent["body"].(string)
+		}
+		original, ok, err := s.loadBridged("matrix", string(relatedID))
+		if err != nil || !ok {
+			return err
+		}
+		return s.slackRequest("chat.update", map[string]interface{}{
+			"channel": s.SlackChannel,
+			"ts":      original.TS,
+			"text":    slackEscape(body),
+		}, nil)
+	}
+	if body == "" {
+		return nil
+	}
+
+	msgtype, _ := evt.Content.Raw["msgtype"].(string)
+	if mxc, ok := evt.Content.Raw["url"].(string); ok && mxc != "" {
+		// Files can't be posted with an attribution, so link to them instead.
+		if dl := downloadURL(cli, mxc); dl != "" {
+			body = fmt.Sprintf("%s: %s", body, dl)
+		}
+	}
+	text := slackEscape(body)
+	if msgtype == string(mevt.MsgEmote) {
+		text = "_" + text + "_"
+	}
+	params := map[string]interface{}{
+		"channel": s.SlackChannel,
+		"text":    text,
+	}
+	name, avatar := memberProfile(cli, evt.RoomID, evt.Sender)
+	params["username"] = name
+	if avatar != "" {
+		params["icon_url"] = avatar
+	}
+	if relType == "m.thread" {
+		root, ok, err := s.loadBridged("matrix", string(relatedID))
+		if err != nil {
+			return err
+		}
+		if ok {
+			params["thread_ts"] = root.TS
+		}
+	}
+
+	var res struct {
+		TS string `json:"ts"`
+	}
+	if err := s.slackRequest("chat.postMessage", params, &res); err != nil {
+		return err
+	}
+	s.storeBridged(bridgedMessage{TS: res.TS, EventID: evt.ID})
+	return nil
+}
+
+func (s *Service) relayRedaction(evt *mevt.Event) error {
+	original, ok, err := s.loadBridged("matrix", string(evt.Redacts))
+	if err != nil || !ok {
+		return err
+	}
+	if err = s.slackRequest("chat.delete", map[string]interface{}{
+		"channel": s.SlackChannel,
+		"ts":      original.TS,
+	}, nil); err != nil {
+		return err
+	}
+	s.forgetBridged(original)
+	return nil
+}
+
+// relation returns the type of the event's m.relates_to and the event it relates to, if any.
+func relation(content map[string]interface{}) (string, id.EventID) {
+	rel, ok := content["m.relates_to"].(map[string]interface{})
+	if !ok {
+		return "", ""
+	}
+	relType, _ := rel["rel_type"].(string)
+	eventID, _ := rel["event_id"].(string)
+	return relType, id.EventID(eventID)
+}
+
+// memberProfile returns the display name and avatar URL of the room member, falling back to their
+// user ID.
+func memberProfile(cli types.MatrixClient, roomID id.RoomID, userID id.UserID) (string, string) {
+	var member struct {
+		Displayname string `json:"displayname"`
+		AvatarURL   string `json:"avatar_url"`
+	}
+	stateCli, ok := cli.(types.StateGetter)
+	if !ok {
+		return userID.String(), ""
+	}
+	if err := stateCli.StateEvent(roomID, mevt.StateMember, userID.String(), &member); err != nil {
+		log.WithError(err).WithField("user_id", userID).Warn("Failed to load member profile")
+		return userID.String(), ""
+	}
+	name := member.Displayname
+	if name == "" {
+		name = userID.String()
+	}
+	return name, downloadURL(cli, member.AvatarURL)
+}
+
+// downloadURL returns the HTTP URL of mxc:// content, or "" if it isn't an mxc:// URL.
+func downloadURL(cli types.MatrixClient, mxc string) string {
+	urlCli, ok := cli.(types.URLBuilder)
+	if !ok || !strings.HasPrefix(mxc, "mxc://") {
+		return ""
+	}
+	parts := strings.SplitN(strings.TrimPrefix(mxc, "mxc://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return ""
+	}
+	return urlCli.BuildBaseURL("_matrix", "media", "r0", "download", parts[0], parts[1])
+}
+
+// slackEscape escapes the characters which Slack treats as control characters, see
+// https://api.slack.com/reference/surfaces/formatting#escaping
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// slackIdentity returns who the service's Slack token belongs to.
+func (s *Service) slackIdentity() (slackIdentity, error) {
+	slackIdentitiesMutex.Lock()
+	self, ok := slackIdentities[s.SlackToken]
+	slackIdentitiesMutex.Unlock()
+	if ok {
+		return self, nil
+	}
+	if err := s.slackRequest("auth.test", map[string]interface{}{}, &self); err != nil {
+		return self, err
+	}
+	slackIdentitiesMutex.Lock()
+	slackIdentities[s.SlackToken] = self
+	slackIdentitiesMutex.Unlock()
+	return self, nil
+}
+
+// slackUserName returns the name which the Slack user is shown with.
+func (s *Service) slackUserName(userID string) (string, error) {
+	cacheKey := s.SlackToken + " " + userID
+	slackUsersMutex.Lock()
+	cached, ok := slackUsers[cacheKey]
+	slackUsersMutex.Unlock()
+	if ok && time.Since(cached.fetched) < userCacheTTL {
+		return cached.name, nil
+	}
+
+	var res struct {
+		User struct {
+			Name    string `json:"name"`
+			Profile struct {
+				DisplayName string `json:"display_name"`
+				RealName    string `json:"real_name"`
+			} `json:"profile"`
+		} `json:"user"`
+	}
+	// users.info only accepts form encoded parameters
+	if err := s.slackRequest("users.info?user="+url.QueryEscape(userID), nil, &res); err != nil {
+		return "", err
+	}
+	name := res.User.Profile.DisplayName
+	if name == "" {
+		name = res.User.Profile.RealName
+	}
+	if name == "" {
+		name = res.User.Name
+	}
+
+	slackUsersMutex.Lock()
+	slackUsers[cacheKey] = cachedSlackUser{name: name, fetched: time.Now()}
+	slackUsersMutex.Unlock()
+	return name, nil
+}
+
+// slackRequest calls a Slack Web API method with the service's token. Parameters are sent as JSON
+// if there are any, and the response is decoded into out if it is not nil.
+func (s *Service) slackRequest(method string, params map[string]interface{}, out interface{}) error {
+	httpMethod := "GET"
+	var reqBody []byte
+	if params != nil {
+		httpMethod = "POST"
+		var err error
+		if reqBody, err = json.Marshal(params); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(httpMethod, slackAPIURL+method, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.SlackToken)
+	if params != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	res, err := netClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("Slack responded to %s with HTTP %d", method, res.StatusCode)
+	}
+	// Slack responds with 200 OK to failed calls, and says so in the body instead.
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err = json.Unmarshal(body, &status); err != nil {
+		return err
+	}
+	if !status.OK {
+		return fmt.Errorf("Slack %s failed: %s", method, status.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (s *Service) loadBridged(side, ref string) (msg bridgedMessage, ok bool, err error) {
+	if ref == "" {
+		return
+	}
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), side+" "+ref)
+	if err == sql.ErrNoRows {
+		return msg, false, nil
+	} else if err != nil {
+		return
+	}
+	return msg, true, json.Unmarshal(stateJSON, &msg)
+}
+
+// storeBridged remembers the message under both its Slack timestamp and Matrix event ID, for
+// bridgeMemory.
+func (s *Service) storeBridged(msg bridgedMessage) {
+	stateJSON, err := json.Marshal(msg)
+	if err == nil {
+		err = bridgedState.Store(s.ServiceID(), time.Now(), stateJSON, "slack "+msg.TS, "matrix "+string(msg.EventID))
+	}
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to store bridged message")
+	}
+}
+
+func (s *Service) forgetBridged(msg bridgedMessage) {
+	db := database.GetServiceDB()
+	if err := db.DeleteServiceState(s.ServiceID(), "slack "+msg.TS); err != nil {
+		log.WithError(err).Error("Failed to forget bridged message")
+	}
+	if err := db.DeleteServiceState(s.ServiceID(), "matrix "+string(msg.EventID)); err != nil {
+		log.WithError(err).Error("Failed to forget bridged message")
+	}
+}
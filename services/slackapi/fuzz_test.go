@@ -0,0 +1,40 @@
+//go:build go1.18
+// +build go1.18
+
+package slackapi
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+)
+
+func FuzzSlackMessage(f *testing.F) {
+	// Never fetch attachment icons from the internet whilst fuzzing.
+	netClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("Unhandled URL %s", req.URL.String())
+	})}
+
+	f.Add("application/json", []byte(`{"text":"Hello <https://matrix.org|Matrix>","username":"bot","channel":"general"}`))
+	f.Add("application/json", []byte(`{"text":"*bold*","mrkdwn":false,"attachments":[{"color":"good","title":"Title",`+
+		`"author_name":"alice","author_icon":"https://img.somewhere/a.png","mrkdwn_in":["text","pretext"]}]}`))
+	f.Add("application/x-www-form-urlencoded", []byte("payload="+url.QueryEscape(`{"text":"form encoded"}`)))
+	f.Add("text/plain", []byte("nope"))
+
+	f.Fuzz(func(t *testing.T, contentType string, body []byte) {
+		req, err := http.NewRequest("POST", "https://neb.somewhere/services/hooks/slackapi", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		message, err := getSlackMessage(*req)
+		if err != nil {
+			return
+		}
+		slackMessageToHTMLMessage(message)
+	})
+}
@@ -1,9 +1,14 @@
 package slackapi
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
 	"net/http"
 	"strings"
 
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/templates"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	"maunium.net/go/mautrix/event"
@@ -18,10 +23,19 @@ const ServiceType = "slackapi"
 // This service will send HTML formatted messages into a room when an outgoing slack webhook
 // hits WebhookURL.
 //
+// It can also bridge the room and a Slack channel both ways, by giving WebhookURL to a Slack app
+// as its Events API request URL, subscribed to the "message.channels" event. Messages sent into
+// the room are then posted to the channel as the Matrix user who sent them, and edits, deletions
+// and threads are bridged both ways. The app needs the "chat:write", "chat:write.customize",
+// "channels:history" and "users:read" scopes.
+//
 // Example JSON request:
 // {
 //   "room_id": "!someroomid:some.domain.com",
-//   "message_type": "m.text"
+//   "message_type": "m.text",
+//   "slack_token": "xoxb-...",
+//   "slack_channel": "C0123456789",
+//   "signing_secret": "8f742231b10e8888abcd99yyyzzz85a5"
 // }
 type Service struct {
 	types.DefaultService
@@ -30,12 +44,20 @@ type Service struct {
 	WebhookURL  string            `json:"webhook_url"`
 	RoomID      id.RoomID         `json:"room_id"`
 	MessageType event.MessageType `json:"message_type"`
+	// Optional. The bot token of the Slack app, used to post Matrix messages into the Slack channel.
+	SlackToken string `json:"slack_token"`
+	// Optional. The ID of the Slack channel to bridge the room with. Required with SlackToken.
+	SlackChannel string `json:"slack_channel"`
+	// Optional. The signing secret of the Slack app, used to verify requests from the Events API.
+	// Events API requests are refused without it.
+	SigningSecret string `json:"signing_secret"`
 }
 
-// OnReceiveWebhook receives requests from a slack outgoing webhook and possibly sends requests
-// to Matrix as a result.
+// OnReceiveWebhook receives requests from a slack outgoing webhook or the Slack Events API and possibly
+// sends requests to Matrix as a result.
 //
 // This requires that the WebhookURL is given to an outgoing slack webhook (see https://api.slack.com/outgoing-webhooks)
+// or to a Slack app as its Events API request URL (see https://api.slack.com/apis/connections/events-api)
 func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
 	segments := strings.Split(req.URL.Path, "/")
 
@@ -44,6 +66,17 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		return
 	}
 
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	if isEventRequest(body) {
+		s.onSlackEvent(w, req, body, cli)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
 	messageType := s.MessageType
 	if messageType == "" {
 		messageType = event.MsgText
@@ -64,14 +97,18 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		return
 	}
 	htmlMessage.MsgType = messageType
-	cli.SendMessageEvent(
-		roomID, event.EventMessage, htmlMessage,
-	)
+	// Operators can override the message with a template named "slackapi", which is given the
+	// Slack message payload.
+	htmlMessage = templates.Render("slackapi", slackMessage, htmlMessage)
+	notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: htmlMessage})
 	w.WriteHeader(200)
 }
 
 // Register joins the configured room and sets the public WebhookURL
 func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.SlackToken != "" && s.SlackChannel == "" {
+		return errors.New("A slack_channel is required with a slack_token")
+	}
 	s.WebhookURL = s.webhookEndpointURL
 	if _, err := client.JoinRoom(s.RoomID.String(), "", nil); err != nil {
 		log.WithFields(log.Fields{
@@ -0,0 +1,243 @@
+package slackapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func sign(secret string, ts int64, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("v0:%d:%s", ts, body)))
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	s := &Service{SigningSecret: "shh"}
+	now := time.Unix(1600000000, 0)
+	body := `{"type":"event_callback"}`
+
+	testCases := []struct {
+		name      string
+		ts        int64
+		signature string
+		wantErr   bool
+	}{
+		{"valid", now.Unix(), sign("shh", now.Unix(), body), false},
+		{"wrong secret", now.Unix(), sign("nope", now.Unix(), body), true},
+		{"replayed", now.Add(-10 * time.Minute).Unix(), sign("shh", now.Add(-10*time.Minute).Unix(), body), true},
+		{"unsigned", now.Unix(), "", true},
+	}
+	for _, tc := range testCases {
+		header := http.Header{}
+		header.Set("X-Slack-Request-Timestamp", strconv.FormatInt(tc.ts, 10))
+		header.Set("X-Slack-Signature", tc.signature)
+		err := s.verifySignature(header, []byte(body), now)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+
+	if err := (&Service{}).verifySignature(http.Header{}, []byte(body), now); err == nil {
+		t.Errorf("Accepted an event without a signing secret")
+	}
+}
+
+func TestBridge(t *testing.T) {
+	store := testutils.NewStateStorage()
+	database.SetServiceDB(store)
+
+	// Mock the Slack Web API
+	var slackCalls []string
+	var slackParams []map[string]interface{}
+	slackAPIURL = "https://slack.test/api/"
+	netClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Authorization") != "Bearer xoxb-token" {
+			return nil, fmt.Errorf("Bad Authorization header: %s", req.Header.Get("Authorization"))
+		}
+		method := strings.TrimPrefix(req.URL.Path, "/api/")
+		var params map[string]interface{}
+		if req.Body != nil {
+			json.NewDecoder(req.Body).Decode(&params)
+		}
+		slackCalls = append(slackCalls, method)
+		slackParams = append(slackParams, params)
+		var res string
+		switch method {
+		case "auth.test":
+			res = `{"ok":true,"user_id":"UBOT","bot_id":"BBOT"}`
+		case "users.info":
+			res = `{"ok":true,"user":{"name":"zelda","profile":{"display_name":"Princess Zelda"}}}`
+		case "chat.postMessage":
+			res = `{"ok":true,"ts":"2000.000200"}`
+		case "chat.update", "chat.delete":
+			res = `{"ok":true}`
+		default:
+			return nil, fmt.Errorf("Unknown Slack method: %s", method)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(res)),
+		}, nil
+	})}
+
+	// Mock Matrix
+	var sent []map[string]interface{}
+	var redacted []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		switch {
+		case strings.Contains(req.URL.Path, "/state/m.room.member/"):
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"displayname":"Link","avatar_url":"mxc://hyrule/link"}`)),
+			}, nil
+		case strings.Contains(req.URL.Path, "/send/m.room.message/"):
+			var content map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+				return nil, err
+			}
+			sent = append(sent, content)
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`{"event_id":"$%d"}`, len(sent)))),
+			}, nil
+		case strings.Contains(req.URL.Path, "/redact/"):
+			redacted = append(redacted, req.URL.Path)
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$redaction"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"room_id": "!castle:hyrule",
+		"slack_token": "xoxb-token",
+		"slack_channel": "C123",
+		"signing_secret": "shh"
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create slackapi service: ", err)
+	}
+
+	deliver := func(body, retryNum string) {
+		req, _ := http.NewRequest("POST", "https://neb.somewhere/services/hooks/slackapi", bytes.NewBufferString(body))
+		now := time.Now().Unix()
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Slack-Request-Timestamp", strconv.FormatInt(now, 10))
+		req.Header.Set("X-Slack-Signature", sign("shh", now, body))
+		if retryNum != "" {
+			req.Header.Set("X-Slack-Retry-Num", retryNum)
+		}
+		w := httptest.NewRecorder()
+		srv.OnReceiveWebhook(w, req, matrixCli)
+		if w.Code != 200 {
+			t.Fatalf("Expected 200 OK for Slack event, got %d", w.Code)
+		}
+		bridging.Wait()
+	}
+	slackEvent := func(ev string) {
+		deliver(`{"type":"event_callback","event":`+ev+`}`, "")
+	}
+
+	// Slack -> Matrix
+	slackEvent(`{"type":"message","channel":"C123","user":"UZELDA","text":"Hello *hero*","ts":"1000.000100"}`)
+	if len(sent) != 1 || sent[0]["body"] != "Princess Zelda: Hello *hero*" {
+		t.Fatalf("Expected the Slack message to be sent as Princess Zelda, got %v", sent)
+	}
+	slackEvent(`{"type":"message","channel":"C123","user":"UZELDA","text":"In a thread","ts":"1000.000300","thread_ts":"1000.000100"}`)
+	relatesTo, _ := sent[1]["m.relates_to"].(map[string]interface{})
+	if relatesTo["rel_type"] != "m.thread" || relatesTo["event_id"] != "$1" {
+		t.Errorf("Expected a thread reply to $1, got m.relates_to %v", relatesTo)
+	}
+	slackEvent(`{"type":"message","subtype":"message_changed","channel":"C123","message":{"user":"UZELDA","text":"Hello hero","ts":"1000.000100"}}`)
+	relatesTo, _ = sent[2]["m.relates_to"].(map[string]interface{})
+	if relatesTo["rel_type"] != "m.replace" || relatesTo["event_id"] != "$1" {
+		t.Errorf("Expected an edit of $1, got m.relates_to %v", relatesTo)
+	}
+	slackEvent(`{"type":"message","subtype":"message_deleted","channel":"C123","deleted_ts":"1000.000300"}`)
+	if len(redacted) != 1 || !strings.Contains(redacted[0], "/$2/") {
+		t.Errorf("Expected $2 to be redacted, got %v", redacted)
+	}
+	// Messages in other channels, and the service's own messages, aren't bridged
+	slackEvent(`{"type":"message","channel":"COTHER","user":"UZELDA","text":"Elsewhere","ts":"1000.000400"}`)
+	slackEvent(`{"type":"message","subtype":"bot_message","channel":"C123","bot_id":"BBOT","text":"Echo","ts":"1000.000500"}`)
+	if len(sent) != 3 {
+		t.Errorf("Expected no more messages in Matrix, got %v", sent[3:])
+	}
+	// Retries of events which have been received are dropped
+	retried := `{"type":"event_callback","event_id":"Ev1","event":{"type":"message","channel":"C123","user":"UZELDA","text":"Again","ts":"1000.000600"}}`
+	deliver(retried, "")
+	deliver(retried, "1")
+	if len(sent) != 4 {
+		t.Errorf("Expected the retried event to be bridged once, got %v", sent[3:])
+	}
+
+	// Matrix -> Slack
+	observer := srv.(types.MessageObserver)
+	matrixEvent := func(evType mevt.Type, eventID, redacts string, content map[string]interface{}) {
+		observer.OnMessage(matrixCli, &mevt.Event{
+			Type:    evType,
+			ID:      id.EventID(eventID),
+			RoomID:  "!castle:hyrule",
+			Sender:  "@link:hyrule",
+			Redacts: id.EventID(redacts),
+			Content: mevt.Content{Raw: content},
+		})
+	}
+	slackCalls = nil
+	slackParams = nil
+	matrixEvent(mevt.EventMessage, "$hey", "", map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "Hey <listen>",
+		"m.relates_to": map[string]interface{}{
+			"rel_type": "m.thread",
+			"event_id": "$1",
+		},
+	})
+	if len(slackCalls) != 1 || slackCalls[0] != "chat.postMessage" {
+		t.Fatalf("Expected chat.postMessage, got %v", slackCalls)
+	}
+	params := slackParams[0]
+	if params["text"] != "Hey &lt;listen&gt;" || params["username"] != "Link" || params["thread_ts"] != "1000.000100" ||
+		params["icon_url"] != "https://hyrule/_matrix/media/r0/download/hyrule/link" {
+		t.Errorf("Bad chat.postMessage parameters: %v", params)
+	}
+	matrixEvent(mevt.EventMessage, "$edit", "", map[string]interface{}{
+		"msgtype":       "m.text",
+		"body":          "* Hey, listen",
+		"m.new_content": map[string]interface{}{"msgtype": "m.text", "body": "Hey, listen"},
+		"m.relates_to":  map[string]interface{}{"rel_type": "m.replace", "event_id": "$hey"},
+	})
+	if len(slackCalls) != 2 || slackCalls[1] != "chat.update" || slackParams[1]["ts"] != "2000.000200" || slackParams[1]["text"] != "Hey, listen" {
+		t.Errorf("Expected chat.update of 2000.000200, got %v %v", slackCalls, slackParams)
+	}
+	matrixEvent(mevt.EventRedaction, "$redact", "$hey", map[string]interface{}{})
+	if len(slackCalls) != 3 || slackCalls[2] != "chat.delete" || slackParams[2]["ts"] != "2000.000200" {
+		t.Errorf("Expected chat.delete of 2000.000200, got %v %v", slackCalls, slackParams)
+	}
+	if _, ok := store.State["id matrix $hey"]; ok {
+		t.Errorf("Expected the deleted message to be forgotten")
+	}
+}
@@ -0,0 +1,119 @@
+package socialfeed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jaytaylor/html2text"
+)
+
+// mastodonSource reads the public posts of accounts on Mastodon, or other fediverse servers with
+// Mastodon's API.
+type mastodonSource struct {
+	host string
+}
+
+type mastodonStatus struct {
+	ID          string `json:"id"`
+	URL         string `json:"url"`
+	Content     string `json:"content"`
+	SpoilerText string `json:"spoiler_text"`
+	Account     struct {
+		Acct        string `json:"acct"`
+		DisplayName string `json:"display_name"`
+	} `json:"account"`
+	Reblog           *mastodonStatus `json:"reblog"`
+	MediaAttachments []struct {
+		Type        string `json:"type"`
+		URL         string `json:"url"`
+		Description string `json:"description"`
+	} `json:"media_attachments"`
+}
+
+func (m *mastodonSource) get(path string, q url.Values, v interface{}) error {
+	u := "https://" + m.host + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	res, err := httpClient.Get(u)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (m *mastodonSource) lookup(username string) (string, error) {
+	var account struct {
+		ID string `json:"id"`
+	}
+	if err := m.get("/api/v1/accounts/lookup", url.Values{"acct": {username}}, &account); err != nil {
+		return "", err
+	}
+	return account.ID, nil
+}
+
+func (m *mastodonSource) posts(accountID, sinceID string, feed *Feed) ([]post, error) {
+	q := url.Values{}
+	if sinceID == "" {
+		q.Set("limit", "1")
+	} else {
+		q.Set("limit", strconv.Itoa(fetchLimit))
+		q.Set("since_id", sinceID)
+	}
+	if !feed.IncludeReplies {
+		q.Set("exclude_replies", "true")
+	}
+	if !feed.IncludeReposts {
+		q.Set("exclude_reblogs", "true")
+	}
+	var statuses []mastodonStatus
+	if err := m.get("/api/v1/accounts/"+url.PathEscape(accountID)+"/statuses", q, &statuses); err != nil {
+		return nil, err
+	}
+	var posts []post
+	for _, status := range statuses {
+		p := post{
+			ID:     status.ID,
+			Author: status.Account.DisplayName,
+			Handle: "@" + status.Account.Acct + "@" + m.host,
+		}
+		original := &status
+		if status.Reblog != nil {
+			original = status.Reblog
+			p.RepostOf = "@" + original.Account.Acct
+		}
+		text, err := html2text.FromString(original.Content, html2text.Options{OmitLinks: true})
+		if err != nil {
+			return nil, err
+		}
+		p.Text = strings.TrimSpace(text)
+		p.Warning = original.SpoilerText
+		p.URL = original.URL
+		for _, attachment := range original.MediaAttachments {
+			kind := attachment.Type
+			if kind == "gifv" {
+				kind = "video"
+			}
+			p.Media = append(p.Media, media{
+				Kind:        kind,
+				URL:         attachment.URL,
+				Description: attachment.Description,
+			})
+		}
+		posts = append(posts, p)
+	}
+	return posts, nil
+}
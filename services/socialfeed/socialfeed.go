@@ -0,0 +1,363 @@
+// Package socialfeed implements a Service which relays the posts of Mastodon and Twitter accounts
+// into rooms.
+package socialfeed
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Social feed service
+const ServiceType = "socialfeed"
+
+const (
+	defaultPollInterval = 5 * time.Minute
+	minPollIntervalMins = 1
+	// How many posts are asked for each poll
+	fetchLimit = 20
+	// How many posts are relayed each poll, so that a burst of posts doesn't flood rooms
+	maxPostsPerPoll = 5
+	// How many of a post's attachments are re-uploaded
+	maxMediaPerPost = 4
+)
+
+var (
+	// e.g. @Gargron@mastodon.social
+	fediverseAccountRegex = regexp.MustCompile(`^@([A-Za-z0-9_]+(?:[.-][A-Za-z0-9_]+)*)@([A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)+)$`)
+	// e.g. @NASA
+	twitterAccountRegex = regexp.MustCompile(`^@([A-Za-z0-9_]{1,15})$`)
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// errNotFound is returned by sources when the account doesn't exist.
+var errNotFound = errors.New("account not found")
+
+// Service contains the Config fields for the Social feed service.
+//
+// Each feed is keyed by its account: "@user@server" for Mastodon and other fediverse servers with
+// Mastodon's API, or "@user" for Twitter, which needs the bearer token of a Twitter app. New
+// posts are relayed into the feed's rooms, with their images and videos re-uploaded to Matrix.
+// Replies and boosts or retweets are left out unless the feed includes them.
+//
+// The posts made before a feed is added are not relayed.
+//
+// Example JSON request:
+//   {
+//       "twitter_bearer_token": "AAAAAAAAAAAAAAAAAAAAA...",
+//       "feeds": {
+//           "@Gargron@mastodon.social": {
+//               "rooms": ["!fediverse:localhost"],
+//               "include_reposts": true
+//           },
+//           "@NASA": {
+//               "rooms": ["!space:localhost"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. How often to check the feeds for new posts, in minutes. Defaults to 5.
+	PollIntervalMins int `json:"poll_interval_mins"`
+	// The bearer token of a Twitter app. Required to follow Twitter accounts.
+	TwitterBearerToken string `json:"twitter_bearer_token"`
+	// The accounts to follow.
+	Feeds map[string]Feed `json:"feeds"`
+}
+
+// Feed is which of an account's posts are relayed, and where.
+type Feed struct {
+	// The rooms to relay posts into.
+	Rooms []id.RoomID `json:"rooms"`
+	// Optional. Relay the account's replies. Defaults to false.
+	IncludeReplies bool `json:"include_replies"`
+	// Optional. Relay the account's boosts or retweets of other accounts' posts. Defaults to false.
+	IncludeReposts bool `json:"include_reposts"`
+}
+
+// post is a toot or tweet, in the form the service relays it.
+type post struct {
+	ID string
+	// The display name of the account, if known
+	Author string
+	Handle string
+	// Optional. The account whose post this is a boost of.
+	RepostOf string
+	// Optional. The content warning which the text is hidden behind.
+	Warning string
+	Text    string
+	URL     string
+	Media   []media
+}
+
+type media struct {
+	// "image", "video" or "audio"
+	Kind        string
+	URL         string
+	Description string
+}
+
+// A source reads the posts of accounts on a network.
+type source interface {
+	// lookup returns the ID of the account with the username, or errNotFound.
+	lookup(username string) (string, error)
+	// posts returns the account's posts since sinceID, newest first. If sinceID is empty, only
+	// the latest posts are returned.
+	posts(accountID, sinceID string, feed *Feed) ([]post, error)
+}
+
+// source returns the source which reads the account, and the account's username on it.
+func (s *Service) source(account string) (source, string) {
+	if m := fediverseAccountRegex.FindStringSubmatch(account); m != nil {
+		return &mastodonSource{host: strings.ToLower(m[2])}, m[1]
+	}
+	m := twitterAccountRegex.FindStringSubmatch(account)
+	return &twitterSource{bearerToken: s.TwitterBearerToken, username: m[1]}, m[1]
+}
+
+// cursor is where an account's posts were last read up to. It is stored in the service state
+// under "cursor <account>".
+type cursor struct {
+	AccountID string `json:"account_id"`
+	LastSeen  string `json:"last_seen"`
+}
+
+func (s *Service) pollInterval() time.Duration {
+	if s.PollIntervalMins <= 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(s.PollIntervalMins) * time.Minute
+}
+
+// OnPoll relays the posts made by each account since the last poll.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	s.check(cli)
+	return time.Now().Add(s.pollInterval())
+}
+
+func (s *Service) check(cli types.MatrixClient) {
+	var accounts []string
+	for account := range s.Feeds {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+	for _, account := range accounts {
+		feed := s.Feeds[account]
+		if err := s.checkFeed(cli, account, &feed); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey:   err,
+				"service_id":   s.ServiceID(),
+				"service_type": s.ServiceType(),
+				"account":      account,
+			}).Error("Failed to check feed")
+		}
+	}
+}
+
+func (s *Service) checkFeed(cli types.MatrixClient, account string, feed *Feed) error {
+	src, username := s.source(account)
+	stateKey := "cursor " + account
+	c, err := s.loadCursor(stateKey)
+	if err != nil {
+		return err
+	}
+	if c.AccountID == "" {
+		if c.AccountID, err = src.lookup(username); err != nil {
+			return fmt.Errorf("Failed to look up %s: %s", account, err)
+		}
+	}
+	posts, err := src.posts(c.AccountID, c.LastSeen, feed)
+	if err != nil {
+		return err
+	}
+	firstPoll := c.LastSeen == ""
+	if len(posts) > 0 {
+		c.LastSeen = posts[0].ID
+	}
+	// Remember the posts first, so that they aren't relayed again if sending fails
+	if err = s.storeCursor(stateKey, c); err != nil {
+		return err
+	}
+	if firstPoll || len(posts) == 0 {
+		return nil
+	}
+	if len(posts) > maxPostsPerPoll {
+		posts = posts[:maxPostsPerPoll]
+	}
+
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"account":    account,
+	})
+	// Oldest first
+	for i := len(posts) - 1; i >= 0; i-- {
+		p := posts[i]
+		contents := []mevt.MessageEventContent{postContent(&p)}
+		for j, m := range p.Media {
+			if j == maxMediaPerPost {
+				break
+			}
+			mediaContent, err := uploadMedia(cli, &m)
+			if err != nil {
+				logger.WithError(err).WithField("media_url", m.URL).Error("Failed to upload media")
+				continue
+			}
+			contents = append(contents, *mediaContent)
+		}
+		for _, roomID := range feed.Rooms {
+			for _, content := range contents {
+				if _, err := notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: content}); err != nil {
+					logger.WithError(err).WithField("room_id", roomID).Error("Failed to relay post")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// postContent returns the message a post is relayed in: who posted it, its text and a link.
+func postContent(p *post) mevt.MessageEventContent {
+	author := p.Handle
+	htmlAuthor := html.EscapeString(p.Handle)
+	if p.Author != "" {
+		author = fmt.Sprintf("%s (%s)", p.Author, p.Handle)
+		htmlAuthor = fmt.Sprintf("<strong>%s</strong> (%s)", html.EscapeString(p.Author), html.EscapeString(p.Handle))
+	}
+	if p.RepostOf != "" {
+		author += " boosted " + p.RepostOf
+		htmlAuthor += " boosted " + html.EscapeString(p.RepostOf)
+	}
+	body := author + ":\n"
+	formatted := htmlAuthor + ":<br>"
+	text := html.EscapeString(p.Text)
+	text = strings.Replace(text, "\n", "<br>", -1)
+	if p.Warning != "" {
+		body += "CW: " + p.Warning + "\n"
+		formatted += fmt.Sprintf(`<span data-mx-spoiler="%s">%s</span>`, html.EscapeString(p.Warning), text)
+	} else {
+		formatted += text
+	}
+	body += p.Text
+	if p.URL != "" {
+		body += "\n" + p.URL
+		formatted += fmt.Sprintf(`<br><a href="%s">%s</a>`, html.EscapeString(p.URL), html.EscapeString(p.URL))
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgText,
+		Body:          body,
+		Format:        mevt.FormatHTML,
+		FormattedBody: formatted,
+	}
+}
+
+// uploadMedia re-uploads the attachment to Matrix, returning the message to send it in.
+func uploadMedia(cli types.MatrixClient, m *media) (*mevt.MessageEventContent, error) {
+	resUpload, err := cli.UploadLink(m.URL)
+	if err != nil {
+		return nil, err
+	}
+	msgType := mevt.MsgImage
+	switch m.Kind {
+	case "video":
+		msgType = mevt.MsgVideo
+	case "audio":
+		msgType = mevt.MsgAudio
+	}
+	body := m.Description
+	var mimeType string
+	if u, err := url.Parse(m.URL); err == nil {
+		mimeType = mime.TypeByExtension(path.Ext(u.Path))
+		if body == "" {
+			body = path.Base(u.Path)
+		}
+	}
+	return &mevt.MessageEventContent{
+		MsgType: msgType,
+		Body:    body,
+		URL:     resUpload.ContentURI.CUString(),
+		Info: &mevt.FileInfo{
+			MimeType: mimeType,
+		},
+	}, nil
+}
+
+func (s *Service) loadCursor(stateKey string) (*cursor, error) {
+	c := &cursor{}
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), stateKey)
+	if err == sql.ErrNoRows {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(stateJSON, c)
+	return c, err
+}
+
+func (s *Service) storeCursor(stateKey string, c *cursor) error {
+	stateJSON, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), stateKey, stateJSON)
+}
+
+// Register makes sure that the feeds are configured properly, and joins their rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.PollIntervalMins < 0 || (s.PollIntervalMins > 0 && s.PollIntervalMins < minPollIntervalMins) {
+		return fmt.Errorf("poll_interval_mins can't be less than %d", minPollIntervalMins)
+	}
+	if len(s.Feeds) == 0 {
+		return fmt.Errorf("At least one feed is required")
+	}
+	rooms := make(map[id.RoomID]bool)
+	for account, feed := range s.Feeds {
+		if twitterAccountRegex.MatchString(account) {
+			if s.TwitterBearerToken == "" {
+				return fmt.Errorf("A twitter_bearer_token is required to follow %s", account)
+			}
+		} else if !fediverseAccountRegex.MatchString(account) {
+			return fmt.Errorf("Bad account '%s': must be @user@server or @user for Twitter", account)
+		}
+		if len(feed.Rooms) == 0 {
+			return fmt.Errorf("Feed %s has no rooms to relay posts into", account)
+		}
+		for _, roomID := range feed.Rooms {
+			rooms[roomID] = true
+		}
+	}
+	for roomID := range rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package socialfeed
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestPoll(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	lookups := 0
+	statuses := `[{"id": "100", "content": "<p>Old toot</p>", "account": {"acct": "zelda", "display_name": "Zelda"}}]`
+	tweets := `{"data": [{"id": "500", "text": "Old tweet"}]}`
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		q := req.URL.Query()
+		body := ""
+		switch {
+		case req.URL.String() == "https://castle.hyrule/api/v1/accounts/lookup?acct=zelda":
+			lookups++
+			body = `{"id": "7"}`
+		case strings.HasPrefix(req.URL.String(), "https://castle.hyrule/api/v1/accounts/7/statuses?"):
+			if q.Get("exclude_replies") != "true" || q.Get("exclude_reblogs") != "" {
+				return nil, fmt.Errorf("Bad query: %s", req.URL.String())
+			}
+			body = statuses
+		case req.URL.String() == "https://api.twitter.com/2/users/by/username/Link":
+			body = `{"data": {"id": "42", "name": "Link", "username": "Link"}}`
+		case strings.HasPrefix(req.URL.String(), "https://api.twitter.com/2/users/42/tweets?"):
+			if req.Header.Get("Authorization") != "Bearer hylian_shield" || q.Get("exclude") != "replies,retweets" {
+				return nil, fmt.Errorf("Bad request: %s", req.URL.String())
+			}
+			if q.Get("since_id") != "" && q.Get("since_id") != "500" {
+				return nil, fmt.Errorf("Bad since_id: %s", req.URL.String())
+			}
+			body = tweets
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		switch {
+		case strings.Contains(req.URL.String(), "/join"):
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		case strings.HasPrefix(req.URL.String(), "https://media.hyrule/"):
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Type": {"image/png"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString("\x89PNG")),
+			}, nil
+		case strings.Contains(req.URL.String(), "/upload"):
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://hyrule/media"}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, fmt.Sprintf("%s %s %s", room, msg.MsgType, msg.Body))
+		if strings.Contains(msg.FormattedBody, "Secret") && !strings.Contains(msg.FormattedBody, `<span data-mx-spoiler="Spoilers">Secret &amp; safe</span>`) {
+			t.Errorf("Bad HTML: %s", msg.FormattedBody)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$post:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"twitter_bearer_token": "hylian_shield",
+		"feeds": {
+			"@zelda@castle.hyrule": {"rooms": ["!castle:hyrule"], "include_reposts": true},
+			"@Link": {"rooms": ["!adventure:hyrule"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create socialfeed service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register socialfeed service: ", err)
+	}
+	s := srv.(*Service)
+
+	s.check(matrixCli)
+	if len(sent) != 0 {
+		t.Errorf("Relayed posts made before the feeds were added: %v", sent)
+	}
+
+	// Newest first
+	statuses = `[
+		{"id": "102", "url": "https://castle.hyrule/@impa/9", "account": {"acct": "zelda", "display_name": "Zelda"},
+			"reblog": {"id": "9", "url": "https://castle.hyrule/@impa/9", "content": "<p>Secret &amp; safe</p>", "spoiler_text": "Spoilers",
+				"account": {"acct": "impa", "display_name": "Impa"}}},
+		{"id": "101", "url": "https://castle.hyrule/@zelda/101", "content": "<p>The <a href=\"https://triforce.hyrule\">Triforce</a><br>is safe</p>",
+			"account": {"acct": "zelda", "display_name": "Zelda"},
+			"media_attachments": [{"type": "image", "url": "https://media.hyrule/triforce.png", "description": "The Triforce"}]}
+	]`
+	tweets = `{"data": [{"id": "501", "text": "Found a heart &amp; a rupee", "attachments": {"media_keys": ["3_1"]}}],
+		"includes": {"media": [{"media_key": "3_1", "type": "video", "preview_image_url": "https://media.hyrule/heart.jpg"}]}}`
+	s.check(matrixCli)
+	statuses = `[]`
+	tweets = `{"meta": {"result_count": 0}}`
+	s.check(matrixCli)
+
+	if lookups != 1 {
+		t.Errorf("Expected the account to be looked up once, was looked up %d times", lookups)
+	}
+	want := []string{
+		"!adventure:hyrule m.text @Link:\nFound a heart & a rupee\nhttps://twitter.com/Link/status/501",
+		"!adventure:hyrule m.image heart.jpg",
+		"!castle:hyrule m.text Zelda (@zelda@castle.hyrule):\nThe Triforce\nis safe\nhttps://castle.hyrule/@zelda/101",
+		"!castle:hyrule m.image The Triforce",
+		"!castle:hyrule m.text Zelda (@zelda@castle.hyrule) boosted @impa:\nCW: Spoilers\nSecret & safe\nhttps://castle.hyrule/@impa/9",
+	}
+	if strings.Join(sent, "\n\n") != strings.Join(want, "\n\n") {
+		t.Errorf("Bad messages: got %q, want %q", sent, want)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"feeds": {"@Link": {"rooms": ["!a:hyrule"]}}}`,
+		`{"feeds": {"zelda@castle.hyrule": {"rooms": ["!a:hyrule"]}}}`,
+		`{"feeds": {"@zelda@castle.hyrule": {}}}`,
+		`{"poll_interval_mins": -1, "feeds": {"@zelda@castle.hyrule": {"rooms": ["!a:hyrule"]}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create socialfeed service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
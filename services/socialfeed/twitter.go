@@ -0,0 +1,137 @@
+package socialfeed
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Twitter's API. Overridden by tests.
+var twitterAPIURL = "https://api.twitter.com/2/"
+
+// Twitter won't return fewer tweets than this
+const twitterMinResults = 5
+
+// twitterSource reads tweets with Twitter's v2 API, which needs an app's bearer token.
+type twitterSource struct {
+	bearerToken string
+	username    string
+}
+
+type twitterTimeline struct {
+	Data []struct {
+		ID          string `json:"id"`
+		Text        string `json:"text"`
+		Attachments struct {
+			MediaKeys []string `json:"media_keys"`
+		} `json:"attachments"`
+	} `json:"data"`
+	Includes struct {
+		Media []struct {
+			MediaKey        string `json:"media_key"`
+			Type            string `json:"type"`
+			URL             string `json:"url"`
+			PreviewImageURL string `json:"preview_image_url"`
+			AltText         string `json:"alt_text"`
+		} `json:"media"`
+	} `json:"includes"`
+}
+
+func (t *twitterSource) get(path string, q url.Values, v interface{}) error {
+	u := twitterAPIURL + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.bearerToken)
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (t *twitterSource) lookup(username string) (string, error) {
+	var body struct {
+		Data *struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := t.get("users/by/username/"+url.PathEscape(username), nil, &body); err != nil {
+		return "", err
+	}
+	// Twitter describes unknown users in "errors", rather than with a 404
+	if body.Data == nil {
+		return "", errNotFound
+	}
+	return body.Data.ID, nil
+}
+
+func (t *twitterSource) posts(accountID, sinceID string, feed *Feed) ([]post, error) {
+	q := url.Values{
+		"expansions":   {"attachments.media_keys"},
+		"media.fields": {"type,url,preview_image_url,alt_text"},
+	}
+	if sinceID == "" {
+		q.Set("max_results", strconv.Itoa(twitterMinResults))
+	} else {
+		q.Set("max_results", strconv.Itoa(fetchLimit))
+		q.Set("since_id", sinceID)
+	}
+	var exclude []string
+	if !feed.IncludeReplies {
+		exclude = append(exclude, "replies")
+	}
+	if !feed.IncludeReposts {
+		exclude = append(exclude, "retweets")
+	}
+	if len(exclude) > 0 {
+		q.Set("exclude", strings.Join(exclude, ","))
+	}
+	var timeline twitterTimeline
+	if err := t.get("users/"+url.PathEscape(accountID)+"/tweets", q, &timeline); err != nil {
+		return nil, err
+	}
+	mediaByKey := make(map[string]media)
+	for _, m := range timeline.Includes.Media {
+		// Only photos have a URL. Videos and GIFs are posted as their preview images.
+		link := m.URL
+		if link == "" {
+			link = m.PreviewImageURL
+		}
+		mediaByKey[m.MediaKey] = media{Kind: "image", URL: link, Description: m.AltText}
+	}
+	var posts []post
+	for _, tweet := range timeline.Data {
+		p := post{
+			ID:     tweet.ID,
+			Handle: "@" + t.username,
+			// Twitter escapes &, < and > in tweets
+			Text: html.UnescapeString(tweet.Text),
+			URL:  fmt.Sprintf("https://twitter.com/%s/status/%s", t.username, tweet.ID),
+		}
+		for _, key := range tweet.Attachments.MediaKeys {
+			if m, ok := mediaByKey[key]; ok && m.URL != "" {
+				p.Media = append(p.Media, m)
+			}
+		}
+		posts = append(posts, p)
+	}
+	return posts, nil
+}
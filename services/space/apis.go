@@ -0,0 +1,173 @@
+package space
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The APIs. Overridden by tests.
+var (
+	launchLibraryURL = "https://ll.thespacedevs.com/2.2.0/"
+	n2yoURL          = "https://api.n2yo.com/rest/v1/"
+	apodURL          = "https://api.nasa.gov/planetary/apod"
+)
+
+var httpClient = &http.Client{}
+
+// The NORAD ID of the International Space Station
+const issNoradID = 25544
+
+// launch is an upcoming rocket launch.
+type launch struct {
+	ID string
+	// e.g. "Falcon 9 Block 5 | Starlink Group 6-1"
+	Name     string
+	Provider string
+	// e.g. "Cape Canaveral, FL, USA"
+	Location string
+	// The "no earlier than" time
+	NET time.Time
+	// e.g. "Go for Launch", "To Be Determined"
+	Status       string
+	StatusAbbrev string
+}
+
+// pass is a visible pass of the ISS over a location.
+type pass struct {
+	Start, Max, End time.Time
+	// Compass directions, e.g. "NW"
+	StartDir, MaxDir, EndDir string
+	// The highest the ISS gets above the horizon, in degrees
+	MaxElevation float64
+	// How bright the ISS is. Lower is brighter.
+	Magnitude float64
+}
+
+// apod is NASA's Astronomy Picture of the Day.
+type apod struct {
+	Date        string `json:"date"`
+	Title       string `json:"title"`
+	Explanation string `json:"explanation"`
+	// "image" or "video"
+	MediaType string `json:"media_type"`
+	URL       string `json:"url"`
+	Copyright string `json:"copyright"`
+}
+
+// fetchLaunches returns the next few launches, soonest first.
+func fetchLaunches() ([]launch, error) {
+	var upcoming struct {
+		Results []struct {
+			ID     string `json:"id"`
+			Name   string `json:"name"`
+			NET    string `json:"net"`
+			Status struct {
+				Name   string `json:"name"`
+				Abbrev string `json:"abbrev"`
+			} `json:"status"`
+			Provider struct {
+				Name string `json:"name"`
+			} `json:"launch_service_provider"`
+			Pad struct {
+				Location struct {
+					Name string `json:"name"`
+				} `json:"location"`
+			} `json:"pad"`
+		} `json:"results"`
+	}
+	if err := getJSON(launchLibraryURL+"launch/upcoming/?limit=10", &upcoming); err != nil {
+		return nil, err
+	}
+	var launches []launch
+	for _, r := range upcoming.Results {
+		net, err := time.Parse(time.RFC3339, r.NET)
+		if err != nil {
+			continue
+		}
+		launches = append(launches, launch{
+			ID:           r.ID,
+			Name:         r.Name,
+			Provider:     r.Provider.Name,
+			Location:     r.Pad.Location.Name,
+			NET:          net,
+			Status:       r.Status.Name,
+			StatusAbbrev: r.Status.Abbrev,
+		})
+	}
+	return launches, nil
+}
+
+// fetchPasses returns the visible passes of the ISS over the location in the next day.
+func fetchPasses(apiKey string, loc *ISSLocation) ([]pass, error) {
+	q := url.Values{}
+	q.Set("apiKey", apiKey)
+	u := fmt.Sprintf("%ssatellite/visualpasses/%d/%s/%s/%s/1/60/?%s", n2yoURL, issNoradID,
+		strconv.FormatFloat(loc.Lat, 'f', -1, 64), strconv.FormatFloat(loc.Lon, 'f', -1, 64),
+		strconv.FormatFloat(loc.AltitudeM, 'f', -1, 64), q.Encode())
+	var passes struct {
+		Error  string `json:"error"`
+		Passes []struct {
+			StartUTC       int64   `json:"startUTC"`
+			StartAzCompass string  `json:"startAzCompass"`
+			MaxUTC         int64   `json:"maxUTC"`
+			MaxAzCompass   string  `json:"maxAzCompass"`
+			MaxEl          float64 `json:"maxEl"`
+			EndUTC         int64   `json:"endUTC"`
+			EndAzCompass   string  `json:"endAzCompass"`
+			Mag            float64 `json:"mag"`
+		} `json:"passes"`
+	}
+	if err := getJSON(u, &passes); err != nil {
+		return nil, err
+	}
+	// N2YO reports bad API keys in the body
+	if passes.Error != "" {
+		return nil, fmt.Errorf("%s", passes.Error)
+	}
+	var result []pass
+	for _, p := range passes.Passes {
+		result = append(result, pass{
+			Start:        time.Unix(p.StartUTC, 0).UTC(),
+			Max:          time.Unix(p.MaxUTC, 0).UTC(),
+			End:          time.Unix(p.EndUTC, 0).UTC(),
+			StartDir:     p.StartAzCompass,
+			MaxDir:       p.MaxAzCompass,
+			EndDir:       p.EndAzCompass,
+			MaxElevation: p.MaxEl,
+			Magnitude:    p.Mag,
+		})
+	}
+	return result, nil
+}
+
+// fetchAPOD returns the picture of the day on the date, as "2006-01-02", or today's if it is "".
+func fetchAPOD(apiKey, date string) (*apod, error) {
+	q := url.Values{}
+	q.Set("api_key", apiKey)
+	if date != "" {
+		q.Set("date", date)
+	}
+	var pic apod
+	if err := getJSON(apodURL+"?"+q.Encode(), &pic); err != nil {
+		return nil, err
+	}
+	return &pic, nil
+}
+
+func getJSON(u string, out interface{}) error {
+	res, err := httpClient.Get(u)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,454 @@
+// Package space implements a Service which announces rocket launches and ISS passes, and posts
+// NASA's Astronomy Picture of the Day.
+package space
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Space service
+const ServiceType = "space"
+
+// How often launches and passes are checked by default, and at most. The Launch Library only
+// allows 15 requests an hour without a subscription.
+const (
+	defaultPollInterval = 10 * time.Minute
+	minPollInterval     = 5 * time.Minute
+)
+
+// How long before launches and passes rooms are told about them, unless they configure their own
+const (
+	defaultLaunchNotice = time.Hour
+	defaultPassNotice   = 15 * time.Minute
+)
+
+// NASA's API key for trying its APIs out, which allows 30 requests an hour
+const demoNASAKey = "DEMO_KEY"
+
+var dateRegex = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+
+// Service contains the Config fields for the Space service.
+//
+// This service announces upcoming rocket launches from the Launch Library
+// (https://thespacedevs.com/llapi), and visible passes of the International Space Station over
+// a room's location from N2YO (https://www.n2yo.com/api/), which needs an API key. It also
+// responds to "!launch next" and "!apod", which posts NASA's Astronomy Picture of the Day.
+//
+// Example JSON request:
+//   {
+//       "nasa_api_key": "DEMO_KEY",
+//       "n2yo_api_key": "ABCDEF-GHIJKL-MNOPQR-1234",
+//       "rooms": {
+//           "!space:localhost": {
+//               "launches": true,
+//               "launch_notice_mins": 60,
+//               "iss": {
+//                   "name": "London",
+//                   "lat": 51.51,
+//                   "lon": -0.13,
+//                   "timezone": "Europe/London",
+//                   "notice_mins": 15
+//               }
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The NASA API key for !apod. Defaults to NASA's demo key, which is heavily rate
+	// limited. Keys are free from https://api.nasa.gov/
+	NASAAPIKey string `json:"nasa_api_key"`
+	// The N2YO API key. Required if any room is told about ISS passes.
+	N2YOAPIKey string `json:"n2yo_api_key"`
+	// Optional. How often to check for launches and passes, in minutes. Defaults to 10, and can't
+	// be less than 5.
+	PollIntervalMins int `json:"poll_interval_mins"`
+	// Optional. The rooms to tell about launches and passes.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is what a room is told about.
+type RoomConfig struct {
+	// Optional. Announce rocket launches.
+	Launches bool `json:"launches"`
+	// Optional. How long before launches to announce them, in minutes. Defaults to 60.
+	LaunchNoticeMins int `json:"launch_notice_mins"`
+	// Optional. Announce visible passes of the ISS over this location.
+	ISS *ISSLocation `json:"iss"`
+}
+
+// ISSLocation is where ISS passes are seen from.
+type ISSLocation struct {
+	// Optional. What to call the location in announcements.
+	Name string  `json:"name"`
+	Lat  float64 `json:"lat"`
+	Lon  float64 `json:"lon"`
+	// Optional. The height of the location above sea level, in metres.
+	AltitudeM float64 `json:"altitude_m"`
+	// Optional. The timezone to give pass times in, e.g. "Europe/London". Defaults to UTC.
+	Timezone string `json:"timezone"`
+	// Optional. How long before passes to announce them, in minutes. Defaults to 15.
+	NoticeMins int `json:"notice_mins"`
+}
+
+func (r *RoomConfig) launchNotice() time.Duration {
+	if r.LaunchNoticeMins <= 0 {
+		return defaultLaunchNotice
+	}
+	return time.Duration(r.LaunchNoticeMins) * time.Minute
+}
+
+func (l *ISSLocation) notice() time.Duration {
+	if l.NoticeMins <= 0 {
+		return defaultPassNotice
+	}
+	return time.Duration(l.NoticeMins) * time.Minute
+}
+
+func (l *ISSLocation) location() *time.Location {
+	if loc, err := time.LoadLocation(l.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// Commands supported:
+//    !launch next
+// Responds with the next rocket launch.
+//    !apod [YYYY-MM-DD]
+// Responds with NASA's Astronomy Picture of the Day, or the picture of an earlier day.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"launch", "next"},
+			Help: "Show the next rocket launch",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdLaunchNext()
+			},
+		},
+		{
+			Path:      []string{"apod"},
+			Arguments: []string{"[YYYY-MM-DD]"},
+			Help:      "Show NASA's Astronomy Picture of the Day",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdAPOD(cli, roomID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdLaunchNext() (interface{}, error) {
+	launches, err := fetchLaunches()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch launches: %s", err)
+	}
+	now := time.Now()
+	for _, l := range launches {
+		// Launches stay in the upcoming list for a while after they go
+		if l.NET.After(now) {
+			return launchMessage("🚀 Next launch: ", l, now), nil
+		}
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    "No upcoming launches found",
+	}, nil
+}
+
+func (s *Service) cmdAPOD(cli types.MatrixClient, roomID id.RoomID, args []string) (interface{}, error) {
+	var date string
+	if len(args) > 0 {
+		date = args[0]
+		if len(args) > 1 || !dateRegex.MatchString(date) {
+			return nil, fmt.Errorf("Usage: !apod [YYYY-MM-DD]")
+		}
+	}
+	apiKey := s.NASAAPIKey
+	if apiKey == "" {
+		apiKey = demoNASAKey
+	}
+	pic, err := fetchAPOD(apiKey, date)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch the Astronomy Picture of the Day: %s", err)
+	}
+
+	title := pic.Title
+	if pic.Copyright != "" {
+		title += " © " + strings.TrimSpace(pic.Copyright)
+	}
+	body := fmt.Sprintf("%s (%s)\n%s", title, pic.Date, pic.Explanation)
+	htmlBody := fmt.Sprintf("<strong>%s</strong> (%s)<br>%s",
+		html.EscapeString(title), html.EscapeString(pic.Date), html.EscapeString(pic.Explanation))
+	if pic.MediaType == "image" && pic.URL != "" {
+		resUpload, err := cli.UploadLink(pic.URL)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to upload the Astronomy Picture of the Day: %s", err)
+		}
+		if _, err = cli.SendMessageEvent(roomID, mevt.EventMessage, mevt.MessageEventContent{
+			MsgType: mevt.MsgImage,
+			Body:    pic.Title,
+			URL:     resUpload.ContentURI.CUString(),
+		}); err != nil {
+			return nil, err
+		}
+	} else if pic.URL != "" {
+		// Videos can't be uploaded, so are linked to
+		body += "\n" + pic.URL
+		htmlBody += fmt.Sprintf(`<br><a href="%s">%s</a>`, html.EscapeString(pic.URL), html.EscapeString(pic.URL))
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          body,
+		Format:        mevt.FormatHTML,
+		FormattedBody: htmlBody,
+	}, nil
+}
+
+// OnPoll announces the launches and ISS passes which are coming up soon to the rooms which want
+// them, once each.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	next := time.Now().Add(s.pollInterval())
+	announced, err := s.loadAnnounced()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load announcements")
+		return next
+	}
+	now := time.Now()
+	for key, forgetAt := range announced {
+		if now.After(forgetAt) {
+			delete(announced, key)
+		}
+	}
+
+	var launches []launch
+	if s.wantsLaunches() {
+		if launches, err = fetchLaunches(); err != nil {
+			logger.WithError(err).Error("Failed to fetch launches")
+		}
+	}
+	// Rooms in the same place share passes
+	passes := make(map[ISSLocation][]pass)
+
+	for _, roomID := range s.roomIDs() {
+		room := s.Rooms[roomID]
+		if room.Launches {
+			for _, l := range launches {
+				// Launches whose time isn't known yet aren't worth announcing. Including the time
+				// in the key announces launches again if they are delayed.
+				key := fmt.Sprintf("%s launch %s %d", roomID, l.ID, l.NET.Unix())
+				if l.StatusAbbrev == "TBD" || !l.NET.After(now) || l.NET.Sub(now) > room.launchNotice() {
+					continue
+				}
+				if _, ok := announced[key]; ok {
+					continue
+				}
+				announced[key] = l.NET.Add(24 * time.Hour)
+				s.send(cli, roomID, launchMessage("🚀 Launching soon: ", l, now), "space launch "+l.ID)
+			}
+		}
+		if room.ISS != nil {
+			locPasses, ok := passes[*room.ISS]
+			if !ok {
+				if locPasses, err = fetchPasses(s.N2YOAPIKey, room.ISS); err != nil {
+					logger.WithError(err).WithField("room_id", roomID).Error("Failed to fetch ISS passes")
+				}
+				passes[*room.ISS] = locPasses
+			}
+			for _, p := range locPasses {
+				key := fmt.Sprintf("%s iss %d", roomID, p.Start.Unix())
+				if !p.Start.After(now) || p.Start.Sub(now) > room.ISS.notice() {
+					continue
+				}
+				if _, ok := announced[key]; ok {
+					continue
+				}
+				announced[key] = p.End.Add(24 * time.Hour)
+				s.send(cli, roomID, passMessage(room.ISS, p, now), "")
+			}
+		}
+	}
+
+	if err = s.storeAnnounced(announced); err != nil {
+		logger.WithError(err).Error("Failed to store announcements")
+	}
+	return next
+}
+
+// send announces something in the room. Launches which are announced again because they have
+// been rescheduled are correlated with their first announcement.
+func (s *Service) send(cli types.MatrixClient, roomID id.RoomID, msg *mevt.MessageEventContent, correlationKey string) {
+	_, err := notify.Send(cli, s, notify.Notification{
+		RoomID:         roomID,
+		Content:        *msg,
+		CorrelationKey: correlationKey,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    roomID,
+			"service_id": s.ServiceID(),
+		}).Error("Failed to send announcement")
+	}
+}
+
+func (s *Service) wantsLaunches() bool {
+	for _, room := range s.Rooms {
+		if room.Launches {
+			return true
+		}
+	}
+	return false
+}
+
+// roomIDs returns the IDs of the configured rooms, sorted so that announcements are made in the
+// same order each time.
+func (s *Service) roomIDs() []id.RoomID {
+	var roomIDs []id.RoomID
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Slice(roomIDs, func(i, j int) bool { return roomIDs[i] < roomIDs[j] })
+	return roomIDs
+}
+
+func launchMessage(prefix string, l launch, now time.Time) *mevt.MessageEventContent {
+	title := prefix + l.Name
+	when := fmt.Sprintf("%s (in %s)", l.NET.UTC().Format("Mon 2 Jan 15:04 MST"), formatDuration(l.NET.Sub(now)))
+	details := []string{when}
+	if l.Provider != "" {
+		details = append(details, l.Provider)
+	}
+	if l.Location != "" {
+		details = append(details, l.Location)
+	}
+	if l.Status != "" {
+		details = append(details, l.Status)
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          title + "\n" + strings.Join(details, " · "),
+		Format:        mevt.FormatHTML,
+		FormattedBody: "<strong>" + html.EscapeString(title) + "</strong><br>" + html.EscapeString(strings.Join(details, " · ")),
+	}
+}
+
+func passMessage(loc *ISSLocation, p pass, now time.Time) *mevt.MessageEventContent {
+	title := "🛰️ The ISS passes over"
+	if loc.Name != "" {
+		title += " " + loc.Name
+	}
+	title += " in " + formatDuration(p.Start.Sub(now))
+	tz := loc.location()
+	details := fmt.Sprintf(
+		"Visible from %s, rising in the %s, highest at %.0f° in the %s, and setting in the %s at %s (magnitude %.1f)",
+		p.Start.In(tz).Format("15:04 MST"), p.StartDir, p.MaxElevation, p.MaxDir, p.EndDir,
+		p.End.In(tz).Format("15:04"), p.Magnitude,
+	)
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          title + "\n" + details,
+		Format:        mevt.FormatHTML,
+		FormattedBody: "<strong>" + html.EscapeString(title) + "</strong><br>" + html.EscapeString(details),
+	}
+}
+
+// formatDuration returns a rough duration, like "2 days", "3h 20m" or "15 minutes".
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%d days", d/(24*time.Hour))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh %dm", d/time.Hour, (d%time.Hour)/time.Minute)
+	case d == time.Minute:
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", d/time.Minute)
+}
+
+// loadAnnounced returns when each announcement which has been made can be forgotten. The keys
+// start with the room ID, then the kind of announcement.
+func (s *Service) loadAnnounced() (map[string]time.Time, error) {
+	announced := make(map[string]time.Time)
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "announced")
+	if err == sql.ErrNoRows {
+		return announced, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, &announced); err != nil {
+		return nil, err
+	}
+	return announced, nil
+}
+
+func (s *Service) storeAnnounced(announced map[string]time.Time) error {
+	stateJSON, err := json.Marshal(announced)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "announced", stateJSON)
+}
+
+func (s *Service) pollInterval() time.Duration {
+	if s.PollIntervalMins <= 0 {
+		return defaultPollInterval
+	}
+	if interval := time.Duration(s.PollIntervalMins) * time.Minute; interval > minPollInterval {
+		return interval
+	}
+	return minPollInterval
+}
+
+// Register makes sure that rooms told about ISS passes have a sensible location, and joins the
+// rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	for roomID, room := range s.Rooms {
+		if room.ISS == nil {
+			continue
+		}
+		if s.N2YOAPIKey == "" {
+			return fmt.Errorf("An n2yo_api_key is required for ISS passes")
+		}
+		if room.ISS.Lat < -90 || room.ISS.Lat > 90 || room.ISS.Lon < -180 || room.ISS.Lon > 180 {
+			return fmt.Errorf("The ISS location of room %s isn't on the map", roomID)
+		}
+		if _, err := time.LoadLocation(room.ISS.Timezone); err != nil {
+			return fmt.Errorf("Unknown timezone %q for room %s", room.ISS.Timezone, roomID)
+		}
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
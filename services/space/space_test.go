@@ -0,0 +1,169 @@
+package space
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+// mockAPIs mocks the APIs, with a launch and an ISS pass coming up soon after now, and returns
+// a Matrix client which records the messages it sends.
+func mockAPIs(t *testing.T, now time.Time, sent *[]string) *mautrix.Client {
+	soon, later := now.Add(30*time.Minute).Truncate(time.Second), now.Add(5*time.Hour).Truncate(time.Second)
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch req.URL.String() {
+		case "https://ll.thespacedevs.com/2.2.0/launch/upcoming/?limit=10":
+			body = fmt.Sprintf(`{"results":[
+				{"id":"gone","name":"Electron | Already Gone","net":"%s","status":{"name":"Launch Successful","abbrev":"Success"}},
+				{"id":"tbd","name":"Starship | Flight 9","net":"%s","status":{"name":"To Be Determined","abbrev":"TBD"}},
+				{"id":"f9","name":"Falcon 9 | Starlink","net":"%s","status":{"name":"Go for Launch","abbrev":"Go"},
+					"launch_service_provider":{"name":"SpaceX"},"pad":{"location":{"name":"Cape Canaveral, FL, USA"}}},
+				{"id":"ariane","name":"Ariane 6 | Galileo","net":"%s","status":{"name":"Go for Launch","abbrev":"Go"}}
+			]}`, now.Add(-time.Hour).Format(time.RFC3339), soon.Format(time.RFC3339), soon.Format(time.RFC3339),
+				later.Format(time.RFC3339))
+		case "https://api.n2yo.com/rest/v1/satellite/visualpasses/25544/51.51/-0.13/0/1/60/?apiKey=n2yo":
+			body = fmt.Sprintf(`{"passes":[
+				{"startUTC":%d,"startAzCompass":"W","maxUTC":%d,"maxAzCompass":"S","maxEl":45.2,"endUTC":%d,"endAzCompass":"E","mag":-3.1},
+				{"startUTC":%d,"startAzCompass":"W","maxUTC":%d,"maxAzCompass":"S","maxEl":20,"endUTC":%d,"endAzCompass":"E","mag":-1}
+			]}`, soon.Unix(), soon.Unix()+180, soon.Unix()+360, later.Unix(), later.Unix()+180, later.Unix()+360)
+		case "https://api.nasa.gov/planetary/apod?api_key=DEMO_KEY":
+			body = `{"date":"2021-06-04","title":"Saturn","explanation":"Rings.","media_type":"image",
+				"url":"https://apod.example/saturn.jpg","copyright":" Someone "}`
+		case "https://api.nasa.gov/planetary/apod?api_key=DEMO_KEY&date=2021-06-05":
+			body = `{"date":"2021-06-05","title":"Launch","explanation":"A video.","media_type":"video",
+				"url":"https://video.example/launch"}`
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch {
+		case strings.Contains(req.URL.String(), "/join"):
+			body = `{}`
+		case req.URL.String() == "https://apod.example/saturn.jpg":
+			body = "some image data"
+		case strings.Contains(req.URL.String(), "_matrix/media/r0/upload"):
+			body = `{"content_uri":"mxc://foo/saturn"}`
+		default:
+			var msg mevt.MessageEventContent
+			if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+				t.Fatalf("Failed to decode message: %s", err)
+			}
+			*sent = append(*sent, msg.Body)
+			body = `{"event_id":"$space:hyrule"}`
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+	return matrixCli
+}
+
+func TestOnPoll(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	now := time.Now()
+	var sent []string
+	matrixCli := mockAPIs(t, now, &sent)
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"n2yo_api_key": "n2yo",
+		"rooms": {
+			"!space:hyrule": {"launches": true, "iss": {"name": "London", "lat": 51.51, "lon": -0.13, "notice_mins": 45}}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create space service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register space service: ", err)
+	}
+	s := srv.(*Service)
+
+	// Each is only announced once
+	s.OnPoll(matrixCli)
+	s.OnPoll(matrixCli)
+
+	soon := now.Add(30 * time.Minute).Truncate(time.Second)
+	want := []string{
+		"🚀 Launching soon: Falcon 9 | Starlink\n" + soon.UTC().Format("Mon 2 Jan 15:04 MST") +
+			" (in 30 minutes) · SpaceX · Cape Canaveral, FL, USA · Go for Launch",
+		"🛰️ The ISS passes over London in 30 minutes\nVisible from " + soon.UTC().Format("15:04 MST") +
+			", rising in the W, highest at 45° in the S, and setting in the E at " +
+			soon.Add(6*time.Minute).UTC().Format("15:04") + " (magnitude -3.1)",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad announcements: got %q, want %q", sent, want)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	now := time.Now()
+	var sent []string
+	matrixCli := mockAPIs(t, now, &sent)
+	s := &Service{}
+
+	res, err := s.cmdLaunchNext()
+	if err != nil {
+		t.Fatalf("!launch next failed: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; !strings.HasPrefix(body, "🚀 Next launch: Starship | Flight 9\n") {
+		t.Errorf("Bad next launch: %q", body)
+	}
+
+	res, err = s.cmdAPOD(matrixCli, "!space:hyrule", nil)
+	if err != nil {
+		t.Fatalf("!apod failed: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "Saturn © Someone (2021-06-04)\nRings." {
+		t.Errorf("Bad picture of the day: %q", body)
+	}
+	if len(sent) != 1 || sent[0] != "Saturn" {
+		t.Errorf("Expected the picture to be sent, got %q", sent)
+	}
+	res, err = s.cmdAPOD(matrixCli, "!space:hyrule", []string{"2021-06-05"})
+	if err != nil {
+		t.Fatalf("!apod failed: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "Launch (2021-06-05)\nA video.\nhttps://video.example/launch" {
+		t.Errorf("Bad video of the day: %q", body)
+	}
+	if _, err = s.cmdAPOD(matrixCli, "!space:hyrule", []string{"yesterday"}); err == nil {
+		t.Errorf("Expected !apod yesterday to fail")
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	testCases := map[time.Duration]string{
+		time.Minute:                     "1 minute",
+		15*time.Minute + 20*time.Second: "15 minutes",
+		3*time.Hour + 20*time.Minute:    "3h 20m",
+		50 * time.Hour:                  "2 days",
+	}
+	for d, want := range testCases {
+		if got := formatDuration(d); got != want {
+			t.Errorf("formatDuration(%s) = %q, want %q", d, got, want)
+		}
+	}
+}
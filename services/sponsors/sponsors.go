@@ -0,0 +1,555 @@
+// Package sponsors implements a Service which thanks new sponsors and donors in a room.
+package sponsors
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	text "text/template"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/templates"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Sponsors service
+const ServiceType = "sponsors"
+
+// The platforms sponsorships come from
+const (
+	platformGitHub    = "GitHub Sponsors"
+	platformKofi      = "Ko-fi"
+	platformLiberapay = "Liberapay"
+)
+
+// How often Liberapay is checked for new patrons, and the monthly summary is checked for
+const pollInterval = time.Hour
+
+// Liberapay's public profile data, with %s being the username. Overridden by tests.
+var liberapayURL = "https://liberapay.com/%s/public.json"
+
+var httpClient = &http.Client{}
+
+// Webhooks can arrive at the same time as each other and the poll, and each one updates the
+// stored sponsorships.
+var sponsorshipsMutex sync.Mutex
+
+// Service contains the Config fields for the Sponsors service.
+//
+// New sponsors are thanked in the room when GitHub Sponsors or Ko-fi sends a webhook to the
+// webhook_url. GitHub Sponsors webhooks are checked with the webhook secret, and Ko-fi webhooks
+// with the verification token from https://ko-fi.com/manage/webhooks. Liberapay doesn't send
+// webhooks, so the number of patrons of liberapay_username is checked every hour instead. Its
+// patrons are often anonymous, so they are thanked together.
+//
+// The thank you message can be changed with text_template, which is a Go text/template (see
+// https://golang.org/pkg/text/template/) executed with a Sponsorship. Operators can instead
+// change it for every Sponsors service with a template override named "sponsors.new" (see
+// package "templates").
+//
+// On the first of each month, a summary of the last month's sponsorships is posted.
+//
+// Example JSON request:
+//   {
+//       "room_id": "!sponsors:localhost",
+//       "github_secret": "a_secret_for_github",
+//       "kofi_verification_token": "d2a8b2ad-9e5e-4c3c-a7e5-ca8ad3c5e1c1",
+//       "liberapay_username": "go-neb",
+//       "text_template": "Thank you {{.Name}} for {{.Amount}} {{.Currency}}!",
+//       "monthly_summary": true
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which GitHub Sponsors and Ko-fi should send webhooks to. Populated by Go-NEB after
+	// Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The room to thank sponsors in.
+	RoomID id.RoomID `json:"room_id"`
+	// Optional. The secret of the GitHub Sponsors webhook. Required for GitHub Sponsors.
+	GitHubSecret string `json:"github_secret"`
+	// Optional. The verification token of the Ko-fi webhook. Required for Ko-fi.
+	KofiVerificationToken string `json:"kofi_verification_token"`
+	// Optional. The Liberapay account to check for new patrons.
+	LiberapayUsername string `json:"liberapay_username"`
+	// Optional. The template for the thank you message.
+	TextTemplate string `json:"text_template"`
+	// Optional. Post a summary of each month's sponsorships at the start of the next.
+	MonthlySummary bool `json:"monthly_summary"`
+}
+
+// Sponsorship is a new sponsor or donation, which thank you templates are executed with.
+type Sponsorship struct {
+	// GitHub Sponsors, Ko-fi or Liberapay
+	Platform string
+	// The name of the sponsor, or empty if they are anonymous
+	Name string
+	// The sponsor's profile, if they have a public one
+	URL string
+	// The amount, e.g. "5.00", if it is known
+	Amount string
+	// The currency of the amount, e.g. "USD"
+	Currency string
+	// Whether the amount is paid every month, rather than once
+	Monthly bool
+	// The name of the sponsorship tier, if the platform has tiers
+	Tier string
+	// The message the sponsor left, if they left a public one
+	Message string
+	// How many sponsors this is, for Liberapay, whose new patrons are thanked together
+	Count int
+}
+
+// record is what is remembered about a sponsorship for the monthly summary. Sponsors' names
+// aren't kept.
+type record struct {
+	TimestampSecs int64  `json:"ts"`
+	Platform      string `json:"platform"`
+	Count         int    `json:"count"`
+	Amount        string `json:"amount,omitempty"`
+	Currency      string `json:"currency,omitempty"`
+	Cancelled     bool   `json:"cancelled,omitempty"`
+}
+
+// The parts of a GitHub Sponsors "sponsorship" event which are used
+type githubSponsorshipEvent struct {
+	Action      string `json:"action"`
+	Sponsorship struct {
+		PrivacyLevel string `json:"privacy_level"`
+		Sponsor      struct {
+			Login   string `json:"login"`
+			HTMLURL string `json:"html_url"`
+		} `json:"sponsor"`
+		Tier struct {
+			Name                  string `json:"name"`
+			MonthlyPriceInDollars int    `json:"monthly_price_in_dollars"`
+			IsOneTime             bool   `json:"is_one_time"`
+		} `json:"tier"`
+	} `json:"sponsorship"`
+}
+
+// The parts of a Ko-fi webhook's data which are used
+type kofiData struct {
+	VerificationToken          string `json:"verification_token"`
+	Type                       string `json:"type"`
+	IsPublic                   bool   `json:"is_public"`
+	FromName                   string `json:"from_name"`
+	Message                    string `json:"message"`
+	Amount                     string `json:"amount"`
+	Currency                   string `json:"currency"`
+	IsSubscriptionPayment      bool   `json:"is_subscription_payment"`
+	IsFirstSubscriptionPayment bool   `json:"is_first_subscription_payment"`
+	TierName                   string `json:"tier_name"`
+}
+
+// OnReceiveWebhook receives sponsorships from GitHub Sponsors and Ko-fi, and thanks the sponsors
+// in the room.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := log.WithField("service_id", s.ServiceID())
+	var sp *Sponsorship
+	var code int
+	var err error
+	if event := req.Header.Get("X-GitHub-Event"); event != "" {
+		sp, code, err = s.githubSponsorship(req, event)
+	} else {
+		sp, code, err = s.kofiSponsorship(req)
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Rejected sponsorship webhook")
+		w.WriteHeader(code)
+		return
+	}
+	if sp != nil {
+		s.thank(cli, sp)
+	}
+	w.WriteHeader(200)
+}
+
+// githubSponsorship returns the new sponsorship in a GitHub Sponsors webhook. Cancellations are
+// recorded for the monthly summary, and other events are ignored.
+func (s *Service) githubSponsorship(req *http.Request, event string) (*Sponsorship, int, error) {
+	if s.GitHubSecret == "" {
+		return nil, 403, fmt.Errorf("GitHub Sponsors webhooks aren't configured")
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, 400, err
+	}
+	mac := hmac.New(sha256.New, []byte(s.GitHubSecret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(req.Header.Get("X-Hub-Signature-256"))) {
+		return nil, 403, fmt.Errorf("Bad GitHub signature")
+	}
+	if event != "sponsorship" {
+		// e.g. the "ping" sent when the webhook is created
+		return nil, 200, nil
+	}
+	var ev githubSponsorshipEvent
+	if err = json.Unmarshal(body, &ev); err != nil {
+		return nil, 400, err
+	}
+	switch ev.Action {
+	case "created":
+	case "cancelled":
+		if err = s.recordSponsorship(record{
+			TimestampSecs: time.Now().Unix(),
+			Platform:      platformGitHub,
+			Count:         1,
+			Cancelled:     true,
+		}); err != nil {
+			return nil, 500, err
+		}
+		return nil, 200, nil
+	default:
+		return nil, 200, nil
+	}
+
+	tier := ev.Sponsorship.Tier
+	sp := &Sponsorship{
+		Platform: platformGitHub,
+		Amount:   strconv.Itoa(tier.MonthlyPriceInDollars) + ".00",
+		Currency: "USD",
+		Monthly:  !tier.IsOneTime,
+		Tier:     tier.Name,
+		Count:    1,
+	}
+	if ev.Sponsorship.PrivacyLevel != "private" {
+		sp.Name = ev.Sponsorship.Sponsor.Login
+		sp.URL = ev.Sponsorship.Sponsor.HTMLURL
+	}
+	return sp, 200, nil
+}
+
+// kofiSponsorship returns the donation or new subscription in a Ko-fi webhook. Subscription
+// renewals are ignored, because the sponsor was thanked when they subscribed.
+func (s *Service) kofiSponsorship(req *http.Request) (*Sponsorship, int, error) {
+	if s.KofiVerificationToken == "" {
+		return nil, 403, fmt.Errorf("Ko-fi webhooks aren't configured")
+	}
+	if err := req.ParseForm(); err != nil {
+		return nil, 400, err
+	}
+	var data kofiData
+	if err := json.Unmarshal([]byte(req.PostFormValue("data")), &data); err != nil {
+		return nil, 400, fmt.Errorf("Bad Ko-fi data: %s", err)
+	}
+	if !hmac.Equal([]byte(data.VerificationToken), []byte(s.KofiVerificationToken)) {
+		return nil, 403, fmt.Errorf("Bad Ko-fi verification token")
+	}
+	if data.Type == "Shop Order" || (data.IsSubscriptionPayment && !data.IsFirstSubscriptionPayment) {
+		return nil, 200, nil
+	}
+	sp := &Sponsorship{
+		Platform: platformKofi,
+		Amount:   data.Amount,
+		Currency: data.Currency,
+		Monthly:  data.IsSubscriptionPayment,
+		Tier:     data.TierName,
+		Count:    1,
+	}
+	if data.IsPublic {
+		sp.Name = data.FromName
+		sp.Message = data.Message
+	}
+	return sp, 200, nil
+}
+
+// thank records the sponsorship and thanks the sponsor in the room.
+func (s *Service) thank(cli types.MatrixClient, sp *Sponsorship) {
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"platform":   sp.Platform,
+	})
+	if err := s.recordSponsorship(record{
+		TimestampSecs: time.Now().Unix(),
+		Platform:      sp.Platform,
+		Count:         sp.Count,
+		Amount:        sp.Amount,
+		Currency:      sp.Currency,
+	}); err != nil {
+		logger.WithError(err).Error("Failed to record sponsorship")
+	}
+	msg, err := s.render(sp)
+	if err != nil {
+		logger.WithError(err).Error("Failed to execute thank you template")
+		return
+	}
+	if _, err = notify.Send(cli, s, notify.Notification{RoomID: s.RoomID, Content: msg}); err != nil {
+		logger.WithError(err).Error("Failed to thank sponsor")
+	}
+}
+
+// render returns the thank you message for the sponsorship, from the service's template, the
+// operator's "sponsors.new" template override or the default message.
+func (s *Service) render(sp *Sponsorship) (mevt.MessageEventContent, error) {
+	if s.TextTemplate == "" {
+		return templates.Render("sponsors.new", sp, defaultMessage(sp)), nil
+	}
+	// we don't check whether the template parses because we already did when registering
+	tmpl, _ := text.New("textTemplate").Parse(s.TextTemplate)
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, sp); err != nil {
+		return mevt.MessageEventContent{}, err
+	}
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body.String(),
+	}, nil
+}
+
+func defaultMessage(sp *Sponsorship) mevt.MessageEventContent {
+	who := sp.Name
+	if sp.Count > 1 {
+		who = fmt.Sprintf("our %d new patrons", sp.Count)
+	} else if who == "" {
+		who = "our new anonymous sponsor"
+	}
+	body := fmt.Sprintf("💖 Thank you %s for sponsoring us on %s", who, sp.Platform)
+	if sp.Amount != "" {
+		body += fmt.Sprintf(" with %s %s", sp.Amount, sp.Currency)
+		if sp.Monthly {
+			body += " a month"
+		}
+	}
+	if sp.Tier != "" {
+		body += fmt.Sprintf(" (%s)", sp.Tier)
+	}
+	body += "!"
+	if sp.Message != "" {
+		body += fmt.Sprintf("\n“%s”", sp.Message)
+	}
+	if sp.URL != "" {
+		body += "\n" + sp.URL
+	}
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+// OnPoll thanks new Liberapay patrons, and posts the summary of last month's sponsorships once
+// the month is over.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	now := time.Now()
+	if s.LiberapayUsername != "" {
+		if sp, err := s.newLiberapayPatrons(); err != nil {
+			log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to check Liberapay patrons")
+		} else if sp != nil {
+			s.thank(cli, sp)
+		}
+	}
+	s.summarise(cli, now)
+	return now.Add(pollInterval)
+}
+
+// newLiberapayPatrons returns the patrons who have joined since Liberapay was last checked, or
+// nil if none have. The first check only remembers how many patrons there are.
+func (s *Service) newLiberapayPatrons() (*Sponsorship, error) {
+	res, err := httpClient.Get(fmt.Sprintf(liberapayURL, s.LiberapayUsername))
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var profile struct {
+		NPatrons int `json:"npatrons"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&profile); err != nil {
+		return nil, err
+	}
+
+	var patrons *int
+	if err = s.loadState("liberapay_patrons", &patrons); err != nil {
+		return nil, err
+	}
+	if err = s.storeState("liberapay_patrons", profile.NPatrons); err != nil {
+		return nil, err
+	}
+	if patrons == nil || profile.NPatrons <= *patrons {
+		return nil, nil
+	}
+	return &Sponsorship{
+		Platform: platformLiberapay,
+		Monthly:  true,
+		Count:    profile.NPatrons - *patrons,
+	}, nil
+}
+
+// summarise posts a summary of each month before now which has sponsorships recorded, and then
+// forgets them.
+func (s *Service) summarise(cli types.MatrixClient, now time.Time) {
+	logger := log.WithField("service_id", s.ServiceID())
+	sponsorshipsMutex.Lock()
+	defer sponsorshipsMutex.Unlock()
+	records, err := s.loadRecords()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load sponsorships")
+		return
+	}
+	thisMonth := now.UTC().Format("2006-01")
+	months := make(map[string][]record)
+	var kept []record
+	for _, r := range records {
+		if month := time.Unix(r.TimestampSecs, 0).UTC().Format("2006-01"); month < thisMonth {
+			months[month] = append(months[month], r)
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	if len(months) == 0 {
+		return
+	}
+
+	if s.MonthlySummary {
+		var names []string
+		for month := range months {
+			names = append(names, month)
+		}
+		sort.Strings(names)
+		for _, month := range names {
+			_, err = notify.Send(cli, s, notify.Notification{
+				RoomID:  s.RoomID,
+				Content: *summaryMessage(month, months[month]),
+			})
+			if err != nil {
+				logger.WithError(err).Error("Failed to post monthly summary")
+				return
+			}
+		}
+	}
+	if err = s.storeRecords(kept); err != nil {
+		logger.WithError(err).Error("Failed to store sponsorships")
+	}
+}
+
+// summaryMessage describes the sponsorships of the month, given as "2006-01".
+func summaryMessage(month string, records []record) *mevt.MessageEventContent {
+	newSponsors, cancelled := 0, 0
+	perPlatform := make(map[string]int)
+	perCurrency := make(map[string]float64)
+	for _, r := range records {
+		if r.Cancelled {
+			cancelled += r.Count
+			continue
+		}
+		newSponsors += r.Count
+		perPlatform[r.Platform] += r.Count
+		if amount, err := strconv.ParseFloat(r.Amount, 64); err == nil && r.Currency != "" {
+			perCurrency[strings.ToUpper(r.Currency)] += amount
+		}
+	}
+
+	t, _ := time.Parse("2006-01", month)
+	body := fmt.Sprintf("📈 Sponsorships in %s: %d new", t.Format("January 2006"), newSponsors)
+	if len(perPlatform) > 0 {
+		var platforms []string
+		for platform, n := range perPlatform {
+			platforms = append(platforms, fmt.Sprintf("%s %d", platform, n))
+		}
+		sort.Strings(platforms)
+		body += " (" + strings.Join(platforms, ", ") + ")"
+	}
+	if cancelled > 0 {
+		body += fmt.Sprintf(", %d cancelled", cancelled)
+	}
+	if len(perCurrency) > 0 {
+		var amounts []string
+		for currency, amount := range perCurrency {
+			amounts = append(amounts, fmt.Sprintf("%.2f %s", amount, currency))
+		}
+		sort.Strings(amounts)
+		body += "\nNew sponsors pledged " + strings.Join(amounts, ", ")
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func (s *Service) recordSponsorship(r record) error {
+	sponsorshipsMutex.Lock()
+	defer sponsorshipsMutex.Unlock()
+	records, err := s.loadRecords()
+	if err != nil {
+		return err
+	}
+	return s.storeRecords(append(records, r))
+}
+
+func (s *Service) loadRecords() ([]record, error) {
+	var records []record
+	err := s.loadState("sponsorships", &records)
+	return records, err
+}
+
+func (s *Service) storeRecords(records []record) error {
+	return s.storeState("sponsorships", records)
+}
+
+// loadState unmarshals the state into v, leaving v alone if there isn't any.
+func (s *Service) loadState(key string, v interface{}) error {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), key)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(stateJSON, v)
+}
+
+func (s *Service) storeState(key string, v interface{}) error {
+	stateJSON, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), key, stateJSON)
+}
+
+// Register makes sure the Config information supplied is valid, and joins the room.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if s.RoomID == "" {
+		return fmt.Errorf("A room_id is required")
+	}
+	if s.TextTemplate != "" {
+		if _, err := text.New("textTemplate").Parse(s.TextTemplate); err != nil {
+			return fmt.Errorf("text_template is invalid: %v", err)
+		}
+	}
+	if _, err := client.JoinRoom(s.RoomID.String(), "", nil); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    s.RoomID,
+		}).Error("Failed to join room")
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package sponsors
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func githubRequest(event, secret, body string) *http.Request {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	req, _ := http.NewRequest("POST", "https://neb/services/hooks/c3BvbnNvcnM", strings.NewReader(body))
+	req.Header.Set("X-GitHub-Event", event)
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func kofiRequest(data string) *http.Request {
+	form := url.Values{"data": {data}}
+	req, _ := http.NewRequest("POST", "https://neb/services/hooks/c3BvbnNvcnM", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestSponsors(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	patrons := 10
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "https://liberapay.com/go-neb/public.json" {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`{"npatrons":%d}`, patrons))),
+		}, nil
+	})}
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		if !strings.Contains(req.URL.String(), "/send/m.room.message/") {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$thanks:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"room_id": "!sponsors:hyrule",
+		"github_secret": "shh",
+		"kofi_verification_token": "token",
+		"liberapay_username": "go-neb",
+		"monthly_summary": true
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create sponsors service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register sponsors service: ", err)
+	}
+	s := srv.(*Service)
+
+	webhookTests := []struct {
+		req      *http.Request
+		wantCode int
+	}{
+		{githubRequest("ping", "shh", `{"zen":"Keep it logically awesome."}`), 200},
+		{githubRequest("sponsorship", "wrong", `{"action":"created"}`), 403},
+		{githubRequest("sponsorship", "shh", `{"action":"created","sponsorship":{"privacy_level":"public",
+			"sponsor":{"login":"octocat","html_url":"https://github.com/octocat"},
+			"tier":{"name":"Supporter","monthly_price_in_dollars":5,"is_one_time":false}}}`), 200},
+		{githubRequest("sponsorship", "shh", `{"action":"created","sponsorship":{"privacy_level":"private",
+			"sponsor":{"login":"secret"},"tier":{"name":"Once","monthly_price_in_dollars":20,"is_one_time":true}}}`), 200},
+		{githubRequest("sponsorship", "shh", `{"action":"cancelled","sponsorship":{"sponsor":{"login":"octocat"}}}`), 200},
+		{kofiRequest(`{"verification_token":"wrong","type":"Donation"}`), 403},
+		{kofiRequest(`{"verification_token":"token","type":"Donation","is_public":true,"from_name":"Jo",
+			"message":"Keep it up","amount":"3.00","currency":"GBP"}`), 200},
+		{kofiRequest(`{"verification_token":"token","type":"Subscription","is_public":true,"from_name":"Jo",
+			"amount":"3.00","currency":"GBP","is_subscription_payment":true,"is_first_subscription_payment":false}`), 200},
+	}
+	for i, wt := range webhookTests {
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, wt.req, matrixCli)
+		if w.Code != wt.wantCode {
+			t.Errorf("Webhook %d: got HTTP %d want %d", i, w.Code, wt.wantCode)
+		}
+	}
+
+	// The first poll only counts Liberapay's patrons
+	s.OnPoll(matrixCli)
+	patrons = 12
+	s.OnPoll(matrixCli)
+
+	want := []string{
+		"💖 Thank you octocat for sponsoring us on GitHub Sponsors with 5.00 USD a month (Supporter)!\nhttps://github.com/octocat",
+		"💖 Thank you our new anonymous sponsor for sponsoring us on GitHub Sponsors with 20.00 USD (Once)!",
+		"💖 Thank you Jo for sponsoring us on Ko-fi with 3.00 GBP!\n“Keep it up”",
+		"💖 Thank you our 2 new patrons for sponsoring us on Liberapay!",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad thank you messages: got %q want %q", sent, want)
+	}
+
+	// The month's summary is posted once it is over, and only once
+	sent = nil
+	nextMonth := time.Now().AddDate(0, 1, 0)
+	s.summarise(matrixCli, nextMonth)
+	s.summarise(matrixCli, nextMonth)
+	wantSummary := fmt.Sprintf("📈 Sponsorships in %s: 5 new (GitHub Sponsors 2, Ko-fi 1, Liberapay 2), 1 cancelled\n"+
+		"New sponsors pledged 25.00 USD, 3.00 GBP", time.Now().UTC().Format("January 2006"))
+	if len(sent) != 1 || sent[0] != wantSummary {
+		t.Errorf("Bad summaries: got %q want %q", sent, wantSummary)
+	}
+}
+
+func TestTextTemplate(t *testing.T) {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"room_id": "!sponsors:hyrule",
+		"text_template": "{{.Platform}}: thanks {{or .Name \"friend\"}}!"
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create sponsors service: ", err)
+	}
+	msg, err := srv.(*Service).render(&Sponsorship{Platform: "Ko-fi", Count: 1})
+	if err != nil || msg.Body != "Ko-fi: thanks friend!" {
+		t.Errorf("Bad templated message: %+v, %v", msg, err)
+	}
+}
@@ -0,0 +1,284 @@
+package standup
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/timezone"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// standup is a standup which is in progress. It is stored in the service state under
+// "standup <team>" until the summary is posted.
+type standup struct {
+	StartedTimestampSecs  int64                   `json:"started_timestamp_secs"`
+	DeadlineTimestampSecs int64                   `json:"deadline_timestamp_secs"`
+	Members               map[id.UserID]*response `json:"members"`
+}
+
+// response is a member's part in a standup.
+type response struct {
+	// The direct message room the member is being asked in. Empty if they couldn't be asked.
+	RoomID  id.RoomID `json:"room_id"`
+	Answers []string  `json:"answers"`
+	Skipped bool      `json:"skipped"`
+}
+
+func (r *response) done(questions int) bool {
+	return r.Skipped || r.RoomID == "" || len(r.Answers) >= questions
+}
+
+// complete returns true if every member has answered or skipped.
+func (st *standup) complete(questions int) bool {
+	for _, r := range st.Members {
+		if !r.done(questions) {
+			return false
+		}
+	}
+	return true
+}
+
+// start sends each member of the team the first question of a new standup.
+func (s *Service) start(cli types.MatrixClient, teamName string, team Team, now time.Time) error {
+	deadline, err := team.deadline()
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(team.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	questions := team.questions()
+	st := standup{
+		StartedTimestampSecs:  now.Unix(),
+		DeadlineTimestampSecs: now.Add(deadline).Unix(),
+		Members:               make(map[id.UserID]*response),
+	}
+	for _, member := range team.Members {
+		logger := log.WithFields(log.Fields{
+			"service_id": s.ServiceID(),
+			"team":       teamName,
+			"user_id":    member,
+		})
+		r := &response{}
+		st.Members[member] = r
+		if skip, err := s.takeSkip(teamName, member); err != nil {
+			logger.WithError(err).Error("Failed to load skip")
+		} else if skip {
+			r.Skipped = true
+			continue
+		}
+		roomID, err := s.dmRoom(cli, member)
+		if err != nil {
+			logger.WithError(err).Error("Failed to find a direct message room")
+			continue
+		}
+		// Tell members when the summary is posted in their own timezone, if they have set one
+		memberLoc, ok := timezone.UserLocation(member)
+		if !ok {
+			memberLoc = loc
+		}
+		greeting := fmt.Sprintf(
+			"It's time for the %s standup! Please reply by %s, or reply \"skip\" if you want to skip it.\n\n%s",
+			teamName, time.Unix(st.DeadlineTimestampSecs, 0).In(memberLoc).Format("15:04 MST"), questions[0],
+		)
+		if _, err = cli.SendMessageEvent(roomID, mevt.EventMessage, mevt.MessageEventContent{
+			MsgType: mevt.MsgText,
+			Body:    greeting,
+		}); err != nil {
+			logger.WithError(err).Error("Failed to ask standup question")
+			continue
+		}
+		r.RoomID = roomID
+	}
+	return s.saveStandup(teamName, st)
+}
+
+// finish posts the summary of the standup into the team room and forgets it.
+func (s *Service) finish(cli types.MatrixClient, teamName string, team Team, st standup) {
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"team":       teamName,
+	})
+	loc, err := time.LoadLocation(team.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	started := time.Unix(st.StartedTimestampSecs, 0).In(loc)
+	if _, err := cli.SendMessageEvent(team.RoomID, mevt.EventMessage, summary(teamName, team, st, started)); err != nil {
+		logger.WithError(err).Error("Failed to post standup summary")
+	}
+	if err := database.GetServiceDB().DeleteServiceState(s.ServiceID(), "standup "+teamName); err != nil {
+		logger.WithError(err).Error("Failed to forget standup")
+	}
+}
+
+// summary renders the answers of the standup, in the order the team members are listed.
+func summary(teamName string, team Team, st standup, started time.Time) mevt.MessageEventContent {
+	title := fmt.Sprintf("Standup for %s, %s", teamName, started.Format("Mon 2 Jan"))
+	var text, htm strings.Builder
+	text.WriteString(title + "\n")
+	htm.WriteString("<p><strong>" + html.EscapeString(title) + "</strong></p>\n")
+	for _, member := range team.Members {
+		r := st.Members[member]
+		switch {
+		case r == nil || (!r.Skipped && len(r.Answers) == 0):
+			text.WriteString(fmt.Sprintf("%s: no update\n", member))
+			htm.WriteString(fmt.Sprintf("<p>%s: <em>no update</em></p>\n", html.EscapeString(string(member))))
+		case r.Skipped:
+			text.WriteString(fmt.Sprintf("%s: skipped\n", member))
+			htm.WriteString(fmt.Sprintf("<p>%s: <em>skipped</em></p>\n", html.EscapeString(string(member))))
+		default:
+			text.WriteString(fmt.Sprintf("%s:\n", member))
+			htm.WriteString(fmt.Sprintf("<p>%s:</p>\n<ul>\n", html.EscapeString(string(member))))
+			for i, answer := range r.Answers {
+				q := team.questions()[i]
+				text.WriteString(fmt.Sprintf("  %s %s\n", q, answer))
+				htm.WriteString(fmt.Sprintf(
+					"<li><strong>%s</strong> %s</li>\n", html.EscapeString(q), html.EscapeString(answer),
+				))
+			}
+			htm.WriteString("</ul>\n")
+		}
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.TrimSuffix(text.String(), "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: strings.TrimSuffix(htm.String(), "\n"),
+	}
+}
+
+// OnMessage records the answers which members send in their direct message rooms, asking the next
+// question until they have answered them all.
+func (s *Service) OnMessage(cli types.MatrixClient, evt *mevt.Event) {
+	if evt.Type != mevt.EventMessage {
+		return
+	}
+	body, _ := evt.Content.Raw["body"].(string)
+	body = strings.TrimSpace(body)
+	// Commands are handled elsewhere
+	if body == "" || strings.HasPrefix(body, "!") {
+		return
+	}
+	// Edits would be recorded as another answer
+	if rel, ok := evt.Content.Raw["m.relates_to"].(map[string]interface{}); ok && rel["rel_type"] == "m.replace" {
+		return
+	}
+	for teamName, team := range s.Teams {
+		st, ok, err := s.loadStandup(teamName)
+		if err != nil || !ok {
+			continue
+		}
+		questions := team.questions()
+		r := st.Members[evt.Sender]
+		if r == nil || r.RoomID != evt.RoomID || r.done(len(questions)) {
+			continue
+		}
+		var reply string
+		if strings.EqualFold(body, "skip") {
+			r.Skipped = true
+			reply = "OK, you've skipped this standup."
+		} else {
+			r.Answers = append(r.Answers, body)
+			if len(r.Answers) < len(questions) {
+				reply = questions[len(r.Answers)]
+			} else {
+				reply = "Thanks! I'll post your update when everyone has answered."
+			}
+		}
+		if _, err := cli.SendMessageEvent(evt.RoomID, mevt.EventMessage, mevt.MessageEventContent{
+			MsgType: mevt.MsgText,
+			Body:    reply,
+		}); err != nil {
+			log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to reply to standup answer")
+		}
+		if st.complete(len(questions)) {
+			s.finish(cli, teamName, team, st)
+		} else if err := s.saveStandup(teamName, st); err != nil {
+			log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to save standup")
+		}
+		return
+	}
+}
+
+// dmRoom returns the direct message room with the user, creating one the first time.
+func (s *Service) dmRoom(cli types.MatrixClient, userID id.UserID) (id.RoomID, error) {
+	db := database.GetServiceDB()
+	stateJSON, err := db.LoadServiceState(s.ServiceID(), "dm "+string(userID))
+	if err == nil {
+		var roomID id.RoomID
+		if err = json.Unmarshal(stateJSON, &roomID); err == nil {
+			return roomID, nil
+		}
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+	dcli, ok := cli.(types.RoomCreator)
+	if !ok {
+		return "", fmt.Errorf("Client cannot create rooms")
+	}
+	resp, err := dcli.CreateRoom(&mautrix.ReqCreateRoom{
+		Preset:   "trusted_private_chat",
+		Invite:   []id.UserID{userID},
+		IsDirect: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	if stateJSON, err = json.Marshal(resp.RoomID); err == nil {
+		err = db.StoreServiceState(s.ServiceID(), "dm "+string(userID), stateJSON)
+	}
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Error("Failed to store direct message room")
+	}
+	return resp.RoomID, nil
+}
+
+// loadStandup returns the team's standup if one is in progress.
+func (s *Service) loadStandup(teamName string) (st standup, ok bool, err error) {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "standup "+teamName)
+	if err == sql.ErrNoRows {
+		return st, false, nil
+	} else if err != nil {
+		return st, false, err
+	}
+	if err = json.Unmarshal(stateJSON, &st); err != nil {
+		return st, false, err
+	}
+	return st, true, nil
+}
+
+func (s *Service) saveStandup(teamName string, st standup) error {
+	stateJSON, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "standup "+teamName, stateJSON)
+}
+
+// storeSkip records that the member will skip the team's next standup.
+func (s *Service) storeSkip(teamName string, userID id.UserID) error {
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "skip "+teamName+" "+string(userID), []byte("true"))
+}
+
+// takeSkip returns whether the member is skipping the team's next standup, and forgets it.
+func (s *Service) takeSkip(teamName string, userID id.UserID) (bool, error) {
+	db := database.GetServiceDB()
+	key := "skip " + teamName + " " + string(userID)
+	if _, err := db.LoadServiceState(s.ServiceID(), key); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, db.DeleteServiceState(s.ServiceID(), key)
+}
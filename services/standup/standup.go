@@ -0,0 +1,350 @@
+// Package standup implements a Service which runs asynchronous standups over direct messages.
+package standup
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/schedule"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Standup service
+const ServiceType = "standup"
+
+// Standups which are due more than this long ago, e.g. because Go-NEB wasn't running, are
+// skipped rather than started late.
+const maxLateness = time.Hour
+
+// The questions members are asked if a team doesn't configure its own
+var defaultQuestions = []string{
+	"What did you do yesterday?",
+	"What will you do today?",
+	"Is anything blocking you?",
+}
+
+// Service contains the Config fields for the Standup service.
+//
+// This service runs standups for teams without a meeting. At the scheduled time, it sends each
+// member of the team a direct message asking the standup questions one at a time. Once everyone
+// has answered, or the deadline passes, it posts a summary of the answers into the team's room.
+// Members who registered their timezone with the timezone service are told the deadline in it.
+//
+// Members can reply "skip" to skip a standup, or say "!standup skip" beforehand to skip the next
+// one, e.g. when they will be on holiday. Teams can list dates on which there is no standup.
+//
+// Commands:
+//    !standup start team
+// Starts the team's standup now, rather than waiting for the schedule.
+//    !standup skip [team]
+// Skips the next standup of the team, or the current one if it has started. The team can be left
+// out if the sender is in only one.
+//
+// Example JSON request:
+//   {
+//       "teams": {
+//           "backend": {
+//               "room_id": "!backend:localhost",
+//               "members": ["@alice:localhost", "@bob:localhost"],
+//               "every": "weekday",
+//               "at": "09:30",
+//               "timezone": "Europe/Berlin",
+//               "deadline": "2h",
+//               "skip_dates": ["2021-12-24", "2021-12-31"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	Teams map[string]Team `json:"teams"`
+}
+
+// Team is a group of people who have a standup together. Its schedule is given as the fields of a
+// schedule.Schedule, and defaults to every weekday at 09:00.
+type Team struct {
+	schedule.Schedule
+	// The room to post standup summaries in.
+	RoomID id.RoomID `json:"room_id"`
+	// The people in the standup.
+	Members []id.UserID `json:"members"`
+	// Optional. The IANA timezone of the schedule, e.g. "America/New_York". Defaults to UTC.
+	Timezone string `json:"timezone"`
+	// Optional. The questions to ask, in order. Defaults to what members did yesterday, what
+	// they will do today and what is blocking them.
+	Questions []string `json:"questions"`
+	// Optional. How long members have to answer before the summary is posted, e.g. "90m".
+	// Defaults to 2 hours.
+	Deadline string `json:"deadline"`
+	// Optional. Dates on which there is no standup, as "2006-01-02".
+	SkipDates []string `json:"skip_dates"`
+	// When the next standup starts, in seconds since the epoch. Populated by Go-NEB.
+	NextTimestampSecs int64 `json:"next_timestamp_secs"`
+	// When the last standup was due, in seconds since the epoch. Populated by Go-NEB.
+	LastTimestampSecs int64 `json:"last_timestamp_secs"`
+}
+
+func (t *Team) questions() []string {
+	if len(t.Questions) == 0 {
+		return defaultQuestions
+	}
+	return t.Questions
+}
+
+func (t *Team) deadline() (time.Duration, error) {
+	if t.Deadline == "" {
+		return 2 * time.Hour, nil
+	}
+	return time.ParseDuration(t.Deadline)
+}
+
+func (t *Team) isMember(userID id.UserID) bool {
+	for _, m := range t.Members {
+		if m == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// skips returns true if there is no standup on the day of t.
+func (t *Team) skips(due time.Time, loc *time.Location) bool {
+	date := due.In(loc).Format("2006-01-02")
+	for _, d := range t.SkipDates {
+		if d == date {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error if the team is misconfigured.
+func (t *Team) check() error {
+	if t.RoomID == "" {
+		return fmt.Errorf("A room_id is required")
+	}
+	if len(t.Members) == 0 {
+		return fmt.Errorf("At least one member is required")
+	}
+	if err := t.Schedule.Check(); err != nil {
+		return err
+	}
+	if _, err := time.LoadLocation(t.Timezone); err != nil {
+		return err
+	}
+	if d, err := t.deadline(); err != nil || d <= 0 {
+		return fmt.Errorf("Bad deadline '%s'", t.Deadline)
+	}
+	for _, d := range t.SkipDates {
+		if _, err := time.Parse("2006-01-02", d); err != nil {
+			return fmt.Errorf("Bad skip date '%s'", d)
+		}
+	}
+	return nil
+}
+
+// Commands supported:
+//    !standup start team
+// Starts the team's standup now.
+//    !standup skip [team]
+// Skips the sender's next standup with the team.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"standup", "start"},
+			Arguments: []string{"team"},
+			Help:      "Start a team's standup now",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdStart(cli, userID, args)
+			},
+		},
+		{
+			Path:      []string{"standup", "skip"},
+			Arguments: []string{"[team]"},
+			Help:      "Skip your next standup",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSkip(cli, userID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdStart(cli types.MatrixClient, userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !standup start team")
+	}
+	team, ok := s.Teams[args[0]]
+	if !ok || !team.isMember(userID) {
+		return nil, fmt.Errorf("You aren't in a team called %s", args[0])
+	}
+	if st, ok, err := s.loadStandup(args[0]); err != nil {
+		return nil, err
+	} else if ok {
+		s.finish(cli, args[0], team, st)
+	}
+	if err := s.start(cli, args[0], team, time.Now()); err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Started the %s standup", args[0]),
+	}, nil
+}
+
+func (s *Service) cmdSkip(cli types.MatrixClient, userID id.UserID, args []string) (interface{}, error) {
+	var teamName string
+	if len(args) == 1 {
+		teamName = args[0]
+		if team, ok := s.Teams[teamName]; !ok || !team.isMember(userID) {
+			return nil, fmt.Errorf("You aren't in a team called %s", teamName)
+		}
+	} else if len(args) == 0 {
+		for name, team := range s.Teams {
+			if !team.isMember(userID) {
+				continue
+			}
+			if teamName != "" {
+				return nil, fmt.Errorf("You are in more than one team, say which: !standup skip team")
+			}
+			teamName = name
+		}
+		if teamName == "" {
+			return nil, fmt.Errorf("You aren't in any standup teams")
+		}
+	} else {
+		return nil, fmt.Errorf("Usage: !standup skip [team]")
+	}
+
+	// Skip the standup which is happening, if the member hasn't answered it yet
+	st, ok, err := s.loadStandup(teamName)
+	if err != nil {
+		return nil, err
+	}
+	team := s.Teams[teamName]
+	if a := st.Members[userID]; ok && a != nil && !a.done(len(team.questions())) {
+		a.Skipped = true
+		if err = s.saveStandup(teamName, st); err != nil {
+			return nil, err
+		}
+		if st.complete(len(team.questions())) {
+			s.finish(cli, teamName, team, st)
+		}
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("Skipped today's %s standup", teamName),
+		}, nil
+	}
+	if err = s.storeSkip(teamName, userID); err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Skipping the next %s standup", teamName),
+	}, nil
+}
+
+// OnPoll starts the standups which are due and posts the summaries of those which are over, and
+// returns when the next of either happens.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	now := time.Now()
+	var next time.Time
+	earliest := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	for teamName, team := range s.Teams {
+		teamLogger := logger.WithField("team", teamName)
+		loc, err := time.LoadLocation(team.Timezone)
+		if err != nil {
+			teamLogger.WithError(err).Error("Invalid timezone")
+			continue
+		}
+
+		st, inProgress, err := s.loadStandup(teamName)
+		if err != nil {
+			teamLogger.WithError(err).Error("Failed to load standup")
+		}
+		if inProgress && !now.Before(time.Unix(st.DeadlineTimestampSecs, 0)) {
+			s.finish(cli, teamName, team, st)
+			inProgress = false
+		} else if inProgress {
+			earliest(time.Unix(st.DeadlineTimestampSecs, 0))
+		}
+
+		due := time.Unix(team.NextTimestampSecs, 0)
+		if team.NextTimestampSecs != 0 && !now.Before(due) {
+			if now.Sub(due) > maxLateness {
+				teamLogger.WithField("due", due).Warn("Skipping late standup")
+			} else if !team.skips(due, loc) {
+				if inProgress {
+					s.finish(cli, teamName, team, st)
+				}
+				if err = s.start(cli, teamName, team, now); err != nil {
+					teamLogger.WithError(err).Error("Failed to start standup")
+				}
+				if d, err := team.deadline(); err == nil {
+					earliest(now.Add(d))
+				}
+			}
+			team.LastTimestampSecs = due.Unix()
+		}
+		if team.NextTimestampSecs == 0 || !now.Before(due) {
+			var last time.Time
+			if team.LastTimestampSecs != 0 {
+				last = time.Unix(team.LastTimestampSecs, 0)
+			}
+			n, err := team.Next(now, last, loc)
+			if err != nil {
+				teamLogger.WithError(err).Error("Failed to schedule standup")
+				continue
+			}
+			team.NextTimestampSecs = n.Unix()
+			s.Teams[teamName] = team
+		}
+		earliest(time.Unix(team.NextTimestampSecs, 0))
+	}
+	// Persist the service to save the standup times
+	if _, err := database.GetServiceDB().StoreService(s); err != nil {
+		logger.WithError(err).Error("Failed to persist standup times for service")
+	}
+	return next
+}
+
+// Register checks each team and joins their rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Teams) == 0 {
+		return fmt.Errorf("At least one team is required")
+	}
+	for name, team := range s.Teams {
+		if team.Every == "" {
+			team.Every = "weekday"
+			s.Teams[name] = team
+		}
+		if err := team.check(); err != nil {
+			return fmt.Errorf("Bad team %s: %s", name, err)
+		}
+		if _, err := client.JoinRoom(team.RoomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    team.RoomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
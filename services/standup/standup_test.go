@@ -0,0 +1,165 @@
+package standup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type sentMessage struct {
+	roomID id.RoomID
+	body   string
+}
+
+func TestStandup(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+
+	var sent []sentMessage
+	var invites []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			return nil, err
+		}
+		respBody := `{"event_id":"$yup"}`
+		if strings.HasSuffix(req.URL.Path, "/createRoom") {
+			invitee := content["invite"].([]interface{})[0].(string)
+			invites = append(invites, invitee)
+			respBody = fmt.Sprintf(`{"room_id":"!dm-%s"}`, strings.TrimPrefix(invitee, "@"))
+		} else if strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			roomID := strings.Split(strings.Split(req.URL.Path, "/rooms/")[1], "/")[0]
+			sent = append(sent, sentMessage{id.RoomID(roomID), content["body"].(string)})
+		} else {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(respBody)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"teams": {
+			"knights": {
+				"room_id": "!castle:hyrule",
+				"members": ["@zelda:hyrule", "@link:hyrule", "@impa:hyrule"],
+				"every": "day",
+				"questions": ["Yesterday?", "Today?"],
+				"skip_dates": ["2000-01-01"]
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create standup service: ", err)
+	}
+	s := srv.(*Service)
+	team := s.Teams["knights"]
+	if err = team.check(); err != nil {
+		t.Fatalf("Team failed check: %s", err)
+	}
+
+	// Impa will be away
+	if _, err = s.cmdSkip(matrixCli, "@impa:hyrule", nil); err != nil {
+		t.Fatalf("!standup skip failed: %s", err)
+	}
+
+	// The first poll only schedules the standup
+	next := s.OnPoll(matrixCli)
+	if len(sent) != 0 || next.Before(time.Now()) {
+		t.Fatalf("Expected the standup to be scheduled, got %v, next %s", sent, next)
+	}
+
+	// Make it due
+	team = s.Teams["knights"]
+	team.NextTimestampSecs = time.Now().Add(-time.Minute).Unix()
+	s.Teams["knights"] = team
+	next = s.OnPoll(matrixCli)
+	if len(invites) != 2 || len(sent) != 2 {
+		t.Fatalf("Expected Zelda and Link to be asked, got invites %v, messages %v", invites, sent)
+	}
+	if !strings.HasSuffix(sent[0].body, "Yesterday?") {
+		t.Errorf("Bad first question: %s", sent[0].body)
+	}
+	if next.After(time.Now().Add(2 * time.Hour)) {
+		t.Errorf("Expected to poll again by the deadline, got %s", next)
+	}
+
+	answer := func(sender id.UserID, roomID id.RoomID, body string) {
+		s.OnMessage(matrixCli, &mevt.Event{
+			Sender:  sender,
+			RoomID:  roomID,
+			Type:    mevt.EventMessage,
+			Content: mevt.Content{Raw: map[string]interface{}{"msgtype": "m.text", "body": body}},
+		})
+	}
+	answer("@zelda:hyrule", "!dm-zelda:hyrule", "Read the book of Mudora")
+	// Answers in other rooms are ignored
+	answer("@zelda:hyrule", "!castle:hyrule", "Nothing")
+	answer("@zelda:hyrule", "!dm-zelda:hyrule", "Find the Master Sword")
+	if last := sent[len(sent)-1]; last.roomID != "!dm-zelda:hyrule" || !strings.HasPrefix(last.body, "Thanks!") {
+		t.Errorf("Expected Zelda to be thanked, got %+v", last)
+	}
+	answer("@link:hyrule", "!dm-link:hyrule", "skip")
+
+	last := sent[len(sent)-1]
+	want := "Standup for knights, " + time.Now().UTC().Format("Mon 2 Jan") + "\n" +
+		"@zelda:hyrule:\n" +
+		"  Yesterday? Read the book of Mudora\n" +
+		"  Today? Find the Master Sword\n" +
+		"@link:hyrule: skipped\n" +
+		"@impa:hyrule: skipped"
+	if last.roomID != "!castle:hyrule" || last.body != want {
+		t.Errorf("Bad summary in %s:\n%s\nwant:\n%s", last.roomID, last.body, want)
+	}
+	if _, ok, _ := s.loadStandup("knights"); ok {
+		t.Errorf("Expected the standup to be over")
+	}
+
+	// Standups are posted at the deadline, whoever has answered, and DM rooms are reused
+	n := len(sent)
+	if _, err = s.cmdStart(matrixCli, "@link:hyrule", []string{"knights"}); err != nil {
+		t.Fatalf("!standup start failed: %s", err)
+	}
+	if len(invites) != 3 || len(sent) != n+3 {
+		t.Fatalf("Expected only Impa to be invited, got %v, messages %v", invites, sent[n:])
+	}
+	answer("@link:hyrule", "!dm-link:hyrule", "Slept")
+	st, _, _ := s.loadStandup("knights")
+	st.DeadlineTimestampSecs = time.Now().Add(-time.Second).Unix()
+	if err = s.saveStandup("knights", st); err != nil {
+		t.Fatal(err)
+	}
+	s.OnPoll(matrixCli)
+	last = sent[len(sent)-1]
+	if !strings.Contains(last.body, "@link:hyrule:\n  Yesterday? Slept\n@impa:hyrule: no update") {
+		t.Errorf("Bad summary at the deadline:\n%s", last.body)
+	}
+}
+
+func TestSkipDates(t *testing.T) {
+	team := Team{SkipDates: []string{"2021-12-24"}}
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	// 23:30 UTC on the 23rd is already the 24th in Berlin
+	due := time.Date(2021, 12, 23, 23, 30, 0, 0, time.UTC)
+	if team.skips(due, time.UTC) {
+		t.Errorf("Expected a standup on the 23rd in UTC")
+	}
+	if !team.skips(due, berlin) {
+		t.Errorf("Expected no standup on the 24th in Berlin")
+	}
+}
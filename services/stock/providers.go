@@ -0,0 +1,146 @@
+package stock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The provider APIs. Overridden by tests.
+var (
+	alphaVantageURL = "https://www.alphavantage.co/query"
+	iexURL          = "https://cloud.iexapis.com/stable/"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// errRateLimited is returned by providers when too many quotes have been asked for.
+var errRateLimited = errors.New("rate limited")
+
+// quote is the latest trading of a stock.
+type quote struct {
+	Symbol string
+	// The company's name, if known
+	Name  string
+	Price float64
+	// The change since the previous close, and as a percentage of it
+	Change        float64
+	ChangePercent float64
+	Volume        int64
+	// The day or time of the latest trade, as the provider describes it
+	LatestTrade string
+}
+
+// A provider looks up the quotes of stocks. It returns nil if it doesn't know the symbol.
+type provider interface {
+	quote(symbol string) (*quote, error)
+}
+
+// alphaVantageProvider uses Alpha Vantage's global quotes, which are for the end of the last
+// trading day, or delayed during it. Free API keys can make 5 requests a minute.
+type alphaVantageProvider struct {
+	apiKey string
+}
+
+func (p *alphaVantageProvider) quote(symbol string) (*quote, error) {
+	q := url.Values{}
+	q.Set("function", "GLOBAL_QUOTE")
+	q.Set("symbol", symbol)
+	q.Set("apikey", p.apiKey)
+	res, err := httpClient.Get(alphaVantageURL + "?" + q.Encode())
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusTooManyRequests {
+		return nil, errRateLimited
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var body struct {
+		GlobalQuote map[string]string `json:"Global Quote"`
+		// Alpha Vantage describes rate limits and errors in the body
+		Note         string `json:"Note"`
+		Information  string `json:"Information"`
+		ErrorMessage string `json:"Error Message"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.ErrorMessage != "" {
+		return nil, fmt.Errorf("%s", body.ErrorMessage)
+	}
+	if body.Note != "" || strings.Contains(strings.ToLower(body.Information), "rate limit") {
+		return nil, errRateLimited
+	}
+	if body.Information != "" {
+		return nil, fmt.Errorf("%s", body.Information)
+	}
+	if len(body.GlobalQuote) == 0 {
+		return nil, nil
+	}
+	gq := body.GlobalQuote
+	result := &quote{
+		Symbol:      gq["01. symbol"],
+		LatestTrade: gq["07. latest trading day"],
+	}
+	result.Price, _ = strconv.ParseFloat(gq["05. price"], 64)
+	result.Change, _ = strconv.ParseFloat(gq["09. change"], 64)
+	result.ChangePercent, _ = strconv.ParseFloat(strings.TrimSuffix(gq["10. change percent"], "%"), 64)
+	result.Volume, _ = strconv.ParseInt(gq["06. volume"], 10, 64)
+	return result, nil
+}
+
+// iexProvider uses IEX Cloud, whose API keys are called tokens. Requests use up the account's
+// credits, and IEX refuses them once the credits or the rate limit run out.
+type iexProvider struct {
+	token string
+}
+
+func (p *iexProvider) quote(symbol string) (*quote, error) {
+	res, err := httpClient.Get(iexURL + "stock/" + url.PathEscape(strings.ToLower(symbol)) + "/quote?token=" + url.QueryEscape(p.token))
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	case http.StatusTooManyRequests, http.StatusPaymentRequired:
+		return nil, errRateLimited
+	default:
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var body struct {
+		Symbol        string  `json:"symbol"`
+		CompanyName   string  `json:"companyName"`
+		LatestPrice   float64 `json:"latestPrice"`
+		Change        float64 `json:"change"`
+		ChangePercent float64 `json:"changePercent"`
+		LatestVolume  int64   `json:"latestVolume"`
+		LatestTime    string  `json:"latestTime"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return &quote{
+		Symbol:        body.Symbol,
+		Name:          body.CompanyName,
+		Price:         body.LatestPrice,
+		Change:        body.Change,
+		ChangePercent: body.ChangePercent * 100,
+		Volume:        body.LatestVolume,
+		LatestTrade:   body.LatestTime,
+	}, nil
+}
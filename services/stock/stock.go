@@ -0,0 +1,196 @@
+// Package stock implements a Service which looks up stock quotes.
+package stock
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Stock service
+const ServiceType = "stock"
+
+const (
+	// How long a quote is reused for, so that a busy room doesn't use up the provider's rate limit
+	quoteTTL = time.Minute
+	// How long to stop asking the provider for quotes once it has said it is rate limited
+	rateLimitBackoff = time.Minute
+)
+
+// The quotes which have been looked up recently, and when each provider is rate limited until,
+// keyed by service ID.
+var (
+	cacheMutex   sync.Mutex
+	quoteCache   = make(map[string]cachedQuote)
+	limitedUntil = make(map[string]time.Time)
+)
+
+type cachedQuote struct {
+	quote   *quote
+	fetched time.Time
+}
+
+// Service contains the Config fields for the Stock service.
+//
+// The quotes come from Alpha Vantage (https://www.alphavantage.co/), whose free API keys can
+// look up 5 quotes a minute, or IEX Cloud (https://iexcloud.io/), whose tokens use up the
+// account's credits. Either way, each quote is reused for a minute, and once the provider says
+// the rate limit has been reached, rooms are asked to try again later rather than the provider
+// being asked again.
+//
+// Example JSON request:
+//   {
+//       "provider": "alphavantage",
+//       "api_key": "ABCDEFGHIJKLMNOP"
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The provider of quotes: "alphavantage" or "iex". Defaults to "alphavantage".
+	Provider string `json:"provider"`
+	// The provider's API key, or token for IEX Cloud.
+	APIKey string `json:"api_key"`
+}
+
+// Commands supported:
+//    !stock symbol
+// Responds with the last price, daily change and volume of the stock.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"stock"},
+			Arguments: []string{"symbol"},
+			Help:      "Show the latest price of a stock, e.g. !stock AAPL",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdStock(args, time.Now())
+			},
+		},
+	}
+}
+
+func (s *Service) cmdStock(args []string, now time.Time) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !stock symbol, e.g. !stock AAPL")
+	}
+	symbol := strings.ToUpper(args[0])
+	q, err := s.lookup(symbol, now)
+	if err == errRateLimited {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Too many stock quotes have been asked for. Try again in a minute.",
+		}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to look up %s: %s", symbol, err)
+	}
+	if q == nil {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("No quote found for %s", symbol),
+		}, nil
+	}
+
+	title := q.Symbol
+	if q.Name != "" {
+		title += " (" + q.Name + ")"
+	}
+	arrow := "▲"
+	if q.Change < 0 {
+		arrow = "▼"
+	}
+	summary := fmt.Sprintf("%s %s %+.2f (%+.2f%%)", formatNumber(q.Price, 2), arrow, q.Change, q.ChangePercent)
+	details := "Volume " + formatNumber(float64(q.Volume), 0)
+	if q.LatestTrade != "" {
+		details += " · As of " + q.LatestTrade
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("%s: %s\n%s", title, summary, details),
+		Format:  mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf("<strong>%s</strong>: %s<br>%s",
+			html.EscapeString(title), html.EscapeString(summary), html.EscapeString(details)),
+	}, nil
+}
+
+// lookup returns the stock's quote, from the cache if it was looked up recently.
+func (s *Service) lookup(symbol string, now time.Time) (*quote, error) {
+	key := s.ServiceID() + " " + symbol
+	cacheMutex.Lock()
+	cached, ok := quoteCache[key]
+	until := limitedUntil[s.ServiceID()]
+	cacheMutex.Unlock()
+	if ok && now.Sub(cached.fetched) < quoteTTL {
+		return cached.quote, nil
+	}
+	if now.Before(until) {
+		return nil, errRateLimited
+	}
+
+	q, err := s.provider().quote(symbol)
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	if err == errRateLimited {
+		limitedUntil[s.ServiceID()] = now.Add(rateLimitBackoff)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	// Forget old quotes, so the cache doesn't grow with every symbol ever asked for
+	for k, c := range quoteCache {
+		if now.Sub(c.fetched) >= quoteTTL {
+			delete(quoteCache, k)
+		}
+	}
+	quoteCache[key] = cachedQuote{q, now}
+	return q, nil
+}
+
+func (s *Service) provider() provider {
+	if s.Provider == "iex" {
+		return &iexProvider{token: s.APIKey}
+	}
+	return &alphaVantageProvider{apiKey: s.APIKey}
+}
+
+// formatNumber returns the number with commas between the thousands, e.g. "1,234.50".
+func formatNumber(n float64, decimals int) string {
+	s := strconv.FormatFloat(n, 'f', decimals, 64)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	whole, fraction := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		whole, fraction = s[:i], s[i:]
+	}
+	for i := len(whole) - 3; i > 0; i -= 3 {
+		whole = whole[:i] + "," + whole[i:]
+	}
+	return sign + whole + fraction
+}
+
+// Register makes sure that the provider is configured.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	switch s.Provider {
+	case "", "alphavantage", "iex":
+	default:
+		return fmt.Errorf("Unknown provider '%s': must be alphavantage or iex", s.Provider)
+	}
+	if s.APIKey == "" {
+		return fmt.Errorf("An api_key is required")
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
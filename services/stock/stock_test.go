@@ -0,0 +1,114 @@
+package stock
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestStock(t *testing.T) {
+	requests := 0
+	rateLimited := false
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		requests++
+		var body string
+		status := 200
+		switch req.URL.String() {
+		case "https://www.alphavantage.co/query?apikey=secret&function=GLOBAL_QUOTE&symbol=IBM":
+			body = `{"Global Quote":{"01. symbol":"IBM","05. price":"127.6100","06. volume":"5625372",
+				"07. latest trading day":"2021-03-12","09. change":"-1.2400","10. change percent":"-0.9624%"}}`
+			if rateLimited {
+				body = `{"Note":"Thank you for using Alpha Vantage! Our standard API call frequency is 5 calls per minute."}`
+			}
+		case "https://www.alphavantage.co/query?apikey=secret&function=GLOBAL_QUOTE&symbol=HYRULE":
+			body = `{"Global Quote":{}}`
+		case "https://cloud.iexapis.com/stable/stock/aapl/quote?token=secret":
+			body = `{"symbol":"AAPL","companyName":"Apple Inc","latestPrice":1121.03,"change":2.5,"changePercent":0.02104,
+				"latestVolume":88105050,"latestTime":"March 12, 2021"}`
+		case "https://cloud.iexapis.com/stable/stock/zelda/quote?token=secret":
+			status, body = 404, "Unknown symbol"
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: status,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	srv, err := types.CreateService("alpha", ServiceType, "@neb:hyrule", []byte(`{"api_key": "secret"}`))
+	if err != nil {
+		t.Fatal("Failed to create stock service: ", err)
+	}
+	alpha := srv.(*Service)
+	srv, err = types.CreateService("iex", ServiceType, "@neb:hyrule", []byte(`{"provider": "iex", "api_key": "secret"}`))
+	if err != nil {
+		t.Fatal("Failed to create stock service: ", err)
+	}
+	iex := srv.(*Service)
+	now := time.Date(2021, 3, 13, 12, 0, 0, 0, time.UTC)
+
+	respond := func(res interface{}, err error) string {
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+	for _, tc := range []struct {
+		got, want string
+	}{
+		{respond(alpha.cmdStock([]string{"ibm"}, now)), "IBM: 127.61 ▼ -1.24 (-0.96%)\nVolume 5,625,372 · As of 2021-03-12"},
+		{respond(alpha.cmdStock([]string{"hyrule"}, now)), "No quote found for HYRULE"},
+		{respond(iex.cmdStock([]string{"AAPL"}, now)), "AAPL (Apple Inc): 1,121.03 ▲ +2.50 (+2.10%)\nVolume 88,105,050 · As of March 12, 2021"},
+		{respond(iex.cmdStock([]string{"zelda"}, now)), "No quote found for ZELDA"},
+		{respond(iex.cmdStock(nil, now)), "error: Usage: !stock symbol, e.g. !stock AAPL"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("Got %q, want %q", tc.got, tc.want)
+		}
+	}
+
+	// Quotes are reused for a minute
+	requests = 0
+	respond(alpha.cmdStock([]string{"IBM"}, now.Add(30*time.Second)))
+	if requests != 0 {
+		t.Errorf("Looked up a quote again within a minute")
+	}
+
+	rateLimited = true
+	later := now.Add(2 * time.Minute)
+	want := "Too many stock quotes have been asked for. Try again in a minute."
+	if got := respond(alpha.cmdStock([]string{"IBM"}, later)); got != want {
+		t.Errorf("Bad response when rate limited: %s", got)
+	}
+	requests = 0
+	if got := respond(alpha.cmdStock([]string{"IBM"}, later.Add(30*time.Second))); got != want || requests != 0 {
+		t.Errorf("Asked the provider again while rate limited: %s", got)
+	}
+	rateLimited = false
+	if got := respond(alpha.cmdStock([]string{"IBM"}, later.Add(time.Minute))); got != "IBM: 127.61 ▼ -1.24 (-0.96%)\nVolume 5,625,372 · As of 2021-03-12" {
+		t.Errorf("Bad quote after the rate limit: %s", got)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"provider": "yahoo", "api_key": "secret"}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create stock service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
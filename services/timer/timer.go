@@ -0,0 +1,410 @@
+// Package timer implements a Service which pings people when their countdown timers go off.
+package timer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Timer service
+const ServiceType = "timer"
+
+// How often to look for timers when there are none, in case Go-NEB was restarted with timers
+// which were set by another instance
+const idlePollInterval = time.Hour
+
+const (
+	defaultMaxTimersPerUser = 5
+	defaultMaxDuration      = 7 * 24 * time.Hour
+)
+
+// Commands and OnPoll both update the timers, so they are only loaded and stored while holding
+// this, lest a timer which is cancelled as it goes off still ring.
+var timersMutex sync.Mutex
+
+// Service contains the Config fields for the Timer service.
+//
+// "!timer 10m pizza" sets a timer which pings the sender when it goes off 10 minutes later. With
+// --room, the timer pings the whole room instead. Timers are kept in the service's state, so they
+// still go off if Go-NEB is restarted, although late if it was down when they were due.
+//
+// Example JSON request:
+//   {
+//       "max_timers_per_user": 5,
+//       "max_duration": "24h"
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. How many timers each user can have at once. Defaults to 5.
+	MaxTimersPerUser int `json:"max_timers_per_user"`
+	// Optional. The longest timer which can be set, e.g. "24h". Defaults to a week.
+	MaxDuration string `json:"max_duration"`
+}
+
+// timerState is every timer which hasn't gone off yet. It is stored in the service state under
+// "timers".
+type timerState struct {
+	NextID int     `json:"next_id"`
+	Timers []timer `json:"timers"`
+}
+
+type timer struct {
+	ID     int       `json:"id"`
+	RoomID id.RoomID `json:"room_id"`
+	UserID id.UserID `json:"user_id"`
+	Label  string    `json:"label"`
+	// Whether to ping the room rather than the user who set the timer
+	PingRoom         bool  `json:"ping_room"`
+	DurationSecs     int64 `json:"duration_secs"`
+	DueTimestampSecs int64 `json:"due_timestamp_secs"`
+}
+
+func (t *timer) due() time.Time {
+	return time.Unix(t.DueTimestampSecs, 0)
+}
+
+func (t *timer) description() string {
+	d := formatDuration(time.Duration(t.DurationSecs) * time.Second)
+	if t.Label == "" {
+		return d + " timer"
+	}
+	return fmt.Sprintf("%s (%s timer)", t.Label, d)
+}
+
+// Commands supported:
+//    !timer [--room] duration [label]
+// Sets a timer, e.g. "!timer 1h30m check the oven", which pings the sender, or the room with
+// --room, when it goes off.
+//    !timer list
+// Responds with the timers set in the room.
+//    !timer cancel ID
+// Cancels one of the sender's timers.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"timer"},
+			Arguments: []string{"[--room]", "duration", "[label]"},
+			Help:      "Set a timer, e.g. !timer 10m pizza",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdTimer(cli, roomID, userID, args, time.Now())
+			},
+		},
+		{
+			Path: []string{"timer", "list"},
+			Help: "Show the timers set in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdList(roomID, time.Now())
+			},
+		},
+		{
+			Path:      []string{"timer", "cancel"},
+			Arguments: []string{"ID"},
+			Help:      "Cancel one of your timers",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdCancel(userID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdTimer(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	pingRoom := false
+	if len(args) > 0 && args[0] == "--room" {
+		pingRoom = true
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Usage: !timer [--room] duration [label], e.g. !timer 10m pizza")
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("Bad duration '%s': use e.g. 90s, 10m or 1h30m", args[0])
+	}
+	d = d.Round(time.Second)
+	if d <= 0 {
+		return nil, fmt.Errorf("The timer must be at least 1 second long")
+	}
+	if maxDuration := s.maxDuration(); d > maxDuration {
+		return nil, fmt.Errorf("Timers can be at most %s long", formatDuration(maxDuration))
+	}
+
+	timersMutex.Lock()
+	defer timersMutex.Unlock()
+	state, err := s.loadTimers()
+	if err != nil {
+		return nil, err
+	}
+	count := 0
+	for _, t := range state.Timers {
+		if t.UserID == userID {
+			count++
+		}
+	}
+	if count >= s.maxTimersPerUser() {
+		return nil, fmt.Errorf("You already have %d timers running. Cancel one with !timer cancel ID", count)
+	}
+	state.NextID++
+	t := timer{
+		ID:               state.NextID,
+		RoomID:           roomID,
+		UserID:           userID,
+		Label:            strings.Join(args[1:], " "),
+		PingRoom:         pingRoom,
+		DurationSecs:     int64(d / time.Second),
+		DueTimestampSecs: now.Add(d).Unix(),
+	}
+	state.Timers = append(state.Timers, t)
+	if err = s.storeTimers(state); err != nil {
+		return nil, err
+	}
+	// The poller might be asleep until a later timer, so go off on time without it. If Go-NEB is
+	// restarted first, the poller sends it instead.
+	time.AfterFunc(d, func() {
+		s.fireDue(cli, time.Now())
+	})
+
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body: fmt.Sprintf("⏲️ Timer %d set: %s, going off at %s", t.ID, t.description(),
+			t.due().UTC().Format("15:04:05 MST")),
+	}, nil
+}
+
+func (s *Service) cmdList(roomID id.RoomID, now time.Time) (interface{}, error) {
+	timersMutex.Lock()
+	state, err := s.loadTimers()
+	timersMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, t := range state.Timers {
+		if t.RoomID != roomID {
+			continue
+		}
+		left := t.due().Sub(now)
+		if left < 0 {
+			left = 0
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s – %s left, set by %s", t.ID, t.description(), formatDuration(left), t.UserID))
+	}
+	if len(lines) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "There are no timers in this room",
+		}, nil
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    "Timers:\n" + strings.Join(lines, "\n"),
+	}, nil
+}
+
+func (s *Service) cmdCancel(userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Usage: !timer cancel ID")
+	}
+	timerID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return nil, fmt.Errorf("Bad timer ID '%s'", args[0])
+	}
+
+	timersMutex.Lock()
+	defer timersMutex.Unlock()
+	state, err := s.loadTimers()
+	if err != nil {
+		return nil, err
+	}
+	for i, t := range state.Timers {
+		if t.ID != timerID {
+			continue
+		}
+		if t.UserID != userID {
+			return nil, fmt.Errorf("Timer %d was set by %s, so only they can cancel it", t.ID, t.UserID)
+		}
+		state.Timers = append(state.Timers[:i], state.Timers[i+1:]...)
+		if err = s.storeTimers(state); err != nil {
+			return nil, err
+		}
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("Cancelled timer %d: %s", t.ID, t.description()),
+		}, nil
+	}
+	return nil, fmt.Errorf("There is no timer %d", timerID)
+}
+
+// OnPoll sends the timers which went off while Go-NEB wasn't running, and returns when the next
+// timer goes off.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	now := time.Now()
+	next := s.fireDue(cli, now)
+	if next.IsZero() || next.After(now.Add(idlePollInterval)) {
+		return now.Add(idlePollInterval)
+	}
+	return next
+}
+
+// fireDue pings the rooms of the timers which have gone off, forgets them, and returns when the
+// next timer goes off, or the zero time if there are no more.
+func (s *Service) fireDue(cli types.MatrixClient, now time.Time) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	timersMutex.Lock()
+	defer timersMutex.Unlock()
+	state, err := s.loadTimers()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load timers")
+		return time.Time{}
+	}
+
+	var due, pending []timer
+	for _, t := range state.Timers {
+		if now.Before(t.due()) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	if len(due) > 0 {
+		// Forget the timers first, so that they can't go off twice if storing fails
+		state.Timers = pending
+		if err = s.storeTimers(state); err != nil {
+			logger.WithError(err).Error("Failed to store timers")
+			return time.Time{}
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].DueTimestampSecs < due[j].DueTimestampSecs })
+	for _, t := range due {
+		if _, err := cli.SendMessageEvent(t.RoomID, mevt.EventMessage, timerMessage(t, now)); err != nil {
+			logger.WithError(err).WithField("room_id", t.RoomID).Error("Failed to send timer")
+		}
+	}
+
+	var next time.Time
+	for _, t := range pending {
+		if next.IsZero() || t.due().Before(next) {
+			next = t.due()
+		}
+	}
+	return next
+}
+
+// timerMessage pings the user or room of a timer which has gone off.
+func timerMessage(t timer, now time.Time) *mevt.MessageEventContent {
+	late := ""
+	if lateness := now.Sub(t.due()); lateness >= time.Minute {
+		late = fmt.Sprintf(" – %s late, sorry!", formatDuration(lateness))
+	}
+	pill := fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, t.UserID, html.EscapeString(t.UserID.String()))
+	if t.PingRoom {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgText,
+			Body:    fmt.Sprintf("🔔 @room: %s, set by %s%s", t.description(), t.UserID, late),
+			Format:  mevt.FormatHTML,
+			FormattedBody: fmt.Sprintf("🔔 @room: %s, set by %s%s",
+				html.EscapeString(t.description()), pill, html.EscapeString(late)),
+		}
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgText,
+		Body:          fmt.Sprintf("🔔 %s: %s%s", t.UserID, t.description(), late),
+		Format:        mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf("🔔 %s: %s%s", pill, html.EscapeString(t.description()), html.EscapeString(late)),
+	}
+}
+
+// formatDuration returns the duration to the second, e.g. "1h30m" or "45s".
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d < time.Second {
+		return "0s"
+	}
+	var parts []string
+	if days := d / (24 * time.Hour); days > 0 {
+		parts = append(parts, fmt.Sprintf("%dd", days))
+	}
+	if h := (d % (24 * time.Hour)) / time.Hour; h > 0 {
+		parts = append(parts, fmt.Sprintf("%dh", h))
+	}
+	if m := (d % time.Hour) / time.Minute; m > 0 {
+		parts = append(parts, fmt.Sprintf("%dm", m))
+	}
+	if sec := (d % time.Minute) / time.Second; sec > 0 {
+		parts = append(parts, fmt.Sprintf("%ds", sec))
+	}
+	return strings.Join(parts, "")
+}
+
+func (s *Service) maxTimersPerUser() int {
+	if s.MaxTimersPerUser <= 0 {
+		return defaultMaxTimersPerUser
+	}
+	return s.MaxTimersPerUser
+}
+
+func (s *Service) maxDuration() time.Duration {
+	d, err := time.ParseDuration(s.MaxDuration)
+	if err != nil || d <= 0 {
+		return defaultMaxDuration
+	}
+	return d
+}
+
+func (s *Service) loadTimers() (*timerState, error) {
+	var state timerState
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "timers")
+	if err == sql.ErrNoRows {
+		return &state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (s *Service) storeTimers(state *timerState) error {
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "timers", stateJSON)
+}
+
+// Register makes sure that the limits are sensible.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.MaxDuration != "" {
+		if d, err := time.ParseDuration(s.MaxDuration); err != nil || d <= 0 {
+			return fmt.Errorf("Bad max_duration '%s'", s.MaxDuration)
+		}
+	}
+	if s.MaxTimersPerUser < 0 {
+		return fmt.Errorf("max_timers_per_user can't be negative")
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
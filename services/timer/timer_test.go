@@ -0,0 +1,120 @@
+package timer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestTimers(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		roomID := strings.Split(strings.TrimPrefix(req.URL.Path, "/_matrix/client/r0/rooms/"), "/")[0]
+		sent = append(sent, roomID+" "+msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$timer:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"max_timers_per_user":2,"max_duration":"24h"}`))
+	if err != nil {
+		t.Fatal("Failed to create timer service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register timer service: ", err)
+	}
+	s := srv.(*Service)
+
+	body := func(res interface{}, err error) string {
+		if err != nil {
+			t.Fatalf("Command failed: %s", err)
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+	// Timers are stored to the second
+	now := time.Now().Truncate(time.Second)
+	set := func(userID string, args string) (interface{}, error) {
+		return s.cmdTimer(matrixCli, "!kitchen:hyrule", id.UserID("@"+userID+":hyrule"), strings.Fields(args), now)
+	}
+
+	if got := body(set("link", "10m pizza")); !strings.HasPrefix(got, "⏲️ Timer 1 set: pizza (10m timer), going off at ") {
+		t.Errorf("Bad confirmation: %s", got)
+	}
+	body(set("link", "--room 1h30m team lunch"))
+	if _, err = set("link", "5m tea"); err == nil {
+		t.Errorf("Expected a third timer to be refused")
+	}
+	if _, err = set("zelda", "25h cake"); err == nil {
+		t.Errorf("Expected a timer longer than max_duration to be refused")
+	}
+	if _, err = set("zelda", "soon"); err == nil {
+		t.Errorf("Expected a bad duration to be refused")
+	}
+	body(set("zelda", "20m"))
+
+	if got := body(s.cmdList("!kitchen:hyrule", now.Add(5*time.Minute))); got != "Timers:\n"+
+		"1. pizza (10m timer) – 5m left, set by @link:hyrule\n"+
+		"2. team lunch (1h30m timer) – 1h25m left, set by @link:hyrule\n"+
+		"3. 20m timer – 15m left, set by @zelda:hyrule" {
+		t.Errorf("Bad list: %s", got)
+	}
+	if got := body(s.cmdList("!hall:hyrule", now)); got != "There are no timers in this room" {
+		t.Errorf("Bad list for another room: %s", got)
+	}
+	if _, err = s.cmdCancel("@zelda:hyrule", []string{"1"}); err == nil {
+		t.Errorf("Expected cancelling someone else's timer to fail")
+	}
+	if got := body(s.cmdCancel("@zelda:hyrule", []string{"3"})); got != "Cancelled timer 3: 20m timer" {
+		t.Errorf("Bad cancel: %s", got)
+	}
+
+	// Timers only go off once, and late ones say so
+	next := s.fireDue(matrixCli, now.Add(12*time.Minute))
+	s.fireDue(matrixCli, now.Add(12*time.Minute))
+	if next.Unix() != now.Add(90*time.Minute).Unix() {
+		t.Errorf("Bad next timer: got %s", next)
+	}
+	s.fireDue(matrixCli, now.Add(90*time.Minute))
+	want := []string{
+		"!kitchen:hyrule 🔔 @link:hyrule: pizza (10m timer) – 2m late, sorry!",
+		"!kitchen:hyrule 🔔 @room: team lunch (1h30m timer), set by @link:hyrule",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("Bad timers sent: got %q, want %q", sent, want)
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	testCases := map[time.Duration]string{
+		45 * time.Second:               "45s",
+		10 * time.Minute:               "10m",
+		90*time.Minute + 5*time.Second: "1h30m5s",
+		50 * time.Hour:                 "2d2h",
+		0:                              "0s",
+	}
+	for d, want := range testCases {
+		if got := formatDuration(d); got != want {
+			t.Errorf("formatDuration(%s): got %s, want %s", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+// Package timezone implements a Service which tells the time around the world and converts meeting times.
+package timezone
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Timezone service
+const ServiceType = "timezone"
+
+// Common abbreviations and names of timezones. Abbreviations which change with daylight saving
+// time, like CET and CEST, mean the local time of the region rather than a fixed offset.
+var abbreviations = map[string]string{
+	"UTC":        "UTC",
+	"GMT":        "Europe/London",
+	"BST":        "Europe/London",
+	"WET":        "Europe/Lisbon",
+	"CET":        "Europe/Berlin",
+	"CEST":       "Europe/Berlin",
+	"EET":        "Europe/Helsinki",
+	"EEST":       "Europe/Helsinki",
+	"MSK":        "Europe/Moscow",
+	"IST":        "Asia/Kolkata",
+	"SGT":        "Asia/Singapore",
+	"HKT":        "Asia/Hong_Kong",
+	"JST":        "Asia/Tokyo",
+	"KST":        "Asia/Seoul",
+	"AEST":       "Australia/Sydney",
+	"AEDT":       "Australia/Sydney",
+	"NZST":       "Pacific/Auckland",
+	"NZDT":       "Pacific/Auckland",
+	"ET":         "America/New_York",
+	"EST":        "America/New_York",
+	"EDT":        "America/New_York",
+	"CT":         "America/Chicago",
+	"CST":        "America/Chicago",
+	"CDT":        "America/Chicago",
+	"MT":         "America/Denver",
+	"MST":        "America/Denver",
+	"MDT":        "America/Denver",
+	"PT":         "America/Los_Angeles",
+	"PST":        "America/Los_Angeles",
+	"PDT":        "America/Los_Angeles",
+	"US-EAST":    "America/New_York",
+	"US-CENTRAL": "America/Chicago",
+	"US-WEST":    "America/Los_Angeles",
+}
+
+// The regions of IANA timezones which are named after cities, e.g. "Asia/Tokyo"
+var regions = []string{"Europe", "America", "Asia", "Africa", "Australia", "Pacific", "Atlantic", "Indian"}
+
+// Service contains the Config fields for the Timezone service.
+//
+// This service tells the time in other places, and converts meeting times into other timezones:
+//   !time in Tokyo
+//   !when 15:00 CET for US-East, IST
+// Places can be IANA timezones ("Asia/Kolkata"), cities which timezones are named after ("New
+// York"), common abbreviations ("PST"), the aliases configured below, or Matrix users who have
+// registered their own timezone with "!time set Europe/Paris".
+//
+// Other services, such as standups, use UserLocation to show times in users' own timezones.
+//
+// Example JSON request:
+//   {
+//       "aliases": {
+//           "HQ": "America/Los_Angeles",
+//           "Bangalore office": "Asia/Kolkata"
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. Extra place names, such as offices, and the IANA timezones they are in.
+	Aliases map[string]string `json:"aliases"`
+}
+
+// userTimezone is the timezone a user registered. It is stored in the service state under
+// "user <user ID>".
+type userTimezone struct {
+	Timezone string `json:"timezone"`
+}
+
+// Commands supported:
+//    !time
+// Responds with the time in the sender's timezone.
+//    !time in place
+//    !time place
+// Responds with the time in the place.
+//    !time set place
+//    !time unset
+// Registers or forgets the sender's timezone.
+//    !when time [place] [for place, place...]
+// Responds with the time in each place, when it is the time in the first place. The first place
+// defaults to the sender's timezone, and without "for" the time is converted into it.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"time"},
+			Help: "Show the time in your timezone",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				if len(args) == 0 {
+					args = []string{userID.String()}
+				}
+				return s.cmdTimeIn(userID, args, time.Now())
+			},
+		},
+		{
+			Path:      []string{"time", "in"},
+			Arguments: []string{"place"},
+			Help:      "Show the time in a place or timezone",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdTimeIn(userID, args, time.Now())
+			},
+		},
+		{
+			Path:      []string{"time", "set"},
+			Arguments: []string{"timezone"},
+			Help:      "Set your timezone, which other commands and services use",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSet(userID, args)
+			},
+		},
+		{
+			Path: []string{"time", "unset"},
+			Help: "Forget your timezone",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdUnset(userID)
+			},
+		},
+		{
+			Path:      []string{"when"},
+			Arguments: []string{"time", "[place]", "[for place, place...]"},
+			Help:      "Convert a time into other timezones",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdWhen(userID, args, time.Now())
+			},
+		},
+	}
+}
+
+func (s *Service) cmdTimeIn(userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	place := strings.Join(args, " ")
+	if place == "" {
+		return nil, fmt.Errorf("Usage: !time in place")
+	}
+	loc, err := s.resolve(place)
+	if err != nil {
+		return nil, err
+	}
+	t := now.In(loc)
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("It's %s in %s (%s)", t.Format("15:04 on Mon 2 Jan"), place, describeZone(t)),
+	}, nil
+}
+
+func (s *Service) cmdSet(userID id.UserID, args []string) (interface{}, error) {
+	place := strings.Join(args, " ")
+	if place == "" || strings.HasPrefix(place, "@") {
+		return nil, fmt.Errorf("Usage: !time set timezone, e.g. !time set Europe/Paris")
+	}
+	loc, err := s.resolve(place)
+	if err != nil {
+		return nil, err
+	}
+	stateJSON, err := json.Marshal(userTimezone{Timezone: loc.String()})
+	if err != nil {
+		return nil, err
+	}
+	if err = database.GetServiceDB().StoreServiceState(s.ServiceID(), "user "+userID.String(), stateJSON); err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Your timezone is now %s (%s)", loc, describeZone(time.Now().In(loc))),
+	}, nil
+}
+
+func (s *Service) cmdUnset(userID id.UserID) (interface{}, error) {
+	if err := database.GetServiceDB().DeleteServiceState(s.ServiceID(), "user "+userID.String()); err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    "Forgotten your timezone",
+	}, nil
+}
+
+func (s *Service) cmdWhen(userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	usage := fmt.Errorf("Usage: !when 15:00 CET for US-East, IST")
+	if len(args) == 0 {
+		return nil, usage
+	}
+	from, to := args, []string(nil)
+	for i, arg := range args {
+		if strings.EqualFold(arg, "for") {
+			from = args[:i]
+			to = strings.Split(strings.Join(args[i+1:], " "), ",")
+			break
+		}
+	}
+	if len(from) == 0 {
+		return nil, usage
+	}
+
+	// The time is in the sender's timezone, unless it says where
+	fromPlace := strings.Join(from[1:], " ")
+	if fromPlace == "" {
+		fromPlace = userID.String()
+	}
+	fromLoc, err := s.resolve(fromPlace)
+	if err != nil {
+		return nil, err
+	}
+	clock, err := parseClock(from[0])
+	if err != nil {
+		return nil, err
+	}
+	today := now.In(fromLoc)
+	t := time.Date(today.Year(), today.Month(), today.Day(), clock.Hour(), clock.Minute(), 0, 0, fromLoc)
+
+	if len(to) == 0 {
+		to = []string{userID.String()}
+	}
+	names := []string{fromPlace}
+	times := []time.Time{t}
+	for _, place := range to {
+		place = strings.TrimSpace(place)
+		if place == "" {
+			continue
+		}
+		loc, err := s.resolve(place)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, place)
+		times = append(times, t.In(loc))
+	}
+
+	var lines, rows []string
+	for i, t := range times {
+		formatted := t.Format("15:04 Mon 2 Jan") + " (" + describeZone(t) + ")"
+		lines = append(lines, fmt.Sprintf("%s: %s", names[i], formatted))
+		rows = append(rows, fmt.Sprintf(
+			"<tr><td>%s</td><td>%s</td></tr>", html.EscapeString(names[i]), html.EscapeString(formatted),
+		))
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: "<table>" + strings.Join(rows, "") + "</table>",
+	}, nil
+}
+
+// parseClock parses a time of day like "15:00", "15", "3pm" or "3:30pm".
+func parseClock(s string) (time.Time, error) {
+	s = strings.ToLower(s)
+	for _, layout := range []string{"15:04", "15", "3pm", "3:04pm"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("'%s' is not a time like 15:00 or 3pm", s)
+}
+
+// describeZone returns the abbreviation and UTC offset of the time's zone, e.g. "JST, UTC+09:00".
+func describeZone(t time.Time) string {
+	return t.Format("MST, UTC-07:00")
+}
+
+// resolve returns the timezone of a place, which can be an alias, an abbreviation, an IANA
+// timezone, a city which a timezone is named after, or a user who registered their timezone.
+func (s *Service) resolve(place string) (*time.Location, error) {
+	place = strings.TrimSpace(place)
+	if strings.HasPrefix(place, "@") {
+		loc, ok, err := s.userLocation(id.UserID(place))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s hasn't set their timezone. Set one with !time set Europe/Paris", place)
+		}
+		return loc, nil
+	}
+	for alias, tz := range s.Aliases {
+		if strings.EqualFold(alias, place) {
+			return time.LoadLocation(tz)
+		}
+	}
+	if tz, ok := abbreviations[strings.ToUpper(place)]; ok {
+		return time.LoadLocation(tz)
+	}
+	// LoadLocation treats "" as UTC and "Local" as wherever Go-NEB runs
+	if place != "" && place != "Local" {
+		if loc, err := time.LoadLocation(place); err == nil {
+			return loc, nil
+		}
+	}
+	city := strings.Join(strings.Fields(strings.Title(strings.ToLower(place))), "_")
+	if city != "" {
+		for _, region := range regions {
+			if loc, err := time.LoadLocation(region + "/" + city); err == nil {
+				return loc, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Unknown place '%s'. Try a timezone like Europe/Paris", place)
+}
+
+// userLocation returns the timezone the user registered with this service.
+func (s *Service) userLocation(userID id.UserID) (*time.Location, bool, error) {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "user "+userID.String())
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	var tz userTimezone
+	if err = json.Unmarshal(stateJSON, &tz); err != nil {
+		return nil, false, err
+	}
+	loc, err := time.LoadLocation(tz.Timezone)
+	if err != nil {
+		return nil, false, err
+	}
+	return loc, true, nil
+}
+
+// UserLocation returns the timezone which the user registered with "!time set", with any
+// Timezone service, or false if they haven't registered one.
+func UserLocation(userID id.UserID) (*time.Location, bool) {
+	srvs, err := database.GetServiceDB().LoadServicesByType(ServiceType)
+	if err != nil {
+		log.WithError(err).Error("Failed to load timezone services")
+		return nil, false
+	}
+	for _, srv := range srvs {
+		s, ok := srv.(*Service)
+		if !ok {
+			continue
+		}
+		loc, ok, err := s.userLocation(userID)
+		if err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"service_id": s.ServiceID(),
+				"user_id":    userID,
+			}).Error("Failed to load user timezone")
+		} else if ok {
+			return loc, true
+		}
+	}
+	return nil, false
+}
+
+// Register makes sure that the aliases are real timezones.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	for alias, tz := range s.Aliases {
+		if _, err := time.LoadLocation(tz); err != nil || tz == "" {
+			return fmt.Errorf("Bad timezone '%s' for alias '%s'", tz, alias)
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package timezone
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+type stateStorage struct {
+	*testutils.StateStorage
+	services []types.Service
+}
+
+func (s *stateStorage) LoadServicesByType(serviceType string) ([]types.Service, error) {
+	return s.services, nil
+}
+
+func createService(t *testing.T) (*Service, *stateStorage) {
+	storage := &stateStorage{StateStorage: testutils.NewStateStorage()}
+	database.SetServiceDB(storage)
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"aliases":{"Castle":"Europe/London"}}`))
+	if err != nil {
+		t.Fatal("Failed to create timezone service: ", err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register timezone service: ", err)
+	}
+	storage.services = []types.Service{srv}
+	return srv.(*Service), storage
+}
+
+func TestResolve(t *testing.T) {
+	s, _ := createService(t)
+	testCases := map[string]string{
+		"Tokyo":           "Asia/Tokyo",
+		"new york":        "America/New_York",
+		"Europe/Paris":    "Europe/Paris",
+		"cet":             "Europe/Berlin",
+		"US-East":         "America/New_York",
+		"castle":          "Europe/London",
+		"UTC":             "UTC",
+		"Nowhere":         "",
+		"Local":           "",
+		"../../etc/hosts": "",
+	}
+	for place, want := range testCases {
+		loc, err := s.resolve(place)
+		if want == "" {
+			if err == nil {
+				t.Errorf("Expected %s to be unknown, got %s", place, loc)
+			}
+		} else if err != nil || loc.String() != want {
+			t.Errorf("resolve(%s) = %v, %v, want %s", place, loc, err, want)
+		}
+	}
+}
+
+func TestWhen(t *testing.T) {
+	s, _ := createService(t)
+	now := time.Date(2020, time.July, 6, 12, 0, 0, 0, time.UTC)
+
+	res, err := s.cmdWhen("@link:hyrule", strings.Fields("15:00 CET for US-East, IST"), now)
+	if err != nil {
+		t.Fatalf("!when failed: %s", err)
+	}
+	want := "CET: 15:00 Mon 6 Jul (CEST, UTC+02:00)\n" +
+		"US-East: 09:00 Mon 6 Jul (EDT, UTC-04:00)\n" +
+		"IST: 18:30 Mon 6 Jul (IST, UTC+05:30)"
+	if body := res.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("Bad !when: got %q, want %q", body, want)
+	}
+
+	// Times without a place are in the sender's timezone, which they have to set first
+	if _, err = s.cmdWhen("@link:hyrule", strings.Fields("11pm for Tokyo"), now); err == nil {
+		t.Errorf("Expected !when to fail without a timezone")
+	}
+	if _, err = s.cmdSet("@link:hyrule", []string{"Castle"}); err != nil {
+		t.Fatalf("!time set failed: %s", err)
+	}
+	res, err = s.cmdWhen("@link:hyrule", strings.Fields("11pm for Tokyo, @link:hyrule"), now)
+	if err != nil {
+		t.Fatalf("!when failed: %s", err)
+	}
+	want = "@link:hyrule: 23:00 Mon 6 Jul (BST, UTC+01:00)\n" +
+		"Tokyo: 07:00 Tue 7 Jul (JST, UTC+09:00)\n" +
+		"@link:hyrule: 23:00 Mon 6 Jul (BST, UTC+01:00)"
+	if body := res.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("Bad !when: got %q, want %q", body, want)
+	}
+
+	for _, args := range []string{"", "for Tokyo", "25:00 UTC for Tokyo", "15:00 Atlantis for Tokyo"} {
+		if _, err = s.cmdWhen("@link:hyrule", strings.Fields(args), now); err == nil {
+			t.Errorf("Expected '!when %s' to fail", args)
+		}
+	}
+}
+
+func TestUserLocation(t *testing.T) {
+	s, storage := createService(t)
+	if _, ok := UserLocation("@zelda:hyrule"); ok {
+		t.Errorf("Expected no timezone before !time set")
+	}
+	if _, err := s.cmdSet("@zelda:hyrule", []string{"Asia/Tokyo"}); err != nil {
+		t.Fatalf("!time set failed: %s", err)
+	}
+	if loc, ok := UserLocation("@zelda:hyrule"); !ok || loc.String() != "Asia/Tokyo" {
+		t.Errorf("Expected Asia/Tokyo, got %v", loc)
+	}
+
+	now := time.Date(2020, time.July, 6, 12, 0, 0, 0, time.UTC)
+	res, err := s.cmdTimeIn("@zelda:hyrule", []string{"@zelda:hyrule"}, now)
+	if err != nil {
+		t.Fatalf("!time failed: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "It's 21:00 on Mon 6 Jul in @zelda:hyrule (JST, UTC+09:00)" {
+		t.Errorf("Bad !time: %s", body)
+	}
+
+	if _, err = s.cmdUnset("@zelda:hyrule"); err != nil {
+		t.Fatalf("!time unset failed: %s", err)
+	}
+	if len(storage.State) != 0 {
+		t.Errorf("Expected the timezone to be forgotten, got %v", storage.State)
+	}
+}
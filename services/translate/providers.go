@@ -0,0 +1,151 @@
+package translate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The provider APIs. Overridden by tests.
+var (
+	googleURL    = "https://translation.googleapis.com/language/translate/v2"
+	deeplURL     = "https://api.deepl.com/v2/translate"
+	deeplFreeURL = "https://api-free.deepl.com/v2/translate"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// translation is some text in another language.
+type translation struct {
+	Text string
+	// The language the provider detected the original text to be in, e.g. "fr"
+	SourceLanguage string
+}
+
+// A provider translates text into the target language, detecting the language of the text.
+type provider interface {
+	translate(text, target string) (*translation, error)
+}
+
+// newProvider returns the provider with the name, "google" or "deepl", defaulting to Google.
+func newProvider(name, apiKey string) provider {
+	if name == "deepl" {
+		return &deeplProvider{authKey: apiKey}
+	}
+	return &googleProvider{apiKey: apiKey}
+}
+
+// Text translates the text into the target language with the named provider, "google" or
+// "deepl", so that other services can translate too. It returns the translation and the language
+// which the provider detected the text to be in, e.g. "fr".
+func Text(providerName, apiKey, text, target string) (string, string, error) {
+	t, err := newProvider(providerName, apiKey).translate(text, target)
+	if err != nil {
+		return "", "", err
+	}
+	return t.Text, t.SourceLanguage, nil
+}
+
+// googleProvider uses the Google Cloud Translation API (v2), with an API key.
+type googleProvider struct {
+	apiKey string
+}
+
+func (p *googleProvider) translate(text, target string) (*translation, error) {
+	form := url.Values{}
+	form.Set("q", text)
+	form.Set("target", target)
+	form.Set("format", "text")
+	res, err := httpClient.PostForm(googleURL+"?key="+url.QueryEscape(p.apiKey), form)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Data struct {
+			Translations []struct {
+				TranslatedText         string `json:"translatedText"`
+				DetectedSourceLanguage string `json:"detectedSourceLanguage"`
+			} `json:"translations"`
+		} `json:"data"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	if res.StatusCode != http.StatusOK {
+		if body.Error.Message != "" {
+			return nil, fmt.Errorf("%s", body.Error.Message)
+		}
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	if len(body.Data.Translations) == 0 {
+		return nil, fmt.Errorf("No translation returned")
+	}
+	t := body.Data.Translations[0]
+	return &translation{Text: t.TranslatedText, SourceLanguage: t.DetectedSourceLanguage}, nil
+}
+
+// deeplProvider uses the DeepL API. Keys for the free API end in ":fx" and use a different host.
+type deeplProvider struct {
+	authKey string
+}
+
+func (p *deeplProvider) translate(text, target string) (*translation, error) {
+	u := deeplURL
+	if strings.HasSuffix(p.authKey, ":fx") {
+		u = deeplFreeURL
+	}
+	form := url.Values{}
+	form.Set("text", text)
+	form.Set("target_lang", strings.ToUpper(target))
+	req, err := http.NewRequest("POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "DeepL-Auth-Key "+p.authKey)
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden:
+		return nil, fmt.Errorf("The DeepL api_key was refused")
+	case 456:
+		return nil, fmt.Errorf("The DeepL translation quota has been used up")
+	default:
+		var body struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(res.Body).Decode(&body) == nil && body.Message != "" {
+			return nil, fmt.Errorf("%s", body.Message)
+		}
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var body struct {
+		Translations []struct {
+			DetectedSourceLanguage string `json:"detected_source_language"`
+			Text                   string `json:"text"`
+		} `json:"translations"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if len(body.Translations) == 0 {
+		return nil, fmt.Errorf("No translation returned")
+	}
+	t := body.Translations[0]
+	return &translation{Text: t.Text, SourceLanguage: strings.ToLower(t.DetectedSourceLanguage)}, nil
+}
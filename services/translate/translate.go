@@ -0,0 +1,112 @@
+// Package translate implements a Service which translates text into other languages.
+package translate
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Translate service
+const ServiceType = "translate"
+
+// The most text that will be sent to the provider at once, as providers charge by the character
+const maxTextLength = 2000
+
+// A language code like "de", "pt-BR" or "zh-Hant"
+var languageRegex = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z]{2,4})?$`)
+
+// Service contains the Config fields for the Translate service.
+//
+// Translations come from the Google Cloud Translation API
+// (https://cloud.google.com/translate), or from DeepL (https://www.deepl.com/pro-api), whose
+// free API keys end in ":fx". Either way the language of the text is detected by the provider.
+//
+// Example JSON request:
+//   {
+//       "provider": "deepl",
+//       "api_key": "00000000-0000-0000-0000-000000000000:fx"
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The provider of translations: "google" or "deepl". Defaults to "google".
+	Provider string `json:"provider"`
+	// The provider's API key.
+	APIKey string `json:"api_key"`
+}
+
+// Commands supported:
+//    !translate lang text
+// Responds with the text translated into the language, e.g. "!translate de Good morning".
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"translate"},
+			Arguments: []string{"lang", "text"},
+			Help:      "Translate text into another language, e.g. !translate de Good morning",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdTranslate(args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdTranslate(args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("Usage: !translate lang text, e.g. !translate de Good morning")
+	}
+	target := args[0]
+	if !languageRegex.MatchString(target) {
+		return nil, fmt.Errorf("'%s' is not a language code, e.g. en, de or pt-BR", target)
+	}
+	text := strings.Join(args[1:], " ")
+	if utf8.RuneCountInString(text) > maxTextLength {
+		return nil, fmt.Errorf("Text is too long to translate: the limit is %d characters", maxTextLength)
+	}
+
+	t, err := s.provider().translate(text, target)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to translate: %s", err)
+	}
+	languages := strings.ToUpper(target)
+	if t.SourceLanguage != "" {
+		languages = strings.ToUpper(t.SourceLanguage) + " → " + languages
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          fmt.Sprintf("%s: %s", languages, t.Text),
+		Format:        mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf("<em>%s</em>: %s", html.EscapeString(languages), html.EscapeString(t.Text)),
+	}, nil
+}
+
+func (s *Service) provider() provider {
+	return newProvider(s.Provider, s.APIKey)
+}
+
+// Register makes sure that the provider is configured.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	switch s.Provider {
+	case "", "google", "deepl":
+	default:
+		return fmt.Errorf("Unknown provider '%s': must be google or deepl", s.Provider)
+	}
+	if s.APIKey == "" {
+		return fmt.Errorf("An api_key is required")
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package translate
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestTranslate(t *testing.T) {
+	googleURL = "https://google.hyrule/translate"
+	deeplURL = "https://deepl.hyrule/translate"
+	deeplFreeURL = "https://free.deepl.hyrule/translate"
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if err := req.ParseForm(); err != nil {
+			return nil, err
+		}
+		body := ""
+		switch req.URL.Host {
+		case "google.hyrule":
+			if req.URL.Query().Get("key") != "triforce" {
+				return &http.Response{
+					StatusCode: 400,
+					Body:       ioutil.NopCloser(bytes.NewBufferString(`{"error":{"message":"API key not valid"}}`)),
+				}, nil
+			}
+			if req.PostForm.Get("q") != "Hey, <listen>!" || req.PostForm.Get("target") != "de" {
+				return nil, fmt.Errorf("Bad form: %v", req.PostForm)
+			}
+			body = `{"data":{"translations":[{"translatedText":"Hey, <hör zu>!","detectedSourceLanguage":"en"}]}}`
+		case "free.deepl.hyrule":
+			if req.Header.Get("Authorization") != "DeepL-Auth-Key triforce:fx" {
+				return &http.Response{StatusCode: 403, Body: ioutil.NopCloser(bytes.NewBufferString(""))}, nil
+			}
+			if req.PostForm.Get("text") != "Hey, <listen>!" || req.PostForm.Get("target_lang") != "PT-BR" {
+				return nil, fmt.Errorf("Bad form: %v", req.PostForm)
+			}
+			body = `{"translations":[{"detected_source_language":"EN","text":"Ei, <escute>!"}]}`
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	for _, tc := range []struct {
+		provider   string
+		apiKey     string
+		lang       string
+		wantBody   string
+		wantFormat string
+	}{
+		{"google", "triforce", "de", "EN → DE: Hey, <hör zu>!", "<em>EN → DE</em>: Hey, &lt;hör zu&gt;!"},
+		{"deepl", "triforce:fx", "pt-BR", "EN → PT-BR: Ei, <escute>!", "<em>EN → PT-BR</em>: Ei, &lt;escute&gt;!"},
+	} {
+		s := &Service{Provider: tc.provider, APIKey: tc.apiKey}
+		res, err := s.cmdTranslate([]string{tc.lang, "Hey,", "<listen>!"})
+		if err != nil {
+			t.Errorf("%s: failed to translate: %s", tc.provider, err)
+			continue
+		}
+		msg := res.(*mevt.MessageEventContent)
+		if msg.Body != tc.wantBody || msg.FormattedBody != tc.wantFormat {
+			t.Errorf("%s: got %q / %q, want %q / %q", tc.provider, msg.Body, msg.FormattedBody, tc.wantBody, tc.wantFormat)
+		}
+	}
+
+	for _, tc := range []struct {
+		provider string
+		apiKey   string
+		args     []string
+		wantErr  string
+	}{
+		{"google", "triforce", []string{"de"}, "Usage"},
+		{"google", "triforce", []string{"german!", "Hey"}, "not a language code"},
+		{"google", "triforce", []string{"de", strings.Repeat("a", maxTextLength+1)}, "too long"},
+		{"google", "ganon", []string{"de", "Hey"}, "API key not valid"},
+		{"deepl", "ganon:fx", []string{"de", "Hey"}, "api_key was refused"},
+	} {
+		s := &Service{Provider: tc.provider, APIKey: tc.apiKey}
+		if _, err := s.cmdTranslate(tc.args); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s %v: expected error containing %q, got %v", tc.provider, tc.args, tc.wantErr, err)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"provider": "deepl"}`,
+		`{"provider": "babelfish", "api_key": "triforce"}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create translate service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package travisci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Matches a build ID, or the URL of a build e.g. https://app.travis-ci.com/github/owner/repo/builds/123
+var buildRegex = regexp.MustCompile(`^(?:https?://.*/builds/)?([0-9]+)/?$`)
+
+// A build, as returned by the Travis-CI API v3
+type travisBuild struct {
+	ID                int     `json:"id"`
+	Number            string  `json:"number"`
+	State             string  `json:"state"`
+	Duration          *int    `json:"duration"`
+	EventType         string  `json:"event_type"`
+	PullRequestNumber *int    `json:"pull_request_number"`
+	PullRequestTitle  *string `json:"pull_request_title"`
+	Repository        struct {
+		Slug string `json:"slug"`
+	} `json:"repository"`
+	Branch struct {
+		Name string `json:"name"`
+	} `json:"branch"`
+	Commit struct {
+		SHA     string `json:"sha"`
+		Message string `json:"message"`
+	} `json:"commit"`
+	CreatedBy struct {
+		Login string `json:"login"`
+	} `json:"created_by"`
+}
+
+// An error, as returned by the Travis-CI API v3
+type travisError struct {
+	ErrorType    string `json:"error_type"`
+	ErrorMessage string `json:"error_message"`
+}
+
+// Commands supported:
+//    !travis status owner/repo
+// Responds with the state of the latest build of the repository. The repository can be left out
+// if the room has only one.
+//    !travis restart owner/repo 123456
+// Restarts the build with the given ID or URL.
+//
+// Only the repositories configured for the room can be used, and only if the service has an API token.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"travis", "status"},
+			Arguments: []string{"owner/repo"},
+			Help:      "Show the latest build of a repository",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdStatus(roomID, args)
+			},
+		},
+		{
+			Path:      []string{"travis", "restart"},
+			Arguments: []string{"owner/repo", "build"},
+			Help:      "Restart a build of a repository",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdRestart(roomID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdStatus(roomID id.RoomID, args []string) (interface{}, error) {
+	var repo string
+	if len(args) == 1 {
+		repo = args[0]
+	} else if len(args) == 0 {
+		repos := s.roomRepos(roomID)
+		if len(repos) != 1 {
+			return nil, fmt.Errorf("Usage: !travis status owner/repo")
+		}
+		repo = repos[0]
+	} else {
+		return nil, fmt.Errorf("Usage: !travis status owner/repo")
+	}
+	repo, err := s.requireRoomRepo(roomID, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Builds []travisBuild `json:"builds"`
+	}
+	if err = s.apiRequest("GET", "/repo/"+url.PathEscape(repo)+"/builds?limit=1&sort_by=id:desc", &res); err != nil {
+		return nil, err
+	}
+	if len(res.Builds) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("%s has not been built yet", repo),
+		}, nil
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    s.buildSummary(repo, &res.Builds[0]),
+	}, nil
+}
+
+func (s *Service) cmdRestart(roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("Usage: !travis restart owner/repo build")
+	}
+	repo, err := s.requireRoomRepo(roomID, args[0])
+	if err != nil {
+		return nil, err
+	}
+	match := buildRegex.FindStringSubmatch(args[1])
+	if match == nil {
+		return nil, fmt.Errorf("'%s' is not a build ID or build URL", args[1])
+	}
+	buildID := match[1]
+
+	// Make sure the build belongs to the repository, so that only the room's builds can be restarted.
+	var build travisBuild
+	if err = s.apiRequest("GET", "/build/"+buildID, &build); err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(build.Repository.Slug, repo) {
+		return nil, fmt.Errorf("Build %s is not a build of %s", buildID, repo)
+	}
+	if err = s.apiRequest("POST", "/build/"+buildID+"/restart", nil); err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Restarting %s#%s", repo, build.Number),
+	}, nil
+}
+
+// roomRepos returns the repositories configured for the room.
+func (s *Service) roomRepos(roomID id.RoomID) (repos []string) {
+	for repo := range s.Rooms[roomID].Repos {
+		repos = append(repos, repo)
+	}
+	return
+}
+
+// requireRoomRepo returns the repository as it is configured for the room, or an error if it isn't.
+func (s *Service) requireRoomRepo(roomID id.RoomID, repo string) (string, error) {
+	if s.APIToken == "" {
+		return "", fmt.Errorf("The Travis-CI service has no API token to run commands with")
+	}
+	for _, roomRepo := range s.roomRepos(roomID) {
+		if strings.EqualFold(roomRepo, repo) {
+			return roomRepo, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not a repository of this room", repo)
+}
+
+// buildSummary returns a one line description of the build, with a link to it on travis-ci.com.
+func (s *Service) buildSummary(repo string, b *travisBuild) string {
+	ref := b.Branch.Name
+	if b.EventType == "pull_request" && b.PullRequestNumber != nil {
+		ref = "PR #" + strconv.Itoa(*b.PullRequestNumber)
+	}
+	sha := b.Commit.SHA
+	if len(sha) > 10 {
+		sha = sha[:10]
+	}
+	subject := strings.SplitN(b.Commit.Message, "\n", 2)[0]
+	summary := fmt.Sprintf("%s#%s %s on %s (%s", repo, b.Number, b.State, ref, sha)
+	if b.CreatedBy.Login != "" {
+		summary += " : " + b.CreatedBy.Login
+	}
+	summary += "): " + subject
+	if b.Duration != nil {
+		summary += fmt.Sprintf(" [%s]", time.Duration(*b.Duration)*time.Second)
+	}
+	// Travis CI Enterprise build URLs can't be worked out from the API URL.
+	if s.apiURL() == defaultAPIURLs[0] {
+		summary += fmt.Sprintf("\nhttps://app.travis-ci.com/github/%s/builds/%d", repo, b.ID)
+	}
+	return summary
+}
+
+// apiRequest makes a request to the Travis-CI API v3, decoding the response into out if it is not nil.
+func (s *Service) apiRequest(method, path string, out interface{}) error {
+	req, err := http.NewRequest(method, s.apiURL()+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Travis-API-Version", "3")
+	req.Header.Set("Authorization", "token "+s.APIToken)
+	req.Header.Set("User-Agent", "Go-NEB")
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		var travisErr travisError
+		body, _ := ioutil.ReadAll(res.Body)
+		if json.Unmarshal(body, &travisErr) == nil && travisErr.ErrorMessage != "" {
+			return fmt.Errorf("Travis-CI: %s", travisErr.ErrorMessage)
+		}
+		return fmt.Errorf("Travis-CI responded with HTTP %d", res.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,32 @@
+//go:build go1.18
+// +build go1.18
+
+package travisci
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func FuzzNotification(f *testing.F) {
+	examplePayload, err := url.QueryUnescape(strings.TrimPrefix(exampleBody, "payload="))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(examplePayload, DefaultTemplate)
+	f.Add(`{"repository":{"owner_name":"o","name":"r"},"commit":"abc","started_at":"nope"}`, "%{commit} %{duration}")
+	f.Add(`{}`, "")
+
+	f.Fuzz(func(t *testing.T, payload, template string) {
+		var notif webhookNotification
+		if err := json.Unmarshal([]byte(payload), &notif); err != nil {
+			return
+		}
+		out := outputForTemplate(template, notifToTemplate(notif))
+		if template != "" && !strings.Contains(template, "%{") && out != template {
+			t.Errorf("template without variables was modified: got %q want %q", out, template)
+		}
+	})
+}
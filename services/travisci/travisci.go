@@ -1,16 +1,20 @@
-// Package travisci implements a Service capable of processing webhooks from Travis-CI.
+// Package travisci implements a Service capable of processing webhooks from Travis-CI, and of
+// checking and restarting builds with the Travis-CI API v3.
 package travisci
 
 import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/templates"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
@@ -37,8 +41,12 @@ var httpClient = &http.Client{}
 // webhook events to it. It requires a public domain which Travis-CI can reach.
 // Notices will be sent as the service user ID.
 //
+// If an API token is given, the repositories of a room can also be checked on and have their
+// builds restarted from that room with !travis status and !travis restart.
+//
 // Example JSON request:
 //   {
+//       api_token: "YOUR_TRAVIS_API_TOKEN",
 //       rooms: {
 //           "!ewfug483gsfe:localhost": {
 //               repos: {
@@ -54,6 +62,12 @@ type Service struct {
 	webhookEndpointURL string
 	// The URL which should be added to .travis.yml - Populated by Go-NEB after Service registration.
 	WebhookURL string `json:"webhook_url"`
+	// Optional. A Travis-CI API token, which the !travis commands are run with. It can be found
+	// on the settings page of your Travis-CI account.
+	APIToken string `json:"api_token"`
+	// Optional. The Travis-CI API server. Defaults to https://api.travis-ci.com. Travis CI
+	// Enterprise installations should set this to their own API server.
+	APIURL string `json:"api_url"`
 	// A map from Matrix room ID to Github-style owner/repo repositories.
 	Rooms map[id.RoomID]struct {
 		// A map of "owner/repo" to configuration information
@@ -74,11 +88,15 @@ type Service struct {
 			//   commit_message: commit message of build
 			//   commit_subject: first line of the commit message
 			//   result: result of build
+			//   state: state of the build, e.g. passed, failed or errored
 			//   message: Travis CI message to the build
 			//   duration: total duration of all builds in the matrix
 			//   elapsed_time: time between build start and finish
 			//   compare_url: commit change view URL
 			//   build_url: URL of the build detail
+			//   pull_request_number: the number of the pull request built, if any
+			//   pull_request_title: the title of the pull request built, if any
+			//   tag: the tag built, if any
 			Template string `json:"template"`
 		} `json:"repos"`
 	} `json:"rooms"`
@@ -89,9 +107,12 @@ type webhookNotification struct {
 	ID             int     `json:"id"`
 	Number         string  `json:"number"`
 	Status         *int    `json:"status"` // 0 (success) or 1 (incomplete/fail).
+	State          string  `json:"state"`  // e.g. passed, failed, errored or canceled
 	StartedAt      *string `json:"started_at"`
 	FinishedAt     *string `json:"finished_at"`
 	StatusMessage  string  `json:"status_message"`
+	ResultMessage  string  `json:"result_message"`
+	Duration       *int    `json:"duration"` // seconds, summed over all jobs in the matrix
 	Commit         string  `json:"commit"`
 	Branch         string  `json:"branch"`
 	Message        string  `json:"message"`
@@ -103,7 +124,13 @@ type webhookNotification struct {
 	AuthorEmail    string  `json:"author_email"`
 	Type           string  `json:"type"`
 	BuildURL       string  `json:"build_url"`
-	Repository     struct {
+	// Pull request builds only
+	PullRequest       bool    `json:"pull_request"`
+	PullRequestNumber *int    `json:"pull_request_number"`
+	PullRequestTitle  *string `json:"pull_request_title"`
+	// Tag builds only
+	Tag        *string `json:"tag"`
+	Repository struct {
 		Name      string `json:"name"`
 		OwnerName string `json:"owner_name"`
 		URL       string `json:"url"`
@@ -133,10 +160,13 @@ func notifToTemplate(n webhookNotification) map[string]string {
 	if n.Status != nil {
 		t["result"] = strconv.Itoa(*n.Status)
 	}
+	t["state"] = n.State
 	t["message"] = n.StatusMessage // message: Travis CI message to the build
+	if t["message"] == "" {
+		t["message"] = n.ResultMessage
+	}
 
 	if n.StartedAt != nil && n.FinishedAt != nil {
-		// duration: total duration of all builds in the matrix -- TODO
 		// elapsed_time: time between build start and finish
 		// Example from docs: "2011-11-11T11:11:11Z"
 		start, err := time.Parse("2006-01-02T15:04:05Z", *n.StartedAt)
@@ -151,6 +181,19 @@ func notifToTemplate(n webhookNotification) map[string]string {
 			t["elapsed_time"] = t["duration"]
 		}
 	}
+	if n.Duration != nil {
+		// duration: total duration of all builds in the matrix
+		t["duration"] = (time.Duration(*n.Duration) * time.Second).String()
+	}
+	if n.PullRequest && n.PullRequestNumber != nil {
+		t["pull_request_number"] = strconv.Itoa(*n.PullRequestNumber)
+	}
+	if n.PullRequestTitle != nil {
+		t["pull_request_title"] = *n.PullRequestTitle
+	}
+	if n.Tag != nil {
+		t["tag"] = *n.Tag
+	}
 
 	t["compare_url"] = n.CompareURL
 	t["build_url"] = n.BuildURL
@@ -191,7 +234,7 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		w.WriteHeader(400)
 		return
 	}
-	if err := verifyOrigin([]byte(payload), req.Header.Get("Signature")); err != nil {
+	if err := verifyOrigin([]byte(payload), req.Header.Get("Signature"), s.apiURLs()); err != nil {
 		log.WithFields(log.Fields{
 			"Signature":  req.Header.Get("Signature"),
 			log.ErrorKey: err,
@@ -227,12 +270,17 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 				Body:    outputForTemplate(repoData.Template, tmplData),
 				MsgType: "m.notice",
 			}
+			if repoData.Template == "" {
+				// Repos without their own template use the operator's "travisci" template
+				// override, if there is one. It is given the same variables, e.g. {{.build_url}}.
+				msg = templates.Render("travisci", tmplData, msg)
+			}
 
 			logger.WithFields(log.Fields{
 				"message": msg,
 				"room_id": roomID,
 			}).Print("Sending Travis-CI notification to room")
-			if _, e := cli.SendMessageEvent(roomID, mevt.EventMessage, msg); e != nil {
+			if _, e := notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: msg}); e != nil {
 				logger.WithError(e).WithField("room_id", roomID).Print(
 					"Failed to send Travis-CI notification to room.")
 			}
@@ -241,9 +289,33 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 	w.WriteHeader(200)
 }
 
+// apiURLs returns the API servers whose keys webhooks may be signed with, the configured one first.
+func (s *Service) apiURLs() []string {
+	urls := []string{s.apiURL()}
+	for _, u := range defaultAPIURLs {
+		if u != urls[0] {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// apiURL returns the API server which commands are run against.
+func (s *Service) apiURL() string {
+	if s.APIURL == "" {
+		return defaultAPIURLs[0]
+	}
+	return strings.TrimSuffix(s.APIURL, "/")
+}
+
 // Register makes sure the Config information supplied is valid.
 func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
 	s.WebhookURL = s.webhookEndpointURL
+	if s.APIURL != "" {
+		if u, err := url.Parse(s.APIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("api_url '%s' is not a valid URL", s.APIURL)
+		}
+	}
 	for _, roomData := range s.Rooms {
 		for repo := range roomData.Repos {
 			match := ownerRepoRegex.FindStringSubmatch(repo)
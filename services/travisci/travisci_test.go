@@ -15,6 +15,7 @@ import (
 	"github.com/matrix-org/go-neb/types"
 	"maunium.net/go/mautrix"
 	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 const travisOrgPEMPublicKey = (`-----BEGIN PUBLIC KEY-----
@@ -205,3 +206,72 @@ func makeService(t *testing.T, template string) *Service {
 	}
 	return srv.(*Service)
 }
+
+func TestCommands(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	var restarted bool
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Travis-API-Version") != "3" || req.Header.Get("Authorization") != "token secret" {
+			return nil, fmt.Errorf("Bad request headers: %v", req.Header)
+		}
+		var body string
+		switch req.Method + " " + req.URL.EscapedPath() {
+		case "GET /repo/Kegsay%2Fflow-jsdoc/builds":
+			body = `{"builds":[{"id":176075135,"number":"18","state":"passed","duration":32,"event_type":"push",
+				"repository":{"slug":"Kegsay/flow-jsdoc"},"branch":{"name":"master"},
+				"commit":{"sha":"3a092c3a6032ebb50384c99b445f947e9ce86e2a","message":"Test Travis webhook support\n\nMore"},
+				"created_by":{"login":"Kegsay"}}]}`
+		case "GET /build/176075135":
+			body = `{"id":176075135,"number":"18","repository":{"slug":"Kegsay/flow-jsdoc"}}`
+		case "GET /build/1":
+			body = `{"id":1,"number":"1","repository":{"slug":"someone/else"}}`
+		case "POST /build/176075135/restart":
+			restarted = true
+			body = `{"@type":"pending","state_change":"restart"}`
+		default:
+			return nil, fmt.Errorf("Unhandled request %s %s", req.Method, req.URL.String())
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@travisci:hyrule", []byte(`{
+		"api_token": "secret",
+		"rooms": {"!ewfug483gsfe:localhost": {"repos": {"Kegsay/flow-jsdoc": {}}}}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create Travis-CI service: ", err)
+	}
+	cmds := srv.Commands(nil)
+	status, restart := cmds[0], cmds[1]
+	room := id.RoomID("!ewfug483gsfe:localhost")
+
+	res, err := status.Command(room, "@link:hyrule", nil)
+	if err != nil {
+		t.Fatalf("!travis status failed: %s", err)
+	}
+	want := "Kegsay/flow-jsdoc#18 passed on master (3a092c3a60 : Kegsay): Test Travis webhook support [32s]\n" +
+		"https://app.travis-ci.com/github/Kegsay/flow-jsdoc/builds/176075135"
+	if body := res.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("!travis status want '%s', got '%s'", want, body)
+	}
+	if _, err = status.Command("!other:localhost", "@link:hyrule", []string{"Kegsay/flow-jsdoc"}); err == nil {
+		t.Error("!travis status worked for a repository of another room")
+	}
+
+	if _, err = restart.Command(room, "@link:hyrule", []string{"Kegsay/flow-jsdoc", "1"}); err == nil || restarted {
+		t.Error("!travis restart restarted a build of another repository")
+	}
+	res, err = restart.Command(room, "@link:hyrule", []string{
+		"kegsay/flow-jsdoc", "https://app.travis-ci.com/github/Kegsay/flow-jsdoc/builds/176075135",
+	})
+	if err != nil {
+		t.Fatalf("!travis restart failed: %s", err)
+	}
+	if !restarted {
+		t.Error("!travis restart did not restart the build")
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "Restarting Kegsay/flow-jsdoc#18" {
+		t.Errorf("Bad !travis restart response: %s", body)
+	}
+}
@@ -11,44 +11,58 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
-// Host => Public Key.
-// Travis has a .com and .org with different public keys.
-// .org is the public one and is one we will try first, then .com
-var travisPublicKeyMap = map[string]*rsa.PublicKey{
-	"api.travis-ci.org": nil,
-	"api.travis-ci.com": nil,
+// The API servers whose public keys are always tried. Repositories on travis-ci.org have moved to
+// travis-ci.com, but webhooks configured before the move may still be signed with the .org key.
+var defaultAPIURLs = []string{"https://api.travis-ci.com", "https://api.travis-ci.org"}
+
+// How long a public key is used before it is fetched again, in case Travis rotates it.
+const publicKeyTTL = 24 * time.Hour
+
+type cachedPublicKey struct {
+	key     *rsa.PublicKey
+	fetched time.Time
 }
 
-func verifyOrigin(payload []byte, sigHeader string) error {
+// API URL => Public Key.
+var (
+	travisPublicKeyMutex sync.Mutex
+	travisPublicKeyMap   = make(map[string]cachedPublicKey)
+)
+
+// verifyOrigin checks that the payload was signed by one of the API servers, trying each in turn.
+func verifyOrigin(payload []byte, sigHeader string, apiURLs []string) error {
 	/*
-		From: https://docs.travis-ci.com/user/notifications#Verifying-Webhook-requests
+		From: https://docs.travis-ci.com/user/notifications#verifying-webhook-requests
 			 1. Pick up the payload data from the HTTP request’s body.
 			 2. Obtain the Signature header value, and base64-decode it.
 			 3. Obtain the public key corresponding to the private key that signed the payload.
 				This is available at the /config endpoint’s config.notifications.webhook.public_key on
-				the relevant API server. (e.g., https://api.travis-ci.org/config)
+				the relevant API server. (e.g., https://api.travis-ci.com/config)
 			4. Verify the signature using the public key and SHA1 digest.
 	*/
 	sig, err := base64.StdEncoding.DecodeString(sigHeader)
 	if err != nil {
 		return fmt.Errorf("verifyOrigin: Failed to decode signature as base64: %s", err)
 	}
+	digest := sha1.Sum(payload)
 
-	if err := loadPublicKeys(); err != nil {
-		return fmt.Errorf("verifyOrigin: Failed to cache Travis public keys: %s", err)
-	}
-
-	// 4. Verify with SHA1
 	// NB: We don't know who sent this request (no Referer header or anything) so we need to try
-	//     both public keys at both endpoints. We use the .org one first since it's more popular.
-	var verifyErr error
-	for _, host := range []string{"api.travis-ci.org", "api.travis-ci.com"} {
-		h := sha1.New()
-		h.Write(payload)
-		digest := h.Sum(nil)
-		verifyErr = rsa.VerifyPKCS1v15(travisPublicKeyMap[host], crypto.SHA1, digest, sig)
+	//     the public keys of every API server.
+	verifyErr := fmt.Errorf("no API servers to verify with")
+	for _, apiURL := range apiURLs {
+		pubKey, err := loadPublicKey(apiURL)
+		if err != nil {
+			log.WithError(err).WithField("api_url", apiURL).Warn("Failed to load Travis-CI public key")
+			verifyErr = err
+			continue
+		}
+		verifyErr = rsa.VerifyPKCS1v15(pubKey, crypto.SHA1, digest[:], sig)
 		if verifyErr == nil {
 			return nil // Valid for this key
 		}
@@ -56,28 +70,36 @@ func verifyOrigin(payload []byte, sigHeader string) error {
 	return fmt.Errorf("verifyOrigin: Signature verification failed: %s", verifyErr)
 }
 
-func loadPublicKeys() error {
-	for _, host := range []string{"api.travis-ci.com", "api.travis-ci.org"} {
-		pubKey := travisPublicKeyMap[host]
-		if pubKey == nil {
-			pemPubKey, err := fetchPEMPublicKey("https://" + host + "/config")
-			if err != nil {
-				return err
-			}
-			block, _ := pem.Decode([]byte(pemPubKey))
-			if block == nil {
-				return fmt.Errorf("public_key at %s doesn't have a valid PEM block", host)
-			}
+// loadPublicKey returns the webhook public key of the API server, fetching it if it isn't cached.
+func loadPublicKey(apiURL string) (*rsa.PublicKey, error) {
+	travisPublicKeyMutex.Lock()
+	cached, ok := travisPublicKeyMap[apiURL]
+	travisPublicKeyMutex.Unlock()
+	if ok && time.Since(cached.fetched) < publicKeyTTL {
+		return cached.key, nil
+	}
 
-			k, err := x509.ParsePKIXPublicKey(block.Bytes)
-			if err != nil {
-				return err
-			}
-			pubKey = k.(*rsa.PublicKey)
-			travisPublicKeyMap[host] = pubKey
-		}
+	pemPubKey, err := fetchPEMPublicKey(apiURL + "/config")
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(pemPubKey))
+	if block == nil {
+		return nil, fmt.Errorf("public_key at %s doesn't have a valid PEM block", apiURL)
 	}
-	return nil
+	k, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, ok := k.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public_key at %s is not an RSA key", apiURL)
+	}
+
+	travisPublicKeyMutex.Lock()
+	travisPublicKeyMap[apiURL] = cachedPublicKey{pubKey, time.Now()}
+	travisPublicKeyMutex.Unlock()
+	return pubKey, nil
 }
 
 func fetchPEMPublicKey(travisURL string) (key string, err error) {
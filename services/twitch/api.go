@@ -0,0 +1,168 @@
+package twitch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Twitch's APIs. Overridden by tests.
+var (
+	tokenURL = "https://id.twitch.tv/oauth2/token"
+	apiURL   = "https://api.twitch.tv/helix/"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// The most channels which can be asked about in one request
+const maxChannelsPerRequest = 100
+
+// The app access tokens which have been granted, keyed by service ID, along with the client ID
+// they were granted to so that a change of credentials gets a new token.
+var (
+	tokenMutex sync.Mutex
+	tokens     = make(map[string]accessToken)
+)
+
+type accessToken struct {
+	clientID string
+	token    string
+	expires  time.Time
+}
+
+// stream is a live stream, as returned by Twitch's "Get Streams" API.
+type stream struct {
+	// Twitch gives each broadcast a new ID, which it keeps for as long as it is live
+	ID        string `json:"id"`
+	UserLogin string `json:"user_login"`
+	UserName  string `json:"user_name"`
+	GameName  string `json:"game_name"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	// e.g. "https://static-cdn.jtvnw.net/previews-ttv/live_user_zelda-{width}x{height}.jpg"
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+// channelURL returns the link to the channel on Twitch.
+func (s *stream) channelURL() string {
+	return "https://www.twitch.tv/" + s.UserLogin
+}
+
+// thumbnail returns the link to a 1280x720 image of the stream.
+func (s *stream) thumbnail() string {
+	return strings.NewReplacer("{width}", "1280", "{height}", "720").Replace(s.ThumbnailURL)
+}
+
+// fetchToken returns an app access token, granting a new one if the last one has expired.
+func (s *Service) fetchToken(now time.Time) (string, error) {
+	tokenMutex.Lock()
+	defer tokenMutex.Unlock()
+	if t, ok := tokens[s.ServiceID()]; ok && t.clientID == s.ClientID && now.Before(t.expires) {
+		return t.token, nil
+	}
+
+	form := url.Values{
+		"client_id":     {s.ClientID},
+		"client_secret": {s.ClientSecret},
+		"grant_type":    {"client_credentials"},
+	}
+	res, err := httpClient.PostForm(tokenURL, form)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode == http.StatusBadRequest || res.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("Twitch refused the client_id and client_secret")
+	} else if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.AccessToken == "" {
+		return "", fmt.Errorf("Failed to get an access token")
+	}
+	// Grant a new token a minute early, rather than have requests refused
+	tokens[s.ServiceID()] = accessToken{
+		clientID: s.ClientID,
+		token:    body.AccessToken,
+		expires:  now.Add(time.Duration(body.ExpiresIn)*time.Second - time.Minute),
+	}
+	return body.AccessToken, nil
+}
+
+// fetchStreams returns the live streams of the channels, keyed by the channels' login names.
+// Channels which aren't live are left out.
+func (s *Service) fetchStreams(channels []string) (map[string]stream, error) {
+	streams := make(map[string]stream)
+	for len(channels) > 0 {
+		batch := channels
+		if len(batch) > maxChannelsPerRequest {
+			batch = batch[:maxChannelsPerRequest]
+		}
+		channels = channels[len(batch):]
+		if err := s.fetchStreamsBatch(batch, streams); err != nil {
+			return nil, err
+		}
+	}
+	return streams, nil
+}
+
+func (s *Service) fetchStreamsBatch(channels []string, streams map[string]stream) error {
+	token, err := s.fetchToken(time.Now())
+	if err != nil {
+		return err
+	}
+	q := url.Values{
+		"user_login": channels,
+		"first":      {fmt.Sprint(maxChannelsPerRequest)},
+	}
+	req, err := http.NewRequest("GET", apiURL+"streams?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Client-Id", s.ClientID)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		// Forget the token, in case it was revoked
+		tokenMutex.Lock()
+		delete(tokens, s.ServiceID())
+		tokenMutex.Unlock()
+		return fmt.Errorf("Twitch refused the access token")
+	default:
+		return fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var body struct {
+		Data []stream `json:"data"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return err
+	}
+	for _, st := range body.Data {
+		// Reruns and premieres used to be listed too, and aren't going live
+		if st.Type != "live" {
+			continue
+		}
+		streams[strings.ToLower(st.UserLogin)] = st
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+// Package twitch implements a Service which announces when Twitch channels go live.
+package twitch
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Twitch service
+const ServiceType = "twitch"
+
+const (
+	defaultPollInterval = 5 * time.Minute
+	minPollIntervalMins = 1
+)
+
+var channelRegex = regexp.MustCompile(`^[a-z0-9_]{3,25}$`)
+
+// Service contains the Config fields for the Twitch service.
+//
+// Twitch's API needs the credentials of an app, which can be registered at
+// https://dev.twitch.tv/console/apps. Only its client ID and secret are used, as Go-NEB only
+// reads public streams.
+//
+// Each room is sent "<channel> is now live: <title>" and a thumbnail of the stream when one of
+// its channels starts streaming. A stream is only announced once, however long it is live for
+// and even after a restart, and streams which were already live when a channel was added are
+// not announced.
+//
+// Example JSON request:
+//   {
+//       "client_id": "wbmytr93xzw8zbg0p1izqyzzc5mbiz",
+//       "client_secret": "nyo51xcdrerl8z9m56w9w6wg",
+//       "poll_interval_mins": 5,
+//       "rooms": {
+//           "!speedrunning:localhost": {
+//               "channels": ["gamesdonequick", "zfg1"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// The client ID of the Twitch app.
+	ClientID string `json:"client_id"`
+	// The secret of the Twitch app.
+	ClientSecret string `json:"client_secret"`
+	// Optional. How often to check whether the channels are live, in minutes. Defaults to 5.
+	PollIntervalMins int `json:"poll_interval_mins"`
+	// Optional. The rooms to announce streams to.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig is which channels are announced to a room.
+type RoomConfig struct {
+	// The login names of the channels, as in https://www.twitch.tv/<channel>.
+	Channels []string `json:"channels"`
+}
+
+func (s *Service) pollInterval() time.Duration {
+	if s.PollIntervalMins <= 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(s.PollIntervalMins) * time.Minute
+}
+
+// OnPoll announces the channels which have gone live to the rooms.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	s.check(cli)
+	return time.Now().Add(s.pollInterval())
+}
+
+func (s *Service) check(cli types.MatrixClient) {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	// Each channel is only asked about once, however many rooms it is announced to
+	channelSet := make(map[string]bool)
+	for _, room := range s.Rooms {
+		for _, channel := range room.Channels {
+			channelSet[normaliseChannel(channel)] = true
+		}
+	}
+	var channels []string
+	for channel := range channelSet {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	streams, err := s.fetchStreams(channels)
+	if err != nil {
+		logger.WithError(err).Error("Failed to fetch streams")
+		return
+	}
+
+	for roomID, room := range s.Rooms {
+		for _, channel := range room.Channels {
+			channel = normaliseChannel(channel)
+			var live *stream
+			if st, ok := streams[channel]; ok {
+				live = &st
+			}
+			if err := s.announce(cli, roomID, channel, live); err != nil {
+				logger.WithError(err).WithFields(log.Fields{
+					"room_id": roomID,
+					"channel": channel,
+				}).Error("Failed to announce stream")
+			}
+		}
+	}
+}
+
+// announce sends the room the stream if it hasn't been sent it already. The stream is nil if the
+// channel isn't live.
+func (s *Service) announce(cli types.MatrixClient, roomID id.RoomID, channel string, live *stream) error {
+	stateKey := "stream " + roomID.String() + " " + channel
+	lastID, known, err := s.loadStreamID(stateKey)
+	if err != nil {
+		return err
+	}
+	var streamID string
+	if live != nil {
+		streamID = live.ID
+	}
+	if known && streamID == lastID {
+		return nil
+	}
+	// Remember the stream first, so that it isn't announced again if sending fails
+	if err = s.storeStreamID(stateKey, streamID); err != nil {
+		return err
+	}
+	if !known || live == nil {
+		return nil
+	}
+	if _, err = notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: streamContent(live)}); err != nil {
+		return err
+	}
+	if live.ThumbnailURL == "" {
+		return nil
+	}
+	// The stream has been announced, so a missing thumbnail isn't worth more than a warning
+	thumbnail, err := thumbnailContent(cli, live)
+	if err != nil {
+		log.WithError(err).WithField("channel", channel).Warn("Failed to upload stream thumbnail")
+		return nil
+	}
+	_, err = notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: *thumbnail})
+	return err
+}
+
+// streamContent returns a message saying that the stream has started, with a link to it.
+func streamContent(st *stream) mevt.MessageEventContent {
+	name := st.UserName
+	if name == "" {
+		name = st.UserLogin
+	}
+	body := fmt.Sprintf("%s is now live: %s", name, st.Title)
+	formatted := fmt.Sprintf(`<a href="%s">%s</a> is now live: %s`,
+		html.EscapeString(st.channelURL()), html.EscapeString(name), html.EscapeString(st.Title))
+	if st.GameName != "" {
+		body += "\nPlaying " + st.GameName
+		formatted += "<br>Playing " + html.EscapeString(st.GameName)
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          body + "\n" + st.channelURL(),
+		Format:        mevt.FormatHTML,
+		FormattedBody: formatted,
+	}
+}
+
+// thumbnailContent uploads the stream's thumbnail to Matrix, returning the message to send it in.
+func thumbnailContent(cli types.MatrixClient, st *stream) (*mevt.MessageEventContent, error) {
+	link := st.thumbnail()
+	resUpload, err := cli.UploadLink(link)
+	if err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgImage,
+		Body:    path.Base(link),
+		URL:     resUpload.ContentURI.CUString(),
+		Info: &mevt.FileInfo{
+			MimeType: "image/jpeg",
+			Width:    1280,
+			Height:   720,
+		},
+	}, nil
+}
+
+// normaliseChannel returns the channel's login name, which Twitch treats case-insensitively.
+func normaliseChannel(channel string) string {
+	channel = strings.TrimPrefix(channel, "https://www.twitch.tv/")
+	return strings.ToLower(channel)
+}
+
+// loadStreamID returns the ID of the stream the room was last sent for the channel, or "" if the
+// channel was offline. known is false if the channel has never been checked for the room.
+func (s *Service) loadStreamID(stateKey string) (streamID string, known bool, err error) {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), stateKey)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	err = json.Unmarshal(stateJSON, &streamID)
+	return streamID, true, err
+}
+
+func (s *Service) storeStreamID(stateKey, streamID string) error {
+	stateJSON, err := json.Marshal(streamID)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), stateKey, stateJSON)
+}
+
+// Register makes sure that the app and channels are configured, and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.ClientID == "" || s.ClientSecret == "" {
+		return fmt.Errorf("A client_id and client_secret are required")
+	}
+	if s.PollIntervalMins < 0 || (s.PollIntervalMins > 0 && s.PollIntervalMins < minPollIntervalMins) {
+		return fmt.Errorf("poll_interval_mins can't be less than %d", minPollIntervalMins)
+	}
+	for roomID, room := range s.Rooms {
+		if len(room.Channels) == 0 {
+			return fmt.Errorf("Room %s has no channels", roomID)
+		}
+		for _, channel := range room.Channels {
+			if !channelRegex.MatchString(normaliseChannel(channel)) {
+				return fmt.Errorf("Bad channel '%s' for room %s", channel, roomID)
+			}
+		}
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
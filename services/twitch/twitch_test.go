@@ -0,0 +1,168 @@
+package twitch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func streamJSON(streamID, login, title string) string {
+	return fmt.Sprintf(`{"id":"%s","user_login":"%s","user_name":"%s","game_name":"Ocarina of Time","type":"live","title":"%s",`+
+		`"thumbnail_url":"https://static-cdn.jtvnw.net/previews-ttv/live_user_%s-{width}x{height}.jpg"}`,
+		streamID, login, strings.Title(login), title, login)
+}
+
+func TestPoll(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	tokens = make(map[string]accessToken)
+	granted := 0
+	live := map[string]string{
+		"zelda": streamJSON("1", "zelda", "Already live"),
+	}
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() == "https://id.twitch.tv/oauth2/token" {
+			req.ParseForm()
+			if req.PostForm.Get("client_id") != "zelda_app" || req.PostForm.Get("client_secret") != "triforce_secret" {
+				return &http.Response{StatusCode: 403, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+			}
+			granted++
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"access_token":"master_key","expires_in":5000000,"token_type":"bearer"}`)),
+			}, nil
+		}
+		if req.Header.Get("Authorization") != "Bearer master_key" || req.Header.Get("Client-Id") != "zelda_app" {
+			return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		if !strings.HasPrefix(req.URL.String(), "https://api.twitch.tv/helix/streams?") {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		var data []string
+		for _, login := range req.URL.Query()["user_login"] {
+			if st, ok := live[login]; ok {
+				data = append(data, st)
+			}
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"data":[` + strings.Join(data, ",") + `],"pagination":{}}`)),
+		}, nil
+	})}
+
+	var sent []string
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		switch {
+		case strings.Contains(req.URL.String(), "/join"):
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		case strings.HasPrefix(req.URL.String(), "https://static-cdn.jtvnw.net/previews-ttv/"):
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Type": {"image/jpeg"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString("\xff\xd8\xff")),
+			}, nil
+		case strings.Contains(req.URL.String(), "/upload"):
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://hyrule/thumbnail"}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		sent = append(sent, fmt.Sprintf("%s %s %s", room, msg.MsgType, msg.Body))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$stream:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"client_id": "zelda_app",
+		"client_secret": "triforce_secret",
+		"rooms": {
+			"!castle:hyrule": {"channels": ["Zelda", "link"]},
+			"!forest:hyrule": {"channels": ["https://www.twitch.tv/link"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create twitch service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register twitch service: ", err)
+	}
+	s := srv.(*Service)
+
+	s.check(matrixCli)
+	if len(sent) != 0 {
+		t.Errorf("Announced streams which were live before the channels were added: %v", sent)
+	}
+
+	live["link"] = streamJSON("2", "link", "Any% <glitchless>")
+	s.check(matrixCli)
+	// Still live, so not announced again
+	s.check(matrixCli)
+	// Zelda goes offline and starts a new stream
+	delete(live, "zelda")
+	s.check(matrixCli)
+	live["zelda"] = streamJSON("3", "zelda", "Back again")
+	s.check(matrixCli)
+
+	if granted != 1 {
+		t.Errorf("Expected the access token to be reused, %d were granted", granted)
+	}
+	var castle, forest []string
+	for _, msg := range sent {
+		if strings.HasPrefix(msg, "!castle:hyrule ") {
+			castle = append(castle, strings.TrimPrefix(msg, "!castle:hyrule "))
+		} else {
+			forest = append(forest, strings.TrimPrefix(msg, "!forest:hyrule "))
+		}
+	}
+	linkLive := "m.notice Link is now live: Any% <glitchless>\nPlaying Ocarina of Time\nhttps://www.twitch.tv/link"
+	thumbnail := "m.image live_user_link-1280x720.jpg"
+	wantCastle := []string{
+		linkLive, thumbnail,
+		"m.notice Zelda is now live: Back again\nPlaying Ocarina of Time\nhttps://www.twitch.tv/zelda", "m.image live_user_zelda-1280x720.jpg",
+	}
+	if strings.Join(castle, "\n\n") != strings.Join(wantCastle, "\n\n") {
+		t.Errorf("Bad messages in !castle: got %q, want %q", castle, wantCastle)
+	}
+	if wantForest := []string{linkLive, thumbnail}; strings.Join(forest, "\n\n") != strings.Join(wantForest, "\n\n") {
+		t.Errorf("Bad messages in !forest: got %q, want %q", forest, wantForest)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"rooms": {"!a:hyrule": {"channels": ["zelda"]}}}`,
+		`{"client_id": "a", "client_secret": "b", "rooms": {"!a:hyrule": {}}}`,
+		`{"client_id": "a", "client_secret": "b", "rooms": {"!a:hyrule": {"channels": ["not a channel"]}}}`,
+		`{"client_id": "a", "client_secret": "b", "poll_interval_mins": -1}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create twitch service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
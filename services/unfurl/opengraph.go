@@ -0,0 +1,150 @@
+package unfurl
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/services/utils"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	fetchTimeout = 10 * time.Second
+	maxRedirects = 5
+	// The most of a page which is read looking for its metadata, which is in the <head>
+	maxPageSize = 512 * 1024
+	// The biggest preview image which is uploaded
+	maxImageSize = 2 * 1024 * 1024
+)
+
+// httpClient fetches pages and images, refusing links to private networks. Overridden by tests.
+var httpClient = utils.NewPublicHTTPClient(fetchTimeout, maxRedirects)
+
+// preview is what a page says about itself, from its OpenGraph metadata or else its title and
+// description.
+type preview struct {
+	// The URL of the page, after any redirects
+	URL         string
+	SiteName    string
+	Title       string
+	Description string
+	// The absolute URL of the page's image, if it has one
+	ImageURL string
+}
+
+// fetchPreview returns the preview of the page at the URL, or nil if it isn't an HTML page.
+func fetchPreview(pageURL string) (*preview, error) {
+	req, err := http.NewRequest("GET", pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "Go-NEB link previews")
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, nil
+	}
+	p := parsePreview(io.LimitReader(res.Body, maxPageSize))
+	p.URL = res.Request.URL.String()
+	if p.ImageURL != "" {
+		if u, err := res.Request.URL.Parse(p.ImageURL); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			p.ImageURL = u.String()
+		} else {
+			p.ImageURL = ""
+		}
+	}
+	return p, nil
+}
+
+// parsePreview reads the metadata in the <head> of an HTML page.
+func parsePreview(r io.Reader) *preview {
+	var p preview
+	var title string
+	var description string
+	z := html.NewTokenizer(r)
+	inTitle := false
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return p.withFallbacks(title, description)
+		case html.TextToken:
+			if inTitle {
+				title += string(z.Text())
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch atom.Lookup(name) {
+			case atom.Title:
+				inTitle = false
+			case atom.Head:
+				return p.withFallbacks(title, description)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch atom.Lookup(name) {
+			case atom.Title:
+				inTitle = tt == html.StartTagToken
+			case atom.Body:
+				return p.withFallbacks(title, description)
+			case atom.Meta:
+				attrs := make(map[string]string)
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+					attrs[string(k)] = string(v)
+				}
+				property := strings.ToLower(attrs["property"])
+				if property == "" {
+					property = strings.ToLower(attrs["name"])
+				}
+				content := strings.TrimSpace(attrs["content"])
+				switch property {
+				case "og:title":
+					p.Title = content
+				case "og:description":
+					p.Description = content
+				case "og:site_name":
+					p.SiteName = content
+				case "og:image", "og:image:url", "og:image:secure_url":
+					if p.ImageURL == "" {
+						p.ImageURL = content
+					}
+				case "description":
+					description = content
+				}
+			}
+		}
+	}
+}
+
+// withFallbacks uses the page's <title> and description if it has no OpenGraph ones.
+func (p *preview) withFallbacks(title, description string) *preview {
+	if p.Title == "" {
+		p.Title = strings.Join(strings.Fields(title), " ")
+	}
+	if p.Description == "" {
+		p.Description = description
+	}
+	return p
+}
+
+// hostname returns the lower case host of the URL, without a trailing dot.
+func hostname(u *url.URL) string {
+	return strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+}
@@ -0,0 +1,245 @@
+// Package unfurl implements a Service which previews links posted in rooms.
+package unfurl
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Unfurl service
+const ServiceType = "unfurl"
+
+// The longest description which is shown
+const maxDescriptionLength = 300
+
+// The height which preview images are shown at
+const imageHeight = 120
+
+// An http or https link in a message
+var linkRegex = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// Service contains the Config fields for the Unfurl service.
+//
+// When a link is posted in a room, the page is fetched and a preview of it is posted: its title,
+// description and image, from its OpenGraph metadata or else its <title> and description. Links
+// to private networks, and to blocked_domains and their subdomains, aren't previewed.
+//
+// Previews are on in every room the bot is in. "!unfurl off" turns them off in a room, and
+// "!unfurl on" turns them back on.
+//
+// Example JSON request:
+//   {
+//       "blocked_domains": ["internal.example.com", "youtube.com"]
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The domains whose links aren't previewed, along with their subdomains.
+	BlockedDomains []string `json:"blocked_domains"`
+}
+
+// Commands supported:
+//    !unfurl on
+// Turns link previews on in the room.
+//    !unfurl off
+// Turns link previews off in the room.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"unfurl", "on"},
+			Help: "Turn link previews on in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSetEnabled(roomID, true)
+			},
+		},
+		{
+			Path: []string{"unfurl", "off"},
+			Help: "Turn link previews off in this room",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSetEnabled(roomID, false)
+			},
+		},
+	}
+}
+
+// Expansions previews every link in a message.
+func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
+	return []types.Expansion{
+		{
+			Regexp: linkRegex,
+			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+				return s.expandLink(cli, roomID, matchingGroups[0])
+			},
+		},
+	}
+}
+
+func (s *Service) expandLink(cli types.MatrixClient, roomID id.RoomID, link string) interface{} {
+	link = trimLink(link)
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" || s.isBlocked(u) {
+		return nil
+	}
+	disabled, err := s.isDisabled(roomID)
+	if err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to load unfurl settings")
+		return nil
+	}
+	if disabled {
+		return nil
+	}
+
+	p, err := fetchPreview(link)
+	if err != nil {
+		log.WithError(err).WithField("url", link).Info("Failed to fetch link preview")
+		return nil
+	}
+	if p == nil || p.Title == "" {
+		return nil
+	}
+	if final, err := url.Parse(p.URL); err == nil && s.isBlocked(final) {
+		// Redirected to a blocked domain
+		return nil
+	}
+
+	var imageURI id.ContentURIString
+	if p.ImageURL != "" {
+		if imageURI, err = uploadImage(cli, p.ImageURL); err != nil {
+			log.WithError(err).WithField("url", p.ImageURL).Info("Failed to upload link preview image")
+		}
+	}
+	return previewMessage(p, imageURI)
+}
+
+// previewMessage returns a compact card of the page's title, site, description and image.
+func previewMessage(p *preview, imageURI id.ContentURIString) *mevt.MessageEventContent {
+	description := p.Description
+	if utf8.RuneCountInString(description) > maxDescriptionLength {
+		description = string([]rune(description)[:maxDescriptionLength-1]) + "…"
+	}
+	body := "🔗 " + p.Title
+	formatted := fmt.Sprintf(`<strong><a href="%s">%s</a></strong>`, html.EscapeString(p.URL), html.EscapeString(p.Title))
+	if p.SiteName != "" && p.SiteName != p.Title {
+		body += " · " + p.SiteName
+		formatted += " · " + html.EscapeString(p.SiteName)
+	}
+	if description != "" {
+		body += "\n" + description
+		formatted += "<br>" + html.EscapeString(description)
+	}
+	if imageURI != "" {
+		formatted += fmt.Sprintf(`<br><img src="%s" alt="%s" height="%d">`, imageURI, html.EscapeString(p.Title), imageHeight)
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          body,
+		Format:        mevt.FormatHTML,
+		FormattedBody: "<blockquote>" + formatted + "</blockquote>",
+	}
+}
+
+// uploadImage fetches the image and uploads it to Matrix.
+func uploadImage(cli types.MatrixClient, imageURL string) (id.ContentURIString, error) {
+	mediaCli, ok := cli.(types.MediaUploader)
+	if !ok {
+		return "", fmt.Errorf("Unable to upload images with this client")
+	}
+	data, contentType, err := utils.FetchImage(httpClient, imageURL, maxImageSize)
+	if err != nil {
+		return "", err
+	}
+	resUpload, err := mediaCli.UploadBytes(data, contentType)
+	if err != nil {
+		return "", err
+	}
+	return resUpload.ContentURI.CUString(), nil
+}
+
+// trimLink returns the link without the punctuation which ends the sentence it is in, e.g.
+// "https://example.com" for "(see https://example.com).".
+func trimLink(link string) string {
+	for {
+		trimmed := strings.TrimRight(link, ".,;:!?'*_")
+		if strings.HasSuffix(trimmed, ")") && strings.Count(trimmed, "(") < strings.Count(trimmed, ")") {
+			trimmed = trimmed[:len(trimmed)-1]
+		}
+		if trimmed == link {
+			return link
+		}
+		link = trimmed
+	}
+}
+
+// isBlocked returns true if the URL's host is a blocked domain or one of its subdomains.
+func (s *Service) isBlocked(u *url.URL) bool {
+	host := hostname(u)
+	for _, domain := range s.BlockedDomains {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) cmdSetEnabled(roomID id.RoomID, enabled bool) (interface{}, error) {
+	stateJSON, err := json.Marshal(!enabled)
+	if err != nil {
+		return nil, err
+	}
+	if err = database.GetServiceDB().StoreServiceState(s.ServiceID(), "disabled "+roomID.String(), stateJSON); err != nil {
+		return nil, fmt.Errorf("Failed to store unfurl settings: %s", err)
+	}
+	body := "Link previews are now on in this room"
+	if !enabled {
+		body = "Link previews are now off in this room"
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}, nil
+}
+
+// isDisabled returns true if link previews have been turned off in the room. This is stored in
+// the service state under "disabled <room ID>".
+func (s *Service) isDisabled(roomID id.RoomID) (bool, error) {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "disabled "+roomID.String())
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	var disabled bool
+	err = json.Unmarshal(stateJSON, &disabled)
+	return disabled, err
+}
+
+// Register makes sure that the blocked domains are domains.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	for _, domain := range s.BlockedDomains {
+		if domain == "" || strings.ContainsAny(domain, "/:* ") {
+			return fmt.Errorf("Bad blocked domain '%s': must be a domain like example.com", domain)
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package unfurl
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const templePage = `<!DOCTYPE html>
+<html><head>
+<title>
+  Temple of Time
+</title>
+<meta property="og:title" content="The Temple of Time">
+<meta property="og:site_name" content="Hyrule Wiki">
+<meta property="og:description" content="Where the Master Sword <rests>.">
+<meta property="og:image" content="/images/temple.png">
+</head><body><meta property="og:title" content="Not the title"></body></html>`
+
+const woodsPage = `<html><head><title>Lost Woods</title><meta name="description" content="Don't get lost."></head></html>`
+
+func TestExpansion(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	var fetched []string
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		fetched = append(fetched, req.URL.String())
+		res := &http.Response{StatusCode: 200, Header: make(http.Header), Request: req}
+		switch req.URL.String() {
+		case "https://wiki.hyrule/Temple_of_Time":
+			res.Header.Set("Content-Type", "text/html; charset=utf-8")
+			res.Body = ioutil.NopCloser(bytes.NewBufferString(templePage))
+		case "https://wiki.hyrule/images/temple.png":
+			res.Header.Set("Content-Type", "image/png")
+			res.Body = ioutil.NopCloser(bytes.NewBufferString("\x89PNG"))
+		case "http://woods.hyrule/":
+			res.Header.Set("Content-Type", "text/html")
+			res.Body = ioutil.NopCloser(bytes.NewBufferString(woodsPage))
+		case "https://hyrule.example/master_sword.zip":
+			res.Header.Set("Content-Type", "application/zip")
+			res.Body = ioutil.NopCloser(bytes.NewBufferString("PK"))
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return res, nil
+	})}
+
+	var uploads int
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.String(), "/upload") {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		uploads++
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://hyrule/temple"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"blocked_domains": ["castle.hyrule"]
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create unfurl service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register unfurl service: ", err)
+	}
+	expansions := srv.Expansions(matrixCli)
+	if len(expansions) != 1 {
+		t.Fatalf("Expected 1 expansion, got %d", len(expansions))
+	}
+	expand := func(message string) []*mevt.MessageEventContent {
+		var previews []*mevt.MessageEventContent
+		for _, m := range expansions[0].Regexp.FindAllStringSubmatch(message, -1) {
+			if res := expansions[0].Expand("!room:hyrule", "@link:hyrule", m); res != nil {
+				previews = append(previews, res.(*mevt.MessageEventContent))
+			}
+		}
+		return previews
+	}
+
+	previews := expand("Have you seen (https://wiki.hyrule/Temple_of_Time)? Also http://woods.hyrule/.")
+	if len(previews) != 2 {
+		t.Fatalf("Expected 2 previews, got %v", previews)
+	}
+	if want := "🔗 The Temple of Time · Hyrule Wiki\nWhere the Master Sword <rests>."; previews[0].Body != want {
+		t.Errorf("Bad preview: got %q, want %q", previews[0].Body, want)
+	}
+	wantHTML := `<blockquote><strong><a href="https://wiki.hyrule/Temple_of_Time">The Temple of Time</a></strong> · Hyrule Wiki` +
+		`<br>Where the Master Sword &lt;rests&gt;.<br><img src="mxc://hyrule/temple" alt="The Temple of Time" height="120"></blockquote>`
+	if previews[0].FormattedBody != wantHTML {
+		t.Errorf("Bad preview HTML: got %q, want %q", previews[0].FormattedBody, wantHTML)
+	}
+	if want := "🔗 Lost Woods\nDon't get lost."; previews[1].Body != want {
+		t.Errorf("Bad fallback preview: got %q, want %q", previews[1].Body, want)
+	}
+	if uploads != 1 {
+		t.Errorf("Expected 1 image upload, got %d", uploads)
+	}
+
+	fetched = nil
+	if previews = expand("https://castle.hyrule/ https://dungeon.castle.hyrule/ https://hyrule.example/master_sword.zip"); len(previews) != 0 {
+		t.Errorf("Expected no previews, got %v", previews)
+	}
+	if len(fetched) != 1 {
+		t.Errorf("Expected blocked domains not to be fetched, got %v", fetched)
+	}
+
+	s := srv.(*Service)
+	if _, err = s.cmdSetEnabled("!room:hyrule", false); err != nil {
+		t.Fatal("Failed to turn previews off: ", err)
+	}
+	fetched = nil
+	if previews = expand("http://woods.hyrule/"); len(previews) != 0 || len(fetched) != 0 {
+		t.Errorf("Expected no previews once turned off, got %v", previews)
+	}
+	if _, err = s.cmdSetEnabled("!room:hyrule", true); err != nil {
+		t.Fatal("Failed to turn previews on: ", err)
+	}
+	if previews = expand("http://woods.hyrule/"); len(previews) != 1 {
+		t.Errorf("Expected a preview once turned on, got %v", previews)
+	}
+}
+
+func TestTrimLink(t *testing.T) {
+	for link, want := range map[string]string{
+		"https://hyrule.example/":                   "https://hyrule.example/",
+		"https://hyrule.example/page.":              "https://hyrule.example/page",
+		"https://hyrule.example/page)!":             "https://hyrule.example/page",
+		"https://en.wiki.example/Zelda_(game)":      "https://en.wiki.example/Zelda_(game)",
+		"https://en.wiki.example/Zelda_(game)),":    "https://en.wiki.example/Zelda_(game)",
+		"https://hyrule.example/search?q=triforce;": "https://hyrule.example/search?q=triforce",
+	} {
+		if got := trimLink(link); got != want {
+			t.Errorf("trimLink(%q): got %q, want %q", link, got, want)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"blocked_domains": [""]}`,
+		`{"blocked_domains": ["https://castle.hyrule/"]}`,
+		`{"blocked_domains": ["*.castle.hyrule"]}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create unfurl service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Package urban implements a Service which looks up slang on Urban Dictionary.
+package urban
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Urban service
+const ServiceType = "urban"
+
+// How many characters of a definition and an example are posted, so that long ones don't flood
+// the room
+const (
+	maxDefinitionLength = 400
+	maxExampleLength    = 200
+)
+
+// The Urban Dictionary API. Overridden by tests.
+var defineURL = "https://api.urbandictionary.com/v0/define"
+
+var httpClient = &http.Client{}
+
+// Urban Dictionary links to other definitions by putting the term in brackets
+var linkRegex = regexp.MustCompile(`\[([^\[\]]*)\]`)
+
+var spaceRegex = regexp.MustCompile(`[ \t]*\r?\n[\s]*`)
+
+// Service contains the Config fields for the Urban service.
+//
+// Definitions are stripped of Urban Dictionary's link markup, and long ones are cut short.
+//
+// Example JSON request:
+//   {}
+type Service struct {
+	types.DefaultService
+}
+
+type urbanDefinition struct {
+	Word       string `json:"word"`
+	Definition string `json:"definition"`
+	Example    string `json:"example"`
+	Permalink  string `json:"permalink"`
+	ThumbsUp   int    `json:"thumbs_up"`
+	ThumbsDown int    `json:"thumbs_down"`
+}
+
+// Commands supported:
+//    !urban term
+// Responds with the top definition of the term on Urban Dictionary, with an example.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"urban"},
+			Arguments: []string{"term"},
+			Help:      "Look up a term on Urban Dictionary",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdUrban(args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdUrban(args []string) (interface{}, error) {
+	term := strings.Join(args, " ")
+	if term == "" {
+		return nil, fmt.Errorf("Usage: !urban term")
+	}
+	def, err := define(term)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up %s on Urban Dictionary: %s", term, err)
+	}
+	if def == nil {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("Urban Dictionary has no definition of %s", term),
+		}, nil
+	}
+
+	definition := truncate(clean(def.Definition), maxDefinitionLength)
+	example := truncate(clean(def.Example), maxExampleLength)
+	votes := fmt.Sprintf("👍 %d 👎 %d", def.ThumbsUp, def.ThumbsDown)
+
+	body := fmt.Sprintf("%s: %s", def.Word, definition)
+	formatted := fmt.Sprintf("<strong>%s</strong>: %s", html.EscapeString(def.Word), html.EscapeString(definition))
+	if example != "" {
+		body += "\nExample: " + example
+		formatted += "<br><em>" + html.EscapeString(example) + "</em>"
+	}
+	body += "\n" + votes
+	formatted += "<br>" + votes
+	if def.Permalink != "" {
+		body += " · " + def.Permalink
+		formatted += fmt.Sprintf(` · <a href="%s">more</a>`, html.EscapeString(def.Permalink))
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          body,
+		Format:        mevt.FormatHTML,
+		FormattedBody: formatted,
+	}, nil
+}
+
+// define returns the top definition of the term, or nil if there isn't one.
+func define(term string) (*urbanDefinition, error) {
+	res, err := httpClient.Get(defineURL + "?" + url.Values{"term": {term}}.Encode())
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var result struct {
+		List []urbanDefinition `json:"list"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	// The API returns the definitions with the most votes first
+	if len(result.List) == 0 {
+		return nil, nil
+	}
+	return &result.List[0], nil
+}
+
+// clean removes the link markup from the text, and joins its lines.
+func clean(text string) string {
+	text = linkRegex.ReplaceAllString(text, "$1")
+	return strings.TrimSpace(spaceRegex.ReplaceAllString(text, " "))
+}
+
+// truncate cuts the text at the last word which fits in max characters.
+func truncate(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	cut := string(runes[:max])
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ,.;:") + "…"
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
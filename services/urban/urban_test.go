@@ -0,0 +1,80 @@
+package urban
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestCommand(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch req.URL.String() {
+		case "https://api.urbandictionary.com/v0/define?term=yeet":
+			body = `{"list":[
+				{"word":"yeet","definition":"To [throw] something\r\n\r\nwith force","example":"He [yeeted] the <ball>.",
+					"permalink":"http://yeet.urbanup.com/1","thumbs_up":1200,"thumbs_down":34},
+				{"word":"yeet","definition":"Something else","thumbs_up":5,"thumbs_down":2}
+			]}`
+		case "https://api.urbandictionary.com/v0/define?term=qwertyuiop+zxcv":
+			body = `{"list":[]}`
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create urban service: ", err)
+	}
+	cmd := srv.Commands(nil)[0]
+
+	res, err := cmd.Command("!someroom:hyrule", "@navi:hyrule", []string{"yeet"})
+	if err != nil {
+		t.Fatalf("Failed to process command: %s", err)
+	}
+	msg := res.(*mevt.MessageEventContent)
+	if want := "yeet: To throw something with force\nExample: He yeeted the <ball>.\n👍 1200 👎 34 · http://yeet.urbanup.com/1"; msg.Body != want {
+		t.Errorf("Bad body: got %q, want %q", msg.Body, want)
+	}
+	if !strings.Contains(msg.FormattedBody, "<em>He yeeted the &lt;ball&gt;.</em>") {
+		t.Errorf("Example isn't escaped: %s", msg.FormattedBody)
+	}
+
+	res, err = cmd.Command("!someroom:hyrule", "@navi:hyrule", []string{"qwertyuiop", "zxcv"})
+	if err != nil {
+		t.Fatalf("Failed to process command: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "Urban Dictionary has no definition of qwertyuiop zxcv" {
+		t.Errorf("Bad response for unknown term: %s", body)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	testCases := []struct {
+		text string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"one two three four", 10, "one two…"},
+		{"one, two three", 8, "one…"},
+		{"ünïcödé wörds", 9, "ünïcödé…"},
+	}
+	for _, tc := range testCases {
+		if got := truncate(tc.text, tc.max); got != tc.want {
+			t.Errorf("truncate(%q, %d): got %q, want %q", tc.text, tc.max, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+)
+
+// ExpiringState stores service state which is deleted once it hasn't been stored again for a
+// while, so that state kept for every message a service sees doesn't pile up in the database. It
+// remembers when each state key was last stored in an index, which is itself stored as service
+// state. Share one ExpiringState between every service of a type, so that their index updates
+// are serialised.
+type ExpiringState struct {
+	// The state key which the index is stored under.
+	IndexKey string
+	// How long state is kept after it was last stored.
+	TTL   time.Duration
+	mutex sync.Mutex
+}
+
+// Store stores the state under each of the state keys, recording that they were stored at the
+// given time, and deletes the service's state which was last stored longer than TTL before then.
+func (e *ExpiringState) Store(serviceID string, stored time.Time, stateJSON []byte, stateKeys ...string) error {
+	db := database.GetServiceDB()
+	for _, stateKey := range stateKeys {
+		if err := db.StoreServiceState(serviceID, stateKey, stateJSON); err != nil {
+			return err
+		}
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	index := make(map[string]time.Time)
+	indexJSON, err := db.LoadServiceState(serviceID, e.IndexKey)
+	if err == nil {
+		err = json.Unmarshal(indexJSON, &index)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	for stateKey, last := range index {
+		if stored.Sub(last) <= e.TTL {
+			continue
+		}
+		if err = db.DeleteServiceState(serviceID, stateKey); err != nil {
+			return err
+		}
+		delete(index, stateKey)
+	}
+	for _, stateKey := range stateKeys {
+		index[stateKey] = stored
+	}
+	if indexJSON, err = json.Marshal(index); err != nil {
+		return err
+	}
+	return db.StoreServiceState(serviceID, e.IndexKey, indexJSON)
+}
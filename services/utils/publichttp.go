@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Networks which aren't on the public internet. Services which fetch URLs given to them in chat
+// refuse to connect to them, so that nobody can make Go-NEB reach internal systems.
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // "This" network
+	"10.0.0.0/8",     // Private
+	"100.64.0.0/10",  // Carrier-grade NAT
+	"127.0.0.0/8",    // Loopback
+	"169.254.0.0/16", // Link local, including cloud metadata endpoints
+	"172.16.0.0/12",  // Private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // Private
+	"198.18.0.0/15",  // Benchmarking
+	"224.0.0.0/4",    // Multicast
+	"240.0.0.0/4",    // Reserved, including broadcast
+	"::/128",         // Unspecified
+	"::1/128",        // Loopback
+	"fc00::/7",       // Unique local
+	"fe80::/10",      // Link local
+	"ff00::/8",       // Multicast
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// CheckPublicAddress refuses connections to private networks, for use as the Control function of
+// a net.Dialer. It runs after the hostname is resolved, so that hostnames which resolve to private
+// addresses are refused too.
+func CheckPublicAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("Cannot connect to %s", host)
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return fmt.Errorf("Connecting to private address %s is not allowed", ip)
+		}
+	}
+	return nil
+}
+
+// PublicHTTPTransport returns an HTTP transport which only connects to the public internet, with
+// the given timeout for connecting. Pass allowPrivate to connect anywhere, for services whose
+// configuration allows it.
+func PublicHTTPTransport(timeout time.Duration, allowPrivate bool) *http.Transport {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = CheckPublicAddress
+	}
+	return &http.Transport{
+		// Proxies would make the address check useless
+		Proxy:               nil,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: timeout,
+	}
+}
+
+// NewPublicHTTPClient returns an HTTP client for fetching URLs given to Go-NEB in chat, which
+// only connects to the public internet and follows at most maxRedirects redirects.
+func NewPublicHTTPClient(timeout time.Duration, maxRedirects int) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: PublicHTTPTransport(timeout, false),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		},
+	}
+}
+
+// FetchImage downloads the image at the URL with the client, refusing anything which isn't an
+// image or is bigger than maxSize bytes. Returns the image and its content type.
+func FetchImage(cli *http.Client, imageURL string, maxSize int64) ([]byte, string, error) {
+	res, err := cli.Get(imageURL)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, "", fmt.Errorf("Not an image: %s", contentType)
+	}
+	if res.ContentLength > maxSize {
+		return nil, "", fmt.Errorf("Image is too big: %d bytes", res.ContentLength)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, "", fmt.Errorf("Image is too big")
+	}
+	return data, contentType, nil
+}
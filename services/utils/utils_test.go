@@ -2,7 +2,10 @@ package utils
 
 import (
 	"testing"
+	"time"
 
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
 	mevt "maunium.net/go/mautrix/event"
 )
 
@@ -17,3 +20,46 @@ func TestHTMLStrip(t *testing.T) {
 		t.Fatalf(`Expected Body "%v", got "%v"`, expected, stripped.Body)
 	}
 }
+
+func TestCheckPublicAddress(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:80", "10.1.2.3:443", "169.254.169.254:80", "[::1]:80", "[::ffff:192.168.0.1]:80"} {
+		if err := CheckPublicAddress("tcp", address, nil); err == nil {
+			t.Errorf("Expected %s to be refused", address)
+		}
+	}
+	for _, address := range []string{"93.184.216.34:443", "[2606:2800:220:1:248:1893:25c8:1946]:443"} {
+		if err := CheckPublicAddress("tcp", address, nil); err != nil {
+			t.Errorf("Expected %s to be allowed, got %s", address, err)
+		}
+	}
+}
+
+func TestExpiringState(t *testing.T) {
+	store := testutils.NewStateStorage()
+	database.SetServiceDB(store)
+	expiring := &ExpiringState{IndexKey: "index", TTL: time.Hour}
+
+	start := time.Now()
+	if err := expiring.Store("id", start, []byte(`"zelda"`), "a", "b"); err != nil {
+		t.Fatalf("Failed to store state: %s", err)
+	}
+	if err := expiring.Store("id", start.Add(30*time.Minute), []byte(`"link"`), "c"); err != nil {
+		t.Fatalf("Failed to store state: %s", err)
+	}
+	if len(store.State) != 4 {
+		t.Fatalf("Expected 3 keys and the index to be stored, got %v", store.State)
+	}
+	if err := expiring.Store("id", start.Add(61*time.Minute), []byte(`"ganon"`), "d"); err != nil {
+		t.Fatalf("Failed to store state: %s", err)
+	}
+	for _, key := range []string{"id a", "id b"} {
+		if _, ok := store.State[key]; ok {
+			t.Errorf("Expected %q to have expired", key)
+		}
+	}
+	for _, key := range []string{"id c", "id d"} {
+		if _, ok := store.State[key]; !ok {
+			t.Errorf("Expected %q to be kept", key)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Package weather implements a Service which looks up the weather with OpenWeatherMap.
+package weather
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Weather service
+const ServiceType = "weather"
+
+// How many days "!forecast" covers
+const forecastDays = 3
+
+// The OpenWeatherMap API. Overridden by tests.
+var owmURL = "https://api.openweathermap.org/data/2.5/"
+
+var httpClient = &http.Client{}
+
+// The symbols of the temperature and wind speed of each kind of units
+var unitSymbols = map[string]struct{ temp, speed string }{
+	"metric":   {"°C", "m/s"},
+	"imperial": {"°F", "mph"},
+	"standard": {"K", "m/s"},
+}
+
+// Service contains the Config fields for the Weather service.
+//
+// Example JSON request:
+//   {
+//       "api_key": "0123456789abcdef0123456789abcdef",
+//       "units": "metric"
+//   }
+type Service struct {
+	types.DefaultService
+	// The OpenWeatherMap API key, from https://home.openweathermap.org/api_keys
+	APIKey string `json:"api_key"`
+	// Optional. "metric" (°C), "imperial" (°F) or "standard" (kelvin). Defaults to "metric".
+	Units string `json:"units"`
+}
+
+type owmConditions []struct {
+	Description string `json:"description"`
+}
+
+// description returns the first of the conditions, e.g. "Light rain".
+func (c owmConditions) description() string {
+	if len(c) == 0 || c[0].Description == "" {
+		return ""
+	}
+	d := c[0].Description
+	return strings.ToUpper(d[:1]) + d[1:]
+}
+
+type owmCurrent struct {
+	Name string `json:"name"`
+	Sys  struct {
+		Country string `json:"country"`
+	} `json:"sys"`
+	Weather owmConditions `json:"weather"`
+	Main    struct {
+		Temp      float64 `json:"temp"`
+		FeelsLike float64 `json:"feels_like"`
+		Humidity  int     `json:"humidity"`
+	} `json:"main"`
+	Wind struct {
+		Speed float64 `json:"speed"`
+	} `json:"wind"`
+}
+
+type owmForecast struct {
+	City struct {
+		Name    string `json:"name"`
+		Country string `json:"country"`
+		// The offset from UTC in seconds
+		Timezone int `json:"timezone"`
+	} `json:"city"`
+	// Every 3 hours for 5 days
+	List []owmForecastEntry `json:"list"`
+}
+
+type owmForecastEntry struct {
+	Dt   int64 `json:"dt"`
+	Main struct {
+		TempMin float64 `json:"temp_min"`
+		TempMax float64 `json:"temp_max"`
+	} `json:"main"`
+	Weather owmConditions `json:"weather"`
+}
+
+// dayForecast is the weather of a day.
+type dayForecast struct {
+	Day              time.Time
+	TempMin, TempMax float64
+	// The conditions of most of the day
+	Description string
+}
+
+// Commands supported:
+//    !weather city
+// Responds with the current temperature and conditions in the city.
+//    !forecast city
+// Responds with the temperatures and conditions of the next 3 days in the city.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"weather"},
+			Arguments: []string{"city"},
+			Help:      "Show the current weather in a city",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdWeather(args)
+			},
+		},
+		{
+			Path:      []string{"forecast"},
+			Arguments: []string{"city"},
+			Help:      fmt.Sprintf("Show the weather forecast for the next %d days in a city", forecastDays),
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdForecast(args, time.Now())
+			},
+		},
+	}
+}
+
+func (s *Service) cmdWeather(args []string) (interface{}, error) {
+	city := strings.Join(args, " ")
+	if city == "" {
+		return nil, fmt.Errorf("Usage: !weather city")
+	}
+	var current owmCurrent
+	found, err := s.get("weather", city, &current)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up the weather in %s: %s", city, err)
+	} else if !found {
+		return notFound(city), nil
+	}
+
+	symbols := unitSymbols[s.units()]
+	place := placeName(current.Name, current.Sys.Country)
+	summary := fmt.Sprintf("%s, %s", formatTemp(current.Main.Temp, symbols.temp), current.Weather.description())
+	details := fmt.Sprintf("Feels like %s · Humidity %d%% · Wind %.1f %s",
+		formatTemp(current.Main.FeelsLike, symbols.temp), current.Main.Humidity, current.Wind.Speed, symbols.speed)
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("%s: %s\n%s", place, summary, details),
+		Format:  mevt.FormatHTML,
+		FormattedBody: fmt.Sprintf("<strong>%s</strong>: %s<br>%s",
+			html.EscapeString(place), html.EscapeString(summary), html.EscapeString(details)),
+	}, nil
+}
+
+func (s *Service) cmdForecast(args []string, now time.Time) (interface{}, error) {
+	city := strings.Join(args, " ")
+	if city == "" {
+		return nil, fmt.Errorf("Usage: !forecast city")
+	}
+	var forecast owmForecast
+	found, err := s.get("forecast", city, &forecast)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up the forecast for %s: %s", city, err)
+	} else if !found {
+		return notFound(city), nil
+	}
+
+	loc := time.FixedZone(forecast.City.Name, forecast.City.Timezone)
+	days := dailyForecasts(forecast.List, loc, now)
+	if len(days) == 0 {
+		return notFound(city), nil
+	}
+	symbols := unitSymbols[s.units()]
+	title := fmt.Sprintf("%d-day forecast for %s", len(days), placeName(forecast.City.Name, forecast.City.Country))
+	var lines, items []string
+	for _, d := range days {
+		line := fmt.Sprintf("%s: %s–%s, %s", d.Day.Format("Mon 2 Jan"),
+			formatTemp(d.TempMin, ""), formatTemp(d.TempMax, symbols.temp), d.Description)
+		lines = append(lines, line)
+		items = append(items, "<li>"+html.EscapeString(line)+"</li>")
+	}
+	return &mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          title + "\n" + strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: "<strong>" + html.EscapeString(title) + "</strong><ul>" + strings.Join(items, "") + "</ul>",
+	}, nil
+}
+
+// dailyForecasts groups the 3-hourly forecast into the days after today in the location, up
+// to forecastDays of them.
+func dailyForecasts(entries []owmForecastEntry, loc *time.Location, now time.Time) []dayForecast {
+	today := now.In(loc).Format("2006-01-02")
+	var days []dayForecast
+	var counts []map[string]int
+	for _, e := range entries {
+		t := time.Unix(e.Dt, 0).In(loc)
+		date := t.Format("2006-01-02")
+		if date <= today {
+			continue
+		}
+		if len(days) == 0 || days[len(days)-1].Day.Format("2006-01-02") != date {
+			if len(days) == forecastDays {
+				break
+			}
+			days = append(days, dayForecast{
+				Day:     time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc),
+				TempMin: e.Main.TempMin,
+				TempMax: e.Main.TempMax,
+			})
+			counts = append(counts, make(map[string]int))
+		}
+		d := &days[len(days)-1]
+		d.TempMin = math.Min(d.TempMin, e.Main.TempMin)
+		d.TempMax = math.Max(d.TempMax, e.Main.TempMax)
+		description := e.Weather.description()
+		c := counts[len(counts)-1]
+		c[description]++
+		if d.Description == "" || c[description] > c[d.Description] {
+			d.Description = description
+		}
+	}
+	return days
+}
+
+// get fetches the endpoint for the city. It returns false if OpenWeatherMap doesn't know the city.
+func (s *Service) get(endpoint, city string, out interface{}) (bool, error) {
+	q := url.Values{}
+	q.Set("q", city)
+	q.Set("units", s.units())
+	q.Set("appid", s.APIKey)
+	res, err := httpClient.Get(owmURL + endpoint + "?" + q.Encode())
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return false, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		var owmErr struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(res.Body).Decode(&owmErr) == nil && owmErr.Message != "" {
+			return false, fmt.Errorf("%s", owmErr.Message)
+		}
+		return false, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	return true, json.NewDecoder(res.Body).Decode(out)
+}
+
+func (s *Service) units() string {
+	if s.Units == "" {
+		return "metric"
+	}
+	return s.Units
+}
+
+func notFound(city string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("No weather found for %s", city),
+	}
+}
+
+func placeName(name, country string) string {
+	if country == "" {
+		return name
+	}
+	return name + ", " + country
+}
+
+// formatTemp returns the temperature to the nearest degree, e.g. "12°C".
+func formatTemp(temp float64, symbol string) string {
+	return fmt.Sprintf("%d%s", int(math.Round(temp)), symbol)
+}
+
+// Register makes sure that there is an API key and the units are known.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.APIKey == "" {
+		return fmt.Errorf("An api_key is required")
+	}
+	if _, ok := unitSymbols[s.units()]; !ok {
+		return fmt.Errorf("Unknown units '%s': must be metric, imperial or standard", s.Units)
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package weather
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestWeather(t *testing.T) {
+	// 2021-06-04 was a Friday. London is an hour ahead of UTC in June.
+	now := time.Date(2021, 6, 4, 12, 0, 0, 0, time.UTC)
+	var entries []string
+	for _, e := range []struct {
+		hoursFromNow     int
+		tempMin, tempMax float64
+		description      string
+	}{
+		{3, 18, 19, "clear sky"},
+		// Midnight on Saturday in London
+		{11, 12, 12.4, "light rain"},
+		{23, 16, 20.6, "light rain"},
+		{32, 13, 14, "clear sky"},
+		{35, 9.5, 10, "few clouds"},
+		{47, 15, 22, "few clouds"},
+		{59, 11, 17, "broken clouds"},
+		// Tuesday is beyond the 3 days
+		{83, 10, 15, "snow"},
+	} {
+		entries = append(entries, fmt.Sprintf(`{"dt":%d,"main":{"temp_min":%v,"temp_max":%v},"weather":[{"description":"%s"}]}`,
+			now.Add(time.Duration(e.hoursFromNow)*time.Hour).Unix(), e.tempMin, e.tempMax, e.description))
+	}
+
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var body string
+		status := 200
+		switch req.URL.String() {
+		case "https://api.openweathermap.org/data/2.5/weather?appid=secret&q=London&units=metric":
+			body = `{"name":"London","sys":{"country":"GB"},"weather":[{"description":"light rain"}],
+				"main":{"temp":12.5,"feels_like":-0.4,"humidity":80},"wind":{"speed":4.12}}`
+		case "https://api.openweathermap.org/data/2.5/weather?appid=secret&q=Atlantis&units=metric":
+			status, body = 404, `{"cod":"404","message":"city not found"}`
+		case "https://api.openweathermap.org/data/2.5/forecast?appid=secret&q=London&units=imperial":
+			body = `{"city":{"name":"London","country":"GB","timezone":3600},"list":[` + strings.Join(entries, ",") + `]}`
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: status,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	s := &Service{APIKey: "secret"}
+	res, err := s.cmdWeather([]string{"London"})
+	if err != nil {
+		t.Fatalf("!weather failed: %s", err)
+	}
+	want := "London, GB: 13°C, Light rain\nFeels like 0°C · Humidity 80% · Wind 4.1 m/s"
+	if body := res.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("Bad weather: got %q, want %q", body, want)
+	}
+	res, err = s.cmdWeather([]string{"Atlantis"})
+	if err != nil || res.(*mevt.MessageEventContent).Body != "No weather found for Atlantis" {
+		t.Errorf("Expected no weather for Atlantis, got %v, %v", res, err)
+	}
+
+	s.Units = "imperial"
+	res, err = s.cmdForecast([]string{"London"}, now)
+	if err != nil {
+		t.Fatalf("!forecast failed: %s", err)
+	}
+	content := res.(*mevt.MessageEventContent)
+	want = "3-day forecast for London, GB\n" +
+		"Sat 5 Jun: 12–21°F, Light rain\n" +
+		"Sun 6 Jun: 10–22°F, Few clouds\n" +
+		"Mon 7 Jun: 11–17°F, Broken clouds"
+	if content.Body != want {
+		t.Errorf("Bad forecast: got %q, want %q", content.Body, want)
+	}
+	if !strings.HasSuffix(content.FormattedBody, "<li>Mon 7 Jun: 11–17°F, Broken clouds</li></ul>") {
+		t.Errorf("Bad HTML forecast: %s", content.FormattedBody)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{`{}`, `{"api_key":"secret","units":"kelvin"}`} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create weather service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected Register(%s) to fail", config)
+		}
+	}
+}
@@ -5,9 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jaytaylor/html2text"
 	"github.com/matrix-org/go-neb/types"
@@ -19,9 +25,25 @@ import (
 // ServiceType of the Wikipedia service
 const ServiceType = "wikipedia"
 const maxExtractLength = 1024 // Max length of extract string in bytes
+const maxChoices = 10         // Max number of disambiguation options to list
+const leadImageWidth = 640    // Width in pixels of the lead image thumbnail
+
+// How long a user has to pick from a list of disambiguation options
+const choiceTimeout = 5 * time.Minute
 
 var httpClient = &http.Client{}
 
+// The Wikipedia editions which can be picked with !wikipedia <lang> search_text. Editions missing
+// from this list can still be used as the service's default language.
+var languages = map[string]bool{
+	"ar": true, "bg": true, "ca": true, "cs": true, "cy": true, "da": true, "de": true, "el": true,
+	"en": true, "eo": true, "es": true, "et": true, "eu": true, "fa": true, "fi": true, "fr": true,
+	"ga": true, "gl": true, "he": true, "hr": true, "hu": true, "hy": true, "id": true, "it": true,
+	"ja": true, "ka": true, "ko": true, "la": true, "lt": true, "lv": true, "ms": true, "nl": true,
+	"nn": true, "no": true, "pl": true, "pt": true, "ro": true, "ru": true, "sk": true, "sl": true,
+	"sr": true, "sv": true, "th": true, "tr": true, "uk": true, "ur": true, "vi": true, "zh": true,
+}
+
 // Search results (returned by search query)
 type wikipediaSearchResults struct {
 	Query wikipediaQuery `json:"query"` // Containter for the query response
@@ -34,22 +56,83 @@ type wikipediaQuery struct {
 
 // Representation of an individual wikipedia page
 type wikipediaPage struct {
-	PageID    int64  `json:"pageid"`    // Unique ID for the wikipedia page
-	NS        int    `json:"ns"`        // Namespace ID
-	Title     string `json:"title"`     // Page title text
-	Touched   string `json:"touched"`   // Date that the page was last touched / modified
-	LastRevID int64  `json:"lastrevid"` //
-	Extract   string `json:"extract"`   // Page extract text
+	PageID    int64              `json:"pageid"`    // Unique ID for the wikipedia page
+	NS        int                `json:"ns"`        // Namespace ID
+	Title     string             `json:"title"`     // Page title text
+	Touched   string             `json:"touched"`   // Date that the page was last touched / modified
+	LastRevID int64              `json:"lastrevid"` //
+	Extract   string             `json:"extract"`   // Page extract text
+	PageProps map[string]string  `json:"pageprops"` // Page properties, e.g. "disambiguation"
+	Thumbnail *wikipediaImage    `json:"thumbnail"` // Lead image of the page, if it has one
+	Links     []wikipediaPageRef `json:"links"`     // Articles linked to from the page
+}
+
+// A scaled version of an image on a wikipedia page
+type wikipediaImage struct {
+	Source string `json:"source"` // URL of the image
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// A link to another wikipedia page
+type wikipediaPageRef struct {
+	NS    int    `json:"ns"`
+	Title string `json:"title"`
 }
 
+// Search results (returned by full text search)
+type wikipediaTextSearchResults struct {
+	Query struct {
+		Search []wikipediaPageRef `json:"search"`
+	} `json:"query"`
+}
+
+// The articles a room was last offered to pick from
+type pendingChoice struct {
+	// The user who searched, who can pick by replying with just a number
+	userID   id.UserID
+	language string
+	titles   []string
+	expires  time.Time
+}
+
+// The articles each room was last offered to pick from, until someone picks one or they expire.
+var (
+	choicesMutex sync.Mutex
+	choices      = make(map[id.RoomID]pendingChoice)
+)
+
 // Service contains the Config fields for the Wikipedia service.
+//
+// Example request:
+//
+//	{
+//	    "language": "de"
+//	}
 type Service struct {
 	types.DefaultService
+	// Optional. The code of the Wikipedia edition to search by default, e.g. "de" for
+	// de.wikipedia.org. Defaults to "en".
+	Language string `json:"language"`
 }
 
 // Commands supported:
-//    !wikipedia some_search_query_without_quotes
-// Responds with a suitable article extract and link to the referenced page into the same room as the command.
+//
+//	!wikipedia some_search_query_without_quotes
+//
+// Responds with a suitable article extract, lead image and link to the referenced page into the same room as the command.
+//
+//	!wikipedia de some_search_query_without_quotes
+//
+// Does the same, but searches the German Wikipedia.
+//
+// If the query matches a disambiguation page, a numbered list of the articles it refers to is sent
+// instead. If it doesn't match an article's title, a numbered list of the articles which mention it
+// is sent. The user who searched can reply with one of the numbers to get that article.
+//
+//	!wikipedia 2
+//
+// Responds with the second article of the list most recently sent into the room.
 func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	return []types.Command{
 		{
@@ -61,42 +144,189 @@ func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	}
 }
 
+// Expansions expands a bare number into the chosen article, if the sender was just shown a list of
+// articles to pick from in the room.
+func (s *Service) Expansions(client types.MatrixClient) []types.Expansion {
+	return []types.Expansion{
+		{
+			Regexp: regexp.MustCompile(`^\s*([0-9]{1,2})\s*$`),
+			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+				return s.expandChoice(client, roomID, userID, matchingGroups[1])
+			},
+		},
+	}
+}
+
 // usageMessage returns a matrix TextMessage representation of the service usage
 func usageMessage() *mevt.MessageEventContent {
 	return &mevt.MessageEventContent{
 		MsgType: mevt.MsgNotice,
-		Body:    "Usage: !wikipedia search_text",
+		Body:    "Usage: !wikipedia [language] search_text",
 	}
 }
 
+// defaultLanguage returns the code of the Wikipedia edition to search if the user doesn't pick one
+func (s *Service) defaultLanguage() string {
+	if s.Language != "" {
+		return strings.ToLower(s.Language)
+	}
+	return "en"
+}
+
 func (s *Service) cmdWikipediaSearch(client types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
 	// Check for query text
 	if len(args) < 1 {
 		return usageMessage(), nil
 	}
 
-	// Get the query text and per,form search
+	// A number picks from the list of articles the room was just shown
+	if choice, ok := pendingChoiceIn(roomID); ok && len(args) == 1 {
+		if n, err := strconv.Atoi(args[0]); err == nil {
+			return s.pick(client, roomID, choice, n), nil
+		}
+	}
+
+	// A leading language code picks the Wikipedia edition to search
+	language := s.defaultLanguage()
+	if len(args) > 1 && languages[strings.ToLower(args[0])] {
+		language = strings.ToLower(args[0])
+		args = args[1:]
+	}
+
+	// Get the query text and perform search
 	querySentence := strings.Join(args, " ")
-	searchResultPage, err := s.text2Wikipedia(querySentence)
+	searchResultPage, err := s.text2Wikipedia(language, querySentence)
 	if err != nil {
 		return nil, err
 	}
 
+	// Offer the user the articles which mention the query if there isn't one with that title
+	if searchResultPage == nil {
+		titles, err := searchWikipedia(language, querySentence)
+		if err != nil {
+			return nil, err
+		}
+		if len(titles) != 1 {
+			return choiceMessage(fmt.Sprintf("Articles matching %s:", querySentence), language, titles, roomID, userID), nil
+		}
+		if searchResultPage, err = s.text2Wikipedia(language, titles[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Offer the user the articles a disambiguation page lists, rather than its extract
+	if _, ok := searchResultPage.PageProps["disambiguation"]; ok {
+		return s.disambiguationMessage(language, searchResultPage, roomID, userID), nil
+	}
+	return s.articleMessage(client, roomID, language, searchResultPage), nil
+}
+
+// pendingChoiceIn returns the list of articles the room was last offered, if it hasn't expired.
+func pendingChoiceIn(roomID id.RoomID) (pendingChoice, bool) {
+	choicesMutex.Lock()
+	defer choicesMutex.Unlock()
+	choice, ok := choices[roomID]
+	if ok && time.Now().After(choice.expires) {
+		delete(choices, roomID)
+		ok = false
+	}
+	return choice, ok
+}
+
+// expandChoice responds with the article the user picked from a list of disambiguation options,
+// or nil if they weren't picking from one.
+func (s *Service) expandChoice(client types.MatrixClient, roomID id.RoomID, userID id.UserID, number string) interface{} {
+	choice, ok := pendingChoiceIn(roomID)
+	if !ok || choice.userID != userID {
+		return nil
+	}
+	n, _ := strconv.Atoi(number)
+	return s.pick(client, roomID, choice, n)
+}
+
+// pick responds with the nth article of the choice, and forgets the choice.
+func (s *Service) pick(client types.MatrixClient, roomID id.RoomID, choice pendingChoice, n int) interface{} {
+	if n < 1 || n > len(choice.titles) {
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("Pick a number between 1 and %d", len(choice.titles)),
+		}
+	}
+	choicesMutex.Lock()
+	delete(choices, roomID)
+	choicesMutex.Unlock()
+
+	page, err := s.text2Wikipedia(choice.language, choice.titles[n-1])
+	if err != nil {
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    err.Error(),
+		}
+	}
+	return s.articleMessage(client, roomID, choice.language, page)
+}
+
+// disambiguationMessage lists the articles a disambiguation page refers to, and remembers them so
+// that the user can pick one.
+func (s *Service) disambiguationMessage(language string, page *wikipediaPage, roomID id.RoomID, userID id.UserID) interface{} {
+	var titles []string
+	for _, link := range page.Links {
+		if link.NS == 0 && len(titles) < maxChoices {
+			titles = append(titles, link.Title)
+		}
+	}
+	if len(titles) == 0 {
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("%s is ambiguous, try a more specific search", page.Title),
+		}
+	}
+	return choiceMessage(fmt.Sprintf("%s may refer to:", page.Title), language, titles, roomID, userID)
+}
+
+// choiceMessage lists the articles under the heading, and remembers them so that they can be
+// picked from.
+func choiceMessage(heading, language string, titles []string, roomID id.RoomID, userID id.UserID) interface{} {
+	if len(titles) == 0 {
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "No results",
+		}
+	}
+
+	choicesMutex.Lock()
+	choices[roomID] = pendingChoice{userID, language, titles, time.Now().Add(choiceTimeout)}
+	choicesMutex.Unlock()
+
+	body := heading + "\n"
+	for i, title := range titles {
+		body += fmt.Sprintf("%d. %s\n", i+1, title)
+	}
+	body += "Reply with a number, or say !wikipedia number, to pick one."
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+// articleMessage returns the extract of the page and a link to it. The page's lead image, if it
+// has one, is sent into the room ahead of the extract.
+func (s *Service) articleMessage(client types.MatrixClient, roomID id.RoomID, language string, page *wikipediaPage) interface{} {
 	// No article extracts
-	if searchResultPage == nil || searchResultPage.Extract == "" {
+	if page == nil || page.Extract == "" {
 		return mevt.MessageEventContent{
 			MsgType: "m.notice",
 			Body:    "No results",
-		}, nil
+		}
 	}
 
 	// Convert article HTML to text
-	extractText, err := html2text.FromString(searchResultPage.Extract)
+	extractText, err := html2text.FromString(page.Extract)
 	if err != nil {
 		return mevt.MessageEventContent{
 			MsgType: "m.notice",
 			Body:    "Failed to convert extract to plain text - " + err.Error(),
-		}, nil
+		}
 	}
 
 	// Truncate the extract text, if necessary
@@ -105,32 +335,62 @@ func (s *Service) cmdWikipediaSearch(client types.MatrixClient, roomID id.RoomID
 	}
 
 	// Add a link to the bottom of the extract
-	extractText += fmt.Sprintf("\nhttp://en.wikipedia.org/?curid=%d", searchResultPage.PageID)
+	extractText += fmt.Sprintf("\nhttps://%s.wikipedia.org/?curid=%d", language, page.PageID)
+
+	if page.Thumbnail != nil && page.Thumbnail.Source != "" {
+		if err := sendLeadImage(client, roomID, page); err != nil {
+			log.WithError(err).WithField("image", page.Thumbnail.Source).Warn("Failed to send Wikipedia lead image")
+		}
+	}
 
 	// Return article extract
 	return mevt.MessageEventContent{
 		MsgType: "m.notice",
 		Body:    extractText,
-	}, nil
+	}
+}
+
+// sendLeadImage uploads the page's lead image to Matrix and sends it into the room
+func sendLeadImage(client types.MatrixClient, roomID id.RoomID, page *wikipediaPage) error {
+	resUpload, err := client.UploadLink(page.Thumbnail.Source)
+	if err != nil {
+		return err
+	}
+	_, err = client.SendMessageEvent(roomID, mevt.EventMessage, mevt.MessageEventContent{
+		MsgType: mevt.MsgImage,
+		Body:    page.Title,
+		URL:     resUpload.ContentURI.CUString(),
+		Info: &mevt.FileInfo{
+			Width:    page.Thumbnail.Width,
+			Height:   page.Thumbnail.Height,
+			MimeType: mime.TypeByExtension(path.Ext(page.Thumbnail.Source)),
+		},
+	})
+	return err
 }
 
-// text2Wikipedia returns a Wikipedia article summary
-func (s *Service) text2Wikipedia(query string) (*wikipediaPage, error) {
-	log.Info("Searching Wikipedia for: ", query)
+// text2Wikipedia returns a Wikipedia article summary from the Wikipedia edition for the language
+func (s *Service) text2Wikipedia(language, query string) (*wikipediaPage, error) {
+	log.WithField("language", language).Info("Searching Wikipedia for: ", query)
 
-	u, err := url.Parse("https://en.wikipedia.org/w/api.php")
+	u, err := url.Parse(fmt.Sprintf("https://%s.wikipedia.org/w/api.php", language))
 	if err != nil {
 		return nil, err
 	}
 
 	// Example query - https://en.wikipedia.org/w/api.php?action=query&prop=extracts&format=json&exintro=&titles=RMS+Titanic
 	q := u.Query()
-	q.Set("action", "query")  // Action - query for articles
-	q.Set("prop", "extracts") // Return article extracts
+	q.Set("action", "query")                             // Action - query for articles
+	q.Set("prop", "extracts|pageprops|pageimages|links") // Return article extracts, lead images and links
 	q.Set("format", "json")
 	q.Set("redirects", "")
 	// q.Set("exintro", "")
-	q.Set("titles", query) // Text to search for
+	q.Set("ppprop", "disambiguation")                  // Only tell us whether the page is a disambiguation page
+	q.Set("piprop", "thumbnail")                       // Return a scaled lead image...
+	q.Set("pithumbsize", strconv.Itoa(leadImageWidth)) // ...this wide
+	q.Set("plnamespace", "0")                          // Only return links to articles...
+	q.Set("pllimit", "max")                            // ...and as many as possible, for disambiguation pages
+	q.Set("titles", query)                             // Text to search for
 
 	u.RawQuery = q.Encode()
 	// log.Info("Request URL: ", u)
@@ -152,18 +412,56 @@ func (s *Service) text2Wikipedia(query string) (*wikipediaPage, error) {
 	// log.Info(response2String(res))
 	if err := json.NewDecoder(res.Body).Decode(&searchResults); err != nil {
 		return nil, fmt.Errorf("ERROR - %s", err.Error())
-	} else if len(searchResults.Query.Pages) < 1 {
-		return nil, fmt.Errorf("No articles found")
 	}
 
-	// Return only the first search result with an extract
+	// Return only the first search result with an extract, or which is a disambiguation page
 	for _, page := range searchResults.Query.Pages {
-		if page.Extract != "" {
+		_, disambiguation := page.PageProps["disambiguation"]
+		if page.Extract != "" || disambiguation {
 			return &page, nil
 		}
 	}
 
-	return nil, fmt.Errorf("No articles with extracts found")
+	// There is no article with the title
+	return nil, nil
+}
+
+// searchWikipedia returns the titles of the articles which best match the query, from the
+// Wikipedia edition for the language
+func searchWikipedia(language, query string) ([]string, error) {
+	u, err := url.Parse(fmt.Sprintf("https://%s.wikipedia.org/w/api.php", language))
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("action", "query")
+	q.Set("list", "search") // Full text search
+	q.Set("format", "json")
+	q.Set("srnamespace", "0") // Only search articles
+	q.Set("srlimit", strconv.Itoa(maxChoices))
+	q.Set("srprop", "") // Only return the titles
+	q.Set("srsearch", query)
+	u.RawQuery = q.Encode()
+
+	res, err := httpClient.Get(u.String())
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("Request error: %d, %s", res.StatusCode, response2String(res))
+	}
+	var searchResults wikipediaTextSearchResults
+	if err := json.NewDecoder(res.Body).Decode(&searchResults); err != nil {
+		return nil, fmt.Errorf("ERROR - %s", err.Error())
+	}
+	var titles []string
+	for _, result := range searchResults.Query.Search {
+		titles = append(titles, result.Title)
+	}
+	return titles, nil
 }
 
 // response2String returns a string representation of an HTTP response body
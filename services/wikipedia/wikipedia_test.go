@@ -13,6 +13,8 @@ import (
 	"github.com/matrix-org/go-neb/testutils"
 	"github.com/matrix-org/go-neb/types"
 	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 // TODO: It would be nice to tabularise this test so we can try failing different combinations of responses to make
@@ -97,3 +99,196 @@ func TestCommand(t *testing.T) {
 		t.Fatalf("Failed to process command: %s", err.Error())
 	}
 }
+
+func TestLanguageAndDisambiguation(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	imageURL := "https://upload.wikimedia.org/wikipedia/commons/thumb/merkur.jpg"
+
+	var requestedHosts []string
+	wikipediaTrans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		requestedHosts = append(requestedHosts, req.URL.Host)
+		var page wikipediaPage
+		switch title := req.URL.Query().Get("titles"); title {
+		case "Merkur":
+			page = wikipediaPage{
+				PageID:    1,
+				Title:     "Merkur",
+				Extract:   "Merkur steht für:",
+				PageProps: map[string]string{"disambiguation": ""},
+				Links: []wikipediaPageRef{
+					{NS: 0, Title: "Merkur (Mythologie)"},
+					{NS: 0, Title: "Merkur (Planet)"},
+				},
+			}
+		case "Merkur (Planet)":
+			page = wikipediaPage{
+				PageID:    2,
+				Title:     title,
+				Extract:   "Der Merkur ist der kleinste Planet.",
+				Thumbnail: &wikipediaImage{Source: imageURL, Width: 640, Height: 480},
+			}
+		default:
+			t.Fatalf("Unexpected search: %s", title)
+		}
+		b, err := json.Marshal(wikipediaSearchResults{
+			Query: wikipediaQuery{Pages: map[string]wikipediaPage{"1": page}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to marshal Wikipedia response - %s", err)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(b)),
+		}, nil
+	})
+	httpClient = &http.Client{Transport: wikipediaTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@wikipediabot:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create Wikipedia service: ", err)
+	}
+	wikipedia := srv.(*Service)
+
+	// Mock the response from Matrix, recording the lead image being sent
+	var sentImage map[string]interface{}
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() == imageURL {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("some image data")),
+			}, nil
+		} else if strings.Contains(req.URL.String(), "_matrix/media/r0/upload") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://foo/bar"}`)),
+			}, nil
+		} else if strings.Contains(req.URL.String(), "/send/m.room.message/") {
+			if err := json.NewDecoder(req.Body).Decode(&sentImage); err != nil {
+				t.Fatalf("Failed to decode sent message: %s", err)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$image"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@wikipediabot:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	cmd := wikipedia.Commands(matrixCli)[0]
+	expansion := wikipedia.Expansions(matrixCli)[0]
+
+	// Nothing to pick from yet, so numbers are left alone
+	if res := expansion.Expand("!someroom:hyrule", "@navi:hyrule", []string{"2", "2"}); res != nil {
+		t.Fatalf("Expanded a number with no options pending: %+v", res)
+	}
+
+	res, err := cmd.Command("!someroom:hyrule", "@navi:hyrule", []string{"de", "Merkur"})
+	if err != nil {
+		t.Fatalf("Failed to process command: %s", err.Error())
+	}
+	if len(requestedHosts) != 1 || requestedHosts[0] != "de.wikipedia.org" {
+		t.Errorf("Searched the wrong Wikipedia: %v", requestedHosts)
+	}
+	wantList := "Merkur may refer to:\n1. Merkur (Mythologie)\n2. Merkur (Planet)\nReply with a number, or say !wikipedia number, to pick one."
+	if body := res.(mevt.MessageEventContent).Body; body != wantList {
+		t.Errorf("Bad disambiguation list: got %q want %q", body, wantList)
+	}
+
+	// Only the user who searched can pick an option
+	if res := expansion.Expand("!someroom:hyrule", "@link:hyrule", []string{"2", "2"}); res != nil {
+		t.Errorf("Expanded another user's choice: %+v", res)
+	}
+	res = expansion.Expand("!someroom:hyrule", "@navi:hyrule", []string{"2", "2"})
+	content, ok := res.(mevt.MessageEventContent)
+	if !ok || !strings.Contains(content.Body, "Der Merkur ist der kleinste Planet.") ||
+		!strings.HasSuffix(content.Body, "https://de.wikipedia.org/?curid=2") {
+		t.Errorf("Bad article response: %+v", res)
+	}
+	if sentImage == nil || sentImage["msgtype"] != "m.image" || sentImage["url"] != "mxc://foo/bar" {
+		t.Errorf("Lead image was not sent: %+v", sentImage)
+	}
+
+	// The choice has been used up
+	if res := expansion.Expand("!someroom:hyrule", "@navi:hyrule", []string{"1", "1"}); res != nil {
+		t.Errorf("Expanded a choice twice: %+v", res)
+	}
+}
+
+func TestSearchResults(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	wikipediaTrans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		query := req.URL.Query()
+		var res interface{}
+		if search := query.Get("srsearch"); search != "" {
+			var results wikipediaTextSearchResults
+			if search == "smallest planet" {
+				results.Query.Search = []wikipediaPageRef{{Title: "Mercury (planet)"}, {Title: "Dwarf planet"}}
+			} else if search == "hermes planet" {
+				results.Query.Search = []wikipediaPageRef{{Title: "Mercury (planet)"}}
+			}
+			res = results
+		} else {
+			// Only "Mercury (planet)" is the title of an article
+			page := wikipediaPage{PageID: -1, Title: query.Get("titles")}
+			if page.Title == "Mercury (planet)" {
+				page = wikipediaPage{PageID: 3, Title: page.Title, Extract: "Mercury is the smallest planet."}
+			}
+			res = wikipediaSearchResults{
+				Query: wikipediaQuery{Pages: map[string]wikipediaPage{"1": page}},
+			}
+		}
+		b, err := json.Marshal(res)
+		if err != nil {
+			t.Fatalf("Failed to marshal Wikipedia response - %s", err)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(b)),
+		}, nil
+	})
+	httpClient = &http.Client{Transport: wikipediaTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@wikipediabot:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create Wikipedia service: ", err)
+	}
+	wikipedia := srv.(*Service)
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@wikipediabot:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+	cmd := wikipedia.Commands(matrixCli)[0]
+
+	search := func(userID id.UserID, query string) string {
+		res, err := cmd.Command("!searchroom:hyrule", userID, strings.Fields(query))
+		if err != nil {
+			t.Fatalf("Failed to process command: %s", err.Error())
+		}
+		return res.(mevt.MessageEventContent).Body
+	}
+
+	// A single match is responded with directly
+	if body := search("@navi:hyrule", "hermes planet"); !strings.HasPrefix(body, "Mercury is the smallest planet.") {
+		t.Errorf("Bad single search result: %q", body)
+	}
+	if body := search("@navi:hyrule", "nothing like this"); body != "No results" {
+		t.Errorf("Bad response to no search results: %q", body)
+	}
+
+	// Several matches are listed, and anyone in the room can pick one
+	wantList := "Articles matching smallest planet:\n1. Mercury (planet)\n2. Dwarf planet\nReply with a number, or say !wikipedia number, to pick one."
+	if body := search("@navi:hyrule", "smallest planet"); body != wantList {
+		t.Errorf("Bad search results list: got %q want %q", body, wantList)
+	}
+	if body := search("@link:hyrule", "3"); body != "Pick a number between 1 and 2" {
+		t.Errorf("Bad response to out of range choice: %q", body)
+	}
+	if body := search("@link:hyrule", "1"); !strings.HasPrefix(body, "Mercury is the smallest planet.") {
+		t.Errorf("Bad chosen article: %q", body)
+	}
+}
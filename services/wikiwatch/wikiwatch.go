@@ -0,0 +1,376 @@
+// Package wikiwatch implements a Service which posts the recent changes to MediaWiki wikis into rooms.
+package wikiwatch
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Wikiwatch service
+const ServiceType = "wikiwatch"
+
+const (
+	defaultPollInterval = 5 * time.Minute
+	minPollIntervalMins = 1
+	// How many changes are asked for each poll. Busier wikis should be polled more often.
+	fetchLimit = 100
+	// How many changes are posted to a room each poll, so that mass edits don't flood it
+	maxChangesPerPoll = 10
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Service contains the Config fields for the Wikiwatch service.
+//
+// Each wiki is keyed by its api.php URL. Its edits and new pages are posted into its rooms with
+// the edit summary and a link to the diff. Changes can be limited to some namespaces, e.g. 0 for
+// articles and 4 for the project's pages, or to some pages. Bot edits are left out unless
+// "show_bots" is set, and minor edits are left out if "hide_minor" is set.
+//
+// The changes made before a wiki is added are not posted.
+//
+// Example JSON request:
+//   {
+//       "poll_interval_mins": 5,
+//       "wikis": {
+//           "https://wiki.example.org/w/api.php": {
+//               "rooms": ["!wiki:localhost"],
+//               "namespaces": [0, 4],
+//               "pages": ["Main Page", "Project:Events"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. How often to check the wikis for changes, in minutes. Defaults to 5.
+	PollIntervalMins int `json:"poll_interval_mins"`
+	// The wikis to watch, keyed by the URL of their api.php.
+	Wikis map[string]Wiki `json:"wikis"`
+}
+
+// Wiki is which changes to a wiki are posted, and where.
+type Wiki struct {
+	// The rooms to post changes into.
+	Rooms []id.RoomID `json:"rooms"`
+	// Optional. The namespaces to post changes in. Defaults to every namespace.
+	Namespaces []int `json:"namespaces"`
+	// Optional. The titles of the pages to post changes to. Defaults to every page.
+	Pages []string `json:"pages"`
+	// Optional. Post edits made by bots. Defaults to false.
+	ShowBots bool `json:"show_bots"`
+	// Optional. Leave out minor edits. Defaults to false.
+	HideMinor bool `json:"hide_minor"`
+}
+
+// watches returns whether changes to the page are posted.
+func (w *Wiki) watches(title string) bool {
+	if len(w.Pages) == 0 {
+		return true
+	}
+	for _, page := range w.Pages {
+		if normaliseTitle(page) == normaliseTitle(title) {
+			return true
+		}
+	}
+	return false
+}
+
+// change is an entry in MediaWiki's recent changes.
+type change struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	RevID    int64  `json:"revid"`
+	OldRevID int64  `json:"old_revid"`
+	RCID     int64  `json:"rcid"`
+	User     string `json:"user"`
+	Bot      bool   `json:"bot"`
+	Minor    bool   `json:"minor"`
+	OldLen   int    `json:"oldlen"`
+	NewLen   int    `json:"newlen"`
+	Comment  string `json:"comment"`
+}
+
+type recentChangesResponse struct {
+	Query struct {
+		RecentChanges []change `json:"recentchanges"`
+	} `json:"query"`
+	Error *struct {
+		Code string `json:"code"`
+		Info string `json:"info"`
+	} `json:"error"`
+}
+
+func (s *Service) pollInterval() time.Duration {
+	if s.PollIntervalMins <= 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(s.PollIntervalMins) * time.Minute
+}
+
+// OnPoll posts the changes to every wiki since the last poll.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	s.check(cli)
+	return time.Now().Add(s.pollInterval())
+}
+
+func (s *Service) check(cli types.MatrixClient) {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	lastSeen, err := s.loadLastSeen()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load the last seen changes")
+		return
+	}
+
+	var apiURLs []string
+	for apiURL := range s.Wikis {
+		apiURLs = append(apiURLs, apiURL)
+	}
+	sort.Strings(apiURLs)
+	for _, apiURL := range apiURLs {
+		wiki := s.Wikis[apiURL]
+		changes, err := fetchChanges(apiURL, &wiki)
+		if err != nil {
+			logger.WithError(err).WithField("wiki", apiURL).Error("Failed to fetch recent changes")
+			continue
+		}
+		last, seen := lastSeen[apiURL]
+		var unseen []change
+		for _, c := range changes {
+			if c.RCID > last {
+				unseen = append(unseen, c)
+			}
+		}
+		// Oldest first
+		sort.Slice(unseen, func(i, j int) bool { return unseen[i].RCID < unseen[j].RCID })
+		if len(unseen) > 0 {
+			lastSeen[apiURL] = unseen[len(unseen)-1].RCID
+		} else if !seen {
+			lastSeen[apiURL] = 0
+		}
+		if !seen {
+			// The wiki was just added
+			continue
+		}
+
+		var posted []change
+		for _, c := range unseen {
+			if wiki.watches(c.Title) {
+				posted = append(posted, c)
+			}
+		}
+		if len(posted) == 0 {
+			continue
+		}
+		content := formatChanges(apiURL, posted)
+		for _, roomID := range wiki.Rooms {
+			if _, err := notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: content}); err != nil {
+				logger.WithError(err).WithFields(log.Fields{
+					"wiki":    apiURL,
+					"room_id": roomID,
+				}).Error("Failed to send recent changes")
+			}
+		}
+	}
+
+	if err = s.storeLastSeen(lastSeen); err != nil {
+		logger.WithError(err).Error("Failed to store the last seen changes")
+	}
+}
+
+// formatChanges returns a message listing the changes, up to maxChangesPerPoll of them.
+func formatChanges(apiURL string, changes []change) mevt.MessageEventContent {
+	var more int
+	if len(changes) > maxChangesPerPoll {
+		more = len(changes) - maxChangesPerPoll
+		changes = changes[len(changes)-maxChangesPerPoll:]
+	}
+	var lines, htmlLines []string
+	for _, c := range changes {
+		verb, emoji := "edited", "✏️"
+		if c.Type == "new" {
+			verb, emoji = "created", "📄"
+		}
+		summary := fmt.Sprintf("%s %s %s (%+d)", c.User, verb, c.Title, c.NewLen-c.OldLen)
+		if c.Minor {
+			summary += " [minor]"
+		}
+		if c.Comment != "" {
+			summary += ": " + c.Comment
+		}
+		link := changeURL(apiURL, c)
+		lines = append(lines, fmt.Sprintf("%s %s\n%s", emoji, summary, link))
+		htmlLines = append(htmlLines, fmt.Sprintf(`%s <a href="%s">%s</a>`, emoji, html.EscapeString(link), html.EscapeString(summary)))
+	}
+	if more > 0 {
+		earlier := fmt.Sprintf("…and %d earlier changes", more)
+		lines = append([]string{earlier}, lines...)
+		htmlLines = append([]string{html.EscapeString(earlier)}, htmlLines...)
+	}
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.Join(lines, "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: strings.Join(htmlLines, "<br>"),
+	}
+}
+
+// changeURL returns the link to the change's diff, or to the page if it was created.
+func changeURL(apiURL string, c change) string {
+	index := strings.TrimSuffix(apiURL, "api.php") + "index.php"
+	if c.Type == "new" || c.OldRevID == 0 {
+		return index + "?" + url.Values{"oldid": {strconv.FormatInt(c.RevID, 10)}}.Encode()
+	}
+	return index + "?" + url.Values{
+		"diff":  {strconv.FormatInt(c.RevID, 10)},
+		"oldid": {strconv.FormatInt(c.OldRevID, 10)},
+	}.Encode()
+}
+
+// fetchChanges returns the wiki's latest edits and new pages in its namespaces, newest first.
+func fetchChanges(apiURL string, wiki *Wiki) ([]change, error) {
+	q := url.Values{
+		"action":        {"query"},
+		"list":          {"recentchanges"},
+		"rcprop":        {"title|ids|sizes|flags|user|comment"},
+		"rctype":        {"edit|new"},
+		"rclimit":       {strconv.Itoa(fetchLimit)},
+		"format":        {"json"},
+		"formatversion": {"2"},
+	}
+	var show []string
+	if !wiki.ShowBots {
+		show = append(show, "!bot")
+	}
+	if wiki.HideMinor {
+		show = append(show, "!minor")
+	}
+	if len(show) > 0 {
+		q.Set("rcshow", strings.Join(show, "|"))
+	}
+	if len(wiki.Namespaces) > 0 {
+		var namespaces []string
+		for _, ns := range wiki.Namespaces {
+			namespaces = append(namespaces, strconv.Itoa(ns))
+		}
+		q.Set("rcnamespace", strings.Join(namespaces, "|"))
+	}
+
+	req, err := http.NewRequest("GET", apiURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Wikimedia's wikis refuse requests without a User-Agent which identifies the application
+	req.Header.Set("User-Agent", "Go-NEB")
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var body recentChangesResponse
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Error != nil {
+		return nil, fmt.Errorf("%s: %s", body.Error.Code, body.Error.Info)
+	}
+	return body.Query.RecentChanges, nil
+}
+
+// normaliseTitle returns the title the way MediaWiki compares titles, e.g. "Main_page" is the
+// same page as "Main page", but "main page" is not.
+func normaliseTitle(title string) string {
+	title = strings.TrimSpace(strings.Replace(title, "_", " ", -1))
+	if title == "" {
+		return ""
+	}
+	// Only the first letter is case-insensitive
+	runes := []rune(title)
+	return strings.ToUpper(string(runes[0])) + string(runes[1:])
+}
+
+// loadLastSeen returns the ID of the last change seen on each wiki, keyed by api.php URL. It is
+// stored in the service state under "last_seen".
+func (s *Service) loadLastSeen() (map[string]int64, error) {
+	lastSeen := make(map[string]int64)
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "last_seen")
+	if err == sql.ErrNoRows {
+		return lastSeen, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(stateJSON, &lastSeen); err != nil {
+		return nil, err
+	}
+	return lastSeen, nil
+}
+
+func (s *Service) storeLastSeen(lastSeen map[string]int64) error {
+	stateJSON, err := json.Marshal(lastSeen)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "last_seen", stateJSON)
+}
+
+// Register makes sure that the wikis are configured properly, and joins their rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.PollIntervalMins < 0 || (s.PollIntervalMins > 0 && s.PollIntervalMins < minPollIntervalMins) {
+		return fmt.Errorf("poll_interval_mins can't be less than %d", minPollIntervalMins)
+	}
+	if len(s.Wikis) == 0 {
+		return fmt.Errorf("At least one wiki is required")
+	}
+	rooms := make(map[id.RoomID]bool)
+	for apiURL, wiki := range s.Wikis {
+		u, err := url.Parse(apiURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || !strings.HasSuffix(u.Path, "/api.php") || u.RawQuery != "" {
+			return fmt.Errorf("Bad wiki '%s': use the URL of its api.php, e.g. https://wiki.example.org/w/api.php", apiURL)
+		}
+		if len(wiki.Rooms) == 0 {
+			return fmt.Errorf("Wiki %s has no rooms to post changes into", apiURL)
+		}
+		for _, roomID := range wiki.Rooms {
+			rooms[roomID] = true
+		}
+	}
+	for roomID := range rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package wikiwatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestCheck(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	changes := `[{"type":"edit","title":"Main Page","revid":10,"old_revid":9,"rcid":100,"user":"Impa","oldlen":50,"newlen":60,"comment":"Old news"}]`
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		q := req.URL.Query()
+		if !strings.HasPrefix(req.URL.String(), "https://wiki.hyrule/w/api.php?") || q.Get("list") != "recentchanges" {
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		if q.Get("rcnamespace") != "0|4" || q.Get("rcshow") != "!bot" || req.Header.Get("User-Agent") == "" {
+			return nil, fmt.Errorf("Bad query: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"query":{"recentchanges":` + changes + `}}`)),
+		}, nil
+	})}
+
+	var sent []mevt.MessageEventContent
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "/join") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		sent = append(sent, msg)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$change:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"wikis": {
+			"https://wiki.hyrule/w/api.php": {
+				"rooms": ["!wiki:hyrule"],
+				"namespaces": [0, 4],
+				"pages": ["Main_Page", "Hyrule:Events", "temple of Time"]
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create wikiwatch service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register wikiwatch service: ", err)
+	}
+	s := srv.(*Service)
+
+	s.check(matrixCli)
+	if len(sent) != 0 {
+		t.Errorf("Posted changes made before the wiki was added: %v", sent)
+	}
+
+	changes = `[
+		{"type":"new","title":"Temple of Time","revid":13,"old_revid":0,"rcid":103,"user":"Rauru","oldlen":0,"newlen":420,"comment":"Created page"},
+		{"type":"edit","title":"Lost Woods","revid":12,"old_revid":8,"rcid":102,"user":"Saria","oldlen":80,"newlen":70,"comment":""},
+		{"type":"edit","title":"Main Page","revid":11,"old_revid":10,"rcid":101,"user":"Impa","minor":true,"oldlen":60,"newlen":55,"comment":"Fix <typo>"},
+		{"type":"edit","title":"Main Page","revid":10,"old_revid":9,"rcid":100,"user":"Impa","oldlen":50,"newlen":60,"comment":"Old news"}
+	]`
+	s.check(matrixCli)
+	s.check(matrixCli)
+
+	if len(sent) != 1 {
+		t.Fatalf("Expected one message, got %v", sent)
+	}
+	wantBody := "✏️ Impa edited Main Page (-5) [minor]: Fix <typo>\nhttps://wiki.hyrule/w/index.php?diff=11&oldid=10\n" +
+		"📄 Rauru created Temple of Time (+420): Created page\nhttps://wiki.hyrule/w/index.php?oldid=13"
+	if sent[0].Body != wantBody {
+		t.Errorf("Bad message: got %q, want %q", sent[0].Body, wantBody)
+	}
+	if !strings.Contains(sent[0].FormattedBody, `<a href="https://wiki.hyrule/w/index.php?diff=11&amp;oldid=10">Impa edited Main Page (-5) [minor]: Fix &lt;typo&gt;</a>`) {
+		t.Errorf("Bad HTML: %s", sent[0].FormattedBody)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"wikis": {"https://wiki.hyrule/w/api.php": {}}}`,
+		`{"wikis": {"https://wiki.hyrule/wiki/Main_Page": {"rooms": ["!wiki:hyrule"]}}}`,
+		`{"wikis": {"ftp://wiki.hyrule/w/api.php": {"rooms": ["!wiki:hyrule"]}}}`,
+		`{"poll_interval_mins": -1, "wikis": {"https://wiki.hyrule/w/api.php": {"rooms": ["!wiki:hyrule"]}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create wikiwatch service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
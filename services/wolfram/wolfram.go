@@ -0,0 +1,144 @@
+// Package wolfram implements a Service which answers questions with Wolfram|Alpha.
+package wolfram
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Wolfram service
+const ServiceType = "wolfram"
+
+// The Wolfram|Alpha APIs. Overridden by tests.
+var wolframURL = "https://api.wolframalpha.com/v1/"
+
+var httpClient = &http.Client{}
+
+// What the Short Answers API responds with when it doesn't understand the query at all, rather
+// than having no short answer to it
+const notUnderstood = "Wolfram|Alpha did not understand your input"
+
+// Service contains the Config fields for the Wolfram service.
+//
+// Queries are answered with the Short Answers API if they have a short answer, e.g. "How far is
+// the Moon?", and with an image of the full results from the Simple API if they don't, e.g.
+// "Plot sin(x)". Both need an AppID from https://developer.wolframalpha.com/portal/myapps/
+//
+// Example JSON request:
+//   {
+//       "app_id": "ABCDEF-1234567890",
+//       "units": "metric"
+//   }
+type Service struct {
+	types.DefaultService
+	// The Wolfram|Alpha AppID to use when making HTTP requests to Wolfram|Alpha.
+	AppID string `json:"app_id"`
+	// Optional. "metric" or "imperial". Defaults to guessing from the location of the server.
+	Units string `json:"units"`
+}
+
+// Commands supported:
+//    !wolfram some question without quotes
+// Responds with the short answer to the question, or an image of the full results if there
+// isn't one.
+func (s *Service) Commands(client types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"wolfram"},
+			Arguments: []string{"question"},
+			Help:      "Ask Wolfram|Alpha a question",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdWolfram(client, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdWolfram(client types.MatrixClient, args []string) (interface{}, error) {
+	query := strings.Join(args, " ")
+	if query == "" {
+		return nil, fmt.Errorf("Usage: !wolfram question")
+	}
+	log.Info("Asking Wolfram|Alpha ", query)
+
+	res, err := httpClient.Get(s.apiURL("result", query))
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query Wolfram|Alpha: %s", err)
+	}
+	answer, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read Wolfram|Alpha response: %s", err)
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    string(answer),
+		}, nil
+	case http.StatusNotImplemented:
+		// There is no short answer, or the query wasn't understood
+	default:
+		return nil, fmt.Errorf("Failed to query Wolfram|Alpha (HTTP %d): %s", res.StatusCode, answer)
+	}
+	if strings.TrimSpace(string(answer)) == notUnderstood {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Wolfram|Alpha didn't understand the question",
+		}, nil
+	}
+
+	// The image is downloaded by NEB, so the AppID isn't given to the homeserver.
+	resUpload, err := client.UploadLink(s.apiURL("simple", query))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to upload Wolfram|Alpha results to matrix: %s", err)
+	}
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgImage,
+		Body:    query,
+		URL:     resUpload.ContentURI.CUString(),
+		Info: &mevt.FileInfo{
+			MimeType: "image/gif",
+		},
+	}, nil
+}
+
+// apiURL returns the URL of the endpoint of the API which answers the query.
+func (s *Service) apiURL(endpoint, query string) string {
+	q := url.Values{}
+	q.Set("appid", s.AppID)
+	q.Set("i", query)
+	if s.Units != "" {
+		q.Set("units", s.Units)
+	}
+	return wolframURL + endpoint + "?" + q.Encode()
+}
+
+// Register makes sure that there is an AppID and the units are known.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.AppID == "" {
+		return fmt.Errorf("An app_id is required")
+	}
+	if s.Units != "" && s.Units != "metric" && s.Units != "imperial" {
+		return fmt.Errorf("Unknown units '%s': must be metric or imperial", s.Units)
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
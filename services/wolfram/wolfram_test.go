@@ -0,0 +1,95 @@
+package wolfram
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestCommand(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		status, body := 200, ""
+		switch req.URL.String() {
+		case "https://api.wolframalpha.com/v1/result?appid=secret&i=how+far+is+the+moon&units=metric":
+			body = "The Moon is about 384000 kilometers away"
+		case "https://api.wolframalpha.com/v1/result?appid=secret&i=plot+sin%28x%29&units=metric":
+			status, body = 501, "No short answer available"
+		case "https://api.wolframalpha.com/v1/result?appid=secret&i=flibbertigibbet&units=metric":
+			status, body = 501, "Wolfram|Alpha did not understand your input"
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: status,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})}
+
+	uploaded := ""
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.HasPrefix(req.URL.String(), "https://api.wolframalpha.com/v1/simple?") {
+			uploaded = req.URL.String()
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("some image data")),
+			}, nil
+		} else if strings.Contains(req.URL.String(), "_matrix/media/r0/upload") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://foo/plot"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"app_id":"secret","units":"metric"}`))
+	if err != nil {
+		t.Fatal("Failed to create Wolfram service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register Wolfram service: ", err)
+	}
+	cmds := srv.Commands(matrixCli)
+	if len(cmds) != 1 {
+		t.Fatalf("Unexpected number of commands: %d", len(cmds))
+	}
+	cmd := cmds[0]
+
+	res, err := cmd.Command("!someroom:hyrule", "@navi:hyrule", strings.Fields("how far is the moon"))
+	if err != nil {
+		t.Fatalf("Failed to process command: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "The Moon is about 384000 kilometers away" {
+		t.Errorf("Bad short answer: %q", body)
+	}
+
+	res, err = cmd.Command("!someroom:hyrule", "@navi:hyrule", strings.Fields("plot sin(x)"))
+	if err != nil {
+		t.Fatalf("Failed to process command: %s", err)
+	}
+	if content := res.(mevt.MessageEventContent); content.MsgType != mevt.MsgImage || content.URL != "mxc://foo/plot" {
+		t.Errorf("Expected an image of the results, got %+v", content)
+	}
+	if uploaded != "https://api.wolframalpha.com/v1/simple?appid=secret&i=plot+sin%28x%29&units=metric" {
+		t.Errorf("Bad results image URL: %s", uploaded)
+	}
+
+	res, err = cmd.Command("!someroom:hyrule", "@navi:hyrule", []string{"flibbertigibbet"})
+	if err != nil {
+		t.Fatalf("Failed to process command: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; body != "Wolfram|Alpha didn't understand the question" {
+		t.Errorf("Bad response to nonsense: %q", body)
+	}
+}
@@ -0,0 +1,262 @@
+// Package xkcd implements a Service which posts xkcd comics.
+package xkcd
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the XKCD service
+const ServiceType = "xkcd"
+
+// How often xkcd is checked for new comics. New comics come out three times a week.
+const pollInterval = time.Hour
+
+// There is no comic 404, as a joke
+const missingComic = 404
+
+// The xkcd website, which has a JSON API. Overridden by tests.
+var xkcdURL = "https://xkcd.com/"
+
+var httpClient = &http.Client{}
+
+// Service contains the Config fields for the XKCD service.
+//
+// New comics are announced to the rooms, which are joined when the service is registered.
+//
+// Example JSON request:
+//   {
+//       "rooms": ["!comics:localhost"]
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The rooms to announce new comics to.
+	Rooms []id.RoomID `json:"rooms"`
+}
+
+type comic struct {
+	Num       int    `json:"num"`
+	SafeTitle string `json:"safe_title"`
+	Img       string `json:"img"`
+	Alt       string `json:"alt"`
+}
+
+// Commands supported:
+//    !xkcd [number|random]
+// Responds with the latest comic, the comic with that number or a random comic.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"xkcd"},
+			Arguments: []string{"[number|random]"},
+			Help:      "Show an xkcd comic",
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdXKCD(cli, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdXKCD(cli types.MatrixClient, args []string) (interface{}, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("Usage: !xkcd [number|random]")
+	}
+	num := 0
+	if len(args) == 1 {
+		if args[0] == "random" {
+			latest, err := fetchComic(0)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to fetch the latest xkcd: %s", err)
+			}
+			num = randomNum(latest.Num)
+		} else {
+			var err error
+			if num, err = strconv.Atoi(args[0]); err != nil || num < 1 {
+				return nil, fmt.Errorf("Usage: !xkcd [number|random]")
+			}
+		}
+	}
+
+	c, err := fetchComic(num)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch xkcd: %s", err)
+	}
+	if c == nil {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("There is no xkcd %d", num),
+		}, nil
+	}
+	msg, err := comicMessage(cli, c)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// randomNum returns the number of a random comic, up to the latest.
+func randomNum(latest int) int {
+	if latest <= 1 {
+		return 1
+	}
+	for {
+		if num := rand.Intn(latest) + 1; num != missingComic {
+			return num
+		}
+	}
+}
+
+// comicMessage uploads the comic to Matrix, and returns an image message with the comic's
+// alt-text.
+func comicMessage(cli types.MatrixClient, c *comic) (*mevt.MessageEventContent, error) {
+	title := fmt.Sprintf("xkcd %d: %s", c.Num, c.SafeTitle)
+	link := fmt.Sprintf("%s%d/", xkcdURL, c.Num)
+	// Interactive comics don't have an image
+	if c.Img == "" {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    title + "\n" + link,
+		}, nil
+	}
+	resUpload, err := cli.UploadLink(c.Img)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to upload xkcd %d to matrix: %s", c.Num, err)
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgImage,
+		Body:    fmt.Sprintf("%s\n%s\n%s", title, c.Alt, link),
+		URL:     resUpload.ContentURI.CUString(),
+		Info: &mevt.FileInfo{
+			MimeType: mime.TypeByExtension(path.Ext(c.Img)),
+		},
+	}, nil
+}
+
+// fetchComic returns the comic with the number, or the latest comic if the number is 0. It
+// returns nil if there is no such comic.
+func fetchComic(num int) (*comic, error) {
+	u := xkcdURL + "info.0.json"
+	if num > 0 {
+		u = fmt.Sprintf("%s%d/info.0.json", xkcdURL, num)
+	}
+	res, err := httpClient.Get(u)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var c comic
+	if err = json.NewDecoder(res.Body).Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// OnPoll announces the latest comic to the rooms if it is new. The first poll only remembers the
+// latest comic, so that it isn't announced when the service is created.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	next := time.Now().Add(pollInterval)
+	if len(s.Rooms) == 0 {
+		return next
+	}
+	latest, err := fetchComic(0)
+	if err != nil || latest == nil {
+		logger.WithError(err).Error("Failed to fetch the latest xkcd")
+		return next
+	}
+	announced, err := s.loadAnnounced()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load the last announced xkcd")
+		return next
+	}
+	if latest.Num <= announced {
+		return next
+	}
+	// Remember the comic first, so that it isn't announced again if sending fails
+	if err = s.storeAnnounced(latest.Num); err != nil {
+		logger.WithError(err).Error("Failed to store the last announced xkcd")
+		return next
+	}
+	if announced == 0 {
+		return next
+	}
+
+	msg, err := comicMessage(cli, latest)
+	if err != nil {
+		logger.WithError(err).Error("Failed to upload the latest xkcd")
+		return next
+	}
+	for _, roomID := range s.Rooms {
+		if _, err := notify.Send(cli, s, notify.Notification{RoomID: roomID, Content: *msg}); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to announce xkcd")
+		}
+	}
+	return next
+}
+
+// loadAnnounced returns the number of the last comic announced, or 0 if none has been.
+func (s *Service) loadAnnounced() (int, error) {
+	stateJSON, err := database.GetServiceDB().LoadServiceState(s.ServiceID(), "announced")
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var num int
+	err = json.Unmarshal(stateJSON, &num)
+	return num, err
+}
+
+func (s *Service) storeAnnounced(num int) error {
+	stateJSON, err := json.Marshal(num)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(s.ServiceID(), "announced", stateJSON)
+}
+
+// Register joins the rooms new comics are announced to.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	for _, roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package xkcd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const comicJSON = `{"num":%d,"safe_title":"Comic %d","img":"https://imgs.xkcd.com/comics/comic_%d.png","alt":"Alt text %d"}`
+
+func TestXKCD(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	latest := 2000
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		num := latest
+		if req.URL.String() != "https://xkcd.com/info.0.json" {
+			if _, err := fmt.Sscanf(req.URL.String(), "https://xkcd.com/%d/info.0.json", &num); err != nil {
+				return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+			}
+		}
+		if num == 404 || num > latest {
+			return &http.Response{
+				StatusCode: 404,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("Not Found")),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(comicJSON, num, num, num, num))),
+		}, nil
+	})}
+
+	var uploaded []string
+	var sent []mevt.MessageEventContent
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch {
+		case strings.HasPrefix(req.URL.String(), "https://imgs.xkcd.com/"):
+			uploaded = append(uploaded, req.URL.String())
+			body = "some image data"
+		case strings.Contains(req.URL.String(), "_matrix/media/r0/upload"):
+			body = `{"content_uri":"mxc://foo/bar"}`
+		case strings.Contains(req.URL.String(), "/join"):
+			body = `{}`
+		case strings.Contains(req.URL.String(), "/send/m.room.message/"):
+			var msg mevt.MessageEventContent
+			if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+				t.Fatalf("Failed to decode message: %s", err)
+			}
+			sent = append(sent, msg)
+			body = `{"event_id":"$xkcd:hyrule"}`
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"rooms": ["!comics:hyrule"]}`))
+	if err != nil {
+		t.Fatal("Failed to create XKCD service: ", err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register XKCD service: ", err)
+	}
+	s := srv.(*Service)
+
+	res, err := s.cmdXKCD(matrixCli, []string{"327"})
+	if err != nil {
+		t.Fatalf("Failed to fetch comic: %s", err)
+	}
+	msg := res.(*mevt.MessageEventContent)
+	if msg.MsgType != mevt.MsgImage || msg.URL != "mxc://foo/bar" || msg.Info.MimeType != "image/png" ||
+		msg.Body != "xkcd 327: Comic 327\nAlt text 327\nhttps://xkcd.com/327/" {
+		t.Errorf("Bad comic message: %+v", msg)
+	}
+	if len(uploaded) != 1 || uploaded[0] != "https://imgs.xkcd.com/comics/comic_327.png" {
+		t.Errorf("Bad uploads: %v", uploaded)
+	}
+	if res, err = s.cmdXKCD(matrixCli, nil); err != nil || !strings.HasPrefix(res.(*mevt.MessageEventContent).Body, "xkcd 2000:") {
+		t.Errorf("Bad latest comic: %+v, %v", res, err)
+	}
+	if res, err = s.cmdXKCD(matrixCli, []string{"404"}); err != nil || res.(*mevt.MessageEventContent).Body != "There is no xkcd 404" {
+		t.Errorf("Bad missing comic: %+v, %v", res, err)
+	}
+	if _, err = s.cmdXKCD(matrixCli, []string{"latest"}); err == nil {
+		t.Errorf("Expected a bad argument to be refused")
+	}
+	for i := 0; i < 20; i++ {
+		if num := randomNum(405); num < 1 || num > 405 || num == 404 {
+			t.Fatalf("Bad random comic number: %d", num)
+		}
+	}
+
+	// The comic which is out when the service starts isn't announced, but the next one is, once
+	s.OnPoll(matrixCli)
+	if len(sent) != 0 {
+		t.Errorf("Announced the current comic: %+v", sent)
+	}
+	latest = 2001
+	s.OnPoll(matrixCli)
+	s.OnPoll(matrixCli)
+	if len(sent) != 1 || !strings.HasPrefix(sent[0].Body, "xkcd 2001: Comic 2001\n") {
+		t.Errorf("Bad announcements: %+v", sent)
+	}
+}
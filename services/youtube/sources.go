@@ -0,0 +1,167 @@
+package youtube
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// YouTube's channel feeds and Data API. Overridden by tests.
+var (
+	feedURL = "https://www.youtube.com/feeds/videos.xml"
+	apiURL  = "https://www.googleapis.com/youtube/v3/"
+)
+
+// How many of a channel's latest uploads are asked for from the Data API. The feeds always have
+// the latest 15.
+const fetchLimit = 15
+
+// video is an upload, in the form the service announces it.
+type video struct {
+	ID           string
+	Title        string
+	ChannelTitle string
+	Published    time.Time
+	// Optional. A link to the video's thumbnail image.
+	Thumbnail string
+}
+
+func (v *video) url() string {
+	return "https://www.youtube.com/watch?v=" + v.ID
+}
+
+// A source reads the uploads of YouTube channels.
+type source interface {
+	// videos returns the channel's latest uploads, newest first.
+	videos(channelID string) ([]video, error)
+}
+
+// feedSource reads the Atom feeds YouTube has for every channel, which need no API key but are
+// only updated every few minutes.
+type feedSource struct{}
+
+type atomFeed struct {
+	Title   string `xml:"title"`
+	Entries []struct {
+		VideoID   string    `xml:"http://www.youtube.com/xml/schemas/2015 videoId"`
+		Title     string    `xml:"title"`
+		Published time.Time `xml:"published"`
+		Author    struct {
+			Name string `xml:"name"`
+		} `xml:"author"`
+		Thumbnail struct {
+			URL string `xml:"url,attr"`
+		} `xml:"http://search.yahoo.com/mrss/ group>thumbnail"`
+	} `xml:"entry"`
+}
+
+func (feedSource) videos(channelID string) ([]video, error) {
+	res, err := httpClient.Get(feedURL + "?channel_id=" + url.QueryEscape(channelID))
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("Channel %s doesn't exist", channelID)
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	var feed atomFeed
+	if err = xml.NewDecoder(res.Body).Decode(&feed); err != nil {
+		return nil, err
+	}
+	var videos []video
+	for _, e := range feed.Entries {
+		videos = append(videos, video{
+			ID:           e.VideoID,
+			Title:        e.Title,
+			ChannelTitle: e.Author.Name,
+			Published:    e.Published,
+			Thumbnail:    e.Thumbnail.URL,
+		})
+	}
+	return videos, nil
+}
+
+// apiSource reads the playlists of channels' uploads with the YouTube Data API, which needs an API
+// key. Each request costs one unit of the key's daily quota.
+type apiSource struct {
+	apiKey string
+}
+
+type playlistItems struct {
+	Items []struct {
+		Snippet struct {
+			PublishedAt  time.Time `json:"publishedAt"`
+			Title        string    `json:"title"`
+			ChannelTitle string    `json:"channelTitle"`
+			Thumbnails   map[string]struct {
+				URL string `json:"url"`
+			} `json:"thumbnails"`
+			ResourceID struct {
+				VideoID string `json:"videoId"`
+			} `json:"resourceId"`
+		} `json:"snippet"`
+	} `json:"items"`
+	Error *struct {
+		Message string `json:"message"`
+		Errors  []struct {
+			Reason string `json:"reason"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+func (a *apiSource) videos(channelID string) ([]video, error) {
+	// Every channel's uploads are in a playlist whose ID is the channel's with "UU" for "UC", so
+	// the channel doesn't have to be looked up first
+	q := url.Values{
+		"part":       {"snippet"},
+		"playlistId": {"UU" + strings.TrimPrefix(channelID, "UC")},
+		"maxResults": {fmt.Sprint(fetchLimit)},
+		"key":        {a.apiKey},
+	}
+	res, err := httpClient.Get(apiURL + "playlistItems?" + q.Encode())
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var body playlistItems
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Request error: %d", res.StatusCode)
+	}
+	if body.Error != nil {
+		for _, e := range body.Error.Errors {
+			if e.Reason == "quotaExceeded" {
+				return nil, fmt.Errorf("The API key's daily quota is used up")
+			} else if e.Reason == "playlistNotFound" {
+				return nil, fmt.Errorf("Channel %s doesn't exist", channelID)
+			}
+		}
+		return nil, fmt.Errorf("Request error: %d: %s", res.StatusCode, body.Error.Message)
+	}
+	var videos []video
+	for _, item := range body.Items {
+		v := video{
+			ID:           item.Snippet.ResourceID.VideoID,
+			Title:        item.Snippet.Title,
+			ChannelTitle: item.Snippet.ChannelTitle,
+			Published:    item.Snippet.PublishedAt,
+		}
+		for _, size := range []string{"maxres", "high", "medium", "default"} {
+			if t, ok := item.Snippet.Thumbnails[size]; ok {
+				v.Thumbnail = t.URL
+				break
+			}
+		}
+		videos = append(videos, v)
+	}
+	return videos, nil
+}
@@ -0,0 +1,225 @@
+package youtube
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const (
+	zeldaChannel = "UCzeldazeldazeldazelda01"
+	linkChannel  = "UClinklinklinklinklink01"
+)
+
+func feedEntry(videoID, title, published string) string {
+	return fmt.Sprintf(`<entry><yt:videoId>%s</yt:videoId><title>%s</title><published>%s</published>
+		<author><name>Princess Zelda</name></author>
+		<media:group><media:thumbnail url="https://i.ytimg.com/vi/%s/hqdefault.jpg" width="480" height="360"/></media:group></entry>`,
+		videoID, title, published, videoID)
+}
+
+// matrixClient returns a client which serves any thumbnail and records the messages sent.
+func matrixClient(t *testing.T, sent *[]string) *mautrix.Client {
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		switch {
+		case strings.Contains(req.URL.String(), "/join"):
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		case strings.HasPrefix(req.URL.String(), "https://i.ytimg.com/"):
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Type": {"image/jpeg"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString("\xff\xd8\xff")),
+			}, nil
+		case strings.Contains(req.URL.String(), "/upload"):
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://hyrule/thumbnail"}`)),
+			}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		room := strings.Split(req.URL.Path, "/")[5]
+		*sent = append(*sent, fmt.Sprintf("%s %s %s", room, msg.MsgType, msg.Body))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$upload:hyrule"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+	return matrixCli
+}
+
+func createService(t *testing.T, cli *mautrix.Client, config string) *Service {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+	if err != nil {
+		t.Fatal("Failed to create youtube service: ", err)
+	}
+	if err = srv.Register(nil, cli); err != nil {
+		t.Fatal("Failed to register youtube service: ", err)
+	}
+	return srv.(*Service)
+}
+
+func TestPollFeeds(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	feeds := map[string][]string{
+		zeldaChannel: {feedEntry("harp", "Old song", "2021-03-01T12:00:00+00:00")},
+		linkChannel:  nil,
+	}
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		entries, ok := feeds[req.URL.Query().Get("channel_id")]
+		if !strings.HasPrefix(req.URL.String(), "https://www.youtube.com/feeds/videos.xml?") || !ok {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(""))}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(`<?xml version="1.0" encoding="UTF-8"?>
+				<feed xmlns:yt="http://www.youtube.com/xml/schemas/2015" xmlns:media="http://search.yahoo.com/mrss/" xmlns="http://www.w3.org/2005/Atom">
+				<title>Channel</title>` + strings.Join(entries, "") + `</feed>`)),
+		}, nil
+	})}
+	var sent []string
+	matrixCli := matrixClient(t, &sent)
+	s := createService(t, matrixCli, `{
+		"channels": {
+			"`+zeldaChannel+`": {"rooms": ["!castle:hyrule", "!music:hyrule"]},
+			"`+linkChannel+`": {"rooms": ["!castle:hyrule"]}
+		}
+	}`)
+
+	s.check(matrixCli)
+	if len(sent) != 0 {
+		t.Errorf("Announced uploads made before the channels were added: %v", sent)
+	}
+
+	// Newest first
+	feeds[zeldaChannel] = []string{
+		feedEntry("lullaby", "Zelda's Lullaby &amp; more", "2021-03-03T12:00:00+00:00"),
+		feedEntry("storms", "Song of Storms", "2021-03-02T12:00:00+00:00"),
+		feedEntry("harp", "Old song", "2021-03-01T12:00:00+00:00"),
+	}
+	feeds[linkChannel] = []string{feedEntry("ocarina", "First video", "2021-03-02T00:00:00+00:00")}
+	s.check(matrixCli)
+	s.check(matrixCli)
+
+	// Channels are checked in order of their IDs, and uploads announced oldest first
+	want := []string{
+		"!castle:hyrule m.notice 📺 Princess Zelda uploaded First video\nhttps://www.youtube.com/watch?v=ocarina",
+		"!castle:hyrule m.image ocarina.jpg",
+		"!castle:hyrule m.notice 📺 Princess Zelda uploaded Song of Storms\nhttps://www.youtube.com/watch?v=storms",
+		"!castle:hyrule m.image storms.jpg",
+		"!music:hyrule m.notice 📺 Princess Zelda uploaded Song of Storms\nhttps://www.youtube.com/watch?v=storms",
+		"!music:hyrule m.image storms.jpg",
+		"!castle:hyrule m.notice 📺 Princess Zelda uploaded Zelda's Lullaby & more\nhttps://www.youtube.com/watch?v=lullaby",
+		"!castle:hyrule m.image lullaby.jpg",
+		"!music:hyrule m.notice 📺 Princess Zelda uploaded Zelda's Lullaby & more\nhttps://www.youtube.com/watch?v=lullaby",
+		"!music:hyrule m.image lullaby.jpg",
+	}
+	if strings.Join(sent, "\n\n") != strings.Join(want, "\n\n") {
+		t.Errorf("Bad messages: got %q, want %q", sent, want)
+	}
+}
+
+func TestPollAPI(t *testing.T) {
+	database.SetServiceDB(testutils.NewStateStorage())
+	items := []string{`{"snippet": {"publishedAt": "2021-03-01T12:00:00Z", "title": "Old song", "channelTitle": "Zelda",
+		"resourceId": {"videoId": "harp"}, "thumbnails": {"default": {"url": "https://i.ytimg.com/vi/harp/default.jpg"}}}}`}
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		q := req.URL.Query()
+		if !strings.HasPrefix(req.URL.String(), "https://www.googleapis.com/youtube/v3/playlistItems?") ||
+			q.Get("key") != "master_sword" || q.Get("part") != "snippet" {
+			return nil, fmt.Errorf("Bad request: %s", req.URL.String())
+		}
+		if q.Get("playlistId") != "UUzeldazeldazeldazelda01" {
+			return &http.Response{
+				StatusCode: 404,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"error": {"code": 404, "message": "Not found", "errors": [{"reason": "playlistNotFound"}]}}`)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"items": [` + strings.Join(items, ",") + `]}`)),
+		}, nil
+	})}
+	var sent []string
+	matrixCli := matrixClient(t, &sent)
+	s := createService(t, matrixCli, `{
+		"api_key": "master_sword",
+		"channels": {"`+zeldaChannel+`": {"rooms": ["!castle:hyrule"]}}
+	}`)
+
+	s.check(matrixCli)
+	items = append([]string{`{"snippet": {"publishedAt": "2021-03-02T12:00:00Z", "title": "Song of Storms", "channelTitle": "Zelda",
+		"resourceId": {"videoId": "storms"}, "thumbnails": {"default": {"url": "https://i.ytimg.com/vi/storms/default.jpg"},
+		"high": {"url": "https://i.ytimg.com/vi/storms/hqdefault.jpg"}}}}`}, items...)
+	s.check(matrixCli)
+
+	want := []string{
+		"!castle:hyrule m.notice 📺 Zelda uploaded Song of Storms\nhttps://www.youtube.com/watch?v=storms",
+		"!castle:hyrule m.image storms.jpg",
+	}
+	if strings.Join(sent, "\n\n") != strings.Join(want, "\n\n") {
+		t.Errorf("Bad messages: got %q, want %q", sent, want)
+	}
+	if _, err := (&apiSource{apiKey: "master_sword"}).videos(linkChannel); err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Errorf("Expected an unknown channel to fail, got %v", err)
+	}
+}
+
+func TestPollInterval(t *testing.T) {
+	channels := make(map[string]Channel)
+	for i := 0; i < 100; i++ {
+		channels[fmt.Sprintf("UC%022d", i)] = Channel{}
+	}
+	for _, tc := range []struct {
+		s    Service
+		want time.Duration
+	}{
+		{Service{}, 15 * time.Minute},
+		{Service{PollIntervalMins: 5, Channels: channels}, 5 * time.Minute},
+		{Service{APIKey: "key", PollIntervalMins: 5, Channels: map[string]Channel{zeldaChannel: {}}}, 5 * time.Minute},
+		// 100 channels checked 10000 times a day
+		{Service{APIKey: "key", PollIntervalMins: 5, Channels: channels}, 24 * time.Hour / 100},
+		{Service{APIKey: "key", DailyQuota: 1000, Channels: channels}, 24 * time.Hour / 10},
+	} {
+		if got := tc.s.pollInterval(); got != tc.want {
+			t.Errorf("Bad poll interval for %d channels: got %s, want %s", len(tc.s.Channels), got, tc.want)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"channels": {"zelda": {"rooms": ["!castle:hyrule"]}}}`,
+		`{"channels": {"` + zeldaChannel + `": {}}}`,
+		`{"poll_interval_mins": 1, "channels": {"` + zeldaChannel + `": {"rooms": ["!castle:hyrule"]}}}`,
+		`{"daily_quota": -1, "channels": {"` + zeldaChannel + `": {"rooms": ["!castle:hyrule"]}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create youtube service: ", err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config to be refused: %s", config)
+		}
+	}
+}
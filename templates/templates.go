@@ -0,0 +1,115 @@
+// Package templates lets operators customise the messages which services send for notifications.
+//
+// Every notification has a dotted name such as "github.issues.closed" or "jira.issue_updated".
+// Services render their messages through Render, which looks for a template override stored in
+// the database for that name. If one exists, it is executed with the notification's data and
+// replaces the service's own formatting. Overrides are matched on the most specific name first,
+// so an override for "github.issues" applies to every issue event, and one for "github" applies
+// to every GitHub notification which hasn't been overridden more specifically.
+//
+// Overrides are managed with the /admin/configureTemplate API or the "templates" section of
+// the config file.
+package templates
+
+import (
+	"bytes"
+	"database/sql"
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+// funcs are available to every template override.
+var funcs = map[string]interface{}{
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	"truncate": func(n int, s string) string {
+		if r := []rune(s); len(r) > n {
+			return string(r[:n]) + "…"
+		}
+		return s
+	},
+}
+
+// Lookup returns the override which applies to the named notification, trying the name itself
+// and then each of its dotted prefixes. Returns false if there isn't one.
+func Lookup(name string) (api.Template, bool) {
+	db := database.GetServiceDB()
+	if db == nil {
+		return api.Template{}, false
+	}
+	for name != "" {
+		tmpl, err := db.LoadTemplate(name)
+		if err == nil && tmpl.Text != "" {
+			return tmpl, true
+		}
+		if err != nil && err != sql.ErrNoRows {
+			log.WithError(err).WithField("template", name).Error("Failed to load template")
+		}
+		i := strings.LastIndex(name, ".")
+		if i == -1 {
+			break
+		}
+		name = name[:i]
+	}
+	return api.Template{}, false
+}
+
+// Execute renders the template with the given data into a message with the given msgtype. Keys
+// missing from map data are errors, rather than rendering as "<no value>".
+func Execute(tmpl api.Template, msgType mevt.MessageType, data interface{}) (mevt.MessageEventContent, error) {
+	content := mevt.MessageEventContent{MsgType: msgType}
+	t, err := template.New(tmpl.Name).Funcs(funcs).Option("missingkey=error").Parse(tmpl.Text)
+	if err != nil {
+		return content, err
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, data); err != nil {
+		return content, err
+	}
+	content.Body = buf.String()
+	if tmpl.HTML == "" {
+		return content, nil
+	}
+	h, err := htmltemplate.New(tmpl.Name).Funcs(funcs).Option("missingkey=error").Parse(tmpl.HTML)
+	if err != nil {
+		return content, err
+	}
+	buf.Reset()
+	if err = h.Execute(&buf, data); err != nil {
+		return content, err
+	}
+	content.Format = mevt.FormatHTML
+	content.FormattedBody = buf.String()
+	return content, nil
+}
+
+// Render returns the message to send for the named notification. If an override applies to the
+// name it is executed with data, keeping the msgtype of the fallback. Otherwise, or if the
+// override fails to execute, the fallback message is returned unchanged.
+func Render(name string, data interface{}, fallback mevt.MessageEventContent) mevt.MessageEventContent {
+	tmpl, ok := Lookup(name)
+	if !ok {
+		return fallback
+	}
+	msgType := fallback.MsgType
+	if msgType == "" {
+		msgType = mevt.MsgNotice
+	}
+	content, err := Execute(tmpl, msgType, data)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"notification": name,
+			"template":     tmpl.Name,
+		}).Error("Failed to execute template override, using the default message")
+		return fallback
+	}
+	return content
+}
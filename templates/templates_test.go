@@ -0,0 +1,68 @@
+package templates
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+type templateStorage struct {
+	database.NopStorage
+	templates map[string]api.Template
+}
+
+func (s *templateStorage) LoadTemplate(name string) (api.Template, error) {
+	tmpl, ok := s.templates[name]
+	if !ok {
+		return api.Template{}, sql.ErrNoRows
+	}
+	return tmpl, nil
+}
+
+func TestRender(t *testing.T) {
+	database.SetServiceDB(&templateStorage{templates: map[string]api.Template{
+		"github.issues": {
+			Name: "github.issues",
+			Text: "{{.repo}}: {{upper .title}}",
+			HTML: "<b>{{.repo}}</b>: {{.title}}",
+		},
+		"jira": {
+			Name: "jira",
+			Text: "{{.Missing.Field}}",
+		},
+	}})
+	data := map[string]string{"repo": "owner/repo", "title": "<script>"}
+	fallback := mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "default"}
+
+	testCases := []struct {
+		name string
+		want mevt.MessageEventContent
+	}{
+		{"github.issues.closed", mevt.MessageEventContent{
+			MsgType:       mevt.MsgText,
+			Body:          "owner/repo: <SCRIPT>",
+			Format:        mevt.FormatHTML,
+			FormattedBody: "<b>owner/repo</b>: &lt;script&gt;",
+		}},
+		{"github.issues", mevt.MessageEventContent{
+			MsgType:       mevt.MsgText,
+			Body:          "owner/repo: <SCRIPT>",
+			Format:        mevt.FormatHTML,
+			FormattedBody: "<b>owner/repo</b>: &lt;script&gt;",
+		}},
+		// not overridden
+		{"github.push", fallback},
+		// the override fails to execute
+		{"jira.issue_created", fallback},
+	}
+	for _, tc := range testCases {
+		got := Render(tc.name, data, fallback)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Render(%q): want %+v, got %+v", tc.name, tc.want, got)
+		}
+	}
+}
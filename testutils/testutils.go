@@ -1,7 +1,10 @@
 package testutils
 
 import (
+	"database/sql"
 	"net/http"
+
+	"github.com/matrix-org/go-neb/database"
 )
 
 // MockTransport implements RoundTripper
@@ -26,3 +29,37 @@ func NewRoundTripper(roundTrip func(*http.Request) (*http.Response, error)) http
 	rt.RT = roundTrip
 	return rt
 }
+
+// StateStorage is a database.Storer which keeps service state in memory, for testing services
+// which store state. Everything else is a no-op.
+type StateStorage struct {
+	database.NopStorage
+	// State is keyed by the service ID and the state key, separated by a space.
+	State map[string][]byte
+}
+
+// NewStateStorage returns a StateStorage with no state.
+func NewStateStorage() *StateStorage {
+	return &StateStorage{State: make(map[string][]byte)}
+}
+
+// LoadServiceState returns sql.ErrNoRows if the state hasn't been stored, like the database does.
+func (s *StateStorage) LoadServiceState(serviceID, stateKey string) ([]byte, error) {
+	stateJSON, ok := s.State[serviceID+" "+stateKey]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return stateJSON, nil
+}
+
+// StoreServiceState stores the state in memory
+func (s *StateStorage) StoreServiceState(serviceID, stateKey string, stateJSON []byte) error {
+	s.State[serviceID+" "+stateKey] = stateJSON
+	return nil
+}
+
+// DeleteServiceState deletes the state from memory
+func (s *StateStorage) DeleteServiceState(serviceID, stateKey string) error {
+	delete(s.State, serviceID+" "+stateKey)
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"regexp"
 	"strings"
 
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -16,6 +17,9 @@ type Command struct {
 	Arguments []string
 	Help      string
 	Command   func(roomID id.RoomID, userID id.UserID, arguments []string) (content interface{}, err error)
+	// Optional. Called instead of Command for commands which need the message event itself, e.g. to
+	// find out which message it is a reply to.
+	EventCommand func(evt *event.Event, arguments []string) (content interface{}, err error)
 }
 
 // An Expansion is something that actives when the user sends any message
@@ -0,0 +1,27 @@
+package types
+
+import (
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// A QueuedNotification is a notification which is being held back from a room instead of being
+// sent straight away, e.g. so it can be sent later as part of a digest.
+type QueuedNotification struct {
+	// The bot user which will send the notification.
+	UserID id.UserID
+	// The room the notification is for.
+	RoomID id.RoomID
+	// The service which produced the notification.
+	ServiceID string
+	// Why the notification is being held, e.g. "digest".
+	Reason string
+	// How important the notification is, e.g. "critical".
+	Severity string
+	// The message which would have been sent.
+	Content event.MessageEventContent
+	// When the notification was queued. Populated when loading from the database.
+	Queued time.Time `json:"-"`
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"strings"
 	"time"
@@ -28,6 +29,86 @@ type Poller interface {
 	OnPoll(client MatrixClient) time.Time
 }
 
+// MessageObserver represents a thing which sees every message. Services should implement this method
+// signature to be told about all messages in the rooms their service user is in, rather than just
+// commands and expansions, e.g. to bridge them elsewhere.
+type MessageObserver interface {
+	// OnMessage is called with every m.room.message, m.room.redaction and m.reaction event, apart
+	// from those sent by the service user itself.
+	OnMessage(cli MatrixClient, evt *event.Event)
+}
+
+// RecentMessage is a message which was sent into a room recently.
+type RecentMessage struct {
+	EventID id.EventID
+	Sender  id.UserID
+	// The text of the message, as of its latest edit
+	Body string
+}
+
+// RecentMessageLister is implemented by matrix clients which remember the latest messages in each
+// room they are in, which services can type-assert for, e.g. to correct what was said.
+type RecentMessageLister interface {
+	// RecentMessages returns the latest messages in the room, oldest first.
+	RecentMessages(roomID id.RoomID) []RecentMessage
+}
+
+// The interfaces below are implemented by matrix clients which can do more than MatrixClient
+// requires. Services type-assert for the ones they need, and explain in their response if the
+// client can't.
+
+// EventGetter is implemented by matrix clients which can fetch single events, e.g. the message
+// which was replied or reacted to.
+type EventGetter interface {
+	GetEvent(roomID id.RoomID, eventID id.EventID) (*event.Event, error)
+}
+
+// StateGetter is implemented by matrix clients which can read the current state of rooms.
+type StateGetter interface {
+	StateEvent(roomID id.RoomID, eventType event.Type, stateKey string, outContent interface{}) error
+}
+
+// StateSender is implemented by matrix clients which can change the state of rooms, e.g. their
+// topics.
+type StateSender interface {
+	SendStateEvent(roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}) (*mautrix.RespSendEvent, error)
+}
+
+// EventRedacter is implemented by matrix clients which can redact events.
+type EventRedacter interface {
+	RedactEvent(roomID id.RoomID, eventID id.EventID, extra ...mautrix.ReqRedact) (*mautrix.RespSendEvent, error)
+}
+
+// MediaDownloader is implemented by matrix clients which can download mxc:// content.
+type MediaDownloader interface {
+	Download(mxcURL id.ContentURI) (io.ReadCloser, error)
+}
+
+// MediaUploader is implemented by matrix clients which can upload content they already have,
+// rather than content at a URL.
+type MediaUploader interface {
+	UploadBytes(data []byte, contentType string) (*mautrix.RespMediaUpload, error)
+}
+
+// RoomCreator is implemented by matrix clients which can create rooms, including direct messages.
+type RoomCreator interface {
+	CreateRoom(req *mautrix.ReqCreateRoom) (*mautrix.RespCreateRoom, error)
+}
+
+// MemberManager is implemented by matrix clients which can change who is in rooms.
+type MemberManager interface {
+	InviteUser(roomID id.RoomID, req *mautrix.ReqInviteUser) (*mautrix.RespInviteUser, error)
+	KickUser(roomID id.RoomID, req *mautrix.ReqKickUser) (*mautrix.RespKickUser, error)
+	BanUser(roomID id.RoomID, req *mautrix.ReqBanUser) (*mautrix.RespBanUser, error)
+	UnbanUser(roomID id.RoomID, req *mautrix.ReqUnbanUser) (*mautrix.RespUnbanUser, error)
+}
+
+// URLBuilder is implemented by matrix clients which can build URLs on their homeserver, e.g. to
+// link to mxc:// content from outside Matrix.
+type URLBuilder interface {
+	BuildBaseURL(urlPath ...interface{}) string
+}
+
 // MatrixClient represents an object that can communicate with a Matrix server in certain ways that services require.
 type MatrixClient interface {
 	// Join a room by ID or alias. Content can optionally specify the request body.
@@ -40,6 +121,12 @@ type MatrixClient interface {
 }
 
 // A Service is the configuration for a bot service.
+//
+// Services are loaded from the database afresh for every request, message and poll, so anything
+// a service needs to remember between them is either stored as service state (see
+// database.Storer) or kept in package-level variables keyed by service ID. State which more than
+// one of them can update at once, e.g. Commands and OnPoll, must only be loaded and stored while
+// holding a package-level mutex.
 type Service interface {
 	// Return the user ID of this service.
 	ServiceUserID() id.UserID
@@ -47,6 +134,8 @@ type Service interface {
 	ServiceID() string
 	// Return the type of service. This string MUST NOT change.
 	ServiceType() string
+	// Return the room which everything the service sends is redirected into, if any.
+	ServiceCanaryRoomID() id.RoomID
 	Commands(cli MatrixClient) []Command
 	Expansions(cli MatrixClient) []Expansion
 	OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli MatrixClient)
@@ -67,11 +156,21 @@ type DefaultService struct {
 	id            string
 	serviceUserID id.UserID
 	serviceType   string
+	// Optional. A room ID to redirect everything this service sends into, like the CanaryRoomID of
+	// a client but for this service alone. Taken from the "canary_room_id" key of every service's
+	// config.
+	CanaryRoomID id.RoomID `json:"canary_room_id,omitempty"`
 }
 
 // NewDefaultService creates a new service with implementations for ServiceID(), ServiceType() and ServiceUserID()
 func NewDefaultService(serviceID string, serviceUserID id.UserID, serviceType string) DefaultService {
-	return DefaultService{serviceID, serviceUserID, serviceType}
+	return DefaultService{id: serviceID, serviceUserID: serviceUserID, serviceType: serviceType}
+}
+
+// ServiceCanaryRoomID returns the room which everything the service sends is redirected into, or
+// an empty string if the service sends to the intended rooms.
+func (s *DefaultService) ServiceCanaryRoomID() id.RoomID {
+	return s.CanaryRoomID
 }
 
 // ServiceID returns the service's ID. In order for this to return the ID, DefaultService MUST have been
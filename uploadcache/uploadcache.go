@@ -0,0 +1,121 @@
+// Package uploadcache remembers the media which services have uploaded to the homeserver for a
+// search, so that the same search soon afterwards reuses the upload instead of searching and
+// uploading again.
+package uploadcache
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	mevt "maunium.net/go/mautrix/event"
+)
+
+// A Cache stores messages with uploaded media. Implementations must be safe to use from several
+// goroutines.
+type Cache interface {
+	// Get returns the message stored under the key, if it hasn't expired.
+	Get(key string) (mevt.MessageEventContent, bool)
+	// Put stores the message under the key until the TTL has passed.
+	Put(key string, content mevt.MessageEventContent, ttl time.Duration)
+}
+
+// Shared is the cache used by services which opt in to caching. It can be replaced with another
+// implementation, e.g. one backed by a store shared between several instances of NEB.
+var Shared Cache = NewMemoryCache(1000)
+
+// Key returns the cache key of a search: the service ID, the kind of search, which should include
+// anything else which changes the result such as a content rating, and the query ignoring case
+// and spacing.
+func Key(serviceID, kind, query string) string {
+	return serviceID + " " + kind + " " + strings.ToLower(strings.Join(strings.Fields(query), " "))
+}
+
+// Fetch returns the message cached under the key, or calls fetch and caches the message it
+// returns for the TTL. Nothing is cached if the TTL isn't positive, or if the message has no
+// uploaded media, such as a "nothing found" notice.
+func Fetch(key string, ttl time.Duration, fetch func() (mevt.MessageEventContent, error)) (mevt.MessageEventContent, error) {
+	if ttl <= 0 {
+		return fetch()
+	}
+	if content, ok := Shared.Get(key); ok {
+		return content, nil
+	}
+	content, err := fetch()
+	if err != nil {
+		return content, err
+	}
+	if content.URL != "" {
+		Shared.Put(key, content, ttl)
+	}
+	return content, nil
+}
+
+type cachedContent struct {
+	content mevt.MessageEventContent
+	expires time.Time
+}
+
+// MemoryCache is a Cache which keeps messages in memory.
+type MemoryCache struct {
+	maxEntries int
+	now        func() time.Time // overridden by tests
+
+	mu      sync.Mutex
+	entries map[string]cachedContent
+}
+
+// NewMemoryCache makes a MemoryCache which holds up to maxEntries messages. When it is full, the
+// messages closest to expiring are forgotten first.
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		now:        time.Now,
+		entries:    make(map[string]cachedContent),
+	}
+}
+
+// Get returns the message stored under the key, if it hasn't expired.
+func (c *MemoryCache) Get(key string) (mevt.MessageEventContent, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.entries[key]
+	if !ok {
+		return mevt.MessageEventContent{}, false
+	}
+	if c.now().After(cached.expires) {
+		delete(c.entries, key)
+		return mevt.MessageEventContent{}, false
+	}
+	return cached.content, true
+}
+
+// Put stores the message under the key until the TTL has passed.
+func (c *MemoryCache) Put(key string, content mevt.MessageEventContent, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		for k, cached := range c.entries {
+			if now.After(cached.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for len(c.entries) > 0 && len(c.entries) >= c.maxEntries {
+			c.evictSoonest()
+		}
+	}
+	c.entries[key] = cachedContent{content, now.Add(ttl)}
+}
+
+// evictSoonest forgets the message closest to expiring.
+func (c *MemoryCache) evictSoonest() {
+	var soonestKey string
+	var soonest time.Time
+	for k, cached := range c.entries {
+		if soonestKey == "" || cached.expires.Before(soonest) {
+			soonestKey, soonest = k, cached.expires
+		}
+	}
+	delete(c.entries, soonestKey)
+}
@@ -0,0 +1,92 @@
+package uploadcache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestMemoryCache(t *testing.T) {
+	now := time.Date(2021, 6, 4, 12, 0, 0, 0, time.UTC)
+	c := NewMemoryCache(2)
+	c.now = func() time.Time { return now }
+
+	c.Put("a", mevt.MessageEventContent{URL: "mxc://foo/a"}, time.Minute)
+	c.Put("b", mevt.MessageEventContent{URL: "mxc://foo/b"}, 10*time.Minute)
+	if content, ok := c.Get("a"); !ok || content.URL != "mxc://foo/a" {
+		t.Errorf("Expected a to be cached, got %v, %v", content, ok)
+	}
+
+	// Full, so the message closest to expiring makes room
+	c.Put("c", mevt.MessageEventContent{URL: "mxc://foo/c"}, 5*time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Expected a to have been evicted")
+	}
+	if _, ok := c.Get("b"); !ok {
+		t.Errorf("Expected b to still be cached")
+	}
+
+	now = now.Add(6 * time.Minute)
+	if _, ok := c.Get("c"); ok {
+		t.Errorf("Expected c to have expired")
+	}
+	if _, ok := c.Get("b"); !ok {
+		t.Errorf("Expected b to still be cached")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	Shared = NewMemoryCache(10)
+	fetches := 0
+	fetch := func(content mevt.MessageEventContent) func() (mevt.MessageEventContent, error) {
+		return func() (mevt.MessageEventContent, error) {
+			fetches++
+			return content, nil
+		}
+	}
+	img := mevt.MessageEventContent{MsgType: mevt.MsgImage, URL: "mxc://foo/cat"}
+	notice := mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "No image found!"}
+
+	testCases := []struct {
+		key         string
+		ttl         time.Duration
+		content     mevt.MessageEventContent
+		wantFetches int
+	}{
+		{Key("id", "image", "Cat"), time.Minute, img, 1},
+		// Same query, differently written
+		{Key("id", "image", "  cat "), time.Minute, img, 1},
+		{Key("other", "image", "cat"), time.Minute, img, 2},
+		// Not cached without a TTL
+		{Key("id", "gif", "cat"), 0, img, 3},
+		{Key("id", "gif", "cat"), time.Minute, img, 4},
+		// Notices aren't cached
+		{Key("id", "image", "dog"), time.Minute, notice, 5},
+		{Key("id", "image", "dog"), time.Minute, notice, 6},
+	}
+	for _, tc := range testCases {
+		content, err := Fetch(tc.key, tc.ttl, fetch(tc.content))
+		if err != nil {
+			t.Fatalf("Fetch(%q) failed: %s", tc.key, err)
+		}
+		if content.URL != tc.content.URL {
+			t.Errorf("Fetch(%q): got %v, want %v", tc.key, content, tc.content)
+		}
+		if fetches != tc.wantFetches {
+			t.Errorf("Fetch(%q): %d fetches, want %d", tc.key, fetches, tc.wantFetches)
+		}
+	}
+
+	// Errors aren't cached
+	_, err := Fetch(Key("id", "image", "fish"), time.Minute, func() (mevt.MessageEventContent, error) {
+		return mevt.MessageEventContent{}, fmt.Errorf("upload failed")
+	})
+	if err == nil {
+		t.Errorf("Expected the error to be returned")
+	}
+	if _, ok := Shared.Get(Key("id", "image", "fish")); ok {
+		t.Errorf("Expected the failed fetch not to be cached")
+	}
+}